@@ -0,0 +1,259 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// FlushIntervalSink is implemented by push sinks whose flush interval can
+// be changed at runtime.
+type FlushIntervalSink interface {
+	SetFlushInterval(interval time.Duration)
+}
+
+// AdminState is the runtime configuration reported and changed by the
+// admin handler.
+type AdminState struct {
+	AllowedPrefixes []string
+	BlockedPrefixes []string
+	AllowedLabels   []string
+	BlockedLabels   []string
+
+	// SamplerBudget is the budget of the AdaptiveSampler, if configured
+	SamplerBudget int `json:",omitempty"`
+
+	// Sinks are the names of the sinks attached to a DynamicFanoutSink
+	Sinks []string `json:",omitempty"`
+}
+
+// AdminSinkPolicy restricts the sinks the admin handler may attach. The URL
+// of a sink makes the process connect to its host and, for some schemes, read
+// local files named by its query parameters, such as the certificates of
+// statsite+tls, so only the schemes, parameters and hosts listed are
+// accepted:
+//
+//	AdminSinkPolicy{
+//		Schemes: map[string][]string{"inmem": {"interval", "retain"}},
+//	}
+type AdminSinkPolicy struct {
+	// Schemes maps the URL schemes of the sinks which may be attached to the
+	// query parameters allowed with them. No sink can be attached when it
+	// is empty.
+	Schemes map[string][]string
+
+	// Hosts restricts the host, including any port, of sink URLs. Any host
+	// is accepted when it is empty.
+	Hosts []string
+}
+
+// check returns an error if the sink URL is not allowed by the policy.
+func (p AdminSinkPolicy) check(u *url.URL) error {
+	if len(p.Schemes) == 0 {
+		return fmt.Errorf("attaching sinks is disabled")
+	}
+	params, ok := p.Schemes[u.Scheme]
+	if !ok {
+		return fmt.Errorf("sink scheme %q is not allowed", u.Scheme)
+	}
+	for name := range u.Query() {
+		if !slices.Contains(params, name) {
+			return fmt.Errorf("sink parameter %q is not allowed for scheme %q", name, u.Scheme)
+		}
+	}
+	if len(p.Hosts) > 0 && !slices.Contains(p.Hosts, u.Host) {
+		return fmt.Errorf("sink host %q is not allowed", u.Host)
+	}
+	return nil
+}
+
+// adminSinkRequest attaches a sink or changes its flush interval
+type adminSinkRequest struct {
+	URL           string
+	FlushInterval string
+}
+
+// AdminHandler returns an http.Handler which lets operators change the
+// telemetry configuration at runtime, for example to turn up verbosity during
+// an incident without a redeploy. Every request must pass auth, which must
+// require a bearer token or a client certificate, as an IP allowlist alone
+// does not authenticate the caller. The handler serves, relative to where it
+// is mounted:
+//
+//	GET    /state                      the current AdminState
+//	PUT    /filters                    replace the prefix and label filters
+//	PUT    /sampler                    set the adaptive sampler budget
+//	PUT    /sinks/{name}               attach a sink created from a URL
+//	DELETE /sinks/{name}               detach and shut down a sink
+//	PUT    /sinks/{name}/flush_interval change the flush interval of a sink
+//
+// Request bodies are JSON encoded AdminState fields, or objects with URL and
+// FlushInterval for sinks. Sinks can only be attached and detached when the
+// metrics instance was created with a DynamicFanoutSink, and the URL must be
+// allowed by sinks before it is passed to NewMetricSinkFromURL. Every change
+// is logged.
+func (m *Metrics) AdminHandler(auth EndpointAuth, sinks AdminSinkPolicy) (http.Handler, error) {
+	if len(auth.BearerTokens) == 0 && !auth.RequireClientCert && len(auth.ClientCertNames) == 0 {
+		return nil, fmt.Errorf("admin handler requires a bearer token or a client certificate")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /state", func(resp http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(resp, m.adminState())
+	})
+	mux.HandleFunc("PUT /filters", func(resp http.ResponseWriter, req *http.Request) {
+		var state AdminState
+		if !readAdminJSON(resp, req, &state) {
+			return
+		}
+		m.UpdateFilterAndLabels(state.AllowedPrefixes, state.BlockedPrefixes, state.AllowedLabels, state.BlockedLabels)
+		log.Printf("[INFO] metrics: admin updated filters, allowed prefixes %v, blocked prefixes %v, allowed labels %v, blocked labels %v",
+			state.AllowedPrefixes, state.BlockedPrefixes, state.AllowedLabels, state.BlockedLabels)
+		writeAdminJSON(resp, m.adminState())
+	})
+	mux.HandleFunc("PUT /sampler", func(resp http.ResponseWriter, req *http.Request) {
+		if m.AdaptiveSampler == nil {
+			http.Error(resp, "no adaptive sampler is configured", http.StatusNotImplemented)
+			return
+		}
+		var state AdminState
+		if !readAdminJSON(resp, req, &state) {
+			return
+		}
+		m.AdaptiveSampler.SetBudget(state.SamplerBudget)
+		log.Printf("[INFO] metrics: admin set the sampler budget to %d", state.SamplerBudget)
+		writeAdminJSON(resp, m.adminState())
+	})
+	mux.HandleFunc("PUT /sinks/{name}", func(resp http.ResponseWriter, req *http.Request) {
+		dyn, ok := m.dynamicSink(resp)
+		if !ok {
+			return
+		}
+		var sr adminSinkRequest
+		if !readAdminJSON(resp, req, &sr) {
+			return
+		}
+		u, err := url.Parse(sr.URL)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sinks.check(u); err != nil {
+			http.Error(resp, err.Error(), http.StatusForbidden)
+			return
+		}
+		sink, err := NewMetricSinkFromURL(sr.URL)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := req.PathValue("name")
+		if old := dyn.Attach(name, sink); old != nil {
+			if ss, ok := old.(ShutdownSink); ok {
+				ss.Shutdown()
+			}
+		}
+		log.Printf("[INFO] metrics: admin attached sink %q", name)
+		writeAdminJSON(resp, m.adminState())
+	})
+	mux.HandleFunc("DELETE /sinks/{name}", func(resp http.ResponseWriter, req *http.Request) {
+		dyn, ok := m.dynamicSink(resp)
+		if !ok {
+			return
+		}
+		name := req.PathValue("name")
+		old := dyn.Detach(name)
+		if old == nil {
+			http.Error(resp, "unknown sink", http.StatusNotFound)
+			return
+		}
+		if ss, ok := old.(ShutdownSink); ok {
+			ss.Shutdown()
+		}
+		log.Printf("[INFO] metrics: admin detached sink %q", name)
+		writeAdminJSON(resp, m.adminState())
+	})
+	mux.HandleFunc("PUT /sinks/{name}/flush_interval", func(resp http.ResponseWriter, req *http.Request) {
+		dyn, ok := m.dynamicSink(resp)
+		if !ok {
+			return
+		}
+		var sr adminSinkRequest
+		if !readAdminJSON(resp, req, &sr) {
+			return
+		}
+		interval, err := time.ParseDuration(sr.FlushInterval)
+		if err != nil || interval <= 0 {
+			http.Error(resp, "bad flush interval", http.StatusBadRequest)
+			return
+		}
+		name := req.PathValue("name")
+		sink := dyn.Sink(name)
+		if sink == nil {
+			http.Error(resp, "unknown sink", http.StatusNotFound)
+			return
+		}
+		fs, ok := sink.(FlushIntervalSink)
+		if !ok {
+			http.Error(resp, "sink does not support changing its flush interval", http.StatusNotImplemented)
+			return
+		}
+		fs.SetFlushInterval(interval)
+		log.Printf("[INFO] metrics: admin set the flush interval of sink %q to %s", name, interval)
+		writeAdminJSON(resp, m.adminState())
+	})
+
+	return auth.Wrap(mux)
+}
+
+// adminState returns the current runtime configuration.
+func (m *Metrics) adminState() AdminState {
+	m.filterLock.RLock()
+	state := AdminState{
+		AllowedPrefixes: m.AllowedPrefixes,
+		BlockedPrefixes: m.BlockedPrefixes,
+		AllowedLabels:   m.AllowedLabels,
+		BlockedLabels:   m.BlockedLabels,
+	}
+	m.filterLock.RUnlock()
+
+	if m.AdaptiveSampler != nil {
+		state.SamplerBudget = m.AdaptiveSampler.Budget()
+	}
+	if dyn, ok := m.sink.(*DynamicFanoutSink); ok {
+		state.Sinks = dyn.Names()
+	}
+	return state
+}
+
+// dynamicSink returns the DynamicFanoutSink of the metrics instance, or
+// responds with an error if it has none.
+func (m *Metrics) dynamicSink(resp http.ResponseWriter) (*DynamicFanoutSink, bool) {
+	dyn, ok := m.sink.(*DynamicFanoutSink)
+	if !ok {
+		http.Error(resp, "sinks can only be changed with a DynamicFanoutSink", http.StatusNotImplemented)
+	}
+	return dyn, ok
+}
+
+func readAdminJSON(resp http.ResponseWriter, req *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(resp, req.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(resp, fmt.Sprintf("bad request body: %s", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeAdminJSON(resp http.ResponseWriter, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(resp).Encode(v)
+}
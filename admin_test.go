@@ -0,0 +1,181 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// intervalSink records flush interval changes
+type intervalSink struct {
+	MockSink
+	interval time.Duration
+}
+
+func (i *intervalSink) SetFlushInterval(interval time.Duration) {
+	i.interval = interval
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) (int, AdminState) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var state AdminState
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&state); err != nil {
+			t.Fatalf("bad response: %s", err)
+		}
+	}
+	return rec.Code, state
+}
+
+func TestMetrics_AdminHandler(t *testing.T) {
+	base := &intervalSink{}
+	dyn := NewDynamicFanoutSink(map[string]MetricSink{"base": base})
+	conf := DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	conf.AdaptiveSampler = NewAdaptiveSampler(10, time.Minute)
+	met, err := New(conf, dyn)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if _, err := met.AdminHandler(EndpointAuth{}, AdminSinkPolicy{}); err == nil {
+		t.Fatalf("expected an empty auth to be rejected")
+	}
+	if _, err := met.AdminHandler(EndpointAuth{AllowedNetworks: []string{"127.0.0.1"}}, AdminSinkPolicy{}); err == nil {
+		t.Fatalf("expected an IP allowlist alone to be rejected")
+	}
+	h, err := met.AdminHandler(EndpointAuth{BearerTokens: []string{"secret"}}, AdminSinkPolicy{
+		Schemes: map[string][]string{"inmem": {"interval", "retain"}, "statsd": nil},
+		Hosts:   []string{"", "statsd:8125"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Unauthenticated requests are rejected
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/state", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+
+	code, state := adminRequest(t, h, "GET", "/state", "")
+	if code != http.StatusOK || state.SamplerBudget != 10 || !reflect.DeepEqual(state.Sinks, []string{"base"}) {
+		t.Fatalf("bad state: %d %+v", code, state)
+	}
+
+	code, state = adminRequest(t, h, "PUT", "/filters", `{"BlockedPrefixes":["noisy"]}`)
+	if code != http.StatusOK || !reflect.DeepEqual(state.BlockedPrefixes, []string{"noisy"}) {
+		t.Fatalf("bad filters: %d %+v", code, state)
+	}
+	met.IncrCounter([]string{"noisy", "key"}, 1)
+	if len(base.getKeys()) != 0 {
+		t.Fatalf("blocked prefix should be filtered")
+	}
+
+	code, state = adminRequest(t, h, "PUT", "/sampler", `{"SamplerBudget":1000}`)
+	if code != http.StatusOK || state.SamplerBudget != 1000 {
+		t.Fatalf("bad sampler: %d %+v", code, state)
+	}
+
+	code, state = adminRequest(t, h, "PUT", "/sinks/debug", `{"URL":"inmem://?interval=10s&retain=1m"}`)
+	if code != http.StatusOK || !reflect.DeepEqual(state.Sinks, []string{"base", "debug"}) {
+		t.Fatalf("bad attach: %d %+v", code, state)
+	}
+	if _, ok := dyn.Sink("debug").(*InmemSink); !ok {
+		t.Fatalf("expected an inmem sink")
+	}
+	for _, u := range []string{
+		"statsite+tls://statsd:8125?ca_file=/etc/shadow",
+		"inmem://?interval=10s&retain=1m&other=1",
+		"statsd://attacker:8125",
+	} {
+		if code, _ := adminRequest(t, h, "PUT", "/sinks/bad", `{"URL":"`+u+`"}`); code != http.StatusForbidden {
+			t.Fatalf("expected %s to be forbidden, got %d", u, code)
+		}
+	}
+	disabled, err := met.AdminHandler(EndpointAuth{BearerTokens: []string{"secret"}}, AdminSinkPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if code, _ := adminRequest(t, disabled, "PUT", "/sinks/debug", `{"URL":"inmem://"}`); code != http.StatusForbidden {
+		t.Fatalf("expected attaching to be disabled, got %d", code)
+	}
+
+	code, _ = adminRequest(t, h, "PUT", "/sinks/base/flush_interval", `{"FlushInterval":"5s"}`)
+	if code != http.StatusOK || base.interval != 5*time.Second {
+		t.Fatalf("bad flush interval: %d %s", code, base.interval)
+	}
+	if code, _ := adminRequest(t, h, "PUT", "/sinks/debug/flush_interval", `{"FlushInterval":"5s"}`); code != http.StatusNotImplemented {
+		t.Fatalf("expected unsupported sinks to fail, got %d", code)
+	}
+
+	code, state = adminRequest(t, h, "DELETE", "/sinks/base", "")
+	if code != http.StatusOK || !reflect.DeepEqual(state.Sinks, []string{"debug"}) || !base.shutdown {
+		t.Fatalf("bad detach: %d %+v", code, state)
+	}
+	if code, _ := adminRequest(t, h, "DELETE", "/sinks/base", ""); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+
+	if code, _ := adminRequest(t, h, "PUT", "/filters", `{"Unknown":1}`); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown fields to fail, got %d", code)
+	}
+}
+
+func TestMetrics_AdminHandler_StaticSink(t *testing.T) {
+	_, met := mockMetric()
+	h, err := met.AdminHandler(EndpointAuth{BearerTokens: []string{"secret"}}, AdminSinkPolicy{})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if code, _ := adminRequest(t, h, "DELETE", "/sinks/any", ""); code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", code)
+	}
+	if code, _ := adminRequest(t, h, "PUT", "/sampler", `{"SamplerBudget":5}`); code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", code)
+	}
+}
+
+func TestFlushLoop_SetInterval(t *testing.T) {
+	flushed := make(chan struct{}, 10)
+	l := startFlushLoop(time.Hour, func(now time.Time, final bool) {
+		flushed <- struct{}{}
+	})
+	l.setInterval(time.Millisecond)
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected a flush at the new interval")
+	}
+	l.stop()
+	// Changing a stopped loop must not block
+	l.setInterval(time.Second)
+}
+
+func TestFlushLoop_RetryDeadline(t *testing.T) {
+	l := startFlushLoop(time.Hour, func(now time.Time, final bool) {})
+	defer l.stop()
+
+	now := time.Now()
+	if got := l.retryDeadline(now); !got.Equal(now.Add(time.Hour)) {
+		t.Fatalf("bad deadline %s", got)
+	}
+	l.setInterval(time.Minute)
+	if got := l.retryDeadline(now); !got.Equal(now.Add(time.Minute)) {
+		t.Fatalf("retries are not bounded by the new interval: %s", got)
+	}
+}
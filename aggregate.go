@@ -0,0 +1,117 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// aggregateKind is the type of metric an aggregate was recorded as
+type aggregateKind int
+
+const (
+	aggregateGauge aggregateKind = iota
+	aggregateCounter
+	aggregateSample
+	aggregateKV
+)
+
+// aggregate is the rolled up value of one series over a flush interval
+type aggregate struct {
+	kind   aggregateKind
+	key    []string
+	labels []Label
+	last   float64
+	sum    float64
+	count  int
+	min    float64
+	max    float64
+}
+
+func (a *aggregate) mean() float64 {
+	if a.count == 0 {
+		return 0
+	}
+	return a.sum / float64(a.count)
+}
+
+// intervalAggregator rolls up metrics between flushes for push based sinks
+// which submit one value per series and interval, rather than every call.
+type intervalAggregator struct {
+	lock   sync.Mutex
+	series map[string]*aggregate
+}
+
+func newIntervalAggregator() *intervalAggregator {
+	return &intervalAggregator{series: make(map[string]*aggregate)}
+}
+
+func (a *intervalAggregator) record(kind aggregateKind, key []string, val float64, labels []Label) {
+	id := seriesKey(key, labels)
+	switch kind {
+	case aggregateGauge:
+		id = "g|" + id
+	case aggregateCounter:
+		id = "c|" + id
+	case aggregateSample:
+		id = "s|" + id
+	case aggregateKV:
+		id = "k|" + id
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	agg, ok := a.series[id]
+	if !ok {
+		// Copy the labels, as callers are free to reuse the slice
+		agg = &aggregate{
+			kind:   kind,
+			key:    key,
+			labels: append([]Label(nil), labels...),
+			min:    val,
+			max:    val,
+		}
+		a.series[id] = agg
+	}
+	agg.last = val
+	agg.sum += val
+	agg.count++
+	if val < agg.min {
+		agg.min = val
+	}
+	if val > agg.max {
+		agg.max = val
+	}
+}
+
+// restore records restored counter totals, which sinks keeping cumulative
+// series add to their running totals on the next flush.
+func (a *intervalAggregator) restore(counters []RestoredCounter) {
+	for _, c := range counters {
+		a.record(aggregateCounter, c.Key, c.Total, c.Labels)
+	}
+}
+
+// drain returns everything aggregated since the last drain, in a stable
+// order, and starts a new interval.
+func (a *intervalAggregator) drain() []*aggregate {
+	a.lock.Lock()
+	series := a.series
+	a.series = make(map[string]*aggregate)
+	a.lock.Unlock()
+
+	ids := make([]string, 0, len(series))
+	for id := range series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	out := make([]*aggregate, len(ids))
+	for i, id := range ids {
+		out[i] = series[id]
+	}
+	return out
+}
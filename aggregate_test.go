@@ -0,0 +1,38 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+)
+
+func TestIntervalAggregator(t *testing.T) {
+	a := newIntervalAggregator()
+	labels := []Label{{"a", "b"}}
+	a.record(aggregateCounter, []string{"c"}, 1, labels)
+	a.record(aggregateCounter, []string{"c"}, 2, labels)
+	a.record(aggregateGauge, []string{"c"}, 7, labels)
+	a.record(aggregateSample, []string{"s"}, 4, nil)
+	a.record(aggregateSample, []string{"s"}, 2, nil)
+	labels[0].Value = "changed"
+
+	out := a.drain()
+	if len(out) != 3 {
+		t.Fatalf("bad series: %v", out)
+	}
+	// Sorted by kind then series
+	if out[0].kind != aggregateCounter || out[0].sum != 3 || out[0].labels[0].Value != "b" {
+		t.Fatalf("bad counter: %+v", out[0])
+	}
+	if out[1].kind != aggregateGauge || out[1].last != 7 {
+		t.Fatalf("bad gauge: %+v", out[1])
+	}
+	if s := out[2]; s.count != 2 || s.min != 2 || s.max != 4 || s.mean() != 3 {
+		t.Fatalf("bad sample: %+v", s)
+	}
+
+	if len(a.drain()) != 0 {
+		t.Fatalf("drain should start a new interval")
+	}
+}
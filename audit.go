@@ -0,0 +1,131 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a single emission, as kept by the audit log.
+type AuditEntry struct {
+	Time   time.Time
+	Type   string
+	Key    string
+	Labels []Label `json:",omitempty"`
+
+	// Value is the emitted value, timers are recorded in milliseconds
+	Value float64
+
+	// Caller is the file:line which made the emission, if
+	// Config.AuditCaller is set
+	Caller string `json:",omitempty"`
+}
+
+// auditLog is a fixed size ring buffer of recent emissions
+type auditLog struct {
+	lock    sync.Mutex
+	entries []AuditEntry
+	next    int
+	full    bool
+	caller  bool
+}
+
+func newAuditLog(size int, caller bool) *auditLog {
+	return &auditLog{entries: make([]AuditEntry, size), caller: caller}
+}
+
+func (a *auditLog) record(typ string, key []string, val float64, labels []Label) {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Type:   typ,
+		Key:    strings.Join(key, "."),
+		Labels: append([]Label(nil), labels...),
+		Value:  val,
+	}
+	if a.caller {
+		entry.Caller = auditCaller()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.entries[a.next] = entry
+	a.next++
+	if a.next == len(a.entries) {
+		a.next = 0
+		a.full = true
+	}
+}
+
+// snapshot returns the recorded entries, oldest first.
+func (a *auditLog) snapshot() []AuditEntry {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.full {
+		return append([]AuditEntry(nil), a.entries[:a.next]...)
+	}
+	out := make([]AuditEntry, 0, len(a.entries))
+	out = append(out, a.entries[a.next:]...)
+	return append(out, a.entries[:a.next]...)
+}
+
+// auditCaller returns the file:line of the first caller outside this
+// package, skipping the global proxies and internal helpers.
+func auditCaller() string {
+	var pcs [16]uintptr
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		internal := strings.HasPrefix(frame.Function, "github.com/hashicorp/go-metrics.") &&
+			!strings.HasSuffix(frame.File, "_test.go")
+		if !internal {
+			return frame.File + ":" + strconv.Itoa(frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// AuditLog returns the most recent emissions, oldest first. It requires
+// Config.AuditLogSize, otherwise nil is returned.
+func (m *Metrics) AuditLog() []AuditEntry {
+	if m.audit == nil {
+		return nil
+	}
+	return m.audit.snapshot()
+}
+
+// AuditHandler returns an http.Handler serving the audit log as JSON, for
+// mounting on an admin endpoint. The optional "key" query parameter limits
+// the output to keys with the given prefix, which helps answer what code
+// emits a given metric in a running binary.
+func (m *Metrics) AuditHandler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		entries := m.AuditLog()
+		if prefix := req.URL.Query().Get("key"); prefix != "" {
+			filtered := entries[:0]
+			for _, e := range entries {
+				if strings.HasPrefix(e.Key, prefix) {
+					filtered = append(filtered, e)
+				}
+			}
+			entries = filtered
+		}
+		if entries == nil {
+			entries = []AuditEntry{}
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(resp).Encode(entries)
+	})
+}
@@ -0,0 +1,62 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_AuditLog(t *testing.T) {
+	conf := DefaultConfig("")
+	conf.EnableRuntimeMetrics = false
+	conf.AuditLogSize = 2
+	conf.AuditCaller = true
+	met, err := New(conf, &BlackholeSink{})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	met.SetGauge([]string{"a"}, 1)
+	met.IncrCounterWithLabels([]string{"b"}, 2, []Label{{"x", "y"}})
+	met.AddSample([]string{"c"}, 3)
+
+	// The oldest entry has been overwritten
+	entries := met.AuditLog()
+	if len(entries) != 2 || entries[0].Key != "b" || entries[1].Key != "c" {
+		t.Fatalf("bad entries: %+v", entries)
+	}
+	if entries[0].Type != "counter" || entries[0].Value != 2 || entries[0].Labels[0] != (Label{"x", "y"}) {
+		t.Fatalf("bad entry: %+v", entries[0])
+	}
+	if !strings.Contains(entries[1].Caller, "audit_test.go:") {
+		t.Fatalf("bad caller: %q", entries[1].Caller)
+	}
+
+	resp := httptest.NewRecorder()
+	met.AuditHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/?key=c", nil))
+	var served []AuditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&served); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(served) != 1 || served[0].Key != "c" {
+		t.Fatalf("bad response: %+v", served)
+	}
+}
+
+func TestMetrics_AuditLogDisabled(t *testing.T) {
+	_, met := mockMetric()
+	met.SetGauge([]string{"a"}, 1)
+	if met.AuditLog() != nil {
+		t.Fatalf("expected no audit log")
+	}
+
+	resp := httptest.NewRecorder()
+	met.AuditHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	if strings.TrimSpace(resp.Body.String()) != "[]" {
+		t.Fatalf("bad response: %s", resp.Body)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// awsIMDSEndpoint is the EC2 instance metadata service
+	awsIMDSEndpoint = "http://169.254.169.254"
+
+	// awsECSEndpoint serves the credentials of ECS task roles at the
+	// relative URI of AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+	awsECSEndpoint = "http://169.254.170.2"
+
+	// awsCredentialsRefresh is how long before they expire temporary
+	// credentials are refreshed, so they never expire in flight
+	awsCredentialsRefresh = 5 * time.Minute
+)
+
+// awsCredentialSource returns the credentials used to sign AWS requests.
+// Static credentials are returned as is, while temporary credentials of a
+// web identity, an ECS task role or an EC2 instance profile are fetched and
+// cached until shortly before they expire.
+type awsCredentialSource struct {
+	// fetch returns temporary credentials, it is nil for static ones
+	fetch func(ctx context.Context) (awsCredentials, time.Time, error)
+
+	lock    sync.Mutex
+	cached  awsCredentials
+	expires time.Time
+}
+
+// awsTemporaryCredentials are temporary credentials as returned by STS,
+// which names the token SessionToken, and the metadata endpoints
+type awsTemporaryCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId" xml:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey" xml:"SecretAccessKey"`
+	Token           string    `json:"Token" xml:"SessionToken"`
+	Expiration      time.Time `json:"Expiration" xml:"Expiration"`
+}
+
+// newAWSCredentialSource returns the first credentials found, like the AWS
+// SDKs: the static credentials if set, the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, the web
+// identity of AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN as set for IAM
+// roles for service accounts on EKS, the task role of an ECS container, and
+// finally the EC2 instance profile unless AWS_EC2_METADATA_DISABLED is set.
+func newAWSCredentialSource(client *http.Client, static awsCredentials, region string) (*awsCredentialSource, error) {
+	if static.accessKeyID == "" && static.secretAccessKey == "" {
+		static.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		static.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		static.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if static.accessKeyID != "" || static.secretAccessKey != "" {
+		if static.accessKeyID == "" || static.secretAccessKey == "" {
+			return nil, fmt.Errorf("AWS access key ID and secret access key are required")
+		}
+		return &awsCredentialSource{cached: static}, nil
+	}
+
+	var fetch func(ctx context.Context) (awsCredentials, time.Time, error)
+	switch {
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		fetch = awsWebIdentityFetcher(client, region)
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		fetch = awsContainerFetcher(client)
+	case !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true"):
+		fetch = awsIMDSFetcher(client)
+	default:
+		return nil, fmt.Errorf("AWS credentials are required")
+	}
+	return &awsCredentialSource{fetch: fetch}, nil
+}
+
+// credentials returns the current credentials, fetching new temporary
+// credentials if needed.
+func (a *awsCredentialSource) credentials(ctx context.Context) (awsCredentials, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.fetch == nil || a.cached.accessKeyID != "" && time.Now().Before(a.expires) {
+		return a.cached, nil
+	}
+
+	creds, expiration, err := a.fetch(ctx)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("fetching AWS credentials: %w", err)
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("fetching AWS credentials: no access key in response")
+	}
+	a.cached = creds
+	a.expires = expiration.Add(-awsCredentialsRefresh)
+	return a.cached, nil
+}
+
+// awsWebIdentityFetcher assumes AWS_ROLE_ARN with the token of
+// AWS_WEB_IDENTITY_TOKEN_FILE, which is read again on every refresh as it is
+// rotated. The STS endpoint can be overridden with AWS_ENDPOINT_URL_STS.
+func awsWebIdentityFetcher(client *http.Client, region string) func(ctx context.Context) (awsCredentials, time.Time, error) {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	switch {
+	case endpoint != "":
+	case region != "":
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	default:
+		endpoint = "https://sts.amazonaws.com/"
+	}
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "go-metrics"
+	}
+
+	return func(ctx context.Context) (awsCredentials, time.Time, error) {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		form := url.Values{
+			"Action":           {"AssumeRoleWithWebIdentity"},
+			"Version":          {"2011-06-15"},
+			"RoleArn":          {roleARN},
+			"RoleSessionName":  {sessionName},
+			"WebIdentityToken": {strings.TrimSpace(string(token))},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		var body struct {
+			Credentials awsTemporaryCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+		}
+		if err := awsCredentialsRequest(client, req, func(resp *http.Response) error {
+			return xml.NewDecoder(resp.Body).Decode(&body)
+		}); err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		return body.Credentials.credentials(), body.Credentials.Expiration, nil
+	}
+}
+
+// awsContainerFetcher fetches the credentials of an ECS task role, or of an
+// EKS pod identity, which authenticates with the token of
+// AWS_CONTAINER_AUTHORIZATION_TOKEN or AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE.
+func awsContainerFetcher(client *http.Client) func(ctx context.Context) (awsCredentials, time.Time, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = awsECSEndpoint + uri
+	}
+	tokenFile, token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"), os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+
+	return func(ctx context.Context) (awsCredentials, time.Time, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		auth := token
+		if tokenFile != "" {
+			b, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return awsCredentials{}, time.Time{}, err
+			}
+			auth = strings.TrimSpace(string(b))
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return awsJSONCredentials(client, req)
+	}
+}
+
+// awsIMDSFetcher fetches the credentials of the EC2 instance profile with
+// IMDSv2. The endpoint can be overridden with
+// AWS_EC2_METADATA_SERVICE_ENDPOINT.
+func awsIMDSFetcher(client *http.Client) func(ctx context.Context) (awsCredentials, time.Time, error) {
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = awsIMDSEndpoint
+	}
+
+	return func(ctx context.Context) (awsCredentials, time.Time, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/latest/api/token", nil)
+		if err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		var token string
+		if err := awsCredentialsRequest(client, req, func(resp *http.Response) error {
+			return awsReadFirstLine(resp, &token)
+		}); err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+
+		rolesURL := endpoint + "/latest/meta-data/iam/security-credentials/"
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, rolesURL, nil); err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		var role string
+		if err := awsCredentialsRequest(client, req, func(resp *http.Response) error {
+			return awsReadFirstLine(resp, &role)
+		}); err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		if role == "" {
+			return awsCredentials{}, time.Time{}, fmt.Errorf("no instance profile is attached")
+		}
+
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, rolesURL+url.PathEscape(role), nil); err != nil {
+			return awsCredentials{}, time.Time{}, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		return awsJSONCredentials(client, req)
+	}
+}
+
+// awsJSONCredentials requests temporary credentials encoded as JSON, as
+// served by the metadata endpoints.
+func awsJSONCredentials(client *http.Client, req *http.Request) (awsCredentials, time.Time, error) {
+	var body awsTemporaryCredentials
+	if err := awsCredentialsRequest(client, req, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&body)
+	}); err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	return body.credentials(), body.Expiration, nil
+}
+
+// awsCredentialsRequest sends a request and decodes a successful response.
+func awsCredentialsRequest(client *http.Client, req *http.Request, decode func(*http.Response) error) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := CheckHTTPResponse(resp); err != nil {
+		return err
+	}
+	return decode(resp)
+}
+
+func awsReadFirstLine(resp *http.Response, line *string) error {
+	s := bufio.NewScanner(resp.Body)
+	s.Scan()
+	*line = strings.TrimSpace(s.Text())
+	return s.Err()
+}
+
+func (c awsTemporaryCredentials) credentials() awsCredentials {
+	return awsCredentials{accessKeyID: c.AccessKeyID, secretAccessKey: c.SecretAccessKey, sessionToken: c.Token}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clearAWSCredentialsEnv unsets the variables selecting a credentials
+// provider, so tests do not depend on the environment they run in.
+func clearAWSCredentialsEnv(t *testing.T) {
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME", "AWS_ENDPOINT_URL_STS",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+		"AWS_EC2_METADATA_DISABLED", "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestAWSCredentialSource_Static(t *testing.T) {
+	clearAWSCredentialsEnv(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+
+	src, err := newAWSCredentialSource(http.DefaultClient, awsCredentials{}, "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	c, err := src.credentials(context.Background())
+	if err != nil || c.accessKeyID != "id" || c.secretAccessKey != "secret" || c.sessionToken != "token" {
+		t.Fatalf("bad credentials: %v %v", c, err)
+	}
+
+	src, err = newAWSCredentialSource(http.DefaultClient, awsCredentials{accessKeyID: "static", secretAccessKey: "key"}, "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if c, _ := src.credentials(context.Background()); c.accessKeyID != "static" || c.sessionToken != "" {
+		t.Fatalf("static credentials should win: %v", c)
+	}
+
+	if _, err := newAWSCredentialSource(http.DefaultClient, awsCredentials{accessKeyID: "static"}, "us-east-1"); err == nil {
+		t.Fatalf("expected a missing secret access key to fail")
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	if _, err := newAWSCredentialSource(http.DefaultClient, awsCredentials{}, "us-east-1"); err == nil {
+		t.Fatalf("expected missing credentials to fail")
+	}
+}
+
+func TestAWSCredentialSource_WebIdentity(t *testing.T) {
+	clearAWSCredentialsEnv(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt1\n"), 0o600); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	var tokens []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Method != http.MethodPost ||
+			r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("RoleArn") != "arn:aws:iam::123:role/metrics" ||
+			r.Form.Get("RoleSessionName") != "go-metrics" {
+			t.Errorf("bad request: %s %v", r.Method, r.Form)
+		}
+		tokens = append(tokens, r.Form.Get("WebIdentityToken"))
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIA%d</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, len(tokens), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123:role/metrics")
+	t.Setenv("AWS_ENDPOINT_URL_STS", srv.URL)
+
+	src, err := newAWSCredentialSource(srv.Client(), awsCredentials{}, "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	c, err := src.credentials(context.Background())
+	if err != nil || c.accessKeyID != "ASIA1" || c.secretAccessKey != "secret" || c.sessionToken != "session" {
+		t.Fatalf("bad credentials: %v %v", c, err)
+	}
+	if c, _ := src.credentials(context.Background()); c.accessKeyID != "ASIA1" || len(tokens) != 1 {
+		t.Fatalf("credentials should be cached: %v %v", c, tokens)
+	}
+
+	// The rotated token is read again once the credentials are about to
+	// expire
+	if err := os.WriteFile(tokenFile, []byte("jwt2"), 0o600); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	src.expires = time.Now().Add(-time.Second)
+	if c, _ := src.credentials(context.Background()); c.accessKeyID != "ASIA2" || tokens[1] != "jwt2" {
+		t.Fatalf("credentials should be refreshed: %v %v", c, tokens)
+	}
+}
+
+func TestAWSCredentialSource_Container(t *testing.T) {
+	clearAWSCredentialsEnv(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/creds" || r.Header.Get("Authorization") != "auth" {
+			t.Errorf("bad request: %s %v", r.URL.Path, r.Header)
+		}
+		fmt.Fprintf(w, `{"AccessKeyId":"ASIAECS","SecretAccessKey":"secret","Token":"session","Expiration":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/creds")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "auth")
+
+	src, err := newAWSCredentialSource(srv.Client(), awsCredentials{}, "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	c, err := src.credentials(context.Background())
+	if err != nil || c.accessKeyID != "ASIAECS" || c.sessionToken != "session" {
+		t.Fatalf("bad credentials: %v %v", c, err)
+	}
+}
+
+func TestAWSCredentialSource_IMDS(t *testing.T) {
+	clearAWSCredentialsEnv(t)
+	var fetches int
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			if r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+				t.Errorf("missing token ttl")
+			}
+			fmt.Fprint(w, "imds-token")
+		case r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case fail:
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "metrics-role\n")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/metrics-role":
+			fetches++
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"ASIA%d","SecretAccessKey":"secret","Token":"session","Expiration":%q}`,
+				fetches, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL+"/")
+
+	src, err := newAWSCredentialSource(srv.Client(), awsCredentials{}, "us-east-1")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	c, err := src.credentials(context.Background())
+	if err != nil || c.accessKeyID != "ASIA1" || c.sessionToken != "session" {
+		t.Fatalf("bad credentials: %v %v", c, err)
+	}
+
+	src.expires = time.Now().Add(-time.Second)
+	if c, _ := src.credentials(context.Background()); c.accessKeyID != "ASIA2" {
+		t.Fatalf("credentials should be refreshed: %v", c)
+	}
+
+	src.expires = time.Now().Add(-time.Second)
+	fail = true
+	if _, err := src.credentials(context.Background()); err == nil {
+		t.Fatalf("expected a failed refresh to fail")
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// azureMonitorFlushInterval is used when AzureMonitorOpts.FlushInterval
+	// is not set, matching the one minute granularity of custom metrics
+	azureMonitorFlushInterval = time.Minute
+
+	// azureMonitorNamespace is used when AzureMonitorOpts.Namespace is not
+	// set
+	azureMonitorNamespace = "go-metrics"
+
+	// azureMonitorMaxDimensions is the number of dimensions Azure Monitor
+	// accepts per custom metric
+	azureMonitorMaxDimensions = 10
+)
+
+// AzureMonitorOpts is used to configure an AzureMonitorSink. Requests are
+// authenticated as the service principal given by TenantID, ClientID and
+// ClientSecret, or otherwise as the managed identity of the host, selected
+// by ClientID for user assigned identities.
+type AzureMonitorOpts struct {
+	// Region and ResourceID identify the Azure resource the metrics are
+	// published for, such as the AKS cluster. Both are required.
+	Region     string
+	ResourceID string
+
+	// Namespace groups the metrics in Azure Monitor, it defaults to
+	// "go-metrics"
+	Namespace string
+
+	// TenantID, ClientID and ClientSecret configure authentication
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+
+	// FlushInterval is how often metrics are published, it defaults to a
+	// minute
+	FlushInterval time.Duration
+
+	// Endpoint overrides the regional Azure Monitor address
+	Endpoint string
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// RetryPolicy applies to failed requests, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// AzureMonitorSink provides a MetricSink that publishes to the Azure Monitor
+// custom metrics REST API. Metrics are aggregated in memory and published on
+// every flush interval, with one request per metric holding all of its
+// dimension combinations.
+//
+// The key, joined with '.', becomes the metric name and labels become
+// dimensions. Every value is published as min, max, sum and count: gauges
+// and key/value pairs as their last value, counters as their sum, and
+// samples with their actual statistics.
+type AzureMonitorSink struct {
+	url       string
+	namespace string
+	token     func(ctx context.Context) (string, error)
+	client    *http.Client
+	retry     RetryPolicy
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewAzureMonitorSink creates an AzureMonitorSink and starts its flush loop.
+func NewAzureMonitorSink(opts AzureMonitorOpts) (*AzureMonitorSink, error) {
+	if opts.ResourceID == "" {
+		return nil, fmt.Errorf("azure monitor resource ID is required")
+	}
+	endpoint := strings.TrimSuffix(opts.Endpoint, "/")
+	if endpoint == "" {
+		if opts.Region == "" {
+			return nil, fmt.Errorf("azure monitor region is required")
+		}
+		endpoint = "https://" + opts.Region + ".monitoring.azure.com"
+	}
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = azureMonitorNamespace
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = azureMonitorFlushInterval
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	var tokens *azureTokenSource
+	if opts.ClientSecret != "" {
+		if opts.TenantID == "" || opts.ClientID == "" {
+			return nil, fmt.Errorf("azure monitor service principal requires a tenant and client ID")
+		}
+		tokens = newAzureSPTokenSource(client, "", opts.TenantID, opts.ClientID, opts.ClientSecret)
+	} else {
+		tokens = newAzureMSITokenSource(client, "", opts.ClientID)
+	}
+
+	s := &AzureMonitorSink{
+		url:       endpoint + "/" + strings.TrimPrefix(opts.ResourceID, "/") + "/metrics",
+		namespace: namespace,
+		token:     tokens.token,
+		client:    client,
+		retry:     retry,
+		loop:      newFlushLoop(interval),
+		agg:       newIntervalAggregator(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+// NewAzureMonitorSinkFromURL creates an AzureMonitorSink from a URL. The
+// host is the region and the path the resource ID, for example
+// azuremonitor://westeurope/subscriptions/.../managedClusters/prod. The
+// optional "namespace", "tenant_id", "client_id", "client_secret" and
+// "flush_interval" parameters set the matching AzureMonitorOpts.
+func NewAzureMonitorSinkFromURL(u *url.URL) (MetricSink, error) {
+	params := u.Query()
+	opts := AzureMonitorOpts{
+		Region:       u.Host,
+		ResourceID:   u.Path,
+		Namespace:    params.Get("namespace"),
+		TenantID:     params.Get("tenant_id"),
+		ClientID:     params.Get("client_id"),
+		ClientSecret: params.Get("client_secret"),
+	}
+	if v := params.Get("flush_interval"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad 'flush_interval' param: %s", err)
+		}
+		opts.FlushInterval = interval
+	}
+	return NewAzureMonitorSink(opts)
+}
+
+func (s *AzureMonitorSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *AzureMonitorSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *AzureMonitorSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *AzureMonitorSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *AzureMonitorSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *AzureMonitorSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *AzureMonitorSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *AzureMonitorSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *AzureMonitorSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Azure Monitor sink supports.
+func (s *AzureMonitorSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Preflight checks that the ingestion endpoint resolves and that a token can
+// be acquired with the configured credentials, see ValidatePipeline.
+func (s *AzureMonitorSink) Preflight(ctx context.Context) error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return &PreflightError{Stage: PreflightStageConfig, Err: err}
+	}
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return &PreflightError{Stage: PreflightStageDNS, Err: err}
+	}
+	if _, err := s.token(ctx); err != nil {
+		return &PreflightError{Stage: PreflightStageAuth, Err: err}
+	}
+	return nil
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// published.
+func (s *AzureMonitorSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *AzureMonitorSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *AzureMonitorSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error publishing to Azure Monitor! Err: %s", err)
+	}
+}
+
+// azureMonitorRequest is the body of a custom metrics request
+type azureMonitorRequest struct {
+	Time string `json:"time"`
+	Data struct {
+		BaseData azureMonitorBaseData `json:"baseData"`
+	} `json:"data"`
+}
+
+type azureMonitorBaseData struct {
+	Metric    string               `json:"metric"`
+	Namespace string               `json:"namespace"`
+	DimNames  []string             `json:"dimNames,omitempty"`
+	Series    []azureMonitorSeries `json:"series"`
+}
+
+type azureMonitorSeries struct {
+	DimValues []string `json:"dimValues,omitempty"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     int      `json:"count"`
+}
+
+// flush publishes everything aggregated since the last flush, one request
+// per metric. Failures of one metric do not hold up the others.
+func (s *AzureMonitorSink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	var errs []string
+	for _, req := range s.requests(aggs, now) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		err = s.retry.Do(ctx, "Azure Monitor", func() error {
+			return s.post(ctx, body)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", req.Data.BaseData.Metric, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// requests groups aggregates into one request per metric, with the union of
+// their label names as dimensions.
+func (s *AzureMonitorSink) requests(aggs []*aggregate, now time.Time) []*azureMonitorRequest {
+	byName := make(map[string][]*aggregate)
+	var names []string
+	for _, a := range aggs {
+		name := strings.Join(a.key, ".")
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], a)
+	}
+	sort.Strings(names)
+
+	ts := now.UTC().Format(time.RFC3339)
+	out := make([]*azureMonitorRequest, 0, len(names))
+	for _, name := range names {
+		group := byName[name]
+
+		seen := make(map[string]bool)
+		var dims []string
+		for _, a := range group {
+			for _, l := range a.labels {
+				if !seen[l.Name] {
+					seen[l.Name] = true
+					dims = append(dims, l.Name)
+				}
+			}
+		}
+		sort.Strings(dims)
+		if len(dims) > azureMonitorMaxDimensions {
+			log.Printf("[WARN] Dropping Azure Monitor dimensions of %s beyond the limit of %d", name, azureMonitorMaxDimensions)
+			dims = dims[:azureMonitorMaxDimensions]
+		}
+
+		req := &azureMonitorRequest{Time: ts}
+		req.Data.BaseData = azureMonitorBaseData{
+			Metric:    name,
+			Namespace: s.namespace,
+			DimNames:  dims,
+		}
+		for _, a := range group {
+			ser := azureMonitorSeries{}
+			if len(dims) > 0 {
+				ser.DimValues = make([]string, len(dims))
+				for i, dim := range dims {
+					for _, l := range a.labels {
+						if l.Name == dim {
+							ser.DimValues[i] = l.Value
+						}
+					}
+				}
+			}
+			switch a.kind {
+			case aggregateGauge, aggregateKV:
+				ser.Min, ser.Max, ser.Sum, ser.Count = a.last, a.last, a.last, 1
+			case aggregateCounter:
+				ser.Min, ser.Max, ser.Sum, ser.Count = a.sum, a.sum, a.sum, 1
+			case aggregateSample:
+				ser.Min, ser.Max, ser.Sum, ser.Count = a.min, a.max, a.sum, a.count
+			}
+			req.Data.BaseData.Series = append(req.Data.BaseData.Series, ser)
+		}
+		out = append(out, req)
+	}
+	return out
+}
+
+func (s *AzureMonitorSink) post(ctx context.Context, body []byte) error {
+	token, err := s.token(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return CheckHTTPResponse(resp)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAzureMonitorSink(t *testing.T) {
+	var reqs []azureMonitorRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/subscriptions/sub/resourceGroups/rg/metrics" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("bad request: %s %v", r.URL.Path, r.Header)
+		}
+		var req azureMonitorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad body: %s", err)
+		}
+		reqs = append(reqs, req)
+	}))
+	defer srv.Close()
+
+	s, err := NewAzureMonitorSink(AzureMonitorOpts{
+		ResourceID:    "/subscriptions/sub/resourceGroups/rg",
+		Endpoint:      srv.URL,
+		Namespace:     "app",
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	s.token = func(ctx context.Context) (string, error) { return "token", nil }
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 3, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "500"}, {"method", "GET"}})
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+	if err := s.flush(time.Unix(60, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if len(reqs) != 2 {
+		t.Fatalf("expected one request per metric, got %d", len(reqs))
+	}
+	api := reqs[0]
+	if api.Time != "1970-01-01T00:01:00Z" || api.Data.BaseData.Metric != "api.requests" || api.Data.BaseData.Namespace != "app" {
+		t.Fatalf("bad request: %+v", api)
+	}
+	if !reflect.DeepEqual(api.Data.BaseData.DimNames, []string{"code", "method"}) {
+		t.Fatalf("bad dimensions: %v", api.Data.BaseData.DimNames)
+	}
+	expected := []azureMonitorSeries{
+		{DimValues: []string{"200", ""}, Min: 5, Max: 5, Sum: 5, Count: 1},
+		{DimValues: []string{"500", "GET"}, Min: 1, Max: 1, Sum: 1, Count: 1},
+	}
+	if !reflect.DeepEqual(api.Data.BaseData.Series, expected) {
+		t.Fatalf("bad series: %+v", api.Data.BaseData.Series)
+	}
+
+	latency := reqs[1].Data.BaseData
+	if latency.DimNames != nil || !reflect.DeepEqual(latency.Series, []azureMonitorSeries{{Min: 10, Max: 30, Sum: 40, Count: 2}}) {
+		t.Fatalf("bad sample: %+v", latency)
+	}
+}
+
+func TestNewAzureMonitorSink_Errors(t *testing.T) {
+	if _, err := NewAzureMonitorSink(AzureMonitorOpts{Region: "westeurope"}); err == nil {
+		t.Fatalf("expected a missing resource ID to fail")
+	}
+	if _, err := NewAzureMonitorSink(AzureMonitorOpts{ResourceID: "/subscriptions/sub"}); err == nil {
+		t.Fatalf("expected a missing region to fail")
+	}
+	if _, err := NewAzureMonitorSink(AzureMonitorOpts{Region: "westeurope", ResourceID: "/subscriptions/sub", ClientSecret: "secret"}); err == nil {
+		t.Fatalf("expected a partial service principal to fail")
+	}
+}
+
+func TestNewAzureMonitorSinkFromURL(t *testing.T) {
+	u, _ := url.Parse("azuremonitor://westeurope/subscriptions/sub/resourceGroups/rg?namespace=app&flush_interval=30s")
+	ms, err := NewAzureMonitorSinkFromURL(u)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s := ms.(*AzureMonitorSink)
+	defer s.Shutdown()
+	interval := time.Duration(s.loop.interval.Load())
+	if s.url != "https://westeurope.monitoring.azure.com/subscriptions/sub/resourceGroups/rg/metrics" || s.namespace != "app" || interval != 30*time.Second {
+		t.Fatalf("bad sink: %s %s %s", s.url, s.namespace, interval)
+	}
+
+	u, _ = url.Parse("azuremonitor://westeurope/subscriptions/sub?flush_interval=soon")
+	if _, err := NewAzureMonitorSinkFromURL(u); err == nil {
+		t.Fatalf("expected a bad interval to fail")
+	}
+}
+
+func TestAzureTokenSource(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/msi":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "identity" ||
+				r.URL.Query().Get("resource") != azureMonitorResource {
+				t.Errorf("bad MSI request: %v %v", r.URL, r.Header)
+			}
+		case "/tenant/oauth2/token":
+			_ = r.ParseForm()
+			if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("client_secret") != "secret" {
+				t.Errorf("bad SP request: %v", r.PostForm)
+			}
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`{"access_token":"abc","expires_in":"3600","token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	for _, ts := range []*azureTokenSource{
+		newAzureMSITokenSource(srv.Client(), srv.URL+"/msi", "identity"),
+		newAzureSPTokenSource(srv.Client(), srv.URL, "tenant", "client", "secret"),
+	} {
+		calls = 0
+		for i := 0; i < 2; i++ {
+			token, err := ts.token(context.Background())
+			if err != nil || token != "abc" {
+				t.Fatalf("bad token: %q %v", token, err)
+			}
+		}
+		if calls != 1 {
+			t.Fatalf("tokens should be cached, got %d calls", calls)
+		}
+	}
+}
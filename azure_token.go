@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// azureMonitorResource is the audience of Azure Monitor tokens
+	azureMonitorResource = "https://monitoring.azure.com/"
+
+	// azureIMDSTokenURL is the managed identity endpoint of the Azure
+	// instance metadata service
+	azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+	// azureLoginURL is the Azure AD endpoint of service principal logins
+	azureLoginURL = "https://login.microsoftonline.com"
+)
+
+// azureTokenSource fetches Azure AD access tokens, either for a managed
+// identity or a service principal, and caches them until shortly before
+// they expire.
+type azureTokenSource struct {
+	client *http.Client
+
+	// newRequest builds the token request
+	newRequest func(ctx context.Context) (*http.Request, error)
+
+	lock    sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+// newAzureMSITokenSource returns tokens of the managed identity, or of the
+// user assigned identity with the given client ID if set.
+func newAzureMSITokenSource(client *http.Client, endpoint, clientID string) *azureTokenSource {
+	if endpoint == "" {
+		endpoint = azureIMDSTokenURL
+	}
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {azureMonitorResource},
+	}
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	return &azureTokenSource{
+		client: client,
+		newRequest: func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Metadata", "true")
+			return req, nil
+		},
+	}
+}
+
+// newAzureSPTokenSource returns tokens of a service principal using the
+// client credentials flow.
+func newAzureSPTokenSource(client *http.Client, endpoint, tenantID, clientID, clientSecret string) *azureTokenSource {
+	if endpoint == "" {
+		endpoint = azureLoginURL
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"resource":      {azureMonitorResource},
+	}
+	tokenURL := strings.TrimSuffix(endpoint, "/") + "/" + url.PathEscape(tenantID) + "/oauth2/token"
+	return &azureTokenSource{
+		client: client,
+		newRequest: func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req, nil
+		},
+	}
+}
+
+func (a *azureTokenSource) token(ctx context.Context) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.cached != "" && time.Now().Before(a.expires) {
+		return a.cached, nil
+	}
+
+	req, err := a.newRequest(ctx)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := CheckHTTPResponse(resp); err != nil {
+		return "", err
+	}
+
+	// Azure AD v1 endpoints encode expires_in as a string
+	var body struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("azure token response has no access token")
+	}
+	expiresIn, err := strconv.Atoi(body.ExpiresIn.String())
+	if err != nil {
+		return "", fmt.Errorf("bad azure token expiry: %s", err)
+	}
+	a.cached = body.AccessToken
+	// Refresh a minute early so tokens never expire in flight
+	a.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return a.cached, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketTunerMaxSamples bounds the raw samples kept per metric while
+	// learning. Beyond this, reservoir sampling keeps a uniform subset.
+	bucketTunerMaxSamples = 10000
+)
+
+// BucketTuner removes the guesswork from configuring histogram buckets. For
+// every metric it records raw samples during an initial learning window, and
+// then proposes and locks in bucket boundaries that split the observed
+// distribution into buckets holding roughly equal numbers of samples. The
+// chosen boundaries are logged so they can be copied into static
+// configuration. A BucketTuner is used by setting HistogramBuckets.Tuner in
+// the options of a sink supporting histograms:
+//
+//	tuner := metrics.NewBucketTuner(10*time.Minute, 10)
+//	sink, err := prometheus.NewPrometheusSinkFrom(prometheus.PrometheusOpts{
+//		HistogramBuckets: metrics.HistogramBuckets{Tuner: tuner},
+//	})
+type BucketTuner struct {
+	window  time.Duration
+	buckets int
+
+	lock    sync.Mutex
+	metrics map[string]*tunedMetric
+}
+
+type tunedMetric struct {
+	start   time.Time
+	seen    int
+	samples []float64
+	locked  []float64
+}
+
+// NewBucketTuner creates a BucketTuner which learns for window before locking
+// in the given number of bucket boundaries per metric.
+func NewBucketTuner(window time.Duration, buckets int) *BucketTuner {
+	if buckets < 1 {
+		buckets = 1
+	}
+	return &BucketTuner{
+		window:  window,
+		buckets: buckets,
+		metrics: make(map[string]*tunedMetric),
+	}
+}
+
+// Observe records a sample for a metric. Once the buckets of the metric are
+// locked in this is a cheap no-op. Values which are not finite are ignored.
+func (b *BucketTuner) Observe(key []string, val float64) {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return
+	}
+	b.observeAt(strings.Join(key, "."), val, time.Now())
+}
+
+// Buckets returns the locked in bucket upper bounds of a metric, in
+// increasing order. The second return value is false while the metric is
+// still learning.
+func (b *BucketTuner) Buckets(key []string) ([]float64, bool) {
+	return b.bucketsAt(strings.Join(key, "."), time.Now())
+}
+
+func (b *BucketTuner) observeAt(key string, val float64, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t, ok := b.metrics[key]
+	if !ok {
+		t = &tunedMetric{start: now}
+		b.metrics[key] = t
+	}
+	if t.locked != nil {
+		return
+	}
+	if now.Sub(t.start) >= b.window && len(t.samples) > 0 {
+		b.lockIn(key, t)
+		return
+	}
+
+	t.seen++
+	if len(t.samples) < bucketTunerMaxSamples {
+		t.samples = append(t.samples, val)
+	} else if i := rand.Intn(t.seen); i < bucketTunerMaxSamples {
+		t.samples[i] = val
+	}
+}
+
+func (b *BucketTuner) bucketsAt(key string, now time.Time) ([]float64, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	t, ok := b.metrics[key]
+	if !ok {
+		return nil, false
+	}
+	if t.locked == nil {
+		if now.Sub(t.start) < b.window || len(t.samples) == 0 {
+			return nil, false
+		}
+		b.lockIn(key, t)
+	}
+	return append([]float64(nil), t.locked...), true
+}
+
+// lockIn computes the bucket boundaries of a metric and frees its samples.
+// The caller must hold b.lock.
+func (b *BucketTuner) lockIn(key string, t *tunedMetric) {
+	t.locked = proposeBuckets(t.samples, b.buckets)
+	t.samples = nil
+	log.Printf("[INFO] Locked in histogram buckets for %q after %d samples: %v", key, t.seen, t.locked)
+}
+
+// proposeBuckets returns up to n increasing upper bounds placed at evenly
+// spaced quantiles of the samples, rounded to two significant digits so
+// they are easy to read and reuse.
+func proposeBuckets(samples []float64, n int) []float64 {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	var bounds []float64
+	for i := 1; i <= n; i++ {
+		idx := int(math.Ceil(float64(i)*float64(len(sorted))/float64(n))) - 1
+		bound := roundSignificant(sorted[idx], 2)
+		if bound < sorted[idx] {
+			// Keep the boundary an upper bound after rounding
+			bound = roundSignificantUp(sorted[idx], 2)
+		}
+		if len(bounds) == 0 || bound > bounds[len(bounds)-1] {
+			bounds = append(bounds, bound)
+		}
+	}
+	return bounds
+}
+
+func roundSignificant(v float64, digits int) float64 {
+	if v == 0 {
+		return 0
+	}
+	scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(math.Abs(v))))
+	return math.Round(v*scale) / scale
+}
+
+func roundSignificantUp(v float64, digits int) float64 {
+	if v == 0 {
+		return 0
+	}
+	scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(math.Abs(v))))
+	return math.Ceil(v*scale) / scale
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBucketTuner(t *testing.T) {
+	b := NewBucketTuner(time.Minute, 4)
+	now := time.Now()
+
+	for i := 1; i <= 100; i++ {
+		b.observeAt("rpc.latency", float64(i), now)
+	}
+	if _, ok := b.bucketsAt("rpc.latency", now.Add(30*time.Second)); ok {
+		t.Fatalf("should still be learning")
+	}
+	if _, ok := b.bucketsAt("unknown", now); ok {
+		t.Fatalf("unknown metric should have no buckets")
+	}
+
+	buckets, ok := b.bucketsAt("rpc.latency", now.Add(time.Minute))
+	if !ok {
+		t.Fatalf("buckets should be locked in")
+	}
+	if want := []float64{25, 50, 75, 100}; !reflect.DeepEqual(buckets, want) {
+		t.Fatalf("got %v want %v", buckets, want)
+	}
+
+	// Locked buckets no longer change
+	b.observeAt("rpc.latency", 1000, now.Add(2*time.Minute))
+	buckets, _ = b.bucketsAt("rpc.latency", now.Add(2*time.Minute))
+	if want := []float64{25, 50, 75, 100}; !reflect.DeepEqual(buckets, want) {
+		t.Fatalf("got %v want %v", buckets, want)
+	}
+}
+
+func TestProposeBuckets(t *testing.T) {
+	// Boundaries are rounded up to two significant digits and deduplicated
+	got := proposeBuckets([]float64{0.123, 0.123, 0.123, 4567}, 4)
+	if want := []float64{0.13, 4600}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
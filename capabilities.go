@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+// Capabilities describes the optional features supported by a MetricSink, so
+// callers can pick the richest encoding each sink understands instead of
+// degrading everything to the lowest common denominator.
+type Capabilities struct {
+	// Histograms is set if the sink can represent true histograms rather
+	// than treating every sample as a timer.
+	Histograms bool
+
+	// PrecisionFloats is set if the sink retains 64 bit gauge values.
+	PrecisionFloats bool
+
+	// Timestamps is set if the sink can record caller provided timestamps.
+	Timestamps bool
+
+	// Tags is set if the sink transmits labels as dimensions rather than
+	// flattening them into the key.
+	Tags bool
+}
+
+// CapabilitySink is an optional interface implemented by sinks that can
+// describe which features they support.
+type CapabilitySink interface {
+	MetricSink
+
+	Capabilities() Capabilities
+}
+
+// SinkCapabilities returns the capabilities of a sink. Sinks that do not
+// implement CapabilitySink have their capabilities inferred from the
+// optional interfaces they implement.
+func SinkCapabilities(sink MetricSink) Capabilities {
+	if cs, ok := sink.(CapabilitySink); ok {
+		return cs.Capabilities()
+	}
+	_, precision := sink.(PrecisionGaugeMetricSink)
+	_, histograms := sink.(HistogramMetricSink)
+	return Capabilities{
+		Histograms:      histograms,
+		PrecisionFloats: precision,
+	}
+}
+
+// setPrecisionGauge emits a 64 bit gauge using the best encoding supported by
+// sink. Sinks which declare their capabilities but cannot retain 64 bit values
+// receive a 32 bit gauge instead. Other sinks without 64 bit support ignore
+// the value, as they always have.
+func setPrecisionGauge(sink MetricSink, key []string, val float64, labels []Label) {
+	if s64, ok := sink.(PrecisionGaugeMetricSink); ok {
+		s64.SetPrecisionGaugeWithLabels(key, val, labels)
+		return
+	}
+	if _, ok := sink.(CapabilitySink); ok {
+		sink.SetGaugeWithLabels(key, float32(val), labels)
+	}
+}
+
+// addHistogram records a histogram observation using the best encoding
+// supported by sink, which is a sample for sinks without true histograms.
+func addHistogram(sink MetricSink, key []string, val float64, labels []Label) {
+	switch s := sink.(type) {
+	case HistogramMetricSink:
+		s.AddHistogramWithLabels(key, val, labels)
+	case MetricSinkV2:
+		s.AddHistogramSampleWithLabels(key, val, labels)
+	default:
+		sink.AddSampleWithLabels(key, float32(val), labels)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+)
+
+// legacySink only implements the base MetricSink interface
+type legacySink struct {
+	gauges []float32
+}
+
+func (l *legacySink) SetGauge(key []string, val float32) {
+	l.SetGaugeWithLabels(key, val, nil)
+}
+func (l *legacySink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	l.gauges = append(l.gauges, val)
+}
+func (l *legacySink) EmitKey(key []string, val float32)                               {}
+func (l *legacySink) IncrCounter(key []string, val float32)                           {}
+func (l *legacySink) IncrCounterWithLabels(key []string, val float32, labels []Label) {}
+func (l *legacySink) AddSample(key []string, val float32)                             {}
+func (l *legacySink) AddSampleWithLabels(key []string, val float32, labels []Label)   {}
+
+// capSink declares its capabilities but has no 64 bit support
+type capSink struct {
+	legacySink
+}
+
+func (c *capSink) Capabilities() Capabilities {
+	return Capabilities{Tags: true}
+}
+
+func TestSinkCapabilities(t *testing.T) {
+	if c := SinkCapabilities(&MockSink{}); !c.PrecisionFloats || c.Tags {
+		t.Fatalf("bad inferred capabilities: %#v", c)
+	}
+	if c := SinkCapabilities(&capSink{}); c.PrecisionFloats || !c.Tags {
+		t.Fatalf("bad declared capabilities: %#v", c)
+	}
+	fh := FanoutSink{&capSink{}, &MockSink{}}
+	if c := fh.Capabilities(); !c.PrecisionFloats || !c.Tags || c.Histograms {
+		t.Fatalf("bad fanout capabilities: %#v", c)
+	}
+}
+
+func TestFanoutSink_PrecisionGaugeFallback(t *testing.T) {
+	declared := &capSink{}
+	precise := &MockSink{}
+	legacy := &legacySink{}
+	fh := FanoutSink{declared, precise, legacy}
+
+	fh.SetPrecisionGauge([]string{"test"}, 42)
+
+	if len(declared.gauges) != 1 || declared.gauges[0] != 42 {
+		t.Fatalf("declared sink should get a 32 bit gauge: %v", declared.gauges)
+	}
+	if len(precise.precisionVals) != 1 || precise.precisionVals[0] != 42 {
+		t.Fatalf("precise sink should get a 64 bit gauge: %v", precise.precisionVals)
+	}
+	if len(legacy.gauges) != 0 {
+		t.Fatalf("legacy sink should ignore 64 bit gauges")
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// CapturedMetrics holds what was emitted through a Metrics instance while a
+// function passed to Metrics.Capture ran. Names are the keys joined with
+// '.', as passed to the Metrics methods, before any renames, prefixes or
+// filters are applied.
+type CapturedMetrics struct {
+	lock     sync.Mutex
+	gauges   map[string]SnapshotValue
+	counters map[string]SnapshotValue
+	samples  map[string]SampledValue
+}
+
+func newCapturedMetrics() *CapturedMetrics {
+	return &CapturedMetrics{
+		gauges:   make(map[string]SnapshotValue),
+		counters: make(map[string]SnapshotValue),
+		samples:  make(map[string]SampledValue),
+	}
+}
+
+// Counter returns the sum of the increments to a counter. Without labels
+// the increments of every label set are summed, otherwise only those with
+// exactly the given labels.
+func (c *CapturedMetrics) Counter(name string, labels ...Label) float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(labels) > 0 {
+		return c.counters[captureKey(name, labels)].Value
+	}
+	var total float64
+	for _, v := range c.counters {
+		if v.Name == name {
+			total += v.Value
+		}
+	}
+	return total
+}
+
+// Gauge returns the last value set for a gauge with exactly the given
+// labels, if it was set at all.
+func (c *CapturedMetrics) Gauge(name string, labels ...Label) (float64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	v, ok := c.gauges[captureKey(name, labels)]
+	return v.Value, ok
+}
+
+// SampleCount returns the number of samples recorded, including timers.
+// Without labels the samples of every label set are counted.
+func (c *CapturedMetrics) SampleCount(name string, labels ...Label) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(labels) > 0 {
+		if s := c.samples[captureKey(name, labels)].AggregateSample; s != nil {
+			return s.Count
+		}
+		return 0
+	}
+	var total int
+	for _, v := range c.samples {
+		if v.Name == name {
+			total += v.Count
+		}
+	}
+	return total
+}
+
+// Names returns the distinct names of every gauge, counter and sample
+// emitted, sorted.
+func (c *CapturedMetrics) Names() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	seen := make(map[string]struct{})
+	for _, v := range c.gauges {
+		seen[v.Name] = struct{}{}
+	}
+	for _, v := range c.counters {
+		seen[v.Name] = struct{}{}
+	}
+	for _, v := range c.samples {
+		seen[v.Name] = struct{}{}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *CapturedMetrics) setGauge(key []string, val float64, labels []Label) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := seriesKey(key, labels)
+	v, ok := c.gauges[k]
+	if !ok {
+		v = newSnapshotValue(key, labels)
+	}
+	v.Value = val
+	c.gauges[k] = v
+}
+
+func (c *CapturedMetrics) incrCounter(key []string, val float64, labels []Label) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := seriesKey(key, labels)
+	v, ok := c.counters[k]
+	if !ok {
+		v = newSnapshotValue(key, labels)
+	}
+	v.Value += val
+	c.counters[k] = v
+}
+
+func (c *CapturedMetrics) addSample(key []string, val float64, labels []Label) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := seriesKey(key, labels)
+	v, ok := c.samples[k]
+	if !ok {
+		v = SampledValue{
+			Name:            strings.Join(key, "."),
+			Hash:            k,
+			AggregateSample: &AggregateSample{},
+			Labels:          append([]Label(nil), labels...),
+		}
+	}
+	v.Ingest(val, 1)
+	c.samples[k] = v
+}
+
+// captureKey is seriesKey for a name which is already joined.
+func captureKey(name string, labels []Label) string {
+	return seriesKey([]string{name}, labels)
+}
+
+// captureSet tracks the captures in progress on a Metrics instance. The
+// active count keeps the emission path down to one atomic load while nothing
+// is being captured.
+type captureSet struct {
+	active atomic.Int32
+	lock   sync.Mutex
+	list   []*CapturedMetrics
+}
+
+func (s *captureSet) add(c *CapturedMetrics) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.list = append(s.list, c)
+	s.active.Add(1)
+}
+
+func (s *captureSet) remove(c *CapturedMetrics) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, other := range s.list {
+		if other == c {
+			s.list = append(s.list[:i:i], s.list[i+1:]...)
+			s.active.Add(-1)
+			return
+		}
+	}
+}
+
+// each calls fn for every capture in progress.
+func (s *captureSet) each(fn func(*CapturedMetrics)) {
+	if s.active.Load() == 0 {
+		return
+	}
+	s.lock.Lock()
+	list := s.list
+	s.lock.Unlock()
+
+	for _, c := range list {
+		fn(c)
+	}
+}
+
+// Capture runs fn and returns everything emitted through this Metrics
+// instance while it ran, independently of the configured sinks and of
+// Config.EnableSnapshot. Metrics emitted concurrently by other goroutines
+// are included as well. It is intended for tests asserting on the metrics
+// of a code path, see the metricstest package.
+func (m *Metrics) Capture(fn func()) *CapturedMetrics {
+	c, stop := m.StartCapture()
+	defer stop()
+
+	fn()
+	return c
+}
+
+// StartCapture is Capture for emissions which do not fit in one function,
+// such as those of a whole test run. Everything emitted through this Metrics
+// instance is captured until stop is called.
+func (m *Metrics) StartCapture() (c *CapturedMetrics, stop func()) {
+	c = newCapturedMetrics()
+	m.captures.add(c)
+	return c, func() { m.captures.remove(c) }
+}
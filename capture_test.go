@@ -0,0 +1,54 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetrics_Capture(t *testing.T) {
+	_, met := mockMetric()
+	met.IncrCounter([]string{"before"}, 1)
+
+	var inner *CapturedMetrics
+	outer := met.Capture(func() {
+		met.IncrCounterWithLabels([]string{"cache", "miss"}, 1, []Label{{"cache", "a"}})
+		inner = met.Capture(func() {
+			met.IncrCounterWithLabels([]string{"cache", "miss"}, 2, []Label{{"cache", "b"}})
+			met.SetGauge([]string{"pool", "size"}, 4)
+			met.AddSample([]string{"db", "rows"}, 10)
+			met.MeasureSince([]string{"db", "rows"}, time.Now())
+		})
+	})
+	met.IncrCounter([]string{"cache", "miss"}, 1)
+
+	if got := outer.Counter("cache.miss"); got != 3 {
+		t.Fatalf("bad outer counter: %v", got)
+	}
+	if got := outer.Counter("cache.miss", Label{"cache", "a"}); got != 1 {
+		t.Fatalf("bad labeled counter: %v", got)
+	}
+	if got := inner.Counter("cache.miss"); got != 2 {
+		t.Fatalf("bad inner counter: %v", got)
+	}
+	if got := outer.Counter("before"); got != 0 {
+		t.Fatalf("bad counter from before the capture: %v", got)
+	}
+	if v, ok := inner.Gauge("pool.size"); !ok || v != 4 {
+		t.Fatalf("bad gauge: %v %v", v, ok)
+	}
+	if _, ok := inner.Gauge("pool.size", Label{"pool", "db"}); ok {
+		t.Fatalf("expected no gauge with other labels")
+	}
+	if n := inner.SampleCount("db.rows"); n != 2 {
+		t.Fatalf("bad sample count: %d", n)
+	}
+	if n := inner.SampleCount("db.rows", Label{"db", "main"}); n != 0 {
+		t.Fatalf("bad labeled sample count: %d", n)
+	}
+	if met.captures.active.Load() != 0 {
+		t.Fatalf("captures still active")
+	}
+}
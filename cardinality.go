@@ -0,0 +1,100 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// cardinalityKey is the self-telemetry gauge reporting the number of
+// distinct label sets seen for each key, labeled with the key
+var cardinalityKey = []string{"metrics", "cardinality"}
+
+// cardinalityTracker records when each label set of each key was last seen
+type cardinalityTracker struct {
+	window time.Duration
+
+	lock       sync.Mutex
+	seen       map[string]map[string]time.Time
+	lastReport time.Time
+}
+
+func newCardinalityTracker(window time.Duration) *cardinalityTracker {
+	return &cardinalityTracker{
+		window:     window,
+		seen:       make(map[string]map[string]time.Time),
+		lastReport: time.Now(),
+	}
+}
+
+// record notes a label set for key, returning true when a window has passed
+// since the last report.
+func (c *cardinalityTracker) record(key []string, labels []Label, now time.Time) bool {
+	name := strings.Join(key, ".")
+	series := seriesKey(nil, labels)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	sets, ok := c.seen[name]
+	if !ok {
+		sets = make(map[string]time.Time)
+		c.seen[name] = sets
+	}
+	sets[series] = now
+
+	if now.Sub(c.lastReport) < c.window {
+		return false
+	}
+	c.lastReport = now
+	return true
+}
+
+// counts returns the number of label sets seen per key within the window,
+// forgetting older ones.
+func (c *cardinalityTracker) counts(now time.Time) map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	out := make(map[string]int, len(c.seen))
+	for name, sets := range c.seen {
+		for series, last := range sets {
+			if now.Sub(last) > c.window {
+				delete(sets, series)
+			}
+		}
+		if len(sets) == 0 {
+			delete(c.seen, name)
+			continue
+		}
+		out[name] = len(sets)
+	}
+	return out
+}
+
+// Cardinality returns the number of distinct label sets seen for each key
+// over the last Config.CardinalityWindow, keyed by the key joined with '.'.
+// The same numbers are reported once per window through the
+// metrics.cardinality gauge, labeled with the key, so cardinality offenders
+// show up in the configured sinks. It returns nil if tracking is disabled.
+func (m *Metrics) Cardinality() map[string]int {
+	if m.cardinality == nil {
+		return nil
+	}
+	return m.cardinality.counts(time.Now())
+}
+
+// trackCardinality records the label set of an emission and reports the
+// counts through the sink once per window.
+func (m *Metrics) trackCardinality(key []string, labels []Label) {
+	now := time.Now()
+	if !m.cardinality.record(key, labels, now) {
+		return
+	}
+	for name, count := range m.cardinality.counts(now) {
+		m.setGaugeWithLabels(cardinalityKey, float32(count), []Label{{Name: "name", Value: name}})
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCardinalityTracker(t *testing.T) {
+	now := time.Now()
+	c := newCardinalityTracker(time.Minute)
+	c.record([]string{"req"}, []Label{{"path", "/a"}}, now)
+	c.record([]string{"req"}, []Label{{"path", "/b"}}, now.Add(30*time.Second))
+	c.record([]string{"req"}, []Label{{"path", "/a"}}, now.Add(30*time.Second))
+	c.record([]string{"up"}, nil, now)
+
+	if got := c.counts(now.Add(45 * time.Second)); !reflect.DeepEqual(got, map[string]int{"req": 2, "up": 1}) {
+		t.Fatalf("bad counts: %v", got)
+	}
+
+	// Label sets not seen within the window are forgotten
+	if got := c.counts(now.Add(75 * time.Second)); !reflect.DeepEqual(got, map[string]int{"req": 2}) {
+		t.Fatalf("bad counts: %v", got)
+	}
+	if got := c.counts(now.Add(time.Hour)); len(got) != 0 {
+		t.Fatalf("bad counts: %v", got)
+	}
+}
+
+func TestMetrics_Cardinality(t *testing.T) {
+	m, met := mockMetric()
+	if met.Cardinality() != nil {
+		t.Fatalf("tracking should be disabled by default")
+	}
+
+	met.cardinality = newCardinalityTracker(time.Hour)
+	met.IncrCounterWithLabels([]string{"req"}, 1, []Label{{"user", "1"}})
+	met.IncrCounterWithLabels([]string{"req"}, 1, []Label{{"user", "2"}})
+	if got := met.Cardinality(); got["req"] != 2 {
+		t.Fatalf("bad counts: %v", got)
+	}
+
+	// Once the window has passed, the counts are reported through the sink
+	met.cardinality.lastReport = time.Now().Add(-2 * time.Hour)
+	met.IncrCounterWithLabels([]string{"req"}, 1, []Label{{"user", "3"}})
+	keys := m.getKeys()
+	if len(keys) != 4 || !reflect.DeepEqual(keys[2], cardinalityKey) || m.vals[2] != 3 {
+		t.Fatalf("bad keys: %v %v", keys, m.vals)
+	}
+	if !reflect.DeepEqual(m.labels[2], []Label{{"name", "req"}}) {
+		t.Fatalf("bad labels: %v", m.labels[2])
+	}
+}
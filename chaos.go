@@ -0,0 +1,146 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// ChaosOpts configures the degradation injected by a ChaosSink.
+type ChaosOpts struct {
+	// Latency is added to every call before it reaches the wrapped sink
+	Latency time.Duration
+
+	// Jitter adds a further random delay between zero and Jitter
+	Jitter time.Duration
+
+	// ErrorRate is the fraction of calls, between 0 and 1, which fail and
+	// are dropped instead of reaching the wrapped sink
+	ErrorRate float64
+}
+
+// ChaosSink wraps a MetricSink and injects latency, jitter and failures into
+// every call. It is meant for load and capacity tests, to measure how
+// sensitive an application is to a degraded telemetry path. Do not use it in
+// production.
+type ChaosSink struct {
+	sink MetricSink
+	opts ChaosOpts
+
+	// failed counts calls dropped by the injected error rate
+	failed uint64
+
+	// Overridden in tests
+	random func() float64
+	sleep  func(time.Duration)
+}
+
+// NewChaosSink wraps sink with the given degradation.
+func NewChaosSink(sink MetricSink, opts ChaosOpts) *ChaosSink {
+	return &ChaosSink{
+		sink:   sink,
+		opts:   opts,
+		random: rand.Float64,
+		sleep:  time.Sleep,
+	}
+}
+
+// Failed returns the number of calls dropped by the injected error rate.
+func (c *ChaosSink) Failed() uint64 {
+	return atomic.LoadUint64(&c.failed)
+}
+
+func (c *ChaosSink) SetGauge(key []string, val float32) {
+	if c.inject() {
+		c.sink.SetGauge(key, val)
+	}
+}
+
+func (c *ChaosSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if c.inject() {
+		c.sink.SetGaugeWithLabels(key, val, labels)
+	}
+}
+
+func (c *ChaosSink) SetPrecisionGauge(key []string, val float64) {
+	c.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (c *ChaosSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	if c.inject() {
+		setPrecisionGauge(c.sink, key, val, labels)
+	}
+}
+
+func (c *ChaosSink) EmitKey(key []string, val float32) {
+	if c.inject() {
+		c.sink.EmitKey(key, val)
+	}
+}
+
+func (c *ChaosSink) IncrCounter(key []string, val float32) {
+	if c.inject() {
+		c.sink.IncrCounter(key, val)
+	}
+}
+
+func (c *ChaosSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if c.inject() {
+		c.sink.IncrCounterWithLabels(key, val, labels)
+	}
+}
+
+func (c *ChaosSink) AddSample(key []string, val float32) {
+	if c.inject() {
+		c.sink.AddSample(key, val)
+	}
+}
+
+func (c *ChaosSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if c.inject() {
+		c.sink.AddSampleWithLabels(key, val, labels)
+	}
+}
+
+func (c *ChaosSink) AddHistogram(key []string, val float64) {
+	c.AddHistogramWithLabels(key, val, nil)
+}
+
+func (c *ChaosSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	if c.inject() {
+		addHistogram(c.sink, key, val, labels)
+	}
+}
+
+// Shutdown forwards to the wrapped sink if it supports it, after the
+// injected delay.
+func (c *ChaosSink) Shutdown() {
+	c.delay()
+	if ss, ok := c.sink.(ShutdownSink); ok {
+		ss.Shutdown()
+	}
+}
+
+// inject applies the configured delay and reports whether the call should
+// be forwarded.
+func (c *ChaosSink) inject() bool {
+	c.delay()
+	if c.opts.ErrorRate > 0 && c.random() < c.opts.ErrorRate {
+		atomic.AddUint64(&c.failed, 1)
+		return false
+	}
+	return true
+}
+
+func (c *ChaosSink) delay() {
+	d := c.opts.Latency
+	if c.opts.Jitter > 0 {
+		d += time.Duration(c.random() * float64(c.opts.Jitter))
+	}
+	if d > 0 {
+		c.sleep(d)
+	}
+}
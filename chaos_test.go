@@ -0,0 +1,52 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChaosSink(t *testing.T) {
+	m := &MockSink{}
+	sink := NewChaosSink(m, ChaosOpts{
+		Latency:   10 * time.Millisecond,
+		Jitter:    10 * time.Millisecond,
+		ErrorRate: 0.5,
+	})
+
+	var slept []time.Duration
+	sink.sleep = func(d time.Duration) { slept = append(slept, d) }
+	rolls := []float64{0.5, 0.1, 0.5, 0.9}
+	sink.random = func() float64 {
+		r := rolls[0]
+		rolls = rolls[1:]
+		return r
+	}
+
+	// First call: 5ms of jitter, then fails with 0.1 < 0.5
+	sink.IncrCounter([]string{"a"}, 1)
+	// Second call: 5ms of jitter, then succeeds with 0.9
+	sink.IncrCounter([]string{"b"}, 1)
+
+	if len(m.getKeys()) != 1 || m.getKeys()[0][0] != "b" {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+	if sink.Failed() != 1 {
+		t.Fatalf("bad failed count: %d", sink.Failed())
+	}
+	if len(slept) != 2 || slept[0] != 15*time.Millisecond || slept[1] != 15*time.Millisecond {
+		t.Fatalf("bad delays: %v", slept)
+	}
+}
+
+func TestChaosSink_Passthrough(t *testing.T) {
+	m := &MockSink{}
+	sink := NewChaosSink(m, ChaosOpts{})
+	sink.SetGaugeWithLabels([]string{"g"}, 1, []Label{{"a", "b"}})
+	sink.AddSample([]string{"s"}, 2)
+	if len(m.getKeys()) != 2 || sink.Failed() != 0 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCheckpointInterval is used when CounterCheckpointInterval is
+	// not set
+	defaultCheckpointInterval = time.Minute
+
+	// checkpointRestartsGauge is the precision gauge holding the number of
+	// restarts in a checkpoint
+	checkpointRestartsGauge = "checkpoint.restarts"
+)
+
+// checkpointRestartsKey is the counter incremented whenever a checkpoint is
+// restored, so restarts can be told apart from counter resets downstream.
+var checkpointRestartsKey = []string{"metrics", "restarts"}
+
+// CumulativeSink is implemented by sinks reporting counters as running
+// totals, such as the RemoteWriteSink and the OTLP sink with cumulative
+// temporality. When Config.CounterCheckpointPath is set, New passes them the
+// restored totals so that their series continue from where the previous
+// process stopped instead of resetting on every restart.
+type CumulativeSink interface {
+	// RestoreCounters seeds the running totals of counters, given with
+	// their keys and labels as the sink receives them from Metrics, and the
+	// time they started accumulating.
+	RestoreCounters(start time.Time, counters []RestoredCounter)
+}
+
+// RestoredCounter is the total of a counter restored from a checkpoint.
+type RestoredCounter struct {
+	Key    []string
+	Labels []Label
+	Total  float64
+}
+
+// counterCheckpoint is the state persisted by a counter checkpoint.
+type counterCheckpoint struct {
+	StartTime time.Time
+	Restarts  uint64
+	SavedAt   time.Time
+	Counters  map[string]SnapshotValue
+}
+
+// summary converts the checkpoint to a MetricsSummary, so it is written
+// with a SnapshotCodec. The counter totals are the sums of the counters, the
+// timestamp is the time they started accumulating, and the restarts are
+// kept in a precision gauge.
+func (cp *counterCheckpoint) summary() *MetricsSummary {
+	s := &MetricsSummary{
+		Timestamp: cp.StartTime.Format(time.RFC3339Nano),
+		PrecisionGauges: []PrecisionGaugeValue{{
+			Name:        checkpointRestartsGauge,
+			Value:       float64(cp.Restarts),
+			LastUpdated: cp.SavedAt,
+		}},
+		Counters: make([]SampledValue, 0, len(cp.Counters)),
+	}
+	for key, v := range cp.Counters {
+		s.Counters = append(s.Counters, SampledValue{
+			Name:            v.Name,
+			Hash:            key,
+			Labels:          v.Labels,
+			AggregateSample: &AggregateSample{Count: 1, Sum: v.Value, LastUpdated: cp.SavedAt},
+		})
+	}
+	sort.Slice(s.Counters, func(i, j int) bool { return s.Counters[i].Hash < s.Counters[j].Hash })
+	return s
+}
+
+// checkpointFromSummary is the reverse of counterCheckpoint.summary. Codecs
+// which do not keep series hashes rebuild them from the decoded labels.
+func checkpointFromSummary(s *MetricsSummary) (*counterCheckpoint, error) {
+	start, err := time.Parse(time.RFC3339Nano, s.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("bad start time: %s", err)
+	}
+	cp := &counterCheckpoint{
+		StartTime: start,
+		Counters:  make(map[string]SnapshotValue, len(s.Counters)),
+	}
+	for _, g := range s.PrecisionGauges {
+		if g.Name == checkpointRestartsGauge {
+			cp.Restarts, cp.SavedAt = uint64(g.Value), g.LastUpdated
+		}
+	}
+	for _, c := range s.Counters {
+		labels := summaryLabels(c.Labels, c.DisplayLabels)
+		key := c.Hash
+		if key == "" {
+			key = seriesKey([]string{c.Name}, labels)
+		}
+		v := SnapshotValue{Name: c.Name, Labels: labels}
+		if c.AggregateSample != nil {
+			v.Value = c.Sum
+		}
+		cp.Counters[key] = v
+	}
+	return cp, nil
+}
+
+// loadCheckpoint reads the checkpoint at path. A missing file is not an
+// error and returns nil.
+func loadCheckpoint(path string, codec SnapshotCodec) (*counterCheckpoint, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s MetricsSummary
+	if err := codec.Decode(bytes.NewReader(raw), &s); err != nil {
+		return nil, fmt.Errorf("invalid counter checkpoint %q: %s", path, err)
+	}
+	cp, err := checkpointFromSummary(&s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid counter checkpoint %q: %s", path, err)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint replaces the checkpoint at path. The file is written
+// next to the destination and renamed into place, so a crash mid-write never
+// leaves a truncated checkpoint behind.
+func writeCheckpoint(path string, codec SnapshotCodec, cp *counterCheckpoint) error {
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, cp.summary()); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// checkpointCodec returns the codec of the counter checkpoint
+func (m *Metrics) checkpointCodec() SnapshotCodec {
+	if m.CounterCheckpointCodec != nil {
+		return m.CounterCheckpointCodec
+	}
+	return ProtobufSnapshotCodec
+}
+
+// restoreCheckpoint seeds the snapshot registry and any CumulativeSink from
+// the configured checkpoint file, counting the reload as a restart in the
+// metrics.restarts counter.
+func (m *Metrics) restoreCheckpoint() {
+	cp, err := loadCheckpoint(m.CounterCheckpointPath, m.checkpointCodec())
+	if err != nil {
+		log.Printf("[ERR] metrics: Failed to load counter checkpoint, starting from zero: %s", err)
+		return
+	}
+	if cp == nil {
+		return
+	}
+	m.snapshots.restore(cp.Counters, cp.StartTime, cp.Restarts+1)
+	if sink, ok := m.sink.(CumulativeSink); ok {
+		sink.RestoreCounters(cp.StartTime, m.restoredCounters(cp))
+	}
+	m.emitCounter(checkpointRestartsKey, 1, nil)
+}
+
+// restoredCounters returns the counters of a checkpoint with the renames,
+// prefixes, labels and filters applied as for IncrCounter.
+func (m *Metrics) restoredCounters(cp *counterCheckpoint) []RestoredCounter {
+	counters := make([]RestoredCounter, 0, len(cp.Counters))
+	for _, v := range cp.Counters {
+		key, dual := m.renamedKeys(strings.Split(v.Name, "."))
+		for _, k := range [][]string{key, dual} {
+			if k == nil {
+				continue
+			}
+			labels := v.Labels[:len(v.Labels):len(v.Labels)]
+			if k, labels, allowed := m.counterSeries(k, labels); allowed {
+				counters = append(counters, RestoredCounter{Key: k, Labels: labels, Total: v.Value})
+			}
+		}
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		return seriesKey(counters[i].Key, counters[i].Labels) < seriesKey(counters[j].Key, counters[j].Labels)
+	})
+	return counters
+}
+
+// Checkpoint writes the running counter totals to CounterCheckpointPath so
+// that they are restored by New on the next start. It is called periodically
+// and on Shutdown, and may be called directly, for example before a planned
+// restart.
+func (m *Metrics) Checkpoint() error {
+	if m.CounterCheckpointPath == "" || m.snapshots == nil {
+		return nil
+	}
+	s := m.snapshots.snapshot()
+	return writeCheckpoint(m.CounterCheckpointPath, m.checkpointCodec(), &counterCheckpoint{
+		StartTime: s.StartTime,
+		Restarts:  s.Restarts,
+		SavedAt:   time.Now(),
+		Counters:  s.Counters,
+	})
+}
+
+func (m *Metrics) checkpointLoop(stop <-chan struct{}) {
+	interval := m.CounterCheckpointInterval
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.Checkpoint(); err != nil {
+				log.Printf("[ERR] metrics: Failed to write counter checkpoint: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
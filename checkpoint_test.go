@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetrics_CounterCheckpoint(t *testing.T) {
+	for _, codec := range []SnapshotCodec{nil, JSONSnapshotCodec, MsgpackSnapshotCodec, CBORSnapshotCodec} {
+		path := filepath.Join(t.TempDir(), "counters")
+		conf := DefaultConfig("")
+		conf.EnableRuntimeMetrics = false
+		conf.CounterCheckpointPath = path
+		conf.CounterCheckpointCodec = codec
+
+		met, err := New(conf, &BlackholeSink{})
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		met.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"code", "200"}})
+		first := met.Snapshot()
+		if first.Restarts != 0 {
+			t.Fatalf("bad restarts: %d", first.Restarts)
+		}
+		met.Shutdown()
+
+		// A new instance picks up where the previous one left off
+		met, err = New(conf, &BlackholeSink{})
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		met.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"code", "200"}})
+
+		s := met.Snapshot()
+		met.Shutdown()
+		if v, ok := s.Counter([]string{"requests"}, []Label{{"code", "200"}}); !ok || v != 5 {
+			t.Fatalf("%v: bad counter: %v %v", codec, v, ok)
+		}
+		if s.Restarts != 1 || !s.StartTime.Equal(first.StartTime) {
+			t.Fatalf("%v: bad restart info: %d %v %v", codec, s.Restarts, s.StartTime, first.StartTime)
+		}
+	}
+}
+
+// cumulativeMock records the totals restored into it
+type cumulativeMock struct {
+	MockSink
+	start    time.Time
+	restored []RestoredCounter
+}
+
+func (c *cumulativeMock) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	c.start, c.restored = start, counters
+}
+
+func TestMetrics_CounterCheckpoint_CumulativeSink(t *testing.T) {
+	conf := DefaultConfig("service")
+	conf.EnableRuntimeMetrics = false
+	conf.EnableHostname = false
+	conf.CounterCheckpointPath = filepath.Join(t.TempDir(), "counters")
+
+	met, err := New(conf, &BlackholeSink{})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	met.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"code", "200"}})
+	start := met.Snapshot().StartTime
+	met.Shutdown()
+
+	// Only the cumulative member of the fanout gets the totals, with the
+	// service prefix applied, while both see the restart
+	cumulative, delta := &cumulativeMock{}, &MockSink{}
+	met, err = New(conf, FanoutSink{cumulative, delta})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer met.Shutdown()
+
+	want := []RestoredCounter{{Key: []string{"service", "requests"}, Labels: []Label{{"code", "200"}}, Total: 3}}
+	if !reflect.DeepEqual(cumulative.restored, want) || !cumulative.start.Equal(start) {
+		t.Fatalf("bad restore %v %v", cumulative.restored, cumulative.start)
+	}
+	for _, sink := range []*MockSink{&cumulative.MockSink, delta} {
+		if keys := sink.getKeys(); len(keys) != 1 || !reflect.DeepEqual(keys[0], []string{"service", "metrics", "restarts"}) {
+			t.Fatalf("bad keys %v", keys)
+		}
+	}
+}
+
+func TestLoadCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	if cp, err := loadCheckpoint(filepath.Join(dir, "missing"), ProtobufSnapshotCodec); cp != nil || err != nil {
+		t.Fatalf("missing file should be ignored: %v %v", cp, err)
+	}
+
+	path := filepath.Join(dir, "corrupt")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if _, err := loadCheckpoint(path, ProtobufSnapshotCodec); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// A corrupt checkpoint is logged and ignored rather than failing New
+	conf := DefaultConfig("")
+	conf.EnableRuntimeMetrics = false
+	conf.CounterCheckpointPath = path
+	met, err := New(conf, &BlackholeSink{})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer met.Shutdown()
+	if len(met.Snapshot().Counters) != 0 {
+		t.Fatalf("expected no counters")
+	}
+}
@@ -59,6 +59,12 @@ func (s *CirconusSink) Flush() {
 	s.metrics.Flush()
 }
 
+// Capabilities reports what the Circonus sink supports. Labels are flattened
+// into the key.
+func (s *CirconusSink) Capabilities() metrics.Capabilities {
+	return metrics.Capabilities{PrecisionFloats: true}
+}
+
 // SetGauge sets value for a gauge metric
 func (s *CirconusSink) SetGauge(key []string, val float32) {
 	flatKey := s.flattenKey(key)
@@ -0,0 +1,331 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cloudWatchFlushInterval is used when CloudWatchSinkOpts.FlushInterval
+	// is not set, matching the standard resolution of CloudWatch
+	cloudWatchFlushInterval = time.Minute
+
+	// cloudWatchMaxDatums and cloudWatchMaxBytes are the limits of a single
+	// PutMetricData call
+	cloudWatchMaxDatums = 20
+	cloudWatchMaxBytes  = 150 * 1024
+
+	// cloudWatchMaxDimensions is the number of dimensions CloudWatch accepts
+	// per datum
+	cloudWatchMaxDimensions = 30
+)
+
+// CloudWatchSinkOpts is used to configure a CloudWatchSink.
+type CloudWatchSinkOpts struct {
+	// Namespace holds every metric, it is required
+	Namespace string
+
+	// Region is the AWS region to submit to. It defaults to the AWS_REGION
+	// or AWS_DEFAULT_REGION environment variables.
+	Region string
+
+	// Endpoint overrides the regional monitoring endpoint, such as for VPC
+	// endpoints
+	Endpoint string
+
+	// AccessKeyID, SecretAccessKey and SessionToken sign requests. They
+	// default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN environment variables, and then to the temporary
+	// credentials of a web identity, such as IAM roles for service
+	// accounts on EKS, an ECS task role or the EC2 instance profile, which
+	// are refreshed before they expire.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Dimensions are added to every metric
+	Dimensions []Label
+
+	// FlushInterval is how often metrics are submitted, it defaults to a
+	// minute
+	FlushInterval time.Duration
+
+	// HTTPClient is used for submissions, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// RetryPolicy applies to failed submissions, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// CloudWatchSink provides a MetricSink that submits metrics to AWS
+// CloudWatch with PutMetricData. Metrics are aggregated in memory and
+// submitted on every flush interval, split into calls within the API limits.
+//
+// The key, joined with '.', becomes the metric name and labels become
+// dimensions. Gauges and key/value pairs report their last value, counters
+// their sum with the Count unit, and samples are submitted as statistic sets.
+type CloudWatchSink struct {
+	namespace  string
+	region     string
+	endpoint   string
+	creds      *awsCredentialSource
+	dimensions []Label
+	client     *http.Client
+	retry      RetryPolicy
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewCloudWatchSink creates a CloudWatchSink and starts its flush loop.
+func NewCloudWatchSink(opts CloudWatchSinkOpts) (*CloudWatchSink, error) {
+	if opts.Namespace == "" {
+		return nil, fmt.Errorf("cloudwatch namespace is required")
+	}
+	region := opts.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("cloudwatch region is required")
+	}
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://monitoring.%s.amazonaws.com/", region)
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = cloudWatchFlushInterval
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	creds, err := newAWSCredentialSource(client, awsCredentials{
+		accessKeyID:     opts.AccessKeyID,
+		secretAccessKey: opts.SecretAccessKey,
+		sessionToken:    opts.SessionToken,
+	}, region)
+	if err != nil {
+		return nil, err
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	s := &CloudWatchSink{
+		namespace:  opts.Namespace,
+		region:     region,
+		endpoint:   endpoint,
+		creds:      creds,
+		dimensions: opts.Dimensions,
+		client:     client,
+		retry:      retry,
+		loop:       newFlushLoop(interval),
+		agg:        newIntervalAggregator(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *CloudWatchSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *CloudWatchSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *CloudWatchSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *CloudWatchSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *CloudWatchSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *CloudWatchSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *CloudWatchSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *CloudWatchSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *CloudWatchSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the CloudWatch sink supports.
+func (s *CloudWatchSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// submitted.
+func (s *CloudWatchSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *CloudWatchSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *CloudWatchSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error submitting to CloudWatch! Err: %s", err)
+	}
+}
+
+// flush submits everything aggregated since the last flush, in as many
+// PutMetricData calls as the datum and size limits require.
+func (s *CloudWatchSink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	var batch [][]cloudWatchParam
+	size := 0
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		body := s.encodeBatch(batch)
+		batch, size = batch[:0], 0
+		return s.retry.Do(ctx, "CloudWatch", func() error {
+			return s.submit(body, now)
+		})
+	}
+
+	for _, a := range aggs {
+		datum := s.datum(a, now)
+		n := 0
+		for _, p := range datum {
+			// Leave room for the member prefix of every parameter
+			n += len(p.name) + len(p.value) + 32
+		}
+		if len(batch) == cloudWatchMaxDatums || (len(batch) > 0 && size+n > cloudWatchMaxBytes) {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, datum)
+		size += n
+	}
+	return send()
+}
+
+// cloudWatchParam is one field of a MetricDatum, relative to its member
+// prefix
+type cloudWatchParam struct {
+	name  string
+	value string
+}
+
+// datum returns the MetricDatum fields of an aggregate.
+func (s *CloudWatchSink) datum(a *aggregate, now time.Time) []cloudWatchParam {
+	out := []cloudWatchParam{
+		{"MetricName", strings.Join(a.key, ".")},
+		{"Timestamp", now.UTC().Format(time.RFC3339)},
+	}
+
+	dims := append(append([]Label(nil), s.dimensions...), a.labels...)
+	sort.SliceStable(dims, func(i, j int) bool { return dims[i].Name < dims[j].Name })
+	n := 0
+	for _, d := range dims {
+		if d.Name == "" || d.Value == "" {
+			// Empty dimension names and values are rejected
+			continue
+		}
+		if n == cloudWatchMaxDimensions {
+			log.Printf("[WARN] Dropping CloudWatch dimensions of %s beyond the limit of %d", out[0].value, cloudWatchMaxDimensions)
+			break
+		}
+		n++
+		prefix := "Dimensions.member." + strconv.Itoa(n) + "."
+		out = append(out, cloudWatchParam{prefix + "Name", d.Name}, cloudWatchParam{prefix + "Value", d.Value})
+	}
+
+	switch a.kind {
+	case aggregateGauge, aggregateKV:
+		out = append(out, cloudWatchParam{"Value", formatCloudWatchValue(a.last)})
+	case aggregateCounter:
+		out = append(out,
+			cloudWatchParam{"Value", formatCloudWatchValue(a.sum)},
+			cloudWatchParam{"Unit", "Count"})
+	case aggregateSample:
+		out = append(out,
+			cloudWatchParam{"StatisticValues.SampleCount", strconv.Itoa(a.count)},
+			cloudWatchParam{"StatisticValues.Sum", formatCloudWatchValue(a.sum)},
+			cloudWatchParam{"StatisticValues.Minimum", formatCloudWatchValue(a.min)},
+			cloudWatchParam{"StatisticValues.Maximum", formatCloudWatchValue(a.max)})
+	}
+	return out
+}
+
+func formatCloudWatchValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// encodeBatch encodes a PutMetricData call of the query API.
+func (s *CloudWatchSink) encodeBatch(batch [][]cloudWatchParam) []byte {
+	form := url.Values{
+		"Action":    {"PutMetricData"},
+		"Version":   {"2010-08-01"},
+		"Namespace": {s.namespace},
+	}
+	for i, datum := range batch {
+		prefix := "MetricData.member." + strconv.Itoa(i+1) + "."
+		for _, p := range datum {
+			form.Set(prefix+p.name, p.value)
+		}
+	}
+	return []byte(awsCanonicalQuery(form))
+}
+
+func (s *CloudWatchSink) submit(body []byte, now time.Time) error {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds, err := s.creds.credentials(req.Context())
+	if err != nil {
+		return err
+	}
+	signV4(req, body, creds, s.region, "monitoring", now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return CheckHTTPResponse(resp)
+}
@@ -0,0 +1,157 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloudWatchSink(t *testing.T) {
+	var lock sync.Mutex
+	var forms []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=id/19700101/us-west-2/monitoring/aws4_request") {
+			t.Errorf("bad authorization: %s", r.Header.Get("Authorization"))
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("bad form: %s", err)
+		}
+		form := make(map[string]string)
+		for k, v := range r.PostForm {
+			form[k] = v[0]
+		}
+		lock.Lock()
+		forms = append(forms, form)
+		lock.Unlock()
+	}))
+	defer srv.Close()
+
+	s, err := NewCloudWatchSink(CloudWatchSinkOpts{
+		Namespace:       "App",
+		Region:          "us-west-2",
+		Endpoint:        srv.URL,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		Dimensions:      []Label{{"env", "prod"}},
+		FlushInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 3, []Label{{"code", "200"}})
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+	if err := s.flush(time.Unix(1, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if len(forms) != 1 {
+		t.Fatalf("expected one call, got %d", len(forms))
+	}
+	expected := map[string]string{
+		"Action":    "PutMetricData",
+		"Version":   "2010-08-01",
+		"Namespace": "App",
+
+		"MetricData.member.1.MetricName":                  "api.requests",
+		"MetricData.member.1.Timestamp":                   "1970-01-01T00:00:01Z",
+		"MetricData.member.1.Dimensions.member.1.Name":    "code",
+		"MetricData.member.1.Dimensions.member.1.Value":   "200",
+		"MetricData.member.1.Dimensions.member.2.Name":    "env",
+		"MetricData.member.1.Dimensions.member.2.Value":   "prod",
+		"MetricData.member.1.Value":                       "5",
+		"MetricData.member.1.Unit":                        "Count",
+		"MetricData.member.2.MetricName":                  "latency",
+		"MetricData.member.2.Timestamp":                   "1970-01-01T00:00:01Z",
+		"MetricData.member.2.Dimensions.member.1.Name":    "env",
+		"MetricData.member.2.Dimensions.member.1.Value":   "prod",
+		"MetricData.member.2.StatisticValues.SampleCount": "2",
+		"MetricData.member.2.StatisticValues.Sum":         "40",
+		"MetricData.member.2.StatisticValues.Minimum":     "10",
+		"MetricData.member.2.StatisticValues.Maximum":     "30",
+	}
+	if len(forms[0]) != len(expected) {
+		t.Fatalf("bad form: %v", forms[0])
+	}
+	for k, v := range expected {
+		if forms[0][k] != v {
+			t.Fatalf("bad %s: %q, want %q", k, forms[0][k], v)
+		}
+	}
+}
+
+func TestCloudWatchSink_Chunking(t *testing.T) {
+	var calls []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		n := 0
+		for k := range r.PostForm {
+			if strings.HasSuffix(k, ".MetricName") {
+				n++
+			}
+		}
+		calls = append(calls, n)
+	}))
+	defer srv.Close()
+
+	s, err := NewCloudWatchSink(CloudWatchSinkOpts{
+		Namespace:       "App",
+		Region:          "us-west-2",
+		Endpoint:        srv.URL,
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		FlushInterval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	for i := 0; i < 45; i++ {
+		s.SetGauge([]string{fmt.Sprintf("gauge%02d", i)}, 1)
+	}
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(calls) != 3 || calls[0] != 20 || calls[1] != 20 || calls[2] != 5 {
+		t.Fatalf("bad chunks: %v", calls)
+	}
+
+	// Large dimension values split calls before the datum limit
+	calls = nil
+	big := strings.Repeat("x", 250)
+	for i := 0; i < 20; i++ {
+		labels := make([]Label, 30)
+		for j := range labels {
+			labels[j] = Label{fmt.Sprintf("dim%02d", j), big}
+		}
+		s.SetGaugeWithLabels([]string{fmt.Sprintf("gauge%02d", i)}, 1, labels)
+	}
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(calls) < 2 {
+		t.Fatalf("expected the size limit to split calls: %v", calls)
+	}
+}
+
+func TestNewCloudWatchSink_Errors(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	if _, err := NewCloudWatchSink(CloudWatchSinkOpts{Region: "us-east-1"}); err == nil {
+		t.Fatalf("expected a missing namespace to fail")
+	}
+	if _, err := NewCloudWatchSink(CloudWatchSinkOpts{Namespace: "App", AccessKeyID: "id", SecretAccessKey: "secret"}); err == nil {
+		t.Fatalf("expected a missing region to fail")
+	}
+}
@@ -0,0 +1,445 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// collectdFlushInterval, collectdPlugin and collectdMaxPacket are used
+	// when the matching CollectdOpts are not set. The packet size is the
+	// default buffer size of the collectd network plugin.
+	collectdFlushInterval = 10 * time.Second
+	collectdPlugin        = "gometrics"
+	collectdMaxPacket     = 1452
+
+	// collectdPort is used when CollectdOpts.Address has no port
+	collectdPort = "25826"
+
+	// collectdMaxName is the longest host, plugin or type name collectd
+	// accepts, excluding the null terminator
+	collectdMaxName = 63
+)
+
+// Security levels of the collectd network protocol
+const (
+	CollectdSecurityNone    = ""
+	CollectdSecuritySign    = "sign"
+	CollectdSecurityEncrypt = "encrypt"
+)
+
+// Part types of the collectd binary protocol
+const (
+	collectdPartHost           = 0x0000
+	collectdPartPlugin         = 0x0002
+	collectdPartPluginInstance = 0x0003
+	collectdPartType           = 0x0004
+	collectdPartTypeInstance   = 0x0005
+	collectdPartValues         = 0x0006
+	collectdPartTimeHR         = 0x0008
+	collectdPartIntervalHR     = 0x0009
+	collectdPartSignSHA256     = 0x0200
+	collectdPartEncrAES256     = 0x0210
+
+	// collectdGauge is the data source type of every value sent
+	collectdGauge = 1
+)
+
+// CollectdOpts is used to configure a CollectdSink.
+type CollectdOpts struct {
+	// Address is the collectd server, the port defaults to 25826
+	Address string
+
+	// Host is the host of the value lists, it defaults to the hostname
+	Host string
+
+	// Plugin is the plugin of the value lists, it defaults to "gometrics"
+	Plugin string
+
+	// FlushInterval is how often metrics are sent, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// MaxPacketSize bounds the size of every datagram, it defaults to the
+	// 1452 bytes collectd reads
+	MaxPacketSize int
+
+	// SecurityLevel is CollectdSecurityNone, the default,
+	// CollectdSecuritySign to sign packets with HMAC-SHA-256, or
+	// CollectdSecurityEncrypt to encrypt them with AES-256, using the
+	// Username and Password configured on the server
+	SecurityLevel string
+	Username      string
+	Password      string
+}
+
+// CollectdSink provides a MetricSink which sends metrics to collectd, or any
+// server accepting its binary network protocol, over UDP. Metrics are
+// aggregated in memory and sent on every flush interval as value lists of
+// the configured host and plugin. The flattened key is the type instance,
+// and label values joined with '-' the plugin instance. Gauges and key/value
+// pairs are sent with the "gauge" type and their last value, counters with
+// the "count" type and their sum over the interval, and samples as .count,
+// .mean, .min and .max type instances. All values are sent as gauges, so
+// collectd stores them as they are.
+type CollectdSink struct {
+	addr     string
+	host     string
+	plugin   string
+	interval time.Duration
+	maxSize  int
+	security string
+	username string
+	password string
+	dial     Dialer
+
+	agg  *intervalAggregator
+	conn net.Conn
+	loop *flushLoop
+}
+
+// collectdValue is a single value list sent to collectd
+type collectdValue struct {
+	pluginInstance string
+	typ            string
+	typeInstance   string
+	value          float64
+}
+
+// NewCollectdSink creates a CollectdSink and starts its flush loop.
+func NewCollectdSink(opts CollectdOpts) (*CollectdSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("collectd address is required")
+	}
+	addr := opts.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, collectdPort)
+	}
+	switch opts.SecurityLevel {
+	case CollectdSecurityNone:
+	case CollectdSecuritySign, CollectdSecurityEncrypt:
+		if opts.Username == "" || opts.Password == "" {
+			return nil, fmt.Errorf("collectd security level %q requires a username and password", opts.SecurityLevel)
+		}
+	default:
+		return nil, fmt.Errorf("unknown collectd security level %q", opts.SecurityLevel)
+	}
+	host := opts.Host
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	plugin := opts.Plugin
+	if plugin == "" {
+		plugin = collectdPlugin
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = collectdFlushInterval
+	}
+	maxSize := opts.MaxPacketSize
+	if maxSize <= 0 {
+		maxSize = collectdMaxPacket
+	}
+
+	s := &CollectdSink{
+		addr:     addr,
+		host:     host,
+		plugin:   plugin,
+		interval: interval,
+		maxSize:  maxSize,
+		security: opts.SecurityLevel,
+		username: opts.Username,
+		password: opts.Password,
+		dial:     net.Dial,
+		agg:      newIntervalAggregator(),
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+func (s *CollectdSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *CollectdSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *CollectdSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *CollectdSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *CollectdSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *CollectdSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *CollectdSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *CollectdSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *CollectdSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the collectd sink supports. Labels are folded
+// into the plugin instance.
+func (s *CollectdSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// sent.
+func (s *CollectdSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *CollectdSink) SetFlushInterval(interval time.Duration) {
+	s.interval = interval
+	s.loop.setInterval(interval)
+}
+
+func (s *CollectdSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error pushing to collectd! Err: %s", err)
+	}
+	if final && s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// flush sends everything aggregated since the last flush. It is only called
+// from the flush loop, which owns the connection.
+func (s *CollectdSink) flush(now time.Time) error {
+	packets, err := s.packets(s.values(s.agg.drain()), now)
+	if err != nil || len(packets) == 0 {
+		return err
+	}
+
+	if s.conn == nil {
+		conn, err := s.dial("udp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	for _, packet := range packets {
+		if _, err := s.conn.Write(packet); err != nil {
+			_ = s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// values converts aggregates into value lists.
+func (s *CollectdSink) values(aggs []*aggregate) []collectdValue {
+	var values []collectdValue
+	for _, a := range aggs {
+		instance := make([]string, len(a.labels))
+		for i, l := range a.labels {
+			instance[i] = l.Value
+		}
+		v := collectdValue{
+			pluginInstance: strings.Join(instance, "-"),
+			typ:            "gauge",
+			typeInstance:   strings.Join(a.key, "."),
+		}
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			v.value = a.last
+			values = append(values, v)
+		case aggregateCounter:
+			v.typ, v.value = "count", a.sum
+			values = append(values, v)
+		case aggregateSample:
+			name := v.typeInstance
+			for _, stat := range []struct {
+				suffix string
+				val    float64
+			}{{".count", float64(a.count)}, {".mean", a.mean()}, {".min", a.min}, {".max", a.max}} {
+				v.typeInstance, v.value = name+stat.suffix, stat.val
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// packets encodes value lists into datagrams of at most maxSize bytes,
+// signed or encrypted according to the security level. Every datagram
+// starts with the host, time, interval and plugin, which the value lists
+// following them share.
+func (s *CollectdSink) packets(values []collectdValue, now time.Time) ([][]byte, error) {
+	// Room left for the signature or encryption part wrapping the data
+	limit := s.maxSize
+	switch s.security {
+	case CollectdSecuritySign:
+		limit -= 4 + sha256.Size + len(s.username)
+	case CollectdSecurityEncrypt:
+		limit -= 4 + 2 + len(s.username) + aes.BlockSize + sha1.Size
+	}
+
+	var header bytes.Buffer
+	appendCollectdString(&header, collectdPartHost, s.host)
+	appendCollectdNumber(&header, collectdPartTimeHR, collectdHRTime(now.Sub(time.Unix(0, 0))))
+	appendCollectdNumber(&header, collectdPartIntervalHR, collectdHRTime(s.interval))
+	appendCollectdString(&header, collectdPartPlugin, s.plugin)
+	if header.Len() >= limit {
+		return nil, fmt.Errorf("collectd packet size of %d bytes is too small", s.maxSize)
+	}
+
+	var packets [][]byte
+	var packet, list bytes.Buffer
+	for _, v := range values {
+		list.Reset()
+		appendCollectdString(&list, collectdPartPluginInstance, v.pluginInstance)
+		appendCollectdString(&list, collectdPartType, v.typ)
+		appendCollectdString(&list, collectdPartTypeInstance, v.typeInstance)
+		appendCollectdGauge(&list, v.value)
+		if header.Len()+list.Len() > limit {
+			// A value list which cannot fit any packet is skipped
+			continue
+		}
+		if packet.Len() > 0 && packet.Len()+list.Len() > limit {
+			packets = append(packets, bytes.Clone(packet.Bytes()))
+			packet.Reset()
+		}
+		if packet.Len() == 0 {
+			packet.Write(header.Bytes())
+		}
+		packet.Write(list.Bytes())
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, bytes.Clone(packet.Bytes()))
+	}
+
+	for i, p := range packets {
+		var err error
+		switch s.security {
+		case CollectdSecuritySign:
+			packets[i] = signCollectdPacket(p, s.username, s.password)
+		case CollectdSecurityEncrypt:
+			packets[i], err = encryptCollectdPacket(p, s.username, s.password)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return packets, nil
+}
+
+// collectdHRTime converts a duration into the high resolution time of
+// collectd, in units of 2^-30 seconds.
+func collectdHRTime(d time.Duration) uint64 {
+	sec, nsec := uint64(d/time.Second), uint64(d%time.Second)
+	return sec<<30 | (nsec<<30)/uint64(time.Second)
+}
+
+// appendCollectdString appends a null terminated string part, truncated to
+// the longest name collectd accepts.
+func appendCollectdString(buf *bytes.Buffer, typ uint16, v string) {
+	if len(v) > collectdMaxName {
+		v = v[:collectdMaxName]
+	}
+	_ = binary.Write(buf, binary.BigEndian, [2]uint16{typ, uint16(4 + len(v) + 1)})
+	buf.WriteString(v)
+	buf.WriteByte(0)
+}
+
+// appendCollectdNumber appends a 64 bit numeric part.
+func appendCollectdNumber(buf *bytes.Buffer, typ uint16, v uint64) {
+	_ = binary.Write(buf, binary.BigEndian, [2]uint16{typ, 4 + 8})
+	_ = binary.Write(buf, binary.BigEndian, v)
+}
+
+// appendCollectdGauge appends a values part holding a single gauge. Unlike
+// the rest of the protocol, gauges are little endian.
+func appendCollectdGauge(buf *bytes.Buffer, v float64) {
+	_ = binary.Write(buf, binary.BigEndian, [3]uint16{collectdPartValues, 4 + 2 + 1 + 8, 1})
+	buf.WriteByte(collectdGauge)
+	_ = binary.Write(buf, binary.LittleEndian, math.Float64bits(v))
+}
+
+// signCollectdPacket prepends an HMAC-SHA-256 signature part to data. The
+// signature covers the username followed by the data.
+func signCollectdPacket(data []byte, username, password string) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(username))
+	mac.Write(data)
+
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, [2]uint16{collectdPartSignSHA256, uint16(4 + sha256.Size + len(username))})
+	buf.Write(mac.Sum(nil))
+	buf.WriteString(username)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// encryptCollectdPacket wraps data in an AES-256 encryption part. The SHA-1
+// of the data followed by the data is encrypted in OFB mode, with the
+// SHA-256 of the password as the key and a random IV.
+func encryptCollectdPacket(data []byte, username, password string) ([]byte, error) {
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	checksum := sha1.Sum(data)
+	plaintext := append(checksum[:], data...)
+	collectdOFB(block, iv, plaintext)
+
+	var buf bytes.Buffer
+	length := 4 + 2 + len(username) + len(iv) + len(plaintext)
+	_ = binary.Write(&buf, binary.BigEndian, [3]uint16{collectdPartEncrAES256, uint16(length), uint16(len(username))})
+	buf.WriteString(username)
+	buf.Write(iv)
+	buf.Write(plaintext)
+	return buf.Bytes(), nil
+}
+
+// collectdOFB encrypts or decrypts data in place in OFB mode, which collectd
+// requires and the standard library only provides as a deprecated stream.
+func collectdOFB(block cipher.Block, iv, data []byte) {
+	stream := bytes.Clone(iv)
+	for i := 0; i < len(data); i += len(stream) {
+		block.Encrypt(stream, stream)
+		for j := 0; j < len(stream) && i+j < len(data); j++ {
+			data[i+j] ^= stream[j]
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collectdPart is a decoded part of a collectd packet
+type collectdPart struct {
+	typ  uint16
+	body []byte
+}
+
+func decodeCollectdParts(t *testing.T, packet []byte) []collectdPart {
+	t.Helper()
+	var parts []collectdPart
+	for len(packet) > 0 {
+		if len(packet) < 4 {
+			t.Fatalf("truncated part header %x", packet)
+		}
+		typ := binary.BigEndian.Uint16(packet)
+		length := int(binary.BigEndian.Uint16(packet[2:]))
+		if length < 4 || length > len(packet) {
+			t.Fatalf("bad part length %d", length)
+		}
+		parts = append(parts, collectdPart{typ, packet[4:length]})
+		packet = packet[length:]
+	}
+	return parts
+}
+
+// describeCollectdParts renders the value lists of a plain packet as
+// "plugin/instance/type/type_instance=value" lines.
+func describeCollectdParts(t *testing.T, parts []collectdPart) []string {
+	t.Helper()
+	var lines []string
+	names := map[uint16]string{}
+	for _, p := range parts {
+		switch p.typ {
+		case collectdPartHost, collectdPartPlugin, collectdPartPluginInstance, collectdPartType, collectdPartTypeInstance:
+			names[p.typ] = strings.TrimSuffix(string(p.body), "\x00")
+		case collectdPartValues:
+			if len(p.body) != 11 || p.body[1] != 1 || p.body[2] != collectdGauge {
+				t.Fatalf("bad values part %x", p.body)
+			}
+			val := math.Float64frombits(binary.LittleEndian.Uint64(p.body[3:]))
+			lines = append(lines, fmt.Sprintf("%s/%s/%s/%s/%s=%v", names[collectdPartHost], names[collectdPartPlugin],
+				names[collectdPartPluginInstance], names[collectdPartType], names[collectdPartTypeInstance], val))
+		}
+	}
+	return lines
+}
+
+func newTestCollectdSink(t *testing.T, opts CollectdOpts) (*CollectdSink, net.PacketConn) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	opts.Address = pc.LocalAddr().String()
+	opts.Host = "web-1"
+	opts.FlushInterval = time.Hour
+	s, err := NewCollectdSink(opts)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	t.Cleanup(s.Shutdown)
+	return s, pc
+}
+
+func readCollectdPacket(t *testing.T, pc net.PacketConn) []byte {
+	t.Helper()
+	buf := make([]byte, 65536)
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	return buf[:n]
+}
+
+func TestCollectdSink(t *testing.T) {
+	s, pc := newTestCollectdSink(t, CollectdOpts{})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}, {"method", "GET"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	s.AddSample([]string{"api", "latency"}, 10)
+
+	now := time.Unix(1700000000, int64(500*time.Millisecond))
+	if err := s.flush(now); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	parts := decodeCollectdParts(t, readCollectdPacket(t, pc))
+	if parts[1].typ != collectdPartTimeHR || binary.BigEndian.Uint64(parts[1].body) != 1700000000<<30|1<<29 {
+		t.Fatalf("bad time part %+v", parts[1])
+	}
+	if parts[2].typ != collectdPartIntervalHR || binary.BigEndian.Uint64(parts[2].body) != 3600<<30 {
+		t.Fatalf("bad interval part %+v", parts[2])
+	}
+	want := []string{
+		"web-1/gometrics/200-GET/count/api.requests=2",
+		"web-1/gometrics//gauge/queue.depth=7",
+		"web-1/gometrics//gauge/api.latency.count=1",
+		"web-1/gometrics//gauge/api.latency.mean=10",
+		"web-1/gometrics//gauge/api.latency.min=10",
+		"web-1/gometrics//gauge/api.latency.max=10",
+	}
+	if got := describeCollectdParts(t, parts); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("bad values %v", got)
+	}
+}
+
+func TestCollectdSink_PacketSize(t *testing.T) {
+	s, _ := newTestCollectdSink(t, CollectdOpts{MaxPacketSize: 200})
+	var values []collectdValue
+	for i := 0; i < 20; i++ {
+		values = append(values, collectdValue{typ: "gauge", typeInstance: fmt.Sprintf("metric.%d", i), value: float64(i)})
+	}
+	packets, err := s.packets(values, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(packets) < 2 {
+		t.Fatalf("expected several packets, got %d", len(packets))
+	}
+	var got []string
+	for _, p := range packets {
+		if len(p) > 200 {
+			t.Fatalf("packet of %d bytes exceeds the limit", len(p))
+		}
+		parts := decodeCollectdParts(t, p)
+		if parts[0].typ != collectdPartHost {
+			t.Fatalf("expected every packet to start with the host")
+		}
+		got = append(got, describeCollectdParts(t, parts)...)
+	}
+	if len(got) != 20 {
+		t.Fatalf("expected every value list to be sent, got %d", len(got))
+	}
+}
+
+func TestCollectdSink_Sign(t *testing.T) {
+	s, pc := newTestCollectdSink(t, CollectdOpts{SecurityLevel: CollectdSecuritySign, Username: "alice", Password: "secret"})
+	s.SetGauge([]string{"a"}, 1)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	packet := readCollectdPacket(t, pc)
+	if binary.BigEndian.Uint16(packet) != collectdPartSignSHA256 {
+		t.Fatalf("expected a signature part")
+	}
+	length := int(binary.BigEndian.Uint16(packet[2:]))
+	sig, user, data := packet[4:36], packet[36:length], packet[length:]
+	if string(user) != "alice" {
+		t.Fatalf("bad username %q", user)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(user)
+	mac.Write(data)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		t.Fatalf("bad signature")
+	}
+	if got := describeCollectdParts(t, decodeCollectdParts(t, data)); len(got) != 1 || got[0] != "web-1/gometrics//gauge/a=1" {
+		t.Fatalf("bad values %v", got)
+	}
+}
+
+func TestCollectdSink_Encrypt(t *testing.T) {
+	s, pc := newTestCollectdSink(t, CollectdOpts{SecurityLevel: CollectdSecurityEncrypt, Username: "alice", Password: "secret"})
+	s.SetGauge([]string{"a"}, 1)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	packet := readCollectdPacket(t, pc)
+	if binary.BigEndian.Uint16(packet) != collectdPartEncrAES256 || int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+		t.Fatalf("bad encryption part header %x", packet[:4])
+	}
+	userLen := int(binary.BigEndian.Uint16(packet[4:]))
+	if string(packet[6:6+userLen]) != "alice" {
+		t.Fatalf("bad username %q", packet[6:6+userLen])
+	}
+	iv := packet[6+userLen : 6+userLen+aes.BlockSize]
+	payload := bytes.Clone(packet[6+userLen+aes.BlockSize:])
+
+	key := sha256.Sum256([]byte("secret"))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	collectdOFB(block, iv, payload)
+	checksum, data := payload[:sha1.Size], payload[sha1.Size:]
+	if sum := sha1.Sum(data); !bytes.Equal(checksum, sum[:]) {
+		t.Fatalf("bad checksum")
+	}
+	if got := describeCollectdParts(t, decodeCollectdParts(t, data)); len(got) != 1 || got[0] != "web-1/gometrics//gauge/a=1" {
+		t.Fatalf("bad values %v", got)
+	}
+}
+
+func TestNewCollectdSink_Invalid(t *testing.T) {
+	for _, opts := range []CollectdOpts{
+		{},
+		{Address: "collectd", SecurityLevel: "bogus"},
+		{Address: "collectd", SecurityLevel: CollectdSecuritySign},
+		{Address: "collectd", SecurityLevel: CollectdSecurityEncrypt, Username: "alice"},
+	} {
+		if _, err := NewCollectdSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+
+	s, err := NewCollectdSink(CollectdOpts{Address: "collectd"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.addr != "collectd:25826" {
+		t.Fatalf("bad addr %s", s.addr)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// csvInterval is used when CSVOpts.Interval is not set
+	csvInterval = 10 * time.Second
+
+	// csvSampleRetention is used when CSVOpts.SampleRetention is not set
+	csvSampleRetention = 1024
+)
+
+// csvHeader names the columns written by a CSVSink
+var csvHeader = []string{"timestamp", "name", "type", "labels", "count", "sum", "min", "max", "mean", "p95", "p99"}
+
+// CSVOpts is used to configure a CSVSink.
+type CSVOpts struct {
+	// Path is the file rows are appended to, which is created if needed.
+	// The header row is written when the file is empty.
+	Path string
+
+	// Writer receives the rows instead of a file when Path is not set,
+	// starting with the header row
+	Writer io.Writer
+
+	// Interval is the length of the aggregation intervals, each of which is
+	// written once it ended. It defaults to 10 seconds.
+	Interval time.Duration
+
+	// SampleRetention is the number of raw values kept per sample and
+	// interval to compute the percentiles, see
+	// InmemSink.EnableSampleRetention. It defaults to 1024.
+	SampleRetention int
+}
+
+// CSVSink provides a MetricSink which writes aggregated intervals as CSV
+// rows, for importing into spreadsheets and data frames. Metrics are
+// aggregated by an embedded InmemSink, and every series of an interval is
+// written as a row once the interval ended:
+//
+//	timestamp,name,type,labels,count,sum,min,max,mean,p95,p99
+//	2024-01-02T15:04:00Z,api.latency,sample,route=/users,4,50,3,30,12.5,28.5,29.7
+//
+// The timestamp is the start of the interval. Gauges have the last value set
+// in the interval as their sum, min, max and mean, and percentiles are only
+// written for samples and key/value points.
+type CSVSink struct {
+	*InmemSink
+
+	file *os.File
+	w    *csv.Writer
+	loop *flushLoop
+
+	// written is the start of the last interval written, only used from
+	// the flush loop
+	written time.Time
+}
+
+// NewCSVSink creates a CSVSink, opening or creating the file, and starts
+// writing the intervals as they end.
+func NewCSVSink(opts CSVOpts) (*CSVSink, error) {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = csvInterval
+	}
+	retention := opts.SampleRetention
+	if retention <= 0 {
+		retention = csvSampleRetention
+	}
+
+	// Ended intervals are retained until the next flush has written them
+	s := &CSVSink{InmemSink: NewInmemSink(interval, 3*interval)}
+	s.EnableSampleRetention(retention)
+
+	out := opts.Writer
+	header := true
+	if opts.Path != "" {
+		f, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		s.file, out, header = f, f, info.Size() == 0
+	} else if out == nil {
+		return nil, fmt.Errorf("csv path or writer is required")
+	}
+
+	s.w = csv.NewWriter(out)
+	if header {
+		if err := s.w.WriteAll([][]string{csvHeader}); err != nil {
+			if s.file != nil {
+				_ = s.file.Close()
+			}
+			return nil, err
+		}
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+// Shutdown stops writing after the rows of the current interval, which has
+// not ended yet, and closes the file.
+func (s *CSVSink) Shutdown() {
+	s.loop.stop()
+}
+
+func (s *CSVSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now, final); err != nil {
+		log.Printf("[ERR] Error writing CSV rows! Err: %s", err)
+	}
+	if final && s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+// flush writes the rows of the intervals which ended since the last flush,
+// and of the current interval as well when final is set.
+func (s *CSVSink) flush(now time.Time, final bool) error {
+	current := now.Truncate(s.interval)
+
+	s.intervalLock.RLock()
+	var pending []*IntervalMetrics
+	for _, intv := range s.intervals {
+		if !intv.Interval.After(s.written) {
+			continue
+		}
+		if intv.Interval.Before(current) || final {
+			pending = append(pending, intv)
+		}
+	}
+	s.intervalLock.RUnlock()
+
+	for _, intv := range pending {
+		intv.RLock()
+		rows := csvIntervalRows(intv)
+		intv.RUnlock()
+		if err := s.w.WriteAll(rows); err != nil {
+			return err
+		}
+		s.written = intv.Interval
+	}
+	return nil
+}
+
+// csvIntervalRows returns the rows of an interval, sorted by type and series.
+func csvIntervalRows(intv *IntervalMetrics) [][]string {
+	ts := intv.Interval.UTC().Format(time.RFC3339)
+	var rows [][]string
+	for _, series := range intervalSeriesOf(intv) {
+		r := []string{ts, series.name, series.typ, csvLabels(series.labels), strconv.Itoa(series.count),
+			csvValue(series.sum), csvValue(series.min), csvValue(series.max), csvValue(series.mean), "", ""}
+		if len(series.values) > 0 {
+			r[9] = csvValue(percentile(series.values, 95))
+			r[10] = csvValue(percentile(series.values, 99))
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// intervalSeries is the aggregate of a series over an interval, as written
+// by the sinks storing ended intervals
+type intervalSeries struct {
+	name   string
+	typ    string
+	labels []Label
+	count  int
+	sum    float64
+	min    float64
+	max    float64
+	mean   float64
+
+	// values are the retained values of samples and key/value points,
+	// copied so they can be sorted without holding the interval lock
+	values []float64
+}
+
+// intervalSeriesOf returns the series of an interval, sorted by type and
+// series. Gauges have the last value set in the interval as their sum, min,
+// max and mean. The interval must be read locked.
+func intervalSeriesOf(intv *IntervalMetrics) []intervalSeries {
+	var series []intervalSeries
+	for _, k := range sortedKeys(intv.Counters) {
+		c := intv.Counters[k]
+		series = append(series, intervalSeries{c.Name, "counter", c.Labels, c.Count, c.Sum, c.Min, c.Max, c.AggregateSample.Mean(), nil})
+	}
+	for _, k := range sortedKeys(intv.Gauges) {
+		g := intv.Gauges[k]
+		v := float64(g.Value)
+		series = append(series, intervalSeries{g.Name, "gauge", g.Labels, 1, v, v, v, v, nil})
+	}
+	for _, k := range sortedKeys(intv.PrecisionGauges) {
+		g := intv.PrecisionGauges[k]
+		series = append(series, intervalSeries{g.Name, "gauge", g.Labels, 1, g.Value, g.Value, g.Value, g.Value, nil})
+	}
+	for _, k := range sortedKeys(intv.Points) {
+		var a AggregateSample
+		values := make([]float64, len(intv.Points[k]))
+		for i, v := range intv.Points[k] {
+			values[i] = float64(v)
+			a.Ingest(values[i], 1)
+		}
+		series = append(series, intervalSeries{k, "kv", nil, a.Count, a.Sum, a.Min, a.Max, a.Mean(), values})
+	}
+	for _, k := range sortedKeys(intv.Samples) {
+		sample := intv.Samples[k]
+		var values []float64
+		if r, ok := intv.retained[k]; ok {
+			values = append(values, r.values...)
+		}
+		series = append(series, intervalSeries{sample.Name, "sample", sample.Labels, sample.Count, sample.Sum, sample.Min, sample.Max, sample.AggregateSample.Mean(), values})
+	}
+	return series
+}
+
+// sortedKeys returns the keys of a map of series, sorted.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// csvLabels formats labels as name=value pairs separated by semicolons.
+func csvLabels(labels []Label) string {
+	display := make(map[string]string, len(labels))
+	for _, l := range labels {
+		display[l.Name] = l.Value
+	}
+	names := sortedKeys(display)
+	var b []byte
+	for i, name := range names {
+		if i > 0 {
+			b = append(b, ';')
+		}
+		b = append(b, name...)
+		b = append(b, '=')
+		b = append(b, display[name]...)
+	}
+	return string(b)
+}
+
+func csvValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
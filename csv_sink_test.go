@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCSVSink(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewCSVSink(CSVOpts{Writer: &buf, Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}, {"app", "web"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 3, []Label{{"code", "200"}, {"app", "web"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	s.EmitKey([]string{"keys"}, 4)
+	for v := 1; v <= 100; v++ {
+		s.AddSample([]string{"api", "latency"}, float32(v))
+	}
+	s.Shutdown()
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("bad rows %v", rows)
+	}
+	if !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Fatalf("bad header %v", rows[0])
+	}
+	ts := time.Now().Truncate(time.Hour).UTC().Format(time.RFC3339)
+	want := [][]string{
+		{ts, "api.requests", "counter", "app=web;code=200", "2", "5", "2", "3", "2.5", "", ""},
+		{ts, "queue.depth", "gauge", "", "1", "7", "7", "7", "7", "", ""},
+		{ts, "keys", "kv", "", "1", "4", "4", "4", "4", "4", "4"},
+		{ts, "api.latency", "sample", "", "100", "5050", "1", "100", "50.5", "95.05", "99.01"},
+	}
+	if !reflect.DeepEqual(rows[1:], want) {
+		t.Fatalf("bad rows %v", rows[1:])
+	}
+}
+
+func TestCSVSink_EndedIntervals(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewCSVSink(CSVOpts{Writer: &buf, Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	s.IncrCounter([]string{"a"}, 1)
+
+	// The current interval is not written until it ended
+	now := time.Now()
+	if err := s.flush(now, false); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if rows, _ := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll(); len(rows) != 1 {
+		t.Fatalf("bad rows %v", rows)
+	}
+
+	if err := s.flush(now.Add(time.Hour), false); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if rows, _ := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll(); len(rows) != 2 {
+		t.Fatalf("bad rows %v", rows)
+	}
+
+	// Intervals are written once
+	if err := s.flush(now.Add(2*time.Hour), false); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if rows, _ := csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll(); len(rows) != 2 {
+		t.Fatalf("bad rows %v", rows)
+	}
+}
+
+func TestCSVSink_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.csv")
+	for i := 0; i < 2; i++ {
+		s, err := NewCSVSink(CSVOpts{Path: path, Interval: time.Hour})
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		s.IncrCounter([]string{"restarts"}, 1)
+		s.Shutdown()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	// The header is only written to a new file
+	if len(rows) != 3 || rows[0][0] != "timestamp" || rows[1][1] != "restarts" || rows[2][1] != "restarts" {
+		t.Fatalf("bad rows %v", rows)
+	}
+
+	if _, err := NewCSVSink(CSVOpts{}); err == nil {
+		t.Fatalf("expected a missing path and writer to fail")
+	}
+}
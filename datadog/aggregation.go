@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package datadog
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// aggregator implements the client side aggregation of DogStatsdSink,
+// keeping one value per metric name and tag set
+type aggregator struct {
+	lock   sync.Mutex
+	gauges map[string]*aggregateContext
+	counts map[string]*aggregateContext
+}
+
+// aggregateContext is the value of one metric name and tag set
+type aggregateContext struct {
+	name string
+	tags []string
+	val  float64
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		gauges: make(map[string]*aggregateContext),
+		counts: make(map[string]*aggregateContext),
+	}
+}
+
+// gauge keeps the last value of a gauge.
+func (a *aggregator) gauge(name string, tags []string, val float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.context(a.gauges, name, tags).val = val
+}
+
+// count sums the increments of a counter.
+func (a *aggregator) count(name string, tags []string, val float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.context(a.counts, name, tags).val += val
+}
+
+// context returns the entry for name and tags, creating it if needed. The
+// lock must be held.
+func (a *aggregator) context(m map[string]*aggregateContext, name string, tags []string) *aggregateContext {
+	id := name + "|" + strings.Join(tags, ",")
+	c, ok := m[id]
+	if !ok {
+		c = &aggregateContext{name: name, tags: tags}
+		m[id] = c
+	}
+	return c
+}
+
+// drain returns and resets the aggregated gauges and counts, each sorted by
+// context.
+func (a *aggregator) drain() ([]*aggregateContext, []*aggregateContext) {
+	a.lock.Lock()
+	gauges, counts := a.gauges, a.counts
+	a.gauges = make(map[string]*aggregateContext, len(gauges))
+	a.counts = make(map[string]*aggregateContext, len(counts))
+	a.lock.Unlock()
+
+	return sortedContexts(gauges), sortedContexts(counts)
+}
+
+func sortedContexts(m map[string]*aggregateContext) []*aggregateContext {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := make([]*aggregateContext, len(ids))
+	for i, id := range ids {
+		out[i] = m[id]
+	}
+	return out
+}
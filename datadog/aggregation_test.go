@@ -0,0 +1,31 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package datadog
+
+import (
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator()
+	a.count("requests", []string{"code:200"}, 1)
+	a.count("requests", []string{"code:500"}, 1)
+	a.count("requests", []string{"code:200"}, 2)
+	a.gauge("queue", nil, 3)
+	a.gauge("queue", nil, 1)
+
+	gauges, counts := a.drain()
+	if len(gauges) != 1 || gauges[0].name != "queue" || gauges[0].val != 1 {
+		t.Fatalf("bad gauges %+v", gauges)
+	}
+	if len(counts) != 2 || counts[0].val != 3 || counts[0].tags[0] != "code:200" || counts[1].val != 1 {
+		t.Fatalf("bad counts %+v", counts)
+	}
+
+	// Draining resets the aggregates
+	gauges, counts = a.drain()
+	if len(gauges) != 0 || len(counts) != 0 {
+		t.Fatalf("expected empty aggregates, got %+v %+v", gauges, counts)
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package datadog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+const (
+	// DefaultAPISite is the Datadog site used when DatadogAPIOpts.Site is
+	// empty
+	DefaultAPISite = "datadoghq.com"
+
+	// defaultAPIFlushInterval is used when DatadogAPIOpts.FlushInterval is
+	// not set
+	defaultAPIFlushInterval = 10 * time.Second
+
+	// maxSeriesPerRequest bounds the size of a single submission, keeping
+	// payloads well under the intake limits
+	maxSeriesPerRequest = 1000
+)
+
+// Series types of the v2 metrics intake API
+const (
+	apiTypeCount = 1
+	apiTypeGauge = 3
+)
+
+// DatadogAPIOpts is used to configure a DatadogAPISink.
+type DatadogAPIOpts struct {
+	// APIKey authenticates submissions, it is required
+	APIKey string
+
+	// Site is the Datadog site to submit to, such as "datadoghq.eu". It
+	// defaults to DefaultAPISite.
+	Site string
+
+	// FlushInterval is how often aggregated metrics are submitted. It
+	// defaults to 10 seconds.
+	FlushInterval time.Duration
+
+	// HostName is attached to every series as the host resource
+	HostName string
+
+	// Tags are added to every series
+	Tags []string
+
+	// HTTPClient is used for submissions, it defaults to a client with a
+	// 10 second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of submissions, which are gzip
+	// compressed by default
+	Compression metrics.HTTPCompression
+
+	// RetryPolicy applies to failed submissions, it defaults to
+	// metrics.DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *metrics.RetryPolicy
+}
+
+// DatadogAPISink provides a MetricSink that submits series directly to the
+// Datadog v2 metrics intake API, for environments such as Cloud Run or Lambda
+// where a dogstatsd agent is not available. Metrics are aggregated in memory
+// and submitted as compressed batches on every flush interval.
+//
+// Gauges report their last value, counters their sum over the interval, and
+// samples are submitted as .count, .min, .max and .avg series. EmitKey is not
+// supported.
+type DatadogAPISink struct {
+	endpoint      string
+	apiKey        string
+	hostName      string
+	tags          []string
+	client        *http.Client
+	encoder       *metrics.HTTPEncoder
+	retry         metrics.RetryPolicy
+	flushInterval time.Duration
+
+	lock   sync.Mutex
+	series map[string]*apiSeries
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// apiSeries aggregates one metric and tag set over a flush interval
+type apiSeries struct {
+	name  string
+	tags  []string
+	kind  string
+	last  float64
+	sum   float64
+	count int
+	min   float64
+	max   float64
+}
+
+// NewDatadogAPISink creates a DatadogAPISink and starts its flush loop.
+func NewDatadogAPISink(opts DatadogAPIOpts) (*DatadogAPISink, error) {
+	if opts.APIKey == "" {
+		return nil, fmt.Errorf("datadog API key is required")
+	}
+	site := opts.Site
+	if site == "" {
+		site = DefaultAPISite
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = defaultAPIFlushInterval
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	encoder, err := metrics.NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	retry := metrics.DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	s := &DatadogAPISink{
+		endpoint:      fmt.Sprintf("https://api.%s/api/v2/series", site),
+		apiKey:        opts.APIKey,
+		hostName:      opts.HostName,
+		tags:          opts.Tags,
+		client:        client,
+		encoder:       encoder,
+		retry:         retry,
+		flushInterval: interval,
+		series:        make(map[string]*apiSeries),
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Capabilities reports what the Datadog API sink supports.
+func (s *DatadogAPISink) Capabilities() metrics.Capabilities {
+	return metrics.Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+func (s *DatadogAPISink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *DatadogAPISink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("gauge", key, float64(val), labels)
+}
+
+func (s *DatadogAPISink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *DatadogAPISink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []metrics.Label) {
+	s.record("gauge", key, val, labels)
+}
+
+// EmitKey is not implemented since the Datadog API does not provide a metric
+// type that holds an arbitrary number of values
+func (s *DatadogAPISink) EmitKey(key []string, val float32) {
+}
+
+func (s *DatadogAPISink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *DatadogAPISink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("counter", key, float64(val), labels)
+}
+
+func (s *DatadogAPISink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *DatadogAPISink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("sample", key, float64(val), labels)
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// submitted.
+func (s *DatadogAPISink) Shutdown() {
+	close(s.stopCh)
+	<-s.doneCh
+}
+
+// Flush submits the metrics aggregated so far immediately.
+func (s *DatadogAPISink) Flush() {
+	if err := s.flush(time.Now()); err != nil {
+		log.Printf("[ERR] Error submitting to Datadog! Err: %s", err)
+	}
+}
+
+func (s *DatadogAPISink) run() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(metrics.JitterInterval(s.flushInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(metrics.JitterInterval(s.flushInterval))
+			s.Flush()
+		case <-s.stopCh:
+			s.Flush()
+			return
+		}
+	}
+}
+
+func (s *DatadogAPISink) record(kind string, key []string, val float64, labels []metrics.Label) {
+	name := strings.Map(sanitize, strings.Join(key, "."))
+	tags := formatTags(labels)
+	id := kind + "|" + name + "|" + strings.Join(tags, ",")
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ser, ok := s.series[id]
+	if !ok {
+		ser = &apiSeries{name: name, tags: tags, kind: kind, min: val, max: val}
+		s.series[id] = ser
+	}
+	ser.last = val
+	ser.sum += val
+	ser.count++
+	if val < ser.min {
+		ser.min = val
+	}
+	if val > ser.max {
+		ser.max = val
+	}
+}
+
+// apiPayload is the body of a v2 series submission
+type apiPayload struct {
+	Series []apiPayloadSeries `json:"series"`
+}
+
+type apiPayloadSeries struct {
+	Metric    string        `json:"metric"`
+	Type      int           `json:"type"`
+	Interval  int64         `json:"interval,omitempty"`
+	Points    []apiPoint    `json:"points"`
+	Tags      []string      `json:"tags,omitempty"`
+	Resources []apiResource `json:"resources,omitempty"`
+}
+
+type apiPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type apiResource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// flush swaps out the aggregated series and submits them in batches.
+func (s *DatadogAPISink) flush(now time.Time) error {
+	s.lock.Lock()
+	pending := s.series
+	s.series = make(map[string]*apiSeries)
+	s.lock.Unlock()
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(s.flushInterval))
+	defer cancel()
+
+	out := s.buildSeries(pending, now)
+	for len(out) > 0 {
+		n := len(out)
+		if n > maxSeriesPerRequest {
+			n = maxSeriesPerRequest
+		}
+		payload := apiPayload{Series: out[:n]}
+		err := s.retry.Do(ctx, "Datadog", func() error {
+			return s.submit(payload)
+		})
+		if err != nil {
+			return err
+		}
+		out = out[n:]
+	}
+	return nil
+}
+
+func (s *DatadogAPISink) buildSeries(pending map[string]*apiSeries, now time.Time) []apiPayloadSeries {
+	ts := now.Unix()
+	interval := int64(s.flushInterval / time.Second)
+
+	var resources []apiResource
+	if s.hostName != "" {
+		resources = []apiResource{{Name: s.hostName, Type: "host"}}
+	}
+
+	var out []apiPayloadSeries
+	add := func(name string, typ int, val float64, tags []string) {
+		ser := apiPayloadSeries{
+			Metric:    name,
+			Type:      typ,
+			Points:    []apiPoint{{Timestamp: ts, Value: val}},
+			Tags:      append(append([]string(nil), s.tags...), tags...),
+			Resources: resources,
+		}
+		if typ == apiTypeCount {
+			ser.Interval = interval
+		}
+		out = append(out, ser)
+	}
+
+	for _, ser := range pending {
+		switch ser.kind {
+		case "gauge":
+			add(ser.name, apiTypeGauge, ser.last, ser.tags)
+		case "counter":
+			add(ser.name, apiTypeCount, ser.sum, ser.tags)
+		case "sample":
+			add(ser.name+".count", apiTypeCount, float64(ser.count), ser.tags)
+			add(ser.name+".min", apiTypeGauge, ser.min, ser.tags)
+			add(ser.name+".max", apiTypeGauge, ser.max, ser.tags)
+			add(ser.name+".avg", apiTypeGauge, ser.sum/float64(ser.count), ser.tags)
+		}
+	}
+
+	// Keep submissions deterministic, which also helps compression
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Metric != out[j].Metric {
+			return out[i].Metric < out[j].Metric
+		}
+		return strings.Join(out[i].Tags, ",") < strings.Join(out[j].Tags, ",")
+	})
+	return out
+}
+
+func (s *DatadogAPISink) submit(payload apiPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("DD-API-KEY", s.apiKey)
+
+	resp, err := s.encoder.Do(s.client, http.MethodPost, s.endpoint, body, header)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return metrics.CheckHTTPResponse(resp)
+}
@@ -0,0 +1,153 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package datadog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+func TestDatadogAPISink(t *testing.T) {
+	var payloads []apiPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("DD-API-KEY") != "secret" || r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("bad headers: %v", r.Header)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		var p apiPayload
+		if err := json.NewDecoder(zr).Decode(&p); err != nil {
+			t.Errorf("bad body: %s", err)
+		}
+		payloads = append(payloads, p)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	s, err := NewDatadogAPISink(DatadogAPIOpts{
+		APIKey:        "secret",
+		FlushInterval: time.Hour,
+		HostName:      "node1",
+		Tags:          []string{"env:test"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	s.endpoint = srv.URL
+
+	s.SetGauge([]string{"queue", "depth"}, 3)
+	s.SetGauge([]string{"queue", "depth"}, 5)
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []metrics.Label{{Name: "code", Value: "200"}})
+	s.IncrCounterWithLabels([]string{"requests"}, 3, []metrics.Label{{Name: "code", Value: "200"}})
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+
+	if err := s.flush(time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("expected one submission, got %d", len(payloads))
+	}
+
+	got := make(map[string]apiPayloadSeries)
+	for _, ser := range payloads[0].Series {
+		got[ser.Metric] = ser
+	}
+	for _, tc := range []struct {
+		metric string
+		typ    int
+		value  float64
+	}{
+		{"queue.depth", apiTypeGauge, 5},
+		{"requests", apiTypeCount, 5},
+		{"latency.count", apiTypeCount, 2},
+		{"latency.min", apiTypeGauge, 10},
+		{"latency.max", apiTypeGauge, 30},
+		{"latency.avg", apiTypeGauge, 20},
+	} {
+		ser, ok := got[tc.metric]
+		if !ok {
+			t.Fatalf("missing series %s", tc.metric)
+		}
+		if ser.Type != tc.typ || ser.Points[0].Value != tc.value || ser.Points[0].Timestamp != 1700000000 {
+			t.Fatalf("bad series %s: %+v", tc.metric, ser)
+		}
+		if ser.Resources[0].Name != "node1" || ser.Tags[0] != "env:test" {
+			t.Fatalf("bad series %s: %+v", tc.metric, ser)
+		}
+	}
+	if tags := got["requests"].Tags; len(tags) != 2 || tags[1] != "code:200" {
+		t.Fatalf("bad tags: %v", tags)
+	}
+
+	// Nothing is submitted for an empty interval
+	if err := s.flush(time.Now()); err != nil || len(payloads) != 1 {
+		t.Fatalf("unexpected submission: %v %d", err, len(payloads))
+	}
+}
+
+func TestDatadogAPISink_Errors(t *testing.T) {
+	if _, err := NewDatadogAPISink(DatadogAPIOpts{}); err == nil {
+		t.Fatalf("expected error without an API key")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	s, err := NewDatadogAPISink(DatadogAPIOpts{APIKey: "bad", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	s.endpoint = srv.URL
+
+	s.IncrCounter([]string{"a"}, 1)
+	if err := s.flush(time.Now()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestDatadogAPISink_Retry(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	s, err := NewDatadogAPISink(DatadogAPIOpts{
+		APIKey:        "secret",
+		FlushInterval: time.Hour,
+		RetryPolicy:   &metrics.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	s.endpoint = srv.URL
+
+	s.SetGauge([]string{"queue", "depth"}, 3)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected a retry, got %d attempts", attempts)
+	}
+}
@@ -5,34 +5,234 @@ package datadog
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/hashicorp/go-metrics"
 )
 
+const (
+	// defaultAggregationInterval is used when
+	// DogStatsdOpts.AggregationFlushInterval is not set
+	defaultAggregationInterval = 2 * time.Second
+
+	// telemetryInterval matches the interval of the telemetry built into
+	// the datadog-go client
+	telemetryInterval = statsd.TelemetryInterval
+)
+
+func init() {
+	metrics.RegisterSinkScheme("dogstatsd", NewDogStatsdSinkFromURL)
+}
+
+// DogStatsdOpts is used to configure a DogStatsdSink with
+// NewDogStatsdSinkWithOpts.
+type DogStatsdOpts struct {
+	// Addr is the dogstatsd address, either "host:port" or
+	// "unix:///path/to/socket". The Kubernetes agent recommends its Unix
+	// socket, usually "unix:///var/run/datadog/dsd.socket", over UDP on a
+	// host port, as datagrams are not lost silently when the agent falls
+	// behind.
+	Addr string
+
+	// HostName is spliced out of keys, see EnableHostNamePropagation
+	HostName string
+
+	// Tags are sent with every metric
+	Tags []string
+
+	// The following options are passed through to the datadog-go client,
+	// which picks its own defaults when they are zero. Raising the buffer
+	// pool and sender queue sizes avoids dropping packets in bursts.
+	MaxBytesPerPayload    int
+	MaxMessagesPerPayload int
+	BufferPoolSize        int
+	BufferFlushInterval   time.Duration
+	SenderQueueSize       int
+	WriteTimeoutUDS       time.Duration
+
+	// ClientAggregation sums counters and keeps the last value of gauges
+	// for every metric and tag set in the sink, and sends them once every
+	// AggregationFlushInterval rather than one message per call. Samples
+	// are always sent as they are, so the agent still sees every value.
+	ClientAggregation bool
+
+	// AggregationFlushInterval defaults to 2 seconds
+	AggregationFlushInterval time.Duration
+
+	// Telemetry sends datadog.dogstatsd.client.metrics, split by the
+	// metrics_type tag, datadog.dogstatsd.client.aggregated_context and
+	// datadog.dogstatsd.client.errors every 10 seconds, next to the packet
+	// telemetry of the datadog-go client itself
+	Telemetry bool
+}
+
+// DogStatsdStats counts what a DogStatsdSink has handed to the client.
+type DogStatsdStats struct {
+	Gauges   uint64
+	Counters uint64
+	Samples  uint64
+
+	// AggregatedContexts is the number of metric and tag sets sent by
+	// client side aggregation, which replace the calls they aggregate
+	AggregatedContexts uint64
+
+	// Errors is the number of metrics the client refused
+	Errors uint64
+}
+
 // DogStatsdSink provides a MetricSink that can be used
 // with a dogstatsd server. It utilizes the Dogstatsd client at github.com/DataDog/datadog-go/statsd
 type DogStatsdSink struct {
 	client            *statsd.Client
 	hostName          string
 	propagateHostname bool
+
+	// agg holds the client side aggregates, when enabled
+	agg       *aggregator
+	telemetry bool
+
+	// counters backing Stats
+	gauges, counters, samples, contexts, errors uint64
+
+	// stopCh and doneCh control the goroutine flushing the aggregates and
+	// sending telemetry, which only runs when either is enabled
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
 }
 
 // NewDogStatsdSink is used to create a new DogStatsdSink with sane defaults
 func NewDogStatsdSink(addr string, hostName string) (*DogStatsdSink, error) {
-	client, err := statsd.New(addr)
+	return NewDogStatsdSinkWithOpts(DogStatsdOpts{Addr: addr, HostName: hostName})
+}
+
+// NewDogStatsdSinkWithOpts creates a DogStatsdSink with control over the
+// buffering of the client, client side aggregation and telemetry.
+func NewDogStatsdSinkWithOpts(opts DogStatsdOpts) (*DogStatsdSink, error) {
+	if opts.Addr == statsd.UnixAddressPrefix {
+		return nil, fmt.Errorf("dogstatsd unix socket path is required")
+	}
+	var options []statsd.Option
+	if opts.MaxBytesPerPayload > 0 {
+		options = append(options, statsd.WithMaxBytesPerPayload(opts.MaxBytesPerPayload))
+	}
+	if opts.MaxMessagesPerPayload > 0 {
+		options = append(options, statsd.WithMaxMessagesPerPayload(opts.MaxMessagesPerPayload))
+	}
+	if opts.BufferPoolSize > 0 {
+		options = append(options, statsd.WithBufferPoolSize(opts.BufferPoolSize))
+	}
+	if opts.BufferFlushInterval > 0 {
+		options = append(options, statsd.WithBufferFlushInterval(opts.BufferFlushInterval))
+	}
+	if opts.SenderQueueSize > 0 {
+		options = append(options, statsd.WithSenderQueueSize(opts.SenderQueueSize))
+	}
+	if opts.WriteTimeoutUDS > 0 {
+		options = append(options, statsd.WithWriteTimeoutUDS(opts.WriteTimeoutUDS))
+	}
+	if len(opts.Tags) > 0 {
+		options = append(options, statsd.WithTags(opts.Tags))
+	}
+	client, err := statsd.New(opts.Addr, options...)
 	if err != nil {
 		return nil, err
 	}
 	sink := &DogStatsdSink{
 		client:            client,
-		hostName:          hostName,
+		hostName:          opts.HostName,
 		propagateHostname: false,
+		telemetry:         opts.Telemetry,
+	}
+	if !opts.ClientAggregation && !opts.Telemetry {
+		return sink, nil
+	}
+
+	interval := opts.AggregationFlushInterval
+	if interval <= 0 {
+		interval = defaultAggregationInterval
 	}
+	if opts.ClientAggregation {
+		sink.agg = newAggregator()
+	}
+	sink.stopCh = make(chan struct{})
+	sink.doneCh = make(chan struct{})
+	go sink.run(interval)
 	return sink, nil
 }
 
+// NewDogStatsdSinkFromURL creates a DogStatsdSink from a URL. It is
+// registered for the "dogstatsd" scheme of metrics.NewMetricSinkFromURL once
+// this package is imported. The host and port become the address, or the
+// path of the Unix socket when there is no host, as in
+// "dogstatsd:///var/run/datadog/dsd.socket". URLs of the "unix" scheme, such
+// as the "unix:///var/run/datadog/dsd.socket" the agent advertises in
+// DD_DOGSTATSD_URL, are accepted when this function is called directly.
+//
+// The optional "hostname", "tags" (comma separated), "client_aggregation",
+// "aggregation_interval", "telemetry", "max_bytes_per_payload",
+// "max_messages_per_payload", "buffer_pool_size", "buffer_flush_interval",
+// "sender_queue_size" and "write_timeout_uds" parameters set the matching
+// DogStatsdOpts.
+func NewDogStatsdSinkFromURL(u *url.URL) (metrics.MetricSink, error) {
+	params := u.Query()
+	opts := DogStatsdOpts{
+		Addr:     u.Host,
+		HostName: params.Get("hostname"),
+	}
+	if u.Scheme == "unix" || u.Host == "" {
+		if u.Path == "" {
+			return nil, fmt.Errorf("dogstatsd address is required")
+		}
+		opts.Addr = statsd.UnixAddressPrefix + u.Path
+	}
+	if tags := params.Get("tags"); tags != "" {
+		opts.Tags = strings.Split(tags, ",")
+	}
+
+	var err error
+	parseBool := func(name string, dst *bool) {
+		if v := params.Get(name); v != "" && err == nil {
+			if *dst, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("bad '%s' param: %s", name, err)
+			}
+		}
+	}
+	parseInt := func(name string, dst *int) {
+		if v := params.Get(name); v != "" && err == nil {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("bad '%s' param: %s", name, err)
+			}
+		}
+	}
+	parseDuration := func(name string, dst *time.Duration) {
+		if v := params.Get(name); v != "" && err == nil {
+			if *dst, err = time.ParseDuration(v); err != nil {
+				err = fmt.Errorf("bad '%s' param: %s", name, err)
+			}
+		}
+	}
+	parseBool("client_aggregation", &opts.ClientAggregation)
+	parseDuration("aggregation_interval", &opts.AggregationFlushInterval)
+	parseBool("telemetry", &opts.Telemetry)
+	parseInt("max_bytes_per_payload", &opts.MaxBytesPerPayload)
+	parseInt("max_messages_per_payload", &opts.MaxMessagesPerPayload)
+	parseInt("buffer_pool_size", &opts.BufferPoolSize)
+	parseDuration("buffer_flush_interval", &opts.BufferFlushInterval)
+	parseInt("sender_queue_size", &opts.SenderQueueSize)
+	parseDuration("write_timeout_uds", &opts.WriteTimeoutUDS)
+	if err != nil {
+		return nil, err
+	}
+	return NewDogStatsdSinkWithOpts(opts)
+}
+
 // SetTags sets common tags on the Dogstatsd Client that will be sent
 // along with all dogstatsd packets.
 // Ref: http://docs.datadoghq.com/guides/dogstatsd/#tags
@@ -87,6 +287,11 @@ func (s *DogStatsdSink) parseKey(key []string) ([]string, []metrics.Label) {
 	return key, labels
 }
 
+// Capabilities reports what the DogStatsd sink supports.
+func (s *DogStatsdSink) Capabilities() metrics.Capabilities {
+	return metrics.Capabilities{PrecisionFloats: true, Tags: true}
+}
+
 // Implementation of methods in the MetricSink interface
 
 func (s *DogStatsdSink) SetGauge(key []string, val float32) {
@@ -113,41 +318,150 @@ func (s *DogStatsdSink) AddSample(key []string, val float32) {
 // The following ...WithLabels methods correspond to Datadog's Tag extension to Statsd.
 // http://docs.datadoghq.com/guides/dogstatsd/#tags
 func (s *DogStatsdSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
-	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
-	rate := 1.0
-	_ = s.client.Gauge(flatKey, float64(val), tags, rate)
+	s.SetPrecisionGaugeWithLabels(key, float64(val), labels)
 }
 
 // The following ...WithLabels methods correspond to Datadog's Tag extension to Statsd.
 // http://docs.datadoghq.com/guides/dogstatsd/#tags
 func (s *DogStatsdSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []metrics.Label) {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
-	rate := 1.0
-	_ = s.client.Gauge(flatKey, val, tags, rate)
+	if s.agg != nil {
+		s.agg.gauge(flatKey, tags, val)
+		return
+	}
+	s.gauge(flatKey, val, tags)
 }
 
 func (s *DogStatsdSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
-	rate := 1.0
-	_ = s.client.Count(flatKey, int64(val), tags, rate)
+	if s.agg != nil {
+		s.agg.count(flatKey, tags, float64(val))
+		return
+	}
+	s.count(flatKey, float64(val), tags)
 }
 
 func (s *DogStatsdSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(key, labels)
 	rate := 1.0
-	_ = s.client.TimeInMilliseconds(flatKey, float64(val), tags, rate)
+	s.record(&s.samples, s.client.TimeInMilliseconds(flatKey, float64(val), tags, rate))
+}
+
+// Stats returns what the sink has handed to the client so far, which can be
+// passed through to another sink.
+func (s *DogStatsdSink) Stats() DogStatsdStats {
+	return DogStatsdStats{
+		Gauges:             atomic.LoadUint64(&s.gauges),
+		Counters:           atomic.LoadUint64(&s.counters),
+		Samples:            atomic.LoadUint64(&s.samples),
+		AggregatedContexts: atomic.LoadUint64(&s.contexts),
+		Errors:             atomic.LoadUint64(&s.errors),
+	}
+}
+
+// Flush sends the client side aggregates, if enabled, and blocks until the
+// buffers of the client are written.
+func (s *DogStatsdSink) Flush() {
+	if s.agg != nil {
+		s.flushAggregates()
+	}
+	_ = s.client.Flush()
 }
 
 // Shutdown disables further metric collection, blocks to flush data, and tears down the sink.
 func (s *DogStatsdSink) Shutdown() {
+	if s.stopCh != nil {
+		s.stopOnce.Do(func() {
+			close(s.stopCh)
+			<-s.doneCh
+		})
+	}
 	_ = s.client.Close()
 }
 
+func (s *DogStatsdSink) gauge(name string, val float64, tags []string) {
+	s.record(&s.gauges, s.client.Gauge(name, val, tags, 1))
+}
+
+func (s *DogStatsdSink) count(name string, val float64, tags []string) {
+	s.record(&s.counters, s.client.Count(name, int64(val), tags, 1))
+}
+
+// record counts a metric handed to the client, or the error it returned.
+func (s *DogStatsdSink) record(counter *uint64, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		return
+	}
+	atomic.AddUint64(counter, 1)
+}
+
+// run flushes the aggregates and sends telemetry until Shutdown.
+func (s *DogStatsdSink) run(interval time.Duration) {
+	defer close(s.doneCh)
+	aggTicker := time.NewTicker(metrics.JitterInterval(interval))
+	defer aggTicker.Stop()
+	telemetryTicker := time.NewTicker(telemetryInterval)
+	defer telemetryTicker.Stop()
+
+	var last DogStatsdStats
+	for {
+		select {
+		case <-aggTicker.C:
+			aggTicker.Reset(metrics.JitterInterval(interval))
+			if s.agg != nil {
+				s.flushAggregates()
+			}
+		case <-telemetryTicker.C:
+			if s.telemetry {
+				last = s.sendTelemetry(last)
+			}
+		case <-s.stopCh:
+			if s.agg != nil {
+				s.flushAggregates()
+			}
+			return
+		}
+	}
+}
+
+// flushAggregates sends one gauge or count per aggregated context.
+func (s *DogStatsdSink) flushAggregates() {
+	gauges, counts := s.agg.drain()
+	for _, c := range gauges {
+		s.gauge(c.name, c.val, c.tags)
+	}
+	for _, c := range counts {
+		s.count(c.name, c.val, c.tags)
+	}
+	atomic.AddUint64(&s.contexts, uint64(len(gauges)+len(counts)))
+}
+
+// sendTelemetry sends the change of the stats since last, bypassing the
+// aggregation and the stats themselves.
+func (s *DogStatsdSink) sendTelemetry(last DogStatsdStats) DogStatsdStats {
+	cur := s.Stats()
+	send := func(name string, val uint64, tags ...string) {
+		_ = s.client.Count(name, int64(val), append([]string{"client:go"}, tags...), 1)
+	}
+	send("datadog.dogstatsd.client.metrics", cur.Gauges-last.Gauges, "metrics_type:gauge")
+	send("datadog.dogstatsd.client.metrics", cur.Counters-last.Counters, "metrics_type:count")
+	send("datadog.dogstatsd.client.metrics", cur.Samples-last.Samples, "metrics_type:timing")
+	send("datadog.dogstatsd.client.aggregated_context", cur.AggregatedContexts-last.AggregatedContexts)
+	send("datadog.dogstatsd.client.errors", cur.Errors-last.Errors)
+	return cur
+}
+
 func (s *DogStatsdSink) getFlatkeyAndCombinedLabels(key []string, labels []metrics.Label) (string, []string) {
 	key, parsedLabels := s.parseKey(key)
 	flatKey := s.flattenKey(key)
 	labels = append(labels, parsedLabels...)
 
+	return flatKey, formatTags(labels)
+}
+
+// formatTags converts labels into Datadog name:value tags
+func formatTags(labels []metrics.Label) []string {
 	var tags []string
 	for _, label := range labels {
 		label.Name = strings.Map(sanitize, label.Name)
@@ -158,6 +472,5 @@ func (s *DogStatsdSink) getFlatkeyAndCombinedLabels(key []string, labels []metri
 			tags = append(tags, label.Name)
 		}
 	}
-
-	return flatKey, tags
+	return tags
 }
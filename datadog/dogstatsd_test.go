@@ -5,8 +5,12 @@ package datadog
 
 import (
 	"net"
+	"net/url"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-metrics"
 )
@@ -167,3 +171,112 @@ func TestMetricSinkInterface(t *testing.T) {
 	var dd *DogStatsdSink
 	_ = metrics.MetricSink(dd)
 }
+
+func TestClientAggregation(t *testing.T) {
+	server, buf := setupTestServerAndBuffer(t)
+	defer func() { _ = server.Close() }()
+
+	dog, err := NewDogStatsdSinkWithOpts(DogStatsdOpts{
+		Addr:                     DogStatsdAddr,
+		ClientAggregation:        true,
+		AggregationFlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer dog.Shutdown()
+
+	labels := []metrics.Label{{Name: "tagkey", Value: "tagvalue"}}
+	dog.IncrCounterWithLabels([]string{"count", "me"}, 1, labels)
+	dog.IncrCounterWithLabels([]string{"count", "me"}, 2, labels)
+	dog.SetGauge([]string{"gauge"}, 1)
+	dog.SetGauge([]string{"gauge"}, 5)
+	dog.Flush()
+	assertServerMatchesExpected(t, server, buf, "gauge:5|g\ncount.me:3|c|#tagkey:tagvalue")
+
+	// Samples are never aggregated
+	dog.AddSample([]string{"sample"}, 4)
+	dog.Flush()
+	assertServerMatchesExpected(t, server, buf, "sample:4.000000|ms")
+
+	expected := DogStatsdStats{Gauges: 1, Counters: 1, Samples: 1, AggregatedContexts: 2}
+	if stats := dog.Stats(); stats != expected {
+		t.Fatalf("got %+v want %+v", stats, expected)
+	}
+}
+
+func TestNewDogStatsdSinkFromURL(t *testing.T) {
+	for _, tc := range []struct {
+		url       string
+		expectErr string
+	}{
+		{"dogstatsd://" + DogStatsdAddr + "?client_aggregation=true&aggregation_interval=1s&buffer_pool_size=64&sender_queue_size=64&telemetry=false&tags=env:prod,team", ""},
+		{"dogstatsd://" + DogStatsdAddr + "?client_aggregation=maybe", "bad 'client_aggregation' param"},
+		{"dogstatsd://" + DogStatsdAddr + "?buffer_pool_size=big", "bad 'buffer_pool_size' param"},
+		{"dogstatsd://" + DogStatsdAddr + "?buffer_flush_interval=soon", "bad 'buffer_flush_interval' param"},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			// The scheme is registered by importing this package
+			sink, err := metrics.NewMetricSinkFromURL(tc.url)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Fatalf("expected err %q, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			dog := sink.(*DogStatsdSink)
+			defer dog.Shutdown()
+			if dog.agg == nil {
+				t.Fatalf("expected client aggregation")
+			}
+			if !reflect.DeepEqual(dog.client.Tags, []string{"env:prod", "team"}) {
+				t.Fatalf("bad tags %v", dog.client.Tags)
+			}
+		})
+	}
+}
+
+func TestDogStatsdSink_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dsd.socket")
+	server, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %s", err)
+	}
+	defer func() { _ = server.Close() }()
+	buf := make([]byte, 1024)
+
+	for _, raw := range []string{"dogstatsd://" + path, "unix://" + path} {
+		t.Run(raw, func(t *testing.T) {
+			u, err := url.Parse(raw)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			sink, err := NewDogStatsdSinkFromURL(u)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			dog := sink.(*DogStatsdSink)
+			dog.IncrCounter([]string{"count", "me"}, 3)
+			dog.Shutdown()
+
+			_ = server.SetReadDeadline(time.Now().Add(3 * time.Second))
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if got := string(buf[:n]); got != "count.me:3|c" {
+				t.Fatalf("bad datagram %q", got)
+			}
+		})
+	}
+
+	if _, err := NewDogStatsdSink("unix://", ""); err == nil {
+		t.Fatalf("expected a missing socket path to fail")
+	}
+	if _, err := NewDogStatsdSinkFromURL(&url.URL{Scheme: "dogstatsd"}); err == nil {
+		t.Fatalf("expected a missing address to fail")
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package dtls sends statsd traffic over DTLS, which encrypts and
+// authenticates UDP datagrams without the blocking behavior of TCP and TLS.
+// It is kept apart from the metrics package so that only users of DTLS
+// depend on github.com/pion/dtls.
+package dtls
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/go-metrics"
+	"github.com/pion/dtls/v2"
+)
+
+// Dialer returns a metrics.Dialer establishing DTLS sessions with config,
+// which holds the certificates or pre-shared key of the client. Only UDP is
+// supported, so the Dialer fails for Unix domain socket and TCP addresses.
+func Dialer(config *dtls.Config) metrics.Dialer {
+	return func(network, addr string) (net.Conn, error) {
+		if network != "udp" {
+			return nil, fmt.Errorf("dtls requires udp, not %s", network)
+		}
+		raddr, err := net.ResolveUDPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return dtls.Dial(network, raddr, config)
+	}
+}
+
+// NewStatsdSink creates a metrics.StatsdSink sending to the UDP host and
+// port addr over DTLS. The session is established when the sink starts, and
+// again after writing to it fails.
+func NewStatsdSink(addr string, config *dtls.Config) (*metrics.StatsdSink, error) {
+	if config == nil {
+		return nil, fmt.Errorf("dtls config is required")
+	}
+	return metrics.NewStatsdSinkWithDialer(addr, Dialer(config))
+}
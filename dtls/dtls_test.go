@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package dtls
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+func pskConfig() *dtls.Config {
+	return &dtls.Config{
+		PSK:             func([]byte) ([]byte, error) { return []byte("secret key"), nil },
+		PSKIdentityHint: []byte("metrics"),
+		CipherSuites:    []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+	}
+}
+
+func TestNewStatsdSink(t *testing.T) {
+	ln, err := dtls.Listen("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, pskConfig())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		lines <- string(buf[:n])
+	}()
+
+	s, err := NewStatsdSink(ln.Addr().String(), pskConfig())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	select {
+	case <-s.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the handshake")
+	}
+
+	s.IncrCounter([]string{"api", "requests"}, 1)
+	select {
+	case got := <-lines:
+		if got != "api.requests:1.000000|c\n" {
+			t.Fatalf("bad packet %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the metric")
+	}
+}
+
+func TestDialer_Network(t *testing.T) {
+	if _, err := Dialer(pskConfig())("tcp", "127.0.0.1:8125"); err == nil {
+		t.Fatalf("expected tcp to be rejected")
+	}
+	if _, err := NewStatsdSink("127.0.0.1:8125", nil); err == nil {
+		t.Fatalf("expected a missing config to fail")
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dynamicSinks is an immutable set of named sinks
+type dynamicSinks struct {
+	names  []string
+	fanout FanoutSink
+}
+
+// DynamicFanoutSink is a FanoutSink whose member sinks, each identified by a
+// name, can be attached and detached while metrics are being emitted. The
+// emission path never takes a lock.
+type DynamicFanoutSink struct {
+	lock  sync.Mutex // Serializes Attach and Detach
+	sinks atomic.Pointer[dynamicSinks]
+}
+
+// NewDynamicFanoutSink creates a DynamicFanoutSink with the given initial
+// sinks, which may be nil.
+func NewDynamicFanoutSink(sinks map[string]MetricSink) *DynamicFanoutSink {
+	d := &DynamicFanoutSink{}
+	set := &dynamicSinks{}
+	for name := range sinks {
+		set.names = append(set.names, name)
+	}
+	sort.Strings(set.names)
+	for _, name := range set.names {
+		set.fanout = append(set.fanout, sinks[name])
+	}
+	d.sinks.Store(set)
+	return d
+}
+
+// Attach adds a sink under a name, replacing and returning any sink
+// previously attached under it.
+func (d *DynamicFanoutSink) Attach(name string, sink MetricSink) MetricSink {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	old := d.sinks.Load()
+	set := &dynamicSinks{}
+	var replaced MetricSink
+	for i, n := range old.names {
+		if n == name {
+			replaced = old.fanout[i]
+			continue
+		}
+		set.names = append(set.names, n)
+		set.fanout = append(set.fanout, old.fanout[i])
+	}
+	set.names = append(set.names, name)
+	set.fanout = append(set.fanout, sink)
+	d.sinks.Store(set)
+	return replaced
+}
+
+// Detach removes and returns the sink attached under a name, or nil if there
+// is none. The sink is not shut down.
+func (d *DynamicFanoutSink) Detach(name string) MetricSink {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	old := d.sinks.Load()
+	set := &dynamicSinks{}
+	var removed MetricSink
+	for i, n := range old.names {
+		if n == name {
+			removed = old.fanout[i]
+			continue
+		}
+		set.names = append(set.names, n)
+		set.fanout = append(set.fanout, old.fanout[i])
+	}
+	d.sinks.Store(set)
+	return removed
+}
+
+// Sink returns the sink attached under a name, or nil if there is none.
+func (d *DynamicFanoutSink) Sink(name string) MetricSink {
+	set := d.sinks.Load()
+	for i, n := range set.names {
+		if n == name {
+			return set.fanout[i]
+		}
+	}
+	return nil
+}
+
+// Names returns the names of the attached sinks, in the order they were
+// attached.
+func (d *DynamicFanoutSink) Names() []string {
+	return append([]string(nil), d.sinks.Load().names...)
+}
+
+func (d *DynamicFanoutSink) SetGauge(key []string, val float32) {
+	d.sinks.Load().fanout.SetGauge(key, val)
+}
+
+func (d *DynamicFanoutSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	d.sinks.Load().fanout.SetGaugeWithLabels(key, val, labels)
+}
+
+func (d *DynamicFanoutSink) SetPrecisionGauge(key []string, val float64) {
+	d.sinks.Load().fanout.SetPrecisionGauge(key, val)
+}
+
+func (d *DynamicFanoutSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	d.sinks.Load().fanout.SetPrecisionGaugeWithLabels(key, val, labels)
+}
+
+func (d *DynamicFanoutSink) EmitKey(key []string, val float32) {
+	d.sinks.Load().fanout.EmitKey(key, val)
+}
+
+func (d *DynamicFanoutSink) EmitKeys(key []string, vals []float32) {
+	d.sinks.Load().fanout.EmitKeys(key, vals)
+}
+
+func (d *DynamicFanoutSink) IncrCounter(key []string, val float32) {
+	d.sinks.Load().fanout.IncrCounter(key, val)
+}
+
+func (d *DynamicFanoutSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	d.sinks.Load().fanout.IncrCounterWithLabels(key, val, labels)
+}
+
+func (d *DynamicFanoutSink) AddSample(key []string, val float32) {
+	d.sinks.Load().fanout.AddSample(key, val)
+}
+
+func (d *DynamicFanoutSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	d.sinks.Load().fanout.AddSampleWithLabels(key, val, labels)
+}
+
+func (d *DynamicFanoutSink) AddHistogram(key []string, val float64) {
+	d.sinks.Load().fanout.AddHistogram(key, val)
+}
+
+func (d *DynamicFanoutSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	d.sinks.Load().fanout.AddHistogramWithLabels(key, val, labels)
+}
+
+// Capabilities reports the union of the capabilities of the currently
+// attached sinks.
+func (d *DynamicFanoutSink) Capabilities() Capabilities {
+	return d.sinks.Load().fanout.Capabilities()
+}
+
+// RestoreCounters passes restored totals on to the attached sinks which are
+// a CumulativeSink. Sinks attached later start from zero.
+func (d *DynamicFanoutSink) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	d.sinks.Load().fanout.RestoreCounters(start, counters)
+}
+
+// tracksUnits is always true, as a UnitSink may be attached at any time.
+func (d *DynamicFanoutSink) tracksUnits() bool { return true }
+
+func (d *DynamicFanoutSink) setUnit(key, unit string) {
+	d.sinks.Load().fanout.setUnit(key, unit)
+}
+
+// Flush flushes the attached sinks that support it.
+func (d *DynamicFanoutSink) Flush() {
+	d.sinks.Load().fanout.Flush()
+}
+
+// Shutdown shuts down the attached sinks that support it.
+func (d *DynamicFanoutSink) Shutdown() {
+	d.sinks.Load().fanout.Shutdown()
+}
@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDynamicFanoutSink(t *testing.T) {
+	a, b := &MockSink{}, &MockSink{}
+	d := NewDynamicFanoutSink(map[string]MetricSink{"a": a})
+
+	d.IncrCounter([]string{"one"}, 1)
+	if old := d.Attach("b", b); old != nil {
+		t.Fatalf("nothing should be replaced")
+	}
+	d.IncrCounter([]string{"two"}, 1)
+	if !reflect.DeepEqual(d.Names(), []string{"a", "b"}) || d.Sink("b") != b {
+		t.Fatalf("bad sinks: %v", d.Names())
+	}
+
+	if d.Detach("a") != a || d.Detach("a") != nil {
+		t.Fatalf("bad detach")
+	}
+	d.IncrCounter([]string{"three"}, 1)
+
+	if got := a.getKeys(); !reflect.DeepEqual(got, [][]string{{"one"}, {"two"}}) {
+		t.Fatalf("bad keys for a: %v", got)
+	}
+	if got := b.getKeys(); !reflect.DeepEqual(got, [][]string{{"two"}, {"three"}}) {
+		t.Fatalf("bad keys for b: %v", got)
+	}
+
+	c := &MockSink{}
+	if old := d.Attach("b", c); old != b {
+		t.Fatalf("attach should return the replaced sink")
+	}
+	d.Shutdown()
+	if !c.shutdown || b.shutdown {
+		t.Fatalf("only attached sinks should be shut down")
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// BPFMapKeySize is the size of the keys of a BPFMapSink map. Series
+	// names are NUL padded, and longer names are shortened, see BPFMapSink.
+	BPFMapKeySize = 64
+
+	// bpfMapKeyHashSize is the number of hex digits of the hash ending the
+	// keys of series names longer than BPFMapKeySize
+	bpfMapKeyHashSize = 16
+
+	// bpfMapValueSize is the size of the values, a float64 in host byte
+	// order
+	bpfMapValueSize = 8
+
+	// bpfMapEntries is the capacity of maps created by a BPFMapSink when
+	// BPFMapOpts.MaxEntries is not set
+	bpfMapEntries = 1024
+)
+
+// BPFMapOpts is used to configure a BPFMapSink.
+type BPFMapOpts struct {
+	// Path is where the map is pinned in the BPF filesystem, for example
+	// "/sys/fs/bpf/myapp_metrics". An existing map pinned there is reused,
+	// otherwise a hash map is created and pinned.
+	Path string
+
+	// MaxEntries is the capacity of a created map, it defaults to 1024
+	MaxEntries int
+
+	// Prefixes selects the series mirrored into the map by key prefix, with
+	// '.' as the separator. All gauges and counters are mirrored when empty.
+	Prefixes []string
+}
+
+// BPFMapSink is an experimental MetricSink mirroring gauges and counter
+// totals into a pinned eBPF hash map, so kernel programs and tools such as
+// bpftool can read application metrics without any syscall into the
+// application. Keys are series names in the "a.b;name=value" form, NUL
+// padded to BPFMapKeySize bytes, and values are float64 in host byte order.
+// Longer names keep their first bytes followed by '#' and 16 hex digits of
+// their SHA-256 hash, so that they stay distinct. Samples and key/value pairs
+// are ignored.
+//
+// Creating or opening maps requires CAP_BPF, or root on older kernels.
+type BPFMapSink struct {
+	fd       int
+	prefixes []string
+
+	lock   sync.Mutex
+	totals map[string]float64
+}
+
+// NewBPFMapSink opens or creates the pinned map and returns a sink writing
+// to it. An existing map must have the key and value sizes of the sink.
+func NewBPFMapSink(opts BPFMapOpts) (*BPFMapSink, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("bpf map path is required")
+	}
+	fd, err := bpfObjGet(opts.Path)
+	if errors.Is(err, unix.ENOENT) {
+		entries := opts.MaxEntries
+		if entries <= 0 {
+			entries = bpfMapEntries
+		}
+		fd, err = bpfMapCreate(entries)
+		if err == nil {
+			if err = bpfObjPin(fd, opts.Path); err != nil {
+				_ = unix.Close(fd)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bpf map %s: %w", opts.Path, err)
+	}
+	info, err := bpfMapInfoByFd(fd)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to inspect bpf map %s: %w", opts.Path, err)
+	}
+	if info.keySize != BPFMapKeySize || info.valueSize != bpfMapValueSize {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("bpf map %s has %d byte keys and %d byte values, expected %d and %d",
+			opts.Path, info.keySize, info.valueSize, BPFMapKeySize, bpfMapValueSize)
+	}
+	return &BPFMapSink{
+		fd:       fd,
+		prefixes: opts.Prefixes,
+		totals:   make(map[string]float64),
+	}, nil
+}
+
+func (s *BPFMapSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *BPFMapSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.SetPrecisionGaugeWithLabels(key, float64(val), labels)
+}
+
+func (s *BPFMapSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *BPFMapSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	if !s.selected(key) {
+		return
+	}
+	s.update(seriesKey(key, labels), val)
+}
+
+func (s *BPFMapSink) EmitKey(key []string, val float32) {
+}
+
+func (s *BPFMapSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *BPFMapSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if !s.selected(key) {
+		return
+	}
+	series := seriesKey(key, labels)
+
+	s.lock.Lock()
+	s.totals[series] += float64(val)
+	total := s.totals[series]
+	s.lock.Unlock()
+
+	s.update(series, total)
+}
+
+func (s *BPFMapSink) AddSample(key []string, val float32) {
+}
+
+func (s *BPFMapSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+}
+
+// Shutdown closes the map. It stays pinned, so readers keep seeing the last
+// values until the pin is removed.
+func (s *BPFMapSink) Shutdown() {
+	_ = unix.Close(s.fd)
+}
+
+func (s *BPFMapSink) selected(key []string) bool {
+	if len(s.prefixes) == 0 {
+		return true
+	}
+	name := strings.Join(key, ".")
+	for _, p := range s.prefixes {
+		if name == p || strings.HasPrefix(name, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BPFMapSink) update(series string, val float64) {
+	key := bpfMapKey(series)
+	var value [bpfMapValueSize]byte
+	binary.NativeEndian.PutUint64(value[:], math.Float64bits(val))
+	if err := bpfMapUpdate(s.fd, key[:], value[:]); err != nil {
+		log.Printf("[ERR] Error updating bpf map! Err: %s", err)
+	}
+}
+
+// bpfMapKey pads a series name to the key size, or shortens it with its
+// hash when longer
+func bpfMapKey(series string) [BPFMapKeySize]byte {
+	var key [BPFMapKeySize]byte
+	if len(series) <= BPFMapKeySize {
+		copy(key[:], series)
+		return key
+	}
+	sum := sha256.Sum256([]byte(series))
+	n := copy(key[:], series[:BPFMapKeySize-bpfMapKeyHashSize-1])
+	key[n] = '#'
+	hex.Encode(key[n+1:], sum[:bpfMapKeyHashSize/2])
+	return key
+}
+
+// The attributes below mirror the unions of union bpf_attr used by each
+// command.
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfObjInfoAttr struct {
+	bpfFd   uint32
+	infoLen uint32
+	info    uint64
+}
+
+// bpfMapInfo mirrors the leading fields of struct bpf_map_info, which the
+// kernel fills up to the length given
+type bpfMapInfo struct {
+	mapType    uint32
+	id         uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfObjAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+func bpfMapCreate(entries int) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    unix.BPF_MAP_TYPE_HASH,
+		keySize:    BPFMapKeySize,
+		valueSize:  bpfMapValueSize,
+		maxEntries: uint32(entries),
+	}
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return int(fd), err
+}
+
+func bpfMapUpdate(fd int, key, value []byte) error {
+	attr := bpfMapElemAttr{
+		mapFd: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+		flags: unix.BPF_ANY,
+	}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func bpfMapInfoByFd(fd int) (bpfMapInfo, error) {
+	var info bpfMapInfo
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    uint64(uintptr(unsafe.Pointer(&info))),
+	}
+	_, err := bpf(unix.BPF_OBJ_GET_INFO_BY_FD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&info)
+	return info, err
+}
+
+func bpfObjGet(path string) (int, error) {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	attr := bpfObjAttr{pathname: uint64(uintptr(unsafe.Pointer(p)))}
+	fd, err := bpf(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(p)
+	return int(fd), err
+}
+
+func bpfObjPin(fd int, path string) error {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr := bpfObjAttr{pathname: uint64(uintptr(unsafe.Pointer(p))), bpfFd: uint32(fd)}
+	_, err = bpf(unix.BPF_OBJ_PIN, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(p)
+	if err != nil {
+		return &os.PathError{Op: "pin", Path: path, Err: err}
+	}
+	return nil
+}
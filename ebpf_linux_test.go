@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBPFMapKey(t *testing.T) {
+	key := bpfMapKey("api.requests;code=200")
+	if string(key[:21]) != "api.requests;code=200" || key[21] != 0 {
+		t.Fatalf("bad key: %q", key)
+	}
+	if exact := bpfMapKey(strings.Repeat("a", BPFMapKeySize)); exact[BPFMapKeySize-1] != 'a' {
+		t.Fatalf("names of the key size should be kept: %q", exact)
+	}
+
+	// Long names sharing their first bytes get distinct keys
+	long, other := bpfMapKey(strings.Repeat("a", 100)), bpfMapKey(strings.Repeat("a", 101))
+	prefix := BPFMapKeySize - bpfMapKeyHashSize - 1
+	if string(long[:prefix]) != strings.Repeat("a", prefix) || long[prefix] != '#' || long == other {
+		t.Fatalf("long names should be hashed: %q %q", long, other)
+	}
+}
+
+func TestBPFMapSink_Selected(t *testing.T) {
+	s := &BPFMapSink{prefixes: []string{"api"}}
+	if !s.selected([]string{"api", "requests"}) || !s.selected([]string{"api"}) || s.selected([]string{"apis"}) {
+		t.Fatalf("bad prefix selection")
+	}
+}
+
+func TestBPFMapSink(t *testing.T) {
+	path := filepath.Join("/sys/fs/bpf", "go_metrics_test")
+	s, err := NewBPFMapSink(BPFMapOpts{Path: path})
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOSYS) {
+		t.Skipf("bpf maps are not available: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() { _ = unix.Unlink(path) }()
+	defer s.Shutdown()
+
+	s.IncrCounter([]string{"requests"}, 1)
+	s.IncrCounter([]string{"requests"}, 2)
+	if s.totals["requests"] != 3 {
+		t.Fatalf("bad total: %v", s.totals)
+	}
+}
+
+func TestBPFMapInfoByFd(t *testing.T) {
+	fd, err := bpfMapCreate(4)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOSYS) {
+		t.Skipf("bpf maps are not available: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	info, err := bpfMapInfoByFd(fd)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if info.keySize != BPFMapKeySize || info.valueSize != bpfMapValueSize || info.maxEntries != 4 {
+		t.Fatalf("bad map info: %+v", info)
+	}
+}
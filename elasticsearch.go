@@ -0,0 +1,419 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// elasticsearchFlushInterval is used when ElasticsearchOpts.FlushInterval
+	// is not set
+	elasticsearchFlushInterval = 10 * time.Second
+
+	// elasticsearchIndex and elasticsearchIndexDateLayout are used when the
+	// index options are not set, giving monthly indices such as
+	// "metrics-2024.05"
+	elasticsearchIndex           = "metrics-"
+	elasticsearchIndexDateLayout = "2006.01"
+
+	// elasticsearchBatchSize is used when ElasticsearchOpts.BatchSize is not
+	// set
+	elasticsearchBatchSize = 1000
+
+	// elasticsearchMaxBuffered is used when ElasticsearchOpts.MaxBuffered is
+	// not set
+	elasticsearchMaxBuffered = 10000
+)
+
+// ElasticsearchOpts is used to configure an ElasticsearchSink.
+type ElasticsearchOpts struct {
+	// Address is the base URL of the cluster, for example
+	// "http://elasticsearch:9200"
+	Address string
+
+	// Index prefixes the name of every index, it defaults to "metrics-"
+	Index string
+
+	// IndexDateLayout is the time layout of the suffix of every index,
+	// formatted in UTC, it defaults to monthly indices with "2006.01"
+	IndexDateLayout string
+
+	// Username and Password enable basic auth, or APIKey the ApiKey
+	// authorization of Elasticsearch
+	Username string
+	Password string
+	APIKey   string
+
+	// FlushInterval is how often documents are written, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the maximum number of documents per bulk request, it
+	// defaults to 1000
+	BatchSize int
+
+	// MaxBuffered bounds the documents kept for the next flush while the
+	// cluster pushes back or is unreachable, it defaults to 10000. The
+	// oldest documents are dropped beyond it and counted in Dropped.
+	MaxBuffered int
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of requests, which are gzip
+	// compressed by default
+	Compression HTTPCompression
+
+	// RetryPolicy applies to failed requests and to documents rejected
+	// with 429 Too Many Requests, it defaults to DefaultRetryPolicy.
+	// Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// ElasticsearchSink provides a MetricSink which writes a document per series
+// and flush interval to Elasticsearch with the _bulk API, into indices
+// suffixed with the date, such as "metrics-2024.05". Documents look like:
+//
+//	{"@timestamp":"2024-05-02T15:04:05Z","name":"api.latency","type":"sample",
+//	 "value":12.5,"count":4,"sum":50,"min":3,"max":30,
+//	 "labels":{"route":"/users"}}
+//
+// Gauges and key/value pairs report their last value, counters their sum and
+// samples their mean, with counters and samples adding the count and
+// samples the sum, min and max of the interval. Labels become fields of the
+// labels object, which Kibana dashboards can filter and split on.
+//
+// When the cluster pushes back with 429 Too Many Requests, for the whole
+// request or for single documents, the documents are retried within the
+// flush interval and kept for the next flush after that, up to MaxBuffered.
+type ElasticsearchSink struct {
+	url         string
+	headers     http.Header
+	index       string
+	dateLayout  string
+	batchSize   int
+	maxBuffered int
+	client      *http.Client
+	encoder     *HTTPEncoder
+	retry       RetryPolicy
+
+	agg  *intervalAggregator
+	loop *flushLoop
+
+	// pending holds the bulk lines of the documents kept for the next
+	// flush, only used from the flush loop
+	pending [][]byte
+	dropped uint64
+}
+
+// elasticsearchDoc is a document written by an ElasticsearchSink
+type elasticsearchDoc struct {
+	Timestamp time.Time         `json:"@timestamp"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Value     float64           `json:"value"`
+	Count     int               `json:"count,omitempty"`
+	Sum       *float64          `json:"sum,omitempty"`
+	Min       *float64          `json:"min,omitempty"`
+	Max       *float64          `json:"max,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// elasticsearchBulkResponse is the part of a _bulk response needed to find
+// the documents which failed
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// NewElasticsearchSink creates an ElasticsearchSink and starts its flush
+// loop.
+func NewElasticsearchSink(opts ElasticsearchOpts) (*ElasticsearchSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("elasticsearch address is required")
+	}
+	index := opts.Index
+	if index == "" {
+		index = elasticsearchIndex
+	}
+	dateLayout := opts.IndexDateLayout
+	if dateLayout == "" {
+		dateLayout = elasticsearchIndexDateLayout
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = elasticsearchFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = elasticsearchBatchSize
+	}
+	maxBuffered := opts.MaxBuffered
+	if maxBuffered <= 0 {
+		maxBuffered = elasticsearchMaxBuffered
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+	encoder, err := NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case opts.APIKey != "":
+		headers.Set("Authorization", "ApiKey "+opts.APIKey)
+	case opts.Username != "" || opts.Password != "":
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(opts.Username, opts.Password)
+		headers.Set("Authorization", req.Header.Get("Authorization"))
+	}
+
+	s := &ElasticsearchSink{
+		url:         strings.TrimSuffix(opts.Address, "/") + "/_bulk",
+		headers:     headers,
+		index:       index,
+		dateLayout:  dateLayout,
+		batchSize:   batchSize,
+		maxBuffered: maxBuffered,
+		loop:        newFlushLoop(interval),
+		client:      client,
+		encoder:     encoder,
+		retry:       retry,
+		agg:         newIntervalAggregator(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *ElasticsearchSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ElasticsearchSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *ElasticsearchSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *ElasticsearchSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *ElasticsearchSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *ElasticsearchSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ElasticsearchSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *ElasticsearchSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ElasticsearchSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Elasticsearch sink supports.
+func (s *ElasticsearchSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Dropped returns the number of documents dropped because more than
+// MaxBuffered were waiting for the cluster.
+func (s *ElasticsearchSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Shutdown stops the flush loop and blocks while the remaining documents are
+// written.
+func (s *ElasticsearchSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often documents are written, starting from
+// now.
+func (s *ElasticsearchSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *ElasticsearchSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error writing to Elasticsearch! Err: %s", err)
+	}
+}
+
+// flush writes the documents kept from earlier flushes and those of the
+// interval ending now. Documents which could not be written because of
+// push back or connection failures are kept for the next flush.
+func (s *ElasticsearchSink) flush(now time.Time) error {
+	lines := append(s.pending, s.documents(s.agg.drain(), now)...)
+	s.pending = nil
+	if len(lines) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	for len(lines) > 0 {
+		n := min(len(lines), s.batchSize)
+		failed, err := s.bulk(ctx, lines[:n])
+		if err != nil {
+			if s.keep(err) {
+				s.buffer(append(failed, lines[n:]...))
+			}
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// keep reports whether the documents of a failed request may succeed later.
+func (s *ElasticsearchSink) keep(err error) bool {
+	if s.retry.Retryable != nil {
+		return s.retry.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// buffer keeps documents for the next flush, dropping the oldest beyond
+// maxBuffered.
+func (s *ElasticsearchSink) buffer(lines [][]byte) {
+	if extra := len(lines) - s.maxBuffered; extra > 0 {
+		atomic.AddUint64(&s.dropped, uint64(extra))
+		lines = lines[extra:]
+	}
+	s.pending = lines
+}
+
+// bulk writes documents with retries, returning those which were not
+// written when it fails. Documents rejected with 429 or a server error are
+// retried, others are logged and dropped as they would fail again.
+func (s *ElasticsearchSink) bulk(ctx context.Context, lines [][]byte) ([][]byte, error) {
+	pending := lines
+	err := s.retry.Do(ctx, "Elasticsearch", func() error {
+		resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, bytes.Join(pending, nil), s.headers)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if err := CheckHTTPResponse(resp); err != nil {
+			return err
+		}
+
+		var result elasticsearchBulkResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("bad bulk response: %w", err)
+		}
+		if !result.Errors {
+			pending = nil
+			return nil
+		}
+
+		var retry [][]byte
+		var rejected int
+		var firstErr json.RawMessage
+		for i, item := range result.Items {
+			if i >= len(pending) {
+				break
+			}
+			for _, action := range item {
+				switch {
+				case action.Status == http.StatusTooManyRequests, action.Status >= 500:
+					retry = append(retry, pending[i])
+				case action.Status >= 300:
+					rejected++
+					if firstErr == nil {
+						firstErr = action.Error
+					}
+				}
+			}
+		}
+		if rejected > 0 {
+			log.Printf("[ERR] Elasticsearch rejected %d documents! Err: %s", rejected, firstErr)
+		}
+		pending = retry
+		if len(retry) > 0 {
+			return &HTTPStatusError{
+				StatusCode: http.StatusTooManyRequests,
+				Status:     "429 Too Many Requests",
+				Body:       fmt.Sprintf("%d documents rejected", len(retry)),
+			}
+		}
+		return nil
+	})
+	return pending, err
+}
+
+// documents encodes aggregates as bulk index actions, each followed by its
+// document. Series with values JSON cannot represent are skipped.
+func (s *ElasticsearchSink) documents(aggs []*aggregate, now time.Time) [][]byte {
+	if len(aggs) == 0 {
+		return nil
+	}
+	action, _ := json.Marshal(map[string]map[string]string{
+		"index": {"_index": s.index + now.UTC().Format(s.dateLayout)},
+	})
+
+	lines := make([][]byte, 0, len(aggs))
+	for _, a := range aggs {
+		doc := elasticsearchDoc{Timestamp: now.UTC(), Name: strings.Join(a.key, ".")}
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			doc.Type, doc.Value = "gauge", a.last
+		case aggregateCounter:
+			doc.Type, doc.Value, doc.Count = "counter", a.sum, a.count
+		case aggregateSample:
+			doc.Type, doc.Value, doc.Count = "sample", a.mean(), a.count
+			doc.Sum, doc.Min, doc.Max = &a.sum, &a.min, &a.max
+		}
+		if len(a.labels) > 0 {
+			doc.Labels = make(map[string]string, len(a.labels))
+			for _, l := range a.labels {
+				doc.Labels[l.Name] = l.Value
+			}
+		}
+		// Marshalling fails for NaN and infinite values
+		b, err := json.Marshal(doc)
+		if err != nil {
+			continue
+		}
+		line := make([]byte, 0, len(action)+len(b)+2)
+		line = append(line, action...)
+		line = append(line, '\n')
+		line = append(line, b...)
+		lines = append(lines, append(line, '\n'))
+	}
+	return lines
+}
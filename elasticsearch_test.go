@@ -0,0 +1,236 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// elasticsearchServer is a _bulk endpoint keeping every indexed document.
+// status picks the status of a request, or of a document by its name.
+type elasticsearchServer struct {
+	*httptest.Server
+	t *testing.T
+
+	lock     sync.Mutex
+	requests int
+	indices  []string
+	docs     []map[string]interface{}
+	status   func(request int, name string) int
+}
+
+func newElasticsearchServer(t *testing.T, status func(request int, name string) int) *elasticsearchServer {
+	e := &elasticsearchServer{t: t, status: status}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.bulk))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *elasticsearchServer) bulk(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.requests++
+
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" || r.Header.Get("Authorization") != "ApiKey secret" {
+		e.t.Errorf("bad request %s %v", r.URL.Path, r.Header)
+	}
+	if code := e.status(e.requests, ""); code != http.StatusOK {
+		w.WriteHeader(code)
+		return
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		e.t.Errorf("bad body: %s", err)
+		return
+	}
+
+	var items []string
+	errors := false
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var action map[string]map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+			e.t.Errorf("bad action %s", scanner.Bytes())
+			return
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			e.t.Errorf("bad document %s", scanner.Bytes())
+			return
+		}
+		code := e.status(e.requests, doc["name"].(string))
+		if code == http.StatusCreated {
+			e.indices = append(e.indices, action["index"]["_index"])
+			e.docs = append(e.docs, doc)
+		} else {
+			errors = true
+		}
+		items = append(items, fmt.Sprintf(`{"index":{"status":%d,"error":{"type":"x"}}}`, code))
+	}
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+func (e *elasticsearchServer) names() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var names []string
+	for _, doc := range e.docs {
+		names = append(names, doc["name"].(string))
+	}
+	return names
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	srv := newElasticsearchServer(t, func(_ int, name string) int {
+		if name == "" {
+			return http.StatusOK
+		}
+		return http.StatusCreated
+	})
+	s, err := NewElasticsearchSink(ElasticsearchOpts{
+		Address:       srv.URL + "/",
+		APIKey:        "secret",
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"route", "/users"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"route", "/users"}})
+	s.AddSample([]string{"api", "latency"}, 10)
+	s.AddSample([]string{"api", "latency"}, 30)
+	s.SetGauge([]string{"queue"}, 4)
+	now := time.Date(2024, 5, 2, 15, 4, 5, 0, time.UTC)
+	if err := s.flush(now); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if len(srv.docs) != 3 {
+		t.Fatalf("bad docs %v", srv.docs)
+	}
+	for _, index := range srv.indices {
+		if index != "metrics-2024.05" {
+			t.Fatalf("bad index %s", index)
+		}
+	}
+	byName := make(map[string]string)
+	for _, doc := range srv.docs {
+		b, _ := json.Marshal(doc)
+		byName[doc["name"].(string)] = string(b)
+	}
+	expected := map[string]string{
+		"api.latency":  `{"@timestamp":"2024-05-02T15:04:05Z","count":2,"max":30,"min":10,"name":"api.latency","sum":40,"type":"sample","value":20}`,
+		"api.requests": `{"@timestamp":"2024-05-02T15:04:05Z","count":2,"labels":{"route":"/users"},"name":"api.requests","type":"counter","value":3}`,
+		"queue":        `{"@timestamp":"2024-05-02T15:04:05Z","name":"queue","type":"gauge","value":4}`,
+	}
+	for name, want := range expected {
+		if byName[name] != want {
+			t.Fatalf("got %s\nwant %s", byName[name], want)
+		}
+	}
+}
+
+func TestElasticsearchSink_Backpressure(t *testing.T) {
+	srv := newElasticsearchServer(t, func(request int, name string) int {
+		switch {
+		case request == 1 && name == "b":
+			return http.StatusTooManyRequests
+		case name == "bad":
+			return http.StatusBadRequest
+		case (request == 3 || request == 4) && name == "":
+			// The whole request is rejected, past the retry budget
+			return http.StatusTooManyRequests
+		case name == "":
+			return http.StatusOK
+		default:
+			return http.StatusCreated
+		}
+	})
+	s, err := NewElasticsearchSink(ElasticsearchOpts{
+		Address:       srv.URL,
+		APIKey:        "secret",
+		FlushInterval: time.Hour,
+		RetryPolicy:   &RetryPolicy{MaxAttempts: 2},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	// The document rejected with 429 is retried, the bad one dropped
+	s.IncrCounter([]string{"a"}, 1)
+	s.IncrCounter([]string{"b"}, 1)
+	s.IncrCounter([]string{"bad"}, 1)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if got := srv.names(); strings.Join(got, ",") != "a,b" {
+		t.Fatalf("bad docs %v", got)
+	}
+
+	// Past the retries the documents are kept for the next flush
+	s.IncrCounter([]string{"c"}, 1)
+	if err := s.flush(time.Now()); err == nil {
+		t.Fatalf("expected error")
+	}
+	if len(s.pending) != 1 {
+		t.Fatalf("bad pending %d", len(s.pending))
+	}
+	s.IncrCounter([]string{"d"}, 1)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if got := srv.names(); strings.Join(got, ",") != "a,b,c,d" {
+		t.Fatalf("bad docs %v", got)
+	}
+}
+
+func TestElasticsearchSink_MaxBuffered(t *testing.T) {
+	srv := newElasticsearchServer(t, func(int, string) int { return http.StatusServiceUnavailable })
+	s, err := NewElasticsearchSink(ElasticsearchOpts{
+		Address:       srv.URL,
+		APIKey:        "secret",
+		FlushInterval: time.Hour,
+		MaxBuffered:   2,
+		RetryPolicy:   &RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounter([]string{"a"}, 1)
+	s.IncrCounter([]string{"b"}, 1)
+	_ = s.flush(time.Now())
+	s.IncrCounter([]string{"c"}, 1)
+	_ = s.flush(time.Now())
+	if s.Dropped() != 1 || len(s.pending) != 2 {
+		t.Fatalf("bad dropped %d pending %d", s.Dropped(), len(s.pending))
+	}
+	if !strings.Contains(string(s.pending[0]), `"name":"b"`) {
+		t.Fatalf("oldest document not dropped: %s", s.pending[0])
+	}
+}
+
+func TestNewElasticsearchSink_Errors(t *testing.T) {
+	if _, err := NewElasticsearchSink(ElasticsearchOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewElasticsearchSink(ElasticsearchOpts{Address: "http://es", Compression: HTTPCompression{Encodings: []string{"br"}}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
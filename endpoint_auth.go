@@ -0,0 +1,125 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// EndpointAuth restricts access to telemetry endpoints, such as
+// InmemSink.DisplayMetricsHandler, Metrics.AuditHandler or the Prometheus
+// handler. Every configured check must pass, and an empty EndpointAuth
+// allows everything.
+type EndpointAuth struct {
+	// BearerTokens are accepted in an "Authorization: Bearer" header.
+	BearerTokens []string
+
+	// RequireClientCert requires a client certificate verified by the TLS
+	// server, which must be configured to request one with ClientAuth.
+	RequireClientCert bool
+
+	// ClientCertNames restricts client certificates to those with one of
+	// these names as common name or DNS subject alternative name. It implies
+	// RequireClientCert.
+	ClientCertNames []string
+
+	// AllowedNetworks restricts the remote address to these IPs or CIDR
+	// prefixes. Forwarding headers are ignored, as they can be spoofed.
+	AllowedNetworks []string
+}
+
+// Wrap returns next guarded by the configured checks. Requests failing the
+// IP allowlist or client certificate check get a 403, and requests without a
+// valid bearer token a 401.
+func (a EndpointAuth) Wrap(next http.Handler) (http.Handler, error) {
+	prefixes := make([]netip.Prefix, 0, len(a.AllowedNetworks))
+	for _, n := range a.AllowedNetworks {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(n, "/") {
+			p, err = netip.ParsePrefix(n)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(n)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %q: %w", n, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	requireCert := a.RequireClientCert || len(a.ClientCertNames) > 0
+
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if len(prefixes) > 0 && !remoteAllowed(req.RemoteAddr, prefixes) {
+			http.Error(resp, "forbidden", http.StatusForbidden)
+			return
+		}
+		if requireCert && !a.clientCertAllowed(req) {
+			http.Error(resp, "forbidden", http.StatusForbidden)
+			return
+		}
+		if len(a.BearerTokens) > 0 && !a.tokenAllowed(req) {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(resp, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(resp, req)
+	}), nil
+}
+
+func remoteAllowed(remoteAddr string, prefixes []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a EndpointAuth) clientCertAllowed(req *http.Request) bool {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	if len(a.ClientCertNames) == 0 {
+		return true
+	}
+	leaf := req.TLS.VerifiedChains[0][0]
+	for _, name := range a.ClientCertNames {
+		if leaf.Subject.CommonName == name || slices.Contains(leaf.DNSNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a EndpointAuth) tokenAllowed(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	allowed := false
+	for _, t := range a.BearerTokens {
+		// Check every token so the time taken does not reveal which matched
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			allowed = true
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpointAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {})
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "prometheus"}}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+
+	for _, tc := range []struct {
+		desc   string
+		auth   EndpointAuth
+		remote string
+		token  string
+		tls    *tls.ConnectionState
+		code   int
+	}{
+		{desc: "no checks", code: 200},
+		{desc: "token", auth: EndpointAuth{BearerTokens: []string{"a", "b"}}, token: "b", code: 200},
+		{desc: "bad token", auth: EndpointAuth{BearerTokens: []string{"a"}}, token: "b", code: 401},
+		{desc: "missing token", auth: EndpointAuth{BearerTokens: []string{"a"}}, code: 401},
+		{desc: "network", auth: EndpointAuth{AllowedNetworks: []string{"10.0.0.0/8"}}, remote: "10.1.2.3:1234", code: 200},
+		{desc: "single IP", auth: EndpointAuth{AllowedNetworks: []string{"10.1.2.3"}}, remote: "10.1.2.3:1234", code: 200},
+		{desc: "outside network", auth: EndpointAuth{AllowedNetworks: []string{"10.0.0.0/8"}}, remote: "192.168.0.1:1234", code: 403},
+		{desc: "cert", auth: EndpointAuth{RequireClientCert: true}, tls: verified, code: 200},
+		{desc: "missing cert", auth: EndpointAuth{RequireClientCert: true}, tls: &tls.ConnectionState{}, code: 403},
+		{desc: "cert name", auth: EndpointAuth{ClientCertNames: []string{"prometheus"}}, tls: verified, code: 200},
+		{desc: "bad cert name", auth: EndpointAuth{ClientCertNames: []string{"grafana"}}, tls: verified, code: 403},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			h, err := tc.auth.Wrap(ok)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.remote != "" {
+				req.RemoteAddr = tc.remote
+			}
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			req.TLS = tc.tls
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, req)
+			if resp.Code != tc.code {
+				t.Fatalf("bad code: %d", resp.Code)
+			}
+		})
+	}
+}
+
+func TestEndpointAuth_InvalidNetwork(t *testing.T) {
+	if _, err := (EndpointAuth{AllowedNetworks: []string{"nope"}}).Wrap(http.NotFoundHandler()); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestEndpointAuth_DisplayMetrics(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, 50*time.Millisecond)
+	inm.SetGauge([]string{"foo"}, 42)
+
+	h, err := EndpointAuth{BearerTokens: []string{"secret"}}.Wrap(inm.DisplayMetricsHandler())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/v1/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), `"Name":"foo"`) {
+		t.Fatalf("bad response: %d %s", resp.Code, resp.Body.String())
+	}
+}
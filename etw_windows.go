@@ -0,0 +1,170 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+//go:build windows && (amd64 || arm64)
+// +build windows
+// +build amd64 arm64
+
+package metrics
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                = syscall.NewLazyDLL("advapi32.dll")
+	procEventRegister       = advapi32.NewProc("EventRegister")
+	procEventUnregister     = advapi32.NewProc("EventUnregister")
+	procEventWriteString    = advapi32.NewProc("EventWriteString")
+	procEventProviderEnable = advapi32.NewProc("EventProviderEnabled")
+)
+
+// ETW keywords set on events by metric type, so trace sessions can enable
+// only some types
+const (
+	ETWKeywordGauge   uint64 = 1 << 0
+	ETWKeywordKV      uint64 = 1 << 1
+	ETWKeywordCounter uint64 = 1 << 2
+	ETWKeywordSample  uint64 = 1 << 3
+)
+
+// etwLevelInfo is the level of every event, TRACE_LEVEL_INFORMATION
+const etwLevelInfo = 4
+
+// ETWSink provides a MetricSink that publishes every metric as an Event
+// Tracing for Windows event under the given provider, for collection by
+// existing Windows telemetry agents or analysis in WPA. Each event is a
+// string event holding a JSON object:
+//
+//	{"type":"counter","name":"api.requests","value":1,"labels":{"code":"200"}}
+//
+// Events carry a keyword per metric type, see ETWKeywordGauge and friends.
+// Metrics are only encoded while a trace session has enabled the provider.
+type ETWSink struct {
+	handle uint64
+}
+
+// etwEvent is the JSON payload of an event
+type etwEvent struct {
+	Type   string            `json:"type"`
+	Name   string            `json:"name"`
+	Value  float64           `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NewETWSink registers an ETW provider with the given GUID, in the usual
+// "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx" form, and returns a sink
+// publishing to it.
+func NewETWSink(provider string) (*ETWSink, error) {
+	guid, err := parseGUID(provider)
+	if err != nil {
+		return nil, err
+	}
+	s := &ETWSink{}
+	r, _, _ := procEventRegister.Call(
+		uintptr(unsafe.Pointer(&guid)),
+		0,
+		0,
+		uintptr(unsafe.Pointer(&s.handle)),
+	)
+	if r != 0 {
+		return nil, fmt.Errorf("failed to register ETW provider: %w", syscall.Errno(r))
+	}
+	return s, nil
+}
+
+func (s *ETWSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ETWSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.write(ETWKeywordGauge, "gauge", key, float64(val), labels)
+}
+
+func (s *ETWSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *ETWSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.write(ETWKeywordGauge, "gauge", key, val, labels)
+}
+
+func (s *ETWSink) EmitKey(key []string, val float32) {
+	s.write(ETWKeywordKV, "kv", key, float64(val), nil)
+}
+
+func (s *ETWSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ETWSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.write(ETWKeywordCounter, "counter", key, float64(val), labels)
+}
+
+func (s *ETWSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ETWSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.write(ETWKeywordSample, "sample", key, float64(val), labels)
+}
+
+// Shutdown unregisters the provider.
+func (s *ETWSink) Shutdown() {
+	_, _, _ = procEventUnregister.Call(uintptr(s.handle))
+}
+
+func (s *ETWSink) write(keyword uint64, typ string, key []string, val float64, labels []Label) {
+	enabled, _, _ := procEventProviderEnable.Call(uintptr(s.handle), etwLevelInfo, uintptr(keyword))
+	if enabled == 0 {
+		return
+	}
+
+	event := etwEvent{Type: typ, Name: strings.Join(key, "."), Value: val}
+	if len(labels) > 0 {
+		event.Labels = make(map[string]string, len(labels))
+		for _, l := range labels {
+			event.Labels[l.Name] = l.Value
+		}
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	str, err := syscall.UTF16PtrFromString(string(payload))
+	if err != nil {
+		return
+	}
+	_, _, _ = procEventWriteString.Call(
+		uintptr(s.handle),
+		etwLevelInfo,
+		uintptr(keyword),
+		uintptr(unsafe.Pointer(str)),
+	)
+}
+
+// parseGUID parses a GUID in its canonical string form, with or without
+// braces.
+func parseGUID(s string) (syscall.GUID, error) {
+	var g syscall.GUID
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 ||
+		len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	g.Data1 = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	g.Data2 = uint16(b[4])<<8 | uint16(b[5])
+	g.Data3 = uint16(b[6])<<8 | uint16(b[7])
+	copy(g.Data4[:], b[8:])
+	return g, nil
+}
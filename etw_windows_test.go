@@ -0,0 +1,39 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+//go:build windows && (amd64 || arm64)
+// +build windows
+// +build amd64 arm64
+
+package metrics
+
+import (
+	"testing"
+)
+
+func TestParseGUID(t *testing.T) {
+	g, err := parseGUID("{12345678-9abc-def0-1122-334455667788}")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if g.Data1 != 0x12345678 || g.Data2 != 0x9abc || g.Data3 != 0xdef0 || g.Data4 != [8]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88} {
+		t.Fatalf("bad GUID: %+v", g)
+	}
+	for _, bad := range []string{"", "12345678-9abc-def0-1122", "1234567z-9abc-def0-1122-334455667788"} {
+		if _, err := parseGUID(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestETWSink(t *testing.T) {
+	s, err := NewETWSink("6f7a4b2e-3c1d-4e5f-8a9b-0c1d2e3f4a5b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Shutdown()
+
+	// Without a trace session these are no-ops, but must not fail
+	s.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"code", "200"}})
+	s.AddSample([]string{"latency"}, 10)
+}
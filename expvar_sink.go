@@ -0,0 +1,178 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ExpvarSink provides a MetricSink which publishes the current values of
+// gauges and counters as expvar variables, so they can be read from
+// /debug/vars without a Prometheus dependency. All metrics are published
+// within a single map variable, keyed by their flattened name. Metrics with
+// labels are maps keyed by their label sets, as in:
+//
+//	"metrics": {
+//		"runtime.num_goroutines": 12,
+//		"api.requests": {"code=200,method=GET": 40, "code=500,method=GET": 2}
+//	}
+//
+// A metric emitted both with and without labels has its unlabeled value
+// under the empty key of its map. Counters hold the total since the sink was
+// created, and samples a map with their total "count" and "sum". Key/value
+// points are ignored.
+type ExpvarSink struct {
+	root *expvar.Map
+
+	// lock serializes the creation of variables
+	lock sync.Mutex
+}
+
+// NewExpvarSink creates an ExpvarSink publishing its metrics under name. It
+// fails if a variable of that name was already published, as expvar does not
+// allow removing variables.
+func NewExpvarSink(name string) (*ExpvarSink, error) {
+	if name == "" {
+		return nil, fmt.Errorf("expvar name is required")
+	}
+	if expvar.Get(name) != nil {
+		return nil, fmt.Errorf("expvar %q is already published", name)
+	}
+	return &ExpvarSink{root: expvar.NewMap(name)}, nil
+}
+
+// Var returns the map variable holding the metrics.
+func (s *ExpvarSink) Var() *expvar.Map {
+	return s.root
+}
+
+func (s *ExpvarSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ExpvarSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.float(key, labels).Set(float64(val))
+}
+
+func (s *ExpvarSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *ExpvarSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.float(key, labels).Set(val)
+}
+
+func (s *ExpvarSink) EmitKey(key []string, val float32) {
+}
+
+func (s *ExpvarSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ExpvarSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.float(key, labels).Add(float64(val))
+}
+
+func (s *ExpvarSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ExpvarSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	m := s.variable(key, labels, true).(*expvar.Map)
+	m.Add("count", 1)
+	m.AddFloat("sum", float64(val))
+}
+
+// Capabilities reports what the expvar sink supports.
+func (s *ExpvarSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Tags: true}
+}
+
+// float returns the variable of a gauge or counter.
+func (s *ExpvarSink) float(key []string, labels []Label) *expvar.Float {
+	return s.variable(key, labels, false).(*expvar.Float)
+}
+
+// variable returns the variable of a metric, which is a *expvar.Map for
+// samples and a *expvar.Float otherwise. It is created if it does not exist
+// or has the other type, as when a gauge and a sample share a name, so the
+// last type emitted wins.
+func (s *ExpvarSink) variable(key []string, labels []Label, sample bool) expvar.Var {
+	name, lkey := strings.Join(key, "."), expvarLabelKey(labels)
+	matches := func(v expvar.Var) bool {
+		switch v.(type) {
+		case *expvar.Map:
+			return sample
+		case *expvar.Float:
+			return !sample
+		}
+		return false
+	}
+	if v := s.lookup(name, lkey); matches(v) {
+		return v
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if v := s.lookup(name, lkey); matches(v) {
+		return v
+	}
+	var v expvar.Var = new(expvar.Float)
+	if sample {
+		v = new(expvar.Map)
+	}
+	s.store(name, lkey, v)
+	return v
+}
+
+// lookup returns the variable of a metric and label set, or nil.
+func (s *ExpvarSink) lookup(name, lkey string) expvar.Var {
+	v := s.root.Get(name)
+	if m, ok := v.(*labeledVars); ok {
+		return m.Get(lkey)
+	}
+	if lkey != "" {
+		return nil
+	}
+	return v
+}
+
+// store sets the variable of a metric and label set. The first time a metric
+// is emitted with labels, its variable is replaced by a map of its label
+// sets, which keeps an unlabeled value under the empty key. It must be called
+// with the lock held.
+func (s *ExpvarSink) store(name, lkey string, v expvar.Var) {
+	existing := s.root.Get(name)
+	m, ok := existing.(*labeledVars)
+	if !ok {
+		if lkey == "" {
+			s.root.Set(name, v)
+			return
+		}
+		m = new(labeledVars)
+		if existing != nil {
+			m.Set("", existing)
+		}
+		s.root.Set(name, m)
+	}
+	m.Set(lkey, v)
+}
+
+// labeledVars is the map of the label sets of a metric. It is a distinct type
+// so that it is not confused with the map of a sample.
+type labeledVars struct {
+	expvar.Map
+}
+
+// expvarLabelKey formats a label set as the key of a labeled metric.
+func expvarLabelKey(labels []Label) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = l.Name + "=" + l.Value
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"reflect"
+	"testing"
+)
+
+func TestExpvarSink(t *testing.T) {
+	s, err := NewExpvarSink("test_expvar_sink")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if expvar.Get("test_expvar_sink") != s.Var() {
+		t.Fatalf("expected the map to be published")
+	}
+
+	s.SetGauge([]string{"runtime", "goroutines"}, 12)
+	s.SetGauge([]string{"runtime", "goroutines"}, 10)
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}, {"method", "GET"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}, {"method", "GET"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "500"}, {"method", "GET"}})
+	s.AddSample([]string{"api", "latency"}, 10)
+	s.AddSample([]string{"api", "latency"}, 20)
+	s.EmitKey([]string{"ignored"}, 1)
+
+	// An unlabeled value emitted first moves under the empty key
+	s.IncrCounter([]string{"cache", "miss"}, 4)
+	s.IncrCounterWithLabels([]string{"cache", "miss"}, 1, []Label{{"tier", "disk"}})
+	s.IncrCounter([]string{"cache", "miss"}, 1)
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(s.Var().String()), &got); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	want := map[string]interface{}{
+		"runtime.goroutines": 10.0,
+		"api.requests":       map[string]interface{}{"code=200,method=GET": 3.0, "code=500,method=GET": 1.0},
+		"api.latency":        map[string]interface{}{"count": 2.0, "sum": 30.0},
+		"cache.miss":         map[string]interface{}{"": 5.0, "tier=disk": 1.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad vars %v", got)
+	}
+}
+
+func TestExpvarSink_TypeChange(t *testing.T) {
+	s, err := NewExpvarSink("test_expvar_sink_type_change")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.AddSample([]string{"x"}, 1)
+	s.SetGauge([]string{"x"}, 2)
+	if v, ok := s.Var().Get("x").(*expvar.Float); !ok || v.Value() != 2 {
+		t.Fatalf("expected the gauge to replace the sample, got %v", s.Var().Get("x"))
+	}
+}
+
+func TestNewExpvarSink_Duplicate(t *testing.T) {
+	if _, err := NewExpvarSink("test_expvar_sink_duplicate"); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if _, err := NewExpvarSink("test_expvar_sink_duplicate"); err == nil {
+		t.Fatalf("expected a duplicate name to fail")
+	}
+	if _, err := NewExpvarSink(""); err == nil {
+		t.Fatalf("expected a missing name to fail")
+	}
+}
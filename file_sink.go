@@ -0,0 +1,457 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// fileFlushInterval and fileAggregateFlushInterval are used when
+	// FileOpts.FlushInterval is not set, for lines per metric and per
+	// aggregated series respectively
+	fileFlushInterval          = time.Second
+	fileAggregateFlushInterval = 10 * time.Second
+
+	// fileRotateTimeLayout formats the time a file was rotated into its
+	// name, sorting in the order of rotation
+	fileRotateTimeLayout = "2006-01-02T15-04-05.000"
+)
+
+// FileOpts is used to configure a FileSink.
+type FileOpts struct {
+	// Path is the file lines are appended to, which is created if needed
+	Path string
+
+	// Aggregate writes a line per series and flush interval, rather than a
+	// line per metric
+	Aggregate bool
+
+	// FlushInterval is how often lines are written to the file, it
+	// defaults to one second, or 10 seconds when aggregating
+	FlushInterval time.Duration
+
+	// QueueSize is the maximum number of metrics buffered between flushes
+	// when not aggregating. Metrics beyond it are dropped and counted in
+	// Dropped. It defaults to DefaultWorkerQueueSize.
+	QueueSize int
+
+	// MaxSize rotates the file before it grows past this many bytes, and
+	// MaxAge once it was written to for this long. Both are disabled when
+	// zero.
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// MaxBackups is the number of rotated files kept, the oldest are
+	// removed beyond it. All are kept when zero.
+	MaxBackups int
+
+	// Compress gzips rotated files
+	Compress bool
+
+	// Codec writes each aggregated interval as a single MetricsSummary
+	// snapshot encoded with it, rather than as JSON lines, so files can be
+	// read back with NewSnapshotDecoder. It requires Aggregate.
+	Codec SnapshotCodec
+}
+
+// FileSink provides a MetricSink which appends metrics to a file as JSON
+// lines, for offline analysis of deployments without a metrics pipeline.
+// Every metric is written as a line such as:
+//
+//	{"name":"api.requests","type":"counter","value":1,
+//	 "labels":{"code":"200"},"timestamp":"2024-01-02T15:04:05.123Z"}
+//
+// When aggregating, every series is written once per flush interval instead,
+// with counters and samples adding the count and samples the sum, min and
+// max of the interval:
+//
+//	{"name":"api.latency","type":"sample","value":12.5,"count":4,"sum":50,
+//	 "min":3,"max":30,"labels":{"route":"/users"},
+//	 "timestamp":"2024-01-02T15:04:05Z"}
+//
+// With a Codec, every interval is written as a snapshot instead, holding
+// gauges as precision gauges, the last value of each key value pair as a
+// point, and counters and samples with their count, sum, min and max.
+//
+// The file is rotated by size or age. Rotated files are renamed with the
+// time of rotation, as in "metrics-2024-01-02T15-04-05.000.jsonl", and
+// optionally gzipped.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	codec      SnapshotCodec
+
+	agg   *intervalAggregator
+	queue *eventQueue
+	loop  *flushLoop
+
+	// The file is only used from the flush loop
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// fileLine is an aggregated series written by a FileSink
+type fileLine struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Value     float64           `json:"value"`
+	Count     int               `json:"count,omitempty"`
+	Sum       *float64          `json:"sum,omitempty"`
+	Min       *float64          `json:"min,omitempty"`
+	Max       *float64          `json:"max,omitempty"`
+	Labels    map[string]string `json:"labels"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// NewFileSink creates a FileSink, opening or creating the file, and starts
+// its flush loop.
+func NewFileSink(opts FileOpts) (*FileSink, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("file path is required")
+	}
+	if opts.Codec != nil && !opts.Aggregate {
+		return nil, fmt.Errorf("a snapshot codec requires aggregation")
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = fileFlushInterval
+		if opts.Aggregate {
+			interval = fileAggregateFlushInterval
+		}
+	}
+	s := &FileSink{
+		path:       opts.Path,
+		maxSize:    opts.MaxSize,
+		maxAge:     opts.MaxAge,
+		maxBackups: opts.MaxBackups,
+		compress:   opts.Compress,
+		codec:      opts.Codec,
+	}
+	if opts.Aggregate {
+		s.agg = newIntervalAggregator()
+	} else {
+		queueSize := opts.QueueSize
+		if queueSize <= 0 {
+			queueSize = DefaultWorkerQueueSize
+		}
+		s.queue = newEventQueue(queueSize, queueSize)
+	}
+	if err := s.open(time.Now()); err != nil {
+		return nil, err
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+func (s *FileSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *FileSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.record(aggregateGauge, "gauge", key, float64(val), labels)
+}
+
+func (s *FileSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *FileSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.record(aggregateGauge, "gauge", key, val, labels)
+}
+
+func (s *FileSink) EmitKey(key []string, val float32) {
+	s.record(aggregateKV, "kv", key, float64(val), nil)
+}
+
+func (s *FileSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *FileSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.record(aggregateCounter, "counter", key, float64(val), labels)
+}
+
+func (s *FileSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *FileSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.record(aggregateSample, "sample", key, float64(val), labels)
+}
+
+func (s *FileSink) record(kind aggregateKind, typ string, key []string, val float64, labels []Label) {
+	if s.agg != nil {
+		s.agg.record(kind, key, val, labels)
+		return
+	}
+	s.queue.add(newMetricEvent(typ, key, val, labels))
+}
+
+// Capabilities reports what the file sink supports.
+func (s *FileSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Dropped returns the number of metrics dropped because more than QueueSize
+// were emitted between flushes.
+func (s *FileSink) Dropped() uint64 {
+	if s.queue == nil {
+		return 0
+	}
+	return s.queue.droppedCount()
+}
+
+// Shutdown stops the flush loop after writing the remaining lines, and
+// closes the file.
+func (s *FileSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often lines are written, starting from now.
+func (s *FileSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *FileSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error writing to file %s! Err: %s", s.path, err)
+	}
+	if final && s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+// flush writes the lines or snapshot since the last flush, rotating the file
+// first when they would take it past its size or age.
+func (s *FileSink) flush(now time.Time) error {
+	var data []byte
+	if s.codec != nil {
+		var err error
+		if data, err = s.snapshot(now); err != nil {
+			return err
+		}
+	} else {
+		data = s.lines(now)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	if s.file == nil {
+		if err := s.open(now); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && (s.maxSize > 0 && s.size+int64(len(data)) > s.maxSize ||
+		s.maxAge > 0 && now.Sub(s.opened) >= s.maxAge) {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// lines encodes the metrics since the last flush as JSON lines.
+func (s *FileSink) lines(now time.Time) []byte {
+	var buf bytes.Buffer
+	if s.agg == nil {
+		for _, e := range s.queue.take() {
+			buf.Write(e.marshalJSON())
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes()
+	}
+
+	for _, a := range s.agg.drain() {
+		line := fileLine{
+			Name:      strings.Join(a.key, "."),
+			Labels:    make(map[string]string, len(a.labels)),
+			Timestamp: now.UTC(),
+		}
+		switch a.kind {
+		case aggregateGauge:
+			line.Type, line.Value = "gauge", a.last
+		case aggregateKV:
+			line.Type, line.Value = "kv", a.last
+		case aggregateCounter:
+			line.Type, line.Value, line.Count = "counter", a.sum, a.count
+		case aggregateSample:
+			line.Type, line.Value, line.Count = "sample", a.mean(), a.count
+			line.Sum, line.Min, line.Max = &a.sum, &a.min, &a.max
+		}
+		for _, l := range a.labels {
+			line.Labels[l.Name] = l.Value
+		}
+		// JSON has no NaN or infinity, which are skipped
+		if math.IsNaN(line.Value) || math.IsInf(line.Value, 0) {
+			continue
+		}
+		b, err := json.Marshal(line)
+		if err != nil {
+			continue
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// snapshot encodes the series aggregated since the last flush as a snapshot.
+func (s *FileSink) snapshot(now time.Time) ([]byte, error) {
+	aggs := s.agg.drain()
+	if len(aggs) == 0 {
+		return nil, nil
+	}
+
+	summary := MetricsSummary{Timestamp: now.Round(time.Second).UTC().String()}
+	for _, a := range aggs {
+		name := strings.Join(a.key, ".")
+		switch a.kind {
+		case aggregateGauge:
+			summary.PrecisionGauges = append(summary.PrecisionGauges, PrecisionGaugeValue{
+				Name: name, Value: a.last, LastUpdated: now, Labels: a.labels,
+			})
+		case aggregateKV:
+			summary.Points = append(summary.Points, PointValue{Name: name, Points: []float32{float32(a.last)}})
+		case aggregateCounter, aggregateSample:
+			v := SampledValue{
+				Name:   name,
+				Mean:   a.mean(),
+				Labels: a.labels,
+				AggregateSample: &AggregateSample{
+					Count: a.count, Sum: a.sum, Min: a.min, Max: a.max, LastUpdated: now,
+				},
+			}
+			if a.kind == aggregateCounter {
+				summary.Counters = append(summary.Counters, v)
+			} else {
+				summary.Samples = append(summary.Samples, v)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.codec.Encode(&buf, &summary); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// open opens the file for appending, creating it if needed.
+func (s *FileSink) open(now time.Time) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.file, s.size, s.opened = f, info.Size(), now
+	return nil
+}
+
+// rotate renames the file with the current time, compresses it if enabled,
+// removes the oldest rotated files beyond maxBackups and opens a new file.
+func (s *FileSink) rotate(now time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	rotated := base + "-" + now.UTC().Format(fileRotateTimeLayout) + ext
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	if err := s.open(now); err != nil {
+		return err
+	}
+
+	if s.compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Printf("[ERR] Error compressing rotated file %s! Err: %s", rotated, err)
+		}
+	}
+	if s.maxBackups > 0 {
+		s.removeBackups(base, ext)
+	}
+	return nil
+}
+
+// removeBackups removes the oldest rotated files beyond maxBackups.
+func (s *FileSink) removeBackups(base, ext string) {
+	matches, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(m, base+"-"), ".gz"), ext)
+		if _, err := time.Parse(fileRotateTimeLayout, stamp); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > s.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("[ERR] Error removing rotated file %s! Err: %s", backups[0], err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// gzipFile replaces path with a gzipped copy named path + ".gz".
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(out.Name())
+		return err
+	}
+	// Windows cannot remove open files
+	_ = in.Close()
+	return os.Remove(path)
+}
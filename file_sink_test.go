@@ -0,0 +1,216 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readJSONLines decodes every line of a file, which is gunzipped first if it
+// ends in .gz.
+func readJSONLines(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	r := bufio.NewScanner(f)
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		r = bufio.NewScanner(zr)
+	}
+	var lines []map[string]interface{}
+	for r.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(r.Bytes(), &line); err != nil {
+			t.Fatalf("bad line %s: %s", r.Bytes(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	sink, err := NewFileSink(FileOpts{Path: path, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	sink.AddSample([]string{"api", "latency"}, 12.5)
+	sink.Shutdown()
+
+	lines := readJSONLines(t, path)
+	if len(lines) != 3 {
+		t.Fatalf("bad lines %v", lines)
+	}
+	if got := lines[0]; got["name"] != "api.requests" || got["type"] != "counter" || got["value"] != float64(1) ||
+		!reflect.DeepEqual(got["labels"], map[string]interface{}{"code": "200"}) || got["timestamp"] == nil {
+		t.Fatalf("bad line %v", got)
+	}
+	if got := lines[2]; got["name"] != "api.latency" || got["type"] != "sample" || got["value"] != 12.5 {
+		t.Fatalf("bad line %v", got)
+	}
+}
+
+func TestFileSink_Aggregate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	if err := os.WriteFile(path, []byte(`{"name":"earlier"}`+"\n"), 0o644); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	sink, err := NewFileSink(FileOpts{Path: path, Aggregate: true, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	sink.AddSampleWithLabels([]string{"api", "latency"}, 10, []Label{{"route", "/users"}})
+	sink.AddSampleWithLabels([]string{"api", "latency"}, 30, []Label{{"route", "/users"}})
+	sink.SetGauge([]string{"goroutines"}, 12)
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := sink.flush(now); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Lines are appended to the existing file
+	lines := readJSONLines(t, path)
+	expected := []map[string]interface{}{
+		{"name": "earlier"},
+		{"name": "goroutines", "type": "gauge", "value": float64(12), "labels": map[string]interface{}{},
+			"timestamp": "2024-01-02T15:04:05Z"},
+		{"name": "api.latency", "type": "sample", "value": float64(20), "count": float64(2),
+			"sum": float64(40), "min": float64(10), "max": float64(30),
+			"labels": map[string]interface{}{"route": "/users"}, "timestamp": "2024-01-02T15:04:05Z"},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("bad lines\n got: %v\nwant: %v", lines, expected)
+	}
+}
+
+func TestFileSink_Codec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.pb")
+	sink, err := NewFileSink(FileOpts{Path: path, Aggregate: true, Codec: ProtobufSnapshotCodec, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	sink.SetGauge([]string{"queue"}, 4)
+	sink.EmitKey([]string{"kv"}, 5)
+	sink.AddSample([]string{"api", "latency"}, 10)
+	sink.AddSample([]string{"api", "latency"}, 30)
+	if err := sink.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	sink.SetGauge([]string{"queue"}, 6)
+	sink.Shutdown()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = f.Close() }()
+	dec := NewSnapshotDecoder(f, ProtobufSnapshotCodec)
+
+	var s MetricsSummary
+	if err := dec.Decode(&s); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(s.Counters) != 1 || s.Counters[0].Name != "api.requests" || s.Counters[0].Count != 2 || s.Counters[0].Sum != 3 ||
+		!reflect.DeepEqual(s.Counters[0].Labels, []Label{{"code", "200"}}) {
+		t.Fatalf("bad counters %#v", s.Counters)
+	}
+	if len(s.Samples) != 1 || s.Samples[0].Min != 10 || s.Samples[0].Max != 30 || s.Samples[0].Mean != 20 {
+		t.Fatalf("bad samples %#v", s.Samples)
+	}
+	if len(s.PrecisionGauges) != 1 || s.PrecisionGauges[0].Value != 4 ||
+		len(s.Points) != 1 || !reflect.DeepEqual(s.Points[0].Points, []float32{5}) {
+		t.Fatalf("bad gauges %#v %#v", s.PrecisionGauges, s.Points)
+	}
+
+	// The second interval follows in the same file
+	if err := dec.Decode(&s); err != nil || len(s.PrecisionGauges) != 1 || s.PrecisionGauges[0].Value != 6 {
+		t.Fatalf("bad second snapshot %#v %v", s, err)
+	}
+}
+
+func TestFileSink_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.jsonl")
+	sink, err := NewFileSink(FileOpts{
+		Path:          path,
+		FlushInterval: time.Hour,
+		MaxSize:       150,
+		MaxAge:        time.Hour,
+		MaxBackups:    2,
+		Compress:      true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	// Each flush writes a line of about 100 bytes, so every flush after the
+	// first rotates by size, except the last which rotates by age
+	start := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		sink.IncrCounter([]string{"requests"}, float32(i))
+		if err := sink.flush(start.Add(time.Duration(i) * time.Second)); err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+	}
+	sink.SetGauge([]string{"x"}, 1)
+	if err := sink.flush(start.Add(2 * time.Hour)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(matches)
+	expected := []string{
+		filepath.Join(dir, "metrics-2024-01-02T15-04-08.000.jsonl.gz"),
+		filepath.Join(dir, "metrics-2024-01-02T17-04-05.000.jsonl.gz"),
+		path,
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("bad files %v", matches)
+	}
+	if lines := readJSONLines(t, expected[0]); len(lines) != 1 || lines[0]["value"] != float64(2) {
+		t.Fatalf("bad rotated lines %v", lines)
+	}
+	if lines := readJSONLines(t, expected[1]); len(lines) != 1 || lines[0]["value"] != float64(3) {
+		t.Fatalf("bad rotated lines %v", lines)
+	}
+	if lines := readJSONLines(t, path); len(lines) != 1 || lines[0]["name"] != "x" {
+		t.Fatalf("bad lines %v", lines)
+	}
+}
+
+func TestNewFileSink_Errors(t *testing.T) {
+	if _, err := NewFileSink(FileOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewFileSink(FileOpts{Path: filepath.Join(t.TempDir(), "missing", "metrics.jsonl")}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewFileSink(FileOpts{Path: filepath.Join(t.TempDir(), "metrics"), Codec: ProtobufSnapshotCodec}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// flushJitter holds the float64 bits of the jitter fraction, see
+// SetFlushJitter
+var flushJitter atomic.Uint64
+
+// SetFlushJitter randomizes the periodic flushes and pushes of the sinks in
+// this package and its subpackages, so that a fleet of instances started
+// together does not hit its collectors in lockstep. Every wait is drawn
+// uniformly within fraction of the flush interval around it, keeping the
+// average interval, so 0.1 turns a 10 second interval into 9 to 11 seconds.
+// The fraction is clamped to [0, 1], and zero, the default, disables jitter.
+// Changes apply from the next wait of every loop.
+func SetFlushJitter(fraction float64) {
+	if math.IsNaN(fraction) || fraction < 0 {
+		fraction = 0
+	}
+	flushJitter.Store(math.Float64bits(math.Min(fraction, 1)))
+}
+
+// FlushJitter returns the jitter fraction, see SetFlushJitter.
+func FlushJitter() float64 {
+	return math.Float64frombits(flushJitter.Load())
+}
+
+// JitterInterval returns interval randomized according to SetFlushJitter,
+// for the flush loops of sinks to wait before every flush. It never returns
+// less than a millisecond.
+func JitterInterval(interval time.Duration) time.Duration {
+	fraction := FlushJitter()
+	if fraction == 0 || interval <= 0 {
+		return interval
+	}
+	d := time.Duration(float64(interval) * (1 + fraction*(2*rand.Float64()-1)))
+	return max(d, time.Millisecond)
+}
+
+// flushLoop periodically calls a flush function from its own goroutine,
+// which is shared by the push based sinks. The final flush happens on stop.
+type flushLoop struct {
+	// interval holds the current interval, see setInterval
+	interval atomic.Int64
+
+	resetCh chan time.Duration
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// startFlushLoop calls flush every interval, with jitter if configured, until
+// stop is called, then one last time with final set.
+func startFlushLoop(interval time.Duration, flush func(now time.Time, final bool)) *flushLoop {
+	l := newFlushLoop(interval)
+	l.start(flush)
+	return l
+}
+
+// newFlushLoop creates a flush loop without starting it, for sinks whose
+// flush function uses the loop, see retryDeadline.
+func newFlushLoop(interval time.Duration) *flushLoop {
+	l := &flushLoop{
+		resetCh: make(chan time.Duration),
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	l.interval.Store(int64(interval))
+	return l
+}
+
+// start runs the loop, see startFlushLoop.
+func (l *flushLoop) start(flush func(now time.Time, final bool)) {
+	interval := time.Duration(l.interval.Load())
+	go func() {
+		defer close(l.doneCh)
+		ticker := time.NewTicker(JitterInterval(interval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ticker.Reset(JitterInterval(interval))
+				flush(time.Now(), false)
+			case interval = <-l.resetCh:
+				ticker.Reset(JitterInterval(interval))
+			case <-l.stopCh:
+				flush(time.Now(), true)
+				return
+			}
+		}
+	}()
+}
+
+// stop ends the loop and blocks until the final flush has completed.
+func (l *flushLoop) stop() {
+	close(l.stopCh)
+	<-l.doneCh
+}
+
+// setInterval changes the interval of the loop, starting from now. It does
+// nothing once the loop has stopped, or for intervals that are not
+// positive.
+func (l *flushLoop) setInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	select {
+	case l.resetCh <- interval:
+		l.interval.Store(int64(interval))
+	case <-l.doneCh:
+	}
+}
+
+// retryDeadline bounds the retries of a flush starting at now to the next
+// flush, following the interval set last.
+func (l *flushLoop) retryDeadline(now time.Time) time.Time {
+	return now.Add(time.Duration(l.interval.Load()))
+}
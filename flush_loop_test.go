@@ -0,0 +1,66 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJitterInterval(t *testing.T) {
+	defer SetFlushJitter(0)
+
+	if d := JitterInterval(10 * time.Second); d != 10*time.Second {
+		t.Fatalf("jitter applied by default: %s", d)
+	}
+
+	SetFlushJitter(0.1)
+	lowest, highest := time.Duration(math.MaxInt64), time.Duration(0)
+	for i := 0; i < 1000; i++ {
+		d := JitterInterval(10 * time.Second)
+		if d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("bad interval %s", d)
+		}
+		if d < lowest {
+			lowest = d
+		}
+		if d > highest {
+			highest = d
+		}
+	}
+	if lowest > 9500*time.Millisecond || highest < 10500*time.Millisecond {
+		t.Fatalf("intervals not spread: %s to %s", lowest, highest)
+	}
+
+	for _, c := range []struct{ in, want float64 }{{-1, 0}, {math.NaN(), 0}, {2, 1}, {0.5, 0.5}} {
+		SetFlushJitter(c.in)
+		if got := FlushJitter(); got != c.want {
+			t.Fatalf("bad jitter for %v: %v", c.in, got)
+		}
+	}
+	if d := JitterInterval(time.Microsecond); d < time.Millisecond {
+		t.Fatalf("bad interval %s", d)
+	}
+}
+
+func TestFlushLoop_Jitter(t *testing.T) {
+	SetFlushJitter(0.5)
+	defer SetFlushJitter(0)
+
+	var flushes atomic.Int32
+	l := startFlushLoop(10*time.Millisecond, func(now time.Time, final bool) {
+		if !final {
+			flushes.Add(1)
+		}
+	})
+	time.Sleep(200 * time.Millisecond)
+	l.stop()
+
+	// The average interval is kept, allowing for a slow scheduler
+	if n := flushes.Load(); n < 5 || n > 40 {
+		t.Fatalf("bad flushes %d", n)
+	}
+}
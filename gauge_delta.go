@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// GaugeDeltaSink wraps a push based MetricSink and suppresses gauge updates
+// whose value has not changed since it was last forwarded. Unchanged gauges
+// are still re-sent once they have been suppressed for longer than the max
+// staleness, so backends that expire idle series keep seeing them. All other
+// metric types are passed through untouched.
+//
+// Gauges which are not set for ten minutes, or for the max staleness when
+// longer, are forgotten, so series which come and go do not accumulate. Their
+// next value is forwarded as if it changed.
+type GaugeDeltaSink struct {
+	sink       MetricSink
+	maxStale   time.Duration
+	evictAfter time.Duration
+
+	lock   sync.Mutex
+	gauges map[string]deltaGauge
+	swept  time.Time
+}
+
+type deltaGauge struct {
+	value  float64
+	sentAt time.Time
+	setAt  time.Time
+}
+
+// gaugeDeltaEvictAfter is how long a gauge which is not set is remembered,
+// unless the max staleness is longer
+const gaugeDeltaEvictAfter = 10 * time.Minute
+
+// NewGaugeDeltaSink wraps sink with gauge delta compression. A zero maxStale
+// means unchanged gauges are never re-sent.
+func NewGaugeDeltaSink(sink MetricSink, maxStale time.Duration) *GaugeDeltaSink {
+	return &GaugeDeltaSink{
+		sink:       sink,
+		maxStale:   maxStale,
+		evictAfter: max(maxStale, gaugeDeltaEvictAfter),
+		gauges:     make(map[string]deltaGauge),
+		swept:      time.Now(),
+	}
+}
+
+func (g *GaugeDeltaSink) SetGauge(key []string, val float32) {
+	g.SetGaugeWithLabels(key, val, nil)
+}
+
+func (g *GaugeDeltaSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if g.changed(key, float64(val), labels, time.Now()) {
+		g.sink.SetGaugeWithLabels(key, val, labels)
+	}
+}
+
+func (g *GaugeDeltaSink) SetPrecisionGauge(key []string, val float64) {
+	g.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+// SetPrecisionGaugeWithLabels forwards changed values with the best encoding
+// supported by the wrapped sink, as Metrics.SetPrecisionGauge does.
+func (g *GaugeDeltaSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	if g.changed(key, val, labels, time.Now()) {
+		setPrecisionGauge(g.sink, key, val, labels)
+	}
+}
+
+func (g *GaugeDeltaSink) EmitKey(key []string, val float32) {
+	g.sink.EmitKey(key, val)
+}
+
+func (g *GaugeDeltaSink) EmitKeys(key []string, vals []float32) {
+	emitKeys(g.sink, key, vals)
+}
+
+func (g *GaugeDeltaSink) IncrCounter(key []string, val float32) {
+	g.sink.IncrCounter(key, val)
+}
+
+func (g *GaugeDeltaSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	g.sink.IncrCounterWithLabels(key, val, labels)
+}
+
+func (g *GaugeDeltaSink) AddSample(key []string, val float32) {
+	g.sink.AddSample(key, val)
+}
+
+func (g *GaugeDeltaSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	g.sink.AddSampleWithLabels(key, val, labels)
+}
+
+func (g *GaugeDeltaSink) AddHistogram(key []string, val float64) {
+	g.AddHistogramWithLabels(key, val, nil)
+}
+
+func (g *GaugeDeltaSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	addHistogram(g.sink, key, val, labels)
+}
+
+// Capabilities reports the capabilities of the wrapped sink.
+func (g *GaugeDeltaSink) Capabilities() Capabilities {
+	return SinkCapabilities(g.sink)
+}
+
+// Flush forwards to the wrapped sink if it supports it. Suppressed gauges are
+// not re-sent.
+func (g *GaugeDeltaSink) Flush() {
+	if fs, ok := g.sink.(FlushSink); ok {
+		fs.Flush()
+	}
+}
+
+// Shutdown forwards to the wrapped sink if it supports it.
+func (g *GaugeDeltaSink) Shutdown() {
+	if ss, ok := g.sink.(ShutdownSink); ok {
+		ss.Shutdown()
+	}
+}
+
+// changed records the gauge value and reports whether it should be forwarded.
+func (g *GaugeDeltaSink) changed(key []string, val float64, labels []Label, now time.Time) bool {
+	k := seriesKey(key, labels)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.evict(now)
+
+	last, ok := g.gauges[k]
+	if ok && last.value == val {
+		if g.maxStale == 0 || now.Sub(last.sentAt) < g.maxStale {
+			last.setAt = now
+			g.gauges[k] = last
+			return false
+		}
+	}
+	g.gauges[k] = deltaGauge{value: val, sentAt: now, setAt: now}
+	return true
+}
+
+// evict forgets the gauges which were not set recently, at most once per
+// eviction period. The lock must be held.
+func (g *GaugeDeltaSink) evict(now time.Time) {
+	if now.Sub(g.swept) < g.evictAfter {
+		return
+	}
+	g.swept = now
+	for k, gauge := range g.gauges {
+		if now.Sub(gauge.setAt) >= g.evictAfter {
+			delete(g.gauges, k)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGaugeDeltaSink(t *testing.T) {
+	m := &MockSink{}
+	g := NewGaugeDeltaSink(m, time.Minute)
+
+	g.SetGauge([]string{"foo"}, 1)
+	g.SetGauge([]string{"foo"}, 1)
+	g.SetGaugeWithLabels([]string{"foo"}, 1, []Label{{"a", "b"}})
+	g.SetGauge([]string{"foo"}, 2)
+	g.SetPrecisionGauge([]string{"foo"}, 2)
+	if len(m.getKeys()) != 3 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+
+	// Other metric types are never suppressed
+	g.IncrCounter([]string{"foo"}, 1)
+	g.IncrCounter([]string{"foo"}, 1)
+	g.AddSample([]string{"foo"}, 1)
+	g.AddSample([]string{"foo"}, 1)
+	if len(m.getKeys()) != 7 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+}
+
+func TestGaugeDeltaSink_MaxStale(t *testing.T) {
+	g := NewGaugeDeltaSink(&MockSink{}, time.Minute)
+	now := time.Now()
+
+	if !g.changed([]string{"foo"}, 1, nil, now) {
+		t.Fatalf("first value should be sent")
+	}
+	if g.changed([]string{"foo"}, 1, nil, now.Add(30*time.Second)) {
+		t.Fatalf("unchanged value should be suppressed")
+	}
+	if !g.changed([]string{"foo"}, 1, nil, now.Add(time.Minute)) {
+		t.Fatalf("stale value should be re-sent")
+	}
+	if g.changed([]string{"foo"}, 1, nil, now.Add(90*time.Second)) {
+		t.Fatalf("unchanged value should be suppressed after resend")
+	}
+}
+
+func TestGaugeDeltaSink_Evict(t *testing.T) {
+	g := NewGaugeDeltaSink(&MockSink{}, 0)
+	now := time.Now()
+
+	g.changed([]string{"gone"}, 1, nil, now)
+	g.changed([]string{"kept"}, 1, nil, now)
+	g.changed([]string{"kept"}, 1, nil, now.Add(gaugeDeltaEvictAfter/2))
+	if !g.changed([]string{"new"}, 1, nil, now.Add(gaugeDeltaEvictAfter)) {
+		t.Fatalf("first value should be sent")
+	}
+	if _, ok := g.gauges["gone"]; ok || len(g.gauges) != 2 {
+		t.Fatalf("idle gauge should be evicted: %v", g.gauges)
+	}
+	if g.changed([]string{"kept"}, 1, nil, now.Add(gaugeDeltaEvictAfter)) {
+		t.Fatalf("recently set gauge should be kept")
+	}
+}
+
+func TestGaugeDeltaSink_Forwarding(t *testing.T) {
+	declared := &capSink{}
+	g := NewGaugeDeltaSink(declared, 0)
+	g.SetPrecisionGauge([]string{"foo"}, 42)
+	g.SetPrecisionGauge([]string{"foo"}, 42)
+	if len(declared.gauges) != 1 || declared.gauges[0] != 42 {
+		t.Fatalf("declared sink should get a 32 bit gauge once: %v", declared.gauges)
+	}
+	if c := g.Capabilities(); !c.Tags || c.PrecisionFloats {
+		t.Fatalf("bad capabilities: %#v", c)
+	}
+
+	m := &MockSink{}
+	g = NewGaugeDeltaSink(m, 0)
+	g.AddHistogram([]string{"foo"}, 1)
+	g.Flush()
+	if len(m.getKeys()) != 1 {
+		t.Fatalf("histogram should be forwarded: %v", m.getKeys())
+	}
+}
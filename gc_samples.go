@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	rtmetrics "runtime/metrics"
+)
+
+// Runtime metrics read to derive per GC cycle samples. Reading them does not
+// stop the world, unlike runtime.ReadMemStats.
+const (
+	gcCyclesMetric    = "/gc/cycles/total:gc-cycles"
+	gcHeapAllocMetric = "/gc/heap/allocs:bytes"
+	gcHeapLiveMetric  = "/gc/heap/live:bytes"
+)
+
+// gcSampler turns the cumulative runtime metrics into per cycle samples
+type gcSampler struct {
+	samples []rtmetrics.Sample
+
+	cycles, allocs, live uint64
+	primed               bool
+}
+
+func newGCSampler() *gcSampler {
+	return &gcSampler{
+		samples: []rtmetrics.Sample{
+			{Name: gcCyclesMetric},
+			{Name: gcHeapAllocMetric},
+			{Name: gcHeapLiveMetric},
+		},
+	}
+}
+
+// gcCycleSample describes the GC cycles completed between two observations
+type gcCycleSample struct {
+	cycles uint64
+
+	// allocPerCycle is the average number of bytes allocated per cycle
+	allocPerCycle float64
+
+	// heapGrowth is the change of the live heap, which may be negative
+	heapGrowth float64
+}
+
+// read observes the runtime metrics, see observe.
+func (g *gcSampler) read() (gcCycleSample, bool) {
+	rtmetrics.Read(g.samples)
+	var vals [3]uint64
+	for i, s := range g.samples {
+		if s.Value.Kind() != rtmetrics.KindUint64 {
+			// Not supported by this Go version
+			return gcCycleSample{}, false
+		}
+		vals[i] = s.Value.Uint64()
+	}
+	return g.observe(vals[0], vals[1], vals[2])
+}
+
+// observe records the cumulative cycle count, allocated bytes and current
+// live heap. It returns a sample when cycles completed since the previous
+// observation, and nothing on the first one.
+func (g *gcSampler) observe(cycles, allocs, live uint64) (gcCycleSample, bool) {
+	defer func() {
+		g.cycles, g.allocs, g.live, g.primed = cycles, allocs, live, true
+	}()
+	if !g.primed || cycles <= g.cycles {
+		return gcCycleSample{}, false
+	}
+	n := cycles - g.cycles
+	return gcCycleSample{
+		cycles:        n,
+		allocPerCycle: float64(allocs-g.allocs) / float64(n),
+		heapGrowth:    float64(live) - float64(g.live),
+	}, true
+}
+
+// emitGCSamples emits a sample for the GC cycles completed since the last
+// call. Cycles completing between two calls are averaged together, so a
+// shorter ProfileInterval gives finer samples.
+func (m *Metrics) emitGCSamples() {
+	s, ok := m.gcSampler.read()
+	if !ok {
+		return
+	}
+	m.AddSample([]string{"runtime", "gc_cycle_alloc_bytes"}, float32(s.allocPerCycle))
+	m.AddSample([]string{"runtime", "gc_heap_growth_bytes"}, float32(s.heapGrowth))
+}
@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGCSampler_Observe(t *testing.T) {
+	g := newGCSampler()
+	if _, ok := g.observe(10, 1000, 500); ok {
+		t.Fatalf("first observation should not produce a sample")
+	}
+	if _, ok := g.observe(10, 1200, 600); ok {
+		t.Fatalf("no cycle completed")
+	}
+	s, ok := g.observe(12, 2200, 400)
+	if !ok {
+		t.Fatalf("expected a sample")
+	}
+	if s.cycles != 2 || s.allocPerCycle != 500 || s.heapGrowth != -200 {
+		t.Fatalf("bad sample: %+v", s)
+	}
+}
+
+var gcTestGarbage []byte
+
+func TestMetrics_EmitGCSamples(t *testing.T) {
+	m, met := mockMetric()
+	met.StrictNames = true
+	met.gcSampler = newGCSampler()
+	met.emitGCSamples()
+
+	for i := 0; i < 1000; i++ {
+		gcTestGarbage = make([]byte, 1024)
+	}
+	runtime.GC()
+	met.emitGCSamples()
+
+	keys := m.getKeys()
+	if len(keys) != 2 || keys[0][1] != "gc_cycle_alloc_bytes" || keys[1][1] != "gc_heap_growth_bytes" {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if m.vals[0] <= 0 {
+		t.Fatalf("bad allocated bytes: %v", m.vals[0])
+	}
+}
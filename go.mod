@@ -6,11 +6,14 @@ require (
 	github.com/DataDog/datadog-go v3.2.0+incompatible
 	github.com/armon/go-metrics v0.4.1
 	github.com/circonus-labs/circonus-gometrics v2.3.1+incompatible
+	github.com/golang/snappy v0.0.4
 	github.com/hashicorp/go-immutable-radix v1.0.0
 	github.com/pascaldekloe/goe v0.1.0
+	github.com/pion/dtls/v2 v2.2.12
 	github.com/prometheus/client_golang v1.11.1
 	github.com/prometheus/client_model v0.2.0
 	github.com/prometheus/common v0.26.0
+	golang.org/x/sys v0.20.0
 	google.golang.org/protobuf v1.33.0
 )
 
@@ -23,10 +26,13 @@ require (
 	github.com/hashicorp/go-retryablehttp v0.7.7 // indirect
 	github.com/hashicorp/golang-lru v0.5.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/transport/v2 v2.2.4 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/prometheus/procfs v0.6.0 // indirect
 	github.com/tv42/httpunix v0.0.0-20150427012821-b75d8614f926 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/crypto v0.18.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
 )
 
 // Introduced undocumented breaking change to metrics sink interface
@@ -0,0 +1,422 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// graphiteFlushInterval is how often aggregated metrics are sent to
+	// carbon. Graphite keeps a single value per path and retention step, so
+	// metrics are rolled up rather than sent on every call.
+	graphiteFlushInterval = 10 * time.Second
+
+	// graphiteBatchSize is the default number of datapoints per pickle
+	// message or plaintext write
+	graphiteBatchSize = 500
+
+	// graphitePlaintextPort and graphitePicklePort are the carbon ports,
+	// used when an address has no port
+	graphitePlaintextPort = "2003"
+	graphitePicklePort    = "2004"
+)
+
+// Carbon protocols spoken by GraphiteSink
+const (
+	GraphiteProtocolPlaintext = "plaintext"
+	GraphiteProtocolPickle    = "pickle"
+)
+
+// GraphiteOpts is used to configure a GraphiteSink.
+type GraphiteOpts struct {
+	// Protocol is GraphiteProtocolPlaintext, the default, or
+	// GraphiteProtocolPickle, which sends each batch as a single pickled
+	// list of (path, (timestamp, value)) tuples and suits high volume
+	// clusters better.
+	Protocol string
+
+	// Prefix is prepended to every metric path, separated with a '.'
+	Prefix string
+
+	// Tags sends labels using the Graphite 1.1 tag syntax, as in
+	// "path;name=value", instead of flattening their values into the path.
+	// A label called "name", which Graphite reserves for the path, is sent
+	// as "_name".
+	Tags bool
+
+	// FlushInterval is how often metrics are sent, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the number of datapoints per write, it defaults to 500
+	BatchSize int
+}
+
+// GraphiteSink provides a MetricSink that sends metrics to a Graphite carbon
+// daemon or relay over TCP. Metrics are aggregated in memory and sent on
+// every flush interval: gauges and key/value pairs report their last value,
+// counters their sum, and samples are sent as .count, .mean, .min and .max
+// paths. Labels are flattened into the path, or sent as tags.
+type GraphiteSink struct {
+	addr          string
+	dial          Dialer
+	prefix        string
+	tags          bool
+	batchSize     int
+	flushInterval time.Duration
+	encode        func(buf *bytes.Buffer, points []graphitePoint)
+
+	agg  *intervalAggregator
+	conn net.Conn
+	loop *flushLoop
+}
+
+// graphitePoint is a single datapoint sent to carbon
+type graphitePoint struct {
+	path      string
+	timestamp int64
+	value     float64
+}
+
+// NewGraphitePickleSink creates a GraphiteSink which speaks the carbon
+// pickle protocol to addr, typically port 2004. Relays that reject floods of
+// plaintext lines accept batches of up to batchSize datapoints per message;
+// zero selects a default of 500.
+func NewGraphitePickleSink(addr string, batchSize int) (*GraphiteSink, error) {
+	return NewGraphiteSink(addr, GraphiteOpts{Protocol: GraphiteProtocolPickle, BatchSize: batchSize})
+}
+
+// NewGraphiteSink creates a GraphiteSink which speaks the carbon plaintext
+// protocol to addr, typically port 2003, or the pickle protocol, typically
+// port 2004.
+func NewGraphiteSink(addr string, opts GraphiteOpts) (*GraphiteSink, error) {
+	var encode func(buf *bytes.Buffer, points []graphitePoint)
+	switch opts.Protocol {
+	case "", GraphiteProtocolPlaintext:
+		encode = encodeGraphitePlaintext
+	case GraphiteProtocolPickle:
+		encode = encodeGraphitePickle
+	default:
+		return nil, fmt.Errorf("unknown graphite protocol %q", opts.Protocol)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = graphiteBatchSize
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = graphiteFlushInterval
+	}
+	s := &GraphiteSink{
+		addr:          addr,
+		dial:          net.Dial,
+		prefix:        opts.Prefix,
+		tags:          opts.Tags,
+		batchSize:     batchSize,
+		flushInterval: interval,
+		encode:        encode,
+		agg:           newIntervalAggregator(),
+	}
+	s.loop = startFlushLoop(s.flushInterval, s.flushLoop)
+	return s, nil
+}
+
+// NewGraphiteSinkFromURL creates a GraphiteSink from a URL. It is used
+// (and tested) from NewMetricSinkFromURL.
+func NewGraphiteSinkFromURL(u *url.URL) (MetricSink, error) {
+	var opts GraphiteOpts
+	params := u.Query()
+	opts.Protocol = params.Get("protocol")
+	opts.Prefix = params.Get("prefix")
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := graphitePlaintextPort
+		if opts.Protocol == GraphiteProtocolPickle {
+			port = graphitePicklePort
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if v := params.Get("tags"); v != "" {
+		tags, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad 'tags' param: %s", err)
+		}
+		opts.Tags = tags
+	}
+	if v := params.Get("flush_interval"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad 'flush_interval' param: %s", err)
+		}
+		opts.FlushInterval = interval
+	}
+	if v := params.Get("batch_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad 'batch_size' param: %s", err)
+		}
+		opts.BatchSize = size
+	}
+	return NewGraphiteSink(addr, opts)
+}
+
+func (s *GraphiteSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *GraphiteSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *GraphiteSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *GraphiteSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *GraphiteSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *GraphiteSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *GraphiteSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *GraphiteSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *GraphiteSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Graphite sink supports.
+func (s *GraphiteSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: s.tags}
+}
+
+// Preflight checks that the Graphite address resolves and accepts
+// connections, see ValidatePipeline.
+func (s *GraphiteSink) Preflight(ctx context.Context) error {
+	return preflightDial(ctx, "tcp", s.addr)
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// sent.
+func (s *GraphiteSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *GraphiteSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *GraphiteSink) flushLoop(now time.Time, final bool) {
+	s.flush(now)
+	if final && s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+// flush sends everything aggregated since the last flush. It is only called
+// from the flush loop, which owns the connection.
+func (s *GraphiteSink) flush(now time.Time) {
+	points := s.points(s.agg.drain(), now.Unix())
+	if len(points) == 0 {
+		return
+	}
+
+	if s.conn == nil {
+		conn, err := s.dial("tcp", s.addr)
+		if err != nil {
+			log.Printf("[ERR] Error connecting to graphite! Err: %s", err)
+			return
+		}
+		s.conn = conn
+	}
+
+	var buf bytes.Buffer
+	for len(points) > 0 {
+		n := min(len(points), s.batchSize)
+		buf.Reset()
+		s.encode(&buf, points[:n])
+		if _, err := s.conn.Write(buf.Bytes()); err != nil {
+			log.Printf("[ERR] Error writing to graphite! Err: %s", err)
+			_ = s.conn.Close()
+			s.conn = nil
+			return
+		}
+		points = points[n:]
+	}
+}
+
+// points converts aggregates into carbon datapoints.
+func (s *GraphiteSink) points(aggs []*aggregate, ts int64) []graphitePoint {
+	var points []graphitePoint
+	for _, a := range aggs {
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			points = append(points, graphitePoint{s.path(a, ""), ts, a.last})
+		case aggregateCounter:
+			points = append(points, graphitePoint{s.path(a, ""), ts, a.sum})
+		case aggregateSample:
+			points = append(points,
+				graphitePoint{s.path(a, "count"), ts, float64(a.count)},
+				graphitePoint{s.path(a, "mean"), ts, a.mean()},
+				graphitePoint{s.path(a, "min"), ts, a.min},
+				graphitePoint{s.path(a, "max"), ts, a.max},
+			)
+		}
+	}
+	return points
+}
+
+// path builds the metric path of an aggregate, with an optional suffix
+// part, and its tags when enabled.
+func (s *GraphiteSink) path(a *aggregate, suffix string) string {
+	parts := a.key
+	if s.prefix != "" {
+		parts = insert(0, s.prefix, parts)
+	}
+	if suffix != "" {
+		parts = append(parts[:len(parts):len(parts)], suffix)
+	}
+	if !s.tags {
+		return s.flattenKeyLabels(parts, a.labels)
+	}
+
+	path := s.flattenKeyLabels(parts, nil)
+	for _, l := range a.labels {
+		name, value := graphiteTagName(l.Name), graphiteTagValue(l.Value)
+		if name == "" || value == "" {
+			// Graphite rejects empty tag names and values
+			continue
+		}
+		if name == "name" {
+			// The name tag holds the path of the series
+			name = "_name"
+		}
+		path += ";" + name + "=" + value
+	}
+	return path
+}
+
+// Flattens the key along with label values into a metric path, removing
+// characters with a meaning in the carbon protocols
+func (s *GraphiteSink) flattenKeyLabels(parts []string, labels []Label) string {
+	for _, label := range labels {
+		parts = append(parts[:len(parts):len(parts)], label.Value)
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ';':
+			return '_'
+		default:
+			return r
+		}
+	}, strings.Join(parts, "."))
+}
+
+// graphiteTagName replaces the characters Graphite does not allow in tag
+// names, and whitespace which would break the plaintext protocol
+func graphiteTagName(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ';', '=', '!', '^':
+			return '_'
+		default:
+			return r
+		}
+	}, v)
+}
+
+// graphiteTagValue replaces the characters Graphite does not allow in tag
+// values, which are ';' and a leading '~', and whitespace
+func graphiteTagValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', ';':
+			return '_'
+		default:
+			return r
+		}
+	}, v)
+	if strings.HasPrefix(v, "~") {
+		v = "_" + v[1:]
+	}
+	return v
+}
+
+// encodeGraphitePlaintext writes points as carbon plaintext lines of the
+// form "path value timestamp".
+func encodeGraphitePlaintext(buf *bytes.Buffer, points []graphitePoint) {
+	var scratch []byte
+	for _, p := range points {
+		buf.WriteString(p.path)
+		buf.WriteByte(' ')
+		scratch = strconv.AppendFloat(scratch[:0], p.value, 'f', -1, 64)
+		buf.Write(scratch)
+		buf.WriteByte(' ')
+		scratch = strconv.AppendInt(scratch[:0], p.timestamp, 10)
+		buf.Write(scratch)
+		buf.WriteByte('\n')
+	}
+}
+
+// encodeGraphitePickle writes points as a carbon pickle message: a 4 byte
+// big endian length header followed by a protocol 2 pickle of a list of
+// (path, (timestamp, value)) tuples.
+func encodeGraphitePickle(buf *bytes.Buffer, points []graphitePoint) {
+	var payload bytes.Buffer
+	var scratch [8]byte
+
+	payload.WriteString("\x80\x02") // PROTO 2
+	payload.WriteString("](")       // EMPTY_LIST, MARK
+	for _, p := range points {
+		payload.WriteByte('X') // BINUNICODE
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(p.path)))
+		payload.Write(scratch[:4])
+		payload.WriteString(p.path)
+
+		if p.timestamp >= math.MinInt32 && p.timestamp <= math.MaxInt32 {
+			payload.WriteByte('J') // BININT
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(int32(p.timestamp)))
+			payload.Write(scratch[:4])
+		} else {
+			payload.WriteString("\x8a\x08") // LONG1, 8 bytes
+			binary.LittleEndian.PutUint64(scratch[:], uint64(p.timestamp))
+			payload.Write(scratch[:])
+		}
+
+		payload.WriteByte('G') // BINFLOAT
+		binary.BigEndian.PutUint64(scratch[:], math.Float64bits(p.value))
+		payload.Write(scratch[:])
+
+		payload.WriteString("\x86\x86") // TUPLE2, TUPLE2
+	}
+	payload.WriteString("e.") // APPENDS, STOP
+
+	binary.BigEndian.PutUint32(scratch[:4], uint32(payload.Len()))
+	buf.Write(scratch[:4])
+	buf.Write(payload.Bytes())
+}
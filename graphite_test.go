@@ -0,0 +1,179 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGraphite_EncodePickle(t *testing.T) {
+	var buf bytes.Buffer
+	encodeGraphitePickle(&buf, []graphitePoint{{"a.b", 1700000000, 1.5}})
+
+	// Generated with pickle.dumps in Python, using MARK/APPENDS for the list
+	payload := "\x80\x02](X\x03\x00\x00\x00a.bJ\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x86e."
+	expected := append([]byte{0, 0, 0, byte(len(payload))}, payload...)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("got %q want %q", buf.Bytes(), expected)
+	}
+
+	// Timestamps past 2038 are encoded as longs
+	buf.Reset()
+	encodeGraphitePickle(&buf, []graphitePoint{{"a.b", 1 << 32, 1.5}})
+	if !bytes.Contains(buf.Bytes(), []byte("\x8a\x08\x00\x00\x00\x00\x01\x00\x00\x00")) {
+		t.Fatalf("expected long timestamp: %q", buf.Bytes())
+	}
+}
+
+func TestGraphite_PickleBatches(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s, err := NewGraphitePickleSink(ln.Addr().String(), 2)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"gauge"}, 1)
+	s.IncrCounterWithLabels([]string{"counter"}, 2, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"counter"}, 3, []Label{{"code", "200"}})
+	s.flush(time.Unix(1700000000, 0))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	// Two points with a batch size of two make a single message
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	var expected bytes.Buffer
+	encodeGraphitePickle(&expected, []graphitePoint{
+		{"counter.200", 1700000000, 5},
+		{"gauge", 1700000000, 1},
+	})
+	if !bytes.Equal(append(header[:], payload...), expected.Bytes()) {
+		t.Fatalf("got %q want %q", payload, expected.Bytes())
+	}
+}
+
+func TestGraphite_SamplePoints(t *testing.T) {
+	s := &GraphiteSink{agg: newIntervalAggregator()}
+	s.AddSample([]string{"req time"}, 10)
+	s.AddSample([]string{"req time"}, 20)
+
+	points := s.points(s.agg.drain(), 1)
+	expected := []graphitePoint{
+		{"req_time.count", 1, 2},
+		{"req_time.mean", 1, 15},
+		{"req_time.min", 1, 10},
+		{"req_time.max", 1, 20},
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("bad points: %v", points)
+	}
+	for i := range expected {
+		if points[i] != expected[i] {
+			t.Fatalf("got %v want %v", points[i], expected[i])
+		}
+	}
+}
+
+func TestGraphite_EncodePlaintext(t *testing.T) {
+	var buf bytes.Buffer
+	encodeGraphitePlaintext(&buf, []graphitePoint{{"a.b", 1700000000, 1.5}, {"c", 1700000000, 2}})
+	if got := buf.String(); got != "a.b 1.5 1700000000\nc 2 1700000000\n" {
+		t.Fatalf("bad lines %q", got)
+	}
+}
+
+func TestGraphite_Plaintext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s, err := NewGraphiteSink(ln.Addr().String(), GraphiteOpts{Prefix: "app", Tags: true, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"code", "200"}, {"path", "a=b;c"}, {"name", "x"}, {"q!", "~re"}})
+	s.AddSampleWithLabels([]string{"latency"}, 10, []Label{{"code", "200"}})
+	s.flush(time.Unix(1700000000, 0))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	expected := "app.requests;code=200;path=a=b_c;_name=x;q_=_re 2 1700000000\n" +
+		"app.latency.count;code=200 1 1700000000\n" +
+		"app.latency.mean;code=200 10 1700000000\n" +
+		"app.latency.min;code=200 10 1700000000\n" +
+		"app.latency.max;code=200 10 1700000000\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("got\n%s\nwant\n%s", buf, expected)
+	}
+}
+
+func TestNewGraphiteSinkFromURL(t *testing.T) {
+	u, _ := url.Parse("graphite://carbon?prefix=app&tags=true&flush_interval=5s&batch_size=10")
+	ms, err := NewGraphiteSinkFromURL(u)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s := ms.(*GraphiteSink)
+	defer s.Shutdown()
+	if s.addr != "carbon:2003" || s.prefix != "app" || !s.tags || s.flushInterval != 5*time.Second || s.batchSize != 10 {
+		t.Fatalf("bad sink: %+v", s)
+	}
+
+	u, _ = url.Parse("graphite://carbon?protocol=pickle")
+	ms, err = NewGraphiteSinkFromURL(u)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s = ms.(*GraphiteSink)
+	defer s.Shutdown()
+	var buf bytes.Buffer
+	s.encode(&buf, []graphitePoint{{"a", 1, 1}})
+	if s.addr != "carbon:2004" || buf.Bytes()[4] != 0x80 {
+		t.Fatalf("expected a pickle sink: %s %q", s.addr, buf.Bytes())
+	}
+
+	for _, bad := range []string{"graphite://carbon?tags=maybe", "graphite://carbon?protocol=json"} {
+		u, _ = url.Parse(bad)
+		if _, err := NewGraphiteSinkFromURL(u); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
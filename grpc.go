@@ -0,0 +1,519 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// grpcExportPath is the path of the Export method of the
+	// gometrics.v1.MetricsCollector service
+	grpcExportPath = "/gometrics.v1.MetricsCollector/Export"
+
+	// grpcFlushInterval, grpcBatchSize and grpcTimeout are used when the
+	// matching GRPCOpts are not set
+	grpcFlushInterval = time.Second
+	grpcBatchSize     = 500
+	grpcTimeout       = 10 * time.Second
+
+	// grpcMaxResponse bounds the response message read from the collector
+	grpcMaxResponse = 1 << 20
+)
+
+// gRPC status codes which are worth retrying, see grpc_collector.proto
+const (
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcAborted           = 10
+	grpcUnavailable       = 14
+)
+
+// Values of the MetricEvent.Type enum
+var grpcEventTypes = map[string]uint64{
+	"gauge":   1,
+	"counter": 2,
+	"sample":  3,
+	"key":     4,
+}
+
+// GRPCOpts is used to configure a GRPCSink.
+type GRPCOpts struct {
+	// Address is the collector, as a URL such as "https://collector:4317"
+	// or a host and port which is connected to with TLS
+	Address string
+
+	// TLSConfig configures the TLS connection, for example with client
+	// certificates, it defaults to verifying the collector with the system
+	// roots
+	TLSConfig *tls.Config
+
+	// HTTPClient replaces the client making the calls, which must speak
+	// HTTP/2. It is required for "http://" addresses, as plaintext HTTP/2
+	// is only available from transports such as golang.org/x/net/http2
+	// with AllowHTTP.
+	HTTPClient *http.Client
+
+	// Metadata is sent with every call, for example to authenticate with
+	// an "authorization" header
+	Metadata map[string]string
+
+	// FlushInterval is the longest an event is buffered, it defaults to
+	// one second
+	FlushInterval time.Duration
+
+	// BatchSize is the largest number of events sent in one call, it
+	// defaults to 500
+	BatchSize int
+
+	// QueueSize is the maximum number of buffered events, including those
+	// kept while the collector is unavailable, beyond which events are
+	// dropped and counted in Dropped. It defaults to DefaultWorkerQueueSize.
+	QueueSize int
+
+	// Timeout bounds every call, it defaults to 10 seconds
+	Timeout time.Duration
+
+	// RetryPolicy applies to failed calls, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush, and the
+	// events of a call which still fails with a status worth retrying are
+	// kept in the queue until then. Its Retryable defaults to the statuses
+	// listed in grpc_collector.proto.
+	RetryPolicy *RetryPolicy
+
+	// OnError is called with the number of events affected when a call
+	// fails, it defaults to logging the error
+	OnError func(err error, events int)
+}
+
+// GRPCStatusError is returned for calls which the collector completed with
+// a status other than OK.
+type GRPCStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *GRPCStatusError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", e.Code, e.Message)
+}
+
+// retryable reports whether the call may succeed when made again.
+func (e *GRPCStatusError) retryable() bool {
+	switch e.Code {
+	case grpcDeadlineExceeded, grpcResourceExhausted, grpcAborted, grpcUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// grpcRetryable reports whether a failed call may succeed when made again,
+// classifying HTTP errors of proxies in front of the collector with
+// IsRetryable.
+func grpcRetryable(err error) bool {
+	var statusErr *GRPCStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.retryable()
+	}
+	return IsRetryable(err)
+}
+
+// GRPCSink provides a MetricSink which sends every metric as an event to a
+// custom collector service over gRPC. The schema of the events and of the
+// gometrics.v1.MetricsCollector service the collector implements is
+// grpc_collector.proto, in the root of this module.
+//
+// Events are buffered and sent in batches with unary Export calls, so the
+// caller never waits on the collector. Batches which fail because the
+// collector is unavailable stay in the queue and are sent again once the
+// connection, which the HTTP/2 transport reestablishes, works again.
+type GRPCSink struct {
+	url       string
+	client    *http.Client
+	metadata  http.Header
+	batchSize int
+	timeout   time.Duration
+	interval  time.Duration
+	retry     RetryPolicy
+	onError   func(error, int)
+	queue     *eventQueue
+
+	// sendLock serializes flushes, which own failing
+	sendLock sync.Mutex
+	failing  bool
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewGRPCSink creates a GRPCSink and starts its flush goroutine.
+func NewGRPCSink(opts GRPCOpts) (*GRPCSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("grpc address is required")
+	}
+	addr := opts.Address
+	if !strings.Contains(addr, "://") {
+		addr = "https://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	client := opts.HTTPClient
+	switch {
+	case u.Scheme != "https" && u.Scheme != "http":
+		return nil, fmt.Errorf("unsupported grpc scheme %q", u.Scheme)
+	case u.Scheme == "http" && client == nil:
+		return nil, fmt.Errorf("plaintext grpc requires an HTTPClient speaking HTTP/2")
+	case client == nil:
+		tlsConfig := opts.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+		}}
+	}
+
+	metadata := make(http.Header)
+	for name, value := range opts.Metadata {
+		metadata.Set(name, value)
+	}
+	metadata.Set("Content-Type", "application/grpc+proto")
+	metadata.Set("Te", "trailers")
+	metadata.Set("User-Agent", "go-metrics grpc")
+
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = grpcFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = grpcBatchSize
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultWorkerQueueSize
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = grpcTimeout
+	}
+	metadata.Set("Grpc-Timeout", strconv.FormatInt(timeout.Milliseconds(), 10)+"m")
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+	if retry.Retryable == nil {
+		retry.Retryable = grpcRetryable
+	}
+	onError := opts.OnError
+	if onError == nil {
+		onError = func(err error, events int) {
+			log.Printf("[ERR] Error sending %d metrics to gRPC collector! Err: %s", events, err)
+		}
+	}
+
+	s := &GRPCSink{
+		url:       strings.TrimSuffix(u.String(), "/") + grpcExportPath,
+		client:    client,
+		metadata:  metadata,
+		batchSize: batchSize,
+		timeout:   timeout,
+		interval:  interval,
+		retry:     retry,
+		onError:   onError,
+		queue:     newEventQueue(queueSize, batchSize),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *GRPCSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *GRPCSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, float64(val), labels))
+}
+
+func (s *GRPCSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *GRPCSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, val, labels))
+}
+
+func (s *GRPCSink) EmitKey(key []string, val float32) {
+	s.queue.add(newMetricEvent("key", key, float64(val), nil))
+}
+
+func (s *GRPCSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *GRPCSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("counter", key, float64(val), labels))
+}
+
+func (s *GRPCSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *GRPCSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("sample", key, float64(val), labels))
+}
+
+// Capabilities reports what the gRPC sink supports.
+func (s *GRPCSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Dropped returns the number of events dropped so far because the queue was
+// full.
+func (s *GRPCSink) Dropped() uint64 {
+	return s.queue.droppedCount()
+}
+
+// Shutdown stops the flush goroutine after a last attempt to send the
+// buffered events.
+func (s *GRPCSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		<-s.doneCh
+	})
+}
+
+func (s *GRPCSink) run() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(JitterInterval(s.interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(JitterInterval(s.interval))
+			s.flush(true)
+		case <-s.queue.kickCh:
+			s.flush(false)
+		case <-s.stopCh:
+			s.flush(true)
+			return
+		}
+	}
+}
+
+// flush sends the buffered events in batches, retrying failed calls with the
+// RetryPolicy. Events are put back into the queue while the collector is
+// failing with a status worth retrying, and only sent again with the next
+// flush of the interval rather than as full batches are buffered.
+func (s *GRPCSink) flush(scheduled bool) {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	events := s.queue.take()
+	if len(events) == 0 {
+		return
+	}
+	if s.failing && !scheduled {
+		s.queue.requeue(events)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+	defer cancel()
+
+	for len(events) > 0 {
+		batch := events[:min(len(events), s.batchSize)]
+		var rejected int64
+		err := s.retry.Do(ctx, "gRPC collector", func() error {
+			var err error
+			rejected, err = s.export(batch)
+			return err
+		})
+		switch {
+		case err != nil && !s.retry.Retryable(err):
+			s.onError(err, len(batch))
+		case err != nil:
+			s.failing = true
+			s.queue.requeue(events)
+			s.onError(err, len(events))
+			return
+		case rejected > 0:
+			s.onError(fmt.Errorf("collector rejected %d events", rejected), int(rejected))
+		}
+		events = events[len(batch):]
+	}
+	s.failing = false
+}
+
+// export makes an Export call, returning the number of events the collector
+// rejected.
+func (s *GRPCSink) export(events []metricEvent) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	body := encodeGRPCMessage(encodeGRPCExportRequest(events))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = s.metadata.Clone()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.ProtoMajor != 2 {
+		return 0, fmt.Errorf("collector responded with %s rather than HTTP/2", resp.Proto)
+	}
+	if err := CheckHTTPResponse(resp); err != nil {
+		return 0, err
+	}
+
+	// The trailers carrying the status are only available once the body
+	// has been read to the end
+	msg, readErr := readGRPCMessage(resp.Body)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, grpcMaxResponse))
+	if err := grpcStatus(resp); err != nil {
+		return 0, err
+	}
+	if readErr != nil {
+		return 0, readErr
+	}
+	return decodeGRPCExportResponse(msg)
+}
+
+// grpcStatus returns the status of a completed call, which is sent in the
+// trailers, or in the headers of a response without a message.
+func grpcStatus(resp *http.Response) error {
+	code, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if code == "" {
+		return fmt.Errorf("collector response has no grpc-status")
+	}
+	n, err := strconv.Atoi(code)
+	if err != nil {
+		return fmt.Errorf("bad grpc-status %q", code)
+	}
+	if n == 0 {
+		return nil
+	}
+	if unescaped, err := url.PathUnescape(msg); err == nil {
+		msg = unescaped
+	}
+	return &GRPCStatusError{Code: n, Message: msg}
+}
+
+// encodeGRPCMessage prefixes an uncompressed message with its gRPC frame
+// header.
+func encodeGRPCMessage(msg []byte) []byte {
+	buf := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg)))
+	return append(buf, msg...)
+}
+
+// readGRPCMessage reads a single uncompressed gRPC message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("compressed grpc messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxResponse {
+		return nil, fmt.Errorf("grpc message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// encodeGRPCExportRequest encodes an ExportRequest message, see
+// grpc_collector.proto.
+func encodeGRPCExportRequest(events []metricEvent) []byte {
+	var out, event, label []byte
+	for _, e := range events {
+		event = event[:0]
+		event = protowire.AppendTag(event, 1, protowire.BytesType)
+		event = protowire.AppendString(event, e.name())
+		for _, part := range e.key {
+			event = protowire.AppendTag(event, 2, protowire.BytesType)
+			event = protowire.AppendString(event, part)
+		}
+		event = protowire.AppendTag(event, 3, protowire.VarintType)
+		event = protowire.AppendVarint(event, grpcEventTypes[e.typ])
+		event = protowire.AppendTag(event, 4, protowire.Fixed64Type)
+		event = protowire.AppendFixed64(event, math.Float64bits(e.val))
+		for _, l := range e.labels {
+			label = label[:0]
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.Name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.Value)
+			event = protowire.AppendTag(event, 5, protowire.BytesType)
+			event = protowire.AppendBytes(event, label)
+		}
+		event = protowire.AppendTag(event, 6, protowire.VarintType)
+		event = protowire.AppendVarint(event, uint64(e.time.UnixNano()))
+
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, event)
+	}
+	return out
+}
+
+// decodeGRPCExportResponse returns the rejected_events of an ExportResponse
+// message, skipping unknown fields.
+func decodeGRPCExportResponse(msg []byte) (int64, error) {
+	var rejected int64
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(msg)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			rejected = int64(v)
+			msg = msg[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return rejected, nil
+}
@@ -0,0 +1,286 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcCollector is a fake MetricsCollector recording the events it receives
+type grpcCollector struct {
+	srv *httptest.Server
+
+	lock     sync.Mutex
+	events   []string
+	metadata http.Header
+	status   []int // statuses of the next calls, OK once exhausted
+	rejected int64
+}
+
+func newGRPCCollector(t *testing.T) *grpcCollector {
+	c := &grpcCollector{}
+	c.srv = httptest.NewUnstartedServer(http.HandlerFunc(c.serve))
+	c.srv.EnableHTTP2 = true
+	c.srv.StartTLS()
+	t.Cleanup(c.srv.Close)
+	return c
+}
+
+func (c *grpcCollector) tlsConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.srv.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+func (c *grpcCollector) serve(resp http.ResponseWriter, req *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.metadata = req.Header.Clone()
+	if req.ProtoMajor != 2 || req.URL.Path != grpcExportPath {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+	msg, err := readGRPCMessage(req.Body)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/grpc+proto")
+	if len(c.status) > 0 {
+		status := c.status[0]
+		c.status = c.status[1:]
+		// A trailers-only response
+		resp.Header().Set("Grpc-Status", fmt.Sprint(status))
+		resp.Header().Set("Grpc-Message", "no%20luck")
+		resp.WriteHeader(http.StatusOK)
+		return
+	}
+	c.events = append(c.events, decodeTestGRPCEvents(msg)...)
+
+	resp.Header().Set("Trailer", "Grpc-Status")
+	resp.WriteHeader(http.StatusOK)
+	var out []byte
+	if c.rejected > 0 {
+		out = protowire.AppendTag(out, 1, protowire.VarintType)
+		out = protowire.AppendVarint(out, uint64(c.rejected))
+	}
+	_, _ = resp.Write(encodeGRPCMessage(out))
+	resp.Header().Set("Grpc-Status", "0")
+}
+
+func (c *grpcCollector) received() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.events...)
+}
+
+// decodeTestGRPCEvents renders the events of an ExportRequest as
+// "name type value label=value..." strings.
+func decodeTestGRPCEvents(msg []byte) []string {
+	var events []string
+	for len(msg) > 0 {
+		_, _, n := protowire.ConsumeTag(msg)
+		msg = msg[n:]
+		event, n := protowire.ConsumeBytes(msg)
+		msg = msg[n:]
+
+		var name, typ, value string
+		var labels []string
+		for len(event) > 0 {
+			num, wtyp, n := protowire.ConsumeTag(event)
+			event = event[n:]
+			switch num {
+			case 1:
+				v, n := protowire.ConsumeString(event)
+				name, event = v, event[n:]
+			case 3:
+				v, n := protowire.ConsumeVarint(event)
+				typ, event = fmt.Sprint(v), event[n:]
+			case 4:
+				v, n := protowire.ConsumeFixed64(event)
+				value, event = fmt.Sprint(math.Float64frombits(v)), event[n:]
+			case 5:
+				label, n := protowire.ConsumeBytes(event)
+				event = event[n:]
+				_, _, n = protowire.ConsumeTag(label)
+				k, n2 := protowire.ConsumeString(label[n:])
+				label = label[n+n2:]
+				_, _, n = protowire.ConsumeTag(label)
+				v, _ := protowire.ConsumeString(label[n:])
+				labels = append(labels, k+"="+v)
+			default:
+				n := protowire.ConsumeFieldValue(num, wtyp, event)
+				event = event[n:]
+			}
+		}
+		events = append(events, strings.Join(append([]string{name, typ, value}, labels...), " "))
+	}
+	return events
+}
+
+func TestGRPCSink(t *testing.T) {
+	c := newGRPCCollector(t)
+	s, err := NewGRPCSink(GRPCOpts{
+		Address:       c.srv.URL,
+		TLSConfig:     c.tlsConfig(),
+		Metadata:      map[string]string{"authorization": "Bearer secret"},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	s.SetPrecisionGauge([]string{"queue", "depth"}, 7.5)
+	s.AddSample([]string{"api", "latency"}, 12)
+	s.EmitKey([]string{"keys"}, 3)
+	s.Shutdown()
+
+	want := []string{
+		"api.requests 2 1 code=200",
+		"queue.depth 1 7.5",
+		"api.latency 3 12",
+		"keys 4 3",
+	}
+	if got := c.received(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("bad events %q", got)
+	}
+	if c.metadata.Get("Authorization") != "Bearer secret" || c.metadata.Get("Content-Type") != "application/grpc+proto" {
+		t.Fatalf("bad metadata %v", c.metadata)
+	}
+}
+
+func TestGRPCSink_Retry(t *testing.T) {
+	c := newGRPCCollector(t)
+	c.status = []int{grpcUnavailable, grpcUnavailable, grpcUnavailable}
+	var errs []string
+	s, err := NewGRPCSink(GRPCOpts{
+		Address:       c.srv.URL,
+		TLSConfig:     c.tlsConfig(),
+		FlushInterval: time.Hour,
+		RetryPolicy:   &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		OnError:       func(err error, events int) { errs = append(errs, fmt.Sprintf("%d %s", events, err)) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"a"}, 1)
+	s.flush(true)
+	if len(c.received()) != 0 || len(errs) != 1 || errs[0] != "1 grpc status 14: no luck" {
+		t.Fatalf("expected the call to fail, got %q", errs)
+	}
+
+	// The events are kept until the next flush of the interval, where the
+	// call succeeds once retried
+	s.SetGauge([]string{"b"}, 2)
+	s.flush(false)
+	if len(c.received()) != 0 {
+		t.Fatalf("expected the events to wait for the next flush")
+	}
+	s.flush(true)
+	if got := c.received(); len(got) != 2 || got[0] != "a 1 1" || got[1] != "b 1 2" {
+		t.Fatalf("bad events %q", got)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors %q", errs)
+	}
+}
+
+func TestGRPCStatusError_Retryable(t *testing.T) {
+	for code, want := range map[int]bool{
+		1:                     false,
+		3:                     false,
+		grpcDeadlineExceeded:  true,
+		grpcResourceExhausted: true,
+		grpcAborted:           true,
+		grpcUnavailable:       true,
+	} {
+		if got := grpcRetryable(&GRPCStatusError{Code: code}); got != want {
+			t.Fatalf("code %d: got %v want %v", code, got, want)
+		}
+	}
+}
+
+func TestGRPCSink_Permanent(t *testing.T) {
+	c := newGRPCCollector(t)
+	c.status = []int{3}
+	var errs []string
+	s, err := NewGRPCSink(GRPCOpts{
+		Address:       c.srv.URL,
+		TLSConfig:     c.tlsConfig(),
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+		OnError:       func(err error, events int) { errs = append(errs, fmt.Sprintf("%d %s", events, err)) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// The rejected batch is dropped while the next one is still sent. Full
+	// batches are flushed right away, and the rest on shutdown.
+	c.lock.Lock()
+	c.rejected = 1
+	c.lock.Unlock()
+	s.SetGauge([]string{"a"}, 1)
+	s.SetGauge([]string{"b"}, 2)
+	s.Shutdown()
+	if got := c.received(); len(got) != 1 || got[0] != "b 1 2" {
+		t.Fatalf("bad events %q", got)
+	}
+	want := []string{"1 grpc status 3: no luck", "1 collector rejected 1 events"}
+	if strings.Join(errs, "|") != strings.Join(want, "|") {
+		t.Fatalf("bad errors %q", errs)
+	}
+}
+
+func TestGRPCSink_NotHTTP2(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}))
+	defer srv.Close()
+	s, err := NewGRPCSink(GRPCOpts{Address: srv.URL, HTTPClient: srv.Client(), FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if _, err := s.export(nil); err == nil || !strings.Contains(err.Error(), "rather than HTTP/2") {
+		t.Fatalf("expected HTTP/1 to be rejected, got %v", err)
+	}
+}
+
+func TestNewGRPCSink_Invalid(t *testing.T) {
+	for _, opts := range []GRPCOpts{
+		{},
+		{Address: "http://collector:4317"},
+		{Address: "ftp://collector"},
+	} {
+		if _, err := NewGRPCSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+
+	s, err := NewGRPCSink(GRPCOpts{Address: "collector:4317"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.url != "https://collector:4317"+grpcExportPath {
+		t.Fatalf("bad url %s", s.url)
+	}
+}
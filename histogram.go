@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DefaultHistogramBuckets are the bucket boundaries of histograms without
+// boundaries of their own, the same as the defaults of the Prometheus client.
+// They suit latencies in seconds.
+var DefaultHistogramBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramBuckets configures the bucket boundaries of histograms in sinks
+// which represent them as true histograms, such as the Prometheus and OTLP
+// sinks. Boundaries are the inclusive upper bounds of the buckets, in
+// increasing order, with an implicit +Inf bucket above the last one:
+//
+//	HistogramBuckets{
+//		Metrics: map[string][]float64{
+//			"api.response.bytes": {1024, 16384, 262144, 1048576},
+//		},
+//	}
+type HistogramBuckets struct {
+	// Default applies to histograms not listed in Metrics, it defaults to
+	// DefaultHistogramBuckets
+	Default []float64
+
+	// Metrics maps the keys of histograms, with '.' as the separator, to
+	// their boundaries. Keys are matched as the sink receives them, so
+	// including any service name or type prefix added by Metrics.
+	Metrics map[string][]float64
+
+	// Tuner, when set, learns the boundaries of histograms not listed in
+	// Metrics from the values the sink observes, see BucketTuner. Default
+	// applies while a histogram is learning, and histograms created in the
+	// meantime keep the Default boundaries.
+	Tuner *BucketTuner
+}
+
+// For returns the bucket boundaries of the histogram with the given key.
+func (h HistogramBuckets) For(key []string) []float64 {
+	if bounds, ok := h.Metrics[strings.Join(key, ".")]; ok {
+		return bounds
+	}
+	if h.Tuner != nil {
+		if bounds, ok := h.Tuner.Buckets(key); ok {
+			return bounds
+		}
+	}
+	if h.Default != nil {
+		return h.Default
+	}
+	return DefaultHistogramBuckets
+}
+
+// Observe feeds a value of the histogram with the given key to the Tuner, if
+// any, unless the histogram has boundaries in Metrics. Sinks call it for
+// every value recorded with AddHistogram.
+func (h HistogramBuckets) Observe(key []string, val float64) {
+	if h.Tuner == nil {
+		return
+	}
+	if _, ok := h.Metrics[strings.Join(key, ".")]; ok {
+		return
+	}
+	h.Tuner.Observe(key, val)
+}
+
+// Validate checks that all boundaries are finite and strictly increasing.
+func (h HistogramBuckets) Validate() error {
+	if err := validateHistogramBounds(h.Default); err != nil {
+		return fmt.Errorf("default histogram buckets: %w", err)
+	}
+	for name, bounds := range h.Metrics {
+		if err := validateHistogramBounds(bounds); err != nil {
+			return fmt.Errorf("histogram buckets of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func validateHistogramBounds(bounds []float64) error {
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("boundary %v is not finite", b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return fmt.Errorf("boundaries %v and %v are not increasing", bounds[i-1], b)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets_For(t *testing.T) {
+	var h HistogramBuckets
+	if got := h.For([]string{"api", "latency"}); !reflect.DeepEqual(got, DefaultHistogramBuckets) {
+		t.Fatalf("bad default buckets %v", got)
+	}
+
+	h = HistogramBuckets{
+		Default: []float64{1, 10},
+		Metrics: map[string][]float64{"api.response.bytes": {1024, 4096}},
+	}
+	if got := h.For([]string{"api", "response", "bytes"}); !reflect.DeepEqual(got, []float64{1024, 4096}) {
+		t.Fatalf("bad metric buckets %v", got)
+	}
+	if got := h.For([]string{"api", "latency"}); !reflect.DeepEqual(got, []float64{1, 10}) {
+		t.Fatalf("bad default buckets %v", got)
+	}
+}
+
+func TestHistogramBuckets_Tuner(t *testing.T) {
+	h := HistogramBuckets{
+		Default: []float64{1, 10},
+		Metrics: map[string][]float64{"api.response.bytes": {1024, 4096}},
+		Tuner:   NewBucketTuner(time.Hour, 2),
+	}
+	for _, v := range []float64{100, 200, 300, 400, math.Inf(1)} {
+		h.Observe([]string{"api", "latency"}, v)
+		h.Observe([]string{"api", "response", "bytes"}, v)
+	}
+	if got := h.For([]string{"api", "latency"}); !reflect.DeepEqual(got, []float64{1, 10}) {
+		t.Fatalf("bad buckets while learning %v", got)
+	}
+	h.Tuner.metrics["api.latency"].start = time.Now().Add(-time.Hour)
+
+	// Listed metrics are neither learned nor overridden
+	if _, ok := h.Tuner.Buckets([]string{"api", "response", "bytes"}); ok {
+		t.Fatalf("listed metric should not be learned")
+	}
+	if got := h.For([]string{"api", "response", "bytes"}); !reflect.DeepEqual(got, []float64{1024, 4096}) {
+		t.Fatalf("bad metric buckets %v", got)
+	}
+	if got := h.For([]string{"api", "latency"}); !reflect.DeepEqual(got, []float64{200, 400}) {
+		t.Fatalf("bad tuned buckets %v", got)
+	}
+	if got := h.For([]string{"api", "other"}); !reflect.DeepEqual(got, []float64{1, 10}) {
+		t.Fatalf("bad default buckets %v", got)
+	}
+}
+
+func TestHistogramBuckets_Validate(t *testing.T) {
+	valid := HistogramBuckets{
+		Default: []float64{-1, 0, 1},
+		Metrics: map[string][]float64{"a": {5}, "b": nil},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	cases := map[string]HistogramBuckets{
+		"default histogram buckets: boundaries 1 and 1 are not increasing": {Default: []float64{0, 1, 1}},
+		"histogram buckets of a: boundary NaN is not finite":               {Metrics: map[string][]float64{"a": {math.NaN()}}},
+		"histogram buckets of a: boundary +Inf is not finite":              {Metrics: map[string][]float64{"a": {1, math.Inf(1)}}},
+	}
+	for want, h := range cases {
+		if err := h.Validate(); err == nil || err.Error() != want {
+			t.Fatalf("bad error %v, want %s", err, want)
+		}
+	}
+}
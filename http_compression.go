@@ -0,0 +1,143 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// Content encodings supported by HTTPCompression
+const (
+	EncodingGzip     = "gzip"
+	EncodingSnappy   = "snappy"
+	EncodingIdentity = "identity"
+)
+
+// HTTPCompression configures how HTTP push sinks compress request bodies.
+type HTTPCompression struct {
+	// Encodings lists the content encodings to use in order of preference.
+	// When the endpoint rejects one with 415 Unsupported Media Type, the
+	// request is retried with the next one, which is then kept for later
+	// requests. It defaults to gzip, falling back to identity.
+	Encodings []string
+
+	// MinSize is the body size under which requests are sent uncompressed,
+	// as compressing small bodies costs more than it saves. Zero compresses
+	// every body.
+	MinSize int
+}
+
+// HTTPEncoder compresses and sends request bodies according to an
+// HTTPCompression, remembering which encoding the endpoint accepts. It is
+// safe for concurrent use.
+type HTTPEncoder struct {
+	encodings []string
+	minSize   int
+
+	lock    sync.Mutex
+	current int
+}
+
+// NewHTTPEncoder creates an HTTPEncoder, validating the encodings.
+func NewHTTPEncoder(c HTTPCompression) (*HTTPEncoder, error) {
+	encodings := c.Encodings
+	if len(encodings) == 0 {
+		encodings = []string{EncodingGzip, EncodingIdentity}
+	}
+	for _, enc := range encodings {
+		switch enc {
+		case EncodingGzip, EncodingSnappy, EncodingIdentity:
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", enc)
+		}
+	}
+	return &HTTPEncoder{encodings: encodings, minSize: c.MinSize}, nil
+}
+
+// Encoding returns the content encoding currently used for large bodies.
+func (e *HTTPEncoder) Encoding() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.encodings[e.current]
+}
+
+// Do sends body with the given method and headers, compressed with the
+// current encoding. The caller must close the body of the response.
+func (e *HTTPEncoder) Do(client *http.Client, method, url string, body []byte, header http.Header) (*http.Response, error) {
+	for {
+		enc := e.Encoding()
+		if len(body) < e.minSize {
+			enc = EncodingIdentity
+		}
+		encoded, err := encodeBody(enc, body)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(method, url, bytes.NewReader(encoded))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if enc != EncodingIdentity {
+			req.Header.Set("Content-Encoding", enc)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnsupportedMediaType || enc == EncodingIdentity || !e.fallback(enc) {
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+}
+
+// fallback moves past a rejected encoding, returning false when there is no
+// other encoding to try.
+func (e *HTTPEncoder) fallback(rejected string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.encodings[e.current] != rejected {
+		// Another request already moved on
+		return true
+	}
+	if e.current == len(e.encodings)-1 {
+		return false
+	}
+	e.current++
+	log.Printf("[WARN] metrics: endpoint rejected %s content encoding, using %s", rejected, e.encodings[e.current])
+	return true
+}
+
+func encodeBody(enc string, body []byte) ([]byte, error) {
+	switch enc {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case EncodingSnappy:
+		return snappy.Encode(nil, body), nil
+	default:
+		return body, nil
+	}
+}
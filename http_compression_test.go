@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestHTTPEncoder(t *testing.T) {
+	var encodings []string
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		enc := req.Header.Get("Content-Encoding")
+		encodings = append(encodings, enc)
+		raw, _ := io.ReadAll(req.Body)
+		switch enc {
+		case "gzip":
+			resp.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		case "snappy":
+			raw, _ = snappy.Decode(nil, raw)
+		}
+		bodies = append(bodies, string(raw))
+	}))
+	defer srv.Close()
+
+	e, err := NewHTTPEncoder(HTTPCompression{Encodings: []string{"gzip", "snappy"}, MinSize: 10})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, body := range []string{"a large enough body", "small", "another large body"} {
+		resp, err := e.Do(srv.Client(), http.MethodPost, srv.URL, []byte(body), http.Header{"X-Test": {"1"}})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("bad status: %d", resp.StatusCode)
+		}
+	}
+
+	if got := strings.Join(encodings, ","); got != "gzip,snappy,,snappy" {
+		t.Fatalf("bad encodings: %s", got)
+	}
+	if got := strings.Join(bodies, ","); got != "a large enough body,small,another large body" {
+		t.Fatalf("bad bodies: %s", got)
+	}
+	if e.Encoding() != "snappy" {
+		t.Fatalf("bad encoding: %s", e.Encoding())
+	}
+}
+
+func TestHTTPEncoder_Gzip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		raw, _ := io.ReadAll(zr)
+		_, _ = resp.Write(raw)
+	}))
+	defer srv.Close()
+
+	e, _ := NewHTTPEncoder(HTTPCompression{})
+	resp, err := e.Do(srv.Client(), http.MethodPost, srv.URL, []byte("hello"), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	raw, _ := io.ReadAll(resp.Body)
+	if string(raw) != "hello" {
+		t.Fatalf("bad echo: %q", raw)
+	}
+}
+
+func TestNewHTTPEncoder_Invalid(t *testing.T) {
+	if _, err := NewHTTPEncoder(HTTPCompression{Encodings: []string{"br"}}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
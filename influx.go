@@ -0,0 +1,312 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// influxFlushInterval is used when InfluxOpts.FlushInterval is not set
+	influxFlushInterval = 10 * time.Second
+
+	// influxBatchSize is used when InfluxOpts.BatchSize is not set, it is
+	// the batch size recommended by InfluxDB
+	influxBatchSize = 5000
+)
+
+// InfluxOpts is used to configure an InfluxSink. Setting Bucket selects the
+// InfluxDB v2 write API, otherwise Database selects the v1 one.
+type InfluxOpts struct {
+	// Address is the base URL of InfluxDB, for example
+	// "http://influxdb:8086"
+	Address string
+
+	// Org, Bucket and Token address the v2 write API
+	Org    string
+	Bucket string
+	Token  string
+
+	// Database and RetentionPolicy address the v1 write API, optionally
+	// authenticated with Username and Password
+	Database        string
+	RetentionPolicy string
+	Username        string
+	Password        string
+
+	// FlushInterval is how often metrics are written, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the maximum number of lines per write, it defaults to
+	// 5000
+	BatchSize int
+
+	// HTTPClient is used for writes, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of writes, which are gzip
+	// compressed by default
+	Compression HTTPCompression
+
+	// RetryPolicy applies to failed writes, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// InfluxSink provides a MetricSink that writes InfluxDB line protocol to the
+// v1 or v2 HTTP write API:
+//
+//	api.requests,code=200,metric_type=counter value=5 1700000000000000000
+//
+// Metrics are aggregated in memory and written in batches on every flush
+// interval. Labels become tags and the key, joined with '.', the
+// measurement. Gauges and key/value pairs report their last value, counters
+// their sum, and samples are written with count, sum, min, max and mean
+// fields. The metric_type tag mirrors the one added by Telegraf's statsd
+// input, like TelegrafSink.
+type InfluxSink struct {
+	url       string
+	headers   http.Header
+	client    *http.Client
+	encoder   *HTTPEncoder
+	retry     RetryPolicy
+	batchSize int
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewInfluxSink creates an InfluxSink and starts its flush loop.
+func NewInfluxSink(opts InfluxOpts) (*InfluxSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("influxdb address is required")
+	}
+	base := strings.TrimSuffix(opts.Address, "/")
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/plain; charset=utf-8")
+
+	query := url.Values{"precision": {"ns"}}
+	var endpoint string
+	switch {
+	case opts.Bucket != "":
+		endpoint = base + "/api/v2/write"
+		query.Set("bucket", opts.Bucket)
+		if opts.Org != "" {
+			query.Set("org", opts.Org)
+		}
+	case opts.Database != "":
+		endpoint = base + "/write"
+		query.Set("db", opts.Database)
+		if opts.RetentionPolicy != "" {
+			query.Set("rp", opts.RetentionPolicy)
+		}
+		if opts.Username != "" {
+			query.Set("u", opts.Username)
+			query.Set("p", opts.Password)
+		}
+	default:
+		return nil, fmt.Errorf("influxdb bucket or database is required")
+	}
+	if opts.Token != "" {
+		headers.Set("Authorization", "Token "+opts.Token)
+	}
+
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = influxFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = influxBatchSize
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	encoder, err := NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	s := &InfluxSink{
+		url:       endpoint + "?" + query.Encode(),
+		headers:   headers,
+		client:    client,
+		encoder:   encoder,
+		retry:     retry,
+		loop:      newFlushLoop(interval),
+		batchSize: batchSize,
+		agg:       newIntervalAggregator(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *InfluxSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *InfluxSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *InfluxSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *InfluxSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *InfluxSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *InfluxSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *InfluxSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *InfluxSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *InfluxSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the InfluxDB sink supports.
+func (s *InfluxSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// written.
+func (s *InfluxSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *InfluxSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *InfluxSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error writing to InfluxDB! Err: %s", err)
+	}
+}
+
+// flush writes everything aggregated since the last flush in batches.
+func (s *InfluxSink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	for len(aggs) > 0 {
+		n := len(aggs)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		var body []byte
+		for _, a := range aggs[:n] {
+			body = appendInfluxLine(body, a, now.UnixNano())
+		}
+		err := s.retry.Do(ctx, "InfluxDB", func() error {
+			resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, s.headers)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = resp.Body.Close() }()
+			return CheckHTTPResponse(resp)
+		})
+		if err != nil {
+			return err
+		}
+		aggs = aggs[n:]
+	}
+	return nil
+}
+
+// influxMeasurementEscaper and influxTagEscaper escape the characters with a
+// special meaning in line protocol
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// appendInfluxLine appends the line protocol encoding of an aggregate.
+func appendInfluxLine(b []byte, a *aggregate, ts int64) []byte {
+	b = append(b, influxMeasurementEscaper.Replace(strings.Join(a.key, "."))...)
+
+	var metricType string
+	switch a.kind {
+	case aggregateGauge:
+		metricType = "gauge"
+	case aggregateKV:
+		metricType = "kv"
+	case aggregateCounter:
+		metricType = "counter"
+	case aggregateSample:
+		metricType = "timing"
+	}
+	tags := append(append([]Label(nil), a.labels...), Label{"metric_type", metricType})
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	for _, t := range tags {
+		if t.Name == "" || t.Value == "" {
+			// Empty tag keys and values are rejected by InfluxDB
+			continue
+		}
+		b = append(b, ',')
+		b = append(b, influxTagEscaper.Replace(t.Name)...)
+		b = append(b, '=')
+		b = append(b, influxTagEscaper.Replace(t.Value)...)
+	}
+
+	b = append(b, ' ')
+	switch a.kind {
+	case aggregateGauge, aggregateKV:
+		b = appendInfluxField(b, "value", a.last)
+	case aggregateCounter:
+		b = appendInfluxField(b, "value", a.sum)
+	case aggregateSample:
+		b = append(b, "count="...)
+		b = strconv.AppendInt(b, int64(a.count), 10)
+		b = append(b, 'i', ',')
+		b = appendInfluxField(b, "sum", a.sum)
+		b = append(b, ',')
+		b = appendInfluxField(b, "min", a.min)
+		b = append(b, ',')
+		b = appendInfluxField(b, "max", a.max)
+		b = append(b, ',')
+		b = appendInfluxField(b, "mean", a.mean())
+	}
+
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, ts, 10)
+	return append(b, '\n')
+}
+
+func appendInfluxField(b []byte, name string, val float64) []byte {
+	b = append(b, name...)
+	b = append(b, '=')
+	return strconv.AppendFloat(b, val, 'g', -1, 64)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInfluxSink(t *testing.T) {
+	var bodies []string
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("bad request: %s %v", r.URL.Path, r.Header)
+		}
+		query = r.URL.RawQuery
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s, err := NewInfluxSink(InfluxOpts{
+		Address:       srv.URL,
+		Org:           "ops",
+		Bucket:        "telemetry",
+		Token:         "secret",
+		FlushInterval: time.Hour,
+		BatchSize:     2,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGaugeWithLabels([]string{"queue", "depth"}, 5, []Label{{"queue name", "a,b"}})
+	s.IncrCounter([]string{"requests"}, 2)
+	s.IncrCounter([]string{"requests"}, 3)
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+	if err := s.flush(time.Unix(1, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if query != "bucket=telemetry&org=ops&precision=ns" {
+		t.Fatalf("bad query: %s", query)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected two batches, got %d", len(bodies))
+	}
+	expected := "requests,metric_type=counter value=5 1000000000\n" +
+		"queue.depth,metric_type=gauge,queue\\ name=a\\,b value=5 1000000000\n" +
+		"latency,metric_type=timing count=2i,sum=40,min=10,max=30,mean=20 1000000000\n"
+	if got := strings.Join(bodies, ""); got != expected {
+		t.Fatalf("got\n%s\nwant\n%s", got, expected)
+	}
+}
+
+func TestInfluxSink_V1(t *testing.T) {
+	s, err := NewInfluxSink(InfluxOpts{
+		Address:         "http://influxdb:8086/",
+		Database:        "telemetry",
+		RetentionPolicy: "autogen",
+		Username:        "user",
+		Password:        "pass",
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.url != "http://influxdb:8086/write?db=telemetry&p=pass&precision=ns&rp=autogen&u=user" {
+		t.Fatalf("bad url: %s", s.url)
+	}
+
+	if _, err := NewInfluxSink(InfluxOpts{Address: "http://influxdb:8086"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// maxIngestBodySize bounds the size of a single ingestion request
+const maxIngestBodySize = 1 << 20
+
+// IngestMetric is a single metric submitted to the ingestion endpoint.
+type IngestMetric struct {
+	// Key is the metric key, one element per part
+	Key []string `json:"key"`
+
+	// Type is one of "counter", "gauge", "precision_gauge", "sample" or "kv"
+	Type string `json:"type"`
+
+	Value float64 `json:"value"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// IngestHandler returns an http.Handler which accepts POSTed JSON metrics and
+// emits them through this Metrics instance, so they are subject to the same
+// filters, prefixes and sinks as metrics emitted in process. This lets sidecar
+// scripts and non-Go subprocesses report through the parent's pipeline.
+//
+// The body may be a single IngestMetric object or an array of them. The
+// whole payload is validated before anything is emitted, so a bad request
+// has no effect.
+func (m *Metrics) IngestHandler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			resp.Header().Set("Allow", http.MethodPost)
+			http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		batch, err := decodeIngestBody(io.LimitReader(req.Body, maxIngestBodySize))
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, metric := range batch {
+			m.ingest(metric)
+		}
+		resp.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func decodeIngestBody(r io.Reader) ([]IngestMetric, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %s", err)
+	}
+
+	var batch []IngestMetric
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &batch); err != nil {
+			return nil, fmt.Errorf("invalid metric batch: %s", err)
+		}
+	} else {
+		var metric IngestMetric
+		if err := json.Unmarshal(raw, &metric); err != nil {
+			return nil, fmt.Errorf("invalid metric: %s", err)
+		}
+		batch = append(batch, metric)
+	}
+
+	for i, metric := range batch {
+		if len(metric.Key) == 0 {
+			return nil, fmt.Errorf("metric %d: missing key", i)
+		}
+		switch metric.Type {
+		case "counter", "gauge", "precision_gauge", "sample", "kv":
+		default:
+			return nil, fmt.Errorf("metric %d: unknown type %q", i, metric.Type)
+		}
+	}
+	return batch, nil
+}
+
+func (m *Metrics) ingest(metric IngestMetric) {
+	var labels []Label
+	for name, value := range metric.Labels {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	// Map iteration order is random, keep the label order deterministic
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+
+	switch metric.Type {
+	case "counter":
+		m.IncrCounterWithLabels(metric.Key, float32(metric.Value), labels)
+	case "gauge":
+		m.SetGaugeWithLabels(metric.Key, float32(metric.Value), labels)
+	case "precision_gauge":
+		m.SetPrecisionGaugeWithLabels(metric.Key, metric.Value, labels)
+	case "sample":
+		m.AddSampleWithLabels(metric.Key, float32(metric.Value), labels)
+	case "kv":
+		m.EmitKey(metric.Key, float32(metric.Value))
+	}
+}
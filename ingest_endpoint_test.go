@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIngestHandler(t *testing.T) {
+	m, met := mockMetric()
+	handler := met.IngestHandler()
+
+	body := `[
+		{"key": ["jobs", "done"], "type": "counter", "value": 3, "labels": {"queue": "a", "host": "b"}},
+		{"key": ["jobs", "pending"], "type": "gauge", "value": 7},
+		{"key": ["jobs", "runtime"], "type": "sample", "value": 1.5}
+	]`
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if resp.Code != http.StatusNoContent {
+		t.Fatalf("bad status: %d %s", resp.Code, resp.Body)
+	}
+
+	expected := [][]string{{"jobs", "done"}, {"jobs", "pending"}, {"jobs", "runtime"}}
+	if got := m.getKeys(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v want %v", got, expected)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{3, 7, 1.5}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	if !reflect.DeepEqual(m.labels[0], []Label{{"host", "b"}, {"queue", "a"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+
+	// A single object is accepted too
+	resp = httptest.NewRecorder()
+	body = `{"key": ["single"], "type": "precision_gauge", "value": 2}`
+	handler.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if resp.Code != http.StatusNoContent || m.precisionVals[0] != 2 {
+		t.Fatalf("bad status: %d %s", resp.Code, resp.Body)
+	}
+}
+
+func TestIngestHandler_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		desc   string
+		method string
+		body   string
+		status int
+	}{
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"bad json", http.MethodPost, "{", http.StatusBadRequest},
+		{"missing key", http.MethodPost, `{"type": "counter", "value": 1}`, http.StatusBadRequest},
+		{"unknown type", http.MethodPost, `{"key": ["a"], "type": "meter", "value": 1}`, http.StatusBadRequest},
+		{"one bad entry", http.MethodPost, `[{"key": ["a"], "type": "counter"}, {"key": ["a"]}]`, http.StatusBadRequest},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			m, met := mockMetric()
+			resp := httptest.NewRecorder()
+			met.IngestHandler().ServeHTTP(resp, httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body)))
+			if resp.Code != tc.status {
+				t.Fatalf("got status %d want %d", resp.Code, tc.status)
+			}
+			if len(m.getKeys()) != 0 {
+				t.Fatalf("nothing should be emitted: %v", m.getKeys())
+			}
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"maps"
 	"math"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +36,17 @@ type InmemSink struct {
 	intervalLock sync.RWMutex
 
 	rateDenom float64
+
+	// history keeps recent gauge values when enabled, see EnableGaugeHistory
+	history *gaugeHistory
+
+	// retainSamples is the number of raw values kept per sample key in each
+	// interval, see EnableSampleRetention
+	retainSamples int
+
+	// topK is the number of heavy hitters tracked per interval, see
+	// EnableTopK
+	topK int
 }
 
 // IntervalMetrics stores the aggregated metrics
@@ -66,6 +78,13 @@ type IntervalMetrics struct {
 	// done is closed when this interval has ended, and a new IntervalMetrics
 	// has been created to receive any future metrics.
 	done chan struct{}
+
+	// retained holds raw sample values when sample retention is enabled
+	retained map[string]*sampleReservoir
+
+	// hot holds the most frequent keys and label values when top-K
+	// tracking is enabled
+	hot *intervalHotSpots
 }
 
 // NewIntervalMetrics creates a new IntervalMetrics for a given interval
@@ -90,7 +109,7 @@ type AggregateSample struct {
 	SumSq       float64   `json:"-"` // The sum of squared values
 	Min         float64   // Minimum value
 	Max         float64   // Maximum value
-	LastUpdated time.Time `json:"-"` // When value was last updated
+	LastUpdated time.Time // When value was last updated
 }
 
 // Computes a Stddev of the values
@@ -152,7 +171,22 @@ func NewInmemSinkFromURL(u *url.URL) (MetricSink, error) {
 		return nil, fmt.Errorf("bad 'retain' param: %s", err)
 	}
 
-	return NewInmemSink(interval, retain), nil
+	sink := NewInmemSink(interval, retain)
+	if v := params.Get("gauge_history"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad 'gauge_history' param: %s", err)
+		}
+		sink.EnableGaugeHistory(size)
+	}
+	if v := params.Get("top_k"); v != "" {
+		k, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad 'top_k' param: %s", err)
+		}
+		sink.EnableTopK(k)
+	}
+	return sink, nil
 }
 
 // NewInmemSink is used to construct a new in-memory sink.
@@ -169,6 +203,11 @@ func NewInmemSink(interval, retain time.Duration) *InmemSink {
 	return i
 }
 
+// Capabilities reports what the in-memory sink supports.
+func (i *InmemSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Tags: true}
+}
+
 func (i *InmemSink) SetGauge(key []string, val float32) {
 	i.SetGaugeWithLabels(key, val, nil)
 }
@@ -179,7 +218,12 @@ func (i *InmemSink) SetGaugeWithLabels(key []string, val float32, labels []Label
 
 	intv.Lock()
 	defer intv.Unlock()
-	intv.Gauges[k] = GaugeValue{Name: name, Value: val, Labels: labels}
+	intv.Gauges[k] = GaugeValue{Name: name, Value: val, LastUpdated: time.Now(), Labels: labels}
+	i.trackHotSpots(intv, name, labels)
+
+	if i.history != nil {
+		i.history.add(k, float64(val))
+	}
 }
 
 func (i *InmemSink) SetPrecisionGauge(key []string, val float64) {
@@ -192,7 +236,12 @@ func (i *InmemSink) SetPrecisionGaugeWithLabels(key []string, val float64, label
 
 	intv.Lock()
 	defer intv.Unlock()
-	intv.PrecisionGauges[k] = PrecisionGaugeValue{Name: name, Value: val, Labels: labels}
+	intv.PrecisionGauges[k] = PrecisionGaugeValue{Name: name, Value: val, LastUpdated: time.Now(), Labels: labels}
+	i.trackHotSpots(intv, name, labels)
+
+	if i.history != nil {
+		i.history.add(k, val)
+	}
 }
 
 func (i *InmemSink) EmitKey(key []string, val float32) {
@@ -203,6 +252,20 @@ func (i *InmemSink) EmitKey(key []string, val float32) {
 	defer intv.Unlock()
 	vals := intv.Points[k]
 	intv.Points[k] = append(vals, val)
+	i.trackHotSpots(intv, k, nil)
+}
+
+// EmitKeys appends a batch of points for key under a single lock.
+func (i *InmemSink) EmitKeys(key []string, vals []float32) {
+	k := i.flattenKey(key)
+	intv := i.getInterval()
+
+	intv.Lock()
+	defer intv.Unlock()
+	intv.Points[k] = append(intv.Points[k], vals...)
+	for range vals {
+		i.trackHotSpots(intv, k, nil)
+	}
 }
 
 func (i *InmemSink) IncrCounter(key []string, val float32) {
@@ -226,6 +289,7 @@ func (i *InmemSink) IncrCounterWithLabels(key []string, val float32, labels []La
 		intv.Counters[k] = agg
 	}
 	agg.Ingest(float64(val), i.rateDenom)
+	i.trackHotSpots(intv, name, labels)
 }
 
 func (i *InmemSink) AddSample(key []string, val float32) {
@@ -249,6 +313,19 @@ func (i *InmemSink) AddSampleWithLabels(key []string, val float32, labels []Labe
 		intv.Samples[k] = agg
 	}
 	agg.Ingest(float64(val), i.rateDenom)
+	i.trackHotSpots(intv, name, labels)
+
+	if i.retainSamples > 0 {
+		if intv.retained == nil {
+			intv.retained = make(map[string]*sampleReservoir)
+		}
+		r, ok := intv.retained[k]
+		if !ok {
+			r = &sampleReservoir{}
+			intv.retained[k] = r
+		}
+		r.add(float64(val), i.retainSamples)
+	}
 }
 
 // Data is used to retrieve all the aggregated metrics
@@ -360,6 +437,9 @@ func (intv *IntervalMetrics) deepCopy() *IntervalMetrics {
 	for k, v := range intv.Samples {
 		c.Samples[k] = v.deepCopy()
 	}
+	if intv.hot != nil {
+		c.hot = intv.hot.clone()
+	}
 
 	return &c
 }
@@ -19,6 +19,11 @@ type MetricsSummary struct {
 	Points          []PointValue
 	Counters        []SampledValue
 	Samples         []SampledValue
+
+	// HotKeys and HotLabels are the most frequently emitted keys and label
+	// values of the interval, when top-K tracking is enabled
+	HotKeys   []HeavyHitter `json:",omitempty"`
+	HotLabels []HeavyHitter `json:",omitempty"`
 }
 
 type GaugeValue struct {
@@ -26,6 +31,13 @@ type GaugeValue struct {
 	Hash  string `json:"-"`
 	Value float32
 
+	// LastUpdated is when the gauge was last set within the interval
+	LastUpdated time.Time
+
+	// History holds the most recent values, oldest first, when gauge
+	// history is enabled on the InmemSink
+	History []float64 `json:",omitempty"`
+
 	Labels        []Label           `json:"-"`
 	DisplayLabels map[string]string `json:"Labels"`
 }
@@ -35,6 +47,13 @@ type PrecisionGaugeValue struct {
 	Hash  string `json:"-"`
 	Value float64
 
+	// LastUpdated is when the gauge was last set within the interval
+	LastUpdated time.Time
+
+	// History holds the most recent values, oldest first, when gauge
+	// history is enabled on the InmemSink
+	History []float64 `json:",omitempty"`
+
 	Labels        []Label           `json:"-"`
 	DisplayLabels map[string]string `json:"Labels"`
 }
@@ -82,7 +101,25 @@ func (i *InmemSink) DisplayMetrics(resp http.ResponseWriter, req *http.Request)
 		interval = data[n-2]
 	}
 
-	return newMetricSummaryFromInterval(interval), nil
+	summary := newMetricSummaryFromInterval(interval)
+	i.addHistory(&summary)
+	return summary, nil
+}
+
+// DisplayMetricsHandler returns an http.Handler serving DisplayMetrics, which
+// can be guarded with EndpointAuth. The response is encoded with the first
+// registered SnapshotCodec accepted by the client, or as JSON.
+func (i *InmemSink) DisplayMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		summary, err := i.DisplayMetrics(resp, req)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		codec := snapshotCodecForAccept(req.Header.Get("Accept"))
+		resp.Header().Set("Content-Type", codec.ContentType())
+		_ = NewSnapshotEncoder(resp, codec).Encode(summary)
+	})
 }
 
 func newMetricSummaryFromInterval(interval *IntervalMetrics) MetricsSummary {
@@ -136,6 +173,11 @@ func newMetricSummaryFromInterval(interval *IntervalMetrics) MetricsSummary {
 	summary.Counters = formatSamples(interval.Counters)
 	summary.Samples = formatSamples(interval.Samples)
 
+	if interval.hot != nil {
+		summary.HotKeys = interval.hot.keys.list()
+		summary.HotLabels = interval.hot.labels.list()
+	}
+
 	return summary
 }
 
@@ -177,6 +219,7 @@ func (i *InmemSink) Stream(ctx context.Context, encoder Encoder) {
 		select {
 		case <-interval.done:
 			summary := newMetricSummaryFromInterval(interval)
+			i.addHistory(&summary)
 			if err := encoder.Encode(summary); err != nil {
 				return
 			}
@@ -129,7 +129,13 @@ func TestDisplayMetrics(t *testing.T) {
 	}
 	result := raw.(MetricsSummary)
 
-	// Ignore the LastUpdated field, we don't export that anyway
+	// LastUpdated is checked separately
+	for i, got := range result.Gauges {
+		if got.LastUpdated.IsZero() {
+			t.Fatalf("bad: gauge %s has no LastUpdated", got.Hash)
+		}
+		expected.Gauges[i].LastUpdated = got.LastUpdated
+	}
 	for i, got := range result.Counters {
 		expected.Counters[i].LastUpdated = got.LastUpdated
 	}
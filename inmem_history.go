@@ -0,0 +1,100 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sync"
+)
+
+// gaugeHistory keeps a fixed size ring of the most recent values of every
+// gauge seen by an InmemSink, independently of the aggregation intervals.
+type gaugeHistory struct {
+	size int
+
+	lock  sync.Mutex
+	rings map[string]*valueRing
+}
+
+// valueRing is a fixed size ring buffer of values
+type valueRing struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newGaugeHistory(size int) *gaugeHistory {
+	return &gaugeHistory{
+		size:  size,
+		rings: make(map[string]*valueRing),
+	}
+}
+
+func (h *gaugeHistory) add(hash string, val float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.rings[hash]
+	if !ok {
+		r = &valueRing{values: make([]float64, h.size)}
+		h.rings[hash] = r
+	}
+	r.values[r.next] = val
+	r.next++
+	if r.next == len(r.values) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// get returns a copy of the recent values for a gauge, oldest first.
+func (h *gaugeHistory) get(hash string) []float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, ok := h.rings[hash]
+	if !ok {
+		return nil
+	}
+	if !r.full {
+		return append([]float64(nil), r.values[:r.next]...)
+	}
+	out := make([]float64, 0, len(r.values))
+	out = append(out, r.values[r.next:]...)
+	return append(out, r.values[:r.next]...)
+}
+
+// EnableGaugeHistory keeps the last size values of every gauge, across
+// intervals, and includes them in the History field of DisplayMetrics output
+// so embedded admin UIs can render sparklines without an external TSDB.
+// It should be called before the sink is used. A size of zero disables it.
+func (i *InmemSink) EnableGaugeHistory(size int) {
+	if size <= 0 {
+		i.history = nil
+		return
+	}
+	i.history = newGaugeHistory(size)
+}
+
+// GaugeHistory returns the recent values of a gauge, oldest first, or nil if
+// gauge history is not enabled or the gauge has not been set.
+func (i *InmemSink) GaugeHistory(key []string, labels []Label) []float64 {
+	if i.history == nil {
+		return nil
+	}
+	k, _ := i.flattenKeyLabels(key, labels)
+	return i.history.get(k)
+}
+
+// addHistory fills in the gauge histories of a summary, if enabled.
+func (i *InmemSink) addHistory(summary *MetricsSummary) {
+	if i.history == nil {
+		return
+	}
+	for j := range summary.Gauges {
+		summary.Gauges[j].History = i.history.get(summary.Gauges[j].Hash)
+	}
+	for j := range summary.PrecisionGauges {
+		summary.PrecisionGauges[j].History = i.history.get(summary.PrecisionGauges[j].Hash)
+	}
+}
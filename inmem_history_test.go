@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInmemSink_GaugeHistory(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 2*time.Hour)
+	if inm.GaugeHistory([]string{"foo"}, nil) != nil {
+		t.Fatalf("history should be disabled by default")
+	}
+
+	inm.EnableGaugeHistory(3)
+	for _, v := range []float32{1, 2, 3, 4, 5} {
+		inm.SetGauge([]string{"foo"}, v)
+	}
+	inm.SetPrecisionGaugeWithLabels([]string{"foo"}, 7, []Label{{"a", "b"}})
+
+	if got, want := inm.GaugeHistory([]string{"foo"}, nil), []float64{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+
+	raw, err := inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	summary := raw.(MetricsSummary)
+	if got, want := summary.Gauges[0].History, []float64{3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got, want := summary.PrecisionGauges[0].History, []float64{7}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestNewInmemSinkFromURL_GaugeHistory(t *testing.T) {
+	sink, err := NewMetricSinkFromURL("inmem://?interval=1s&retain=10s&gauge_history=5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if h := sink.(*InmemSink).history; h == nil || h.size != 5 {
+		t.Fatalf("bad history: %v", h)
+	}
+
+	if _, err := NewMetricSinkFromURL("inmem://?interval=1s&retain=10s&gauge_history=x"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// sampleReservoir keeps a bounded, uniformly sampled subset of the raw values
+// of a sample within an interval.
+type sampleReservoir struct {
+	seen   int
+	values []float64
+}
+
+func (r *sampleReservoir) add(val float64, max int) {
+	r.seen++
+	if len(r.values) < max {
+		r.values = append(r.values, val)
+	} else if j := rand.Intn(r.seen); j < max {
+		r.values[j] = val
+	}
+}
+
+// EnableSampleRetention keeps up to size raw values per sample key in every
+// interval, which makes Percentile queries possible. It should be called
+// before the sink is used. A size of zero disables retention.
+func (i *InmemSink) EnableSampleRetention(size int) {
+	if size < 0 {
+		size = 0
+	}
+	i.retainSamples = size
+}
+
+// Percentile returns the p-th percentile (0-100) of the samples recorded for
+// key and labels in the intervals that started within the given window,
+// including the current one. key is the flattened form of the metric key, as
+// shown by DisplayMetrics. It requires EnableSampleRetention; the second
+// return value is false if there are no retained samples to query.
+//
+// This lets applications make decisions, such as setting adaptive timeouts
+// from the observed p99, based on their own telemetry.
+func (i *InmemSink) Percentile(key string, labels []Label, p float64, window time.Duration) (float64, bool) {
+	return i.percentileAt(key, labels, p, window, time.Now())
+}
+
+func (i *InmemSink) percentileAt(key string, labels []Label, p float64, window time.Duration, now time.Time) (float64, bool) {
+	if i.retainSamples == 0 {
+		return 0, false
+	}
+	k, _ := i.flattenKeyLabels([]string{key}, labels)
+	cutoff := now.Add(-window).Truncate(i.interval)
+
+	var values []float64
+	i.intervalLock.RLock()
+	for _, intv := range i.intervals {
+		if intv.Interval.Before(cutoff) {
+			continue
+		}
+		intv.RLock()
+		if r, ok := intv.retained[k]; ok {
+			values = append(values, r.values...)
+		}
+		intv.RUnlock()
+	}
+	i.intervalLock.RUnlock()
+
+	if len(values) == 0 {
+		return 0, false
+	}
+	return percentile(values, p), true
+}
+
+// percentile computes the p-th percentile of values using linear
+// interpolation between the closest ranks. values is sorted in place.
+func percentile(values []float64, p float64) float64 {
+	sort.Float64s(values)
+	p = math.Max(0, math.Min(100, p))
+
+	rank := p / 100 * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return values[lower]
+	}
+	frac := rank - float64(lower)
+	return values[lower] + frac*(values[upper]-values[lower])
+}
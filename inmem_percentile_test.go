@@ -0,0 +1,51 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInmemSink_Percentile(t *testing.T) {
+	inm := NewInmemSink(time.Hour, 2*time.Hour)
+	inm.AddSample([]string{"rpc", "latency"}, 1)
+	if _, ok := inm.Percentile("rpc.latency", nil, 99, time.Hour); ok {
+		t.Fatalf("retention should be disabled by default")
+	}
+
+	inm = NewInmemSink(time.Hour, 2*time.Hour)
+	inm.EnableSampleRetention(1000)
+	for i := 1; i <= 100; i++ {
+		inm.AddSample([]string{"rpc", "latency"}, float32(i))
+		inm.AddSampleWithLabels([]string{"rpc", "latency"}, float32(1000+i), []Label{{"method", "get"}})
+	}
+
+	if v, ok := inm.Percentile("rpc.latency", nil, 50, time.Hour); !ok || v != 50.5 {
+		t.Fatalf("bad p50: %v %v", v, ok)
+	}
+	if v, ok := inm.Percentile("rpc.latency", nil, 100, time.Hour); !ok || v != 100 {
+		t.Fatalf("bad p100: %v %v", v, ok)
+	}
+	if v, ok := inm.Percentile("rpc.latency", []Label{{"method", "get"}}, 0, time.Hour); !ok || v != 1001 {
+		t.Fatalf("bad p0: %v %v", v, ok)
+	}
+	if _, ok := inm.Percentile("missing", nil, 99, time.Hour); ok {
+		t.Fatalf("expected no samples")
+	}
+
+	// Intervals older than the window are ignored
+	if _, ok := inm.percentileAt("rpc.latency", nil, 99, time.Hour, time.Now().Add(3*time.Hour)); ok {
+		t.Fatalf("expected no samples in window")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	if v := percentile([]float64{4, 1, 3, 2}, 50); v != 2.5 {
+		t.Fatalf("bad: %v", v)
+	}
+	if v := percentile([]float64{7}, 99); v != 7 {
+		t.Fatalf("bad: %v", v)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteMarkdown renders the summary as Markdown tables, one per metric type,
+// for attaching to incident tickets and CI reports. Empty metric types are
+// left out.
+func (s MetricsSummary) WriteMarkdown(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# Metrics at %s\n", s.Timestamp)
+
+	table := func(title string, header []string, rows [][]string) {
+		if len(rows) == 0 {
+			return
+		}
+		fmt.Fprintf(bw, "\n## %s\n\n", title)
+		writeMarkdownRow(bw, header)
+		sep := make([]string, len(header))
+		for i := range sep {
+			sep[i] = "---"
+		}
+		writeMarkdownRow(bw, sep)
+		for _, row := range rows {
+			writeMarkdownRow(bw, row)
+		}
+	}
+
+	var rows [][]string
+	for _, g := range s.Gauges {
+		rows = append(rows, []string{g.Name, formatReportLabels(g.DisplayLabels), formatReportValue(float64(g.Value))})
+	}
+	table("Gauges", []string{"Name", "Labels", "Value"}, rows)
+
+	rows = nil
+	for _, g := range s.PrecisionGauges {
+		rows = append(rows, []string{g.Name, formatReportLabels(g.DisplayLabels), formatReportValue(g.Value)})
+	}
+	table("Precision Gauges", []string{"Name", "Labels", "Value"}, rows)
+
+	rows = nil
+	for _, p := range s.Points {
+		vals := make([]string, len(p.Points))
+		for i, v := range p.Points {
+			vals[i] = formatReportValue(float64(v))
+		}
+		rows = append(rows, []string{p.Name, strings.Join(vals, ", ")})
+	}
+	table("Points", []string{"Name", "Values"}, rows)
+
+	sampledRows := func(values []SampledValue) [][]string {
+		var rows [][]string
+		for _, v := range values {
+			row := []string{v.Name, formatReportLabels(v.DisplayLabels)}
+			if v.AggregateSample != nil {
+				row = append(row,
+					strconv.Itoa(v.Count),
+					formatReportValue(v.Sum),
+					formatReportValue(v.Min),
+					formatReportValue(v.Max),
+					formatReportValue(v.Mean),
+					formatReportValue(v.Stddev))
+			} else {
+				row = append(row, "0", "", "", "", "", "")
+			}
+			rows = append(rows, row)
+		}
+		return rows
+	}
+	sampledHeader := []string{"Name", "Labels", "Count", "Sum", "Min", "Max", "Mean", "Stddev"}
+	table("Counters", sampledHeader, sampledRows(s.Counters))
+	table("Samples", sampledHeader, sampledRows(s.Samples))
+
+	return bw.Flush()
+}
+
+// markdownCellEscaper escapes the characters that would break a table cell
+var markdownCellEscaper = strings.NewReplacer("|", `\|`, "\n", " ")
+
+func writeMarkdownRow(w io.Writer, cells []string) {
+	escaped := make([]string, len(cells))
+	for i, c := range cells {
+		escaped[i] = markdownCellEscaper.Replace(c)
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(escaped, " | "))
+}
+
+// formatReportLabels renders display labels as name=value pairs sorted by
+// name.
+func formatReportLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + labels[name]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func formatReportValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+// sparklineSVG renders values as a small inline SVG line chart. Nothing is
+// rendered for fewer than two values.
+func sparklineSVG(values []float64) template.HTML {
+	if len(values) < 2 {
+		return ""
+	}
+	const width, height = 100.0, 20.0
+
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	span := max - min
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := width * float64(i) / float64(len(values)-1)
+		y := height / 2
+		if span > 0 {
+			y = height - height*(v-min)/span
+		}
+		points[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+	// Only numbers are interpolated, so the markup is safe as is
+	return template.HTML(fmt.Sprintf(
+		`<svg class="spark" width="%d" height="%d" viewBox="-1 -1 %d %d"><polyline fill="none" stroke="currentColor" points="%s"/></svg>`,
+		int(width), int(height), int(width)+2, int(height)+2, strings.Join(points, " ")))
+}
+
+// reportRow is a table row of the HTML report
+type reportRow struct {
+	Cells     []string
+	Sparkline template.HTML
+}
+
+// reportTable is a table of the HTML report, with a trailing column of
+// sparklines when Trend is set
+type reportTable struct {
+	Title  string
+	Header []string
+	Trend  bool
+	Rows   []reportRow
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Metrics at {{.Timestamp}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; cursor: pointer; user-select: none; }
+.spark { color: #36c; vertical-align: middle; }
+</style>
+</head>
+<body>
+<h1>Metrics at {{.Timestamp}}</h1>
+{{range $table := .Tables}}
+<h2>{{.Title}}</h2>
+<table>
+<thead><tr>{{range .Header}}<th>{{.}}</th>{{end}}{{if .Trend}}<th>Trend</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr>{{range .Cells}}<td>{{.}}</td>{{end}}{{if $table.Trend}}<td>{{.Sparkline}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+{{end}}
+<script>
+document.querySelectorAll("th").forEach(function (th) {
+  th.addEventListener("click", function () {
+    var table = th.closest("table"), body = table.tBodies[0];
+    var col = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var asc = th.dataset.order !== "asc";
+    th.dataset.order = asc ? "asc" : "desc";
+    var rows = Array.prototype.slice.call(body.rows);
+    rows.sort(function (a, b) {
+      var x = a.cells[col] ? a.cells[col].textContent : "";
+      var y = b.cells[col] ? b.cells[col].textContent : "";
+      var nx = parseFloat(x), ny = parseFloat(y);
+      var c = (!isNaN(nx) && !isNaN(ny)) ? nx - ny : x.localeCompare(y);
+      return asc ? c : -c;
+    });
+    rows.forEach(function (r) { body.appendChild(r); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// WriteHTML renders the summary as a self-contained HTML page, with tables
+// that sort when a header is clicked and sparklines of gauge history and
+// points. Empty metric types are left out.
+func (s MetricsSummary) WriteHTML(w io.Writer) error {
+	var tables []reportTable
+
+	gauges := reportTable{Title: "Gauges", Header: []string{"Name", "Labels", "Value"}, Trend: true}
+	for _, g := range s.Gauges {
+		gauges.Rows = append(gauges.Rows, reportRow{
+			Cells:     []string{g.Name, formatReportLabels(g.DisplayLabels), formatReportValue(float64(g.Value))},
+			Sparkline: sparklineSVG(g.History),
+		})
+	}
+	precision := reportTable{Title: "Precision Gauges", Header: []string{"Name", "Labels", "Value"}, Trend: true}
+	for _, g := range s.PrecisionGauges {
+		precision.Rows = append(precision.Rows, reportRow{
+			Cells:     []string{g.Name, formatReportLabels(g.DisplayLabels), formatReportValue(g.Value)},
+			Sparkline: sparklineSVG(g.History),
+		})
+	}
+	points := reportTable{Title: "Points", Header: []string{"Name", "Count", "Last"}, Trend: true}
+	for _, p := range s.Points {
+		vals := make([]float64, len(p.Points))
+		for i, v := range p.Points {
+			vals[i] = float64(v)
+		}
+		last := ""
+		if len(vals) > 0 {
+			last = formatReportValue(vals[len(vals)-1])
+		}
+		points.Rows = append(points.Rows, reportRow{
+			Cells:     []string{p.Name, strconv.Itoa(len(vals)), last},
+			Sparkline: sparklineSVG(vals),
+		})
+	}
+	sampled := func(title string, values []SampledValue) reportTable {
+		t := reportTable{Title: title, Header: []string{"Name", "Labels", "Count", "Sum", "Min", "Max", "Mean", "Stddev"}}
+		for _, v := range values {
+			row := []string{v.Name, formatReportLabels(v.DisplayLabels), "0", "", "", "", "", ""}
+			if v.AggregateSample != nil {
+				row = []string{v.Name, formatReportLabels(v.DisplayLabels),
+					strconv.Itoa(v.Count),
+					formatReportValue(v.Sum),
+					formatReportValue(v.Min),
+					formatReportValue(v.Max),
+					formatReportValue(v.Mean),
+					formatReportValue(v.Stddev)}
+			}
+			t.Rows = append(t.Rows, reportRow{Cells: row})
+		}
+		return t
+	}
+
+	for _, t := range []reportTable{gauges, precision, points, sampled("Counters", s.Counters), sampled("Samples", s.Samples)} {
+		if len(t.Rows) > 0 {
+			tables = append(tables, t)
+		}
+	}
+	return reportTemplate.Execute(w, struct {
+		Timestamp string
+		Tables    []reportTable
+	}{s.Timestamp, tables})
+}
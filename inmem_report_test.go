@@ -0,0 +1,98 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func reportSummary() MetricsSummary {
+	return MetricsSummary{
+		Timestamp: "2024-01-01 00:00:00 +0000 UTC",
+		Gauges: []GaugeValue{{
+			Name:          "queue.depth",
+			Value:         5,
+			History:       []float64{1, 3, 5},
+			DisplayLabels: map[string]string{"queue": "a|b", "dc": "east"},
+		}},
+		Points: []PointValue{{Name: "batch", Points: []float32{1, 2}}},
+		Counters: []SampledValue{{
+			Name:            "requests",
+			AggregateSample: &AggregateSample{Count: 2, Sum: 5, Min: 2, Max: 3},
+			Mean:            2.5,
+			Stddev:          0.707107,
+			DisplayLabels:   map[string]string{},
+		}},
+	}
+}
+
+func TestMetricsSummary_WriteMarkdown(t *testing.T) {
+	var buf bytes.Buffer
+	if err := reportSummary().WriteMarkdown(&buf); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	expected := `# Metrics at 2024-01-01 00:00:00 +0000 UTC
+
+## Gauges
+
+| Name | Labels | Value |
+| --- | --- | --- |
+| queue.depth | dc=east, queue=a\|b | 5 |
+
+## Points
+
+| Name | Values |
+| --- | --- |
+| batch | 1, 2 |
+
+## Counters
+
+| Name | Labels | Count | Sum | Min | Max | Mean | Stddev |
+| --- | --- | --- | --- | --- | --- | --- | --- |
+| requests |  | 2 | 5 | 2 | 3 | 2.5 | 0.707107 |
+`
+	if got := buf.String(); got != expected {
+		t.Fatalf("got\n%s\nwant\n%s", got, expected)
+	}
+}
+
+func TestMetricsSummary_WriteHTML(t *testing.T) {
+	summary := reportSummary()
+	summary.Gauges[0].Name = "<script>"
+
+	var buf bytes.Buffer
+	if err := summary.WriteHTML(&buf); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"<h2>Gauges</h2>",
+		"<th>Trend</th>",
+		"<h2>Points</h2>",
+		"<h2>Counters</h2>",
+		"&lt;script&gt;",
+		`<polyline fill="none" stroke="currentColor" points="0.0,20.0 50.0,10.0 100.0,0.0"/>`,
+		"<td>0.707107</td>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "<h2>Samples</h2>") {
+		t.Fatalf("empty tables should be left out")
+	}
+}
+
+func TestSparklineSVG(t *testing.T) {
+	if sparklineSVG([]float64{1}) != "" {
+		t.Fatalf("a single value should not render")
+	}
+	if got := string(sparklineSVG([]float64{2, 2})); !strings.Contains(got, `points="0.0,10.0 100.0,10.0"`) {
+		t.Fatalf("flat values should render mid height: %s", got)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"hash/maphash"
+	"sort"
+)
+
+const (
+	// topKDepth and topKWidth size the count-min sketch of a heavyHitters,
+	// which overestimates a count by at most 2/topKWidth of all emissions
+	// with a probability of 1-2^-topKDepth
+	topKDepth = 4
+	topKWidth = 2048
+)
+
+// topKSeed hashes the items of every sketch
+var topKSeed = maphash.MakeSeed()
+
+// HeavyHitter is a metric key or label value which was emitted frequently
+// within an interval, see InmemSink.EnableTopK. Count is an estimate, which
+// may exceed the true count but is never below it.
+type HeavyHitter struct {
+	Name  string
+	Count uint64
+}
+
+// heavyHitters estimates the k most frequent items of a stream in bounded
+// space. Every item is counted in a count-min sketch, and the items with the
+// highest estimates are kept as candidates.
+type heavyHitters struct {
+	k      int
+	sketch []uint32
+	top    map[string]uint64
+}
+
+func newHeavyHitters(k int) *heavyHitters {
+	return &heavyHitters{
+		k:      k,
+		sketch: make([]uint32, topKDepth*topKWidth),
+		top:    make(map[string]uint64, k),
+	}
+}
+
+// add counts an item, and keeps it as a candidate if its estimate is among
+// the k highest.
+func (h *heavyHitters) add(item string) {
+	// The rows are indexed by combining two halves of one hash
+	sum := maphash.String(topKSeed, item)
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	estimate := uint32(0)
+	for row := uint32(0); row < topKDepth; row++ {
+		i := row*topKWidth + (h1+row*h2)%topKWidth
+		if h.sketch[i] < ^uint32(0) {
+			h.sketch[i]++
+		}
+		if row == 0 || h.sketch[i] < estimate {
+			estimate = h.sketch[i]
+		}
+	}
+
+	if _, ok := h.top[item]; ok || len(h.top) < h.k {
+		h.top[item] = uint64(estimate)
+		return
+	}
+	var minItem string
+	minCount := ^uint64(0)
+	for candidate, count := range h.top {
+		if count < minCount {
+			minItem, minCount = candidate, count
+		}
+	}
+	if uint64(estimate) > minCount {
+		delete(h.top, minItem)
+		h.top[item] = uint64(estimate)
+	}
+}
+
+// list returns the candidates, most frequent first.
+func (h *heavyHitters) list() []HeavyHitter {
+	out := make([]HeavyHitter, 0, len(h.top))
+	for name, count := range h.top {
+		out = append(out, HeavyHitter{Name: name, Count: count})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// clone copies the candidates only, for a copy of an interval which will not
+// be added to.
+func (h *heavyHitters) clone() *heavyHitters {
+	c := &heavyHitters{k: h.k, top: make(map[string]uint64, len(h.top))}
+	for name, count := range h.top {
+		c.top[name] = count
+	}
+	return c
+}
+
+// intervalHotSpots tracks the most frequently emitted keys and label values
+// of an interval.
+type intervalHotSpots struct {
+	keys   *heavyHitters
+	labels *heavyHitters
+}
+
+func (h *intervalHotSpots) clone() *intervalHotSpots {
+	return &intervalHotSpots{keys: h.keys.clone(), labels: h.labels.clone()}
+}
+
+// EnableTopK tracks the k most frequently emitted metric keys, and the k most
+// frequent label values, in every interval and includes them in the HotKeys
+// and HotLabels fields of DisplayMetrics output, to find out which code path
+// is flooding the pipeline. Label values are shown as "name=value". Tracking
+// uses a fixed amount of memory per interval, however many distinct keys are
+// emitted. It should be called before the sink is used. A k of zero disables
+// it.
+func (i *InmemSink) EnableTopK(k int) {
+	if k < 0 {
+		k = 0
+	}
+	i.topK = k
+}
+
+// trackHotSpots counts an emission in the hot spots of an interval, when
+// enabled. The interval must be locked.
+func (i *InmemSink) trackHotSpots(intv *IntervalMetrics, name string, labels []Label) {
+	if i.topK == 0 {
+		return
+	}
+	if intv.hot == nil {
+		intv.hot = &intervalHotSpots{keys: newHeavyHitters(i.topK), labels: newHeavyHitters(i.topK)}
+	}
+	intv.hot.keys.add(name)
+	for _, label := range labels {
+		intv.hot.labels.add(label.Name + "=" + label.Value)
+	}
+}
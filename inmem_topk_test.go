@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHeavyHitters(t *testing.T) {
+	h := newHeavyHitters(3)
+	for i := 0; i < 10000; i++ {
+		// Three heavy items among many distinct light ones
+		h.add(fmt.Sprintf("light.%d", i))
+		if i%4 == 0 {
+			h.add("heavy.a")
+		}
+		if i%5 == 0 {
+			h.add("heavy.b")
+		}
+		if i%10 == 0 {
+			h.add("heavy.c")
+		}
+	}
+
+	top := h.list()
+	if len(top) != 3 {
+		t.Fatalf("bad top %v", top)
+	}
+	for j, want := range []struct {
+		name  string
+		count uint64
+	}{{"heavy.a", 2500}, {"heavy.b", 2000}, {"heavy.c", 1000}} {
+		// The sketch may only overestimate, by little at this width
+		if top[j].Name != want.name || top[j].Count < want.count || top[j].Count > want.count+50 {
+			t.Fatalf("bad top %v", top)
+		}
+	}
+}
+
+func TestInmemSink_TopK(t *testing.T) {
+	inm := NewInmemSink(time.Hour, time.Hour)
+	inm.EnableTopK(2)
+
+	for i := 0; i < 50; i++ {
+		inm.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"route", "/users"}, {"code", "200"}})
+	}
+	for i := 0; i < 20; i++ {
+		inm.AddSampleWithLabels([]string{"api", "latency"}, 1, []Label{{"route", "/users"}})
+	}
+	inm.SetGauge([]string{"queue"}, 1)
+	inm.EmitKeys([]string{"points"}, []float32{1, 2, 3})
+
+	summary, err := inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s := summary.(MetricsSummary)
+	if len(s.HotKeys) != 2 || s.HotKeys[0] != (HeavyHitter{"api.requests", 50}) || s.HotKeys[1] != (HeavyHitter{"api.latency", 20}) {
+		t.Fatalf("bad hot keys %v", s.HotKeys)
+	}
+	if len(s.HotLabels) != 2 || s.HotLabels[0] != (HeavyHitter{"route=/users", 70}) || s.HotLabels[1] != (HeavyHitter{"code=200", 50}) {
+		t.Fatalf("bad hot labels %v", s.HotLabels)
+	}
+
+	// Disabled, nothing is tracked
+	inm = NewInmemSink(time.Hour, time.Hour)
+	inm.IncrCounter([]string{"a"}, 1)
+	summary, _ = inm.DisplayMetrics(nil, nil)
+	if s := summary.(MetricsSummary); s.HotKeys != nil || s.HotLabels != nil {
+		t.Fatalf("unexpected hot spots %v %v", s.HotKeys, s.HotLabels)
+	}
+}
+
+func TestNewInmemSinkFromURL_TopK(t *testing.T) {
+	sink, err := NewMetricSinkFromURL("inmem://?interval=1s&retain=10s&top_k=5")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if k := sink.(*InmemSink).topK; k != 5 {
+		t.Fatalf("bad top k: %d", k)
+	}
+
+	if _, err := NewMetricSinkFromURL("inmem://?interval=1s&retain=10s&top_k=x"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// kafkaBatchSize is used when KafkaOpts.BatchSize is not set
+	kafkaBatchSize = 500
+
+	// kafkaFlushInterval is used when KafkaOpts.FlushInterval is not set
+	kafkaFlushInterval = time.Second
+
+	// kafkaProduceTimeout is used when KafkaOpts.ProduceTimeout is not set
+	kafkaProduceTimeout = 10 * time.Second
+)
+
+// KafkaEncoding selects how a KafkaSink serializes metric events.
+type KafkaEncoding int
+
+const (
+	// KafkaJSON encodes every event as a JSON object:
+	//
+	//	{"name":"api.requests","type":"counter","value":1,
+	//	 "labels":{"code":"200"},"timestamp":"2024-01-02T15:04:05.123Z"}
+	KafkaJSON KafkaEncoding = iota
+
+	// KafkaAvro encodes every event in the Avro binary encoding of
+	// KafkaAvroSchema
+	KafkaAvro
+)
+
+// KafkaAvroSchema is the Avro schema of events encoded with KafkaAvro, to be
+// registered with a schema registry if one is used.
+const KafkaAvroSchema = `{"type":"record","name":"Metric","namespace":"com.hashicorp.gometrics","fields":[` +
+	`{"name":"name","type":"string"},` +
+	`{"name":"type","type":{"type":"enum","name":"MetricType","symbols":["gauge","counter","sample","key"]}},` +
+	`{"name":"value","type":"double"},` +
+	`{"name":"labels","type":{"type":"map","values":"string"}},` +
+	`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}}]}`
+
+// KafkaRecord is a message produced by a KafkaSink.
+type KafkaRecord struct {
+	// Key is the metric name, so the events of a metric keep their order
+	// on a single partition with the default partitioner
+	Key []byte
+
+	// Value is the encoded event
+	Value []byte
+}
+
+// KafkaProducer produces records to a Kafka topic. It is implemented by a
+// small adapter over the Kafka client already used by the application, such
+// as franz-go or sarama, so this package does not depend on one. Produce must
+// only return once the records are acknowledged or have failed.
+type KafkaProducer interface {
+	Produce(ctx context.Context, topic string, records []KafkaRecord) error
+}
+
+// KafkaOpts is used to configure a KafkaSink.
+type KafkaOpts struct {
+	// Producer sends the records, it is required
+	Producer KafkaProducer
+
+	// Topic receives the events, it is required
+	Topic string
+
+	// Encoding selects JSON or Avro events, it defaults to KafkaJSON
+	Encoding KafkaEncoding
+
+	// AvroSchemaID frames Avro events with the Confluent Schema Registry
+	// wire format, a zero byte and the big endian schema ID, when not zero
+	AvroSchemaID uint32
+
+	// BatchSize is the maximum number of records per Produce call, it
+	// defaults to 500. Reaching it triggers a flush.
+	BatchSize int
+
+	// FlushInterval is the longest an event is buffered, it defaults to
+	// one second
+	FlushInterval time.Duration
+
+	// QueueSize is the maximum number of buffered events, beyond which new
+	// events are dropped and counted in Dropped. It defaults to
+	// DefaultWorkerQueueSize.
+	QueueSize int
+
+	// ProduceTimeout bounds every Produce call, it defaults to 10 seconds
+	ProduceTimeout time.Duration
+
+	// OnError is called with the records of every failed Produce call, it
+	// defaults to logging the error
+	OnError func(err error, records []KafkaRecord)
+}
+
+// KafkaSink provides a MetricSink which produces every metric as an event,
+// with its name, type, value, labels and timestamp, to a Kafka topic. Events
+// are not aggregated: they are buffered and produced asynchronously in
+// batches, so the caller never waits on Kafka.
+type KafkaSink struct {
+	producer  KafkaProducer
+	topic     string
+	encoding  KafkaEncoding
+	schemaID  uint32
+	batchSize int
+	timeout   time.Duration
+	onError   func(error, []KafkaRecord)
+	queue     *eventQueue
+
+	// produceLock serializes flushes, keeping batches in order
+	produceLock sync.Mutex
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewKafkaSink creates a KafkaSink and starts its flush goroutine.
+func NewKafkaSink(opts KafkaOpts) (*KafkaSink, error) {
+	if opts.Producer == nil {
+		return nil, fmt.Errorf("kafka producer is required")
+	}
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("kafka topic is required")
+	}
+	switch opts.Encoding {
+	case KafkaJSON, KafkaAvro:
+	default:
+		return nil, fmt.Errorf("unknown kafka encoding %d", opts.Encoding)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = kafkaBatchSize
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = kafkaFlushInterval
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultWorkerQueueSize
+	}
+	timeout := opts.ProduceTimeout
+	if timeout <= 0 {
+		timeout = kafkaProduceTimeout
+	}
+	onError := opts.OnError
+	if onError == nil {
+		onError = func(err error, records []KafkaRecord) {
+			log.Printf("[ERR] Error producing %d metrics to Kafka! Err: %s", len(records), err)
+		}
+	}
+
+	s := &KafkaSink{
+		producer:  opts.Producer,
+		topic:     opts.Topic,
+		encoding:  opts.Encoding,
+		schemaID:  opts.AvroSchemaID,
+		batchSize: batchSize,
+		timeout:   timeout,
+		onError:   onError,
+		queue:     newEventQueue(queueSize, batchSize),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+func (s *KafkaSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *KafkaSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, float64(val), labels))
+}
+
+func (s *KafkaSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *KafkaSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, val, labels))
+}
+
+func (s *KafkaSink) EmitKey(key []string, val float32) {
+	s.queue.add(newMetricEvent("key", key, float64(val), nil))
+}
+
+func (s *KafkaSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *KafkaSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("counter", key, float64(val), labels))
+}
+
+func (s *KafkaSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *KafkaSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("sample", key, float64(val), labels))
+}
+
+// Capabilities reports what the Kafka sink supports.
+func (s *KafkaSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Dropped returns the number of events dropped because the buffer was full.
+func (s *KafkaSink) Dropped() uint64 {
+	return s.queue.droppedCount()
+}
+
+// Flush produces all buffered events and blocks until they are acknowledged
+// or have failed.
+func (s *KafkaSink) Flush() {
+	s.flush()
+}
+
+// Shutdown stops the flush goroutine and blocks while the remaining events
+// are produced.
+func (s *KafkaSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		<-s.doneCh
+	})
+}
+
+func (s *KafkaSink) run(interval time.Duration) {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(JitterInterval(interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(JitterInterval(interval))
+		case <-s.queue.kickCh:
+		case <-s.stopCh:
+			s.flush()
+			return
+		}
+		s.flush()
+	}
+}
+
+// flush produces the buffered events in batches of at most batchSize.
+func (s *KafkaSink) flush() {
+	s.produceLock.Lock()
+	defer s.produceLock.Unlock()
+
+	events := s.queue.take()
+	for len(events) > 0 {
+		n := min(len(events), s.batchSize)
+		records := make([]KafkaRecord, n)
+		for i, e := range events[:n] {
+			records[i] = s.encode(e)
+		}
+		events = events[n:]
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		err := s.producer.Produce(ctx, s.topic, records)
+		cancel()
+		if err != nil {
+			s.onError(err, records)
+		}
+	}
+}
+
+func (s *KafkaSink) encode(e metricEvent) KafkaRecord {
+	name := e.name()
+
+	var value []byte
+	switch s.encoding {
+	case KafkaAvro:
+		if s.schemaID != 0 {
+			value = append(value, 0)
+			value = binary.BigEndian.AppendUint32(value, s.schemaID)
+		}
+		value = appendAvroEvent(value, name, e.typ, e.val, e.labelMap(), e.time)
+	default:
+		value = e.marshalJSON()
+	}
+	return KafkaRecord{Key: []byte(name), Value: value}
+}
+
+// kafkaAvroTypes are the symbols of the MetricType enum in KafkaAvroSchema
+var kafkaAvroTypes = map[string]int64{"gauge": 0, "counter": 1, "sample": 2, "key": 3}
+
+// appendAvroEvent appends the Avro binary encoding of an event. Avro longs
+// and lengths are zigzag varints, as written by binary.AppendVarint.
+func appendAvroEvent(b []byte, name, typ string, val float64, labels map[string]string, t time.Time) []byte {
+	b = appendAvroString(b, name)
+	b = binary.AppendVarint(b, kafkaAvroTypes[typ])
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(val))
+
+	// A map is a block of pairs followed by an empty block
+	if len(labels) > 0 {
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		b = binary.AppendVarint(b, int64(len(names)))
+		for _, name := range names {
+			b = appendAvroString(b, name)
+			b = appendAvroString(b, labels[name])
+		}
+	}
+	b = binary.AppendVarint(b, 0)
+
+	return binary.AppendVarint(b, t.UnixMilli())
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
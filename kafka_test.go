@@ -0,0 +1,184 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kafkaRecorder is a KafkaProducer keeping every batch
+type kafkaRecorder struct {
+	lock    sync.Mutex
+	topic   string
+	batches [][]KafkaRecord
+	err     error
+}
+
+func (k *kafkaRecorder) Produce(ctx context.Context, topic string, records []KafkaRecord) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no deadline")
+	}
+	k.topic = topic
+	k.batches = append(k.batches, records)
+	return k.err
+}
+
+func TestKafkaSink_JSON(t *testing.T) {
+	p := &kafkaRecorder{}
+	s, err := NewKafkaSink(KafkaOpts{Producer: p, Topic: "metrics", BatchSize: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	s.SetPrecisionGauge([]string{"queue"}, 2.5)
+	s.AddSample([]string{"latency"}, 10)
+	s.Shutdown()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.topic != "metrics" {
+		t.Fatalf("bad topic %q", p.topic)
+	}
+	var records []KafkaRecord
+	for _, b := range p.batches {
+		if len(b) > 2 {
+			t.Fatalf("batch too large: %d", len(b))
+		}
+		records = append(records, b...)
+	}
+	if len(records) != 3 {
+		t.Fatalf("bad records %v", records)
+	}
+
+	type event struct {
+		Name      string
+		Type      string
+		Value     float64
+		Labels    map[string]string
+		Timestamp time.Time
+	}
+	var got []event
+	for _, r := range records {
+		var e event
+		if err := json.Unmarshal(r.Value, &e); err != nil {
+			t.Fatalf("bad value %s: %s", r.Value, err)
+		}
+		if string(r.Key) != e.Name {
+			t.Fatalf("bad key %s", r.Key)
+		}
+		if time.Since(e.Timestamp) > time.Minute {
+			t.Fatalf("bad timestamp %s", e.Timestamp)
+		}
+		e.Timestamp = time.Time{}
+		got = append(got, e)
+	}
+	expected := []event{
+		{Name: "api.requests", Type: "counter", Value: 1, Labels: map[string]string{"code": "200"}},
+		{Name: "queue", Type: "gauge", Value: 2.5, Labels: map[string]string{}},
+		{Name: "latency", Type: "sample", Value: 10, Labels: map[string]string{}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %+v want %+v", got, expected)
+	}
+}
+
+func TestKafkaSink_Avro(t *testing.T) {
+	p := &kafkaRecorder{}
+	s, err := NewKafkaSink(KafkaOpts{Producer: p, Topic: "metrics", Encoding: KafkaAvro, AvroSchemaID: 7, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	ts := time.UnixMilli(1700000000123)
+	r := s.encode(metricEvent{typ: "counter", key: []string{"a"}, val: 1.5, labels: []Label{{"k", "v"}}, time: ts})
+
+	b := r.Value
+	if b[0] != 0 || binary.BigEndian.Uint32(b[1:5]) != 7 {
+		t.Fatalf("bad schema registry framing % x", b[:5])
+	}
+	b = b[5:]
+	readLong := func() int64 {
+		v, n := binary.Varint(b)
+		b = b[n:]
+		return v
+	}
+	readString := func() string {
+		n := readLong()
+		s := string(b[:n])
+		b = b[n:]
+		return s
+	}
+	if name := readString(); name != "a" {
+		t.Fatalf("bad name %q", name)
+	}
+	if typ := readLong(); typ != 1 {
+		t.Fatalf("bad type %d", typ)
+	}
+	if val := math.Float64frombits(binary.LittleEndian.Uint64(b)); val != 1.5 {
+		t.Fatalf("bad value %v", val)
+	}
+	b = b[8:]
+	if n := readLong(); n != 1 {
+		t.Fatalf("bad map block %d", n)
+	}
+	if k, v := readString(), readString(); k != "k" || v != "v" {
+		t.Fatalf("bad label %q=%q", k, v)
+	}
+	if n := readLong(); n != 0 {
+		t.Fatalf("bad map end %d", n)
+	}
+	if ms := readLong(); ms != ts.UnixMilli() {
+		t.Fatalf("bad timestamp %d", ms)
+	}
+	if len(b) != 0 {
+		t.Fatalf("trailing bytes % x", b)
+	}
+}
+
+func TestKafkaSink_Errors(t *testing.T) {
+	p := &kafkaRecorder{err: errors.New("leader not available")}
+	var failed []KafkaRecord
+	s, err := NewKafkaSink(KafkaOpts{
+		Producer:      p,
+		Topic:         "metrics",
+		QueueSize:     2,
+		FlushInterval: time.Hour,
+		OnError: func(err error, records []KafkaRecord) {
+			failed = append(failed, records...)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounter([]string{"a"}, 1)
+	s.IncrCounter([]string{"b"}, 1)
+	s.IncrCounter([]string{"c"}, 1)
+	if s.Dropped() != 1 {
+		t.Fatalf("expected a dropped event, got %d", s.Dropped())
+	}
+	s.Flush()
+	if len(failed) != 2 {
+		t.Fatalf("expected failed records, got %v", failed)
+	}
+	s.Shutdown()
+	s.Shutdown()
+
+	if _, err := NewKafkaSink(KafkaOpts{Topic: "metrics"}); err == nil {
+		t.Fatalf("expected error without producer")
+	}
+	if _, err := NewKafkaSink(KafkaOpts{Producer: p}); err == nil {
+		t.Fatalf("expected error without topic")
+	}
+}
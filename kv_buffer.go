@@ -0,0 +1,91 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// kvBufferPoints bounds the key/value points held by the statsd family of
+// sinks between flushes
+const kvBufferPoints = 16384
+
+// kvBuffer holds the points of EmitKey and EmitKeys apart from the metric
+// queue of the statsd family of sinks, so bulk key/value dumps cannot crowd
+// out counters and gauges. Points are kept as values grouped by key and only
+// formatted by the flush goroutine, which bounds the memory of a flood to
+// the value of each point. Points beyond the bound are dropped.
+type kvBuffer struct {
+	lock   sync.Mutex
+	max    int
+	n      int
+	order  []string
+	points map[string][]float32
+
+	dropped uint64
+
+	// kick signals the flush goroutine that points are waiting
+	kick chan struct{}
+}
+
+func newKVBuffer(max int) *kvBuffer {
+	return &kvBuffer{
+		max:    max,
+		points: make(map[string][]float32),
+		kick:   make(chan struct{}, 1),
+	}
+}
+
+// add buffers points for a flattened key, dropping those which do not fit.
+func (b *kvBuffer) add(flatKey string, vals ...float32) {
+	b.lock.Lock()
+	room := b.max - b.n
+	if room < len(vals) {
+		atomic.AddUint64(&b.dropped, uint64(len(vals)-room))
+		vals = vals[:room]
+	}
+	if len(vals) > 0 {
+		existing, ok := b.points[flatKey]
+		if !ok {
+			b.order = append(b.order, flatKey)
+		}
+		b.points[flatKey] = append(existing, vals...)
+		b.n += len(vals)
+	}
+	b.lock.Unlock()
+
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the buffered points as statsd lines, grouped into chunks of at
+// most max bytes, and empties the buffer.
+func (b *kvBuffer) take(max int) []string {
+	b.lock.Lock()
+	order, points := b.order, b.points
+	b.order, b.points, b.n = nil, make(map[string][]float32), 0
+	b.lock.Unlock()
+
+	var chunks []string
+	for _, key := range order {
+		chunks = append(chunks, encodeKVBatch(key, points[key], max)...)
+	}
+	return chunks
+}
+
+// discard empties the buffer, counting its points as dropped.
+func (b *kvBuffer) discard() {
+	b.lock.Lock()
+	atomic.AddUint64(&b.dropped, uint64(b.n))
+	b.order, b.points, b.n = nil, make(map[string][]float32), 0
+	b.lock.Unlock()
+}
+
+// droppedCount returns the number of points dropped so far.
+func (b *kvBuffer) droppedCount() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
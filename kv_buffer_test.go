@@ -0,0 +1,63 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestKVBuffer(t *testing.T) {
+	b := newKVBuffer(4)
+	b.add("a", 1)
+	b.add("b", 2, 3)
+	b.add("a", 4, 5, 6)
+
+	select {
+	case <-b.kick:
+	default:
+		t.Fatalf("expected a kick")
+	}
+	if got := b.droppedCount(); got != 2 {
+		t.Fatalf("bad dropped %d", got)
+	}
+
+	// Points are grouped by key in the order keys were first seen
+	expected := []string{"a:1.000000|kv\na:4.000000|kv\n", "b:2.000000|kv\nb:3.000000|kv\n"}
+	if got := b.take(statsdMaxLen); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %q want %q", got, expected)
+	}
+	if got := b.take(statsdMaxLen); got != nil {
+		t.Fatalf("expected an empty buffer, got %q", got)
+	}
+
+	b.add("c", 7)
+	b.discard()
+	if got := b.droppedCount(); got != 3 || b.take(statsdMaxLen) != nil {
+		t.Fatalf("bad dropped %d", got)
+	}
+}
+
+func TestStatsd_KVFlood(t *testing.T) {
+	// Hold the sink before it connects, so nothing leaves the buffers
+	release := make(chan struct{})
+	s, _ := NewStatsdSinkWithDialer("127.0.0.1:0", func(string, string) (net.Conn, error) {
+		<-release
+		return nil, errors.New("closed")
+	})
+	defer s.Shutdown()
+	defer close(release)
+
+	s.EmitKeys([]string{"dump"}, make([]float32, 2*kvBufferPoints))
+	s.IncrCounter([]string{"requests"}, 1)
+
+	if got := s.KVDropped(); got != kvBufferPoints {
+		t.Fatalf("bad dropped %d", got)
+	}
+	if got := len(s.metricQueue); got != 1 {
+		t.Fatalf("expected the counter to be queued, got %d entries", got)
+	}
+}
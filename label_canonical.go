@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sort"
+)
+
+// LabelConflictPolicy decides what happens to a metric with several labels
+// of the same name but different values, see Config.CanonicalLabels
+type LabelConflictPolicy int
+
+const (
+	// LabelConflictLast keeps the last value given for the label
+	LabelConflictLast LabelConflictPolicy = iota
+
+	// LabelConflictFirst keeps the first value given for the label
+	LabelConflictFirst
+
+	// LabelConflictDrop drops the metric
+	LabelConflictDrop
+)
+
+// canonicalLabels sorts labels by name and removes duplicate names, resolving
+// conflicting values with policy. It returns false if the metric should be
+// dropped. The labels are not modified.
+func canonicalLabels(labels []Label, policy LabelConflictPolicy) ([]Label, bool) {
+	if len(labels) < 2 {
+		return labels, true
+	}
+
+	// Stable sorting keeps duplicates in the order they were given, so the
+	// first and last value of each name are adjacent
+	out := make([]Label, len(labels))
+	copy(out, labels)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	n := 0
+	for i := 0; i < len(out); i++ {
+		if n > 0 && out[n-1].Name == out[i].Name {
+			if out[n-1].Value == out[i].Value {
+				continue
+			}
+			switch policy {
+			case LabelConflictDrop:
+				return nil, false
+			case LabelConflictFirst:
+				continue
+			default:
+				out[n-1] = out[i]
+				continue
+			}
+		}
+		out[n] = out[i]
+		n++
+	}
+	return out[:n], true
+}
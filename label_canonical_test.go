@@ -0,0 +1,54 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonicalLabels(t *testing.T) {
+	in := []Label{{"b", "2"}, {"a", "1"}, {"b", "3"}, {"a", "1"}}
+	for _, tc := range []struct {
+		policy   LabelConflictPolicy
+		expected []Label
+		ok       bool
+	}{
+		{LabelConflictLast, []Label{{"a", "1"}, {"b", "3"}}, true},
+		{LabelConflictFirst, []Label{{"a", "1"}, {"b", "2"}}, true},
+		{LabelConflictDrop, nil, false},
+	} {
+		out, ok := canonicalLabels(in, tc.policy)
+		if ok != tc.ok || !reflect.DeepEqual(out, tc.expected) {
+			t.Fatalf("policy %d: bad labels %v %v", tc.policy, out, ok)
+		}
+	}
+	if !reflect.DeepEqual(in, []Label{{"b", "2"}, {"a", "1"}, {"b", "3"}, {"a", "1"}}) {
+		t.Fatalf("input was modified: %v", in)
+	}
+
+	// Identical duplicates are not a conflict
+	out, ok := canonicalLabels([]Label{{"a", "1"}, {"a", "1"}}, LabelConflictDrop)
+	if !ok || !reflect.DeepEqual(out, []Label{{"a", "1"}}) {
+		t.Fatalf("bad labels %v %v", out, ok)
+	}
+}
+
+func TestMetrics_CanonicalLabels(t *testing.T) {
+	m := &MockSink{}
+	met, _ := New(&Config{FilterDefault: true, CanonicalLabels: true, LabelConflict: LabelConflictDrop}, m)
+
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"b", "2"}, {"a", "1"}})
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"a", "1"}, {"b", "2"}})
+	met.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"a", "1"}, {"a", "2"}})
+
+	if len(m.labels) != 2 {
+		t.Fatalf("expected the conflicting metric to be dropped, got %v", m.labels)
+	}
+	for _, labels := range m.labels {
+		if !reflect.DeepEqual(labels, []Label{{"a", "1"}, {"b", "2"}}) {
+			t.Fatalf("bad labels %v", labels)
+		}
+	}
+}
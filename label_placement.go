@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+// LabelPlacement describes how a LabelPlacementSink adapts labels to the
+// conventions of the sink it wraps.
+type LabelPlacement struct {
+	// Prefix lists labels which are removed and have their values
+	// prepended to the key instead, in the given order. This suits sinks
+	// without tag support, or dashboards built around prefixed keys.
+	Prefix []string
+
+	// Rename maps label names to the name expected by the sink, for example
+	// "host" to "instance" for Prometheus.
+	Rename map[string]string
+}
+
+// LabelPlacementSink wraps a MetricSink and rewrites the labels of every
+// metric according to a LabelPlacement. Combined with EnableHostnameLabel
+// and EnableServiceLabel, this allows the host and service to be emitted as
+// labels to one sink and as key prefixes, or under a different label name,
+// to another.
+type LabelPlacementSink struct {
+	sink      MetricSink
+	placement LabelPlacement
+}
+
+// NewLabelPlacementSink wraps sink with the given label placement.
+func NewLabelPlacementSink(sink MetricSink, placement LabelPlacement) *LabelPlacementSink {
+	return &LabelPlacementSink{sink: sink, placement: placement}
+}
+
+func (l *LabelPlacementSink) SetGauge(key []string, val float32) {
+	l.SetGaugeWithLabels(key, val, nil)
+}
+
+func (l *LabelPlacementSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	key, labels = l.place(key, labels)
+	l.sink.SetGaugeWithLabels(key, val, labels)
+}
+
+func (l *LabelPlacementSink) SetPrecisionGauge(key []string, val float64) {
+	l.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (l *LabelPlacementSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	key, labels = l.place(key, labels)
+	setPrecisionGauge(l.sink, key, val, labels)
+}
+
+func (l *LabelPlacementSink) EmitKey(key []string, val float32) {
+	l.sink.EmitKey(key, val)
+}
+
+func (l *LabelPlacementSink) EmitKeys(key []string, vals []float32) {
+	emitKeys(l.sink, key, vals)
+}
+
+func (l *LabelPlacementSink) IncrCounter(key []string, val float32) {
+	l.IncrCounterWithLabels(key, val, nil)
+}
+
+func (l *LabelPlacementSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	key, labels = l.place(key, labels)
+	l.sink.IncrCounterWithLabels(key, val, labels)
+}
+
+func (l *LabelPlacementSink) AddSample(key []string, val float32) {
+	l.AddSampleWithLabels(key, val, nil)
+}
+
+func (l *LabelPlacementSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	key, labels = l.place(key, labels)
+	l.sink.AddSampleWithLabels(key, val, labels)
+}
+
+func (l *LabelPlacementSink) AddHistogram(key []string, val float64) {
+	l.AddHistogramWithLabels(key, val, nil)
+}
+
+func (l *LabelPlacementSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	key, labels = l.place(key, labels)
+	addHistogram(l.sink, key, val, labels)
+}
+
+// Shutdown forwards to the wrapped sink if it supports it.
+func (l *LabelPlacementSink) Shutdown() {
+	if ss, ok := l.sink.(ShutdownSink); ok {
+		ss.Shutdown()
+	}
+}
+
+// place returns the key and labels rewritten for the wrapped sink. The
+// inputs are never modified.
+func (l *LabelPlacementSink) place(key []string, labels []Label) ([]string, []Label) {
+	if len(labels) == 0 {
+		return key, labels
+	}
+
+	var prefix []string
+	for _, name := range l.placement.Prefix {
+		for _, label := range labels {
+			if label.Name == name {
+				prefix = append(prefix, label.Value)
+				break
+			}
+		}
+	}
+
+	out := make([]Label, 0, len(labels))
+	for _, label := range labels {
+		if l.prefixed(label.Name) {
+			continue
+		}
+		if name, ok := l.placement.Rename[label.Name]; ok {
+			label.Name = name
+		}
+		out = append(out, label)
+	}
+
+	if len(prefix) > 0 {
+		key = append(prefix, key...)
+	}
+	return key, out
+}
+
+func (l *LabelPlacementSink) prefixed(name string) bool {
+	for _, p := range l.placement.Prefix {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
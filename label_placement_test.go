@@ -0,0 +1,52 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetrics_LabelKeys(t *testing.T) {
+	m, met := mockMetric()
+	met.HostName = "node1"
+	met.EnableHostnameLabel = true
+	met.ServiceName = "api"
+	met.EnableServiceLabel = true
+	met.HostnameLabelKey = "instance"
+	met.ServiceLabelKey = "job"
+
+	met.IncrCounter([]string{"req"}, 1)
+	expected := []Label{{"instance", "node1"}, {"job", "api"}}
+	if !reflect.DeepEqual(m.labels[0], expected) {
+		t.Fatalf("got %v want %v", m.labels[0], expected)
+	}
+}
+
+func TestLabelPlacementSink(t *testing.T) {
+	m := &MockSink{}
+	sink := NewLabelPlacementSink(m, LabelPlacement{
+		Prefix: []string{"service", "host"},
+		Rename: map[string]string{"dc": "datacenter"},
+	})
+
+	labels := []Label{{"host", "node1"}, {"dc", "east"}, {"service", "api"}}
+	sink.IncrCounterWithLabels([]string{"req"}, 1, labels)
+
+	if got := m.getKeys()[0]; !reflect.DeepEqual(got, []string{"api", "node1", "req"}) {
+		t.Fatalf("bad key: %v", got)
+	}
+	if !reflect.DeepEqual(m.labels[0], []Label{{"datacenter", "east"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+	if labels[1].Name != "dc" {
+		t.Fatalf("input labels should not be modified")
+	}
+
+	// Metrics without the labels pass through unchanged
+	sink.SetGauge([]string{"g"}, 1)
+	if got := m.getKeys()[1]; !reflect.DeepEqual(got, []string{"g"}) {
+		t.Fatalf("bad key: %v", got)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// m3FlushInterval is used when M3Opts.FlushInterval is not set
+	m3FlushInterval = 10 * time.Second
+
+	// m3RemoteWritePath is the Prometheus remote write endpoint of the M3
+	// coordinator
+	m3RemoteWritePath = "/api/v1/prom/remote/write"
+)
+
+// M3Opts is used to configure an M3Sink.
+type M3Opts struct {
+	// Address is the base URL of the M3 coordinator, for example
+	// "http://m3coordinator:7201"
+	Address string
+
+	// MetricsType routes writes to a namespace, either "unaggregated" (the
+	// default) or "aggregated"
+	MetricsType string
+
+	// StoragePolicy selects the aggregated namespace, for example "10s:40d".
+	// It is required when MetricsType is "aggregated".
+	StoragePolicy string
+
+	// FlushInterval is how often metrics are pushed, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// HTTPClient is used for pushes, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// RetryPolicy applies to failed pushes, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// M3Sink provides a MetricSink that pushes to the remote write endpoint of
+// an M3 coordinator. Metrics are aggregated in memory and pushed on every
+// flush interval, with the metric type of each family annotated in the
+// request metadata and the target namespace selected by the M3-Metrics-Type
+// and M3-Storage-Policy headers.
+//
+// Gauges and key/value pairs report their last value. Counters are sent as
+// cumulative _total series and samples as cumulative _count and _sum series,
+// so they can be queried with rate() as usual.
+type M3Sink struct {
+	url     string
+	headers http.Header
+	client  *http.Client
+	retry   RetryPolicy
+
+	agg        *intervalAggregator
+	cumulative *cumulativeSeries
+	loop       *flushLoop
+}
+
+// NewM3Sink creates an M3Sink and starts its flush loop.
+func NewM3Sink(opts M3Opts) (*M3Sink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("m3 coordinator address is required")
+	}
+	headers := make(http.Header)
+	switch opts.MetricsType {
+	case "", "unaggregated":
+		headers.Set("M3-Metrics-Type", "unaggregated")
+	case "aggregated":
+		if opts.StoragePolicy == "" {
+			return nil, fmt.Errorf("m3 storage policy is required for aggregated metrics")
+		}
+		headers.Set("M3-Metrics-Type", "aggregated")
+		headers.Set("M3-Storage-Policy", opts.StoragePolicy)
+	default:
+		return nil, fmt.Errorf("unknown m3 metrics type %q", opts.MetricsType)
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = m3FlushInterval
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	s := &M3Sink{
+		url:        strings.TrimSuffix(opts.Address, "/") + m3RemoteWritePath,
+		headers:    headers,
+		client:     client,
+		retry:      retry,
+		loop:       newFlushLoop(interval),
+		agg:        newIntervalAggregator(),
+		cumulative: newCumulativeSeries(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *M3Sink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *M3Sink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *M3Sink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *M3Sink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *M3Sink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *M3Sink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *M3Sink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+// RestoreCounters seeds the cumulative totals from a counter checkpoint, see
+// CumulativeSink.
+func (s *M3Sink) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	s.agg.restore(counters)
+}
+
+func (s *M3Sink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *M3Sink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the M3 sink supports.
+func (s *M3Sink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// pushed.
+func (s *M3Sink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *M3Sink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *M3Sink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error pushing to M3! Err: %s", err)
+	}
+}
+
+// flush pushes everything aggregated since the last flush. It is only called
+// from the flush loop, which owns the cumulative state.
+func (s *M3Sink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	if len(aggs) == 0 {
+		return nil
+	}
+	series, meta := s.cumulative.convert(aggs)
+	req := encodeWriteRequest(series, meta, now.UnixMilli())
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+	return s.retry.Do(ctx, "M3", func() error {
+		return postRemoteWrite(s.client, s.url, req, s.headers)
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestM3Sink(t *testing.T) {
+	var headers http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != m3RemoteWritePath {
+			t.Errorf("bad path %s", r.URL.Path)
+		}
+		headers = r.Header
+		raw, _ := io.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, raw)
+	}))
+	defer srv.Close()
+
+	s, err := NewM3Sink(M3Opts{
+		Address:       srv.URL + "/",
+		MetricsType:   "aggregated",
+		StoragePolicy: "10s:40d",
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounter([]string{"jobs"}, 1)
+	if err := s.flush(time.UnixMilli(5000)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if headers.Get("M3-Metrics-Type") != "aggregated" || headers.Get("M3-Storage-Policy") != "10s:40d" {
+		t.Fatalf("bad headers: %v", headers)
+	}
+	if headers.Get("Content-Encoding") != "snappy" {
+		t.Fatalf("bad headers: %v", headers)
+	}
+	series, types := decodeWriteRequest(t, body)
+	if len(series) != 1 || series[0].value != 1 || series[0].timestamp != 5000 || types["jobs_total"] != remoteWriteCounter {
+		t.Fatalf("bad request: %v %v", series, types)
+	}
+}
+
+func TestM3Sink_Opts(t *testing.T) {
+	for _, opts := range []M3Opts{
+		{},
+		{Address: "http://m3", MetricsType: "aggregated"},
+		{Address: "http://m3", MetricsType: "bogus"},
+	} {
+		if _, err := NewM3Sink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
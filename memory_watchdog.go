@@ -0,0 +1,381 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxShedLevel is the most aggressive level of MemoryShedder.ShedMemory
+const maxShedLevel = 3
+
+// memoryEntryOverhead approximates the bytes held per map entry or queued
+// item, on top of its keys and values, for footprint estimates
+const memoryEntryOverhead = 64
+
+// Self-telemetry of the memory watchdog
+var (
+	memoryFootprintKey = []string{"metrics", "memory", "footprint_bytes"}
+	memoryShedKey      = []string{"metrics", "memory", "shed_bytes"}
+)
+
+// MemoryShedder is implemented by components holding data which the
+// MemoryWatchdog may shed under memory pressure.
+type MemoryShedder interface {
+	// MemoryFootprint returns an estimate of the bytes held.
+	MemoryFootprint() int64
+
+	// ShedMemory drops data to reduce the footprint, more aggressively at
+	// each level from 1 to 3, and returns an estimate of the bytes freed.
+	// Level 1 shrinks buffers, level 2 drops derived data which is rebuilt
+	// over time, and level 3 drops everything that is not essential.
+	ShedMemory(level int) int64
+}
+
+// watchedShedder is a component registered with a MemoryWatchdog
+type watchedShedder struct {
+	name     string
+	priority int
+	shedder  MemoryShedder
+}
+
+// MemoryWatchdog keeps the memory held by the library within a budget. It
+// periodically adds up the footprint of the registered components, such as
+// inmem intervals, audit logs and worker queues, and when the budget is
+// exceeded sheds data progressively: every component at level 1 before any
+// at level 2, and lowest priority components first at each level, until
+// the footprint is back within budget.
+//
+// The footprint is reported through the metrics.memory.footprint_bytes
+// gauge, and the bytes shed through the metrics.memory.shed_bytes counter,
+// labeled with the component and level.
+type MemoryWatchdog struct {
+	budget  int64
+	metrics *Metrics
+
+	lock       sync.Mutex
+	components []watchedShedder
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewMemoryWatchdog creates a MemoryWatchdog with a budget in bytes.
+// Self-telemetry is emitted through m, which may be nil.
+func NewMemoryWatchdog(m *Metrics, budget int64) *MemoryWatchdog {
+	return &MemoryWatchdog{
+		budget:  budget,
+		metrics: m,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Watch registers a component under a name used in self-telemetry. Under
+// memory pressure, components with a lower priority are shed first.
+func (w *MemoryWatchdog) Watch(name string, priority int, s MemoryShedder) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.components = append(w.components, watchedShedder{name: name, priority: priority, shedder: s})
+	sort.SliceStable(w.components, func(i, j int) bool {
+		return w.components[i].priority < w.components[j].priority
+	})
+}
+
+// Start checks the footprint every interval until Stop is called.
+func (w *MemoryWatchdog) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.Check()
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the checks started by Start.
+func (w *MemoryWatchdog) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+}
+
+// Check adds up the footprint of the registered components and sheds data
+// if it exceeds the budget. It returns the footprint once done.
+func (w *MemoryWatchdog) Check() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var total int64
+	for _, c := range w.components {
+		total += c.shedder.MemoryFootprint()
+	}
+
+	for level := 1; level <= maxShedLevel && total > w.budget; level++ {
+		for _, c := range w.components {
+			if total <= w.budget {
+				break
+			}
+			freed := c.shedder.ShedMemory(level)
+			if freed <= 0 {
+				continue
+			}
+			total -= freed
+			if w.metrics != nil {
+				w.metrics.incrCounterWithLabels(memoryShedKey, float32(freed), []Label{
+					{Name: "component", Value: c.name},
+					{Name: "level", Value: strconv.Itoa(level)},
+				})
+			}
+		}
+	}
+	if total > w.budget {
+		log.Printf("[WARN] metrics: memory footprint of %d bytes exceeds the budget of %d bytes after shedding", total, w.budget)
+	}
+
+	if w.metrics != nil {
+		w.metrics.setGaugeWithLabels(memoryFootprintKey, float32(total), nil)
+	}
+	return total
+}
+
+// MemoryFootprint estimates the bytes held by the retained intervals and
+// gauge histories.
+func (i *InmemSink) MemoryFootprint() int64 {
+	i.intervalLock.RLock()
+	defer i.intervalLock.RUnlock()
+
+	var total int64
+	for _, intv := range i.intervals {
+		total += intv.footprint()
+	}
+	if i.history != nil {
+		total += i.history.footprint()
+	}
+	return total
+}
+
+// ShedMemory halves the retained intervals at level 1, drops gauge
+// histories and retained raw samples at level 2, and drops every finished
+// interval at level 3. The retention stays reduced afterwards.
+func (i *InmemSink) ShedMemory(level int) int64 {
+	before := i.MemoryFootprint()
+
+	if level >= 2 && i.history != nil {
+		i.history.reset()
+	}
+
+	i.intervalLock.Lock()
+	keep := i.maxIntervals / 2
+	if level >= 3 {
+		keep = 1
+	}
+	if keep < 1 {
+		keep = 1
+	}
+	// Always keep the interval currently being written to
+	if keep < i.maxIntervals {
+		i.maxIntervals = keep
+	}
+	if n := len(i.intervals); n > i.maxIntervals {
+		copy(i.intervals, i.intervals[n-i.maxIntervals:])
+		for j := i.maxIntervals; j < n; j++ {
+			i.intervals[j] = nil
+		}
+		i.intervals = i.intervals[:i.maxIntervals]
+	}
+	if level >= 2 {
+		for _, intv := range i.intervals {
+			intv.Lock()
+			if intv.retained != nil {
+				intv.retained = make(map[string]*sampleReservoir)
+			}
+			intv.Unlock()
+		}
+	}
+	i.intervalLock.Unlock()
+
+	return before - i.MemoryFootprint()
+}
+
+// footprint estimates the bytes held by an interval.
+func (intv *IntervalMetrics) footprint() int64 {
+	intv.RLock()
+	defer intv.RUnlock()
+
+	var total int64
+	for k, v := range intv.Gauges {
+		total += int64(len(k)+len(v.Name)) + labelsFootprint(v.Labels) + memoryEntryOverhead
+	}
+	for k, v := range intv.PrecisionGauges {
+		total += int64(len(k)+len(v.Name)) + labelsFootprint(v.Labels) + memoryEntryOverhead
+	}
+	for k, v := range intv.Points {
+		total += int64(len(k)+4*len(v)) + memoryEntryOverhead
+	}
+	for k, v := range intv.Counters {
+		total += int64(len(k)+len(v.Name)) + labelsFootprint(v.Labels) + 2*memoryEntryOverhead
+	}
+	for k, v := range intv.Samples {
+		total += int64(len(k)+len(v.Name)) + labelsFootprint(v.Labels) + 2*memoryEntryOverhead
+	}
+	for k, r := range intv.retained {
+		total += int64(len(k)+8*len(r.values)) + memoryEntryOverhead
+	}
+	return total
+}
+
+func labelsFootprint(labels []Label) int64 {
+	var total int64
+	for _, l := range labels {
+		total += int64(len(l.Name) + len(l.Value))
+	}
+	return total
+}
+
+func (h *gaugeHistory) footprint() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var total int64
+	for k, r := range h.rings {
+		total += int64(len(k)+8*len(r.values)) + memoryEntryOverhead
+	}
+	return total
+}
+
+// reset forgets every recorded value.
+func (h *gaugeHistory) reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.rings = make(map[string]*valueRing)
+}
+
+// MemoryFootprint estimates the bytes held by the audit log and the
+// cardinality tracker.
+func (m *Metrics) MemoryFootprint() int64 {
+	var total int64
+	if m.audit != nil {
+		total += m.audit.footprint()
+	}
+	if m.cardinality != nil {
+		total += m.cardinality.footprint()
+	}
+	return total
+}
+
+// ShedMemory shrinks the audit log by half at each level, and forgets the
+// label sets seen by the cardinality tracker from level 2, which are
+// relearned within a window.
+func (m *Metrics) ShedMemory(level int) int64 {
+	before := m.MemoryFootprint()
+	if m.audit != nil {
+		m.audit.shrink()
+	}
+	if level >= 2 && m.cardinality != nil {
+		m.cardinality.reset()
+	}
+	return before - m.MemoryFootprint()
+}
+
+func (a *auditLog) footprint() int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	total := int64(len(a.entries)) * memoryEntryOverhead
+	for _, e := range a.entries {
+		total += int64(len(e.Key)+len(e.Type)+len(e.Caller)) + labelsFootprint(e.Labels)
+	}
+	return total
+}
+
+// shrink halves the size of the audit log, keeping the newest entries.
+func (a *auditLog) shrink() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	size := len(a.entries) / 2
+	if size < 1 {
+		size = 1
+	}
+	var ordered []AuditEntry
+	if a.full {
+		ordered = append(append(ordered, a.entries[a.next:]...), a.entries[:a.next]...)
+	} else {
+		ordered = a.entries[:a.next]
+	}
+	if len(ordered) > size {
+		ordered = ordered[len(ordered)-size:]
+	}
+
+	entries := make([]AuditEntry, size)
+	copy(entries, ordered)
+	a.entries = entries
+	a.next = len(ordered) % size
+	a.full = len(ordered) == size
+}
+
+func (c *cardinalityTracker) footprint() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var total int64
+	for name, sets := range c.seen {
+		total += int64(len(name)) + memoryEntryOverhead
+		for series := range sets {
+			total += int64(len(series)) + memoryEntryOverhead
+		}
+	}
+	return total
+}
+
+// reset forgets every label set seen.
+func (c *cardinalityTracker) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seen = make(map[string]map[string]time.Time)
+}
+
+// MemoryFootprint estimates the bytes held by queued calls.
+func (w *WorkerSink) MemoryFootprint() int64 {
+	return int64(len(w.queue)) * 2 * memoryEntryOverhead
+}
+
+// ShedMemory discards the queued calls at level 3, counting them as
+// dropped. The queue itself cannot shrink, so lower levels shed nothing.
+func (w *WorkerSink) ShedMemory(level int) int64 {
+	if level < maxShedLevel {
+		return 0
+	}
+	var freed int64
+	var held []workerOp
+	for {
+		select {
+		case op := <-w.queue:
+			if op.kind == workerBarrier || op.kind == workerStop {
+				// Flush and Shutdown wait on these
+				held = append(held, op)
+				continue
+			}
+			freed += 2 * memoryEntryOverhead
+			atomic.AddUint64(&w.dropped, 1)
+		default:
+			for _, op := range held {
+				w.queue <- op
+			}
+			return freed
+		}
+	}
+}
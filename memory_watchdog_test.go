@@ -0,0 +1,147 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeShedder frees a fixed amount per level
+type fakeShedder struct {
+	size  int64
+	freed map[int]int64
+	calls []int
+}
+
+func (f *fakeShedder) MemoryFootprint() int64 { return f.size }
+
+func (f *fakeShedder) ShedMemory(level int) int64 {
+	f.calls = append(f.calls, level)
+	n := f.freed[level]
+	f.size -= n
+	return n
+}
+
+func TestMemoryWatchdog(t *testing.T) {
+	m, met := mockMetric()
+	w := NewMemoryWatchdog(met, 100)
+
+	low := &fakeShedder{size: 100, freed: map[int]int64{1: 10, 2: 50}}
+	high := &fakeShedder{size: 50, freed: map[int]int64{1: 20}}
+	w.Watch("high", 10, high)
+	w.Watch("low", 1, low)
+
+	// Level 1 frees 30 of the 50 over budget, then level 2 starts with the
+	// lowest priority and is enough on its own
+	if got := w.Check(); got != 70 {
+		t.Fatalf("bad footprint: %d", got)
+	}
+	if !reflect.DeepEqual(low.calls, []int{1, 2}) || !reflect.DeepEqual(high.calls, []int{1}) {
+		t.Fatalf("bad shedding order: %v %v", low.calls, high.calls)
+	}
+
+	keys := m.getKeys()
+	expected := [][]string{memoryShedKey, memoryShedKey, memoryShedKey, memoryFootprintKey}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("bad self-telemetry: %v", keys)
+	}
+	if !reflect.DeepEqual(m.labels[2], []Label{{"component", "low"}, {"level", "2"}}) || m.vals[2] != 50 {
+		t.Fatalf("bad shed counter: %v %v", m.labels[2], m.vals[2])
+	}
+	if m.vals[3] != 70 {
+		t.Fatalf("bad footprint gauge: %v", m.vals[3])
+	}
+
+	// Within budget nothing is shed
+	w.Check()
+	if len(low.calls) != 2 {
+		t.Fatalf("should not shed within budget")
+	}
+}
+
+func TestInmemSink_ShedMemory(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, 100*time.Millisecond)
+	inm.EnableGaugeHistory(10)
+	inm.EnableSampleRetention(10)
+
+	for j := 0; j < 4; j++ {
+		inm.intervalLock.Lock()
+		intv := NewIntervalMetrics(time.Unix(int64(j), 0))
+		inm.intervals = append(inm.intervals, intv)
+		inm.intervalLock.Unlock()
+		inm.SetGauge([]string{"g"}, float32(j))
+	}
+	inm.AddSample([]string{"s"}, 1)
+
+	before := inm.MemoryFootprint()
+	if before <= 0 {
+		t.Fatalf("expected a footprint")
+	}
+	if freed := inm.ShedMemory(1); freed <= 0 || inm.maxIntervals != 5 {
+		t.Fatalf("level 1 should halve retention: freed %d, max %d", freed, inm.maxIntervals)
+	}
+	if freed := inm.ShedMemory(2); freed <= 0 || inm.GaugeHistory([]string{"g"}, nil) != nil {
+		t.Fatalf("level 2 should drop gauge history: freed %d", freed)
+	}
+	inm.ShedMemory(3)
+	if n := len(inm.Data()); n != 1 {
+		t.Fatalf("level 3 should keep only the current interval, got %d", n)
+	}
+}
+
+func TestMetrics_ShedMemory(t *testing.T) {
+	_, met := mockMetric()
+	met.audit = newAuditLog(8, false)
+	met.cardinality = newCardinalityTracker(time.Hour)
+	for i := 0; i < 10; i++ {
+		met.IncrCounterWithLabels([]string{"req"}, float32(i), []Label{{"n", string(rune('a' + i))}})
+	}
+
+	before := met.MemoryFootprint()
+	if freed := met.ShedMemory(1); freed <= 0 {
+		t.Fatalf("expected the audit log to shrink")
+	}
+	entries := met.AuditLog()
+	if len(entries) != 4 || entries[3].Value != 9 {
+		t.Fatalf("should keep the newest entries: %v", entries)
+	}
+	if len(met.Cardinality()) != 1 {
+		t.Fatalf("level 1 should keep cardinality")
+	}
+
+	met.ShedMemory(2)
+	if len(met.Cardinality()) != 0 {
+		t.Fatalf("level 2 should reset cardinality")
+	}
+	if met.MemoryFootprint() >= before {
+		t.Fatalf("footprint should have shrunk")
+	}
+
+	// The shrunk audit log keeps working
+	met.IncrCounter([]string{"after"}, 1)
+	if entries := met.AuditLog(); entries[len(entries)-1].Key != "after" {
+		t.Fatalf("bad audit log after shrinking: %v", entries)
+	}
+}
+
+func TestWorkerSink_ShedMemory(t *testing.T) {
+	g := &gatedSink{release: make(chan struct{})}
+	w := NewWorkerSink(g, 10)
+	for i := 0; i < 5; i++ {
+		w.IncrCounter([]string{"req"}, 1)
+	}
+	if w.ShedMemory(1) != 0 {
+		t.Fatalf("lower levels should not shed")
+	}
+	if w.MemoryFootprint() == 0 || w.ShedMemory(3) == 0 {
+		t.Fatalf("level 3 should discard the queue")
+	}
+	close(g.release)
+	w.Shutdown()
+	if n := uint64(len(g.getKeys())); n+w.Dropped() != 5 {
+		t.Fatalf("every call should be delivered or dropped: %d %d", n, w.Dropped())
+	}
+}
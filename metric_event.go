@@ -0,0 +1,134 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricEvent is a single metric emitted to one of the event sinks, such as
+// the KafkaSink, which publish every call rather than aggregates
+type metricEvent struct {
+	typ    string
+	key    []string
+	val    float64
+	labels []Label
+	time   time.Time
+}
+
+func newMetricEvent(typ string, key []string, val float64, labels []Label) metricEvent {
+	return metricEvent{
+		typ:    typ,
+		key:    key,
+		val:    val,
+		labels: append([]Label(nil), labels...),
+		time:   time.Now(),
+	}
+}
+
+func (e metricEvent) name() string {
+	return strings.Join(e.key, ".")
+}
+
+// labelMap returns the labels by name, the last one winning for duplicates.
+func (e metricEvent) labelMap() map[string]string {
+	labels := make(map[string]string, len(e.labels))
+	for _, l := range e.labels {
+		labels[l.Name] = l.Value
+	}
+	return labels
+}
+
+// marshalJSON encodes the event as a JSON object:
+//
+//	{"name":"api.requests","type":"counter","value":1,
+//	 "labels":{"code":"200"},"timestamp":"2024-01-02T15:04:05.123Z"}
+func (e metricEvent) marshalJSON() []byte {
+	// JSON has no NaN or infinity, which are sent as zero
+	val := e.val
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		val = 0
+	}
+	b, _ := json.Marshal(struct {
+		Name      string            `json:"name"`
+		Type      string            `json:"type"`
+		Value     float64           `json:"value"`
+		Labels    map[string]string `json:"labels"`
+		Timestamp time.Time         `json:"timestamp"`
+	}{e.name(), e.typ, val, e.labelMap(), e.time.UTC()})
+	return b
+}
+
+// eventQueue buffers the events of an event sink until its flush goroutine
+// takes them. Events beyond its size are dropped and counted, so callers
+// never block on the transport.
+type eventQueue struct {
+	size  int
+	batch int
+
+	lock    sync.Mutex
+	events  []metricEvent
+	dropped uint64
+
+	// kickCh is signalled once a full batch is buffered
+	kickCh chan struct{}
+}
+
+func newEventQueue(size, batch int) *eventQueue {
+	return &eventQueue{size: size, batch: batch, kickCh: make(chan struct{}, 1)}
+}
+
+// add buffers an event, or drops it when the queue is full.
+func (q *eventQueue) add(e metricEvent) {
+	q.lock.Lock()
+	if len(q.events) >= q.size {
+		q.lock.Unlock()
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+	q.events = append(q.events, e)
+	full := len(q.events) >= q.batch
+	q.lock.Unlock()
+
+	if full {
+		select {
+		case q.kickCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take returns and removes all buffered events.
+func (q *eventQueue) take() []metricEvent {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	events := q.events
+	q.events = nil
+	return events
+}
+
+// requeue puts events which could not be sent back in front of the queue,
+// dropping the newest events if they no longer fit.
+func (q *eventQueue) requeue(events []metricEvent) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	merged := append(events[:len(events):len(events)], q.events...)
+	if len(merged) > q.size {
+		atomic.AddUint64(&q.dropped, uint64(len(merged)-q.size))
+		merged = merged[:q.size]
+	}
+	q.events = merged
+}
+
+// droppedCount returns the number of events dropped so far.
+func (q *eventQueue) droppedCount() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
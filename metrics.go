@@ -4,6 +4,7 @@
 package metrics
 
 import (
+	"log"
 	"runtime"
 	"strings"
 	"time"
@@ -21,9 +22,40 @@ func (m *Metrics) SetGauge(key []string, val float32) {
 }
 
 func (m *Metrics) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitGauge(key, val, labels)
+}
+
+func (m *Metrics) emitGauge(key []string, val float32, labels []Label) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "gauge")
+	}
+	if m.cardinality != nil {
+		m.trackCardinality(key, labels)
+	}
+	if m.audit != nil {
+		m.audit.record("gauge", key, float64(val), labels)
+	}
+	if m.snapshots != nil {
+		m.snapshots.setGauge(key, float64(val), labels)
+	}
+	m.captures.each(func(c *CapturedMetrics) { c.setGauge(key, float64(val), labels) })
+	if m.ratios != nil {
+		m.deriveRatios(key, float64(val), labels, false)
+	}
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.setGaugeWithLabels(dual, val, labels[:len(labels):len(labels)])
+	}
+	m.setGaugeWithLabels(key, val, labels)
+}
+
+func (m *Metrics) setGaugeWithLabels(key []string, val float32, labels []Label) {
 	if m.HostName != "" {
 		if m.EnableHostnameLabel {
-			labels = append(labels, Label{"host", m.HostName})
+			labels = append(labels, m.hostLabel())
 		} else if m.EnableHostname {
 			key = insert(0, m.HostName, key)
 		}
@@ -33,7 +65,7 @@ func (m *Metrics) SetGaugeWithLabels(key []string, val float32, labels []Label)
 	}
 	if m.ServiceName != "" {
 		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
+			labels = append(labels, m.serviceLabel())
 		} else {
 			key = insert(0, m.ServiceName, key)
 		}
@@ -42,7 +74,10 @@ func (m *Metrics) SetGaugeWithLabels(key []string, val float32, labels []Label)
 	if !allowed {
 		return
 	}
-	m.sink.SetGaugeWithLabels(key, val, labelsFiltered)
+	if keep, _ := m.sampleMetric(key); !keep {
+		return
+	}
+	m.v2().SetGaugeWithLabels(key, val, labelsFiltered)
 }
 
 func (m *Metrics) SetPrecisionGauge(key []string, val float64) {
@@ -50,9 +85,40 @@ func (m *Metrics) SetPrecisionGauge(key []string, val float64) {
 }
 
 func (m *Metrics) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitPrecisionGauge(key, val, labels)
+}
+
+func (m *Metrics) emitPrecisionGauge(key []string, val float64, labels []Label) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "gauge")
+	}
+	if m.cardinality != nil {
+		m.trackCardinality(key, labels)
+	}
+	if m.audit != nil {
+		m.audit.record("gauge", key, val, labels)
+	}
+	if m.snapshots != nil {
+		m.snapshots.setGauge(key, val, labels)
+	}
+	m.captures.each(func(c *CapturedMetrics) { c.setGauge(key, val, labels) })
+	if m.ratios != nil {
+		m.deriveRatios(key, val, labels, false)
+	}
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.setPrecisionGaugeWithLabels(dual, val, labels[:len(labels):len(labels)])
+	}
+	m.setPrecisionGaugeWithLabels(key, val, labels)
+}
+
+func (m *Metrics) setPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
 	if m.HostName != "" {
 		if m.EnableHostnameLabel {
-			labels = append(labels, Label{"host", m.HostName})
+			labels = append(labels, m.hostLabel())
 		} else if m.EnableHostname {
 			key = insert(0, m.HostName, key)
 		}
@@ -62,7 +128,7 @@ func (m *Metrics) SetPrecisionGaugeWithLabels(key []string, val float64, labels
 	}
 	if m.ServiceName != "" {
 		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
+			labels = append(labels, m.serviceLabel())
 		} else {
 			key = insert(0, m.ServiceName, key)
 		}
@@ -71,15 +137,75 @@ func (m *Metrics) SetPrecisionGaugeWithLabels(key []string, val float64, labels
 	if !allowed {
 		return
 	}
-	sink, ok := m.sink.(PrecisionGaugeMetricSink)
-	if !ok {
-		// Sink does not implement PrecisionGaugeMetricSink.
-	} else {
-		sink.SetPrecisionGaugeWithLabels(key, val, labelsFiltered)
+	if keep, _ := m.sampleMetric(key); !keep {
+		return
 	}
+	m.v2().SetPrecisionGaugeWithLabels(key, val, labelsFiltered)
 }
 
 func (m *Metrics) EmitKey(key []string, val float32) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitKeyValue(key, val)
+}
+
+func (m *Metrics) emitKeyValue(key []string, val float32) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "kv")
+	}
+	if m.audit != nil {
+		m.audit.record("kv", key, float64(val), nil)
+	}
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.emitKey(dual, val)
+	}
+	m.emitKey(key, val)
+}
+
+func (m *Metrics) emitKey(key []string, val float32) {
+	key, ok := m.prepareKV(key)
+	if !ok {
+		return
+	}
+	m.v2().EmitKey(key, val)
+}
+
+// EmitKeys emits a batch of key/value points for the same key in one call,
+// such as a periodic dump of per-shard sizes. Sinks implementing
+// BatchEmitSink encode the whole batch at once, others receive one EmitKey
+// call per value. Sampling applies to the batch as a whole.
+func (m *Metrics) EmitKeys(key []string, vals []float32) {
+	if len(vals) == 0 || !m.nameAllowed(key) {
+		return
+	}
+	if m.DetectTypeCollisions {
+		m.checkType(key, "kv")
+	}
+	if m.audit != nil {
+		for _, val := range vals {
+			m.audit.record("kv", key, float64(val), nil)
+		}
+	}
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.emitKeys(dual, vals)
+	}
+	m.emitKeys(key, vals)
+}
+
+func (m *Metrics) emitKeys(key []string, vals []float32) {
+	key, ok := m.prepareKV(key)
+	if !ok {
+		return
+	}
+	m.v2().EmitKeys(key, vals)
+}
+
+// prepareKV applies the prefixes, filters and sampling shared by the
+// key/value emitters, returning false if the point should be dropped.
+func (m *Metrics) prepareKV(key []string) ([]string, bool) {
 	if m.EnableTypePrefix {
 		key = insert(0, "kv", key)
 	}
@@ -88,9 +214,12 @@ func (m *Metrics) EmitKey(key []string, val float32) {
 	}
 	allowed, _ := m.allowMetric(key, nil)
 	if !allowed {
-		return
+		return nil, false
+	}
+	if keep, _ := m.sampleMetric(key); !keep {
+		return nil, false
 	}
-	m.sink.EmitKey(key, val)
+	return key, true
 }
 
 func (m *Metrics) IncrCounter(key []string, val float32) {
@@ -98,24 +227,73 @@ func (m *Metrics) IncrCounter(key []string, val float32) {
 }
 
 func (m *Metrics) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitCounter(key, val, labels)
+}
+
+func (m *Metrics) emitCounter(key []string, val float32, labels []Label) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "counter")
+	}
+	if m.cardinality != nil {
+		m.trackCardinality(key, labels)
+	}
+	if m.audit != nil {
+		m.audit.record("counter", key, float64(val), labels)
+	}
+	if m.snapshots != nil {
+		m.snapshots.incrCounter(key, float64(val), labels)
+	}
+	m.captures.each(func(c *CapturedMetrics) { c.incrCounter(key, float64(val), labels) })
+	if m.ratios != nil {
+		m.deriveRatios(key, float64(val), labels, true)
+	}
+	if m.minuteCounts != nil {
+		m.minuteCounts.record(key, float64(val), time.Now())
+	}
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.incrCounterWithLabels(dual, val, labels[:len(labels):len(labels)])
+	}
+	m.incrCounterWithLabels(key, val, labels)
+}
+
+func (m *Metrics) incrCounterWithLabels(key []string, val float32, labels []Label) {
+	key, labelsFiltered, allowed := m.counterSeries(key, labels)
+	if !allowed {
+		return
+	}
+	keep, rate := m.sampleMetric(key)
+	if !keep {
+		return
+	}
+	if rate < 1 {
+		// Scale the increment so totals survive the sampling
+		val = val / float32(rate)
+	}
+	m.v2().IncrCounterWithLabels(key, val, labelsFiltered)
+}
+
+// counterSeries returns the key and labels of a counter as the sinks receive
+// them, and whether the filters allow it.
+func (m *Metrics) counterSeries(key []string, labels []Label) ([]string, []Label, bool) {
 	if m.HostName != "" && m.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.HostName})
+		labels = append(labels, m.hostLabel())
 	}
 	if m.EnableTypePrefix {
 		key = insert(0, "counter", key)
 	}
 	if m.ServiceName != "" {
 		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
+			labels = append(labels, m.serviceLabel())
 		} else {
 			key = insert(0, m.ServiceName, key)
 		}
 	}
 	allowed, labelsFiltered := m.allowMetric(key, labels)
-	if !allowed {
-		return
-	}
-	m.sink.IncrCounterWithLabels(key, val, labelsFiltered)
+	return key, labelsFiltered, allowed
 }
 
 func (m *Metrics) AddSample(key []string, val float32) {
@@ -123,15 +301,40 @@ func (m *Metrics) AddSample(key []string, val float32) {
 }
 
 func (m *Metrics) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitSample(key, val, labels)
+}
+
+func (m *Metrics) emitSample(key []string, val float32, labels []Label) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "sample")
+	}
+	if m.cardinality != nil {
+		m.trackCardinality(key, labels)
+	}
+	if m.audit != nil {
+		m.audit.record("sample", key, float64(val), labels)
+	}
+	m.captures.each(func(c *CapturedMetrics) { c.addSample(key, float64(val), labels) })
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.addSampleWithLabels(dual, val, labels[:len(labels):len(labels)])
+	}
+	m.addSampleWithLabels(key, val, labels)
+}
+
+func (m *Metrics) addSampleWithLabels(key []string, val float32, labels []Label) {
 	if m.HostName != "" && m.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.HostName})
+		labels = append(labels, m.hostLabel())
 	}
 	if m.EnableTypePrefix {
 		key = insert(0, "sample", key)
 	}
 	if m.ServiceName != "" {
 		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
+			labels = append(labels, m.serviceLabel())
 		} else {
 			key = insert(0, m.ServiceName, key)
 		}
@@ -140,7 +343,66 @@ func (m *Metrics) AddSampleWithLabels(key []string, val float32, labels []Label)
 	if !allowed {
 		return
 	}
-	m.sink.AddSampleWithLabels(key, val, labelsFiltered)
+	if keep, _ := m.sampleMetric(key); !keep {
+		return
+	}
+	m.v2().AddSampleWithLabels(key, val, labelsFiltered)
+}
+
+// AddHistogram records an observation of a histogram, which sinks
+// implementing HistogramMetricSink bucket with the boundaries configured for
+// the metric. Other sinks receive it as a sample.
+func (m *Metrics) AddHistogram(key []string, val float64) {
+	m.AddHistogramWithLabels(key, val, nil)
+}
+
+func (m *Metrics) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitHistogram(key, val, labels)
+}
+
+func (m *Metrics) emitHistogram(key []string, val float64, labels []Label) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "histogram")
+	}
+	if m.cardinality != nil {
+		m.trackCardinality(key, labels)
+	}
+	if m.audit != nil {
+		m.audit.record("histogram", key, val, labels)
+	}
+	m.captures.each(func(c *CapturedMetrics) { c.addSample(key, val, labels) })
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.addHistogramWithLabels(dual, val, labels[:len(labels):len(labels)])
+	}
+	m.addHistogramWithLabels(key, val, labels)
+}
+
+func (m *Metrics) addHistogramWithLabels(key []string, val float64, labels []Label) {
+	if m.HostName != "" && m.EnableHostnameLabel {
+		labels = append(labels, m.hostLabel())
+	}
+	if m.EnableTypePrefix {
+		key = insert(0, "histogram", key)
+	}
+	if m.ServiceName != "" {
+		if m.EnableServiceLabel {
+			labels = append(labels, m.serviceLabel())
+		} else {
+			key = insert(0, m.ServiceName, key)
+		}
+	}
+	allowed, labelsFiltered := m.allowMetric(key, labels)
+	if !allowed {
+		return
+	}
+	if keep, _ := m.sampleMetric(key); !keep {
+		return
+	}
+	m.v2().AddHistogramSampleWithLabels(key, val, labelsFiltered)
 }
 
 func (m *Metrics) MeasureSince(key []string, start time.Time) {
@@ -148,15 +410,45 @@ func (m *Metrics) MeasureSince(key []string, start time.Time) {
 }
 
 func (m *Metrics) MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
+	if !m.nameAllowed(key) {
+		return
+	}
+	m.emitMeasureSince(key, start, labels)
+}
+
+func (m *Metrics) emitMeasureSince(key []string, start time.Time, labels []Label) {
+	if m.DetectTypeCollisions {
+		m.checkType(key, "sample")
+	}
+	if m.cardinality != nil {
+		m.trackCardinality(key, labels)
+	}
+	if m.audit != nil {
+		m.audit.record("timer", key, float64(time.Since(start))/float64(time.Millisecond), labels)
+	}
+	m.captures.each(func(c *CapturedMetrics) {
+		c.addSample(key, float64(time.Since(start))/float64(time.Millisecond), labels)
+	})
+	if m.trackUnits {
+		m.RegisterUnit(key, durationUnit(m.timerGranularity()))
+	}
+	key, dual := m.renameMetric(key)
+	if dual != nil {
+		m.measureSinceWithLabels(dual, start, labels[:len(labels):len(labels)])
+	}
+	m.measureSinceWithLabels(key, start, labels)
+}
+
+func (m *Metrics) measureSinceWithLabels(key []string, start time.Time, labels []Label) {
 	if m.HostName != "" && m.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.HostName})
+		labels = append(labels, m.hostLabel())
 	}
 	if m.EnableTypePrefix {
 		key = insert(0, "timer", key)
 	}
 	if m.ServiceName != "" {
 		if m.EnableServiceLabel {
-			labels = append(labels, Label{"service", m.ServiceName})
+			labels = append(labels, m.serviceLabel())
 		} else {
 			key = insert(0, m.ServiceName, key)
 		}
@@ -165,10 +457,13 @@ func (m *Metrics) MeasureSinceWithLabels(key []string, start time.Time, labels [
 	if !allowed {
 		return
 	}
+	if keep, _ := m.sampleMetric(key); !keep {
+		return
+	}
 	now := time.Now()
 	elapsed := now.Sub(start)
 	msec := float32(elapsed.Nanoseconds()) / float32(m.TimerGranularity)
-	m.sink.AddSampleWithLabels(key, msec, labelsFiltered)
+	m.v2().AddSampleWithLabels(key, msec, labelsFiltered)
 }
 
 // UpdateFilter overwrites the existing filter with the given rules.
@@ -209,7 +504,26 @@ func (m *Metrics) UpdateFilterAndLabels(allow, block, allowedLabels, blockedLabe
 	}
 }
 
+// v2 returns the sink as a MetricSinkV2. Metrics created without New, as
+// the initial global instance is, adapt their sink on the first call.
+func (m *Metrics) v2() MetricSinkV2 {
+	m.sinkV2Once.Do(func() {
+		if m.sinkV2 == nil {
+			m.sinkV2 = AdaptSink(m.sink)
+		}
+	})
+	return m.sinkV2
+}
+
 func (m *Metrics) Shutdown() {
+	m.shutdownOnce.Do(func() {
+		if m.checkpointStop != nil {
+			close(m.checkpointStop)
+			if err := m.Checkpoint(); err != nil {
+				log.Printf("[ERR] metrics: Failed to write counter checkpoint: %s", err)
+			}
+		}
+	})
 	if ss, ok := m.sink.(ShutdownSink); ok {
 		ss.Shutdown()
 	}
@@ -243,6 +557,9 @@ func (m *Metrics) filterLabels(labels []Label) []Label {
 	toReturn := []Label{}
 	for _, label := range labels {
 		if m.labelIsAllowed(&label) {
+			if values, ok := m.labelValues[label.Name]; ok && !values[label.Value] {
+				label.Value = OtherLabelValue
+			}
 			toReturn = append(toReturn, label)
 		}
 	}
@@ -250,8 +567,17 @@ func (m *Metrics) filterLabels(labels []Label) []Label {
 }
 
 // Returns whether the metric should be allowed based on configured prefix filters
-// Also return the applicable labels
+// Also return the applicable labels, in canonical order with CanonicalLabels
 func (m *Metrics) allowMetric(key []string, labels []Label) (bool, []Label) {
+	allowed, labels := m.filterMetric(key, labels)
+	if allowed && m.CanonicalLabels {
+		labels, allowed = canonicalLabels(labels, m.LabelConflict)
+	}
+	return allowed, labels
+}
+
+// filterMetric applies the prefix and label filters
+func (m *Metrics) filterMetric(key []string, labels []Label) (bool, []Label) {
 	m.filterLock.RLock()
 	defer m.filterLock.RUnlock()
 
@@ -267,6 +593,15 @@ func (m *Metrics) allowMetric(key []string, labels []Label) (bool, []Label) {
 	return allowed.(bool), m.filterLabels(labels)
 }
 
+// sampleMetric consults the adaptive sampler, if one is configured, and
+// returns whether the metric should be emitted along with its sample rate
+func (m *Metrics) sampleMetric(key []string) (bool, float64) {
+	if m.AdaptiveSampler == nil {
+		return true, 1
+	}
+	return m.AdaptiveSampler.Sample(strings.Join(key, "."))
+}
+
 // Periodically collects runtime stats to publish
 func (m *Metrics) collectStats() {
 	for {
@@ -310,6 +645,10 @@ func (m *Metrics) EmitRuntimeStats() {
 		m.AddSample([]string{"runtime", "gc_pause_ns"}, float32(pause))
 	}
 	m.lastNumGC = num
+
+	if m.gcSampler != nil {
+		m.emitGCSamples()
+	}
 }
 
 // Creates a new slice with the provided string value as the first element
@@ -334,3 +673,36 @@ func insert(i int, v string, s []string) []string {
 
 	return newS
 }
+
+// seriesKey builds a unique identifier for a key and its labels, in the same
+// "a.b;name=value" form used by the in-memory sink.
+func seriesKey(key []string, labels []Label) string {
+	var b strings.Builder
+	b.WriteString(strings.Join(key, "."))
+	for _, label := range labels {
+		b.WriteString(";")
+		b.WriteString(label.Name)
+		b.WriteString("=")
+		b.WriteString(label.Value)
+	}
+	return b.String()
+}
+
+// hostLabel returns the label carrying the hostname, see HostnameLabelKey.
+func (m *Metrics) hostLabel() Label {
+	name := m.HostnameLabelKey
+	if name == "" {
+		name = "host"
+	}
+	return Label{Name: name, Value: m.HostName}
+}
+
+// serviceLabel returns the label carrying the service name, see
+// ServiceLabelKey.
+func (m *Metrics) serviceLabel() Label {
+	name := m.ServiceLabelKey
+	if name == "" {
+		name = "service"
+	}
+	return Label{Name: name, Value: m.ServiceName}
+}
@@ -157,6 +157,25 @@ func TestMetrics_EmitKey(t *testing.T) {
 	}
 }
 
+func TestMetrics_EmitKeys(t *testing.T) {
+	m, met := mockMetric()
+	met.EnableTypePrefix = true
+	met.EmitKeys([]string{"shard", "size"}, []float32{1, 2, 3})
+	if len(m.getKeys()) != 3 || m.getKeys()[2][0] != "kv" || m.getKeys()[2][2] != "size" {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+	if !reflect.DeepEqual(m.vals, []float32{1, 2, 3}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+
+	inm := NewInmemSink(time.Hour, time.Hour)
+	met = &Metrics{Config: met.Config, sink: inm}
+	met.EmitKeys([]string{"shard", "size"}, []float32{4, 5})
+	if got := inm.Data()[0].Points["kv.shard.size"]; !reflect.DeepEqual(got, []float32{4, 5}) {
+		t.Fatalf("bad points: %v", got)
+	}
+}
+
 func TestMetrics_IncrCounter(t *testing.T) {
 	m, met := mockMetric()
 	met.IncrCounter([]string{"key"}, float32(1))
@@ -245,6 +264,26 @@ func TestMetrics_AddSample(t *testing.T) {
 	}
 }
 
+func TestMetrics_AddHistogram(t *testing.T) {
+	h := &histogramSink{}
+	met := &Metrics{Config: Config{FilterDefault: true, EnableTypePrefix: true}, sink: h}
+	labels := []Label{{"a", "b"}}
+	met.AddHistogramWithLabels([]string{"key"}, 1.5, labels)
+	if !reflect.DeepEqual(h.getKeys(), [][]string{{"histogram", "key"}}) {
+		t.Fatalf("bad keys %v", h.getKeys())
+	}
+	if !reflect.DeepEqual(h.histograms, []float64{1.5}) || !reflect.DeepEqual(h.labels[0], labels) {
+		t.Fatalf("bad histograms %v %v", h.histograms, h.labels)
+	}
+
+	// Sinks without histograms receive a sample
+	m, met := mockMetric()
+	met.AddHistogram([]string{"key"}, 2)
+	if m.getKeys()[0][0] != "key" || m.vals[0] != 2 {
+		t.Fatalf("bad samples %v %v", m.getKeys(), m.vals)
+	}
+}
+
 func TestMetrics_MeasureSince(t *testing.T) {
 	m, met := mockMetric()
 	met.TimerGranularity = time.Millisecond
@@ -573,3 +612,31 @@ func TestMetrics_Filter_Labels_ModifyArgs(t *testing.T) {
 		t.Fatalf("SetGaugeWithLabels modified the input argument")
 	}
 }
+
+func TestMetrics_LabelValueAllowlist(t *testing.T) {
+	m := &MockSink{}
+	conf := DefaultConfig("")
+	conf.EnableHostname = false
+	conf.EnableRuntimeMetrics = false
+	conf.LabelValueAllowlist = map[string][]string{
+		"status_code": {"200", "404", "500"},
+	}
+	met, err := New(conf, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argLabels := []Label{{"status_code", "418"}, {"method", "GET"}}
+	met.IncrCounterWithLabels([]string{"http"}, 1, argLabels)
+	met.IncrCounterWithLabels([]string{"http"}, 1, []Label{{"status_code", "404"}})
+
+	if !reflect.DeepEqual(m.labels[0], []Label{{"status_code", OtherLabelValue}, {"method", "GET"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+	if !reflect.DeepEqual(m.labels[1], []Label{{"status_code", "404"}}) {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+	if argLabels[0].Value != "418" {
+		t.Fatalf("IncrCounterWithLabels modified the input argument")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metricstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+// Coverage records every distinct metric name emitted during a test run, to
+// treat the emitted telemetry as a contract which is checked against a
+// manifest. It is typically started and checked in TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		cov := metricstest.StartCoverage()
+//		code := m.Run()
+//		cov.Stop()
+//		if err := cov.CompareFile("testdata/metrics.manifest"); err != nil {
+//			fmt.Println(err)
+//			code = 1
+//		}
+//		os.Exit(code)
+//	}
+//
+// A manifest lists one metric name per line, blank lines and lines starting
+// with '#' are ignored. A '*' part of a name matches any single part of an
+// emitted name, as in "cache.*.miss".
+type Coverage struct {
+	captured *metrics.CapturedMetrics
+	stop     func()
+}
+
+// CoverageError lists the differences between the metrics emitted during a
+// run and a manifest.
+type CoverageError struct {
+	// Missing are the manifest entries which no emitted metric matched
+	Missing []string
+
+	// Unexpected are the emitted metrics matching no manifest entry
+	Unexpected []string
+}
+
+func (e *CoverageError) Error() string {
+	var b strings.Builder
+	b.WriteString("metrics coverage does not match the manifest")
+	for _, name := range e.Missing {
+		fmt.Fprintf(&b, "\n  missing:    %s", name)
+	}
+	for _, name := range e.Unexpected {
+		fmt.Fprintf(&b, "\n  unexpected: %s", name)
+	}
+	return b.String()
+}
+
+// StartCoverage starts recording the metrics emitted through the global
+// metrics instance. The instance must not be replaced while recording.
+func StartCoverage() *Coverage {
+	return StartCoverageIn(metrics.Default())
+}
+
+// StartCoverageIn is StartCoverage for the given Metrics instance.
+func StartCoverageIn(m *metrics.Metrics) *Coverage {
+	captured, stop := m.StartCapture()
+	return &Coverage{captured: captured, stop: stop}
+}
+
+// Stop ends the recording. Metrics emitted later are not covered.
+func (c *Coverage) Stop() {
+	c.stop()
+}
+
+// Emitted returns the distinct names emitted so far, sorted. It can be
+// written to a file to create the first manifest.
+func (c *Coverage) Emitted() []string {
+	return c.captured.Names()
+}
+
+// Compare returns a *CoverageError when any manifest entry was not emitted,
+// or any emitted metric is not in the manifest.
+func (c *Coverage) Compare(manifest []string) error {
+	emitted := c.Emitted()
+	matched := make([]bool, len(emitted))
+
+	e := &CoverageError{}
+	for _, entry := range manifest {
+		found := false
+		for i, name := range emitted {
+			if matchName(entry, name) {
+				matched[i], found = true, true
+			}
+		}
+		if !found {
+			e.Missing = append(e.Missing, entry)
+		}
+	}
+	for i, name := range emitted {
+		if !matched[i] {
+			e.Unexpected = append(e.Unexpected, name)
+		}
+	}
+	if len(e.Missing) > 0 || len(e.Unexpected) > 0 {
+		return e
+	}
+	return nil
+}
+
+// CompareFile is Compare with the manifest read from a file.
+func (c *Coverage) CompareFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	manifest, err := ReadManifest(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return c.Compare(manifest)
+}
+
+// AssertCoverage fails the test unless the metrics recorded by c match the
+// manifest, see Coverage.Compare.
+func AssertCoverage(t testing.TB, c *Coverage, manifest ...string) {
+	t.Helper()
+	if err := c.Compare(manifest); err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+// ReadManifest reads the names of a manifest, skipping blank lines and
+// comments.
+func ReadManifest(r io.Reader) ([]string, error) {
+	var manifest []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		manifest = append(manifest, line)
+	}
+	return manifest, scanner.Err()
+}
+
+// matchName reports whether an emitted name matches a manifest entry, where
+// a '*' part of the entry matches any single part.
+func matchName(entry, name string) bool {
+	if !strings.Contains(entry, "*") {
+		return entry == name
+	}
+	want, got := strings.Split(entry, "."), strings.Split(name, ".")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != "*" && want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metricstest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+func TestCoverage(t *testing.T) {
+	m := newMetrics(t)
+	m.IncrCounter([]string{"before"}, 1)
+
+	cov := StartCoverageIn(m)
+	m.IncrCounter([]string{"cache", "miss"}, 1)
+	m.IncrCounterWithLabels([]string{"cache", "miss"}, 1, []metrics.Label{{Name: "cache", Value: "a"}})
+	m.SetGauge([]string{"pool", "size"}, 4)
+	m.MeasureSince([]string{"db", "query"}, time.Now())
+	m.IncrCounter([]string{"shard", "3", "writes"}, 1)
+	m.IncrCounter([]string{"shard", "4", "writes"}, 1)
+	cov.Stop()
+	m.IncrCounter([]string{"after"}, 1)
+
+	if got, want := cov.Emitted(), []string{"cache.miss", "db.query", "pool.size", "shard.3.writes", "shard.4.writes"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad emitted %v", got)
+	}
+	AssertCoverage(t, cov, "cache.miss", "db.query", "pool.size", "shard.*.writes")
+
+	err := cov.Compare([]string{"cache.miss", "cache.hit", "db.query", "shard.*"})
+	var cerr *CoverageError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected a coverage error, got %v", err)
+	}
+	if !reflect.DeepEqual(cerr.Missing, []string{"cache.hit", "shard.*"}) ||
+		!reflect.DeepEqual(cerr.Unexpected, []string{"pool.size", "shard.3.writes", "shard.4.writes"}) {
+		t.Fatalf("bad error %#v", cerr)
+	}
+	if !strings.Contains(err.Error(), "missing:    cache.hit") {
+		t.Fatalf("bad message %s", err)
+	}
+
+	rt := &recordingT{TB: t}
+	AssertCoverage(rt, cov, "cache.miss")
+	if len(rt.errors) != 1 {
+		t.Fatalf("expected a failure, got %v", rt.errors)
+	}
+}
+
+func TestCoverage_CompareFile(t *testing.T) {
+	m := newMetrics(t)
+	cov := StartCoverageIn(m)
+	defer cov.Stop()
+	m.IncrCounter([]string{"requests"}, 1)
+	m.AddSample([]string{"latency"}, 1)
+
+	path := filepath.Join(t.TempDir(), "metrics.manifest")
+	manifest := "# Emitted by the API\nrequests\n\n  latency  \n"
+	if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := cov.CompareFile(path); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if err := cov.CompareFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package metricstest provides helpers for asserting on the metrics emitted
+// by the code under test, based on Metrics.Capture:
+//
+//	metricstest.AssertCounterDelta(t, func() {
+//		cache.Get("a")
+//		cache.Get("b")
+//	}, "cache.miss", 2)
+//
+// The helpers use the global metrics instance, while the *In variants take a
+// specific one. Names are the keys joined with '.', as passed to the metrics
+// methods, before any renames, prefixes or filters are applied.
+package metricstest
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+// AssertCounterDelta runs fn and fails the test unless the counter name was
+// incremented by exactly delta through the global metrics instance. Without
+// labels the increments of every label set are summed.
+func AssertCounterDelta(t testing.TB, fn func(), name string, delta float64, labels ...metrics.Label) {
+	t.Helper()
+	AssertCounterDeltaIn(t, metrics.Default(), fn, name, delta, labels...)
+}
+
+// AssertCounterDeltaIn is AssertCounterDelta for the given Metrics instance.
+func AssertCounterDeltaIn(t testing.TB, m *metrics.Metrics, fn func(), name string, delta float64, labels ...metrics.Label) {
+	t.Helper()
+	got := m.Capture(fn).Counter(name, labels...)
+	if got != delta {
+		t.Errorf("counter %s%s: got delta %v, want %v", name, formatLabels(labels), got, delta)
+	}
+}
+
+// AssertSampleCount runs fn and fails the test unless exactly n samples or
+// timings were recorded for name through the global metrics instance.
+// Without labels the samples of every label set are counted.
+func AssertSampleCount(t testing.TB, fn func(), name string, n int, labels ...metrics.Label) {
+	t.Helper()
+	AssertSampleCountIn(t, metrics.Default(), fn, name, n, labels...)
+}
+
+// AssertSampleCountIn is AssertSampleCount for the given Metrics instance.
+func AssertSampleCountIn(t testing.TB, m *metrics.Metrics, fn func(), name string, n int, labels ...metrics.Label) {
+	t.Helper()
+	got := m.Capture(fn).SampleCount(name, labels...)
+	if got != n {
+		t.Errorf("sample %s%s: got %d samples, want %d", name, formatLabels(labels), got, n)
+	}
+}
+
+// AssertGauge runs fn and fails the test unless the gauge name with exactly
+// the given labels was last set to val through the global metrics instance.
+func AssertGauge(t testing.TB, fn func(), name string, val float64, labels ...metrics.Label) {
+	t.Helper()
+	AssertGaugeIn(t, metrics.Default(), fn, name, val, labels...)
+}
+
+// AssertGaugeIn is AssertGauge for the given Metrics instance.
+func AssertGaugeIn(t testing.TB, m *metrics.Metrics, fn func(), name string, val float64, labels ...metrics.Label) {
+	t.Helper()
+	got, ok := m.Capture(fn).Gauge(name, labels...)
+	switch {
+	case !ok:
+		t.Errorf("gauge %s%s: not set", name, formatLabels(labels))
+	case got != val:
+		t.Errorf("gauge %s%s: got %v, want %v", name, formatLabels(labels), got, val)
+	}
+}
+
+func formatLabels(labels []metrics.Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	s := "{"
+	for i, l := range labels {
+		if i > 0 {
+			s += ","
+		}
+		s += l.Name + "=" + l.Value
+	}
+	return s + "}"
+}
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metricstest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+// recordingT collects the failures of an assertion
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func newMetrics(t *testing.T) *metrics.Metrics {
+	conf := metrics.DefaultConfig("")
+	conf.EnableRuntimeMetrics = false
+	m, err := metrics.New(conf, &metrics.BlackholeSink{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return m
+}
+
+func TestAssertCounterDelta(t *testing.T) {
+	m := newMetrics(t)
+	miss := func() {
+		m.IncrCounterWithLabels([]string{"cache", "miss"}, 1, []metrics.Label{{Name: "cache", Value: "a"}})
+		m.IncrCounterWithLabels([]string{"cache", "miss"}, 1, []metrics.Label{{Name: "cache", Value: "b"}})
+	}
+
+	AssertCounterDeltaIn(t, m, miss, "cache.miss", 2)
+	AssertCounterDeltaIn(t, m, miss, "cache.miss", 1, metrics.Label{Name: "cache", Value: "a"})
+
+	// Earlier increments are not part of the delta
+	rt := &recordingT{TB: t}
+	AssertCounterDeltaIn(rt, m, func() {}, "cache.miss", 2)
+	if len(rt.errors) != 1 {
+		t.Fatalf("expected a failure, got %v", rt.errors)
+	}
+}
+
+func TestAssertCounterDelta_Global(t *testing.T) {
+	conf := metrics.DefaultConfig("")
+	conf.EnableRuntimeMetrics = false
+	if _, err := metrics.NewGlobal(conf, &metrics.BlackholeSink{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	AssertCounterDelta(t, func() {
+		metrics.IncrCounter([]string{"requests"}, 3)
+	}, "requests", 3)
+}
+
+func TestAssertSampleCount(t *testing.T) {
+	m := newMetrics(t)
+	AssertSampleCountIn(t, m, func() {
+		m.AddSample([]string{"db", "rows"}, 10)
+		m.MeasureSince([]string{"db", "rows"}, time.Now())
+	}, "db.rows", 2)
+
+	rt := &recordingT{TB: t}
+	AssertSampleCountIn(rt, m, func() {}, "db.rows", 1)
+	if len(rt.errors) != 1 || !strings.Contains(rt.errors[0], "samples") {
+		t.Fatalf("expected a failure, got %v", rt.errors)
+	}
+}
+
+func TestAssertGauge(t *testing.T) {
+	m := newMetrics(t)
+	label := metrics.Label{Name: "pool", Value: "db"}
+	AssertGaugeIn(t, m, func() {
+		m.SetGaugeWithLabels([]string{"pool", "size"}, 4, []metrics.Label{label})
+		m.SetPrecisionGaugeWithLabels([]string{"pool", "size"}, 5, []metrics.Label{label})
+	}, "pool.size", 5, label)
+
+	rt := &recordingT{TB: t}
+	AssertGaugeIn(rt, m, func() {}, "pool.size", 5, label)
+	if len(rt.errors) != 1 || !strings.Contains(rt.errors[0], "not set") {
+		t.Fatalf("expected a failure, got %v", rt.errors)
+	}
+}
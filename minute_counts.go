@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMinuteCountsRetention is used when Config.MinuteCountsRetention is
+// not set
+const defaultMinuteCountsRetention = time.Hour
+
+// minuteBucket is the total of a counter over one minute
+type minuteBucket struct {
+	minute int64
+	count  float64
+}
+
+// minuteCounts keeps per minute totals of the counters listed in
+// Config.MinuteCounts, summed over all label sets, in a ring per key.
+type minuteCounts struct {
+	size int
+
+	lock    sync.Mutex
+	buckets map[string][]minuteBucket
+}
+
+func newMinuteCounts(keys []string, retention time.Duration) *minuteCounts {
+	if len(keys) == 0 {
+		return nil
+	}
+	if retention <= 0 {
+		retention = defaultMinuteCountsRetention
+	}
+	c := &minuteCounts{
+		// One extra bucket for the minute in progress
+		size:    int(retention/time.Minute) + 1,
+		buckets: make(map[string][]minuteBucket, len(keys)),
+	}
+	for _, k := range keys {
+		c.buckets[k] = make([]minuteBucket, c.size)
+	}
+	return c
+}
+
+func (c *minuteCounts) record(key []string, val float64, now time.Time) {
+	name := strings.Join(key, ".")
+	minute := now.Unix() / 60
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ring, ok := c.buckets[name]
+	if !ok {
+		return
+	}
+	b := &ring[minute%int64(c.size)]
+	if b.minute != minute {
+		*b = minuteBucket{minute: minute}
+	}
+	b.count += val
+}
+
+func (c *minuteCounts) since(key []string, window time.Duration, now time.Time) float64 {
+	name := strings.Join(key, ".")
+	current := now.Unix() / 60
+	oldest := now.Add(-window).Unix() / 60
+	if min := current - int64(c.size) + 1; oldest < min {
+		oldest = min
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var total float64
+	for _, b := range c.buckets[name] {
+		if b.minute >= oldest && b.minute <= current {
+			total += b.count
+		}
+	}
+	return total
+}
+
+// CountsSince returns the total of a counter listed in Config.MinuteCounts
+// over the given window, summed over all label sets. Counts are kept per
+// minute, so the window is rounded out to whole minutes and may include up
+// to a minute more. Windows beyond Config.MinuteCountsRetention are capped,
+// and zero is returned for other counters.
+func (m *Metrics) CountsSince(key []string, window time.Duration) float64 {
+	return m.countsSinceAt(key, window, time.Now())
+}
+
+func (m *Metrics) countsSinceAt(key []string, window time.Duration, now time.Time) float64 {
+	if m.minuteCounts == nil {
+		return 0
+	}
+	return m.minuteCounts.since(key, window, now)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMinuteCounts(t *testing.T) {
+	c := newMinuteCounts([]string{"logins"}, 5*time.Minute)
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+	key := []string{"logins"}
+
+	c.record(key, 1, start)
+	c.record(key, 2, start.Add(30*time.Second))
+	c.record(key, 4, start.Add(2*time.Minute))
+	c.record([]string{"other"}, 100, start)
+
+	now := start.Add(2*time.Minute + 10*time.Second)
+	if got := c.since(key, time.Minute, now); got != 4 {
+		t.Fatalf("bad count: %v", got)
+	}
+	if got := c.since(key, 3*time.Minute, now); got != 7 {
+		t.Fatalf("bad count: %v", got)
+	}
+	if got := c.since([]string{"other"}, time.Hour, now); got != 0 {
+		t.Fatalf("untracked counters should be zero: %v", got)
+	}
+
+	// Old buckets are reused once out of retention
+	later := start.Add(6 * time.Minute)
+	c.record(key, 8, later)
+	if got := c.since(key, time.Hour, later); got != 12 {
+		t.Fatalf("bad count: %v", got)
+	}
+}
+
+func TestMetrics_CountsSince(t *testing.T) {
+	_, met := mockMetric()
+	met.minuteCounts = newMinuteCounts([]string{"api.requests"}, 0)
+
+	met.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	met.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "500"}})
+	if got := met.CountsSince([]string{"api", "requests"}, time.Minute); got != 3 {
+		t.Fatalf("bad count: %v", got)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mqttTopic is used when MQTTOpts.Topic is not set
+	mqttTopic = "metrics/{path}"
+
+	// mqttFlushInterval is used when MQTTOpts.FlushInterval is not set
+	mqttFlushInterval = time.Second
+
+	// mqttPublishTimeout is used when MQTTOpts.PublishTimeout is not set
+	mqttPublishTimeout = 10 * time.Second
+)
+
+// MQTTMessage is a message published by an MQTTSink.
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+
+	// QoS and Retain are those of MQTTOpts
+	QoS    byte
+	Retain bool
+}
+
+// MQTTPublisher publishes messages to an MQTT broker. It is implemented by a
+// small adapter over the MQTT client already used by the application, such
+// as eclipse/paho.mqtt.golang or paho.golang, which connects, authenticates
+// and reconnects, so this package does not depend on one. Publish must only
+// return once the messages are acknowledged as required by their QoS, or
+// have failed.
+type MQTTPublisher interface {
+	Publish(ctx context.Context, msgs []MQTTMessage) error
+}
+
+// MQTTOpts is used to configure an MQTTSink.
+type MQTTOpts struct {
+	// Publisher sends the messages, it is required
+	Publisher MQTTPublisher
+
+	// Topic is the template of the topic of every event, which defaults to
+	// "metrics/{path}". It expands the placeholders:
+	//
+	//	{name}        the key joined with '.'
+	//	{path}        the key joined with '/'
+	//	{type}        gauge, counter, sample or key
+	//	{label:NAME}  the value of the label NAME, empty when missing
+	//
+	// The wildcards '+' and '#' are replaced with '_' in expanded values,
+	// as is '/' in key parts and label values.
+	Topic string
+
+	// QoS is the MQTT quality of service of every message, 0, 1 or 2
+	QoS byte
+
+	// Retain asks the broker to retain the last event of every topic
+	Retain bool
+
+	// FlushInterval is the longest an event is buffered, it defaults to
+	// one second
+	FlushInterval time.Duration
+
+	// QueueSize is the maximum number of buffered events, including those
+	// kept after a failed publish, beyond which events are dropped and
+	// counted in Dropped. It defaults to DefaultWorkerQueueSize.
+	QueueSize int
+
+	// PublishTimeout bounds every Publish call, it defaults to 10 seconds
+	PublishTimeout time.Duration
+
+	// OnError is called with the number of events affected when publishing
+	// fails, it defaults to logging the error
+	OnError func(err error, events int)
+}
+
+// MQTTSink provides a MetricSink which publishes every metric as a JSON
+// event, in the format of KafkaJSON, to an MQTT broker, as needed on gateways
+// where MQTT is the only way out. Events are buffered and published
+// asynchronously, and the events of a failed publish, as while the broker is
+// unreachable, are kept and published again by the next flush.
+type MQTTSink struct {
+	publisher MQTTPublisher
+	topic     []mqttTopicPart
+	qos       byte
+	retain    bool
+	timeout   time.Duration
+	onError   func(error, int)
+	queue     *eventQueue
+
+	// publishLock serializes flushes, keeping events in order
+	publishLock sync.Mutex
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// mqttTopicPart is a literal or a placeholder of a topic template
+type mqttTopicPart struct {
+	literal string
+	field   string
+	label   string
+}
+
+// NewMQTTSink creates an MQTTSink and starts its flush goroutine.
+func NewMQTTSink(opts MQTTOpts) (*MQTTSink, error) {
+	if opts.Publisher == nil {
+		return nil, fmt.Errorf("mqtt publisher is required")
+	}
+	if opts.QoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt qos %d", opts.QoS)
+	}
+	template := opts.Topic
+	if template == "" {
+		template = mqttTopic
+	}
+	topic, err := parseMQTTTopic(template)
+	if err != nil {
+		return nil, err
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = mqttFlushInterval
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultWorkerQueueSize
+	}
+	timeout := opts.PublishTimeout
+	if timeout <= 0 {
+		timeout = mqttPublishTimeout
+	}
+	onError := opts.OnError
+	if onError == nil {
+		onError = func(err error, events int) {
+			log.Printf("[ERR] Error publishing %d metrics to MQTT! Err: %s", events, err)
+		}
+	}
+
+	s := &MQTTSink{
+		publisher: opts.Publisher,
+		topic:     topic,
+		qos:       opts.QoS,
+		retain:    opts.Retain,
+		timeout:   timeout,
+		onError:   onError,
+		// The queue is flushed once half full, which leaves room for the
+		// events kept after a failed publish
+		queue:  newEventQueue(queueSize, max(queueSize/2, 1)),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+// parseMQTTTopic splits a topic template into literals and placeholders.
+func parseMQTTTopic(template string) ([]mqttTopicPart, error) {
+	var parts []mqttTopicPart
+	for template != "" {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			parts = append(parts, mqttTopicPart{literal: template})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, mqttTopicPart{literal: template[:start]})
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in mqtt topic %q", template)
+		}
+		placeholder := template[start+1 : start+end]
+		switch {
+		case placeholder == "name", placeholder == "path", placeholder == "type":
+			parts = append(parts, mqttTopicPart{field: placeholder})
+		case strings.HasPrefix(placeholder, "label:") && len(placeholder) > len("label:"):
+			parts = append(parts, mqttTopicPart{field: "label", label: strings.TrimPrefix(placeholder, "label:")})
+		default:
+			return nil, fmt.Errorf("unknown placeholder {%s} in mqtt topic", placeholder)
+		}
+		template = template[start+end+1:]
+	}
+	return parts, nil
+}
+
+func (s *MQTTSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *MQTTSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, float64(val), labels))
+}
+
+func (s *MQTTSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *MQTTSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, val, labels))
+}
+
+func (s *MQTTSink) EmitKey(key []string, val float32) {
+	s.queue.add(newMetricEvent("key", key, float64(val), nil))
+}
+
+func (s *MQTTSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *MQTTSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("counter", key, float64(val), labels))
+}
+
+func (s *MQTTSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *MQTTSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("sample", key, float64(val), labels))
+}
+
+// Capabilities reports what the MQTT sink supports.
+func (s *MQTTSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (s *MQTTSink) Dropped() uint64 {
+	return s.queue.droppedCount()
+}
+
+// Flush publishes all buffered events and blocks until they are acknowledged
+// or have failed.
+func (s *MQTTSink) Flush() {
+	s.flush()
+}
+
+// Shutdown stops the flush goroutine and blocks while the remaining events
+// are published. The publisher is left connected.
+func (s *MQTTSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		<-s.doneCh
+	})
+}
+
+func (s *MQTTSink) run(interval time.Duration) {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(JitterInterval(interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(JitterInterval(interval))
+		case <-s.queue.kickCh:
+		case <-s.stopCh:
+			s.flush()
+			return
+		}
+		s.flush()
+	}
+}
+
+// flush publishes the buffered events, putting them back into the queue
+// when publishing fails.
+func (s *MQTTSink) flush() {
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+
+	events := s.queue.take()
+	if len(events) == 0 {
+		return
+	}
+	msgs := make([]MQTTMessage, len(events))
+	for i, e := range events {
+		msgs[i] = MQTTMessage{Topic: s.eventTopic(e), Payload: e.marshalJSON(), QoS: s.qos, Retain: s.retain}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	err := s.publisher.Publish(ctx, msgs)
+	cancel()
+	if err != nil {
+		s.queue.requeue(events)
+		s.onError(err, len(events))
+	}
+}
+
+// eventTopic expands the topic template for an event.
+func (s *MQTTSink) eventTopic(e metricEvent) string {
+	var b strings.Builder
+	for _, part := range s.topic {
+		switch part.field {
+		case "":
+			b.WriteString(part.literal)
+		case "name":
+			b.WriteString(strings.Map(mqttSanitize, e.name()))
+		case "path":
+			for i, k := range e.key {
+				if i > 0 {
+					b.WriteByte('/')
+				}
+				b.WriteString(strings.Map(mqttSanitizeLevel, k))
+			}
+		case "type":
+			b.WriteString(e.typ)
+		case "label":
+			for _, l := range e.labels {
+				if l.Name == part.label {
+					b.WriteString(strings.Map(mqttSanitizeLevel, l.Value))
+					break
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+func mqttSanitize(r rune) rune {
+	switch r {
+	case '+', '#', 0:
+		return '_'
+	default:
+		return r
+	}
+}
+
+func mqttSanitizeLevel(r rune) rune {
+	if r == '/' {
+		return '_'
+	}
+	return mqttSanitize(r)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttRecorder is an MQTTPublisher keeping every message, which fails while
+// err is set
+type mqttRecorder struct {
+	lock sync.Mutex
+	msgs []MQTTMessage
+	err  error
+}
+
+func (m *mqttRecorder) Publish(ctx context.Context, msgs []MQTTMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no deadline")
+	}
+	if m.err != nil {
+		return m.err
+	}
+	m.msgs = append(m.msgs, msgs...)
+	return nil
+}
+
+func (m *mqttRecorder) messages() []MQTTMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]MQTTMessage(nil), m.msgs...)
+}
+
+func TestMQTTSink_Publish(t *testing.T) {
+	p := &mqttRecorder{}
+	s, err := NewMQTTSink(MQTTOpts{
+		Publisher:     p,
+		Topic:         "site/{label:site}/{type}/{path}",
+		QoS:           1,
+		Retain:        true,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounterWithLabels([]string{"pump", "starts"}, 1, []Label{{"site", "north/1"}})
+	s.SetGauge([]string{"temp+c"}, 21.5)
+	s.Shutdown()
+
+	msgs := p.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("bad messages %v", msgs)
+	}
+	if msgs[0].Topic != "site/north_1/counter/pump/starts" || msgs[0].QoS != 1 || !msgs[0].Retain {
+		t.Fatalf("bad message %+v", msgs[0])
+	}
+	if msgs[1].Topic != "site//gauge/temp_c" {
+		t.Fatalf("bad topic %q", msgs[1].Topic)
+	}
+	var e struct {
+		Name   string
+		Type   string
+		Value  float64
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(msgs[0].Payload, &e); err != nil {
+		t.Fatalf("bad payload %s: %s", msgs[0].Payload, err)
+	}
+	if e.Name != "pump.starts" || e.Type != "counter" || e.Value != 1 || e.Labels["site"] != "north/1" {
+		t.Fatalf("bad event %+v", e)
+	}
+}
+
+func TestMQTTSink_Offline(t *testing.T) {
+	p := &mqttRecorder{err: errors.New("not connected")}
+	var lock sync.Mutex
+	var errs []error
+	s, err := NewMQTTSink(MQTTOpts{
+		Publisher:     p,
+		FlushInterval: time.Hour,
+		OnError: func(err error, events int) {
+			lock.Lock()
+			defer lock.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounter([]string{"first"}, 1)
+	s.Flush()
+	lock.Lock()
+	if len(errs) != 1 || errs[0].Error() != "not connected" {
+		t.Fatalf("bad errors %v", errs)
+	}
+	lock.Unlock()
+
+	// The events of the failed publish are kept and published in order
+	p.lock.Lock()
+	p.err = nil
+	p.lock.Unlock()
+	s.IncrCounter([]string{"second"}, 1)
+	s.Flush()
+	msgs := p.messages()
+	if len(msgs) != 2 || msgs[0].Topic != "metrics/first" || msgs[1].Topic != "metrics/second" {
+		t.Fatalf("bad messages %v", msgs)
+	}
+}
+
+func TestNewMQTTSink_Errors(t *testing.T) {
+	p := &mqttRecorder{}
+	for _, opts := range []MQTTOpts{
+		{},
+		{Publisher: p, QoS: 3},
+		{Publisher: p, Topic: "metrics/{unknown}"},
+		{Publisher: p, Topic: "metrics/{path"},
+	} {
+		if _, err := NewMQTTSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// processFlushInterval is how often a ProcessSink writes buffered
+	// metrics to its parent
+	processFlushInterval = 100 * time.Millisecond
+
+	// maxProcessBuffer bounds the metrics buffered by a ProcessSink between
+	// flushes, and maxProcessPending the encoded snapshots waiting for the
+	// parent while it is unreachable. Further metrics are dropped.
+	maxProcessBuffer  = 32 << 10
+	maxProcessPending = 1 << 20
+
+	// maxProcessSnapshot bounds a single decoded snapshot
+	maxProcessSnapshot = 16 << 20
+
+	// maxProcessCodecName bounds the codec name sent by children
+	maxProcessCodecName = 64
+
+	// processDrainTimeout is how long a closing ProcessAggregator keeps
+	// reading from connected children
+	processDrainTimeout = time.Second
+)
+
+// processMagic starts every connection, identifying the protocol version.
+// It is followed by the length prefixed name of the SnapshotCodec encoding
+// the snapshots sent over the connection.
+var processMagic = []byte("GMP2")
+
+var errProcessSnapshotSize = errors.New("snapshot too large")
+
+// Metric types buffered by a ProcessSink
+const (
+	processGauge byte = iota + 1
+	processPrecisionGauge
+	processKV
+	processCounter
+	processSample
+)
+
+// ProcessSink provides a MetricSink that forwards every metric to a parent
+// process over a local Unix socket, where a ProcessAggregator aggregates the
+// metrics of all its children and exports them once. This suits pre-fork
+// servers and plugin architectures, where each process would otherwise have
+// to be scraped or push on its own.
+//
+// Metrics are written in batches, as MetricsSummary snapshots encoded with a
+// SnapshotCodec, in which every metric is a separate value: counters and
+// samples with a count of one and the metric as their sum. Keys are joined
+// with '.', and split on it again by the parent. While the parent is
+// unreachable metrics are buffered up to a limit, and dropped beyond it.
+type ProcessSink struct {
+	path  string
+	dial  Dialer
+	codec SnapshotCodec
+
+	lock     sync.Mutex
+	batch    MetricsSummary
+	buffered int
+	dropped  bool
+
+	// The connection and pending snapshots are only used from the flush
+	// loop
+	conn    net.Conn
+	pending bytes.Buffer
+	loop    *flushLoop
+}
+
+// NewProcessSink creates a ProcessSink forwarding to the ProcessAggregator
+// listening on the Unix socket at path, encoding metrics with
+// ProtobufSnapshotCodec.
+func NewProcessSink(path string) (*ProcessSink, error) {
+	return newProcessSink(path, net.Dial, ProtobufSnapshotCodec)
+}
+
+// NewProcessSinkWithCodec creates a ProcessSink encoding metrics with codec,
+// which must be registered with RegisterSnapshotCodec in the parent.
+func NewProcessSinkWithCodec(path string, codec SnapshotCodec) (*ProcessSink, error) {
+	return newProcessSink(path, net.Dial, codec)
+}
+
+func newProcessSink(path string, dial Dialer, codec SnapshotCodec) (*ProcessSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("process socket path is required")
+	}
+	if len(codec.Name()) > maxProcessCodecName {
+		return nil, fmt.Errorf("snapshot codec name %q is too long", codec.Name())
+	}
+	s := &ProcessSink{
+		path:  path,
+		dial:  dial,
+		codec: codec,
+	}
+	s.loop = startFlushLoop(processFlushInterval, s.flushLoop)
+	return s, nil
+}
+
+func (s *ProcessSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ProcessSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.append(processGauge, key, float64(val), labels)
+}
+
+func (s *ProcessSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *ProcessSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.append(processPrecisionGauge, key, val, labels)
+}
+
+func (s *ProcessSink) EmitKey(key []string, val float32) {
+	s.append(processKV, key, float64(val), nil)
+}
+
+func (s *ProcessSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ProcessSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.append(processCounter, key, float64(val), labels)
+}
+
+func (s *ProcessSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ProcessSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.append(processSample, key, float64(val), labels)
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// written.
+func (s *ProcessSink) Shutdown() {
+	s.loop.stop()
+}
+
+func (s *ProcessSink) append(typ byte, key []string, val float64, labels []Label) {
+	name := strings.Join(key, ".")
+	// Copy the labels, as callers are free to reuse the slice
+	labels = append([]Label(nil), labels...)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.buffered >= maxProcessBuffer {
+		if !s.dropped {
+			log.Printf("[WARN] metrics: process sink buffer full, dropping metrics")
+			s.dropped = true
+		}
+		return
+	}
+	s.buffered++
+
+	b := &s.batch
+	switch typ {
+	case processGauge:
+		b.Gauges = append(b.Gauges, GaugeValue{Name: name, Value: float32(val), Labels: labels})
+	case processPrecisionGauge:
+		b.PrecisionGauges = append(b.PrecisionGauges, PrecisionGaugeValue{Name: name, Value: val, Labels: labels})
+	case processKV:
+		b.Points = append(b.Points, PointValue{Name: name, Points: []float32{float32(val)}})
+	case processCounter:
+		b.Counters = append(b.Counters, SampledValue{Name: name, Labels: labels, AggregateSample: &AggregateSample{Count: 1, Sum: val}})
+	case processSample:
+		b.Samples = append(b.Samples, SampledValue{Name: name, Labels: labels, AggregateSample: &AggregateSample{Count: 1, Sum: val}})
+	}
+}
+
+func (s *ProcessSink) flushLoop(now time.Time, final bool) {
+	s.flush()
+	if final && s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+// flush encodes the metrics buffered since the last flush, unless earlier
+// snapshots are still pending, and writes the pending snapshots. It is only
+// called from the flush loop. Snapshots are kept for the next attempt when
+// the parent is unreachable.
+func (s *ProcessSink) flush() {
+	if s.pending.Len() < maxProcessPending {
+		s.lock.Lock()
+		batch, n := s.batch, s.buffered
+		s.batch, s.buffered, s.dropped = MetricsSummary{}, 0, false
+		s.lock.Unlock()
+
+		if n > 0 {
+			if err := s.codec.Encode(&s.pending, &batch); err != nil {
+				log.Printf("[ERR] Error encoding metrics for parent process! Err: %s", err)
+			}
+		}
+	}
+	if s.pending.Len() == 0 {
+		return
+	}
+
+	if s.conn == nil {
+		conn, err := s.dial("unix", s.path)
+		if err != nil {
+			log.Printf("[ERR] Error connecting to parent process! Err: %s", err)
+			return
+		}
+		hello := append([]byte(nil), processMagic...)
+		hello = binary.AppendUvarint(hello, uint64(len(s.codec.Name())))
+		hello = append(hello, s.codec.Name()...)
+		if _, err := conn.Write(hello); err != nil {
+			log.Printf("[ERR] Error writing to parent process! Err: %s", err)
+			_ = conn.Close()
+			return
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(s.pending.Bytes()); err != nil {
+		log.Printf("[ERR] Error writing to parent process! Err: %s", err)
+		_ = s.conn.Close()
+		s.conn = nil
+		return
+	}
+	s.pending.Reset()
+}
+
+// ProcessAggregator receives metrics from ProcessSinks in child processes
+// over a Unix socket and emits them to a sink, typically the Metrics
+// instance or aggregating sink of the parent. Child metrics have already
+// been prefixed and filtered by the child's own Metrics instance.
+type ProcessAggregator struct {
+	sink MetricSink
+	ln   net.Listener
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewProcessAggregator listens on the Unix socket at path and starts
+// forwarding the metrics of connecting children to sink. A stale socket file
+// left behind by a previous parent is removed.
+func NewProcessAggregator(path string, sink MetricSink) (*ProcessAggregator, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	a := &ProcessAggregator{
+		sink:  sink,
+		ln:    ln,
+		conns: make(map[net.Conn]struct{}),
+	}
+	a.wg.Add(1)
+	go a.accept()
+	return a, nil
+}
+
+// Addr returns the address the aggregator listens on.
+func (a *ProcessAggregator) Addr() net.Addr {
+	return a.ln.Addr()
+}
+
+// Close stops accepting children, then keeps reading from the connected ones
+// for a short while so metrics already written are emitted, before
+// disconnecting them.
+func (a *ProcessAggregator) Close() error {
+	err := a.ln.Close()
+
+	deadline := time.Now().Add(processDrainTimeout)
+	a.lock.Lock()
+	for conn := range a.conns {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	a.lock.Unlock()
+
+	a.wg.Wait()
+	return err
+}
+
+func (a *ProcessAggregator) accept() {
+	defer a.wg.Done()
+	for {
+		conn, err := a.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[ERR] Error accepting child process! Err: %s", err)
+			}
+			return
+		}
+
+		a.lock.Lock()
+		a.conns[conn] = struct{}{}
+		a.lock.Unlock()
+
+		a.wg.Add(1)
+		go a.serve(conn)
+	}
+}
+
+func (a *ProcessAggregator) serve(conn net.Conn) {
+	defer a.wg.Done()
+	defer func() {
+		a.lock.Lock()
+		delete(a.conns, conn)
+		a.lock.Unlock()
+		_ = conn.Close()
+	}()
+
+	limit := &processLimitReader{r: conn, n: maxProcessSnapshot}
+	r := bufio.NewReader(limit)
+	magic := make([]byte, len(processMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != string(processMagic) {
+		log.Printf("[ERR] Unknown protocol from child process")
+		return
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > maxProcessCodecName {
+		log.Printf("[ERR] Unknown protocol from child process")
+		return
+	}
+	name := make([]byte, n)
+	if _, err := io.ReadFull(r, name); err != nil {
+		log.Printf("[ERR] Unknown protocol from child process")
+		return
+	}
+	codec := LookupSnapshotCodec(string(name))
+	if codec == nil {
+		log.Printf("[ERR] Unknown snapshot codec %q from child process", name)
+		return
+	}
+
+	dec := NewSnapshotDecoder(r, codec)
+	for {
+		limit.n = maxProcessSnapshot
+		var s MetricsSummary
+		if err := dec.Decode(&s); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("[ERR] Error reading from child process! Err: %s", err)
+			}
+			return
+		}
+		a.emit(&s)
+	}
+}
+
+// emit emits the metrics of a snapshot written by a ProcessSink.
+func (a *ProcessAggregator) emit(s *MetricsSummary) {
+	for _, g := range s.Gauges {
+		a.sink.SetGaugeWithLabels(processKey(g.Name), g.Value, g.Labels)
+	}
+	for _, g := range s.PrecisionGauges {
+		setPrecisionGauge(a.sink, processKey(g.Name), g.Value, g.Labels)
+	}
+	for _, p := range s.Points {
+		key := processKey(p.Name)
+		for _, v := range p.Points {
+			a.sink.EmitKey(key, v)
+		}
+	}
+	for _, c := range s.Counters {
+		if c.AggregateSample != nil {
+			a.sink.IncrCounterWithLabels(processKey(c.Name), float32(c.Sum), c.Labels)
+		}
+	}
+	for _, c := range s.Samples {
+		if c.AggregateSample != nil {
+			a.sink.AddSampleWithLabels(processKey(c.Name), float32(c.Sum), c.Labels)
+		}
+	}
+}
+
+func processKey(name string) []string {
+	return strings.Split(name, ".")
+}
+
+// processLimitReader fails reads beyond n bytes, bounding the snapshots read
+// from a child. As reads are buffered the bound is approximate.
+type processLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *processLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errProcessSnapshotSize
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitKeys waits for a sink to receive n metrics, as children are accepted
+// asynchronously.
+func waitKeys(t *testing.T, sink *MockSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.getKeys()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %d metrics, got %v", n, sink.getKeys())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessAggregator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	parent := &MockSink{}
+	agg, err := NewProcessAggregator(path, parent)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for i, child := range []string{"1", "2"} {
+		s, err := NewProcessSink(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"child", child}})
+		s.Shutdown()
+		waitKeys(t, parent, i+1)
+	}
+
+	s, err := NewProcessSink(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.SetGauge([]string{"gauge"}, 1)
+	s.SetPrecisionGaugeWithLabels([]string{"precise"}, 1.5, []Label{{"a", "b"}})
+	s.EmitKey([]string{"kv"}, 2)
+	s.AddSample([]string{"sample", "slow thingy"}, 3)
+	s.Shutdown()
+
+	waitKeys(t, parent, 6)
+	if err := agg.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	keys := parent.getKeys()
+	expected := [][]string{{"requests"}, {"requests"}, {"gauge"}, {"precise"}, {"kv"}, {"sample", "slow thingy"}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if !reflect.DeepEqual(parent.labels[1], []Label{{"child", "2"}}) {
+		t.Fatalf("bad labels: %v", parent.labels[1])
+	}
+	if !reflect.DeepEqual(parent.vals, []float32{1, 1, 1, 2, 3}) || parent.precisionVals[0] != 1.5 {
+		t.Fatalf("bad values: %v %v", parent.vals, parent.precisionVals)
+	}
+}
+
+func TestProcessSink_Unreachable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	s, err := NewProcessSink(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.IncrCounter([]string{"early"}, 1)
+	s.flush()
+
+	// Metrics are kept until the parent comes up
+	parent := &MockSink{}
+	agg, err := NewProcessAggregator(path, parent)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.Shutdown()
+	waitKeys(t, parent, 1)
+	_ = agg.Close()
+
+	if keys := parent.getKeys(); len(keys) != 1 || keys[0][0] != "early" {
+		t.Fatalf("bad keys: %v", keys)
+	}
+}
+
+func TestProcessSink_Codecs(t *testing.T) {
+	for _, codec := range []SnapshotCodec{JSONSnapshotCodec, MsgpackSnapshotCodec, CBORSnapshotCodec} {
+		path := filepath.Join(t.TempDir(), "metrics.sock")
+		parent := &MockSink{}
+		agg, err := NewProcessAggregator(path, parent)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		s, err := NewProcessSinkWithCodec(path, codec)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+		s.AddSample([]string{"api", "latency"}, 3)
+		s.Shutdown()
+		waitKeys(t, parent, 2)
+		_ = agg.Close()
+
+		if keys := parent.getKeys(); !reflect.DeepEqual(keys, [][]string{{"api", "requests"}, {"api", "latency"}}) {
+			t.Fatalf("%s: bad keys: %v", codec.Name(), keys)
+		}
+		if !reflect.DeepEqual(parent.labels[0], []Label{{"code", "200"}}) || !reflect.DeepEqual(parent.vals, []float32{2, 3}) {
+			t.Fatalf("%s: bad metrics: %v %v", codec.Name(), parent.labels, parent.vals)
+		}
+	}
+}
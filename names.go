@@ -0,0 +1,151 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricName is an opaque identifier for a metric key that has been declared
+// up front with RegisterName or MustRegisterName. When Config.StrictNames is
+// enabled metrics must be emitted through a MetricName, with methods such as
+// IncrCounterName, and keys given as a plain []string are dropped, so typo'd
+// names are caught instead of silently fragmenting dashboards.
+type MetricName struct {
+	key  []string
+	flat string
+}
+
+// Key returns a copy of the key parts, suitable for passing to any of the
+// emission functions when the strict names mode is not enabled.
+func (n MetricName) Key() []string {
+	return append([]string(nil), n.key...)
+}
+
+// parts returns the key parts for emission, capped so that nothing appended
+// downstream writes into the name.
+func (n MetricName) parts() []string {
+	return n.key[:len(n.key):len(n.key)]
+}
+
+func (n MetricName) String() string {
+	return n.flat
+}
+
+// nameRegistry holds every registered metric name. It is process wide, as
+// names are typically declared as package level variables by many libraries
+// which all emit through the same global Metrics instance.
+var nameRegistry = struct {
+	sync.RWMutex
+	names map[string]struct{}
+}{names: make(map[string]struct{})}
+
+// builtinNames are the keys of the runtime metrics emitted by the library
+// itself, which keep flowing under the strict names mode. They are kept out
+// of nameRegistry so users remain free to register these names themselves.
+var builtinNames = map[string]struct{}{
+	"runtime.num_goroutines":       {},
+	"runtime.alloc_bytes":          {},
+	"runtime.sys_bytes":            {},
+	"runtime.malloc_count":         {},
+	"runtime.free_count":           {},
+	"runtime.heap_objects":         {},
+	"runtime.total_gc_pause_ns":    {},
+	"runtime.total_gc_runs":        {},
+	"runtime.gc_pause_ns":          {},
+	"runtime.gc_cycle_alloc_bytes": {},
+	"runtime.gc_heap_growth_bytes": {},
+}
+
+// RegisterName declares a metric key. An error is returned if a part is empty
+// or contains whitespace or the '.' separator, or if the key has already been
+// registered.
+func RegisterName(parts ...string) (MetricName, error) {
+	if len(parts) == 0 {
+		return MetricName{}, fmt.Errorf("metric name must have at least one part")
+	}
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " \t\n.") {
+			return MetricName{}, fmt.Errorf("invalid metric name part %q in %q", part, parts)
+		}
+	}
+
+	flat := strings.Join(parts, ".")
+
+	nameRegistry.Lock()
+	defer nameRegistry.Unlock()
+
+	if _, ok := nameRegistry.names[flat]; ok {
+		return MetricName{}, fmt.Errorf("metric name %q is already registered", flat)
+	}
+	nameRegistry.names[flat] = struct{}{}
+
+	return MetricName{key: append([]string(nil), parts...), flat: flat}, nil
+}
+
+// MustRegisterName is like RegisterName but panics on error. It is intended
+// to be used when declaring package level variables, so that duplicate names
+// are caught at startup.
+func MustRegisterName(parts ...string) MetricName {
+	name, err := RegisterName(parts...)
+	if err != nil {
+		panic(err)
+	}
+	return name
+}
+
+// nameAllowed returns whether a key given as a plain []string may be emitted.
+// Under the strict names mode only the builtin runtime names are, as every
+// other metric must be emitted through a MetricName. Dropped keys are logged
+// once so the offending call site can be found without flooding the log.
+func (m *Metrics) nameAllowed(key []string) bool {
+	if !m.StrictNames {
+		return true
+	}
+	flat := strings.Join(key, ".")
+	if _, ok := builtinNames[flat]; ok {
+		return true
+	}
+	if _, logged := m.unregisteredNames.LoadOrStore(flat, true); !logged {
+		log.Printf("[WARN] Dropping metric %q not emitted through a MetricName in strict names mode", flat)
+	}
+	return false
+}
+
+// SetGaugeName sets a gauge declared with RegisterName. Unlike SetGauge it is
+// not subject to the strict names mode.
+func (m *Metrics) SetGaugeName(name MetricName, val float32, labels []Label) {
+	m.emitGauge(name.parts(), val, labels)
+}
+
+// SetPrecisionGaugeName sets a 64 bit gauge declared with RegisterName.
+func (m *Metrics) SetPrecisionGaugeName(name MetricName, val float64, labels []Label) {
+	m.emitPrecisionGauge(name.parts(), val, labels)
+}
+
+// IncrCounterName increments a counter declared with RegisterName.
+func (m *Metrics) IncrCounterName(name MetricName, val float32, labels []Label) {
+	m.emitCounter(name.parts(), val, labels)
+}
+
+// AddSampleName adds a sample to a metric declared with RegisterName.
+func (m *Metrics) AddSampleName(name MetricName, val float32, labels []Label) {
+	m.emitSample(name.parts(), val, labels)
+}
+
+// AddHistogramName records an observation of a histogram declared with
+// RegisterName.
+func (m *Metrics) AddHistogramName(name MetricName, val float64, labels []Label) {
+	m.emitHistogram(name.parts(), val, labels)
+}
+
+// MeasureSinceName records the time elapsed since start as a sample of a
+// metric declared with RegisterName.
+func (m *Metrics) MeasureSinceName(name MetricName, start time.Time, labels []Label) {
+	m.emitMeasureSince(name.parts(), start, labels)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// resetNames empties the process wide name registry once the test is done,
+// so tests registering fixed names can run repeatedly.
+func resetNames(t *testing.T) {
+	t.Cleanup(func() {
+		nameRegistry.Lock()
+		nameRegistry.names = make(map[string]struct{})
+		nameRegistry.Unlock()
+	})
+}
+
+func TestRegisterName(t *testing.T) {
+	resetNames(t)
+	name, err := RegisterName("test", "register", "name")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, want := name.Key(), []string{"test", "register", "name"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if name.String() != "test.register.name" {
+		t.Fatalf("bad string: %s", name)
+	}
+
+	// Mutating the returned key must not affect the name
+	name.Key()[0] = "other"
+	if name.Key()[0] != "test" {
+		t.Fatalf("key was mutated")
+	}
+
+	if _, err := RegisterName("test", "register", "name"); err == nil {
+		t.Fatalf("expected duplicate error")
+	}
+	for _, parts := range [][]string{nil, {"test", ""}, {"test", "has space"}, {"test.dotted"}} {
+		if _, err := RegisterName(parts...); err == nil {
+			t.Fatalf("expected error for %q", parts)
+		}
+	}
+}
+
+func TestMustRegisterName_Panics(t *testing.T) {
+	resetNames(t)
+	MustRegisterName("test", "must", "register")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic")
+		}
+	}()
+	MustRegisterName("test", "must", "register")
+}
+
+func TestMetrics_StrictNames(t *testing.T) {
+	resetNames(t)
+	name := MustRegisterName("test", "strict", "known")
+
+	m, met := mockMetric()
+	met.StrictNames = true
+	met.ServiceName = "service"
+	met.IncrCounterName(name, 1, nil)
+	met.IncrCounter(name.Key(), 1)
+	met.IncrCounter([]string{"test", "strict", "knwon"}, 1)
+	met.SetGauge([]string{"test", "strict", "knwon"}, 1)
+	met.SetGauge([]string{"runtime", "num_goroutines"}, 1)
+	met.MeasureSinceName(name, time.Now(), []Label{{"a", "b"}})
+
+	keys := m.getKeys()
+	if len(keys) != 3 {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if got, want := keys[0], []string{"service", "test", "strict", "known"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got, want := keys[2], []string{"service", "test", "strict", "known"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if name.Key()[0] != "test" {
+		t.Fatalf("name was mutated: %v", name)
+	}
+}
+
+func TestRegisterName_Builtin(t *testing.T) {
+	resetNames(t)
+	// The names of the library's own runtime metrics are not taken
+	name := MustRegisterName("runtime", "num_goroutines")
+
+	m, met := mockMetric()
+	met.StrictNames = true
+	met.SetGaugeName(name, 1, nil)
+	if keys := m.getKeys(); len(keys) != 1 {
+		t.Fatalf("bad keys: %v", keys)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// nanoTimerInterval is used when no flush interval is given to
+	// NewNanoTimer
+	nanoTimerInterval = 10 * time.Second
+
+	// nanoTimerSubBits is the number of bits below the leading one kept by
+	// each bucket, giving 16 buckets per power of two and a relative error
+	// below 3.2% for every reported quantile
+	nanoTimerSubBits    = 4
+	nanoTimerSubBuckets = 1 << nanoTimerSubBits
+	nanoTimerBuckets    = (64 - nanoTimerSubBits + 1) * nanoTimerSubBuckets
+)
+
+// nanoTimerQuantiles are emitted as gauges on every flush
+var nanoTimerQuantiles = []struct {
+	name string
+	q    float64
+}{
+	{"p50", 0.5},
+	{"p90", 0.9},
+	{"p99", 0.99},
+}
+
+// NanoTimer measures very short operations, such as lock hold times, at
+// nanosecond resolution. MeasureSince reports these as samples of a few
+// thousandths of a millisecond or zero, and sending one sample per
+// operation is expensive on hot paths. A NanoTimer instead records each
+// duration into log-linear buckets in memory with a handful of atomic
+// operations, and emits the aggregated histogram once per flush interval:
+//
+//	<key>.count  counter of observations in the interval
+//	<key>.mean   gauge of the mean duration
+//	<key>.p50    gauges of the quantiles, within 3.2% of the exact value
+//	<key>.p90
+//	<key>.p99
+//	<key>.max    gauge of the exact longest duration
+//
+// Durations are emitted as precision gauges in units of the timer
+// granularity of the Metrics instance, so sub-millisecond values keep their
+// fractional part. Nothing is emitted for intervals without observations.
+type NanoTimer struct {
+	m      *Metrics
+	key    []string
+	labels []Label
+	loop   *flushLoop
+
+	// global is set for timers of the global instance, which record and
+	// emit nothing while SetGlobalDisabled is in effect. It is atomic as
+	// the flush loop is already running when it is set.
+	global atomic.Bool
+
+	stopOnce sync.Once
+
+	buckets [nanoTimerBuckets]atomic.Uint64
+	sum     atomic.Uint64
+	max     atomic.Uint64
+}
+
+// NewNanoTimer creates a NanoTimer for key which emits through this Metrics
+// instance every interval, or every 10 seconds when interval is not
+// positive. Stop must be called to release the timer.
+func (m *Metrics) NewNanoTimer(key []string, interval time.Duration, labels ...Label) *NanoTimer {
+	if interval <= 0 {
+		interval = nanoTimerInterval
+	}
+	t := &NanoTimer{
+		m:      m,
+		key:    key,
+		labels: append([]Label(nil), labels...),
+	}
+	granularity := m.timerGranularity()
+	for _, name := range []string{"mean", "p50", "p90", "p99", "max"} {
+		m.RegisterUnit(t.subKey(name), durationUnit(granularity))
+	}
+	t.loop = startFlushLoop(interval, func(time.Time, bool) { t.Flush() })
+	return t
+}
+
+// Observe records a duration. Negative durations are recorded as zero.
+func (t *NanoTimer) Observe(d time.Duration) {
+	if t.global.Load() && globalDisabled.Load() {
+		return
+	}
+	var ns uint64
+	if d > 0 {
+		ns = uint64(d)
+	}
+	t.buckets[nanoBucket(ns)].Add(1)
+	t.sum.Add(ns)
+	for {
+		cur := t.max.Load()
+		if ns <= cur || t.max.CompareAndSwap(cur, ns) {
+			return
+		}
+	}
+}
+
+// ObserveSince records the time elapsed since start.
+func (t *NanoTimer) ObserveSince(start time.Time) {
+	t.Observe(time.Since(start))
+}
+
+// Flush emits everything observed since the last flush. It is called by the
+// flush loop, but can also be called directly, for example before exiting.
+func (t *NanoTimer) Flush() {
+	var counts [nanoTimerBuckets]uint64
+	var total uint64
+	for i := range t.buckets {
+		counts[i] = t.buckets[i].Swap(0)
+		total += counts[i]
+	}
+	sum := t.sum.Swap(0)
+	longest := t.max.Swap(0)
+	if total == 0 || t.global.Load() && globalDisabled.Load() {
+		return
+	}
+
+	granularity := t.m.TimerGranularity
+	if granularity <= 0 {
+		granularity = time.Millisecond
+	}
+	scale := func(ns float64) float64 {
+		return ns / float64(granularity)
+	}
+	// Cap the labels so that host and service labels appended downstream
+	// never write into the shared backing array.
+	labels := t.labels[:len(t.labels):len(t.labels)]
+
+	t.m.IncrCounterWithLabels(t.subKey("count"), float32(total), labels)
+	t.m.SetPrecisionGaugeWithLabels(t.subKey("mean"), scale(float64(sum)/float64(total)), labels)
+	for _, nq := range nanoTimerQuantiles {
+		ns := nanoQuantile(&counts, total, nq.q)
+		// Observations racing with the swaps above can push the estimate
+		// of the top bucket past the maximum
+		if ns > float64(longest) {
+			ns = float64(longest)
+		}
+		t.m.SetPrecisionGaugeWithLabels(t.subKey(nq.name), scale(ns), labels)
+	}
+	t.m.SetPrecisionGaugeWithLabels(t.subKey("max"), scale(float64(longest)), labels)
+}
+
+// Stop ends the flush loop after a final flush. Observations made after Stop
+// are never emitted.
+func (t *NanoTimer) Stop() {
+	t.stopOnce.Do(t.loop.stop)
+}
+
+func (t *NanoTimer) subKey(name string) []string {
+	key := make([]string, len(t.key), len(t.key)+1)
+	copy(key, t.key)
+	return append(key, name)
+}
+
+// nanoBucket returns the bucket of a duration in nanoseconds. Values below
+// 32 have a bucket each, above that every power of two is split into
+// nanoTimerSubBuckets buckets of equal width.
+func nanoBucket(ns uint64) int {
+	if ns < nanoTimerSubBuckets {
+		return int(ns)
+	}
+	shift := bits.Len64(ns) - nanoTimerSubBits - 1
+	return (shift+1)*nanoTimerSubBuckets + int(ns>>shift) - nanoTimerSubBuckets
+}
+
+// nanoBucketMidpoint returns the middle of the range of durations falling
+// into bucket i.
+func nanoBucketMidpoint(i int) float64 {
+	if i < nanoTimerSubBuckets {
+		return float64(i)
+	}
+	shift := i/nanoTimerSubBuckets - 1
+	lower := uint64(i%nanoTimerSubBuckets+nanoTimerSubBuckets) << shift
+	width := uint64(1) << shift
+	return float64(lower) + float64(width-1)/2
+}
+
+// nanoQuantile estimates quantile q from bucket counts adding up to total.
+func nanoQuantile(counts *[nanoTimerBuckets]uint64, total uint64, q float64) float64 {
+	rank := uint64(q*float64(total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range counts {
+		seen += c
+		if seen >= rank {
+			return nanoBucketMidpoint(i)
+		}
+	}
+	return nanoBucketMidpoint(nanoTimerBuckets - 1)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNanoBucket(t *testing.T) {
+	prev := -1
+	for _, ns := range []uint64{0, 1, 15, 16, 31, 32, 33, 34, 63, 64, 1000, 1 << 40, math.MaxUint64} {
+		b := nanoBucket(ns)
+		if b < prev || b >= nanoTimerBuckets {
+			t.Fatalf("bad bucket %d for %d", b, ns)
+		}
+		prev = b
+
+		mid := nanoBucketMidpoint(b)
+		if err := math.Abs(mid-float64(ns)) / math.Max(float64(ns), 1); err > 1.0/32 {
+			t.Fatalf("bad midpoint %f for %d", mid, ns)
+		}
+	}
+	for ns := uint64(0); ns < 32; ns++ {
+		if nanoBucketMidpoint(nanoBucket(ns)) != float64(ns) {
+			t.Fatalf("expected exact bucket for %d", ns)
+		}
+	}
+}
+
+func TestNanoTimer(t *testing.T) {
+	m, met := mockMetric()
+	met.TimerGranularity = time.Microsecond
+
+	timer := met.NewNanoTimer([]string{"lock", "hold"}, time.Hour, Label{"lock", "state"})
+	defer timer.Stop()
+
+	// 1..100 microseconds, which MeasureSince in milliseconds rounds away
+	for i := 1; i <= 100; i++ {
+		timer.Observe(time.Duration(i) * time.Microsecond)
+	}
+	if len(m.getKeys()) != 0 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+
+	timer.Flush()
+	keys := m.getKeys()
+	expected := [][]string{
+		{"lock", "hold", "count"},
+		{"lock", "hold", "mean"},
+		{"lock", "hold", "p50"},
+		{"lock", "hold", "p90"},
+		{"lock", "hold", "p99"},
+		{"lock", "hold", "max"},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("got %v want %v", keys, expected)
+	}
+	if m.vals[0] != 100 {
+		t.Fatalf("bad count: %v", m.vals)
+	}
+	want := []float64{50.5, 50, 90, 99, 100}
+	for i, v := range m.precisionVals {
+		if math.Abs(v-want[i])/want[i] > 1.0/32 {
+			t.Fatalf("bad value for %v: got %f want %f", keys[i+1], v, want[i])
+		}
+	}
+	if m.precisionVals[4] != 100 {
+		t.Fatalf("expected exact max, got %f", m.precisionVals[4])
+	}
+	for _, l := range m.labels {
+		if !reflect.DeepEqual(l, []Label{{"lock", "state"}}) {
+			t.Fatalf("bad labels: %v", l)
+		}
+	}
+
+	// Empty intervals emit nothing
+	timer.Flush()
+	if len(m.getKeys()) != len(expected) {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+}
+
+func TestNanoTimer_Stop(t *testing.T) {
+	m, met := mockMetric()
+
+	timer := met.NewNanoTimer([]string{"fast"}, time.Hour)
+	timer.Observe(250 * time.Nanosecond)
+	timer.Stop()
+	timer.Stop()
+
+	keys := m.getKeys()
+	if len(keys) != 6 {
+		t.Fatalf("expected a final flush, got %v", keys)
+	}
+	// Timer granularity defaults to milliseconds, keeping the fraction
+	if longest := m.precisionVals[4]; longest != 0.00025 {
+		t.Fatalf("bad max: %f", longest)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// natsSubject is used when NATSOpts.Subject is not set
+	natsSubject = "metrics"
+
+	// natsFlushInterval is used when NATSOpts.FlushInterval is not set
+	natsFlushInterval = time.Second
+
+	// natsPublishTimeout is used when NATSOpts.PublishTimeout is not set
+	natsPublishTimeout = 5 * time.Second
+)
+
+// NATSMessage is a message published by a NATSSink.
+type NATSMessage struct {
+	Subject string
+	Data    []byte
+}
+
+// NATSPublisher publishes messages to NATS. It is implemented by a small
+// adapter over the NATS client already used by the application, such as
+// nats.go with Conn.Publish, or JetStream.PublishAsync for at least once
+// delivery into a stream, so this package does not depend on one. Publish
+// must only return once the messages are flushed to the server, or
+// acknowledged by the stream, or have failed.
+type NATSPublisher interface {
+	Publish(ctx context.Context, msgs []NATSMessage) error
+}
+
+// NATSOpts is used to configure a NATSSink.
+type NATSOpts struct {
+	// Publisher sends the messages, it is required
+	Publisher NATSPublisher
+
+	// Subject prefixes the subject of every event, which is followed by
+	// the key of the metric, as in "metrics.<service>.<name>" with the
+	// default prefix "metrics" and a ServiceName
+	Subject string
+
+	// FlushInterval is the longest an event is buffered, it defaults to
+	// one second
+	FlushInterval time.Duration
+
+	// QueueSize is the maximum number of buffered events, including those
+	// kept after a failed publish, beyond which events are dropped and
+	// counted in Dropped. It defaults to DefaultWorkerQueueSize.
+	QueueSize int
+
+	// PublishTimeout bounds every Publish call, it defaults to 5 seconds
+	PublishTimeout time.Duration
+
+	// OnError is called with the number of events affected when publishing
+	// fails, it defaults to logging the error
+	OnError func(err error, events int)
+}
+
+// NATSSink provides a MetricSink which publishes every metric as a JSON
+// event, in the format of KafkaJSON, to a NATS subject derived from its key.
+// Events are buffered and published asynchronously, so the caller never
+// waits on NATS, and the events of a failed publish, as while the client
+// reconnects, are kept and published again by the next flush.
+type NATSSink struct {
+	publisher NATSPublisher
+	subject   string
+	timeout   time.Duration
+	onError   func(error, int)
+	queue     *eventQueue
+
+	// publishLock serializes flushes, keeping events in order
+	publishLock sync.Mutex
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewNATSSink creates a NATSSink and starts its flush goroutine.
+func NewNATSSink(opts NATSOpts) (*NATSSink, error) {
+	if opts.Publisher == nil {
+		return nil, fmt.Errorf("nats publisher is required")
+	}
+	subject := strings.TrimSuffix(opts.Subject, ".")
+	if subject == "" {
+		subject = natsSubject
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = natsFlushInterval
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultWorkerQueueSize
+	}
+	timeout := opts.PublishTimeout
+	if timeout <= 0 {
+		timeout = natsPublishTimeout
+	}
+	onError := opts.OnError
+	if onError == nil {
+		onError = func(err error, events int) {
+			log.Printf("[ERR] Error publishing %d metrics to NATS! Err: %s", events, err)
+		}
+	}
+
+	s := &NATSSink{
+		publisher: opts.Publisher,
+		subject:   subject,
+		timeout:   timeout,
+		onError:   onError,
+		// The queue is flushed once half full, which leaves room for the
+		// events kept after a failed publish
+		queue:  newEventQueue(queueSize, max(queueSize/2, 1)),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+func (s *NATSSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *NATSSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, float64(val), labels))
+}
+
+func (s *NATSSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *NATSSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.queue.add(newMetricEvent("gauge", key, val, labels))
+}
+
+func (s *NATSSink) EmitKey(key []string, val float32) {
+	s.queue.add(newMetricEvent("key", key, float64(val), nil))
+}
+
+func (s *NATSSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *NATSSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("counter", key, float64(val), labels))
+}
+
+func (s *NATSSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *NATSSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.queue.add(newMetricEvent("sample", key, float64(val), labels))
+}
+
+// Capabilities reports what the NATS sink supports.
+func (s *NATSSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Dropped returns the number of events dropped because the queue was full.
+func (s *NATSSink) Dropped() uint64 {
+	return s.queue.droppedCount()
+}
+
+// Flush publishes all buffered events and blocks until they are published
+// or have failed.
+func (s *NATSSink) Flush() {
+	s.flush()
+}
+
+// Shutdown stops the flush goroutine and blocks while the remaining events
+// are published. The publisher is left connected.
+func (s *NATSSink) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		<-s.doneCh
+	})
+}
+
+func (s *NATSSink) run(interval time.Duration) {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(JitterInterval(interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(JitterInterval(interval))
+		case <-s.queue.kickCh:
+		case <-s.stopCh:
+			s.flush()
+			return
+		}
+		s.flush()
+	}
+}
+
+// flush publishes the buffered events, putting them back into the queue
+// when publishing fails.
+func (s *NATSSink) flush() {
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+
+	events := s.queue.take()
+	if len(events) == 0 {
+		return
+	}
+	msgs := make([]NATSMessage, len(events))
+	for i, e := range events {
+		msgs[i] = NATSMessage{Subject: s.eventSubject(e), Data: e.marshalJSON()}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	err := s.publisher.Publish(ctx, msgs)
+	cancel()
+	if err != nil {
+		s.queue.requeue(events)
+		s.onError(err, len(events))
+	}
+}
+
+// eventSubject returns the subject of an event, with a token for every part
+// of its key. Characters with a special meaning in subjects are replaced.
+func (s *NATSSink) eventSubject(e metricEvent) string {
+	var b strings.Builder
+	b.WriteString(s.subject)
+	for _, part := range e.key {
+		b.WriteByte('.')
+		if part == "" {
+			b.WriteByte('_')
+			continue
+		}
+		b.WriteString(strings.Map(natsSanitize, part))
+	}
+	return b.String()
+}
+
+func natsSanitize(r rune) rune {
+	switch r {
+	case ' ', '\t', '\r', '\n', '*', '>':
+		return '_'
+	default:
+		return r
+	}
+}
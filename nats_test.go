@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsRecorder is a NATSPublisher keeping every message, which fails while
+// err is set
+type natsRecorder struct {
+	lock sync.Mutex
+	msgs []NATSMessage
+	err  error
+}
+
+func (n *natsRecorder) Publish(ctx context.Context, msgs []NATSMessage) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("no deadline")
+	}
+	if n.err != nil {
+		return n.err
+	}
+	n.msgs = append(n.msgs, msgs...)
+	return nil
+}
+
+func (n *natsRecorder) messages() []NATSMessage {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]NATSMessage(nil), n.msgs...)
+}
+
+func TestNATSSink_Publish(t *testing.T) {
+	p := &natsRecorder{}
+	s, err := NewNATSSink(NATSOpts{Publisher: p, Subject: "telemetry.", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	s.SetPrecisionGauge([]string{"queue depth", "a>b", ""}, 2.5)
+	s.Shutdown()
+
+	msgs := p.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("bad messages %v", msgs)
+	}
+	if msgs[0].Subject != "telemetry.api.requests" {
+		t.Fatalf("bad subject %q", msgs[0].Subject)
+	}
+	if msgs[1].Subject != "telemetry.queue_depth.a_b._" {
+		t.Fatalf("bad subject %q", msgs[1].Subject)
+	}
+	var e struct {
+		Name   string
+		Type   string
+		Value  float64
+		Labels map[string]string
+	}
+	if err := json.Unmarshal(msgs[0].Data, &e); err != nil {
+		t.Fatalf("bad payload %s: %s", msgs[0].Data, err)
+	}
+	if e.Name != "api.requests" || e.Type != "counter" || e.Value != 1 || e.Labels["code"] != "200" {
+		t.Fatalf("bad event %+v", e)
+	}
+}
+
+func TestNATSSink_Retry(t *testing.T) {
+	p := &natsRecorder{err: errors.New("nats: connection closed")}
+	var failed int
+	s, err := NewNATSSink(NATSOpts{
+		Publisher:     p,
+		FlushInterval: time.Hour,
+		OnError:       func(err error, events int) { failed += events },
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounter([]string{"first"}, 1)
+	s.Flush()
+	if failed != 1 || len(p.messages()) != 0 {
+		t.Fatalf("expected the publish to fail, got %d", failed)
+	}
+
+	// The events of the failed publish are kept and published in order
+	p.lock.Lock()
+	p.err = nil
+	p.lock.Unlock()
+	s.IncrCounter([]string{"second"}, 1)
+	s.Flush()
+	msgs := p.messages()
+	if len(msgs) != 2 || msgs[0].Subject != "metrics.first" || msgs[1].Subject != "metrics.second" {
+		t.Fatalf("bad messages %v", msgs)
+	}
+}
+
+func TestNewNATSSink_Errors(t *testing.T) {
+	if _, err := NewNATSSink(NATSOpts{}); err == nil {
+		t.Fatalf("expected a missing publisher to fail")
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// NewRelicEndpoint is the Metric API endpoint for US accounts
+	NewRelicEndpoint = "https://metric-api.newrelic.com/metric/v1"
+
+	// NewRelicEUEndpoint is the Metric API endpoint for EU accounts
+	NewRelicEUEndpoint = "https://metric-api.eu.newrelic.com/metric/v1"
+
+	// newRelicFlushInterval is used when NewRelicOpts.FlushInterval is not
+	// set
+	newRelicFlushInterval = 10 * time.Second
+
+	// newRelicBatchSize is used when NewRelicOpts.BatchSize is not set,
+	// keeping requests well below the 1MB payload limit
+	newRelicBatchSize = 2000
+)
+
+// NewRelicOpts is used to configure a NewRelicSink.
+type NewRelicOpts struct {
+	// LicenseKey authenticates requests, it is required
+	LicenseKey string
+
+	// Endpoint is the Metric API URL, it defaults to NewRelicEndpoint
+	Endpoint string
+
+	// Attributes are added to every metric, such as "service.name"
+	Attributes map[string]string
+
+	// FlushInterval is how often metrics are sent, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the maximum number of metrics per request, it defaults
+	// to 2000
+	BatchSize int
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of requests, which are gzip
+	// compressed by default
+	Compression HTTPCompression
+
+	// RetryPolicy applies to failed requests, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// NewRelicSink provides a MetricSink that posts dimensional metrics to the
+// New Relic Metric API. Metrics are aggregated in memory and sent on every
+// flush interval.
+//
+// The key, joined with '.', becomes the metric name and labels become
+// attributes. Counters are sent as the "count" type over the flush interval,
+// gauges and key/value pairs as the "gauge" type, and samples as the
+// "summary" type.
+type NewRelicSink struct {
+	url        string
+	headers    http.Header
+	attributes map[string]string
+	batchSize  int
+	client     *http.Client
+	encoder    *HTTPEncoder
+	retry      RetryPolicy
+
+	// last is the end of the previous interval, only used from the flush
+	// loop
+	last time.Time
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewNewRelicSink creates a NewRelicSink and starts its flush loop.
+func NewNewRelicSink(opts NewRelicOpts) (*NewRelicSink, error) {
+	if opts.LicenseKey == "" {
+		return nil, fmt.Errorf("new relic license key is required")
+	}
+	endpoint := opts.Endpoint
+	if endpoint == "" {
+		endpoint = NewRelicEndpoint
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = newRelicFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = newRelicBatchSize
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+	encoder, err := NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Api-Key", opts.LicenseKey)
+
+	s := &NewRelicSink{
+		url:        endpoint,
+		headers:    headers,
+		attributes: opts.Attributes,
+		batchSize:  batchSize,
+		loop:       newFlushLoop(interval),
+		client:     client,
+		encoder:    encoder,
+		retry:      retry,
+		last:       time.Now(),
+		agg:        newIntervalAggregator(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *NewRelicSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *NewRelicSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *NewRelicSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *NewRelicSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *NewRelicSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *NewRelicSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the New Relic sink supports.
+func (s *NewRelicSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// sent.
+func (s *NewRelicSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *NewRelicSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *NewRelicSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error sending to New Relic! Err: %s", err)
+	}
+}
+
+// newRelicPayload is one element of a Metric API request body
+type newRelicPayload struct {
+	Common  newRelicCommon   `json:"common"`
+	Metrics []newRelicMetric `json:"metrics"`
+}
+
+type newRelicCommon struct {
+	Timestamp  int64             `json:"timestamp"`
+	IntervalMS int64             `json:"interval.ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type newRelicMetric struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      interface{}       `json:"value"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type newRelicSummary struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// flush sends everything aggregated since the last flush in batches. The
+// interval covered by counters and summaries runs from the previous flush
+// to now.
+func (s *NewRelicSink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	common := newRelicCommon{
+		Timestamp:  s.last.UnixMilli(),
+		IntervalMS: now.Sub(s.last).Milliseconds(),
+		Attributes: s.attributes,
+	}
+	s.last = now
+	if len(aggs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	metrics := s.metrics(aggs)
+	for len(metrics) > 0 {
+		n := min(len(metrics), s.batchSize)
+		body, err := json.Marshal([]newRelicPayload{{Common: common, Metrics: metrics[:n]}})
+		if err != nil {
+			return err
+		}
+		err = s.retry.Do(ctx, "New Relic", func() error {
+			resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, s.headers)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = resp.Body.Close() }()
+			return CheckHTTPResponse(resp)
+		})
+		if err != nil {
+			return err
+		}
+		metrics = metrics[n:]
+	}
+	return nil
+}
+
+// metrics converts aggregates into Metric API metrics.
+func (s *NewRelicSink) metrics(aggs []*aggregate) []newRelicMetric {
+	out := make([]newRelicMetric, 0, len(aggs))
+	for _, a := range aggs {
+		m := newRelicMetric{Name: strings.Join(a.key, ".")}
+		if len(a.labels) > 0 {
+			m.Attributes = make(map[string]string, len(a.labels))
+			for _, l := range a.labels {
+				m.Attributes[l.Name] = l.Value
+			}
+		}
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			m.Type, m.Value = "gauge", a.last
+		case aggregateCounter:
+			m.Type, m.Value = "count", a.sum
+		case aggregateSample:
+			m.Type, m.Value = "summary", newRelicSummary{Count: a.count, Sum: a.sum, Min: a.min, Max: a.max}
+		}
+		out = append(out, m)
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewRelicSink(t *testing.T) {
+	var payloads [][]newRelicPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Api-Key") != "secret" || r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("bad request: %v", r.Header)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		var p []newRelicPayload
+		if err := json.NewDecoder(zr).Decode(&p); err != nil {
+			t.Errorf("bad body: %s", err)
+		}
+		payloads = append(payloads, p)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	s, err := NewNewRelicSink(NewRelicOpts{
+		LicenseKey:    "secret",
+		Endpoint:      srv.URL,
+		Attributes:    map[string]string{"service.name": "api"},
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.last = time.Unix(1700000000, 0)
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 4)
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+	if err := s.flush(time.Unix(1700000010, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(payloads) != 2 {
+		t.Fatalf("expected two batches, got %d", len(payloads))
+	}
+
+	common := payloads[0][0].Common
+	if common.Timestamp != 1700000000000 || common.IntervalMS != 10000 || common.Attributes["service.name"] != "api" {
+		t.Fatalf("bad common block: %#v", common)
+	}
+
+	got := make(map[string]newRelicMetric)
+	for _, p := range payloads {
+		for _, m := range p[0].Metrics {
+			got[m.Name] = m
+		}
+	}
+	if m := got["requests"]; m.Type != "count" || m.Value != float64(5) || m.Attributes["code"] != "200" {
+		t.Fatalf("bad counter: %#v", m)
+	}
+	if m := got["queue.depth"]; m.Type != "gauge" || m.Value != float64(4) {
+		t.Fatalf("bad gauge: %#v", m)
+	}
+	summary := got["latency"].Value.(map[string]interface{})
+	if got["latency"].Type != "summary" || summary["count"] != float64(2) || summary["sum"] != float64(40) ||
+		summary["min"] != float64(10) || summary["max"] != float64(30) {
+		t.Fatalf("bad summary: %#v", got["latency"])
+	}
+
+	// Empty intervals are not sent, but still move the interval start
+	if err := s.flush(time.Unix(1700000020, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(payloads) != 2 || !s.last.Equal(time.Unix(1700000020, 0)) {
+		t.Fatalf("unexpected request for an empty interval")
+	}
+}
+
+func TestNewNewRelicSink_Errors(t *testing.T) {
+	if _, err := NewNewRelicSink(NewRelicOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	s, err := NewNewRelicSink(NewRelicOpts{LicenseKey: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.url != NewRelicEndpoint {
+		t.Fatalf("bad url %s", s.url)
+	}
+}
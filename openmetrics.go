@@ -0,0 +1,234 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openMetricsExpiration is used when OpenMetricsOpts.Expiration is not set,
+// matching the default of the Prometheus sink
+const openMetricsExpiration = 60 * time.Second
+
+// Content types served by the OpenMetricsSink
+const (
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	promTextContentType    = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// OpenMetricsOpts is used to configure an OpenMetricsSink.
+type OpenMetricsOpts struct {
+	// Expiration is how long a series is exposed after it was last
+	// updated, it defaults to 60 seconds and a negative value keeps series
+	// forever
+	Expiration time.Duration
+}
+
+// OpenMetricsSink provides a MetricSink which serves metrics for Prometheus
+// to scrape, without depending on the Prometheus client library. The sink is
+// an http.Handler responding in the OpenMetrics text format, or in the
+// Prometheus text format to scrapers which do not ask for OpenMetrics:
+//
+//	http.Handle("/metrics", metrics.NewOpenMetricsSink(metrics.OpenMetricsOpts{}))
+//
+// Gauges and key/value pairs report their last value. Counters are exposed
+// as cumulative _total series and samples as summaries with cumulative
+// _count and _sum series, as with the M3Sink. Series which have not
+// been updated within the expiration are dropped.
+type OpenMetricsSink struct {
+	expiration time.Duration
+	now        func() time.Time
+
+	agg *intervalAggregator
+
+	// lock guards the state merged on every scrape
+	lock       sync.Mutex
+	cumulative *cumulativeSeries
+	state      map[string]openMetricsEntry
+	types      map[string]int
+}
+
+// openMetricsEntry is the latest value of a series and when it was updated
+type openMetricsEntry struct {
+	series  remoteWriteSeries
+	updated time.Time
+}
+
+// NewOpenMetricsSink creates an OpenMetricsSink.
+func NewOpenMetricsSink(opts OpenMetricsOpts) *OpenMetricsSink {
+	expiration := opts.Expiration
+	if expiration == 0 {
+		expiration = openMetricsExpiration
+	}
+	return &OpenMetricsSink{
+		expiration: expiration,
+		now:        time.Now,
+		agg:        newIntervalAggregator(),
+		cumulative: newCumulativeSeries(),
+		state:      make(map[string]openMetricsEntry),
+		types:      make(map[string]int),
+	}
+}
+
+func (s *OpenMetricsSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *OpenMetricsSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *OpenMetricsSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *OpenMetricsSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *OpenMetricsSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *OpenMetricsSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *OpenMetricsSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+// RestoreCounters seeds the cumulative totals from a counter checkpoint, see
+// CumulativeSink.
+func (s *OpenMetricsSink) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	s.agg.restore(counters)
+}
+
+func (s *OpenMetricsSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *OpenMetricsSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the OpenMetrics sink supports.
+func (s *OpenMetricsSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Tags: true}
+}
+
+// ServeHTTP responds to a scrape with the current state of the sink.
+func (s *OpenMetricsSink) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		http.Error(resp, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	series, meta := s.collect()
+	var body []byte
+	if strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+		resp.Header().Set("Content-Type", openMetricsContentType)
+		body = encodeOpenMetrics(series, meta)
+	} else {
+		resp.Header().Set("Content-Type", promTextContentType)
+		body = encodePromText(series, meta, promNoTimestamp)
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if req.Method == http.MethodGet {
+		_, _ = resp.Write(body)
+	}
+}
+
+// collect merges everything aggregated since the last scrape into the state
+// of the sink, drops expired series and returns the remaining ones sorted.
+func (s *OpenMetricsSink) collect() ([]remoteWriteSeries, []remoteWriteMetadata) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	series, meta := s.cumulative.convert(s.agg.drain())
+	for _, ser := range series {
+		s.state[seriesKey(nil, ser.labels)] = openMetricsEntry{series: ser, updated: now}
+	}
+	for _, m := range meta {
+		s.types[m.name] = m.typ
+	}
+
+	ids := make([]string, 0, len(s.state))
+	for id, entry := range s.state {
+		if s.expiration > 0 && now.Sub(entry.updated) > s.expiration {
+			// Expired counters start again from zero if they return
+			delete(s.state, id)
+			delete(s.cumulative.totals, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	series = make([]remoteWriteSeries, 0, len(ids))
+	for _, id := range ids {
+		series = append(series, s.state[id].series)
+	}
+	meta = make([]remoteWriteMetadata, 0, len(s.types))
+	for name, typ := range s.types {
+		meta = append(meta, remoteWriteMetadata{name: name, typ: typ})
+	}
+	return series, meta
+}
+
+// encodeOpenMetrics renders series in the OpenMetrics text format. Unlike
+// the Prometheus format, counter families are named without their _total
+// suffix and the exposition ends with an EOF marker.
+func encodeOpenMetrics(series []remoteWriteSeries, meta []remoteWriteMetadata) []byte {
+	types := make(map[string]int, len(meta))
+	for _, m := range meta {
+		types[m.name] = m.typ
+	}
+
+	// Group the series of each family, which must be contiguous
+	families := make(map[string][]remoteWriteSeries)
+	familyTypes := make(map[string]int)
+	var names []string
+	for _, s := range series {
+		name, _ := splitPromName(s.labels)
+		family := name
+		typ, ok := types[name]
+		if !ok {
+			family = strings.TrimSuffix(strings.TrimSuffix(name, "_count"), "_sum")
+			typ = types[family]
+		}
+		if typ == remoteWriteCounter {
+			family = strings.TrimSuffix(family, "_total")
+		}
+		if _, ok := families[family]; !ok {
+			names = append(names, family)
+			familyTypes[family] = typ
+		}
+		families[family] = append(families[family], s)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, family := range names {
+		typ, ok := promTextTypes[familyTypes[family]]
+		if !ok {
+			typ = "unknown"
+		}
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", family, typ)
+		for _, s := range families[family] {
+			writePromSeries(&buf, s)
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,110 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func scrapeOpenMetrics(t *testing.T, s *OpenMetricsSink, accept string) (string, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bad status %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Header().Get("Content-Type"), string(body)
+}
+
+func TestOpenMetricsSink(t *testing.T) {
+	s := NewOpenMetricsSink(OpenMetricsOpts{})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	s.AddSample([]string{"api", "latency"}, 10)
+
+	typ, body := scrapeOpenMetrics(t, s, "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	if typ != openMetricsContentType {
+		t.Fatalf("bad content type %s", typ)
+	}
+	want := "# TYPE api_latency summary\n" +
+		"api_latency_count 1\n" +
+		"api_latency_sum 10\n" +
+		"# TYPE api_requests counter\n" +
+		"api_requests_total{code=\"200\"} 2\n" +
+		"# TYPE queue_depth gauge\n" +
+		"queue_depth 7\n" +
+		"# EOF\n"
+	if body != want {
+		t.Fatalf("bad body\n%s", body)
+	}
+
+	// Counters and samples keep accumulating across scrapes
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 3, []Label{{"code", "200"}})
+	s.AddSample([]string{"api", "latency"}, 20)
+	typ, body = scrapeOpenMetrics(t, s, "")
+	if typ != promTextContentType {
+		t.Fatalf("bad content type %s", typ)
+	}
+	want = "# TYPE api_latency summary\n" +
+		"api_latency_count 2\n" +
+		"api_latency_sum 30\n" +
+		"# TYPE api_requests_total counter\n" +
+		"api_requests_total{code=\"200\"} 5\n" +
+		"# TYPE queue_depth gauge\n" +
+		"queue_depth 7\n"
+	if body != want {
+		t.Fatalf("bad body\n%s", body)
+	}
+}
+
+func TestOpenMetricsSink_Expiration(t *testing.T) {
+	s := NewOpenMetricsSink(OpenMetricsOpts{Expiration: time.Minute})
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	s.IncrCounter([]string{"old"}, 1)
+	scrapeOpenMetrics(t, s, "")
+	now = now.Add(30 * time.Second)
+	s.IncrCounter([]string{"new"}, 1)
+	scrapeOpenMetrics(t, s, "")
+
+	now = now.Add(45 * time.Second)
+	_, body := scrapeOpenMetrics(t, s, "application/openmetrics-text")
+	want := "# TYPE new counter\n" +
+		"new_total 1\n" +
+		"# EOF\n"
+	if body != want {
+		t.Fatalf("bad body\n%s", body)
+	}
+
+	// An expired counter starts again from zero
+	s.IncrCounter([]string{"old"}, 1)
+	_, body = scrapeOpenMetrics(t, s, "application/openmetrics-text")
+	want = "# TYPE new counter\n" +
+		"new_total 1\n" +
+		"# TYPE old counter\n" +
+		"old_total 1\n" +
+		"# EOF\n"
+	if body != want {
+		t.Fatalf("bad body\n%s", body)
+	}
+}
+
+func TestOpenMetricsSink_Method(t *testing.T) {
+	s := NewOpenMetricsSink(OpenMetricsOpts{})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+		t.Fatalf("bad response %d %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
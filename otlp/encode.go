@@ -0,0 +1,192 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package otlp
+
+import (
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages below are encoded by hand with protowire, following
+// opentelemetry/proto/collector/metrics/v1/metrics_service.proto, which
+// avoids depending on the generated OpenTelemetry packages.
+
+// attribute is a string KeyValue
+type attribute struct {
+	key   string
+	value string
+}
+
+// dataPoint is a single exported value of a series. For samples and
+// histograms value holds the sum.
+type dataPoint struct {
+	series  *series
+	start   time.Time
+	time    time.Time
+	value   float64
+	count   uint64
+	buckets []uint64
+}
+
+// instrumentationScope names this library as the producer of the metrics
+const instrumentationScope = "github.com/hashicorp/go-metrics"
+
+// OTLP AggregationTemporality values
+const (
+	temporalityDelta      = 1
+	temporalityCumulative = 2
+)
+
+// encodeExportRequest encodes an ExportMetricsServiceRequest holding a
+// single ResourceMetrics. Points of the same series kind and name, which are
+// adjacent, are grouped in one Metric.
+func encodeExportRequest(resource []attribute, points []dataPoint, t Temporality) []byte {
+	var res []byte
+	for _, a := range resource {
+		res = appendMessage(res, 1, appendKeyValue(nil, a))
+	}
+
+	var scope []byte
+	scope = appendMessage(scope, 1, protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), instrumentationScope))
+	for i := 0; i < len(points); {
+		j := i + 1
+		for j < len(points) && points[j].series.kind == points[i].series.kind && points[j].series.name == points[i].series.name {
+			j++
+		}
+		scope = appendMessage(scope, 2, encodeMetric(points[i:j], t))
+		i = j
+	}
+
+	var rm []byte
+	rm = appendMessage(rm, 1, res)
+	rm = appendMessage(rm, 2, scope)
+
+	return appendMessage(nil, 1, rm)
+}
+
+// encodeMetric encodes a Metric holding points of a single series kind.
+func encodeMetric(points []dataPoint, t Temporality) []byte {
+	var m []byte
+	m = protowire.AppendTag(m, 1, protowire.BytesType)
+	m = protowire.AppendString(m, points[0].series.name)
+
+	temporality := temporalityCumulative
+	if t == Delta {
+		temporality = temporalityDelta
+	}
+
+	var data []byte
+	switch points[0].series.kind {
+	case "gauge":
+		for _, p := range points {
+			data = appendMessage(data, 1, encodeNumberPoint(p, false))
+		}
+		return appendMessage(m, 5, data)
+	case "counter":
+		for _, p := range points {
+			data = appendMessage(data, 1, encodeNumberPoint(p, true))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(temporality))
+		data = protowire.AppendTag(data, 3, protowire.VarintType)
+		data = protowire.AppendVarint(data, 1)
+		return appendMessage(m, 7, data)
+	case "histogram":
+		for _, p := range points {
+			data = appendMessage(data, 1, encodeHistogramPoint(p, t))
+		}
+		data = protowire.AppendTag(data, 2, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(temporality))
+		return appendMessage(m, 9, data)
+	default:
+		for _, p := range points {
+			data = appendMessage(data, 1, encodeSummaryPoint(p))
+		}
+		return appendMessage(m, 11, data)
+	}
+}
+
+// encodeNumberPoint encodes a NumberDataPoint, with a start time for sums.
+func encodeNumberPoint(p dataPoint, withStart bool) []byte {
+	var b []byte
+	if withStart {
+		b = appendFixed64(b, 2, uint64(p.start.UnixNano()))
+	}
+	b = appendFixed64(b, 3, uint64(p.time.UnixNano()))
+	b = appendFixed64(b, 4, math.Float64bits(p.value))
+	return appendAttributes(b, 7, p.series.attrs)
+}
+
+// encodeSummaryPoint encodes a SummaryDataPoint, with the minimum and
+// maximum of the interval as the 0 and 1 quantiles.
+func encodeSummaryPoint(p dataPoint) []byte {
+	var b []byte
+	b = appendFixed64(b, 2, uint64(p.start.UnixNano()))
+	b = appendFixed64(b, 3, uint64(p.time.UnixNano()))
+	b = appendFixed64(b, 4, p.count)
+	b = appendFixed64(b, 5, math.Float64bits(p.value))
+	for _, q := range [][2]float64{{0, p.series.min}, {1, p.series.max}} {
+		var vq []byte
+		vq = appendFixed64(vq, 1, math.Float64bits(q[0]))
+		vq = appendFixed64(vq, 2, math.Float64bits(q[1]))
+		b = appendMessage(b, 6, vq)
+	}
+	return appendAttributes(b, 7, p.series.attrs)
+}
+
+// encodeHistogramPoint encodes a HistogramDataPoint with explicit bounds.
+// The minimum and maximum are only set with delta temporality, as they are
+// not tracked since the sink was created.
+func encodeHistogramPoint(p dataPoint, t Temporality) []byte {
+	var b []byte
+	b = appendFixed64(b, 2, uint64(p.start.UnixNano()))
+	b = appendFixed64(b, 3, uint64(p.time.UnixNano()))
+	b = appendFixed64(b, 4, p.count)
+	b = appendFixed64(b, 5, math.Float64bits(p.value))
+
+	var counts, bounds []byte
+	for _, c := range p.buckets {
+		counts = protowire.AppendFixed64(counts, c)
+	}
+	for _, bound := range p.series.bounds {
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(bound))
+	}
+	b = appendMessage(b, 6, counts)
+	b = appendMessage(b, 7, bounds)
+	b = appendAttributes(b, 9, p.series.attrs)
+	if t == Delta {
+		b = appendFixed64(b, 11, math.Float64bits(p.series.min))
+		b = appendFixed64(b, 12, math.Float64bits(p.series.max))
+	}
+	return b
+}
+
+func appendAttributes(b []byte, num protowire.Number, attrs []attribute) []byte {
+	for _, a := range attrs {
+		b = appendMessage(b, num, appendKeyValue(nil, a))
+	}
+	return b
+}
+
+// appendKeyValue encodes a KeyValue with a string AnyValue.
+func appendKeyValue(b []byte, a attribute) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, a.key)
+	var v []byte
+	v = protowire.AppendTag(v, 1, protowire.BytesType)
+	v = protowire.AppendString(v, a.value)
+	return appendMessage(b, 2, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
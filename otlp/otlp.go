@@ -0,0 +1,426 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package otlp provides a sink exporting to an OpenTelemetry collector, or
+// any other receiver of the OTLP/HTTP metrics protocol.
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+const (
+	// defaultExportInterval is used when OTLPOpts.ExportInterval is not set
+	defaultExportInterval = 10 * time.Second
+
+	// metricsPath is the OTLP/HTTP metrics endpoint
+	metricsPath = "/v1/metrics"
+)
+
+// Temporality selects how counters and sample counts are reported.
+type Temporality int
+
+const (
+	// Cumulative reports running totals since the sink was created, as
+	// expected by Prometheus compatible backends.
+	Cumulative Temporality = iota
+
+	// Delta reports the change over each export interval.
+	Delta
+)
+
+// OTLPOpts is used to configure an OTLPSink.
+type OTLPOpts struct {
+	// Endpoint is the base URL of the receiver, for example
+	// "http://otel-collector:4318". The /v1/metrics path is appended unless
+	// already present.
+	Endpoint string
+
+	// Headers are sent with every export, for example for authentication
+	Headers map[string]string
+
+	// ExportInterval is how often metrics are exported, it defaults to 10
+	// seconds
+	ExportInterval time.Duration
+
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string
+
+	// ResourceAttributes are added to the resource of every export
+	ResourceAttributes map[string]string
+
+	// LabelAttributes renames labels to attribute keys, for example "host"
+	// to "host.name" to follow the semantic conventions. Other labels are
+	// used as attribute keys as is.
+	LabelAttributes map[string]string
+
+	// Temporality of counters and sample counts, it defaults to Cumulative
+	Temporality Temporality
+
+	// HTTPClient is used for exports, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of exports, which are gzip
+	// compressed by default
+	Compression metrics.HTTPCompression
+
+	// RetryPolicy applies to failed exports, it defaults to
+	// metrics.DefaultRetryPolicy. Retries never run past the next export.
+	RetryPolicy *metrics.RetryPolicy
+
+	// HistogramBuckets configures the explicit bucket boundaries of
+	// histograms recorded with AddHistogram
+	HistogramBuckets metrics.HistogramBuckets
+}
+
+// OTLPSink provides a MetricSink that exports to an OpenTelemetry collector
+// using OTLP/HTTP with protobuf encoding. Metrics are aggregated in memory
+// and exported on every interval.
+//
+// Gauges and key/value pairs are exported as gauges holding their last
+// value, counters as monotonic sums, samples as summaries with their count,
+// sum, and minimum and maximum as the 0 and 1 quantiles, and histograms as
+// histograms with explicit bucket boundaries. Metric names
+// are the key parts joined with '.', and labels become string attributes.
+//
+// Only the HTTP transport is supported, as OTLP/gRPC would require a gRPC
+// dependency; collectors enable both by default.
+type OTLPSink struct {
+	url         string
+	headers     http.Header
+	resource    []attribute
+	labelAttrs  map[string]string
+	temporality Temporality
+	client      *http.Client
+	encoder     *metrics.HTTPEncoder
+	retry       metrics.RetryPolicy
+	buckets     metrics.HistogramBuckets
+	interval    time.Duration
+
+	lock   sync.Mutex
+	series map[string]*series
+
+	// restoredStart is the start time of restored counter totals, taken
+	// over by the export goroutine
+	restoredStart time.Time
+
+	// Only used from the export goroutine
+	startTime  time.Time
+	lastExport time.Time
+	totals     map[string]float64
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// series aggregates one metric and attribute set over an export interval
+type series struct {
+	name  string
+	attrs []attribute
+	kind  string
+	last  float64
+	sum   float64
+	count uint64
+	min   float64
+	max   float64
+
+	// bounds and buckets are the boundaries and per bucket counts of
+	// histograms, with the last bucket counting values above all bounds
+	bounds  []float64
+	buckets []uint64
+}
+
+// NewOTLPSink creates an OTLPSink and starts its export loop.
+func NewOTLPSink(opts OTLPOpts) (*OTLPSink, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("otlp endpoint is required")
+	}
+	url := strings.TrimSuffix(opts.Endpoint, "/")
+	if !strings.HasSuffix(url, metricsPath) {
+		url += metricsPath
+	}
+	interval := opts.ExportInterval
+	if interval <= 0 {
+		interval = defaultExportInterval
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	encoder, err := metrics.NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.HistogramBuckets.Validate(); err != nil {
+		return nil, err
+	}
+	retry := metrics.DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	headers := make(http.Header)
+	for name, value := range opts.Headers {
+		headers.Set(name, value)
+	}
+	headers.Set("Content-Type", "application/x-protobuf")
+
+	var resource []attribute
+	if opts.ServiceName != "" {
+		resource = append(resource, attribute{"service.name", opts.ServiceName})
+	}
+	for name, value := range opts.ResourceAttributes {
+		resource = append(resource, attribute{name, value})
+	}
+	sort.Slice(resource, func(i, j int) bool { return resource[i].key < resource[j].key })
+
+	now := time.Now()
+	s := &OTLPSink{
+		url:         url,
+		headers:     headers,
+		resource:    resource,
+		labelAttrs:  opts.LabelAttributes,
+		temporality: opts.Temporality,
+		client:      client,
+		encoder:     encoder,
+		retry:       retry,
+		buckets:     opts.HistogramBuckets,
+		interval:    interval,
+		series:      make(map[string]*series),
+		startTime:   now,
+		lastExport:  now,
+		totals:      make(map[string]float64),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Capabilities reports what the OTLP sink supports.
+func (s *OTLPSink) Capabilities() metrics.Capabilities {
+	return metrics.Capabilities{Histograms: true, PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+func (s *OTLPSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *OTLPSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("gauge", key, float64(val), labels)
+}
+
+func (s *OTLPSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *OTLPSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []metrics.Label) {
+	s.record("gauge", key, val, labels)
+}
+
+func (s *OTLPSink) EmitKey(key []string, val float32) {
+	s.record("gauge", key, float64(val), nil)
+}
+
+func (s *OTLPSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *OTLPSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("counter", key, float64(val), labels)
+}
+
+// RestoreCounters seeds the cumulative totals and their start time from a
+// counter checkpoint, see metrics.CumulativeSink. It does nothing with delta
+// temporality.
+func (s *OTLPSink) RestoreCounters(start time.Time, counters []metrics.RestoredCounter) {
+	if s.temporality == Delta {
+		return
+	}
+	for _, c := range counters {
+		s.record("counter", c.Key, c.Total, c.Labels)
+	}
+	s.lock.Lock()
+	s.restoredStart = start
+	s.lock.Unlock()
+}
+
+func (s *OTLPSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *OTLPSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("sample", key, float64(val), labels)
+}
+
+func (s *OTLPSink) AddHistogram(key []string, val float64) {
+	s.AddHistogramWithLabels(key, val, nil)
+}
+
+func (s *OTLPSink) AddHistogramWithLabels(key []string, val float64, labels []metrics.Label) {
+	s.buckets.Observe(key, val)
+	s.record("histogram", key, val, labels)
+}
+
+// Shutdown stops the export loop and blocks while the remaining metrics are
+// exported.
+func (s *OTLPSink) Shutdown() {
+	close(s.stopCh)
+	<-s.doneCh
+}
+
+func (s *OTLPSink) run() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(metrics.JitterInterval(s.interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ticker.Reset(metrics.JitterInterval(s.interval))
+			s.exportLogged(time.Now())
+		case <-s.stopCh:
+			s.exportLogged(time.Now())
+			return
+		}
+	}
+}
+
+func (s *OTLPSink) exportLogged(now time.Time) {
+	if err := s.export(now); err != nil {
+		log.Printf("[ERR] Error exporting to OTLP! Err: %s", err)
+	}
+}
+
+func (s *OTLPSink) record(kind string, key []string, val float64, labels []metrics.Label) {
+	name := strings.Join(key, ".")
+	attrs := make([]attribute, 0, len(labels))
+	for _, l := range labels {
+		k := l.Name
+		if mapped, ok := s.labelAttrs[k]; ok {
+			k = mapped
+		}
+		attrs = append(attrs, attribute{k, l.Value})
+	}
+	id := kind + "|" + name + "|" + attributesID(attrs)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ser, ok := s.series[id]
+	if !ok {
+		ser = &series{name: name, attrs: attrs, kind: kind, min: val, max: val}
+		if kind == "histogram" {
+			ser.bounds = s.buckets.For(key)
+			ser.buckets = make([]uint64, len(ser.bounds)+1)
+		}
+		s.series[id] = ser
+	}
+	if ser.buckets != nil {
+		// Buckets include their upper bound
+		ser.buckets[sort.SearchFloat64s(ser.bounds, val)]++
+	}
+	ser.last = val
+	ser.sum += val
+	ser.count++
+	if val < ser.min {
+		ser.min = val
+	}
+	if val > ser.max {
+		ser.max = val
+	}
+}
+
+// export swaps out the aggregated series and exports them. It is only called
+// from the export goroutine, which owns the cumulative state.
+func (s *OTLPSink) export(now time.Time) error {
+	s.lock.Lock()
+	pending := s.series
+	s.series = make(map[string]*series)
+	if !s.restoredStart.IsZero() {
+		s.startTime, s.restoredStart = s.restoredStart, time.Time{}
+	}
+	s.lock.Unlock()
+
+	start := s.startTime
+	if s.temporality == Delta {
+		start = s.lastExport
+	}
+	s.lastExport = now
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	points := make([]dataPoint, 0, len(ids))
+	for _, id := range ids {
+		ser := pending[id]
+		p := dataPoint{series: ser, start: start, time: now}
+		switch ser.kind {
+		case "gauge":
+			p.value = ser.last
+		case "counter":
+			p.value = s.accumulate(id, ser.sum)
+		case "sample":
+			p.count = uint64(s.accumulate(id+"|count", float64(ser.count)))
+			p.value = s.accumulate(id+"|sum", ser.sum)
+		case "histogram":
+			p.count = uint64(s.accumulate(id+"|count", float64(ser.count)))
+			p.value = s.accumulate(id+"|sum", ser.sum)
+			p.buckets = make([]uint64, len(ser.buckets))
+			for i, c := range ser.buckets {
+				p.buckets[i] = uint64(s.accumulate(id+"|bucket|"+strconv.Itoa(i), float64(c)))
+			}
+		}
+		points = append(points, p)
+	}
+
+	body := encodeExportRequest(s.resource, points, s.temporality)
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(s.interval))
+	defer cancel()
+	return s.retry.Do(ctx, "OTLP", func() error {
+		resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, s.headers)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		return metrics.CheckHTTPResponse(resp)
+	})
+}
+
+// accumulate returns the running total of a value with cumulative
+// temporality, or the value itself with delta temporality.
+func (s *OTLPSink) accumulate(id string, val float64) float64 {
+	if s.temporality == Delta {
+		return val
+	}
+	s.totals[id] += val
+	return s.totals[id]
+}
+
+func attributesID(attrs []attribute) string {
+	var b strings.Builder
+	for _, a := range attrs {
+		b.WriteString(a.key)
+		b.WriteByte('=')
+		b.WriteString(a.value)
+		b.WriteByte(';')
+	}
+	return b.String()
+}
@@ -0,0 +1,307 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package otlp
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message is a decoded protobuf message, holding the raw values of each
+// field: bytes for length delimited fields and uint64 for the others.
+type message map[protowire.Number][]interface{}
+
+func decode(t *testing.T, b []byte) message {
+	t.Helper()
+	m := make(message)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag")
+		}
+		b = b[n:]
+		var v interface{}
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d", num)
+		}
+		b = b[n:]
+		m[num] = append(m[num], v)
+	}
+	return m
+}
+
+func (m message) msg(t *testing.T, num protowire.Number, i int) message {
+	t.Helper()
+	return decode(t, m[num][i].([]byte))
+}
+
+func (m message) str(num protowire.Number) string {
+	return string(m[num][0].([]byte))
+}
+
+func (m message) float(num protowire.Number) float64 {
+	return math.Float64frombits(m[num][0].(uint64))
+}
+
+func attributes(t *testing.T, m message, num protowire.Number) map[string]string {
+	out := make(map[string]string)
+	for i := range m[num] {
+		kv := m.msg(t, num, i)
+		out[kv.str(1)] = kv.msg(t, 2, 0).str(1)
+	}
+	return out
+}
+
+func TestOTLPSink(t *testing.T) {
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Token") != "secret" {
+			t.Errorf("bad request: %s %v", r.URL.Path, r.Header)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	s, err := NewOTLPSink(OTLPOpts{
+		Endpoint:        srv.URL,
+		Headers:         map[string]string{"X-Token": "secret"},
+		ExportInterval:  time.Hour,
+		ServiceName:     "api",
+		LabelAttributes: map[string]string{"host": "host.name"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGaugeWithLabels([]string{"queue", "depth"}, 5, []metrics.Label{{Name: "host", Value: "node1"}})
+	s.IncrCounter([]string{"requests"}, 2)
+	s.IncrCounter([]string{"requests"}, 3)
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+	if err := s.export(time.Unix(100, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounter([]string{"requests"}, 1)
+	if err := s.export(time.Unix(110, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected two exports, got %d", len(bodies))
+	}
+
+	rm := decode(t, bodies[0]).msg(t, 1, 0)
+	if res := attributes(t, rm.msg(t, 1, 0), 1); res["service.name"] != "api" {
+		t.Fatalf("bad resource: %v", res)
+	}
+	scope := rm.msg(t, 2, 0)
+	if name := scope.msg(t, 1, 0).str(1); name != instrumentationScope {
+		t.Fatalf("bad scope: %s", name)
+	}
+
+	got := make(map[string]message)
+	for i := range scope[2] {
+		m := scope.msg(t, 2, i)
+		got[m.str(1)] = m
+	}
+	if len(got) != 3 {
+		t.Fatalf("bad metrics: %v", got)
+	}
+
+	gauge := got["queue.depth"].msg(t, 5, 0).msg(t, 1, 0)
+	if gauge.float(4) != 5 || attributes(t, gauge, 7)["host.name"] != "node1" {
+		t.Fatalf("bad gauge: %v", gauge)
+	}
+
+	sum := got["requests"].msg(t, 7, 0)
+	if sum[2][0].(uint64) != temporalityCumulative || sum[3][0].(uint64) != 1 {
+		t.Fatalf("bad sum: %v", sum)
+	}
+	if p := sum.msg(t, 1, 0); p.float(4) != 5 {
+		t.Fatalf("bad sum point: %v", p)
+	}
+
+	summary := got["latency"].msg(t, 11, 0).msg(t, 1, 0)
+	if summary[4][0].(uint64) != 2 || summary.float(5) != 40 {
+		t.Fatalf("bad summary: %v", summary)
+	}
+	if q := summary.msg(t, 6, 1); q.float(1) != 1 || q.float(2) != 30 {
+		t.Fatalf("bad max quantile: %v", q)
+	}
+
+	// Counters keep growing with cumulative temporality
+	sum = decode(t, bodies[1]).msg(t, 1, 0).msg(t, 2, 0).msg(t, 2, 0).msg(t, 7, 0)
+	if p := sum.msg(t, 1, 0); p.float(4) != 6 {
+		t.Fatalf("bad cumulative sum: %v", p.float(4))
+	}
+}
+
+func TestOTLPSink_RestoreCounters(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		body, _ = io.ReadAll(zr)
+	}))
+	defer srv.Close()
+
+	s, err := NewOTLPSink(OTLPOpts{Endpoint: srv.URL, ExportInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	// The restored total and start time carry on from the previous process
+	s.RestoreCounters(time.Unix(50, 0), []metrics.RestoredCounter{{Key: []string{"requests"}, Total: 7}})
+	s.IncrCounter([]string{"requests"}, 1)
+	if err := s.export(time.Unix(100, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	p := decode(t, body).msg(t, 1, 0).msg(t, 2, 0).msg(t, 2, 0).msg(t, 7, 0).msg(t, 1, 0)
+	if p.float(4) != 8 || p[2][0].(uint64) != uint64(time.Unix(50, 0).UnixNano()) {
+		t.Fatalf("bad restored point: %v %v", p.float(4), p[2])
+	}
+}
+
+func TestOTLPSink_Delta(t *testing.T) {
+	s := &OTLPSink{temporality: Delta, totals: make(map[string]float64)}
+	s.accumulate("a", 1)
+	if v := s.accumulate("a", 2); v != 2 {
+		t.Fatalf("bad delta: %v", v)
+	}
+}
+
+func TestOTLPSink_Opts(t *testing.T) {
+	if _, err := NewOTLPSink(OTLPOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+	_, err := NewOTLPSink(OTLPOpts{
+		Endpoint:         "http://collector:4318",
+		HistogramBuckets: metrics.HistogramBuckets{Default: []float64{1, math.Inf(1)}},
+	})
+	if err == nil {
+		t.Fatalf("expected invalid buckets to fail")
+	}
+	s, err := NewOTLPSink(OTLPOpts{Endpoint: "http://collector:4318/v1/metrics/"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.url != "http://collector:4318/v1/metrics" {
+		t.Fatalf("bad url: %s", s.url)
+	}
+}
+
+func TestOTLPSink_Histogram(t *testing.T) {
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	s, err := NewOTLPSink(OTLPOpts{
+		Endpoint:       srv.URL,
+		ExportInterval: time.Hour,
+		HistogramBuckets: metrics.HistogramBuckets{
+			Metrics: map[string][]float64{"response.bytes": {100, 1000}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	for _, v := range []float64{50, 100, 500, 5000} {
+		s.AddHistogramWithLabels([]string{"response", "bytes"}, v, []metrics.Label{{Name: "route", Value: "/users"}})
+	}
+	if err := s.export(time.Unix(100, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.AddHistogram([]string{"response", "bytes"}, 10)
+	s.AddHistogramWithLabels([]string{"response", "bytes"}, 10, []metrics.Label{{Name: "route", Value: "/users"}})
+	if err := s.export(time.Unix(110, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	points := func(body []byte) map[string]message {
+		m := decode(t, body).msg(t, 1, 0).msg(t, 2, 0).msg(t, 2, 0)
+		if m.str(1) != "response.bytes" {
+			t.Fatalf("bad metric: %s", m.str(1))
+		}
+		hist := m.msg(t, 9, 0)
+		if hist[2][0].(uint64) != temporalityCumulative {
+			t.Fatalf("bad temporality: %v", hist[2])
+		}
+		out := make(map[string]message)
+		for i := range hist[1] {
+			p := hist.msg(t, 1, i)
+			out[attributes(t, p, 9)["route"]] = p
+		}
+		return out
+	}
+	fixed64s := func(b []byte) []uint64 {
+		var out []uint64
+		for len(b) > 0 {
+			v, n := protowire.ConsumeFixed64(b)
+			out, b = append(out, v), b[n:]
+		}
+		return out
+	}
+
+	p := points(bodies[0])["/users"]
+	if p[4][0].(uint64) != 4 || p.float(5) != 5650 {
+		t.Fatalf("bad histogram point: %v", p)
+	}
+	if got := fixed64s(p[6][0].([]byte)); len(got) != 3 || got[0] != 2 || got[1] != 1 || got[2] != 1 {
+		t.Fatalf("bad bucket counts: %v", got)
+	}
+	if got := fixed64s(p[7][0].([]byte)); len(got) != 2 || math.Float64frombits(got[0]) != 100 || math.Float64frombits(got[1]) != 1000 {
+		t.Fatalf("bad bounds: %v", got)
+	}
+	if _, ok := p[11]; ok {
+		t.Fatalf("unexpected minimum with cumulative temporality")
+	}
+
+	// Bucket counts keep growing with cumulative temporality
+	second := points(bodies[1])
+	if got := fixed64s(second["/users"][6][0].([]byte)); got[0] != 3 || second["/users"][4][0].(uint64) != 5 {
+		t.Fatalf("bad cumulative histogram: %v", got)
+	}
+	if got := fixed64s(second[""][6][0].([]byte)); got[0] != 1 || got[1] != 0 || got[2] != 0 {
+		t.Fatalf("bad new histogram: %v", got)
+	}
+}
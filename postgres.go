@@ -0,0 +1,252 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// postgresTable, postgresInterval and postgresSampleRetention are used
+	// when the matching PostgresOpts are not set
+	postgresTable           = "metrics"
+	postgresInterval        = 10 * time.Second
+	postgresSampleRetention = 1024
+
+	// postgresTimeout bounds every flush written to Postgres
+	postgresTimeout = 30 * time.Second
+)
+
+// postgresTableName restricts table names to plain identifiers, optionally
+// qualified by a schema, as they cannot be passed as query parameters
+var postgresTableName = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*$`)
+
+// PostgresOpts is used to configure a PostgresSink.
+type PostgresOpts struct {
+	// DB is the database the intervals are stored in. It is opened by the
+	// application with a PostgreSQL driver of its choice, such as
+	// github.com/jackc/pgx/v5/stdlib or github.com/lib/pq, which handles
+	// the connection, TLS and authentication. It is not closed by the sink.
+	DB *sql.DB
+
+	// Table is the table the intervals are stored in, which is created if
+	// needed. It may be qualified by a schema, as in "telemetry.metrics",
+	// and defaults to "metrics".
+	Table string
+
+	// Hypertable turns the table into a TimescaleDB hypertable partitioned
+	// by time when it is created, which requires the timescaledb extension
+	Hypertable bool
+
+	// Interval is the length of the aggregation intervals, each of which is
+	// stored once it ended. It defaults to 10 seconds.
+	Interval time.Duration
+
+	// SampleRetention is the number of raw values kept per sample and
+	// interval to compute the percentiles, see
+	// InmemSink.EnableSampleRetention. It defaults to 1024.
+	SampleRetention int
+}
+
+// PostgresSink provides a MetricSink which stores aggregated intervals in a
+// PostgreSQL table, optionally a TimescaleDB hypertable, for teams which have
+// Postgres and nothing else. Metrics are aggregated by an embedded InmemSink,
+// and the intervals which ended since the last flush are stored together in
+// a single transaction, every series as a row of a table such as:
+//
+//	CREATE TABLE metrics (
+//		time   TIMESTAMPTZ      NOT NULL, -- start of the interval
+//		name   TEXT             NOT NULL,
+//		labels JSONB            NOT NULL,
+//		count  BIGINT           NOT NULL,
+//		sum    DOUBLE PRECISION NOT NULL,
+//		min    DOUBLE PRECISION NOT NULL,
+//		max    DOUBLE PRECISION NOT NULL,
+//		p50    DOUBLE PRECISION,
+//		p95    DOUBLE PRECISION,
+//		p99    DOUBLE PRECISION
+//	)
+//
+// Gauges have the last value set in the interval as their sum, min and max,
+// and percentiles are only stored for samples and key/value points. Labels
+// can be queried with the JSONB operators, as in:
+//
+//	SELECT time, sum / count AS mean, p99 FROM metrics
+//	WHERE name = 'api.latency' AND labels @> '{"route": "/users"}'
+//	ORDER BY time
+//
+// Intervals which fail to be stored are tried again on the next flush, as
+// long as they are retained, which is for three intervals.
+type PostgresSink struct {
+	*InmemSink
+
+	db    *sql.DB
+	table string
+	loop  *flushLoop
+
+	// written, the start of the last interval stored, is only used from
+	// the flush loop
+	written time.Time
+}
+
+// NewPostgresSink creates a PostgresSink, creating its table and index if
+// needed, and starts storing the intervals as they end.
+func NewPostgresSink(opts PostgresOpts) (*PostgresSink, error) {
+	if opts.DB == nil {
+		return nil, fmt.Errorf("postgres database is required")
+	}
+	table := opts.Table
+	if table == "" {
+		table = postgresTable
+	}
+	if !postgresTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid postgres table name %q", table)
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = postgresInterval
+	}
+	retention := opts.SampleRetention
+	if retention <= 0 {
+		retention = postgresSampleRetention
+	}
+
+	// Ended intervals are retained until a flush has stored them
+	s := &PostgresSink{
+		InmemSink: NewInmemSink(interval, 3*interval),
+		db:        opts.DB,
+		table:     table,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+	if err := s.createTable(ctx, opts.Hypertable); err != nil {
+		return nil, err
+	}
+	s.EnableSampleRetention(retention)
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+// Shutdown stops the flush loop and blocks while the current interval, which
+// has not ended yet, is stored.
+func (s *PostgresSink) Shutdown() {
+	s.loop.stop()
+}
+
+// createTable creates the table and its index if needed, and converts it
+// into a hypertable if configured.
+func (s *PostgresSink) createTable(ctx context.Context, hypertable bool) error {
+	name := s.table[strings.LastIndexByte(s.table, '.')+1:]
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+			time   TIMESTAMPTZ      NOT NULL,
+			name   TEXT             NOT NULL,
+			labels JSONB            NOT NULL,
+			count  BIGINT           NOT NULL,
+			sum    DOUBLE PRECISION NOT NULL,
+			min    DOUBLE PRECISION NOT NULL,
+			max    DOUBLE PRECISION NOT NULL,
+			p50    DOUBLE PRECISION,
+			p95    DOUBLE PRECISION,
+			p99    DOUBLE PRECISION
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + name + `_name_time ON ` + s.table + ` (name, time DESC)`,
+	}
+	if hypertable {
+		stmts = append(stmts, `SELECT create_hypertable('`+s.table+`', 'time', if_not_exists => TRUE)`)
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresSink) flushLoop(now time.Time, final bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+	if err := s.flush(ctx, now, final); err != nil {
+		log.Printf("[ERR] Error writing to postgres! Err: %s", err)
+	}
+}
+
+// flush stores the intervals which ended since the last flush, and the
+// current interval as well when final is set.
+func (s *PostgresSink) flush(ctx context.Context, now time.Time, final bool) error {
+	current := now.Truncate(s.interval)
+
+	s.intervalLock.RLock()
+	var pending []*IntervalMetrics
+	for _, intv := range s.intervals {
+		if !intv.Interval.After(s.written) {
+			continue
+		}
+		if intv.Interval.Before(current) || final {
+			pending = append(pending, intv)
+		}
+	}
+	s.intervalLock.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := s.insert(ctx, pending); err != nil {
+		return err
+	}
+	s.written = pending[len(pending)-1].Interval
+	return nil
+}
+
+// insert stores the series of the intervals in a single transaction.
+func (s *PostgresSink) insert(ctx context.Context, pending []*IntervalMetrics) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO `+s.table+
+		` (time, name, labels, count, sum, min, max, p50, p95, p99) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	for _, intv := range pending {
+		intv.RLock()
+		series := intervalSeriesOf(intv)
+		intv.RUnlock()
+
+		for _, ser := range series {
+			labels := make(map[string]string, len(ser.labels))
+			for _, l := range ser.labels {
+				labels[l.Name] = l.Value
+			}
+			encoded, err := json.Marshal(labels)
+			if err != nil {
+				return err
+			}
+
+			var p50, p95, p99 sql.NullFloat64
+			if len(ser.values) > 0 {
+				p50 = sql.NullFloat64{Float64: percentile(ser.values, 50), Valid: true}
+				p95 = sql.NullFloat64{Float64: percentile(ser.values, 95), Valid: true}
+				p99 = sql.NullFloat64{Float64: percentile(ser.values, 99), Valid: true}
+			}
+			if _, err := stmt.ExecContext(ctx, intv.Interval.UTC(), ser.name, string(encoded),
+				int64(ser.count), ser.sum, ser.min, ser.max, p50, p95, p99); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
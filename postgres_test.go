@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresSink(t *testing.T) {
+	db, d := openRecordingDB(t)
+	s, err := NewPostgresSink(PostgresOpts{
+		DB:         db,
+		Table:      "public.samples",
+		Hypertable: true,
+		Interval:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	execs := d.recorded()
+	if len(execs) != 3 || !strings.HasPrefix(execs[0].query, "CREATE TABLE IF NOT EXISTS public.samples (") ||
+		execs[1].query != "CREATE INDEX IF NOT EXISTS samples_name_time ON public.samples (name, time DESC)" ||
+		execs[2].query != "SELECT create_hypertable('public.samples', 'time', if_not_exists => TRUE)" {
+		t.Fatalf("bad schema statements %v", execs)
+	}
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"route", "/users"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	for _, v := range []float32{10, 20, 30} {
+		s.AddSample([]string{"api", "latency"}, v)
+	}
+	start := time.Now().Truncate(time.Hour).UTC()
+	s.Shutdown()
+
+	execs = d.recorded()[3:]
+	if len(execs) != 3 {
+		t.Fatalf("bad statements %v", execs)
+	}
+	for _, e := range execs {
+		if e.query != "INSERT INTO public.samples (time, name, labels, count, sum, min, max, p50, p95, p99) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" {
+			t.Fatalf("bad insert %s", e.query)
+		}
+		if !e.args[0].(time.Time).Equal(start) {
+			t.Fatalf("bad time %v", e.args[0])
+		}
+	}
+	counter, gauge, sample := execs[0].args, execs[1].args, execs[2].args
+	if counter[1] != "api.requests" || counter[2] != `{"route":"/users"}` || counter[3] != int64(1) ||
+		counter[4] != 2.0 || counter[5] != 2.0 || counter[6] != 2.0 || counter[7] != nil {
+		t.Fatalf("bad counter row %v", counter)
+	}
+	if gauge[1] != "queue.depth" || gauge[2] != "{}" || gauge[4] != 7.0 || gauge[9] != nil {
+		t.Fatalf("bad gauge row %v", gauge)
+	}
+	if sample[1] != "api.latency" || sample[3] != int64(3) || sample[4] != 60.0 || sample[5] != 10.0 ||
+		sample[6] != 30.0 || sample[7] != 20.0 || sample[8] != 29.0 || sample[9] != 29.8 {
+		t.Fatalf("bad sample row %v", sample)
+	}
+}
+
+func TestPostgresSink_Retry(t *testing.T) {
+	db, d := openRecordingDB(t)
+	s, err := NewPostgresSink(PostgresOpts{DB: db, Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"a"}, 1)
+	now := time.Now()
+	ctx := context.Background()
+
+	// The current interval has not ended yet
+	if err := s.flush(ctx, now, false); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if execs := d.recorded(); len(execs) != 2 {
+		t.Fatalf("expected no inserts, got %v", execs)
+	}
+
+	// A failed transaction stores the interval again on the next flush
+	d.lock.Lock()
+	d.failInserts = 1
+	d.lock.Unlock()
+	if err := s.flush(ctx, now.Add(time.Hour), false); err == nil {
+		t.Fatalf("expected the insert to fail")
+	}
+	if err := s.flush(ctx, now.Add(time.Hour), false); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if err := s.flush(ctx, now.Add(2*time.Hour), false); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if execs := d.recorded(); len(execs) != 3 || execs[2].args[1] != "a" {
+		t.Fatalf("expected the interval to be stored once, got %v", execs)
+	}
+}
+
+func TestNewPostgresSink_Invalid(t *testing.T) {
+	if _, err := NewPostgresSink(PostgresOpts{}); err == nil {
+		t.Fatalf("expected a missing database to fail")
+	}
+	db, _ := openRecordingDB(t)
+	if _, err := NewPostgresSink(PostgresOpts{DB: db, Table: "metrics; DROP TABLE users"}); err == nil {
+		t.Fatalf("expected an invalid table name to fail")
+	}
+
+	s, err := NewPostgresSink(PostgresOpts{DB: db})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.table != "metrics" {
+		t.Fatalf("bad table %s", s.table)
+	}
+}
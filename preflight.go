@@ -0,0 +1,214 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preflightTimeout is used when PipelineConfig.Timeout is not set
+const preflightTimeout = 5 * time.Second
+
+// Stages of a pipeline validation, see SinkReport.Stage
+const (
+	PreflightStageConfig  = "config"
+	PreflightStageDNS     = "dns"
+	PreflightStageConnect = "connect"
+	PreflightStageAuth    = "auth"
+)
+
+// PreflightSink is implemented by sinks which can check that their
+// destination is reachable, and accepts their credentials, without emitting
+// any metrics. Errors should be a *PreflightError naming the failed stage.
+type PreflightSink interface {
+	Preflight(ctx context.Context) error
+}
+
+// PreflightError is a failed preflight check of a sink.
+type PreflightError struct {
+	// Stage is the check which failed, such as PreflightStageDNS
+	Stage string
+	Err   error
+}
+
+func (e *PreflightError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// PipelineConfig describes the sinks of a pipeline to validate.
+type PipelineConfig struct {
+	// Sinks are the URLs of the sinks, as passed to NewMetricSinkFromURL
+	Sinks []string
+
+	// Timeout bounds the checks of each sink, it defaults to 5 seconds
+	Timeout time.Duration
+}
+
+// PipelineReport is the result of ValidatePipeline.
+type PipelineReport struct {
+	// Sinks holds a report per configured sink, in the order of the
+	// configuration
+	Sinks []SinkReport
+}
+
+// SinkReport is the result of validating a single sink.
+type SinkReport struct {
+	// URL is the configured URL, with credentials redacted
+	URL string
+
+	// Scheme is the scheme of the URL, which selects the type of sink
+	Scheme string
+
+	// Checked reports whether the sink supports preflight checks. Sinks
+	// which do not are only constructed.
+	Checked bool
+
+	// Stage is the stage which failed, such as PreflightStageConnect, or
+	// empty when the sink passed
+	Stage string
+
+	// Err is the error of the failed stage, if any
+	Err error
+
+	// Duration is how long the checks of the sink took
+	Duration time.Duration
+}
+
+// OK reports whether every sink passed its checks.
+func (r *PipelineReport) OK() bool {
+	return r.Err() == nil
+}
+
+// Err returns the errors of every sink which failed its checks, or nil.
+func (r *PipelineReport) Err() error {
+	var errs []error
+	for _, s := range r.Sinks {
+		if s.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.URL, s.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidatePipeline performs a dry run of a pipeline, for preflight checks of
+// CLIs and init containers. Every sink is constructed from its URL, then
+// sinks implementing PreflightSink check that their destination resolves,
+// accepts connections and, where it has credentials, accepts them, before
+// the sink is shut down. No metrics are emitted. Sinks are checked
+// concurrently, and the report holds the outcome of each.
+func ValidatePipeline(ctx context.Context, cfg PipelineConfig) *PipelineReport {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = preflightTimeout
+	}
+
+	report := &PipelineReport{Sinks: make([]SinkReport, len(cfg.Sinks))}
+	var wg sync.WaitGroup
+	for i, raw := range cfg.Sinks {
+		wg.Add(1)
+		go func(r *SinkReport, raw string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			validateSink(ctx, r, raw)
+		}(&report.Sinks[i], raw)
+	}
+	wg.Wait()
+	return report
+}
+
+// validateSink constructs the sink of a URL and runs its preflight checks.
+func validateSink(ctx context.Context, r *SinkReport, raw string) {
+	start := time.Now()
+	defer func() { r.Duration = time.Since(start) }()
+
+	r.URL = "<invalid URL>"
+	u, err := url.Parse(raw)
+	if err != nil {
+		r.Stage, r.Err = PreflightStageConfig, err
+		return
+	}
+	r.URL, r.Scheme = redactSinkURL(u), u.Scheme
+
+	sink, err := NewMetricSinkFromURL(raw)
+	if err != nil {
+		r.Stage, r.Err = PreflightStageConfig, err
+		return
+	}
+	defer func() {
+		if ss, ok := sink.(ShutdownSink); ok {
+			ss.Shutdown()
+		}
+	}()
+
+	ps, ok := sink.(PreflightSink)
+	if !ok {
+		return
+	}
+	r.Checked = true
+	if err := ps.Preflight(ctx); err != nil {
+		r.Stage, r.Err = PreflightStageConnect, err
+		var perr *PreflightError
+		if errors.As(err, &perr) {
+			r.Stage, r.Err = perr.Stage, perr.Err
+		}
+	}
+}
+
+// redactSinkURL hides the password and any query parameter which looks like
+// a credential.
+func redactSinkURL(u *url.URL) string {
+	c := *u
+	params := c.Query()
+	for name := range params {
+		lower := strings.ToLower(name)
+		for _, secret := range []string{"secret", "password", "token", "key"} {
+			if strings.Contains(lower, secret) {
+				params.Set(name, "xxxxx")
+				break
+			}
+		}
+	}
+	c.RawQuery = params.Encode()
+	return c.Redacted()
+}
+
+// preflightDial checks that addr resolves and accepts connections on network,
+// closing the connection right away. Connecting over UDP only resolves the
+// address, as nothing is sent. Unix domain sockets are not resolved.
+func preflightDial(ctx context.Context, network, addr string) error {
+	if strings.HasPrefix(network, "unix") {
+		return preflightConnect(ctx, network, addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &PreflightError{Stage: PreflightStageConfig, Err: err}
+	}
+	if net.ParseIP(host) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return &PreflightError{Stage: PreflightStageDNS, Err: err}
+		}
+	}
+	return preflightConnect(ctx, network, addr)
+}
+
+func preflightConnect(ctx context.Context, network, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return &PreflightError{Stage: PreflightStageConnect, Err: err}
+	}
+	return conn.Close()
+}
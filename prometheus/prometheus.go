@@ -7,14 +7,20 @@
 package prometheus
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-metrics"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
 )
 
@@ -32,8 +38,17 @@ type PrometheusOpts struct {
 	// Expiration is the duration a metric is valid for, after which it will be
 	// untracked. If the value is zero, a metric is never expired.
 	Expiration time.Duration
+
+	// Registerer is where the sink registers itself. It defaults to
+	// prometheus.DefaultRegisterer.
 	Registerer prometheus.Registerer
 
+	// Gatherer is used by Handler to serve the registered metrics. If it is
+	// nil and Registerer also implements prometheus.Gatherer (as a
+	// *prometheus.Registry does) then Registerer is used, otherwise it
+	// defaults to prometheus.DefaultGatherer.
+	Gatherer prometheus.Gatherer
+
 	// Gauges, Summaries, and Counters allow us to pre-declare metrics by giving
 	// their Name, Help, and ConstLabels to the PrometheusSink when it is created.
 	// Metrics declared in this way will be initialized at zero and will not be
@@ -49,10 +64,16 @@ type PrometheusOpts struct {
 	//         },
 	//     },
 	// }
-	GaugeDefinitions   []GaugeDefinition
-	SummaryDefinitions []SummaryDefinition
-	CounterDefinitions []CounterDefinition
-	Name               string
+	GaugeDefinitions     []GaugeDefinition
+	SummaryDefinitions   []SummaryDefinition
+	CounterDefinitions   []CounterDefinition
+	HistogramDefinitions []HistogramDefinition
+	Name                 string
+
+	// HistogramBuckets configures the buckets of histograms recorded with
+	// AddHistogram. The Buckets of a HistogramDefinition take precedence
+	// for its name.
+	HistogramBuckets metrics.HistogramBuckets
 }
 
 type PrometheusSink struct {
@@ -60,9 +81,12 @@ type PrometheusSink struct {
 	gauges     sync.Map
 	summaries  sync.Map
 	counters   sync.Map
+	histograms sync.Map
+	buckets    metrics.HistogramBuckets
 	expiration time.Duration
 	help       map[string]string
 	name       string
+	gatherer   prometheus.Gatherer
 }
 
 // GaugeDefinition can be provided to PrometheusOpts to declare a constant gauge that is not deleted on expiry.
@@ -105,6 +129,21 @@ type counter struct {
 	canDelete bool
 }
 
+// HistogramDefinition can be provided to PrometheusOpts to declare a constant histogram that is not deleted on expiry.
+// Buckets defaults to the buckets of PrometheusOpts.HistogramBuckets for the name.
+type HistogramDefinition struct {
+	Name        []string
+	ConstLabels []metrics.Label
+	Help        string
+	Buckets     []float64
+}
+
+type histogram struct {
+	prometheus.Histogram
+	updatedAt time.Time
+	canDelete bool
+}
+
 // NewPrometheusSink creates a new PrometheusSink using the default options.
 func NewPrometheusSink() (*PrometheusSink, error) {
 	return NewPrometheusSinkFrom(DefaultPrometheusOpts)
@@ -116,10 +155,31 @@ func NewPrometheusSinkFrom(opts PrometheusOpts) (*PrometheusSink, error) {
 	if name == "" {
 		name = "default_prometheus_sink"
 	}
+
+	// The buckets of definitions apply to every series of their name
+	buckets := metrics.HistogramBuckets{
+		Default: opts.HistogramBuckets.Default,
+		Metrics: make(map[string][]float64),
+		Tuner:   opts.HistogramBuckets.Tuner,
+	}
+	for k, v := range opts.HistogramBuckets.Metrics {
+		buckets.Metrics[k] = v
+	}
+	for _, h := range opts.HistogramDefinitions {
+		if h.Buckets != nil {
+			buckets.Metrics[strings.Join(h.Name, ".")] = h.Buckets
+		}
+	}
+	if err := buckets.Validate(); err != nil {
+		return nil, err
+	}
+
 	sink := &PrometheusSink{
 		gauges:     sync.Map{},
 		summaries:  sync.Map{},
 		counters:   sync.Map{},
+		histograms: sync.Map{},
+		buckets:    buckets,
 		expiration: opts.Expiration,
 		help:       make(map[string]string),
 		name:       name,
@@ -128,15 +188,36 @@ func NewPrometheusSinkFrom(opts PrometheusOpts) (*PrometheusSink, error) {
 	initGauges(&sink.gauges, opts.GaugeDefinitions, sink.help)
 	initSummaries(&sink.summaries, opts.SummaryDefinitions, sink.help)
 	initCounters(&sink.counters, opts.CounterDefinitions, sink.help)
+	initHistograms(&sink.histograms, opts.HistogramDefinitions, buckets, sink.help)
 
 	reg := opts.Registerer
 	if reg == nil {
 		reg = prometheus.DefaultRegisterer
 	}
 
+	sink.gatherer = opts.Gatherer
+	if sink.gatherer == nil {
+		if g, ok := reg.(prometheus.Gatherer); ok {
+			sink.gatherer = g
+		} else {
+			sink.gatherer = prometheus.DefaultGatherer
+		}
+	}
+
 	return sink, reg.Register(sink)
 }
 
+// Handler returns an http.Handler which serves the metrics of the sink's
+// Gatherer in the Prometheus exposition format, for mounting on an existing
+// exporter or mux.
+func (p *PrometheusSink) Handler() http.Handler {
+	gatherer := p.gatherer
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
 // Describe sends a Collector.Describe value from the descriptor created around PrometheusSink.Name
 // Note that we cannot describe all the metrics (gauges, counters, summaries) in the sink as
 // metrics can be added at any point during the lifecycle of the sink, which does not respect
@@ -204,6 +285,21 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 		count.Collect(c)
 		return true
 	})
+	p.histograms.Range(func(k, v interface{}) bool {
+		if v == nil {
+			return true
+		}
+		h := v.(*histogram)
+		lastUpdate := h.updatedAt
+		if expire && lastUpdate.Add(p.expiration).Before(t) {
+			if h.canDelete {
+				p.histograms.Delete(k)
+				return true
+			}
+		}
+		h.Collect(c)
+		return true
+	})
 }
 
 func initGauges(m *sync.Map, gauges []GaugeDefinition, help map[string]string) {
@@ -247,6 +343,20 @@ func initCounters(m *sync.Map, counters []CounterDefinition, help map[string]str
 	}
 }
 
+func initHistograms(m *sync.Map, histograms []HistogramDefinition, buckets metrics.HistogramBuckets, help map[string]string) {
+	for _, h := range histograms {
+		key, hash := flattenKey(h.Name, h.ConstLabels)
+		help[fmt.Sprintf("histogram.%s", key)] = h.Help
+		pH := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        key,
+			Help:        h.Help,
+			ConstLabels: prometheusLabels(h.ConstLabels),
+			Buckets:     buckets.For(h.Name),
+		})
+		m.Store(hash, &histogram{Histogram: pH})
+	}
+}
+
 var forbiddenCharsReplacer = strings.NewReplacer(" ", "_", ".", "_", "=", "_", "-", "_", "/", "_")
 
 func flattenKey(parts []string, labels []metrics.Label) (string, string) {
@@ -269,6 +379,11 @@ func prometheusLabels(labels []metrics.Label) prometheus.Labels {
 	return l
 }
 
+// Capabilities reports what the Prometheus sink supports.
+func (p *PrometheusSink) Capabilities() metrics.Capabilities {
+	return metrics.Capabilities{Histograms: true, PrecisionFloats: true, Tags: true}
+}
+
 func (p *PrometheusSink) SetGauge(parts []string, val float32) {
 	p.SetPrecisionGauge(parts, float64(val))
 }
@@ -358,6 +473,46 @@ func (p *PrometheusSink) AddSampleWithLabels(parts []string, val float32, labels
 	}
 }
 
+func (p *PrometheusSink) AddHistogram(parts []string, val float64) {
+	p.AddHistogramWithLabels(parts, val, nil)
+}
+
+func (p *PrometheusSink) AddHistogramWithLabels(parts []string, val float64, labels []metrics.Label) {
+	p.buckets.Observe(parts, val)
+	key, hash := flattenKey(parts, labels)
+	ph, ok := p.histograms.Load(hash)
+
+	// Does the histogram already exist?
+	if ok {
+		localHistogram := *ph.(*histogram)
+		localHistogram.Observe(val)
+		localHistogram.updatedAt = time.Now()
+		p.histograms.Store(hash, &localHistogram)
+
+		// The histogram does not exist, create it with the buckets of the
+		// metric and allow it to be deleted
+	} else {
+		help := key
+		existingHelp, ok := p.help[fmt.Sprintf("histogram.%s", key)]
+		if ok {
+			help = existingHelp
+		}
+		h := prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        key,
+			Help:        help,
+			ConstLabels: prometheusLabels(labels),
+			Buckets:     p.buckets.For(parts),
+		})
+		h.Observe(val)
+		ph = &histogram{
+			Histogram: h,
+			updatedAt: time.Now(),
+			canDelete: true,
+		}
+		p.histograms.Store(hash, ph)
+	}
+}
+
 // EmitKey is not implemented. Prometheus doesn’t offer a type for which an
 // arbitrary number of values is retained, as Prometheus works with a pull
 // model, rather than a push model.
@@ -415,27 +570,106 @@ type PrometheusPushSink struct {
 	pusher       *push.Pusher
 	address      string
 	pushInterval time.Duration
+	jitter       time.Duration
+	retry        metrics.RetryPolicy
 	stopChan     chan struct{}
 }
 
+// PrometheusPushOpts is used to configure a PrometheusPushSink.
+type PrometheusPushOpts struct {
+	// Address of the Pushgateway and Name of the job pushed to it
+	Address string
+	Name    string
+
+	// Grouping adds grouping keys beside the job, such as "instance", so
+	// several pushers of a job do not replace each other's metrics
+	Grouping map[string]string
+
+	// Username and Password enable basic auth
+	Username string
+	Password string
+
+	// HTTPClient is used for pushes, it defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	// PushInterval is the interval pushes are aligned to. Each push happens
+	// once an interval has completed, at the next multiple of PushInterval
+	// since the Unix epoch, so pushes line up with scrapes across restarts
+	// and instances.
+	PushInterval time.Duration
+
+	// Jitter delays each push by a random duration up to Jitter after the
+	// interval boundary, so large fleets do not push at the same instant.
+	Jitter time.Duration
+
+	// MaxRetries is the number of times a failed push is retried before
+	// giving up on the interval. Retries never run past the next boundary.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubled for every
+	// following attempt. It defaults to one second.
+	RetryBackoff time.Duration
+
+	// RetryPolicy replaces MaxRetries and RetryBackoff with a policy shared
+	// with other push sinks.
+	RetryPolicy *metrics.RetryPolicy
+}
+
 // NewPrometheusPushSink creates a PrometheusPushSink by taking an address, interval, and destination name.
+// Failed pushes are retried up to three times within their interval.
 func NewPrometheusPushSink(address string, pushInterval time.Duration, name string) (*PrometheusPushSink, error) {
+	return NewPrometheusPushSinkWithOpts(PrometheusPushOpts{
+		Address:      address,
+		Name:         name,
+		PushInterval: pushInterval,
+		MaxRetries:   3,
+	})
+}
+
+// NewPrometheusPushSinkWithOpts creates a PrometheusPushSink with the given
+// push schedule.
+func NewPrometheusPushSinkWithOpts(opts PrometheusPushOpts) (*PrometheusPushSink, error) {
+	if opts.PushInterval <= 0 {
+		return nil, fmt.Errorf("push interval must be positive")
+	}
 	promSink := &PrometheusSink{
 		gauges:     sync.Map{},
 		summaries:  sync.Map{},
 		counters:   sync.Map{},
+		histograms: sync.Map{},
 		expiration: 60 * time.Second,
 		name:       "default_prometheus_sink",
 	}
 
-	pusher := push.New(address, name).Collector(promSink)
+	pusher := push.New(opts.Address, opts.Name).Collector(promSink)
+	for name, value := range opts.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	if opts.Username != "" || opts.Password != "" {
+		pusher = pusher.BasicAuth(opts.Username, opts.Password)
+	}
+	if opts.HTTPClient != nil {
+		pusher = pusher.Client(opts.HTTPClient)
+	}
 
+	retry := metrics.RetryPolicy{
+		MaxAttempts:    opts.MaxRetries + 1,
+		InitialBackoff: opts.RetryBackoff,
+	}
+	if retry.InitialBackoff <= 0 {
+		retry.InitialBackoff = time.Second
+	}
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
 	sink := &PrometheusPushSink{
-		promSink,
-		pusher,
-		address,
-		pushInterval,
-		make(chan struct{}),
+		PrometheusSink: promSink,
+		pusher:         pusher,
+		address:        opts.Address,
+		pushInterval:   opts.PushInterval,
+		jitter:         opts.Jitter,
+		retry:          retry,
+		stopChan:       make(chan struct{}),
 	}
 
 	sink.flushMetrics()
@@ -443,24 +677,77 @@ func NewPrometheusPushSink(address string, pushInterval time.Duration, name stri
 }
 
 func (s *PrometheusPushSink) flushMetrics() {
-	ticker := time.NewTicker(s.pushInterval)
-
 	go func() {
 		for {
+			next := nextPushAt(time.Now(), s.pushInterval, s.jitter, rand.Int63n)
+			timer := time.NewTimer(time.Until(next))
 			select {
-			case <-ticker.C:
-				err := s.pusher.Push()
-				if err != nil {
-					log.Printf("[ERR] Error pushing to Prometheus! Err: %s", err)
-				}
+			case <-timer.C:
+				s.pushWithRetry(next)
 			case <-s.stopChan:
-				ticker.Stop()
+				timer.Stop()
 				return
 			}
 		}
 	}()
 }
 
+// nextPushAt returns when the push for the interval in progress at now
+// should happen: the end of the interval plus a random jitter.
+func nextPushAt(now time.Time, interval, jitter time.Duration, randN func(int64) int64) time.Time {
+	next := now.Truncate(interval).Add(interval)
+	if jitter > 0 {
+		next = next.Add(time.Duration(randN(int64(jitter))))
+	}
+	return next
+}
+
+// pushWithRetry pushes the metrics, retrying according to the retry policy
+// until the push succeeds, the retries run out or the next interval begins.
+func (s *PrometheusPushSink) pushWithRetry(scheduled time.Time) {
+	deadline := scheduled.Truncate(s.pushInterval).Add(s.pushInterval)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := s.retry.Do(ctx, "Prometheus", s.push); err != nil {
+		log.Printf("[ERR] Error pushing to Prometheus! Err: %s", err)
+	}
+}
+
+// pushStatus matches the error returned by the pusher when the Pushgateway
+// responds with an unexpected status
+var pushStatus = regexp.MustCompile(`(?s)^unexpected status code (\d+) while pushing to (\S+): (.*)$`)
+
+// push pushes the metrics once. The pusher reports unexpected statuses as
+// plain errors, which are turned into a metrics.HTTPStatusError so the retry
+// policy does not retry client errors.
+func (s *PrometheusPushSink) push() error {
+	err := s.pusher.Push()
+	if err == nil {
+		return nil
+	}
+	m := pushStatus.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	code, convErr := strconv.Atoi(m[1])
+	if convErr != nil {
+		return err
+	}
+	return fmt.Errorf("pushing to %s: %w", m[2], &metrics.HTTPStatusError{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Body:       strings.TrimSpace(m[3]),
+	})
+}
+
 // Shutdown tears down the PrometheusPushSink, and blocks while flushing metrics to the backend.
 func (s *PrometheusPushSink) Shutdown() {
 	close(s.stopChan)
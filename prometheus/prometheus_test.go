@@ -45,6 +45,45 @@ func TestNewPrometheusSinkFrom(t *testing.T) {
 	}
 }
 
+func TestPrometheusSink_Handler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		Name:       "handler_sink",
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	sink.SetGauge([]string{"injected", "registry"}, 42)
+
+	resp := httptest.NewRecorder()
+	sink.Handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("bad status: %d", resp.Code)
+	}
+	if !strings.Contains(resp.Body.String(), "injected_registry 42") {
+		t.Fatalf("missing gauge in output: %s", resp.Body)
+	}
+
+	// An explicit gatherer takes precedence
+	other := prometheus.NewRegistry()
+	sink, err = NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: prometheus.NewRegistry(),
+		Gatherer:   other,
+		Name:       "handler_sink",
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	sink.SetGauge([]string{"injected", "registry"}, 42)
+
+	resp = httptest.NewRecorder()
+	sink.Handler().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(resp.Body.String(), "injected_registry") {
+		t.Fatalf("unexpected gauge in output: %s", resp.Body)
+	}
+}
+
 func TestNewPrometheusSink(t *testing.T) {
 	sink, err := NewPrometheusSink()
 	if err != nil {
@@ -396,10 +435,100 @@ func TestDefinitionsWithLabels(t *testing.T) {
 func TestMetricSinkInterface(t *testing.T) {
 	var ps *PrometheusSink
 	_ = metrics.MetricSink(ps)
+	_ = metrics.HistogramMetricSink(ps)
 	var pps *PrometheusPushSink
 	_ = metrics.MetricSink(pps)
 }
 
+func TestAddHistogram(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		HistogramDefinitions: []HistogramDefinition{{
+			Name:    []string{"api", "latency"},
+			Help:    "Latency of API calls",
+			Buckets: []float64{0.1, 1},
+		}},
+		HistogramBuckets: metrics.HistogramBuckets{Default: []float64{100, 1000}},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	// Series created at runtime use the buckets of their definition
+	for _, v := range []float64{0.05, 0.5, 5} {
+		sink.AddHistogramWithLabels([]string{"api", "latency"}, v, []metrics.Label{{Name: "route", Value: "/users"}})
+	}
+	sink.AddHistogram([]string{"response", "bytes"}, 512)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	got := make(map[string][]string)
+	for _, mf := range families {
+		if mf.GetType() != dto.MetricType_HISTOGRAM {
+			t.Fatalf("expected %s to be a histogram, got %s", mf.GetName(), mf.GetType())
+		}
+		for _, m := range mf.Metric {
+			h := m.GetHistogram()
+			series := fmt.Sprintf("count=%d sum=%g", h.GetSampleCount(), h.GetSampleSum())
+			for _, b := range h.Bucket {
+				series += fmt.Sprintf(" le%g=%d", b.GetUpperBound(), b.GetCumulativeCount())
+			}
+			got[mf.GetName()] = append(got[mf.GetName()], series)
+		}
+	}
+	want := map[string][]string{
+		"api_latency":    {"count=0 sum=0 le0.1=0 le1=0", "count=3 sum=5.55 le0.1=1 le1=2"},
+		"response_bytes": {"count=1 sum=512 le100=0 le1000=1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad histograms %v", got)
+	}
+	if !sink.Capabilities().Histograms {
+		t.Fatalf("expected histograms to be supported")
+	}
+}
+
+func TestAddHistogram_Tuner(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		// Without a learning window the buckets lock in on the first value
+		HistogramBuckets: metrics.HistogramBuckets{Tuner: metrics.NewBucketTuner(0, 1)},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	sink.AddHistogram([]string{"response", "bytes"}, 512)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if len(families) != 1 {
+		t.Fatalf("bad families %v", families)
+	}
+	h := families[0].Metric[0].GetHistogram()
+	if len(h.Bucket) != 1 || h.Bucket[0].GetUpperBound() != 520 || h.Bucket[0].GetCumulativeCount() != 1 {
+		t.Fatalf("bad tuned buckets %v", h.Bucket)
+	}
+}
+
+func TestNewPrometheusSinkFrom_InvalidBuckets(t *testing.T) {
+	_, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: prometheus.NewRegistry(),
+		HistogramDefinitions: []HistogramDefinition{{
+			Name:    []string{"api", "latency"},
+			Buckets: []float64{1, 0.1},
+		}},
+	})
+	if err == nil || err.Error() != "histogram buckets of api.latency: boundaries 1 and 0.1 are not increasing" {
+		t.Fatalf("bad error %v", err)
+	}
+}
+
 func Test_flattenKey(t *testing.T) {
 	testCases := []struct {
 		name               string
@@ -482,3 +611,114 @@ func Test_flattenKey(t *testing.T) {
 		})
 	}
 }
+
+func TestNextPushAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 7, 0, time.UTC)
+	next := nextPushAt(now, 10*time.Second, 0, nil)
+	if want := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("got %s want %s", next, want)
+	}
+
+	next = nextPushAt(now, 10*time.Second, time.Second, func(n int64) int64 { return n / 2 })
+	if want := time.Date(2024, 1, 1, 0, 0, 10, int(500*time.Millisecond), time.UTC); !next.Equal(want) {
+		t.Fatalf("got %s want %s", next, want)
+	}
+}
+
+func TestPrometheusPushSink_Retry(t *testing.T) {
+	pushed := make(chan int, 10)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		pushed <- attempts
+	}))
+	defer server.Close()
+
+	sink, err := NewPrometheusPushSinkWithOpts(PrometheusPushOpts{
+		Address:      server.URL,
+		Name:         "retrytest",
+		PushInterval: time.Second,
+		MaxRetries:   3,
+		RetryBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	select {
+	case n := <-pushed:
+		if n != 3 {
+			t.Fatalf("expected success on the third attempt, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("push never succeeded")
+	}
+}
+
+func TestPrometheusPushSink_ClientError(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Error(w, "bad metric", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	sink, err := NewPrometheusPushSinkWithOpts(PrometheusPushOpts{
+		Address:      server.URL,
+		Name:         "clienterror",
+		PushInterval: time.Hour,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	err = sink.push()
+	var statusErr *metrics.HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || statusErr.Body != "bad metric" {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+	sink.pushWithRetry(time.Now())
+	if attempts != 2 {
+		t.Fatalf("client errors should not be retried, got %d attempts", attempts)
+	}
+}
+
+func TestPrometheusPushSink_Grouping(t *testing.T) {
+	type push struct {
+		method, path, user, password string
+	}
+	pushed := make(chan push, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		pushed <- push{r.Method, r.URL.Path, user, password}
+	}))
+	defer server.Close()
+
+	sink, err := NewPrometheusPushSinkWithOpts(PrometheusPushOpts{
+		Address:      server.URL,
+		Name:         "batch",
+		Grouping:     map[string]string{"instance": "worker-1"},
+		Username:     "user",
+		Password:     "secret",
+		HTTPClient:   server.Client(),
+		PushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	sink.SetGauge([]string{"one"}, 1)
+	sink.Shutdown()
+
+	expected := push{http.MethodPut, "/metrics/job/batch/instance/worker-1", "user", "secret"}
+	if got := <-pushed; got != expected {
+		t.Fatalf("bad push %+v", got)
+	}
+}
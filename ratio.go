@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+)
+
+// RatioMetric derives a gauge from two other metrics, such as memory used
+// over the memory limit, so saturation can be alerted on directly. Each input
+// may be a gauge, using its last value, or a counter, using its running
+// total. The ratio is emitted with the labels of the inputs whenever either
+// input of the same label set changes and both are known, unless the
+// denominator is zero.
+type RatioMetric struct {
+	Name        []string
+	Numerator   []string
+	Denominator []string
+}
+
+// ratioInput links an input key to the ratio it feeds
+type ratioInput struct {
+	ratio       *RatioMetric
+	denominator bool
+}
+
+// ratioValues are the last known inputs of a ratio for one label set
+type ratioValues struct {
+	num, den       float64
+	hasNum, hasDen bool
+}
+
+// ratioEngine tracks the inputs of the configured ratios
+type ratioEngine struct {
+	inputs map[string][]ratioInput
+
+	lock   sync.Mutex
+	values map[*RatioMetric]map[string]*ratioValues
+}
+
+func newRatioEngine(ratios []RatioMetric) *ratioEngine {
+	if len(ratios) == 0 {
+		return nil
+	}
+	e := &ratioEngine{
+		inputs: make(map[string][]ratioInput, 2*len(ratios)),
+		values: make(map[*RatioMetric]map[string]*ratioValues, len(ratios)),
+	}
+	for i := range ratios {
+		r := &ratios[i]
+		num, den := strings.Join(r.Numerator, "."), strings.Join(r.Denominator, ".")
+		e.inputs[num] = append(e.inputs[num], ratioInput{ratio: r})
+		e.inputs[den] = append(e.inputs[den], ratioInput{ratio: r, denominator: true})
+		e.values[r] = make(map[string]*ratioValues)
+	}
+	return e
+}
+
+// derivedRatio is a ratio ready to be emitted
+type derivedRatio struct {
+	name  []string
+	value float64
+}
+
+// update records an input value, adding it to the running total for
+// counters, and returns the ratios to emit.
+func (e *ratioEngine) update(key []string, val float64, labels []Label, counter bool) []derivedRatio {
+	inputs, ok := e.inputs[strings.Join(key, ".")]
+	if !ok {
+		return nil
+	}
+	series := seriesKey(nil, labels)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var out []derivedRatio
+	for _, in := range inputs {
+		v, ok := e.values[in.ratio][series]
+		if !ok {
+			v = &ratioValues{}
+			e.values[in.ratio][series] = v
+		}
+		if in.denominator {
+			if counter {
+				v.den += val
+			} else {
+				v.den = val
+			}
+			v.hasDen = true
+		} else {
+			if counter {
+				v.num += val
+			} else {
+				v.num = val
+			}
+			v.hasNum = true
+		}
+		if v.hasNum && v.hasDen && v.den != 0 {
+			out = append(out, derivedRatio{name: in.ratio.Name, value: v.num / v.den})
+		}
+	}
+	return out
+}
+
+// deriveRatios emits the ratios fed by an input. They bypass the rename,
+// audit and snapshot stages like other self-telemetry, but still go through
+// prefixes and filtering.
+func (m *Metrics) deriveRatios(key []string, val float64, labels []Label, counter bool) {
+	for _, r := range m.ratios.update(key, val, labels, counter) {
+		m.setPrecisionGaugeWithLabels(r.name, r.value, labels[:len(labels):len(labels)])
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetrics_Ratios(t *testing.T) {
+	m, met := mockMetric()
+	met.ratios = newRatioEngine([]RatioMetric{
+		{
+			Name:        []string{"mem", "utilization"},
+			Numerator:   []string{"mem", "used"},
+			Denominator: []string{"mem", "limit"},
+		},
+		{
+			Name:        []string{"requests", "error_ratio"},
+			Numerator:   []string{"requests", "errors"},
+			Denominator: []string{"requests", "total"},
+		},
+	})
+	labels := []Label{{"cgroup", "a"}}
+
+	// Nothing is derived until both inputs are known
+	met.SetGaugeWithLabels([]string{"mem", "used"}, 25, labels)
+	if len(m.getKeys()) != 1 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+	met.SetGaugeWithLabels([]string{"mem", "limit"}, 100, labels)
+	met.SetGaugeWithLabels([]string{"mem", "used"}, 50, labels)
+
+	// Other label sets are tracked separately
+	met.SetGaugeWithLabels([]string{"mem", "limit"}, 10, []Label{{"cgroup", "b"}})
+
+	// Counters use their running totals
+	met.IncrCounter([]string{"requests", "total"}, 2)
+	met.IncrCounter([]string{"requests", "errors"}, 1)
+	met.IncrCounter([]string{"requests", "total"}, 2)
+
+	keys := m.getKeys()
+	expected := [][]string{
+		{"mem", "used"},
+		{"mem", "utilization"}, {"mem", "limit"},
+		{"mem", "utilization"}, {"mem", "used"},
+		{"mem", "limit"},
+		{"requests", "total"},
+		{"requests", "error_ratio"}, {"requests", "errors"},
+		{"requests", "error_ratio"}, {"requests", "total"},
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	if !reflect.DeepEqual(m.precisionVals, []float64{0.25, 0.5, 0.5, 0.25}) {
+		t.Fatalf("bad ratios: %v", m.precisionVals)
+	}
+	if !reflect.DeepEqual(m.labels[1], labels) {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+}
+
+func TestMetrics_RatiosZeroDenominator(t *testing.T) {
+	m, met := mockMetric()
+	met.ratios = newRatioEngine([]RatioMetric{
+		{Name: []string{"r"}, Numerator: []string{"a"}, Denominator: []string{"b"}},
+	})
+	met.SetGauge([]string{"a"}, 1)
+	met.SetGauge([]string{"b"}, 0)
+	if len(m.getKeys()) != 2 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+}
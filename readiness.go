@@ -0,0 +1,58 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"sync"
+)
+
+// ReadySink is implemented by sinks that connect to a remote endpoint in the
+// background. Ready returns a channel which is closed once the telemetry path
+// has been established for the first time. It stays closed if the
+// connection is later lost and re-established.
+type ReadySink interface {
+	Ready() <-chan struct{}
+}
+
+// WaitReady blocks until sink is ready to deliver metrics or ctx is done,
+// returning the context error in the latter case. Sinks that do not
+// implement ReadySink are always considered ready, and a FanoutSink is ready
+// once all of its sinks are. Services can use this to delay reporting their
+// own readiness until metrics are flowing.
+func WaitReady(ctx context.Context, sink MetricSink) error {
+	if fh, ok := sink.(FanoutSink); ok {
+		for _, s := range fh {
+			if err := WaitReady(ctx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	rs, ok := sink.(ReadySink)
+	if !ok {
+		return nil
+	}
+	select {
+	case <-rs.Ready():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readiness tracks the first successful connection of a network sink.
+type readiness struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newReadiness() readiness {
+	return readiness{ch: make(chan struct{})}
+}
+
+func (r *readiness) markReady() {
+	r.once.Do(func() { close(r.ch) })
+}
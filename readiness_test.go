@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	gate := make(chan struct{})
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	dial := func(n, a string) (net.Conn, error) {
+		<-gate
+		return client, nil
+	}
+	s, err := NewStatsdSinkWithDialer("127.0.0.1:7525", dial)
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+
+	sink := FanoutSink{&BlackholeSink{}, s}
+
+	// Not connected yet, so the wait times out
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := WaitReady(ctx, sink); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	close(gate)
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := WaitReady(ctx, sink); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Sinks without readiness tracking are always ready
+	if err := WaitReady(context.Background(), &BlackholeSink{}); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Recorder accumulates counters and samples for a single unit of work, such
+// as a request, and emits them together when Flush is called. Every metric is
+// emitted with the same shared labels, which can be set at any point before
+// the flush (for example once the response status is known). Counter
+// increments to the same key are summed locally, so hot paths do not contend
+// on the sink for every increment.
+type Recorder struct {
+	m *Metrics
+
+	// global is set for recorders of the global instance, which emit
+	// nothing while SetGlobalDisabled is in effect
+	global bool
+
+	lock     sync.Mutex
+	labels   []Label
+	counters []recordedValue
+	samples  []recordedValue
+	flushed  bool
+}
+
+type recordedValue struct {
+	key []string
+	val float32
+}
+
+// NewRecorder creates a Recorder which emits through this Metrics instance
+// with the given shared labels.
+func (m *Metrics) NewRecorder(labels ...Label) *Recorder {
+	return &Recorder{
+		m:      m,
+		labels: append([]Label(nil), labels...),
+	}
+}
+
+// SetLabel adds a shared label, replacing any existing label with the same
+// name.
+func (r *Recorder) SetLabel(name, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range r.labels {
+		if r.labels[i].Name == name {
+			r.labels[i].Value = value
+			return
+		}
+	}
+	r.labels = append(r.labels, Label{Name: name, Value: value})
+}
+
+// IncrCounter adds val to the counter for key.
+func (r *Recorder) IncrCounter(key []string, val float32) {
+	if r.disabled() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i := range r.counters {
+		if slices.Equal(r.counters[i].key, key) {
+			r.counters[i].val += val
+			return
+		}
+	}
+	r.counters = append(r.counters, recordedValue{key: key, val: val})
+}
+
+// AddSample records a sample for key.
+func (r *Recorder) AddSample(key []string, val float32) {
+	if r.disabled() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.samples = append(r.samples, recordedValue{key: key, val: val})
+}
+
+// MeasureSince records the time elapsed since start as a sample for key,
+// using the timer granularity of the Metrics instance.
+func (r *Recorder) MeasureSince(key []string, start time.Time) {
+	granularity := r.m.TimerGranularity
+	if granularity == 0 {
+		granularity = time.Millisecond
+	}
+	elapsed := time.Since(start)
+	r.AddSample(key, float32(elapsed.Nanoseconds())/float32(granularity))
+}
+
+// Flush emits everything recorded so far with the shared labels. A Recorder
+// can only be flushed once; later calls are no-ops.
+func (r *Recorder) Flush() {
+	r.lock.Lock()
+	if r.flushed {
+		r.lock.Unlock()
+		return
+	}
+	r.flushed = true
+	// Cap the labels so that host and service labels appended downstream
+	// never write into a shared backing array.
+	labels := r.labels[:len(r.labels):len(r.labels)]
+	counters, samples := r.counters, r.samples
+	r.counters, r.samples = nil, nil
+	r.lock.Unlock()
+
+	if r.disabled() {
+		return
+	}
+
+	for _, c := range counters {
+		r.m.IncrCounterWithLabels(c.key, c.val, labels)
+	}
+	for _, s := range samples {
+		r.m.AddSampleWithLabels(s.key, s.val, labels)
+	}
+}
+
+// disabled reports whether the recorder belongs to the global instance while
+// it is disabled, see SetGlobalDisabled.
+func (r *Recorder) disabled() bool {
+	return r.global && globalDisabled.Load()
+}
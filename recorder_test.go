@@ -0,0 +1,47 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	m, met := mockMetric()
+	met.TimerGranularity = time.Millisecond
+
+	r := met.NewRecorder(Label{"route", "/v1/kv"})
+	r.IncrCounter([]string{"cache", "miss"}, 1)
+	r.IncrCounter([]string{"cache", "miss"}, 1)
+	r.IncrCounter([]string{"cache", "hit"}, 1)
+	r.AddSample([]string{"db", "rows"}, 10)
+	r.MeasureSince([]string{"request"}, time.Now())
+
+	// Nothing is emitted until the recorder is flushed
+	if len(m.getKeys()) != 0 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+
+	r.SetLabel("status", "500")
+	r.SetLabel("status", "200")
+	r.Flush()
+	r.Flush()
+
+	keys := m.getKeys()
+	expected := [][]string{{"cache", "miss"}, {"cache", "hit"}, {"db", "rows"}, {"request"}}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("got %v want %v", keys, expected)
+	}
+	if m.vals[0] != 2 || m.vals[1] != 1 || m.vals[2] != 10 {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	labels := []Label{{"route", "/v1/kv"}, {"status", "200"}}
+	for i := range keys {
+		if !reflect.DeepEqual(m.labels[i], labels) {
+			t.Fatalf("bad labels: %v", m.labels[i])
+		}
+	}
+}
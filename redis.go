@@ -0,0 +1,319 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisPrefix, redisStream, redisRetention, redisMaxLen,
+	// redisFlushInterval and redisBatchSize are used when the matching
+	// RedisOpts are not set
+	redisPrefix        = "metrics:"
+	redisStream        = "metrics"
+	redisRetention     = 24 * time.Hour
+	redisMaxLen        = 100000
+	redisFlushInterval = 10 * time.Second
+	redisBatchSize     = 500
+
+	// redisTimeout bounds every flush written to Redis
+	redisTimeout = 10 * time.Second
+)
+
+// RedisMode selects how a RedisSink stores metrics
+type RedisMode int
+
+const (
+	// RedisTimeSeries adds every value to a RedisTimeSeries key per series
+	// with TS.ADD, which requires the RedisTimeSeries module
+	RedisTimeSeries RedisMode = iota
+
+	// RedisStream appends every value as an entry of a single stream with
+	// XADD, which plain Redis supports
+	RedisStream
+)
+
+// RedisClient runs pipelined commands against Redis. It is implemented by a
+// small adapter over the Redis client already used by the application, such
+// as go-redis or rueidis, which connects, authenticates and selects the
+// database, so this package does not depend on one. Every command is its
+// name followed by its arguments. Pipeline returns the error reply of every
+// command, and an error when the commands could not be run at all.
+type RedisClient interface {
+	Pipeline(ctx context.Context, cmds [][]string) ([]error, error)
+}
+
+// RedisOpts is used to configure a RedisSink.
+type RedisOpts struct {
+	// Client runs the commands, it is required
+	Client RedisClient
+
+	// Mode selects RedisTimeSeries, the default, or RedisStream
+	Mode RedisMode
+
+	// Prefix is prepended to the time series keys, it defaults to
+	// "metrics:"
+	Prefix string
+
+	// Stream is the key of the stream in RedisStream mode, it defaults to
+	// "metrics"
+	Stream string
+
+	// Retention is how long time series keep values, it defaults to 24
+	// hours. MaxLen is the approximate number of entries a stream keeps, it
+	// defaults to 100000.
+	Retention time.Duration
+	MaxLen    int
+
+	// FlushInterval is how often metrics are written, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the largest number of commands pipelined at once, it
+	// defaults to 500
+	BatchSize int
+}
+
+// RedisSink provides a MetricSink which stores short-horizon metrics in
+// Redis, for services colocated with it. Metrics are aggregated in memory
+// and written on every flush interval with pipelined commands.
+//
+// In RedisTimeSeries mode, every series is a key named after the prefix, the
+// key of the metric joined with '.' and its labels sorted by name, as in
+// "metrics:api.requests:code=200". Its labels become the labels of the time
+// series, along with __name__ and type, so series can be queried with
+// TS.MRANGE filters. Labels only apply when a time series is created.
+//
+// In RedisStream mode, every value is an entry of the stream with name,
+// type, value and timestamp fields, and a "label.<name>" field per label.
+//
+// Gauges and key/value pairs record their last value, counters their sum
+// over the interval, and samples their .count, .mean, .min and .max.
+type RedisSink struct {
+	client    RedisClient
+	mode      RedisMode
+	prefix    string
+	stream    string
+	retention string
+	maxLen    string
+	batchSize int
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// redisValue is a single value written to Redis
+type redisValue struct {
+	name   string
+	typ    string
+	labels []Label
+	value  float64
+}
+
+// NewRedisSink creates a RedisSink and starts its flush loop.
+func NewRedisSink(opts RedisOpts) (*RedisSink, error) {
+	if opts.Client == nil {
+		return nil, fmt.Errorf("redis client is required")
+	}
+	if opts.Mode != RedisTimeSeries && opts.Mode != RedisStream {
+		return nil, fmt.Errorf("unknown redis mode %d", opts.Mode)
+	}
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = redisPrefix
+	}
+	stream := opts.Stream
+	if stream == "" {
+		stream = redisStream
+	}
+	retention := opts.Retention
+	if retention <= 0 {
+		retention = redisRetention
+	}
+	maxLen := opts.MaxLen
+	if maxLen <= 0 {
+		maxLen = redisMaxLen
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = redisFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = redisBatchSize
+	}
+
+	s := &RedisSink{
+		client:    opts.Client,
+		mode:      opts.Mode,
+		prefix:    prefix,
+		stream:    stream,
+		retention: strconv.FormatInt(retention.Milliseconds(), 10),
+		maxLen:    strconv.Itoa(maxLen),
+		batchSize: batchSize,
+		agg:       newIntervalAggregator(),
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+func (s *RedisSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *RedisSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *RedisSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *RedisSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *RedisSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *RedisSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *RedisSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *RedisSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *RedisSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Redis sink supports.
+func (s *RedisSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// written.
+func (s *RedisSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are written, starting from now.
+func (s *RedisSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *RedisSink) flushLoop(now time.Time, final bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.flush(ctx, now); err != nil {
+		log.Printf("[ERR] Error writing to redis! Err: %s", err)
+	}
+}
+
+// flush writes everything aggregated since the last flush. Commands failing
+// with an error reply are counted and logged, while a failed pipeline drops
+// the rest of the values.
+func (s *RedisSink) flush(ctx context.Context, now time.Time) error {
+	values := redisValues(s.agg.drain())
+	if len(values) == 0 {
+		return nil
+	}
+
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	cmds := make([][]string, len(values))
+	for i, v := range values {
+		cmds[i] = s.command(v, ts)
+	}
+
+	var failed int
+	var lastErr error
+	for len(cmds) > 0 {
+		n := min(len(cmds), s.batchSize)
+		errs, err := s.client.Pipeline(ctx, cmds[:n])
+		if err != nil {
+			return err
+		}
+		for _, err := range errs {
+			if err != nil {
+				failed++
+				lastErr = err
+			}
+		}
+		cmds = cmds[n:]
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed, last error: %w", failed, len(values), lastErr)
+	}
+	return nil
+}
+
+// command returns the command writing a value.
+func (s *RedisSink) command(v redisValue, ts string) []string {
+	value := strconv.FormatFloat(v.value, 'g', -1, 64)
+	if s.mode == RedisStream {
+		cmd := []string{"XADD", s.stream, "MAXLEN", "~", s.maxLen, "*",
+			"name", v.name, "type", v.typ, "value", value, "timestamp", ts}
+		for _, l := range v.labels {
+			cmd = append(cmd, "label."+l.Name, l.Value)
+		}
+		return cmd
+	}
+
+	var key strings.Builder
+	key.WriteString(s.prefix)
+	key.WriteString(v.name)
+	for _, l := range v.labels {
+		key.WriteByte(':')
+		key.WriteString(l.Name)
+		key.WriteByte('=')
+		key.WriteString(l.Value)
+	}
+	cmd := []string{"TS.ADD", key.String(), ts, value, "RETENTION", s.retention, "ON_DUPLICATE", "LAST",
+		"LABELS", "__name__", v.name, "type", v.typ}
+	for _, l := range v.labels {
+		cmd = append(cmd, l.Name, l.Value)
+	}
+	return cmd
+}
+
+// redisValues converts aggregates into values, with labels sorted by name.
+func redisValues(aggs []*aggregate) []redisValue {
+	var values []redisValue
+	for _, a := range aggs {
+		labels := make([]Label, len(a.labels))
+		copy(labels, a.labels)
+		sort.SliceStable(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		name := strings.Join(a.key, ".")
+
+		switch a.kind {
+		case aggregateGauge:
+			values = append(values, redisValue{name, "gauge", labels, a.last})
+		case aggregateKV:
+			values = append(values, redisValue{name, "kv", labels, a.last})
+		case aggregateCounter:
+			values = append(values, redisValue{name, "counter", labels, a.sum})
+		case aggregateSample:
+			values = append(values,
+				redisValue{name + ".count", "sample", labels, float64(a.count)},
+				redisValue{name + ".mean", "sample", labels, a.mean()},
+				redisValue{name + ".min", "sample", labels, a.min},
+				redisValue{name + ".max", "sample", labels, a.max})
+		}
+	}
+	return values
+}
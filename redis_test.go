@@ -0,0 +1,143 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redisRecorder is a RedisClient recording the commands it runs, failing
+// those for which fail returns an error
+type redisRecorder struct {
+	pipelines [][]string
+	fail      func(cmd []string) error
+}
+
+func (r *redisRecorder) Pipeline(ctx context.Context, cmds [][]string) ([]error, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("no deadline")
+	}
+	var pipeline []string
+	errs := make([]error, len(cmds))
+	for i, cmd := range cmds {
+		pipeline = append(pipeline, strings.Join(cmd, " "))
+		if r.fail != nil {
+			errs[i] = r.fail(cmd)
+		}
+	}
+	r.pipelines = append(r.pipelines, pipeline)
+	return errs, nil
+}
+
+func (r *redisRecorder) commands() []string {
+	var out []string
+	for _, p := range r.pipelines {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestRedisSink_TimeSeries(t *testing.T) {
+	r := &redisRecorder{}
+	s, err := NewRedisSink(RedisOpts{
+		Client:        r,
+		Retention:     time.Hour,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"path", "/a"}, {"code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	s.AddSample([]string{"api", "latency"}, 10)
+	if err := s.flush(ctx, time.UnixMilli(1700000000123)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	want := []string{
+		"TS.ADD metrics:api.requests:code=200:path=/a 1700000000123 2 RETENTION 3600000 ON_DUPLICATE LAST LABELS __name__ api.requests type counter code 200 path /a",
+		"TS.ADD metrics:queue.depth 1700000000123 7 RETENTION 3600000 ON_DUPLICATE LAST LABELS __name__ queue.depth type gauge",
+		"TS.ADD metrics:api.latency.count 1700000000123 1 RETENTION 3600000 ON_DUPLICATE LAST LABELS __name__ api.latency.count type sample",
+		"TS.ADD metrics:api.latency.mean 1700000000123 10 RETENTION 3600000 ON_DUPLICATE LAST LABELS __name__ api.latency.mean type sample",
+		"TS.ADD metrics:api.latency.min 1700000000123 10 RETENTION 3600000 ON_DUPLICATE LAST LABELS __name__ api.latency.min type sample",
+		"TS.ADD metrics:api.latency.max 1700000000123 10 RETENTION 3600000 ON_DUPLICATE LAST LABELS __name__ api.latency.max type sample",
+	}
+	if got := r.commands(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("bad commands\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestRedisSink_Stream(t *testing.T) {
+	r := &redisRecorder{}
+	s, err := NewRedisSink(RedisOpts{
+		Client:        r,
+		Mode:          RedisStream,
+		Stream:        "telemetry",
+		MaxLen:        1000,
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.EmitKey([]string{"keys"}, 3)
+	if err := s.flush(ctx, time.UnixMilli(1700000000123)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	want := []string{
+		"XADD telemetry MAXLEN ~ 1000 * name api.requests type counter value 2 timestamp 1700000000123 label.code 200",
+		"XADD telemetry MAXLEN ~ 1000 * name keys type kv value 3 timestamp 1700000000123",
+	}
+	if got := r.commands(); strings.Join(got, "\n") != strings.Join(want, "\n") || len(r.pipelines) != 2 {
+		t.Fatalf("bad commands\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestRedisSink_ErrorReplies(t *testing.T) {
+	r := &redisRecorder{fail: func(cmd []string) error {
+		if strings.Contains(cmd[1], "bad") {
+			return errors.New("ERR TSDB: the key is not a TSDB key")
+		}
+		return nil
+	}}
+	s, err := NewRedisSink(RedisOpts{Client: r, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s.SetGauge([]string{"bad"}, 1)
+	s.SetGauge([]string{"good"}, 1)
+	err = s.flush(ctx, time.Now())
+	if err == nil || err.Error() != "1 of 2 commands failed, last error: ERR TSDB: the key is not a TSDB key" {
+		t.Fatalf("bad error %v", err)
+	}
+}
+
+func TestNewRedisSink_Invalid(t *testing.T) {
+	for _, opts := range []RedisOpts{
+		{},
+		{Client: &redisRecorder{}, Mode: RedisMode(7)},
+	} {
+		if _, err := NewRedisSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
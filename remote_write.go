@@ -0,0 +1,179 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Metric types of the remote write MetricMetadata message
+const (
+	remoteWriteCounter = 1
+	remoteWriteGauge   = 2
+	remoteWriteSummary = 5
+)
+
+// remoteWriteSeries is a single sample of a Prometheus remote write time
+// series. labels includes __name__ and is sorted by name.
+type remoteWriteSeries struct {
+	labels []Label
+	value  float64
+}
+
+// remoteWriteMetadata carries the type of a metric family
+type remoteWriteMetadata struct {
+	name string
+	typ  int
+}
+
+// cumulativeSeries converts interval aggregates into the cumulative series
+// expected by Prometheus remote write receivers. Counter totals and sample
+// counts and sums keep growing across flushes, gauges report their last
+// value. It is only used from a single flush goroutine.
+type cumulativeSeries struct {
+	totals map[string]float64
+}
+
+func newCumulativeSeries() *cumulativeSeries {
+	return &cumulativeSeries{totals: make(map[string]float64)}
+}
+
+func (c *cumulativeSeries) convert(aggs []*aggregate) ([]remoteWriteSeries, []remoteWriteMetadata) {
+	var series []remoteWriteSeries
+	types := make(map[string]int)
+
+	add := func(name string, labels []Label, val float64, cumulative bool) {
+		ls := promLabels(name, labels)
+		if cumulative {
+			id := seriesKey(nil, ls)
+			c.totals[id] += val
+			val = c.totals[id]
+		}
+		series = append(series, remoteWriteSeries{labels: ls, value: val})
+	}
+
+	for _, a := range aggs {
+		name := promName(a.key)
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			add(name, a.labels, a.last, false)
+			types[name] = remoteWriteGauge
+		case aggregateCounter:
+			add(name+"_total", a.labels, a.sum, true)
+			types[name+"_total"] = remoteWriteCounter
+		case aggregateSample:
+			add(name+"_count", a.labels, float64(a.count), true)
+			add(name+"_sum", a.labels, a.sum, true)
+			types[name] = remoteWriteSummary
+		}
+	}
+
+	meta := make([]remoteWriteMetadata, 0, len(types))
+	for name, typ := range types {
+		meta = append(meta, remoteWriteMetadata{name: name, typ: typ})
+	}
+	sort.Slice(meta, func(i, j int) bool { return meta[i].name < meta[j].name })
+	return series, meta
+}
+
+// promName converts a key into a valid Prometheus metric name
+func promName(key []string) string {
+	return strings.Map(promSanitize, strings.Join(key, "_"))
+}
+
+// promLabels returns the labels of a series including its name, sanitized
+// and sorted as required by remote write.
+func promLabels(name string, labels []Label) []Label {
+	out := make([]Label, 0, len(labels)+1)
+	out = append(out, Label{Name: "__name__", Value: name})
+	for _, l := range labels {
+		out = append(out, Label{Name: strings.Map(promSanitize, l.Name), Value: l.Value})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func promSanitize(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+		return r
+	default:
+		return '_'
+	}
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest protobuf message:
+//
+//	message WriteRequest {
+//	  repeated TimeSeries timeseries = 1;
+//	  repeated MetricMetadata metadata = 3;
+//	}
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+//	message MetricMetadata { MetricType type = 1; string metric_family_name = 2; }
+func encodeWriteRequest(series []remoteWriteSeries, meta []remoteWriteMetadata, timestampMs int64) []byte {
+	var out, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.Name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.Value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(timestampMs))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, ts)
+	}
+	for _, m := range meta {
+		msg = msg[:0]
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(m.typ))
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, m.name)
+		out = protowire.AppendTag(out, 3, protowire.BytesType)
+		out = protowire.AppendBytes(out, msg)
+	}
+	return out
+}
+
+// postRemoteWrite sends an encoded WriteRequest, snappy compressed as the
+// protocol requires, along with any extra headers.
+func postRemoteWrite(client *http.Client, url string, req []byte, headers http.Header) error {
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, req)))
+	if err != nil {
+		return err
+	}
+	for name, values := range headers {
+		httpReq.Header[name] = values
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return CheckHTTPResponse(resp)
+}
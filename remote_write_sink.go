@@ -0,0 +1,268 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// remoteWriteFlushInterval is used when RemoteWriteOpts.FlushInterval
+	// is not set
+	remoteWriteFlushInterval = 10 * time.Second
+
+	// remoteWriteMaxSamples is used when RemoteWriteOpts.MaxSamplesPerSend
+	// is not set
+	remoteWriteMaxSamples = 2000
+)
+
+// RemoteWriteOpts is used to configure a RemoteWriteSink.
+type RemoteWriteOpts struct {
+	// URL is the remote write endpoint, for example
+	// "http://prometheus:9090/api/v1/write"
+	URL string
+
+	// BearerToken is sent in the Authorization header, if set
+	BearerToken string
+
+	// Headers are added to every request
+	Headers map[string]string
+
+	// TLSConfig configures TLS, including client certificates for mTLS.
+	// Alternatively CertFile and KeyFile load a client certificate and
+	// CAFile the certificates used to verify the server.
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+	CAFile    string
+
+	// MaxSamplesPerSend is the maximum number of samples per request, it
+	// defaults to 2000
+	MaxSamplesPerSend int
+
+	// FlushInterval is how often metrics are sent, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout using the TLS options. It cannot be combined with
+	// them.
+	HTTPClient *http.Client
+
+	// RetryPolicy applies to failed requests, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// RemoteWriteSink provides a MetricSink that sends to any receiver of the
+// Prometheus remote write protocol, such as Prometheus itself, Cortex, Mimir
+// or Thanos, so metrics do not need to be scraped. Metrics are aggregated in
+// memory and sent on every flush interval in batches of snappy compressed
+// protobuf.
+//
+// Labels become Prometheus labels. Gauges and key/value pairs report their
+// last value. Counters are sent as cumulative _total series and samples as
+// cumulative _count and _sum series, as with the M3Sink.
+type RemoteWriteSink struct {
+	url        string
+	headers    http.Header
+	client     *http.Client
+	retry      RetryPolicy
+	maxSamples int
+
+	agg        *intervalAggregator
+	cumulative *cumulativeSeries
+	loop       *flushLoop
+}
+
+// NewRemoteWriteSink creates a RemoteWriteSink and starts its flush loop.
+func NewRemoteWriteSink(opts RemoteWriteOpts) (*RemoteWriteSink, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("remote write URL is required")
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = remoteWriteFlushInterval
+	}
+	maxSamples := opts.MaxSamplesPerSend
+	if maxSamples <= 0 {
+		maxSamples = remoteWriteMaxSamples
+	}
+
+	tlsConfig, err := remoteWriteTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+		if tlsConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = tlsConfig
+			client.Transport = transport
+		}
+	} else if tlsConfig != nil {
+		return nil, fmt.Errorf("remote write TLS options cannot be combined with an HTTP client")
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	headers := make(http.Header)
+	for name, value := range opts.Headers {
+		headers.Set(name, value)
+	}
+	if opts.BearerToken != "" {
+		headers.Set("Authorization", "Bearer "+opts.BearerToken)
+	}
+
+	s := &RemoteWriteSink{
+		url:        opts.URL,
+		headers:    headers,
+		client:     client,
+		retry:      retry,
+		loop:       newFlushLoop(interval),
+		maxSamples: maxSamples,
+		agg:        newIntervalAggregator(),
+		cumulative: newCumulativeSeries(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+// remoteWriteTLSConfig builds the TLS configuration from the options, or
+// returns nil if none are set.
+func remoteWriteTLSConfig(opts RemoteWriteOpts) (*tls.Config, error) {
+	return clientTLSConfig("remote write", opts.TLSConfig, opts.CertFile, opts.KeyFile, opts.CAFile)
+}
+
+// clientTLSConfig clones base, adding the client certificate of certFile and
+// keyFile and the roots of caFile when set, or returns nil if nothing is set.
+// The name of the sink prefixes errors.
+func clientTLSConfig(name string, base *tls.Config, certFile, keyFile, caFile string) (*tls.Config, error) {
+	if base == nil && certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		config = base.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s client certificate: %w", name, err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s CA file: %w", name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s CA file %s", name, caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func (s *RemoteWriteSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *RemoteWriteSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *RemoteWriteSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *RemoteWriteSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *RemoteWriteSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *RemoteWriteSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *RemoteWriteSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+// RestoreCounters seeds the cumulative totals from a counter checkpoint, see
+// CumulativeSink.
+func (s *RemoteWriteSink) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	s.agg.restore(counters)
+}
+
+func (s *RemoteWriteSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *RemoteWriteSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the remote write sink supports.
+func (s *RemoteWriteSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// sent.
+func (s *RemoteWriteSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *RemoteWriteSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *RemoteWriteSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error sending to remote write! Err: %s", err)
+	}
+}
+
+// flush sends everything aggregated since the last flush, in batches of at
+// most maxSamples samples with the metadata in the first one. It is only
+// called from the flush loop, which owns the cumulative state.
+func (s *RemoteWriteSink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	if len(aggs) == 0 {
+		return nil
+	}
+	series, meta := s.cumulative.convert(aggs)
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+	for len(series) > 0 {
+		n := min(len(series), s.maxSamples)
+		req := encodeWriteRequest(series[:n], meta, now.UnixMilli())
+		err := s.retry.Do(ctx, "remote write", func() error {
+			return postRemoteWrite(s.client, s.url, req, s.headers)
+		})
+		if err != nil {
+			return err
+		}
+		series, meta = series[n:], nil
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestRemoteWriteSink(t *testing.T) {
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Scope-OrgID") != "team" {
+			t.Errorf("bad headers: %v", r.Header)
+		}
+		raw, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, raw)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	s, err := NewRemoteWriteSink(RemoteWriteOpts{
+		URL:               srv.URL + "/api/v1/write",
+		BearerToken:       "secret",
+		Headers:           map[string]string{"X-Scope-OrgID": "team"},
+		MaxSamplesPerSend: 2,
+		FlushInterval:     time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 4)
+	s.AddSample([]string{"latency"}, 10)
+	if err := s.flush(time.UnixMilli(5000)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected two batches, got %d", len(bodies))
+	}
+
+	first, types := decodeWriteRequest(t, bodies[0])
+	second, noTypes := decodeWriteRequest(t, bodies[1])
+	if len(first) != 2 || len(second) != 2 || len(noTypes) != 0 {
+		t.Fatalf("bad batches %v %v", first, second)
+	}
+	if types["requests_total"] != remoteWriteCounter || types["latency"] != remoteWriteSummary {
+		t.Fatalf("bad metadata %v", types)
+	}
+	counter := first[0]
+	if counter.value != 2 || counter.timestamp != 5000 || counter.labels[0] != (Label{"__name__", "requests_total"}) || counter.labels[1] != (Label{"code", "200"}) {
+		t.Fatalf("bad series %v", counter)
+	}
+}
+
+func TestRemoteWriteSink_MTLS(t *testing.T) {
+	var peers int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers = len(r.TLS.PeerCertificates)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		return path
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	s, err := NewRemoteWriteSink(RemoteWriteOpts{
+		URL:           srv.URL,
+		CertFile:      writePEM("client.crt", "CERTIFICATE", der),
+		KeyFile:       writePEM("client.key", "EC PRIVATE KEY", keyDER),
+		CAFile:        writePEM("ca.crt", "CERTIFICATE", srv.Certificate().Raw),
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"a"}, 1)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if peers != 1 {
+		t.Fatalf("expected a client certificate")
+	}
+}
+
+func TestNewRemoteWriteSink_Errors(t *testing.T) {
+	for _, opts := range []RemoteWriteOpts{
+		{},
+		{URL: "http://localhost", CAFile: "/does/not/exist"},
+		{URL: "http://localhost", TLSConfig: &tls.Config{}, HTTPClient: http.DefaultClient},
+	} {
+		if _, err := NewRemoteWriteSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries is a remote write series decoded by decodeWriteRequest
+type decodedSeries struct {
+	labels    []Label
+	value     float64
+	timestamp int64
+}
+
+// decodeWriteRequest decodes the messages produced by encodeWriteRequest,
+// returning the series and a map of metric family name to type.
+func decodeWriteRequest(t *testing.T, b []byte) ([]decodedSeries, map[string]int) {
+	t.Helper()
+	var series []decodedSeries
+	meta := make(map[string]int)
+
+	fields := func(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("bad tag")
+			}
+			b = b[n:]
+			n = fn(num, typ, b)
+			if n < 0 {
+				t.Fatalf("bad field %d", num)
+			}
+			b = b[n:]
+		}
+	}
+
+	fields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		msg, n := protowire.ConsumeBytes(b)
+		switch num {
+		case 1:
+			var s decodedSeries
+			fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				inner, n := protowire.ConsumeBytes(b)
+				switch num {
+				case 1:
+					var l Label
+					fields(inner, func(num protowire.Number, typ protowire.Type, b []byte) int {
+						v, n := protowire.ConsumeString(b)
+						if num == 1 {
+							l.Name = v
+						} else {
+							l.Value = v
+						}
+						return n
+					})
+					s.labels = append(s.labels, l)
+				case 2:
+					fields(inner, func(num protowire.Number, typ protowire.Type, b []byte) int {
+						if num == 1 {
+							v, n := protowire.ConsumeFixed64(b)
+							s.value = math.Float64frombits(v)
+							return n
+						}
+						v, n := protowire.ConsumeVarint(b)
+						s.timestamp = int64(v)
+						return n
+					})
+				}
+				return n
+			})
+			series = append(series, s)
+		case 3:
+			var name string
+			var mt int
+			fields(msg, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				if num == 1 {
+					v, n := protowire.ConsumeVarint(b)
+					mt = int(v)
+					return n
+				}
+				v, n := protowire.ConsumeString(b)
+				name = v
+				return n
+			})
+			meta[name] = mt
+		}
+		return n
+	})
+	return series, meta
+}
+
+func TestRemoteWrite_Encode(t *testing.T) {
+	c := newCumulativeSeries()
+	agg := newIntervalAggregator()
+	agg.record(aggregateCounter, []string{"http", "requests"}, 2, []Label{{"code", "200"}})
+	agg.record(aggregateGauge, []string{"queue depth"}, 4, nil)
+	agg.record(aggregateSample, []string{"latency"}, 3, nil)
+
+	series, meta := c.convert(agg.drain())
+	decoded, types := decodeWriteRequest(t, encodeWriteRequest(series, meta, 1234))
+
+	expected := []decodedSeries{
+		{[]Label{{"__name__", "http_requests_total"}, {"code", "200"}}, 2, 1234},
+		{[]Label{{"__name__", "queue_depth"}}, 4, 1234},
+		{[]Label{{"__name__", "latency_count"}}, 1, 1234},
+		{[]Label{{"__name__", "latency_sum"}}, 3, 1234},
+	}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Fatalf("got %v want %v", decoded, expected)
+	}
+	expectedTypes := map[string]int{
+		"http_requests_total": remoteWriteCounter,
+		"queue_depth":         remoteWriteGauge,
+		"latency":             remoteWriteSummary,
+	}
+	if !reflect.DeepEqual(types, expectedTypes) {
+		t.Fatalf("got %v want %v", types, expectedTypes)
+	}
+
+	// Counters keep accumulating across flushes
+	agg.record(aggregateCounter, []string{"http", "requests"}, 3, []Label{{"code", "200"}})
+	series, _ = c.convert(agg.drain())
+	if len(series) != 1 || series[0].value != 5 {
+		t.Fatalf("bad cumulative series: %v", series)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+// MetricRename describes a metric that is being renamed. Emissions using
+// either name are sent under the new name. While DualEmit is set and the
+// transition period has not ended, they are sent under the old name as well,
+// so dashboards and alerts can be migrated without a gap.
+type MetricRename struct {
+	Old []string
+	New []string
+
+	// DualEmit sends both the old and new names during the transition
+	DualEmit bool
+
+	// Until ends the transition period, after which only the new name is
+	// emitted. A zero value means dual emission never ends.
+	Until time.Time
+}
+
+// renameOldNameKey is the self-telemetry counter incremented every time code
+// emits a metric using its old name, labeled with that name. Once it stays at
+// zero every call site has been migrated.
+var renameOldNameKey = []string{"metrics", "rename", "old_name_emitted"}
+
+// renameTable maps both old and new flattened names to their rename entry
+type renameTable map[string]*MetricRename
+
+func newRenameTable(renames []MetricRename) renameTable {
+	if len(renames) == 0 {
+		return nil
+	}
+	t := make(renameTable, 2*len(renames))
+	for i := range renames {
+		r := &renames[i]
+		t[strings.Join(r.Old, ".")] = r
+		t[strings.Join(r.New, ".")] = r
+	}
+	return t
+}
+
+// renameMetric resolves a caller provided key against the rename table. It
+// returns the key to emit, and a second key to also emit when dual emission
+// is active, or nil.
+func (m *Metrics) renameMetric(key []string) ([]string, []string) {
+	if m.renames == nil {
+		return key, nil
+	}
+	flat := strings.Join(key, ".")
+	r, ok := m.renames[flat]
+	if !ok {
+		return key, nil
+	}
+
+	if flat == strings.Join(r.Old, ".") {
+		m.incrCounterWithLabels(renameOldNameKey, 1, []Label{{Name: "name", Value: flat}})
+	}
+
+	return r.keys()
+}
+
+// renamedKeys is renameMetric without counting the use of an old name, for
+// keys which are not being emitted by a caller.
+func (m *Metrics) renamedKeys(key []string) ([]string, []string) {
+	if r, ok := m.renames[strings.Join(key, ".")]; ok {
+		return r.keys()
+	}
+	return key, nil
+}
+
+// keys returns the key to emit, and the old key while dual emission is
+// active, or nil.
+func (r *MetricRename) keys() ([]string, []string) {
+	if r.DualEmit && (r.Until.IsZero() || time.Now().Before(r.Until)) {
+		return r.New, r.Old
+	}
+	return r.New, nil
+}
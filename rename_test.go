@@ -0,0 +1,42 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Renames(t *testing.T) {
+	m, met := mockMetric()
+	met.renames = newRenameTable([]MetricRename{
+		{Old: []string{"old", "dual"}, New: []string{"new", "dual"}, DualEmit: true},
+		{Old: []string{"old", "plain"}, New: []string{"new", "plain"}},
+		{Old: []string{"old", "expired"}, New: []string{"new", "expired"}, DualEmit: true, Until: time.Now().Add(-time.Hour)},
+	})
+
+	met.IncrCounter([]string{"new", "dual"}, 1)
+	met.SetGauge([]string{"old", "plain"}, 2)
+	met.AddSample([]string{"new", "expired"}, 3)
+	met.EmitKey([]string{"unrelated"}, 4)
+
+	expected := [][]string{
+		{"old", "dual"},
+		{"new", "dual"},
+		{"metrics", "rename", "old_name_emitted"},
+		{"new", "plain"},
+		{"new", "expired"},
+		{"unrelated"},
+	}
+	if got := m.getKeys(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v want %v", got, expected)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{1, 1, 1, 2, 3, 4}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	if !reflect.DeepEqual(m.labels[2], []Label{{"name", "old.plain"}}) {
+		t.Fatalf("bad labels: %v", m.labels[2])
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy describes how push sinks retry failed requests, so every sink
+// behaves the same way during an outage.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Values below one are treated as one, disabling retries.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, doubled for every
+	// following attempt up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Retryable classifies errors, it defaults to IsRetryable.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy is used by push sinks configured without a RetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// Do calls fn until it succeeds, returns an error which is not retryable, or
+// the attempts run out. A retry is never scheduled past the deadline of ctx,
+// typically the next flush, and cancelling ctx stops waiting for one. The
+// last error is returned.
+func (p RetryPolicy) Do(ctx context.Context, name string, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	backoff := p.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		if hasDeadline && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		log.Printf("[WARN] Error pushing to %s, retrying in %s! Err: %s", name, backoff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// HTTPStatusError is returned by push sinks when an endpoint responds with a
+// status other than 2xx.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s: %s", e.Status, e.Body)
+}
+
+// CheckHTTPResponse returns an HTTPStatusError, including the start of the
+// body, if resp does not have a 2xx status.
+func CheckHTTPResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       string(bytes.TrimSpace(msg)),
+	}
+}
+
+// IsRetryable is the default error classification of RetryPolicy. Request
+// timeouts, throttling and server errors are retried, other HTTP statuses
+// are not as the same request would fail again. Any other error, such as a
+// connection failure, is retried unless it is a context cancellation.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	switch code := statusErr.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return true
+	case code == http.StatusNotImplemented:
+		return false
+	default:
+		return code >= 500
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Do(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	calls := 0
+	err := p.Do(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("bad: %v %d", err, calls)
+	}
+
+	calls = 0
+	err = p.Do(context.Background(), "test", func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if err == nil || calls != 3 {
+		t.Fatalf("attempts should run out: %v %d", err, calls)
+	}
+
+	calls = 0
+	err = p.Do(context.Background(), "test", func() error {
+		calls++
+		return &HTTPStatusError{StatusCode: 400, Status: "400 Bad Request"}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("bad request should not be retried: %v %d", err, calls)
+	}
+}
+
+func TestRetryPolicy_Deadline(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	calls := 0
+	_ = p.Do(ctx, "test", func() error {
+		calls++
+		return errors.New("connection refused")
+	})
+	if calls != 1 {
+		t.Fatalf("retry should not run past the deadline: %d", calls)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for code, want := range map[int]bool{
+		400: false, 401: false, 404: false, 408: true, 429: true,
+		500: true, 501: false, 502: true, 503: true,
+	} {
+		err := fmt.Errorf("push: %w", &HTTPStatusError{StatusCode: code, Status: http.StatusText(code)})
+		if got := IsRetryable(err); got != want {
+			t.Fatalf("status %d: got %v", code, got)
+		}
+	}
+	if IsRetryable(context.Canceled) {
+		t.Fatalf("cancellation should not be retried")
+	}
+	if !IsRetryable(errors.New("connection reset")) {
+		t.Fatalf("network errors should be retried")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3SnapshotInterval is used when S3SnapshotOpts.Interval is not set
+const s3SnapshotInterval = 5 * time.Minute
+
+// S3SnapshotOpts is used to configure an S3SnapshotSink.
+type S3SnapshotOpts struct {
+	// Bucket receives the snapshots, it is required
+	Bucket string
+
+	// Prefix is prepended to the key of every snapshot, such as
+	// "metrics/device-42/"
+	Prefix string
+
+	// Region is the region of the bucket. It defaults to the AWS_REGION or
+	// AWS_DEFAULT_REGION environment variables.
+	Region string
+
+	// Endpoint is the URL of an S3-compatible object store, such as
+	// "http://minio:9000", which is addressed with path-style URLs. It
+	// defaults to the virtual-hosted endpoint of the bucket on AWS.
+	Endpoint string
+
+	// AccessKeyID, SecretAccessKey and SessionToken sign requests. They
+	// default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN environment variables, and then to the temporary
+	// credentials of a web identity, such as IAM roles for service
+	// accounts on EKS, an ECS task role or the EC2 instance profile, which
+	// are refreshed before they expire.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Interval is the length of the aggregation intervals, each of which is
+	// uploaded once it ended. It defaults to 5 minutes.
+	Interval time.Duration
+
+	// Codec encodes the snapshots, it defaults to JSONSnapshotCodec
+	Codec SnapshotCodec
+
+	// HTTPClient is used for uploads, it defaults to a client with a 30
+	// second timeout
+	HTTPClient *http.Client
+
+	// RetryPolicy applies to failed uploads, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// S3SnapshotSink provides a MetricSink which archives aggregated intervals to
+// an S3-compatible bucket. Metrics are aggregated by an embedded InmemSink,
+// and every interval is uploaded once it ended as an object holding its
+// MetricsSummary, in the format served by DisplayMetricsHandler with the
+// configured codec. Objects are keyed by the start of their interval:
+//
+//	<prefix>2024/01/02/150400Z.json
+//
+// An interval which fails to upload is tried again on the next flush, as
+// long as it is retained, which is for three intervals.
+type S3SnapshotSink struct {
+	*InmemSink
+
+	url    *url.URL
+	region string
+	creds  *awsCredentialSource
+	prefix string
+	codec  SnapshotCodec
+	client *http.Client
+	retry  RetryPolicy
+	loop   *flushLoop
+
+	// uploaded is the start of the last interval uploaded, only used from
+	// the flush loop
+	uploaded time.Time
+}
+
+// NewS3SnapshotSink creates an S3SnapshotSink and starts uploading the
+// intervals as they end.
+func NewS3SnapshotSink(opts S3SnapshotOpts) (*S3SnapshotSink, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	region := opts.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("s3 region is required")
+	}
+	endpoint := strings.TrimSuffix(opts.Endpoint, "/") + "/" + opts.Bucket
+	if opts.Endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", opts.Bucket, region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = s3SnapshotInterval
+	}
+	codec := opts.Codec
+	if codec == nil {
+		codec = JSONSnapshotCodec
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	creds, err := newAWSCredentialSource(client, awsCredentials{
+		accessKeyID:     opts.AccessKeyID,
+		secretAccessKey: opts.SecretAccessKey,
+		sessionToken:    opts.SessionToken,
+	}, region)
+	if err != nil {
+		return nil, err
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	// Ended intervals are retained until a flush has uploaded them
+	s := &S3SnapshotSink{
+		InmemSink: NewInmemSink(interval, 3*interval),
+		url:       u,
+		region:    region,
+		creds:     creds,
+		prefix:    opts.Prefix,
+		codec:     codec,
+		client:    client,
+		retry:     retry,
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+// Shutdown stops the flush loop and blocks while the current interval, which
+// has not ended yet, is uploaded.
+func (s *S3SnapshotSink) Shutdown() {
+	s.loop.stop()
+}
+
+func (s *S3SnapshotSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now, final); err != nil {
+		log.Printf("[ERR] Error uploading snapshot to S3! Err: %s", err)
+	}
+}
+
+// flush uploads the intervals which ended since the last upload, and the
+// current interval as well when final is set. It stops at the first
+// failure, so the remaining intervals are tried again by the next flush.
+func (s *S3SnapshotSink) flush(now time.Time, final bool) error {
+	current := now.Truncate(s.interval)
+
+	s.intervalLock.RLock()
+	var pending []*IntervalMetrics
+	for _, intv := range s.intervals {
+		if !intv.Interval.After(s.uploaded) {
+			continue
+		}
+		if intv.Interval.Before(current) || final {
+			pending = append(pending, intv)
+		}
+	}
+	s.intervalLock.RUnlock()
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(s.interval))
+	defer cancel()
+	for _, intv := range pending {
+		summary := newMetricSummaryFromInterval(intv)
+		var buf bytes.Buffer
+		if err := s.codec.Encode(&buf, &summary); err != nil {
+			return err
+		}
+		key := s.objectKey(intv.Interval)
+		err := s.retry.Do(ctx, "S3", func() error {
+			return s.put(key, buf.Bytes(), time.Now())
+		})
+		if err != nil {
+			return fmt.Errorf("uploading %s: %w", key, err)
+		}
+		s.uploaded = intv.Interval
+	}
+	return nil
+}
+
+// objectKey returns the key of the snapshot of the interval starting at
+// start.
+func (s *S3SnapshotSink) objectKey(start time.Time) string {
+	return s.prefix + start.UTC().Format("2006/01/02/150405Z") + "." + s.codec.Name()
+}
+
+// put uploads an object with a signed PutObject request.
+func (s *S3SnapshotSink) put(key string, body []byte, now time.Time) error {
+	// Every segment of the key is escaped once, as S3 signs the path
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	u := *s.url
+	u.RawPath = strings.TrimSuffix(s.url.EscapedPath(), "/") + "/" + strings.Join(segments, "/")
+	u.Path = strings.TrimSuffix(s.url.Path, "/") + "/" + key
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("Content-Type", s.codec.ContentType())
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	creds, err := s.creds.credentials(req.Context())
+	if err != nil {
+		return err
+	}
+	signV4(req, body, creds, s.region, "s3", now)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return CheckHTTPResponse(resp)
+}
@@ -0,0 +1,161 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3Bucket is a fake S3-compatible store recording the objects put into it
+type s3Bucket struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+	headers http.Header
+	fail    int
+}
+
+func newS3Bucket(t *testing.T) (*s3Bucket, *httptest.Server) {
+	b := &s3Bucket{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.fail > 0 {
+			b.fail--
+			http.Error(resp, "AccessDenied", http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		b.objects[req.Method+" "+req.URL.EscapedPath()] = body
+		b.headers = req.Header.Clone()
+	}))
+	t.Cleanup(srv.Close)
+	return b, srv
+}
+
+func newTestS3SnapshotSink(t *testing.T, endpoint string) *S3SnapshotSink {
+	t.Helper()
+	s, err := NewS3SnapshotSink(S3SnapshotOpts{
+		Bucket:          "archive",
+		Prefix:          "fleet/device 42/",
+		Region:          "eu-west-1",
+		Endpoint:        endpoint,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Interval:        time.Hour,
+		RetryPolicy:     &RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	return s
+}
+
+func TestS3SnapshotSink(t *testing.T) {
+	b, srv := newS3Bucket(t)
+	s := newTestS3SnapshotSink(t, srv.URL)
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	start := time.Now().Truncate(time.Hour)
+	s.Shutdown()
+
+	key := "PUT /archive/fleet/device%2042/" + start.UTC().Format("2006/01/02/150405Z") + ".json"
+	body, ok := b.objects[key]
+	if !ok {
+		t.Fatalf("expected %s to be uploaded, got %v", key, b.objects)
+	}
+	var summary MetricsSummary
+	if err := JSONSnapshotCodec.Decode(bytes.NewReader(body), &summary); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(summary.Counters) != 1 || summary.Counters[0].Name != "api.requests" || summary.Counters[0].Sum != 2 {
+		t.Fatalf("bad counters %+v", summary.Counters)
+	}
+	if len(summary.Gauges) != 1 || summary.Gauges[0].Value != 7 {
+		t.Fatalf("bad gauges %+v", summary.Gauges)
+	}
+
+	sum := sha256.Sum256(body)
+	if got := b.headers.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("bad payload hash %s", got)
+	}
+	auth := b.headers.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") ||
+		!strings.Contains(auth, "x-amz-content-sha256") {
+		t.Fatalf("bad authorization %s", auth)
+	}
+	if b.headers.Get("Content-Type") != "application/json" {
+		t.Fatalf("bad content type %s", b.headers.Get("Content-Type"))
+	}
+}
+
+func TestS3SnapshotSink_EndedIntervals(t *testing.T) {
+	b, srv := newS3Bucket(t)
+	s := newTestS3SnapshotSink(t, srv.URL)
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"a"}, 1)
+	now := time.Now()
+
+	// The current interval has not ended yet
+	if err := s.flush(now, false); err != nil || len(b.objects) != 0 {
+		t.Fatalf("expected nothing to be uploaded, got %v %v", b.objects, err)
+	}
+
+	// A failed upload is tried again by the next flush
+	b.fail = 1
+	if err := s.flush(now.Add(time.Hour), false); err == nil {
+		t.Fatalf("expected the upload to fail")
+	}
+	if err := s.flush(now.Add(time.Hour), false); err != nil || len(b.objects) != 1 {
+		t.Fatalf("expected the interval to be uploaded, got %v %v", b.objects, err)
+	}
+	if err := s.flush(now.Add(2*time.Hour), false); err != nil || len(b.objects) != 1 {
+		t.Fatalf("expected the interval to be uploaded once, got %v %v", b.objects, err)
+	}
+}
+
+func TestNewS3SnapshotSink(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for _, opts := range []S3SnapshotOpts{
+		{Region: "us-east-1", AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		{Bucket: "archive", AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		{Bucket: "archive", Region: "us-east-1"},
+	} {
+		if _, err := NewS3SnapshotSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+
+	s, err := NewS3SnapshotSink(S3SnapshotOpts{
+		Bucket:          "archive",
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		Codec:           ProtobufSnapshotCodec,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.url.String() != "https://archive.s3.us-east-1.amazonaws.com" {
+		t.Fatalf("bad url %s", s.url)
+	}
+	if key := s.objectKey(time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)); key != "2024/01/02/150400Z.protobuf" {
+		t.Fatalf("bad key %s", key)
+	}
+}
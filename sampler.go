@@ -0,0 +1,142 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveSampler monitors the emission rate of each metric key and lowers
+// the sample rate of keys that exceed a per-window budget. Rates are
+// recomputed at the end of every window, so a key that calms down is
+// restored to full fidelity automatically.
+//
+// Counters that pass through the sampler are scaled by the inverse of the
+// sample rate so that totals remain approximately correct. Gauges and
+// samples are simply thinned out.
+type AdaptiveSampler struct {
+	// budget is the number of emissions allowed per key in each window
+	budget int
+
+	// window is how long emissions are counted before rates are adjusted
+	window time.Duration
+
+	lock  sync.Mutex
+	start time.Time
+	keys  map[string]*samplerState
+}
+
+type samplerState struct {
+	seen int
+
+	// The sample rate is kept as the ratio keep/of to avoid accumulating
+	// floating point error. A zero of means the key is sampled at full rate.
+	keep int
+	of   int
+}
+
+func (s *samplerState) rate() float64 {
+	if s.of == 0 {
+		return 1
+	}
+	return float64(s.keep) / float64(s.of)
+}
+
+// NewAdaptiveSampler creates an AdaptiveSampler that allows up to budget
+// emissions per key in every window before reducing the sample rate.
+func NewAdaptiveSampler(budget int, window time.Duration) *AdaptiveSampler {
+	if budget < 1 {
+		budget = 1
+	}
+	return &AdaptiveSampler{
+		budget: budget,
+		window: window,
+		keys:   make(map[string]*samplerState),
+	}
+}
+
+// Sample records an emission for the given key and reports whether it should
+// be kept, along with the sample rate currently applied to the key.
+func (a *AdaptiveSampler) Sample(key string) (bool, float64) {
+	return a.sampleAt(key, time.Now())
+}
+
+// Budget returns the number of emissions allowed per key in each window.
+func (a *AdaptiveSampler) Budget() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.budget
+}
+
+// SetBudget changes the number of emissions allowed per key in each window,
+// taking effect when the current window ends. Raising it at runtime is a
+// way to turn up telemetry fidelity during an incident.
+func (a *AdaptiveSampler) SetBudget(budget int) {
+	if budget < 1 {
+		budget = 1
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.budget = budget
+}
+
+// Rate returns the sample rate currently applied to a key. Keys that have not
+// been seen are sampled at full rate.
+func (a *AdaptiveSampler) Rate(key string) float64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if s, ok := a.keys[key]; ok {
+		return s.rate()
+	}
+	return 1
+}
+
+// sampleAt allows internal testing of the window logic without mocking clocks.
+func (a *AdaptiveSampler) sampleAt(key string, now time.Time) (bool, float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.start.IsZero() {
+		a.start = now
+	} else if now.Sub(a.start) >= a.window {
+		a.adjust()
+		a.start = now
+	}
+
+	s, ok := a.keys[key]
+	if !ok {
+		s = &samplerState{}
+		a.keys[key] = s
+	}
+	s.seen++
+	if s.of == 0 {
+		return true, 1
+	}
+
+	// Keep an emission whenever the running share of kept emissions crosses
+	// an integer boundary, so they are spread evenly across the window
+	// instead of being clustered at the start.
+	keep := s.seen*s.keep/s.of > (s.seen-1)*s.keep/s.of
+	return keep, s.rate()
+}
+
+// adjust recomputes per-key rates from the volume seen in the last window.
+// The caller must hold a.lock.
+func (a *AdaptiveSampler) adjust() {
+	for key, s := range a.keys {
+		if s.seen == 0 {
+			// Forget idle keys so the sampler stays bounded
+			delete(a.keys, key)
+			continue
+		}
+		if s.seen > a.budget {
+			s.keep, s.of = a.budget, s.seen
+		} else {
+			s.keep, s.of = 0, 0
+		}
+		s.seen = 0
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveSampler(t *testing.T) {
+	a := NewAdaptiveSampler(10, time.Second)
+	now := time.Now()
+
+	// Everything is kept in the first window
+	for i := 0; i < 100; i++ {
+		if keep, rate := a.sampleAt("hot", now); !keep || rate != 1 {
+			t.Fatalf("bad: %v %v", keep, rate)
+		}
+	}
+	a.sampleAt("cold", now)
+
+	// The hot key is throttled down to its budget in the next window
+	now = now.Add(time.Second)
+	kept := 0
+	for i := 0; i < 100; i++ {
+		keep, rate := a.sampleAt("hot", now)
+		if rate != 0.1 {
+			t.Fatalf("bad rate: %v", rate)
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept != 10 {
+		t.Fatalf("bad kept: %d", kept)
+	}
+	if rate := a.Rate("cold"); rate != 1 {
+		t.Fatalf("bad rate: %v", rate)
+	}
+
+	// Once volume drops the key is restored to full rate
+	now = now.Add(time.Second)
+	for i := 0; i < 5; i++ {
+		a.sampleAt("hot", now)
+	}
+	now = now.Add(time.Second)
+	if keep, rate := a.sampleAt("hot", now); !keep || rate != 1 {
+		t.Fatalf("bad: %v %v", keep, rate)
+	}
+
+	// Idle keys are forgotten
+	a.lock.Lock()
+	_, ok := a.keys["cold"]
+	a.lock.Unlock()
+	if ok {
+		t.Fatalf("idle key should have been dropped")
+	}
+}
+
+func TestMetrics_AdaptiveSampler(t *testing.T) {
+	m, met := mockMetric()
+	met.AdaptiveSampler = NewAdaptiveSampler(1, time.Hour)
+	met.AdaptiveSampler.sampleAt("key", time.Now().Add(-time.Hour))
+	met.AdaptiveSampler.sampleAt("key", time.Now().Add(-time.Hour))
+
+	// The key is now sampled at 50%, so every other increment is kept and
+	// scaled up to preserve the total.
+	for i := 0; i < 4; i++ {
+		met.IncrCounter([]string{"key"}, 1)
+	}
+	if len(m.getKeys()) != 2 {
+		t.Fatalf("bad keys: %v", m.getKeys())
+	}
+	for _, v := range m.vals {
+		if v != 2 {
+			t.Fatalf("bad val: %v", m.vals)
+		}
+	}
+}
+
+func TestAdaptiveSampler_SetBudget(t *testing.T) {
+	s := NewAdaptiveSampler(2, time.Minute)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		s.sampleAt("hot", start)
+	}
+
+	// The new budget applies from the next window
+	s.SetBudget(5)
+	if s.Budget() != 5 {
+		t.Fatalf("bad budget: %d", s.Budget())
+	}
+	if _, rate := s.sampleAt("hot", start.Add(time.Minute)); rate != 0.5 {
+		t.Fatalf("bad rate: %v", rate)
+	}
+
+	s.SetBudget(0)
+	if s.Budget() != 1 {
+		t.Fatalf("budget should be at least one: %d", s.Budget())
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"time"
+)
+
+// Scope emits metrics through a Metrics instance with a fixed set of labels,
+// merged once when the scope is created rather than on every call. It is
+// meant to be held by a worker for its whole lifetime, or taken from a
+// sync.Pool and reset per job, so hot loops never rebuild label slices.
+//
+// A Scope is not safe for concurrent use while it is being Reset, but its
+// emit methods may be called concurrently.
+type Scope struct {
+	m      *Metrics
+	labels []Label
+
+	// global is set for scopes of the global instance, which emit nothing
+	// while SetGlobalDisabled is in effect
+	global bool
+}
+
+// NewScope creates a Scope which adds the given labels to every metric.
+func (m *Metrics) NewScope(labels ...Label) *Scope {
+	s := &Scope{m: m}
+	s.Reset(labels...)
+	return s
+}
+
+// With returns a child Scope with additional labels. Labels with the same
+// name as one of the parent's replace it.
+func (s *Scope) With(labels ...Label) *Scope {
+	merged := make([]Label, len(s.labels), len(s.labels)+len(labels))
+	copy(merged, s.labels)
+	return &Scope{m: s.m, labels: mergeLabels(merged, labels), global: s.global}
+}
+
+// Reset replaces the labels of the scope, reusing its storage where
+// possible, so scopes can be recycled through a sync.Pool.
+func (s *Scope) Reset(labels ...Label) {
+	s.labels = mergeLabels(s.labels[:0], labels)
+}
+
+// Labels returns a copy of the labels of the scope.
+func (s *Scope) Labels() []Label {
+	return append([]Label(nil), s.labels...)
+}
+
+func (s *Scope) SetGauge(key []string, val float32) {
+	if s.disabled() {
+		return
+	}
+	s.m.SetGaugeWithLabels(key, val, s.capped())
+}
+
+func (s *Scope) SetPrecisionGauge(key []string, val float64) {
+	if s.disabled() {
+		return
+	}
+	s.m.SetPrecisionGaugeWithLabels(key, val, s.capped())
+}
+
+func (s *Scope) IncrCounter(key []string, val float32) {
+	if s.disabled() {
+		return
+	}
+	s.m.IncrCounterWithLabels(key, val, s.capped())
+}
+
+func (s *Scope) AddSample(key []string, val float32) {
+	if s.disabled() {
+		return
+	}
+	s.m.AddSampleWithLabels(key, val, s.capped())
+}
+
+func (s *Scope) MeasureSince(key []string, start time.Time) {
+	if s.disabled() {
+		return
+	}
+	s.m.MeasureSinceWithLabels(key, start, s.capped())
+}
+
+// disabled reports whether the scope belongs to the global instance while
+// it is disabled, see SetGlobalDisabled.
+func (s *Scope) disabled() bool {
+	return s.global && globalDisabled.Load()
+}
+
+// capped returns the labels with their capacity limited to their length, so
+// host and service labels appended downstream never write into the scope's
+// storage.
+func (s *Scope) capped() []Label {
+	return s.labels[:len(s.labels):len(s.labels)]
+}
+
+// mergeLabels appends extra to dst, replacing labels of dst with the same
+// name instead of duplicating them.
+func mergeLabels(dst []Label, extra []Label) []Label {
+NEXT:
+	for _, l := range extra {
+		for i := range dst {
+			if dst[i].Name == l.Name {
+				dst[i].Value = l.Value
+				continue NEXT
+			}
+		}
+		dst = append(dst, l)
+	}
+	return dst
+}
@@ -0,0 +1,43 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	m, met := mockMetric()
+	met.HostName = "node1"
+	met.EnableHostnameLabel = true
+
+	worker := met.NewScope(Label{"pool", "ingest"}, Label{"worker", "1"})
+	job := worker.With(Label{"worker", "2"}, Label{"tenant", "a"})
+
+	worker.IncrCounter([]string{"jobs"}, 1)
+	job.AddSample([]string{"latency"}, 5)
+
+	if !reflect.DeepEqual(m.labels[0], []Label{{"pool", "ingest"}, {"worker", "1"}, {"host", "node1"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+	if !reflect.DeepEqual(m.labels[1], []Label{{"pool", "ingest"}, {"worker", "2"}, {"tenant", "a"}, {"host", "node1"}}) {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+
+	// Neither the child nor the downstream host label leak into the scope
+	if !reflect.DeepEqual(worker.Labels(), []Label{{"pool", "ingest"}, {"worker", "1"}}) {
+		t.Fatalf("scope labels modified: %v", worker.Labels())
+	}
+}
+
+func TestScope_Reset(t *testing.T) {
+	m, met := mockMetric()
+	s := met.NewScope(Label{"job", "1"}, Label{"tenant", "a"})
+	s.Reset(Label{"job", "2"})
+	s.SetGauge([]string{"g"}, 1)
+	if !reflect.DeepEqual(m.labels[0], []Label{{"job", "2"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// signalFxFlushInterval is used when SignalFxOpts.FlushInterval is not
+	// set
+	signalFxFlushInterval = 10 * time.Second
+
+	// signalFxBatchSize is used when SignalFxOpts.BatchSize is not set
+	signalFxBatchSize = 5000
+
+	// signalFxRealm is used when neither SignalFxOpts.Realm nor Endpoint is
+	// set
+	signalFxRealm = "us0"
+)
+
+// Metric types of the SignalFx DataPoint message
+const (
+	signalFxGauge             = 0
+	signalFxCounter           = 1
+	signalFxCumulativeCounter = 3
+)
+
+// signalFxJSONTypes names the metric types in the JSON format
+var signalFxJSONTypes = map[int]string{
+	signalFxGauge:             "gauge",
+	signalFxCounter:           "counter",
+	signalFxCumulativeCounter: "cumulative_counter",
+}
+
+// SignalFxOpts is used to configure a SignalFxSink.
+type SignalFxOpts struct {
+	// Token is the access token used for requests, it can be replaced later
+	// with SignalFxSink.SetToken. It is required.
+	Token string
+
+	// Realm selects the ingest endpoint of the organization, it defaults to
+	// "us0". Endpoint overrides the address entirely.
+	Realm    string
+	Endpoint string
+
+	// Dimensions are added to every datapoint
+	Dimensions map[string]string
+
+	// DeltaCounters sends counters as the "counter" type holding the change
+	// over each interval. Otherwise counters are sent as the
+	// "cumulative_counter" type with their running total since the sink was
+	// created.
+	DeltaCounters bool
+
+	// Protobuf sends datapoints in the protobuf format rather than JSON
+	Protobuf bool
+
+	// FlushInterval is how often datapoints are sent, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the maximum number of datapoints per request, it
+	// defaults to 5000
+	BatchSize int
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of requests, which are gzip
+	// compressed by default
+	Compression HTTPCompression
+
+	// RetryPolicy applies to failed requests, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// SignalFxSink provides a MetricSink that sends datapoints to the SignalFx
+// (Splunk Observability Cloud) ingest API. Metrics are aggregated in memory
+// and sent on every flush interval.
+//
+// The key, joined with '.', becomes the metric name and labels become
+// dimensions. Gauges and key/value pairs are sent as gauges, counters as
+// cumulative or delta counters, and samples as a .count counter along with
+// .mean, .min and .max gauges.
+type SignalFxSink struct {
+	url         string
+	token       atomic.Pointer[string]
+	contentType string
+	protobuf    bool
+	dimensions  []Label
+	delta       bool
+	batchSize   int
+	client      *http.Client
+	encoder     *HTTPEncoder
+	retry       RetryPolicy
+
+	// totals holds the running totals of counters, only used from the flush
+	// loop
+	totals map[string]float64
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewSignalFxSink creates a SignalFxSink and starts its flush loop.
+func NewSignalFxSink(opts SignalFxOpts) (*SignalFxSink, error) {
+	if opts.Token == "" {
+		return nil, fmt.Errorf("signalfx access token is required")
+	}
+	endpoint := strings.TrimSuffix(opts.Endpoint, "/")
+	if endpoint == "" {
+		realm := opts.Realm
+		if realm == "" {
+			realm = signalFxRealm
+		}
+		endpoint = "https://ingest." + realm + ".signalfx.com"
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = signalFxFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = signalFxBatchSize
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+	encoder, err := NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	var dims []Label
+	for name, value := range opts.Dimensions {
+		dims = append(dims, Label{Name: signalFxDimension(name), Value: value})
+	}
+	sort.Slice(dims, func(i, j int) bool { return dims[i].Name < dims[j].Name })
+
+	s := &SignalFxSink{
+		url:         endpoint + "/v2/datapoint",
+		contentType: "application/json",
+		protobuf:    opts.Protobuf,
+		dimensions:  dims,
+		delta:       opts.DeltaCounters,
+		batchSize:   batchSize,
+		loop:        newFlushLoop(interval),
+		client:      client,
+		encoder:     encoder,
+		retry:       retry,
+		totals:      make(map[string]float64),
+		agg:         newIntervalAggregator(),
+	}
+	if opts.Protobuf {
+		s.contentType = "application/x-protobuf"
+	}
+	s.SetToken(opts.Token)
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+// SetToken replaces the access token, taking effect from the next request,
+// so tokens can be rotated without recreating the sink.
+func (s *SignalFxSink) SetToken(token string) {
+	s.token.Store(&token)
+}
+
+func (s *SignalFxSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SignalFxSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *SignalFxSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *SignalFxSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *SignalFxSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *SignalFxSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SignalFxSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *SignalFxSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SignalFxSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the SignalFx sink supports.
+func (s *SignalFxSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining datapoints
+// are sent.
+func (s *SignalFxSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often datapoints are sent, starting from now.
+func (s *SignalFxSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *SignalFxSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error sending to SignalFx! Err: %s", err)
+	}
+}
+
+// signalFxPoint is a single SignalFx datapoint
+type signalFxPoint struct {
+	metric string
+	typ    int
+	value  float64
+	dims   []Label
+}
+
+// signalFxJSONPoint is a datapoint in the JSON format
+type signalFxJSONPoint struct {
+	Metric     string            `json:"metric"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+}
+
+// flush sends everything aggregated since the last flush in batches.
+func (s *SignalFxSink) flush(now time.Time) error {
+	points := s.points(s.agg.drain())
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	ts := now.UnixMilli()
+	for len(points) > 0 {
+		n := min(len(points), s.batchSize)
+		var body []byte
+		if s.protobuf {
+			body = encodeSignalFxProtobuf(points[:n], ts)
+		} else {
+			var err error
+			if body, err = encodeSignalFxJSON(points[:n], ts); err != nil {
+				return err
+			}
+		}
+		err := s.retry.Do(ctx, "SignalFx", func() error {
+			headers := make(http.Header)
+			headers.Set("Content-Type", s.contentType)
+			headers.Set("X-SF-Token", *s.token.Load())
+			resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, headers)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = resp.Body.Close() }()
+			return CheckHTTPResponse(resp)
+		})
+		if err != nil {
+			return err
+		}
+		points = points[n:]
+	}
+	return nil
+}
+
+// points converts aggregates into datapoints.
+func (s *SignalFxSink) points(aggs []*aggregate) []signalFxPoint {
+	var out []signalFxPoint
+	for _, a := range aggs {
+		name := strings.Join(a.key, ".")
+		dims := s.dims(a.labels)
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			out = append(out, signalFxPoint{name, signalFxGauge, a.last, dims})
+		case aggregateCounter:
+			if s.delta {
+				out = append(out, signalFxPoint{name, signalFxCounter, a.sum, dims})
+				continue
+			}
+			id := seriesKey(a.key, a.labels)
+			s.totals[id] += a.sum
+			out = append(out, signalFxPoint{name, signalFxCumulativeCounter, s.totals[id], dims})
+		case aggregateSample:
+			out = append(out,
+				signalFxPoint{name + ".count", signalFxCounter, float64(a.count), dims},
+				signalFxPoint{name + ".mean", signalFxGauge, a.mean(), dims},
+				signalFxPoint{name + ".min", signalFxGauge, a.min, dims},
+				signalFxPoint{name + ".max", signalFxGauge, a.max, dims},
+			)
+		}
+	}
+	return out
+}
+
+// dims merges the global dimensions with labels, which take precedence, and
+// sanitizes their names.
+func (s *SignalFxSink) dims(labels []Label) []Label {
+	out := make([]Label, 0, len(s.dimensions)+len(labels))
+	for _, d := range s.dimensions {
+		if !hasLabel(labels, d.Name) {
+			out = append(out, d)
+		}
+	}
+	for _, l := range labels {
+		out = append(out, Label{Name: signalFxDimension(l.Name), Value: l.Value})
+	}
+	return out
+}
+
+// signalFxDimension replaces characters which are not allowed in dimension
+// names. Names must also start with a letter.
+func signalFxDimension(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if name == "" || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		name = "d" + name
+	}
+	return name
+}
+
+// encodeSignalFxJSON encodes datapoints in the JSON format, grouped by type.
+func encodeSignalFxJSON(points []signalFxPoint, ts int64) ([]byte, error) {
+	byType := make(map[string][]signalFxJSONPoint)
+	for _, p := range points {
+		jp := signalFxJSONPoint{Metric: p.metric, Value: p.value, Timestamp: ts}
+		if len(p.dims) > 0 {
+			jp.Dimensions = make(map[string]string, len(p.dims))
+			for _, d := range p.dims {
+				jp.Dimensions[d.Name] = d.Value
+			}
+		}
+		typ := signalFxJSONTypes[p.typ]
+		byType[typ] = append(byType[typ], jp)
+	}
+	return json.Marshal(byType)
+}
+
+// encodeSignalFxProtobuf encodes datapoints as a DataPointUploadMessage.
+func encodeSignalFxProtobuf(points []signalFxPoint, ts int64) []byte {
+	var out, dp, datum, dim []byte
+	for _, p := range points {
+		dp = dp[:0]
+		dp = protowire.AppendTag(dp, 2, protowire.BytesType)
+		dp = protowire.AppendString(dp, p.metric)
+		dp = protowire.AppendTag(dp, 3, protowire.VarintType)
+		dp = protowire.AppendVarint(dp, uint64(ts))
+
+		datum = datum[:0]
+		datum = protowire.AppendTag(datum, 2, protowire.Fixed64Type)
+		datum = protowire.AppendFixed64(datum, math.Float64bits(p.value))
+		dp = protowire.AppendTag(dp, 4, protowire.BytesType)
+		dp = protowire.AppendBytes(dp, datum)
+
+		dp = protowire.AppendTag(dp, 5, protowire.VarintType)
+		dp = protowire.AppendVarint(dp, uint64(p.typ))
+		for _, d := range p.dims {
+			dim = dim[:0]
+			dim = protowire.AppendTag(dim, 1, protowire.BytesType)
+			dim = protowire.AppendString(dim, d.Name)
+			dim = protowire.AppendTag(dim, 2, protowire.BytesType)
+			dim = protowire.AppendString(dim, d.Value)
+			dp = protowire.AppendTag(dp, 6, protowire.BytesType)
+			dp = protowire.AppendBytes(dp, dim)
+		}
+
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, dp)
+	}
+	return out
+}
@@ -0,0 +1,152 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestSignalFxSink(t *testing.T) {
+	var tokens []string
+	var bodies []map[string][]signalFxJSONPoint
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/datapoint" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("bad request: %s %v", r.URL, r.Header)
+		}
+		tokens = append(tokens, r.Header.Get("X-SF-Token"))
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		var body map[string][]signalFxJSONPoint
+		if err := json.NewDecoder(zr).Decode(&body); err != nil {
+			t.Errorf("bad body: %s", err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer srv.Close()
+
+	s, err := NewSignalFxSink(SignalFxOpts{
+		Token:         "one",
+		Endpoint:      srv.URL,
+		Dimensions:    map[string]string{"env": "prod"},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"status.code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 4)
+	s.AddSample([]string{"latency"}, 10)
+	if err := s.flush(time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.SetToken("two")
+	s.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"status.code", "200"}})
+	if err := s.flush(time.Unix(1700000010, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if len(tokens) != 2 || tokens[0] != "one" || tokens[1] != "two" {
+		t.Fatalf("bad tokens %v", tokens)
+	}
+
+	body := bodies[0]
+	if len(body["gauge"]) != 4 || len(body["counter"]) != 1 || len(body["cumulative_counter"]) != 1 {
+		t.Fatalf("bad body %v", body)
+	}
+	c := body["cumulative_counter"][0]
+	if c.Metric != "requests" || c.Value != 2 || c.Timestamp != 1700000000000 ||
+		c.Dimensions["status_code"] != "200" || c.Dimensions["env"] != "prod" {
+		t.Fatalf("bad counter %#v", c)
+	}
+	if c := body["counter"][0]; c.Metric != "latency.count" || c.Value != 1 {
+		t.Fatalf("bad sample count %#v", c)
+	}
+
+	// Cumulative counters keep their running total
+	if c := bodies[1]["cumulative_counter"][0]; c.Value != 5 {
+		t.Fatalf("bad cumulative counter %#v", c)
+	}
+}
+
+func TestSignalFxSink_Protobuf(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("bad content type %s", r.Header.Get("Content-Type"))
+		}
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	s, err := NewSignalFxSink(SignalFxOpts{
+		Token:         "secret",
+		Endpoint:      srv.URL,
+		Protobuf:      true,
+		DeltaCounters: true,
+		Compression:   HTTPCompression{Encodings: []string{EncodingIdentity}},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"code", "200"}})
+	if err := s.flush(time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	num, typ, n := protowire.ConsumeTag(body)
+	if num != 1 || typ != protowire.BytesType {
+		t.Fatalf("bad upload message")
+	}
+	dp, _ := protowire.ConsumeBytes(body[n:])
+	fields := make(map[protowire.Number]interface{})
+	for len(dp) > 0 {
+		num, typ, n := protowire.ConsumeTag(dp)
+		dp = dp[n:]
+		switch typ {
+		case protowire.BytesType:
+			fields[num], n = protowire.ConsumeBytes(dp)
+		case protowire.VarintType:
+			fields[num], n = protowire.ConsumeVarint(dp)
+		}
+		dp = dp[n:]
+	}
+	if string(fields[2].([]byte)) != "requests" || fields[3].(uint64) != 1700000000000 || fields[5].(uint64) != signalFxCounter {
+		t.Fatalf("bad datapoint %v", fields)
+	}
+	datum := fields[4].([]byte)
+	_, _, n = protowire.ConsumeTag(datum)
+	if v, _ := protowire.ConsumeFixed64(datum[n:]); math.Float64frombits(v) != 2 {
+		t.Fatalf("bad value")
+	}
+}
+
+func TestSignalFxDimension(t *testing.T) {
+	for in, expected := range map[string]string{
+		"code":        "code",
+		"status.code": "status_code",
+		"1st":         "d1st",
+		"":            "d",
+	} {
+		if got := signalFxDimension(in); got != expected {
+			t.Fatalf("bad dimension for %q: %q", in, got)
+		}
+	}
+}
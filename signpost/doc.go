@@ -0,0 +1,8 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package signpost provides a sink emitting os_signpost events and os_log
+// messages for Instruments. It is only available on macOS with cgo, and is
+// kept out of the root package so that importing go-metrics never requires
+// a C toolchain or the macOS SDK headers.
+package signpost
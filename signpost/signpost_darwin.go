@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package signpost
+
+/*
+#include <stdlib.h>
+#include <os/log.h>
+#include <os/signpost.h>
+
+static os_log_t gm_log_create(const char *subsystem, const char *category) {
+	return os_log_create(subsystem, category);
+}
+
+static void gm_log_info(os_log_t log, const char *msg) {
+	os_log_info(log, "%{public}s", msg);
+}
+
+static void gm_signpost_sample(os_log_t log, const char *msg) {
+	os_signpost_event_emit(log, OS_SIGNPOST_ID_EXCLUSIVE, "sample", "%{public}s", msg);
+}
+
+static os_signpost_id_t gm_signpost_id(os_log_t log) {
+	return os_signpost_id_generate(log);
+}
+
+static void gm_signpost_begin(os_log_t log, os_signpost_id_t id, const char *name) {
+	os_signpost_interval_begin(log, id, "interval", "%{public}s", name);
+}
+
+static void gm_signpost_end(os_log_t log, os_signpost_id_t id, const char *name) {
+	os_signpost_interval_end(log, id, "interval", "%{public}s", name);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+// SignpostSink provides a MetricSink integrating with the macOS unified
+// logging system, so desktop and CLI tools can be profiled with Instruments.
+// Samples are emitted as os_signpost events named "sample", and gauges,
+// counters and key/value pairs as os_log info messages. Each message holds
+// the key, the labels and the value:
+//
+//	api.request_time;method=GET 12.5
+//
+// As a sink only receives samples once measured, they cannot be shown as
+// intervals. Wrap code in Interval to record a real signpost interval.
+type SignpostSink struct {
+	log C.os_log_t
+}
+
+// NewSignpostSink creates a SignpostSink logging under the given subsystem,
+// usually a reverse DNS name such as "com.example.tool", and category.
+func NewSignpostSink(subsystem, category string) *SignpostSink {
+	cSubsystem := C.CString(subsystem)
+	defer C.free(unsafe.Pointer(cSubsystem))
+	cCategory := C.CString(category)
+	defer C.free(unsafe.Pointer(cCategory))
+	return &SignpostSink{log: C.gm_log_create(cSubsystem, cCategory)}
+}
+
+func (s *SignpostSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SignpostSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.info(signpostMessage(key, float64(val), labels))
+}
+
+func (s *SignpostSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *SignpostSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []metrics.Label) {
+	s.info(signpostMessage(key, val, labels))
+}
+
+func (s *SignpostSink) EmitKey(key []string, val float32) {
+	s.info(signpostMessage(key, float64(val), nil))
+}
+
+func (s *SignpostSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SignpostSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.info(signpostMessage(key, float64(val), labels))
+}
+
+func (s *SignpostSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SignpostSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	msg := C.CString(signpostMessage(key, float64(val), labels))
+	defer C.free(unsafe.Pointer(msg))
+	C.gm_signpost_sample(s.log, msg)
+}
+
+// Interval begins a signpost interval named after key and returns the
+// function ending it, for example:
+//
+//	defer sink.Interval([]string{"render"})()
+func (s *SignpostSink) Interval(key []string) func() {
+	name := C.CString(strings.Join(key, "."))
+	id := C.gm_signpost_id(s.log)
+	C.gm_signpost_begin(s.log, id, name)
+	return func() {
+		C.gm_signpost_end(s.log, id, name)
+		C.free(unsafe.Pointer(name))
+	}
+}
+
+func (s *SignpostSink) info(msg string) {
+	cMsg := C.CString(msg)
+	defer C.free(unsafe.Pointer(cMsg))
+	C.gm_log_info(s.log, cMsg)
+}
+
+func signpostMessage(key []string, val float64, labels []metrics.Label) string {
+	var b strings.Builder
+	b.WriteString(strings.Join(key, "."))
+	for _, l := range labels {
+		fmt.Fprintf(&b, ";%s=%s", l.Name, l.Value)
+	}
+	fmt.Fprintf(&b, " %g", val)
+	return b.String()
+}
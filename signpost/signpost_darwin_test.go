@@ -0,0 +1,27 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package signpost
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+func TestSignpostMessage(t *testing.T) {
+	msg := signpostMessage([]string{"api", "request_time"}, 12.5, []metrics.Label{{"method", "GET"}})
+	if msg != "api.request_time;method=GET 12.5" {
+		t.Fatalf("bad message: %s", msg)
+	}
+}
+
+func TestSignpostSink(t *testing.T) {
+	s := NewSignpostSink("com.hashicorp.go-metrics.test", "metrics")
+	s.IncrCounterWithLabels([]string{"requests"}, 1, []metrics.Label{{"code", "200"}})
+	s.AddSample([]string{"latency"}, 10)
+	s.Interval([]string{"work"})()
+}
@@ -5,9 +5,16 @@ package metrics
 
 import (
 	"fmt"
+	"log"
 	"net/url"
+	"strings"
+	"time"
 )
 
+// fanoutFlushTimeout bounds how long FanoutSink waits on each member sink
+// during Flush and Shutdown
+const fanoutFlushTimeout = 10 * time.Second
+
 // The MetricSink interface is used to transmit metrics information
 // to an external system
 type MetricSink interface {
@@ -33,6 +40,38 @@ type PrecisionGaugeMetricSink interface {
 	SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label)
 }
 
+// HistogramMetricSink is implemented by sinks which can represent true
+// histograms, bucketing observations with the boundaries configured for each
+// metric, see HistogramBuckets. Other sinks receive histograms as samples.
+type HistogramMetricSink interface {
+	AddHistogram(key []string, val float64)
+	AddHistogramWithLabels(key []string, val float64, labels []Label)
+}
+
+// BatchEmitSink is implemented by sinks which can encode many key/value
+// points for the same key more efficiently than one EmitKey call each.
+type BatchEmitSink interface {
+	EmitKeys(key []string, vals []float32)
+}
+
+// emitKeys sends a batch of key/value points to sink, falling back to one
+// EmitKey call per value for sinks without batch support.
+func emitKeys(sink MetricSink, key []string, vals []float32) {
+	if bs, ok := sink.(BatchEmitSink); ok {
+		bs.EmitKeys(key, vals)
+		return
+	}
+	for _, val := range vals {
+		sink.EmitKey(key, val)
+	}
+}
+
+// FlushSink is implemented by sinks which buffer metrics and can be asked to
+// send them immediately.
+type FlushSink interface {
+	Flush()
+}
+
 type ShutdownSink interface {
 	MetricSink
 
@@ -45,15 +84,23 @@ type ShutdownSink interface {
 // BlackholeSink is used to just blackhole messages
 type BlackholeSink struct{}
 
-func (*BlackholeSink) SetGauge(key []string, val float32)                                    {}
-func (*BlackholeSink) SetGaugeWithLabels(key []string, val float32, labels []Label)          {}
-func (*BlackholeSink) SetPrecisionGauge(key []string, val float64)                           {}
-func (*BlackholeSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {}
-func (*BlackholeSink) EmitKey(key []string, val float32)                                     {}
-func (*BlackholeSink) IncrCounter(key []string, val float32)                                 {}
-func (*BlackholeSink) IncrCounterWithLabels(key []string, val float32, labels []Label)       {}
-func (*BlackholeSink) AddSample(key []string, val float32)                                   {}
-func (*BlackholeSink) AddSampleWithLabels(key []string, val float32, labels []Label)         {}
+func (*BlackholeSink) SetGauge(key []string, val float32)                                       {}
+func (*BlackholeSink) SetGaugeWithLabels(key []string, val float32, labels []Label)             {}
+func (*BlackholeSink) SetPrecisionGauge(key []string, val float64)                              {}
+func (*BlackholeSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label)    {}
+func (*BlackholeSink) EmitKey(key []string, val float32)                                        {}
+func (*BlackholeSink) EmitKeys(key []string, vals []float32)                                    {}
+func (*BlackholeSink) IncrCounter(key []string, val float32)                                    {}
+func (*BlackholeSink) IncrCounterWithLabels(key []string, val float32, labels []Label)          {}
+func (*BlackholeSink) AddSample(key []string, val float32)                                      {}
+func (*BlackholeSink) AddSampleWithLabels(key []string, val float32, labels []Label)            {}
+func (*BlackholeSink) AddHistogram(key []string, val float64)                                   {}
+func (*BlackholeSink) AddHistogramWithLabels(key []string, val float64, labels []Label)         {}
+func (*BlackholeSink) IncrPrecisionCounterWithLabels(key []string, val float64, labels []Label) {}
+func (*BlackholeSink) AddHistogramSampleWithLabels(key []string, val float64, labels []Label)   {}
+func (*BlackholeSink) WritePoint(p Point)                                                       {}
+func (*BlackholeSink) WritePoints(points []Point)                                               {}
+func (*BlackholeSink) Capabilities() Capabilities                                               { return Capabilities{} }
 
 // FanoutSink is used to sink to fanout values to multiple sinks
 type FanoutSink []MetricSink
@@ -74,10 +121,8 @@ func (fh FanoutSink) SetPrecisionGauge(key []string, val float64) {
 
 func (fh FanoutSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
 	for _, s := range fh {
-		// The Sink needs to implement PrecisionGaugeMetricSink, in case it doesn't, the metric value won't be set and ingored instead
-		if s64, ok := s.(PrecisionGaugeMetricSink); ok {
-			s64.SetPrecisionGaugeWithLabels(key, val, labels)
-		}
+		// Each member gets the best encoding it supports, see setPrecisionGauge
+		setPrecisionGauge(s, key, val, labels)
 	}
 }
 
@@ -87,6 +132,12 @@ func (fh FanoutSink) EmitKey(key []string, val float32) {
 	}
 }
 
+func (fh FanoutSink) EmitKeys(key []string, vals []float32) {
+	for _, s := range fh {
+		emitKeys(s, key, vals)
+	}
+}
+
 func (fh FanoutSink) IncrCounter(key []string, val float32) {
 	fh.IncrCounterWithLabels(key, val, nil)
 }
@@ -107,12 +158,166 @@ func (fh FanoutSink) AddSampleWithLabels(key []string, val float32, labels []Lab
 	}
 }
 
-func (fh FanoutSink) Shutdown() {
+func (fh FanoutSink) AddHistogram(key []string, val float64) {
+	fh.AddHistogramWithLabels(key, val, nil)
+}
+
+func (fh FanoutSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	for _, s := range fh {
+		// Each member gets the best encoding it supports, see addHistogram
+		addHistogram(s, key, val, labels)
+	}
+}
+
+func (fh FanoutSink) IncrPrecisionCounterWithLabels(key []string, val float64, labels []Label) {
+	for _, s := range fh {
+		incrPrecisionCounter(s, key, val, labels)
+	}
+}
+
+func (fh FanoutSink) AddHistogramSampleWithLabels(key []string, val float64, labels []Label) {
+	fh.AddHistogramWithLabels(key, val, labels)
+}
+
+// WritePoint and WritePoints pass points on to the members which implement
+// MetricSinkV2, and dispatch them to the matching method of the others as
+// AdaptSink does, without wrapping them on every call.
+func (fh FanoutSink) WritePoint(p Point) {
+	for _, s := range fh {
+		if v2, ok := s.(MetricSinkV2); ok {
+			v2.WritePoint(p)
+		} else {
+			writePoint(s, p)
+		}
+	}
+}
+
+func (fh FanoutSink) WritePoints(points []Point) {
+	for _, s := range fh {
+		if v2, ok := s.(MetricSinkV2); ok {
+			v2.WritePoints(points)
+			continue
+		}
+		for _, p := range points {
+			writePoint(s, p)
+		}
+	}
+}
+
+// Capabilities reports the union of the capabilities of all member sinks.
+// Each member still receives the best encoding it supports individually.
+func (fh FanoutSink) Capabilities() Capabilities {
+	var c Capabilities
+	for _, s := range fh {
+		sc := SinkCapabilities(s)
+		c.Histograms = c.Histograms || sc.Histograms
+		c.PrecisionFloats = c.PrecisionFloats || sc.PrecisionFloats
+		c.Timestamps = c.Timestamps || sc.Timestamps
+		c.Tags = c.Tags || sc.Tags
+	}
+	return c
+}
+
+func (fh FanoutSink) tracksUnits() bool {
 	for _, s := range fh {
+		if tracksUnits(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreCounters passes restored totals on to the member sinks which are
+// a CumulativeSink.
+func (fh FanoutSink) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	for _, s := range fh {
+		if c, ok := s.(CumulativeSink); ok {
+			c.RestoreCounters(start, counters)
+		}
+	}
+}
+
+// setUnit passes the unit of a key on to the member sinks tracking units,
+// see UnitSink.
+func (fh FanoutSink) setUnit(key, unit string) {
+	for _, s := range fh {
+		if tracksUnits(s) {
+			s.(unitTracker).setUnit(key, unit)
+		}
+	}
+}
+
+// Flush flushes all member sinks implementing FlushSink concurrently, see
+// FlushWithTimeout.
+func (fh FanoutSink) Flush() {
+	if err := fh.FlushWithTimeout(fanoutFlushTimeout); err != nil {
+		log.Printf("[WARN] metrics: %s", err)
+	}
+}
+
+// FlushWithTimeout flushes all member sinks implementing FlushSink
+// concurrently, waiting at most timeout for each of them so one slow member
+// does not hold up the others. An error lists the sinks which timed out;
+// their flush keeps running in the background.
+func (fh FanoutSink) FlushWithTimeout(timeout time.Duration) error {
+	return fh.parallel("flush", timeout, func(s MetricSink) {
+		if fs, ok := s.(FlushSink); ok {
+			fs.Flush()
+		}
+	})
+}
+
+// Shutdown shuts down all member sinks concurrently, see ShutdownWithTimeout.
+func (fh FanoutSink) Shutdown() {
+	if err := fh.ShutdownWithTimeout(fanoutFlushTimeout); err != nil {
+		log.Printf("[WARN] metrics: %s", err)
+	}
+}
+
+// ShutdownWithTimeout shuts down all member sinks implementing ShutdownSink
+// concurrently, waiting at most timeout for each of them. An error lists the
+// sinks which timed out; their shutdown keeps running in the background.
+func (fh FanoutSink) ShutdownWithTimeout(timeout time.Duration) error {
+	return fh.parallel("shutdown", timeout, func(s MetricSink) {
 		if ss, ok := s.(ShutdownSink); ok {
 			ss.Shutdown()
 		}
+	})
+}
+
+// parallel runs fn against every member sink concurrently and waits for each
+// to finish or for the timeout to expire.
+func (fh FanoutSink) parallel(op string, timeout time.Duration, fn func(MetricSink)) error {
+	done := make([]chan struct{}, len(fh))
+	for i, s := range fh {
+		done[i] = make(chan struct{})
+		go func(s MetricSink, done chan struct{}) {
+			defer close(done)
+			fn(s)
+		}(s, done[i])
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	var timedOut []string
+	for i, ch := range done {
+		select {
+		case <-ch:
+		case <-deadline.C:
+			// The deadline is shared, so every sink still running has
+			// now had the full timeout
+			for j := i; j < len(done); j++ {
+				select {
+				case <-done[j]:
+				default:
+					timedOut = append(timedOut, fmt.Sprintf("%d (%T)", j, fh[j]))
+				}
+			}
+			return fmt.Errorf("fanout %s timed out after %s for sinks %s", op, timeout, strings.Join(timedOut, ", "))
+		}
 	}
+	return nil
 }
 
 // sinkURLFactoryFunc is an generic interface around the *SinkFromURL() function provided
@@ -122,9 +327,23 @@ type sinkURLFactoryFunc func(*url.URL) (MetricSink, error)
 // sinkRegistry supports the generic NewMetricSink function by mapping URL
 // schemes to metric sink factory functions
 var sinkRegistry = map[string]sinkURLFactoryFunc{
-	"statsd":   NewStatsdSinkFromURL,
-	"statsite": NewStatsiteSinkFromURL,
-	"inmem":    NewInmemSinkFromURL,
+	"statsd":       NewStatsdSinkFromURL,
+	"statsd+tcp":   NewStatsdSinkFromURL,
+	"unixgram":     NewStatsdSinkFromURL,
+	"statsite":     NewStatsiteSinkFromURL,
+	"statsite+tls": NewStatsiteTLSSinkFromURL,
+	"inmem":        NewInmemSinkFromURL,
+	"graphite":     NewGraphiteSinkFromURL,
+	"azuremonitor": NewAzureMonitorSinkFromURL,
+}
+
+// RegisterSinkScheme makes NewMetricSinkFromURL create sinks for a URL
+// scheme with factory, replacing any sink already registered for it. It lets
+// sinks outside this package, such as the DogStatsdSink of the datadog
+// package, be configured by URL, and must be called before
+// NewMetricSinkFromURL is used, typically from an init function.
+func RegisterSinkScheme(scheme string, factory func(*url.URL) (MetricSink, error)) {
+	sinkRegistry[scheme] = factory
 }
 
 // NewMetricSinkFromURL allows a generic URL input to configure any of the
@@ -132,14 +351,41 @@ var sinkRegistry = map[string]sinkURLFactoryFunc{
 // and query parameters are used to set options.
 //
 // "statsd://" - Initializes a StatsdSink. The host and port are passed through
-// as the "addr" of the sink
+// as the "addr" of the sink. The optional "tags" parameter set to "m3" sends
+// labels with the M3 tag extension.
+//
+// "statsd+tcp://" - Initializes a StatsdSink sending over TCP, with the same
+// parameters as "statsd://".
+//
+// "unixgram://" - Initializes a StatsdSink sending to the Unix domain socket
+// at the path of the URL, such as "unixgram:///var/run/statsd.sock", with the
+// same parameters as "statsd://".
 //
 // "statsite://" - Initializes a StatsiteSink. The host and port become the
 // "addr" of the sink
 //
+// "statsite+tls://" - Initializes a StatsiteSink connecting over TLS. The
+// optional "ca_file", "cert_file", "key_file" and "server_name" parameters
+// configure the verification of the server and the client certificate.
+//
 // "inmem://" - Initializes an InmemSink. The host and port are ignored. The
 // "interval" and "duration" query parameters must be specified with valid
-// durations, see NewInmemSink for details.
+// durations, see NewInmemSink for details. The optional "gauge_history"
+// parameter enables gauge histories of the given size, and "top_k" the
+// tracking of the given number of heavy hitters.
+//
+// "graphite://" - Initializes a GraphiteSink. The host and port become the
+// "addr" of the sink, with port 2003 by default, or 2004 with the pickle
+// protocol. The optional "protocol", "prefix", "tags", "flush_interval" and
+// "batch_size" parameters set the matching GraphiteOpts.
+//
+// "azuremonitor://" - Initializes an AzureMonitorSink. The host is the region
+// and the path the resource ID. The optional "namespace", "tenant_id",
+// "client_id", "client_secret" and "flush_interval" parameters set the
+// matching AzureMonitorOpts.
+//
+// Further schemes are added with RegisterSinkScheme, such as "dogstatsd://"
+// by importing the datadog package.
 func NewMetricSinkFromURL(urlStr string) (MetricSink, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
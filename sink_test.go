@@ -4,10 +4,12 @@
 package metrics
 
 import (
+	"net/url"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type MockSink struct {
@@ -268,6 +270,47 @@ func TestFanoutSink_Sample_Labels(t *testing.T) {
 	}
 }
 
+// blockingSink blocks in Shutdown and Flush until released
+type blockingSink struct {
+	BlackholeSink
+	release chan struct{}
+}
+
+func (b *blockingSink) Shutdown() { <-b.release }
+func (b *blockingSink) Flush()    { <-b.release }
+
+func TestFanoutSink_ShutdownTimeout(t *testing.T) {
+	m := &MockSink{}
+	slow := &blockingSink{release: make(chan struct{})}
+	defer close(slow.release)
+	fh := FanoutSink{slow, m}
+
+	start := time.Now()
+	err := fh.ShutdownWithTimeout(50 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "0 (*metrics.blockingSink)") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took too long: %s", elapsed)
+	}
+
+	// Healthy sinks are shut down even though an earlier member is stuck
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.shutdown {
+		t.Fatalf("expected mock sink to be shut down")
+	}
+}
+
+func TestFanoutSink_Flush(t *testing.T) {
+	fast := &blockingSink{release: make(chan struct{})}
+	close(fast.release)
+	fh := FanoutSink{fast, &MockSink{}}
+	if err := fh.FlushWithTimeout(time.Second); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+}
+
 func TestNewMetricSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
 		desc      string
@@ -285,11 +328,36 @@ func TestNewMetricSinkFromURL(t *testing.T) {
 			input:  "statsite://someserver:123",
 			expect: reflect.TypeOf(&StatsiteSink{}),
 		},
+		{
+			desc:   "statsd+tcp scheme yields a StatsdSink",
+			input:  "statsd+tcp://someserver:123",
+			expect: reflect.TypeOf(&StatsdSink{}),
+		},
+		{
+			desc:   "unixgram scheme yields a StatsdSink",
+			input:  "unixgram:///var/run/statsd.sock",
+			expect: reflect.TypeOf(&StatsdSink{}),
+		},
+		{
+			desc:   "statsite+tls scheme yields a StatsiteSink",
+			input:  "statsite+tls://someserver:123?server_name=statsite.internal",
+			expect: reflect.TypeOf(&StatsiteSink{}),
+		},
 		{
 			desc:   "inmem scheme yields an InmemSink",
 			input:  "inmem://?interval=30s&retain=30s",
 			expect: reflect.TypeOf(&InmemSink{}),
 		},
+		{
+			desc:   "graphite scheme yields a GraphiteSink",
+			input:  "graphite://someserver:2003?prefix=app",
+			expect: reflect.TypeOf(&GraphiteSink{}),
+		},
+		{
+			desc:   "azuremonitor scheme yields an AzureMonitorSink",
+			input:  "azuremonitor://westeurope/subscriptions/sub/resourceGroups/rg?namespace=app",
+			expect: reflect.TypeOf(&AzureMonitorSink{}),
+		},
 		{
 			desc:      "unknown scheme yields an error",
 			input:     "notasink://whatever",
@@ -314,3 +382,18 @@ func TestNewMetricSinkFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterSinkScheme(t *testing.T) {
+	RegisterSinkScheme("blackhole", func(u *url.URL) (MetricSink, error) {
+		return &BlackholeSink{}, nil
+	})
+	defer delete(sinkRegistry, "blackhole")
+
+	ms, err := NewMetricSinkFromURL("blackhole://")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if _, ok := ms.(*BlackholeSink); !ok {
+		t.Fatalf("bad sink %T", ms)
+	}
+}
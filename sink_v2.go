@@ -0,0 +1,154 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"time"
+)
+
+// PointKind identifies how a Point should be interpreted by a sink
+type PointKind int
+
+const (
+	// PointGauge retains the last value it is set to
+	PointGauge PointKind = iota
+
+	// PointCounter accumulates values
+	PointCounter
+
+	// PointSample is a timing sample, where quantiles are used
+	PointSample
+
+	// PointHistogram is an observation for a histogram
+	PointHistogram
+
+	// PointKey is a key/value pair, labels are ignored
+	PointKey
+)
+
+// Point is a single 64 bit measurement. A zero Time means the time the point
+// is written.
+type Point struct {
+	Kind   PointKind
+	Key    []string
+	Value  float64
+	Labels []Label
+	Time   time.Time
+}
+
+// MetricSinkV2 extends MetricSink with 64 bit counters, histograms,
+// timestamped points and batches, so Metrics can use one interface rather
+// than probing each sink for optional ones. Sinks implementing only
+// MetricSink are wrapped with AdaptSink.
+type MetricSinkV2 interface {
+	MetricSink
+	PrecisionGaugeMetricSink
+	BatchEmitSink
+
+	// Counters with 64 bit precision
+	IncrPrecisionCounterWithLabels(key []string, val float64, labels []Label)
+
+	// Histograms record the distribution of observations, rather than
+	// treating them as timers
+	AddHistogramSampleWithLabels(key []string, val float64, labels []Label)
+
+	// WritePoint records a point at its own timestamp, if the sink supports
+	// timestamps, and WritePoints records a batch of points
+	WritePoint(p Point)
+	WritePoints(points []Point)
+
+	Capabilities() Capabilities
+}
+
+// AdaptSink returns sink as a MetricSinkV2. Sinks which do not implement it
+// are wrapped with an adapter translating each method into the closest one
+// the sink supports: 64 bit values become 32 bit ones, histograms become
+// samples unless the sink implements HistogramMetricSink, timestamps are dropped and batches are written point by point.
+// Precision gauges follow the same rules as Metrics.SetPrecisionGauge.
+func AdaptSink(sink MetricSink) MetricSinkV2 {
+	if v2, ok := sink.(MetricSinkV2); ok {
+		return v2
+	}
+	return &sinkAdapter{MetricSink: sink}
+}
+
+// sinkAdapter implements MetricSinkV2 on top of a legacy MetricSink
+type sinkAdapter struct {
+	MetricSink
+}
+
+func (a *sinkAdapter) SetPrecisionGauge(key []string, val float64) {
+	a.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (a *sinkAdapter) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	setPrecisionGauge(a.MetricSink, key, val, labels)
+}
+
+func (a *sinkAdapter) EmitKeys(key []string, vals []float32) {
+	emitKeys(a.MetricSink, key, vals)
+}
+
+func (a *sinkAdapter) IncrPrecisionCounterWithLabels(key []string, val float64, labels []Label) {
+	incrPrecisionCounter(a.MetricSink, key, val, labels)
+}
+
+func (a *sinkAdapter) AddHistogramSampleWithLabels(key []string, val float64, labels []Label) {
+	addHistogram(a.MetricSink, key, val, labels)
+}
+
+func (a *sinkAdapter) WritePoint(p Point) {
+	writePoint(a.MetricSink, p)
+}
+
+func (a *sinkAdapter) WritePoints(points []Point) {
+	for _, p := range points {
+		writePoint(a.MetricSink, p)
+	}
+}
+
+func (a *sinkAdapter) Capabilities() Capabilities {
+	return SinkCapabilities(a.MetricSink)
+}
+
+// Flush and Shutdown are passed through, so the adapter can stand in for the
+// sink it wraps
+func (a *sinkAdapter) Flush() {
+	if fs, ok := a.MetricSink.(FlushSink); ok {
+		fs.Flush()
+	}
+}
+
+func (a *sinkAdapter) Shutdown() {
+	if ss, ok := a.MetricSink.(ShutdownSink); ok {
+		ss.Shutdown()
+	}
+}
+
+// incrPrecisionCounter increments a 64 bit counter if sink supports them, and
+// a 32 bit one otherwise.
+func incrPrecisionCounter(sink MetricSink, key []string, val float64, labels []Label) {
+	if v2, ok := sink.(MetricSinkV2); ok {
+		v2.IncrPrecisionCounterWithLabels(key, val, labels)
+		return
+	}
+	sink.IncrCounterWithLabels(key, float32(val), labels)
+}
+
+// writePoint dispatches a point to the matching method of sink, ignoring
+// its timestamp.
+func writePoint(sink MetricSink, p Point) {
+	switch p.Kind {
+	case PointGauge:
+		setPrecisionGauge(sink, p.Key, p.Value, p.Labels)
+	case PointCounter:
+		incrPrecisionCounter(sink, p.Key, p.Value, p.Labels)
+	case PointSample:
+		sink.AddSampleWithLabels(p.Key, float32(p.Value), p.Labels)
+	case PointHistogram:
+		addHistogram(sink, p.Key, p.Value, p.Labels)
+	case PointKey:
+		sink.EmitKey(p.Key, float32(p.Value))
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdaptSink(t *testing.T) {
+	m := &MockSink{}
+	s := AdaptSink(m)
+
+	s.IncrPrecisionCounterWithLabels([]string{"requests"}, 2, []Label{{"a", "b"}})
+	s.AddHistogramSampleWithLabels([]string{"latency"}, 1.5, nil)
+	s.WritePoints([]Point{
+		{Kind: PointGauge, Key: []string{"gauge"}, Value: 3.25, Time: time.Unix(1, 0)},
+		{Kind: PointKey, Key: []string{"kv"}, Value: 4},
+	})
+	s.EmitKeys([]string{"batch"}, []float32{5, 6})
+
+	expectedKeys := [][]string{{"requests"}, {"latency"}, {"gauge"}, {"kv"}, {"batch"}, {"batch"}}
+	if !reflect.DeepEqual(m.getKeys(), expectedKeys) {
+		t.Fatalf("bad keys %v", m.getKeys())
+	}
+	if !reflect.DeepEqual(m.vals, []float32{2, 1.5, 4, 5, 6}) {
+		t.Fatalf("bad vals %v", m.vals)
+	}
+	if !reflect.DeepEqual(m.precisionVals, []float64{3.25}) {
+		t.Fatalf("bad precision vals %v", m.precisionVals)
+	}
+	if !reflect.DeepEqual(m.labels[0], []Label{{"a", "b"}}) {
+		t.Fatalf("bad labels %v", m.labels[0])
+	}
+
+	s.(ShutdownSink).Shutdown()
+	if !m.shutdown {
+		t.Fatalf("expected shutdown to be passed through")
+	}
+}
+
+func TestAdaptSink_V2(t *testing.T) {
+	b := &BlackholeSink{}
+	if s := AdaptSink(b); s != MetricSinkV2(b) {
+		t.Fatalf("expected sink to be returned as is")
+	}
+	var _ MetricSinkV2 = FanoutSink{}
+
+	// Metrics not built by New adapt their sink once
+	met := &Metrics{sink: &legacySink{}}
+	if met.v2() != met.v2() {
+		t.Fatalf("expected the adapter to be cached")
+	}
+}
+
+func TestFanoutSink_WritePoint(t *testing.T) {
+	legacy := &legacySink{}
+	inm := NewInmemSink(time.Hour, time.Hour)
+	fh := FanoutSink{legacy, inm}
+	fh.WritePoints([]Point{
+		{Kind: PointGauge, Key: []string{"queue"}, Value: 3},
+		{Kind: PointCounter, Key: []string{"requests"}, Value: 2},
+	})
+	fh.IncrPrecisionCounterWithLabels([]string{"requests"}, 1, nil)
+
+	if len(legacy.gauges) != 0 {
+		t.Fatalf("legacy sink should ignore 64 bit gauges: %v", legacy.gauges)
+	}
+	data := inm.Data()[0]
+	if data.PrecisionGauges["queue"].Value != 3 || data.Counters["requests"].Sum != 3 {
+		t.Fatalf("bad points: %v %v", data.PrecisionGauges, data.Counters)
+	}
+}
+
+func TestAdaptSink_PrecisionGauge(t *testing.T) {
+	// Legacy sinks without capabilities ignore 64 bit gauges, as they
+	// always have
+	var legacy legacySink
+	AdaptSink(&legacy).SetPrecisionGauge([]string{"a"}, 1)
+	if len(legacy.gauges) != 0 {
+		t.Fatalf("expected precision gauge to be ignored")
+	}
+
+	// Sinks declaring their capabilities get a 32 bit gauge instead
+	var c capSink
+	AdaptSink(&c).SetPrecisionGauge([]string{"a"}, 1.5)
+	if len(c.gauges) != 1 || c.gauges[0] != 1.5 {
+		t.Fatalf("bad gauges %v", c.gauges)
+	}
+}
+
+// histogramSink is a MockSink which records true histograms
+type histogramSink struct {
+	MockSink
+	histograms []float64
+}
+
+func (h *histogramSink) AddHistogram(key []string, val float64) {
+	h.AddHistogramWithLabels(key, val, nil)
+}
+
+func (h *histogramSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.keys = append(h.keys, key)
+	h.histograms = append(h.histograms, val)
+	h.labels = append(h.labels, labels)
+}
+
+func TestAdaptSink_Histogram(t *testing.T) {
+	h := &histogramSink{}
+	AdaptSink(h).AddHistogramSampleWithLabels([]string{"latency"}, 1.5, []Label{{"a", "b"}})
+	if !reflect.DeepEqual(h.histograms, []float64{1.5}) || len(h.vals) != 0 {
+		t.Fatalf("expected a histogram, got %v %v", h.histograms, h.vals)
+	}
+	if !SinkCapabilities(h).Histograms || SinkCapabilities(&MockSink{}).Histograms {
+		t.Fatalf("bad inferred capabilities")
+	}
+
+	// Each member of a fanout gets the best encoding it supports
+	h, m := &histogramSink{}, &MockSink{}
+	fh := FanoutSink{h, m, NewWorkerSink(&histogramSink{}, 1)}
+	fh.AddHistogram([]string{"latency"}, 2.5)
+	if !reflect.DeepEqual(h.histograms, []float64{2.5}) {
+		t.Fatalf("bad histograms %v", h.histograms)
+	}
+	if !reflect.DeepEqual(m.vals, []float32{2.5}) {
+		t.Fatalf("expected a sample, got %v", m.vals)
+	}
+	w := fh[2].(*WorkerSink)
+	w.Flush()
+	if got := w.sink.(*histogramSink).histograms; !reflect.DeepEqual(got, []float64{2.5}) {
+		t.Fatalf("bad queued histograms %v", got)
+	}
+	w.Shutdown()
+}
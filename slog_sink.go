@@ -0,0 +1,195 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// slogMessage and slogRateLimit are used when the matching SlogOpts are
+	// not set
+	slogMessage   = "metric"
+	slogRateLimit = 100
+)
+
+// SlogOpts is used to configure a SlogSink.
+type SlogOpts struct {
+	// Logger receives the records, it defaults to slog.Default()
+	Logger *slog.Logger
+
+	// Level is the level of the records, it defaults to slog.LevelInfo
+	Level slog.Level
+
+	// Message is the message of the records, it defaults to "metric"
+	Message string
+
+	// RateLimit is the sustained number of records per second, it defaults
+	// to 100 and a negative value disables the limit. Burst is how many
+	// records can be logged at once, it defaults to RateLimit.
+	RateLimit float64
+	Burst     int
+}
+
+// SlogSink provides a MetricSink which logs every metric as a structured
+// record through a slog.Logger, for environments where logs are the only
+// telemetry channel. With the text handler, records look like:
+//
+//	level=INFO msg=metric name=api.requests type=counter value=1 labels.code=200
+//
+// Records beyond the rate limit are dropped rather than flooding the logs.
+// The number dropped is logged with the next record allowed, as in:
+//
+//	level=WARN msg="metrics dropped by rate limit" dropped=1520
+type SlogSink struct {
+	logger  *slog.Logger
+	level   slog.Level
+	message string
+
+	// Token bucket of the rate limit, disabled when rate is zero
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	dropped uint64
+	total   uint64
+	now     func() time.Time
+}
+
+// NewSlogSink creates a SlogSink.
+func NewSlogSink(opts SlogOpts) *SlogSink {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	message := opts.Message
+	if message == "" {
+		message = slogMessage
+	}
+	rate := opts.RateLimit
+	if rate == 0 {
+		rate = slogRateLimit
+	}
+	rate = math.Max(rate, 0)
+	burst := float64(opts.Burst)
+	if burst <= 0 {
+		burst = math.Max(rate, 1)
+	}
+	return &SlogSink{
+		logger:  logger,
+		level:   opts.Level,
+		message: message,
+		rate:    rate,
+		burst:   burst,
+		tokens:  burst,
+		now:     time.Now,
+	}
+}
+
+func (s *SlogSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SlogSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.log("gauge", key, float64(val), labels)
+}
+
+func (s *SlogSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *SlogSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.log("gauge", key, val, labels)
+}
+
+func (s *SlogSink) EmitKey(key []string, val float32) {
+	s.log("kv", key, float64(val), nil)
+}
+
+func (s *SlogSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SlogSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.log("counter", key, float64(val), labels)
+}
+
+func (s *SlogSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SlogSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.log("sample", key, float64(val), labels)
+}
+
+// Capabilities reports what the slog sink supports.
+func (s *SlogSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Tags: true}
+}
+
+// Dropped returns the number of records dropped by the rate limit so far.
+func (s *SlogSink) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.total
+}
+
+func (s *SlogSink) log(typ string, key []string, val float64, labels []Label) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, s.level) {
+		return
+	}
+	allowed, dropped := s.allow()
+	if !allowed {
+		return
+	}
+	if dropped > 0 {
+		s.logger.LogAttrs(ctx, slog.LevelWarn, "metrics dropped by rate limit", slog.Uint64("dropped", dropped))
+	}
+
+	attrs := []slog.Attr{
+		slog.String("name", strings.Join(key, ".")),
+		slog.String("type", typ),
+		slog.Float64("value", val),
+	}
+	if len(labels) > 0 {
+		group := make([]any, len(labels))
+		for i, l := range labels {
+			group[i] = slog.String(l.Name, l.Value)
+		}
+		attrs = append(attrs, slog.Group("labels", group...))
+	}
+	s.logger.LogAttrs(ctx, s.level, s.message, attrs...)
+}
+
+// allow takes a token from the bucket, returning whether the record may be
+// logged and, if so, how many were dropped since the last one.
+func (s *SlogSink) allow() (bool, uint64) {
+	if s.rate == 0 {
+		return true, 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	if !s.last.IsZero() {
+		s.tokens = math.Min(s.burst, s.tokens+now.Sub(s.last).Seconds()*s.rate)
+	}
+	s.last = now
+	if s.tokens < 1 {
+		s.dropped++
+		s.total++
+		return false, 0
+	}
+	s.tokens--
+	dropped := s.dropped
+	s.dropped = 0
+	return true, dropped
+}
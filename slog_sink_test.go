@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSlogSink(opts SlogOpts) (*SlogSink, *bytes.Buffer) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	opts.Logger = slog.New(handler)
+	return NewSlogSink(opts), &buf
+}
+
+func TestSlogSink(t *testing.T) {
+	s, buf := newTestSlogSink(SlogOpts{})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	s.SetPrecisionGauge([]string{"queue", "depth"}, 7.5)
+	s.AddSample([]string{"api", "latency"}, 12)
+	s.EmitKey([]string{"keys"}, 3)
+
+	want := "level=INFO msg=metric name=api.requests type=counter value=1 labels.code=200\n" +
+		"level=INFO msg=metric name=queue.depth type=gauge value=7.5\n" +
+		"level=INFO msg=metric name=api.latency type=sample value=12\n" +
+		"level=INFO msg=metric name=keys type=kv value=3\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("bad records\n%s", got)
+	}
+}
+
+func TestSlogSink_Level(t *testing.T) {
+	s, buf := newTestSlogSink(SlogOpts{Level: slog.LevelDebug, Message: "telemetry"})
+	s.SetGauge([]string{"a"}, 1)
+	if buf.Len() != 0 {
+		t.Fatalf("expected disabled records to be skipped, got %q", buf.String())
+	}
+	if s.Dropped() != 0 {
+		t.Fatalf("expected disabled records not to count as dropped")
+	}
+}
+
+func TestSlogSink_RateLimit(t *testing.T) {
+	s, buf := newTestSlogSink(SlogOpts{RateLimit: 2, Burst: 3})
+	now := time.Unix(1700000000, 0)
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 10; i++ {
+		s.IncrCounter([]string{"a"}, 1)
+	}
+	if n := strings.Count(buf.String(), "msg=metric"); n != 3 {
+		t.Fatalf("expected the burst to be logged, got %d records", n)
+	}
+	if s.Dropped() != 7 {
+		t.Fatalf("bad dropped %d", s.Dropped())
+	}
+
+	// One token is refilled every half second
+	buf.Reset()
+	now = now.Add(500 * time.Millisecond)
+	s.IncrCounter([]string{"a"}, 1)
+	s.IncrCounter([]string{"a"}, 1)
+	want := "level=WARN msg=\"metrics dropped by rate limit\" dropped=7\n" +
+		"level=INFO msg=metric name=a type=counter value=1\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("bad records\n%s", got)
+	}
+	if s.Dropped() != 8 {
+		t.Fatalf("bad dropped %d", s.Dropped())
+	}
+}
+
+func TestSlogSink_Unlimited(t *testing.T) {
+	s, buf := newTestSlogSink(SlogOpts{RateLimit: -1})
+	for i := 0; i < 1000; i++ {
+		s.IncrCounter([]string{"a"}, 1)
+	}
+	if n := strings.Count(buf.String(), "msg=metric"); n != 1000 || s.Dropped() != 0 {
+		t.Fatalf("expected every record to be logged, got %d", n)
+	}
+}
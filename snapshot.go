@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// SnapshotValue is the current value of a gauge or the running total of a
+// counter, as recorded by the Metrics snapshot registry.
+type SnapshotValue struct {
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// MetricsSnapshot is a point in time copy of the current gauge values and
+// counter totals emitted through a Metrics instance. Entries are keyed by the
+// key as passed by the caller, joined with '.', followed by ";name=value" for
+// each label. Service and host prefixes are not included.
+type MetricsSnapshot struct {
+	Gauges   map[string]SnapshotValue
+	Counters map[string]SnapshotValue
+
+	// StartTime is when the counter totals started accumulating. With
+	// CounterCheckpointPath it is preserved across restarts, so exporters
+	// using cumulative temporality can use it as the series start time.
+	StartTime time.Time
+
+	// Restarts is the number of times the counter totals were restored from
+	// a checkpoint, letting exporters detect process restarts.
+	Restarts uint64
+}
+
+// Gauge returns the last value set for a gauge.
+func (s MetricsSnapshot) Gauge(key []string, labels []Label) (float64, bool) {
+	v, ok := s.Gauges[seriesKey(key, labels)]
+	return v.Value, ok
+}
+
+// Counter returns the running total of a counter.
+func (s MetricsSnapshot) Counter(key []string, labels []Label) (float64, bool) {
+	v, ok := s.Counters[seriesKey(key, labels)]
+	return v.Value, ok
+}
+
+// snapshotRegistry is the lightweight registry backing Metrics.Snapshot. It
+// only keeps a single value per series, independently of the configured sink.
+type snapshotRegistry struct {
+	lock      sync.Mutex
+	gauges    map[string]SnapshotValue
+	counters  map[string]SnapshotValue
+	startTime time.Time
+	restarts  uint64
+}
+
+func newSnapshotRegistry() *snapshotRegistry {
+	return &snapshotRegistry{
+		gauges:    make(map[string]SnapshotValue),
+		counters:  make(map[string]SnapshotValue),
+		startTime: time.Now(),
+	}
+}
+
+// restore seeds the counter totals, typically from a checkpoint.
+func (r *snapshotRegistry) restore(counters map[string]SnapshotValue, startTime time.Time, restarts uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for k, v := range counters {
+		r.counters[k] = v
+	}
+	if !startTime.IsZero() {
+		r.startTime = startTime
+	}
+	r.restarts = restarts
+}
+
+func (r *snapshotRegistry) setGauge(key []string, val float64, labels []Label) {
+	k := seriesKey(key, labels)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	v, ok := r.gauges[k]
+	if !ok {
+		v = newSnapshotValue(key, labels)
+	}
+	v.Value = val
+	r.gauges[k] = v
+}
+
+func (r *snapshotRegistry) incrCounter(key []string, val float64, labels []Label) {
+	k := seriesKey(key, labels)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	v, ok := r.counters[k]
+	if !ok {
+		v = newSnapshotValue(key, labels)
+	}
+	v.Value += val
+	r.counters[k] = v
+}
+
+func (r *snapshotRegistry) snapshot() MetricsSnapshot {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := MetricsSnapshot{
+		Gauges:    make(map[string]SnapshotValue, len(r.gauges)),
+		Counters:  make(map[string]SnapshotValue, len(r.counters)),
+		StartTime: r.startTime,
+		Restarts:  r.restarts,
+	}
+	for k, v := range r.gauges {
+		s.Gauges[k] = v
+	}
+	for k, v := range r.counters {
+		s.Counters[k] = v
+	}
+	return s
+}
+
+// newSnapshotValue copies the labels, as callers are free to reuse the slice.
+func newSnapshotValue(key []string, labels []Label) SnapshotValue {
+	return SnapshotValue{
+		Name:   strings.Join(key, "."),
+		Labels: append([]Label(nil), labels...),
+	}
+}
+
+// Snapshot returns the current gauge values and counter totals emitted through
+// this Metrics instance, regardless of which sinks are configured. It requires
+// Config.EnableSnapshot, otherwise an empty snapshot is returned.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	if m.snapshots == nil {
+		return MetricsSnapshot{
+			Gauges:   make(map[string]SnapshotValue),
+			Counters: make(map[string]SnapshotValue),
+		}
+	}
+	return m.snapshots.snapshot()
+}
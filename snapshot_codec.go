@@ -0,0 +1,664 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// snapshotProtobufVersion is the version of the protobuf snapshot encoding.
+// Decoding rejects snapshots of a newer version.
+const snapshotProtobufVersion = 1
+
+// SnapshotCodec encodes and decodes MetricsSummary snapshots, so every
+// consumer of snapshots, such as DisplayMetricsHandler, Stream, the FileSink,
+// counter checkpoints and the ProcessSink, can share the same encodings.
+// JSON, protobuf, msgpack and CBOR codecs are registered by default, and
+// codecs for other formats can be added with RegisterSnapshotCodec.
+//
+// Codecs encode the Labels of summary values, or their DisplayLabels when
+// Labels are not set, and decode both.
+type SnapshotCodec interface {
+	// Name identifies the codec, such as "json"
+	Name() string
+
+	// ContentType is the media type of encoded snapshots
+	ContentType() string
+
+	// Encode writes a snapshot, and Decode reads one. Decode may read past
+	// the end of the snapshot, use NewSnapshotDecoder to read a stream of
+	// them.
+	Encode(w io.Writer, s *MetricsSummary) error
+	Decode(r io.Reader, s *MetricsSummary) error
+}
+
+var (
+	// JSONSnapshotCodec encodes snapshots as JSON, in the format served by
+	// DisplayMetricsHandler. Decoded labels are sorted by name, as JSON only
+	// carries them as a map.
+	JSONSnapshotCodec SnapshotCodec = jsonSnapshotCodec{}
+
+	// ProtobufSnapshotCodec encodes snapshots as a compact, versioned
+	// protobuf message which preserves label order and series hashes.
+	ProtobufSnapshotCodec SnapshotCodec = protobufSnapshotCodec{}
+
+	// MsgpackSnapshotCodec and CBORSnapshotCodec encode snapshots as
+	// versioned msgpack and CBOR documents, which preserve label order and
+	// series hashes like the protobuf codec, but are self-describing.
+	MsgpackSnapshotCodec SnapshotCodec = msgpackSnapshotCodec{}
+	CBORSnapshotCodec    SnapshotCodec = cborSnapshotCodec{}
+)
+
+// snapshotCodecs holds the registered codecs by name
+var snapshotCodecs = struct {
+	sync.RWMutex
+	codecs []SnapshotCodec
+}{codecs: []SnapshotCodec{JSONSnapshotCodec, ProtobufSnapshotCodec, MsgpackSnapshotCodec, CBORSnapshotCodec}}
+
+// RegisterSnapshotCodec adds a codec, replacing any codec of the same name.
+func RegisterSnapshotCodec(c SnapshotCodec) {
+	snapshotCodecs.Lock()
+	defer snapshotCodecs.Unlock()
+
+	for i, existing := range snapshotCodecs.codecs {
+		if existing.Name() == c.Name() {
+			snapshotCodecs.codecs[i] = c
+			return
+		}
+	}
+	snapshotCodecs.codecs = append(snapshotCodecs.codecs, c)
+}
+
+// LookupSnapshotCodec returns the codec registered under name, or nil.
+func LookupSnapshotCodec(name string) SnapshotCodec {
+	snapshotCodecs.RLock()
+	defer snapshotCodecs.RUnlock()
+
+	for _, c := range snapshotCodecs.codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// snapshotCodecForAccept returns the first registered codec whose media type
+// is listed in an Accept header, falling back to JSON.
+func snapshotCodecForAccept(accept string) SnapshotCodec {
+	snapshotCodecs.RLock()
+	defer snapshotCodecs.RUnlock()
+
+	for _, part := range strings.Split(accept, ",") {
+		want, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		for _, c := range snapshotCodecs.codecs {
+			if have, _, _ := mime.ParseMediaType(c.ContentType()); have == want {
+				return c
+			}
+		}
+	}
+	return JSONSnapshotCodec
+}
+
+// snapshotEncoder adapts a SnapshotCodec to the Encoder interface
+type snapshotEncoder struct {
+	w     io.Writer
+	codec SnapshotCodec
+}
+
+// NewSnapshotEncoder returns an Encoder writing snapshots to w with codec,
+// for use with InmemSink.Stream.
+func NewSnapshotEncoder(w io.Writer, codec SnapshotCodec) Encoder {
+	return &snapshotEncoder{w: w, codec: codec}
+}
+
+func (e *snapshotEncoder) Encode(v interface{}) error {
+	switch s := v.(type) {
+	case MetricsSummary:
+		return e.codec.Encode(e.w, &s)
+	case *MetricsSummary:
+		return e.codec.Encode(e.w, s)
+	default:
+		return fmt.Errorf("cannot encode %T as a snapshot", v)
+	}
+}
+
+// SnapshotDecoder reads a stream of snapshots, such as one written by Stream
+// with NewSnapshotEncoder.
+type SnapshotDecoder struct {
+	decode func(s *MetricsSummary) error
+}
+
+// NewSnapshotDecoder returns a SnapshotDecoder reading snapshots encoded with
+// codec from r.
+func NewSnapshotDecoder(r io.Reader, codec SnapshotCodec) *SnapshotDecoder {
+	switch codec.(type) {
+	case jsonSnapshotCodec:
+		// A json.Decoder buffers its input, so it must be kept across
+		// snapshots
+		dec := json.NewDecoder(r)
+		return &SnapshotDecoder{decode: func(s *MetricsSummary) error {
+			if err := dec.Decode(s); err != nil {
+				return err
+			}
+			restoreSummaryLabels(s)
+			return nil
+		}}
+	case msgpackSnapshotCodec, cborSnapshotCodec:
+		// Documents are read through a bufio.Reader, which must be kept
+		// across snapshots for the same reason
+		br := bufio.NewReader(r)
+		return &SnapshotDecoder{decode: func(s *MetricsSummary) error {
+			return codec.Decode(br, s)
+		}}
+	}
+	return &SnapshotDecoder{decode: func(s *MetricsSummary) error {
+		return codec.Decode(r, s)
+	}}
+}
+
+// Decode reads the next snapshot into s, returning io.EOF at the end of the
+// stream.
+func (d *SnapshotDecoder) Decode(s *MetricsSummary) error {
+	return d.decode(s)
+}
+
+type jsonSnapshotCodec struct{}
+
+func (jsonSnapshotCodec) Name() string        { return "json" }
+func (jsonSnapshotCodec) ContentType() string { return "application/json" }
+
+func (jsonSnapshotCodec) Encode(w io.Writer, s *MetricsSummary) error {
+	return json.NewEncoder(w).Encode(withDisplayLabels(s))
+}
+
+// withDisplayLabels returns a copy of s with the DisplayLabels of values
+// which only have Labels filled in, as JSON only carries DisplayLabels.
+// Summaries of the InmemSink are returned as is.
+func withDisplayLabels(s *MetricsSummary) *MetricsSummary {
+	out := *s
+	copied := false
+	for i, g := range s.Gauges {
+		if g.DisplayLabels == nil && g.Labels != nil {
+			if !copied {
+				out.Gauges, copied = append([]GaugeValue(nil), s.Gauges...), true
+			}
+			out.Gauges[i].DisplayLabels = displayLabels(g.Labels)
+		}
+	}
+	copied = false
+	for i, g := range s.PrecisionGauges {
+		if g.DisplayLabels == nil && g.Labels != nil {
+			if !copied {
+				out.PrecisionGauges, copied = append([]PrecisionGaugeValue(nil), s.PrecisionGauges...), true
+			}
+			out.PrecisionGauges[i].DisplayLabels = displayLabels(g.Labels)
+		}
+	}
+	out.Counters = sampledWithDisplayLabels(s.Counters)
+	out.Samples = sampledWithDisplayLabels(s.Samples)
+	return &out
+}
+
+func sampledWithDisplayLabels(values []SampledValue) []SampledValue {
+	out, copied := values, false
+	for i, v := range values {
+		if v.DisplayLabels == nil && v.Labels != nil {
+			if !copied {
+				out, copied = append([]SampledValue(nil), values...), true
+			}
+			out[i].DisplayLabels = displayLabels(v.Labels)
+		}
+	}
+	return out
+}
+
+func (jsonSnapshotCodec) Decode(r io.Reader, s *MetricsSummary) error {
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return err
+	}
+	restoreSummaryLabels(s)
+	return nil
+}
+
+// restoreSummaryLabels fills in the labels of a summary decoded from JSON
+func restoreSummaryLabels(s *MetricsSummary) {
+	for i := range s.Gauges {
+		s.Gauges[i].Labels = sortedLabels(s.Gauges[i].DisplayLabels)
+	}
+	for i := range s.PrecisionGauges {
+		s.PrecisionGauges[i].Labels = sortedLabels(s.PrecisionGauges[i].DisplayLabels)
+	}
+	for i := range s.Counters {
+		s.Counters[i].Labels = sortedLabels(s.Counters[i].DisplayLabels)
+	}
+	for i := range s.Samples {
+		s.Samples[i].Labels = sortedLabels(s.Samples[i].DisplayLabels)
+	}
+}
+
+// summaryLabels returns the labels of a summary value. Summaries built by
+// the InmemSink only carry display labels.
+func summaryLabels(labels []Label, display map[string]string) []Label {
+	if labels != nil {
+		return labels
+	}
+	return sortedLabels(display)
+}
+
+// sortedLabels converts display labels back into labels sorted by name
+func sortedLabels(display map[string]string) []Label {
+	if len(display) == 0 {
+		return nil
+	}
+	labels := make([]Label, 0, len(display))
+	for name, value := range display {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// protobufSnapshotCodec encodes snapshots as the following message:
+//
+//	message MetricsSummary {
+//	  uint32 version = 1;
+//	  string timestamp = 2;
+//	  repeated Gauge gauges = 3;
+//	  repeated Gauge precision_gauges = 4;
+//	  repeated Points points = 5;
+//	  repeated Sampled counters = 6;
+//	  repeated Sampled samples = 7;
+//	}
+//	message Label { string name = 1; string value = 2; }
+//	message Gauge {
+//	  string name = 1; string hash = 2; repeated Label labels = 3;
+//	  double value = 4; repeated double history = 5;
+//	  int64 last_updated_unix_nano = 6;
+//	}
+//	message Points { string name = 1; repeated double values = 2; }
+//	message Sampled {
+//	  string name = 1; string hash = 2; repeated Label labels = 3;
+//	  int64 count = 4; double rate = 5; double sum = 6; double sum_sq = 7;
+//	  double min = 8; double max = 9; int64 last_updated_unix_nano = 10;
+//	  double mean = 11; double stddev = 12;
+//	}
+type protobufSnapshotCodec struct{}
+
+func (protobufSnapshotCodec) Name() string { return "protobuf" }
+func (protobufSnapshotCodec) ContentType() string {
+	return "application/x-protobuf; proto=go-metrics.MetricsSummary"
+}
+
+func (protobufSnapshotCodec) Encode(w io.Writer, s *MetricsSummary) error {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, snapshotProtobufVersion)
+	b = appendProtoString(b, 2, s.Timestamp)
+	for _, g := range s.Gauges {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeProtoGauge(g.Name, g.Hash, summaryLabels(g.Labels, g.DisplayLabels), float64(g.Value), g.History, g.LastUpdated))
+	}
+	for _, g := range s.PrecisionGauges {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeProtoGauge(g.Name, g.Hash, summaryLabels(g.Labels, g.DisplayLabels), g.Value, g.History, g.LastUpdated))
+	}
+	for _, p := range s.Points {
+		var m []byte
+		m = appendProtoString(m, 1, p.Name)
+		m = appendProtoDoubles(m, 2, float32sTo64(p.Points))
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	for _, c := range s.Counters {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeProtoSampled(c))
+	}
+	for _, c := range s.Samples {
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeProtoSampled(c))
+	}
+
+	// Snapshots are length prefixed so a stream can hold several
+	var prefix []byte
+	prefix = protowire.AppendVarint(prefix, uint64(len(b)))
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (protobufSnapshotCodec) Decode(r io.Reader, s *MetricsSummary) error {
+	size, err := readUvarint(r)
+	if err != nil {
+		return err
+	}
+	// Read rather than allocate up front, so a corrupt length fails on the
+	// end of the input
+	b, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return err
+	}
+	if uint64(len(b)) != size {
+		return io.ErrUnexpectedEOF
+	}
+
+	*s = MetricsSummary{}
+	return rangeProtoFields(b, func(num protowire.Number, v protoValue) error {
+		switch num {
+		case 1:
+			if v.varint > snapshotProtobufVersion {
+				return fmt.Errorf("unsupported snapshot version %d", v.varint)
+			}
+		case 2:
+			s.Timestamp = string(v.bytes)
+		case 3, 4:
+			var g PrecisionGaugeValue
+			if err := decodeProtoGauge(v.bytes, &g); err != nil {
+				return err
+			}
+			if num == 3 {
+				s.Gauges = append(s.Gauges, GaugeValue{
+					Name: g.Name, Hash: g.Hash, Value: float32(g.Value), History: g.History,
+					LastUpdated: g.LastUpdated, Labels: g.Labels, DisplayLabels: g.DisplayLabels,
+				})
+			} else {
+				s.PrecisionGauges = append(s.PrecisionGauges, g)
+			}
+		case 5:
+			var p PointValue
+			err := rangeProtoFields(v.bytes, func(num protowire.Number, v protoValue) error {
+				switch num {
+				case 1:
+					p.Name = string(v.bytes)
+				case 2:
+					vals, err := decodeProtoDoubles(v)
+					for _, val := range vals {
+						p.Points = append(p.Points, float32(val))
+					}
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			s.Points = append(s.Points, p)
+		case 6, 7:
+			var c SampledValue
+			if err := decodeProtoSampled(v.bytes, &c); err != nil {
+				return err
+			}
+			if num == 6 {
+				s.Counters = append(s.Counters, c)
+			} else {
+				s.Samples = append(s.Samples, c)
+			}
+		}
+		return nil
+	})
+}
+
+func encodeProtoGauge(name, hash string, labels []Label, value float64, history []float64, updated time.Time) []byte {
+	var m []byte
+	m = appendProtoString(m, 1, name)
+	m = appendProtoString(m, 2, hash)
+	m = appendProtoLabels(m, 3, labels)
+	m = appendProtoDouble(m, 4, value)
+	m = appendProtoDoubles(m, 5, history)
+	if !updated.IsZero() {
+		m = protowire.AppendTag(m, 6, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(updated.UnixNano()))
+	}
+	return m
+}
+
+func decodeProtoGauge(b []byte, g *PrecisionGaugeValue) error {
+	err := rangeProtoFields(b, func(num protowire.Number, v protoValue) error {
+		switch num {
+		case 1:
+			g.Name = string(v.bytes)
+		case 2:
+			g.Hash = string(v.bytes)
+		case 3:
+			l, err := decodeProtoLabel(v.bytes)
+			g.Labels = append(g.Labels, l)
+			return err
+		case 4:
+			g.Value = math.Float64frombits(v.varint)
+		case 5:
+			vals, err := decodeProtoDoubles(v)
+			g.History = append(g.History, vals...)
+			return err
+		case 6:
+			g.LastUpdated = time.Unix(0, int64(v.varint))
+		}
+		return nil
+	})
+	g.DisplayLabels = displayLabels(g.Labels)
+	return err
+}
+
+func encodeProtoSampled(c SampledValue) []byte {
+	var m []byte
+	m = appendProtoString(m, 1, c.Name)
+	m = appendProtoString(m, 2, c.Hash)
+	m = appendProtoLabels(m, 3, summaryLabels(c.Labels, c.DisplayLabels))
+	if a := c.AggregateSample; a != nil {
+		m = protowire.AppendTag(m, 4, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(a.Count))
+		m = appendProtoDouble(m, 5, a.Rate)
+		m = appendProtoDouble(m, 6, a.Sum)
+		m = appendProtoDouble(m, 7, a.SumSq)
+		m = appendProtoDouble(m, 8, a.Min)
+		m = appendProtoDouble(m, 9, a.Max)
+		if !a.LastUpdated.IsZero() {
+			m = protowire.AppendTag(m, 10, protowire.VarintType)
+			m = protowire.AppendVarint(m, uint64(a.LastUpdated.UnixNano()))
+		}
+	}
+	m = appendProtoDouble(m, 11, c.Mean)
+	return appendProtoDouble(m, 12, c.Stddev)
+}
+
+func decodeProtoSampled(b []byte, c *SampledValue) error {
+	a := &AggregateSample{}
+	err := rangeProtoFields(b, func(num protowire.Number, v protoValue) error {
+		switch num {
+		case 1:
+			c.Name = string(v.bytes)
+		case 2:
+			c.Hash = string(v.bytes)
+		case 3:
+			l, err := decodeProtoLabel(v.bytes)
+			c.Labels = append(c.Labels, l)
+			return err
+		case 4:
+			a.Count = int(v.varint)
+		case 5:
+			a.Rate = math.Float64frombits(v.varint)
+		case 6:
+			a.Sum = math.Float64frombits(v.varint)
+		case 7:
+			a.SumSq = math.Float64frombits(v.varint)
+		case 8:
+			a.Min = math.Float64frombits(v.varint)
+		case 9:
+			a.Max = math.Float64frombits(v.varint)
+		case 10:
+			a.LastUpdated = time.Unix(0, int64(v.varint))
+		case 11:
+			c.Mean = math.Float64frombits(v.varint)
+		case 12:
+			c.Stddev = math.Float64frombits(v.varint)
+		}
+		return nil
+	})
+	c.AggregateSample = a
+	c.DisplayLabels = displayLabels(c.Labels)
+	return err
+}
+
+func decodeProtoLabel(b []byte) (Label, error) {
+	var l Label
+	err := rangeProtoFields(b, func(num protowire.Number, v protoValue) error {
+		switch num {
+		case 1:
+			l.Name = string(v.bytes)
+		case 2:
+			l.Value = string(v.bytes)
+		}
+		return nil
+	})
+	return l, err
+}
+
+// displayLabels builds the DisplayLabels of a summary value, which are never
+// nil, matching the InmemSink
+func displayLabels(labels []Label) map[string]string {
+	out := make(map[string]string, len(labels))
+	for _, l := range labels {
+		out[l.Name] = l.Value
+	}
+	return out
+}
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// appendProtoDoubles appends a packed repeated double field
+func appendProtoDoubles(b []byte, num protowire.Number, vals []float64) []byte {
+	if len(vals) == 0 {
+		return b
+	}
+	packed := make([]byte, 0, 8*len(vals))
+	for _, v := range vals {
+		packed = protowire.AppendFixed64(packed, math.Float64bits(v))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, packed)
+}
+
+func appendProtoLabels(b []byte, num protowire.Number, labels []Label) []byte {
+	for _, l := range labels {
+		var m []byte
+		m = appendProtoString(m, 1, l.Name)
+		m = appendProtoString(m, 2, l.Value)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return b
+}
+
+func float32sTo64(vals []float32) []float64 {
+	out := make([]float64, len(vals))
+	for i, v := range vals {
+		out[i] = float64(v)
+	}
+	return out
+}
+
+// protoValue is a decoded field value: the raw bits of varint and fixed
+// fields, or the contents of length delimited ones
+type protoValue struct {
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+// rangeProtoFields calls fn with every field of a message, skipping fields
+// of unknown types.
+func rangeProtoFields(b []byte, fn func(protowire.Number, protoValue) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		v := protoValue{typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			v.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v.varint, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeProtoDoubles decodes a packed or unpacked repeated double field
+func decodeProtoDoubles(v protoValue) ([]float64, error) {
+	if v.typ == protowire.Fixed64Type {
+		return []float64{math.Float64frombits(v.varint)}, nil
+	}
+	var out []float64
+	b := v.bytes
+	for len(b) > 0 {
+		bits, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			return out, protowire.ParseError(n)
+		}
+		out = append(out, math.Float64frombits(bits))
+		b = b[n:]
+	}
+	return out, nil
+}
+
+// readUvarint reads a varint from r one byte at a time, so no more than the
+// prefix is consumed
+func readUvarint(r io.Reader) (uint64, error) {
+	var x uint64
+	var buf [1]byte
+	for shift := uint(0); shift < 64; shift += 7 {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			if shift > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		x |= uint64(buf[0]&0x7f) << shift
+		if buf[0] < 0x80 {
+			return x, nil
+		}
+	}
+	return 0, fmt.Errorf("snapshot length overflows")
+}
@@ -0,0 +1,646 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	// snapshotDocumentVersion is the version of the msgpack and CBOR
+	// snapshot encodings. Decoding rejects snapshots of a newer version.
+	snapshotDocumentVersion = 1
+
+	// maxSnapshotString bounds the strings of decoded msgpack and CBOR
+	// snapshots, and maxSnapshotDepth their nesting
+	maxSnapshotString = 1 << 20
+	maxSnapshotDepth  = 8
+)
+
+var errSnapshotDepth = errors.New("snapshot is nested too deeply")
+
+// msgpackSnapshotCodec and cborSnapshotCodec encode snapshots as the same
+// document of maps keyed by field name, so fields can be added without
+// breaking readers:
+//
+//	{"version": 1, "timestamp": string,
+//	 "gauges": [Gauge], "precision_gauges": [Gauge],
+//	 "points": [{"name": string, "values": [float]}],
+//	 "counters": [Sampled], "samples": [Sampled]}
+//
+//	Gauge: {"name": string, "hash": string, "labels": [[name, value]],
+//	  "value": float, "history": [float], "updated": unix nanos}
+//
+//	Sampled: {"name": string, "hash": string, "labels": [[name, value]],
+//	  "count": int, "rate": float, "sum": float, "sum_sq": float,
+//	  "min": float, "max": float, "updated": unix nanos,
+//	  "mean": float, "stddev": float}
+//
+// Like the protobuf encoding, it preserves label order and series hashes.
+type msgpackSnapshotCodec struct{}
+
+func (msgpackSnapshotCodec) Name() string        { return "msgpack" }
+func (msgpackSnapshotCodec) ContentType() string { return "application/vnd.msgpack" }
+
+func (msgpackSnapshotCodec) Encode(w io.Writer, s *MetricsSummary) error {
+	mw := &msgpackWriter{}
+	writeSnapshotDocument(mw, s)
+	_, err := w.Write(mw.b)
+	return err
+}
+
+func (msgpackSnapshotCodec) Decode(r io.Reader, s *MetricsSummary) error {
+	return decodeSnapshotDocument(r, s, readMsgpackValue)
+}
+
+type cborSnapshotCodec struct{}
+
+func (cborSnapshotCodec) Name() string        { return "cbor" }
+func (cborSnapshotCodec) ContentType() string { return "application/cbor" }
+
+func (cborSnapshotCodec) Encode(w io.Writer, s *MetricsSummary) error {
+	cw := &cborWriter{}
+	writeSnapshotDocument(cw, s)
+	_, err := w.Write(cw.b)
+	return err
+}
+
+func (cborSnapshotCodec) Decode(r io.Reader, s *MetricsSummary) error {
+	return decodeSnapshotDocument(r, s, readCBORValue)
+}
+
+// snapshotWriter writes the data model shared by msgpack and CBOR
+type snapshotWriter interface {
+	mapHeader(n int)
+	arrayHeader(n int)
+	string(s string)
+	int(v int64)
+	float(v float64)
+}
+
+func writeSnapshotDocument(w snapshotWriter, s *MetricsSummary) {
+	w.mapHeader(7)
+	w.string("version")
+	w.int(snapshotDocumentVersion)
+	w.string("timestamp")
+	w.string(s.Timestamp)
+
+	w.string("gauges")
+	w.arrayHeader(len(s.Gauges))
+	for _, g := range s.Gauges {
+		writeSnapshotGauge(w, g.Name, g.Hash, summaryLabels(g.Labels, g.DisplayLabels), float64(g.Value), g.History, g.LastUpdated)
+	}
+	w.string("precision_gauges")
+	w.arrayHeader(len(s.PrecisionGauges))
+	for _, g := range s.PrecisionGauges {
+		writeSnapshotGauge(w, g.Name, g.Hash, summaryLabels(g.Labels, g.DisplayLabels), g.Value, g.History, g.LastUpdated)
+	}
+
+	w.string("points")
+	w.arrayHeader(len(s.Points))
+	for _, p := range s.Points {
+		w.mapHeader(2)
+		w.string("name")
+		w.string(p.Name)
+		w.string("values")
+		w.arrayHeader(len(p.Points))
+		for _, v := range p.Points {
+			w.float(float64(v))
+		}
+	}
+
+	w.string("counters")
+	w.arrayHeader(len(s.Counters))
+	for _, c := range s.Counters {
+		writeSnapshotSampled(w, c)
+	}
+	w.string("samples")
+	w.arrayHeader(len(s.Samples))
+	for _, c := range s.Samples {
+		writeSnapshotSampled(w, c)
+	}
+}
+
+func writeSnapshotGauge(w snapshotWriter, name, hash string, labels []Label, value float64, history []float64, updated time.Time) {
+	w.mapHeader(6)
+	w.string("name")
+	w.string(name)
+	w.string("hash")
+	w.string(hash)
+	writeSnapshotLabels(w, labels)
+	w.string("value")
+	w.float(value)
+	w.string("history")
+	w.arrayHeader(len(history))
+	for _, v := range history {
+		w.float(v)
+	}
+	w.string("updated")
+	w.int(snapshotUnixNano(updated))
+}
+
+func writeSnapshotSampled(w snapshotWriter, c SampledValue) {
+	a := c.AggregateSample
+	if a == nil {
+		a = &AggregateSample{}
+	}
+	w.mapHeader(12)
+	w.string("name")
+	w.string(c.Name)
+	w.string("hash")
+	w.string(c.Hash)
+	writeSnapshotLabels(w, summaryLabels(c.Labels, c.DisplayLabels))
+	w.string("count")
+	w.int(int64(a.Count))
+	w.string("rate")
+	w.float(a.Rate)
+	w.string("sum")
+	w.float(a.Sum)
+	w.string("sum_sq")
+	w.float(a.SumSq)
+	w.string("min")
+	w.float(a.Min)
+	w.string("max")
+	w.float(a.Max)
+	w.string("updated")
+	w.int(snapshotUnixNano(a.LastUpdated))
+	w.string("mean")
+	w.float(c.Mean)
+	w.string("stddev")
+	w.float(c.Stddev)
+}
+
+func writeSnapshotLabels(w snapshotWriter, labels []Label) {
+	w.string("labels")
+	w.arrayHeader(len(labels))
+	for _, l := range labels {
+		w.arrayHeader(2)
+		w.string(l.Name)
+		w.string(l.Value)
+	}
+}
+
+// snapshotUnixNano encodes the zero time as zero, which UnixNano does not
+func snapshotUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// snapshotValueReader reads a msgpack or CBOR value as a map[string]any,
+// []any, string, int64, uint64, float64, bool or nil
+type snapshotValueReader func(r *bufio.Reader, depth int) (interface{}, error)
+
+// decodeSnapshotDocument reads a single document. Unless r is a
+// bufio.Reader it may read past the end of the document.
+func decodeSnapshotDocument(r io.Reader, s *MetricsSummary, read snapshotValueReader) error {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	// Only an empty stream ends with io.EOF
+	if _, err := br.Peek(1); err != nil {
+		return err
+	}
+	v, err := read(br, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("snapshot is a %T, not a map", v)
+	}
+	if version := docInt(doc["version"]); version > snapshotDocumentVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	*s = MetricsSummary{Timestamp: docString(doc["timestamp"])}
+	for _, v := range docArray(doc["gauges"]) {
+		g := docGauge(v)
+		s.Gauges = append(s.Gauges, GaugeValue{
+			Name: g.Name, Hash: g.Hash, Value: float32(g.Value), History: g.History,
+			LastUpdated: g.LastUpdated, Labels: g.Labels, DisplayLabels: g.DisplayLabels,
+		})
+	}
+	for _, v := range docArray(doc["precision_gauges"]) {
+		s.PrecisionGauges = append(s.PrecisionGauges, docGauge(v))
+	}
+	for _, v := range docArray(doc["points"]) {
+		m := docMap(v)
+		p := PointValue{Name: docString(m["name"])}
+		for _, val := range docArray(m["values"]) {
+			p.Points = append(p.Points, float32(docFloat(val)))
+		}
+		s.Points = append(s.Points, p)
+	}
+	for _, v := range docArray(doc["counters"]) {
+		s.Counters = append(s.Counters, docSampled(v))
+	}
+	for _, v := range docArray(doc["samples"]) {
+		s.Samples = append(s.Samples, docSampled(v))
+	}
+	return nil
+}
+
+func docGauge(v interface{}) PrecisionGaugeValue {
+	m := docMap(v)
+	g := PrecisionGaugeValue{
+		Name:        docString(m["name"]),
+		Hash:        docString(m["hash"]),
+		Value:       docFloat(m["value"]),
+		LastUpdated: docTime(m["updated"]),
+		Labels:      docLabels(m["labels"]),
+	}
+	for _, val := range docArray(m["history"]) {
+		g.History = append(g.History, docFloat(val))
+	}
+	g.DisplayLabels = displayLabels(g.Labels)
+	return g
+}
+
+func docSampled(v interface{}) SampledValue {
+	m := docMap(v)
+	c := SampledValue{
+		Name: docString(m["name"]),
+		Hash: docString(m["hash"]),
+		AggregateSample: &AggregateSample{
+			Count:       int(docInt(m["count"])),
+			Rate:        docFloat(m["rate"]),
+			Sum:         docFloat(m["sum"]),
+			SumSq:       docFloat(m["sum_sq"]),
+			Min:         docFloat(m["min"]),
+			Max:         docFloat(m["max"]),
+			LastUpdated: docTime(m["updated"]),
+		},
+		Mean:   docFloat(m["mean"]),
+		Stddev: docFloat(m["stddev"]),
+		Labels: docLabels(m["labels"]),
+	}
+	c.DisplayLabels = displayLabels(c.Labels)
+	return c
+}
+
+func docLabels(v interface{}) []Label {
+	var labels []Label
+	for _, l := range docArray(v) {
+		if pair := docArray(l); len(pair) == 2 {
+			labels = append(labels, Label{Name: docString(pair[0]), Value: docString(pair[1])})
+		}
+	}
+	return labels
+}
+
+// The doc accessors return the zero value for missing fields and fields of
+// an unexpected type
+
+func docMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func docArray(v interface{}) []interface{} {
+	a, _ := v.([]interface{})
+	return a
+}
+
+func docString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func docFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return 0
+}
+
+func docInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
+
+func docTime(v interface{}) time.Time {
+	if n := docInt(v); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// readSnapshotUint reads a big endian unsigned integer of size bytes
+func readSnapshotUint(r *bufio.Reader, size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func readSnapshotString(r *bufio.Reader, n uint64) (string, error) {
+	if n > maxSnapshotString {
+		return "", fmt.Errorf("snapshot string of %d bytes is too long", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func readSnapshotArray(r *bufio.Reader, n uint64, depth int, read snapshotValueReader) (interface{}, error) {
+	// Every element takes at least a byte, so a bogus count fails on the
+	// end of the input rather than allocating
+	size := n
+	if size > 64 {
+		size = 64
+	}
+	out := make([]interface{}, 0, size)
+	for i := uint64(0); i < n; i++ {
+		v, err := read(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func readSnapshotMap(r *bufio.Reader, n uint64, depth int, read snapshotValueReader) (interface{}, error) {
+	out := make(map[string]interface{})
+	for i := uint64(0); i < n; i++ {
+		k, err := read(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("snapshot map key is a %T, not a string", k)
+		}
+		if out[key], err = read(r, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// msgpackWriter encodes values in the msgpack format
+type msgpackWriter struct {
+	b []byte
+}
+
+func (w *msgpackWriter) header(n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		w.b = append(w.b, fix|byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, b16), uint16(n))
+	default:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, b32), uint32(n))
+	}
+}
+
+func (w *msgpackWriter) mapHeader(n int)   { w.header(n, 0x80, 0xde, 0xdf) }
+func (w *msgpackWriter) arrayHeader(n int) { w.header(n, 0x90, 0xdc, 0xdd) }
+
+func (w *msgpackWriter) string(s string) {
+	switch n := len(s); {
+	case n < 32:
+		w.b = append(w.b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.b = append(w.b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, 0xda), uint16(n))
+	default:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, 0xdb), uint32(n))
+	}
+	w.b = append(w.b, s...)
+}
+
+func (w *msgpackWriter) int(v int64) {
+	switch {
+	case v >= -32 && v < 128:
+		// Positive and negative fixints
+		w.b = append(w.b, byte(v))
+	case v > 0 && v <= math.MaxUint32:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, 0xce), uint32(v))
+	default:
+		w.b = binary.BigEndian.AppendUint64(append(w.b, 0xd3), uint64(v))
+	}
+}
+
+func (w *msgpackWriter) float(v float64) {
+	w.b = binary.BigEndian.AppendUint64(append(w.b, 0xcb), math.Float64bits(v))
+}
+
+func readMsgpackValue(r *bufio.Reader, depth int) (interface{}, error) {
+	if depth > maxSnapshotDepth {
+		return nil, errSnapshotDepth
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return readSnapshotMap(r, uint64(b&0x0f), depth, readMsgpackValue)
+	case b&0xf0 == 0x90:
+		return readSnapshotArray(r, uint64(b&0x0f), depth, readMsgpackValue)
+	case b&0xe0 == 0xa0:
+		return readSnapshotString(r, uint64(b&0x1f))
+	}
+
+	// The remaining types are followed by a length or value of a fixed size
+	var size int
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xcc, 0xd0, 0xd9:
+		size = 1
+	case 0xc5, 0xcd, 0xd1, 0xda, 0xdc, 0xde:
+		size = 2
+	case 0xc6, 0xca, 0xce, 0xd2, 0xdb, 0xdd, 0xdf:
+		size = 4
+	case 0xcb, 0xcf, 0xd3:
+		size = 8
+	default:
+		return nil, fmt.Errorf("unsupported msgpack type 0x%02x", b)
+	}
+	n, err := readSnapshotUint(r, size)
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		return readSnapshotString(r, n)
+	case 0xdc, 0xdd:
+		return readSnapshotArray(r, n, depth, readMsgpackValue)
+	case 0xde, 0xdf:
+		return readSnapshotMap(r, n, depth, readMsgpackValue)
+	case 0xca:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		return math.Float64frombits(n), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		// Sign extend
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	default:
+		return n, nil
+	}
+}
+
+// cborWriter encodes values in the CBOR format
+type cborWriter struct {
+	b []byte
+}
+
+func (w *cborWriter) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		w.b = append(w.b, major|byte(n))
+	case n <= math.MaxUint8:
+		w.b = append(w.b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, major|26), uint32(n))
+	default:
+		w.b = binary.BigEndian.AppendUint64(append(w.b, major|27), n)
+	}
+}
+
+func (w *cborWriter) mapHeader(n int)   { w.head(5, uint64(n)) }
+func (w *cborWriter) arrayHeader(n int) { w.head(4, uint64(n)) }
+
+func (w *cborWriter) string(s string) {
+	w.head(3, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *cborWriter) int(v int64) {
+	if v >= 0 {
+		w.head(0, uint64(v))
+	} else {
+		// Negative integers encode -1 - v
+		w.head(1, uint64(^v))
+	}
+}
+
+func (w *cborWriter) float(v float64) {
+	w.b = binary.BigEndian.AppendUint64(append(w.b, 0xfb), math.Float64bits(v))
+}
+
+func readCBORValue(r *bufio.Reader, depth int) (interface{}, error) {
+	if depth > maxSnapshotDepth {
+		return nil, errSnapshotDepth
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			bits, err := readSnapshotUint(r, 2)
+			return float16ToFloat64(uint16(bits)), err
+		case 26:
+			bits, err := readSnapshotUint(r, 4)
+			return float64(math.Float32frombits(uint32(bits))), err
+		case 27:
+			bits, err := readSnapshotUint(r, 8)
+			return math.Float64frombits(bits), err
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		if n, err = readSnapshotUint(r, 1<<(info-24)); err != nil {
+			return nil, err
+		}
+	default:
+		// Including indefinite lengths, which are never written
+		return nil, fmt.Errorf("unsupported CBOR length %d", info)
+	}
+
+	switch major {
+	case 0:
+		return n, nil
+	case 1:
+		return int64(^n), nil
+	case 2, 3:
+		return readSnapshotString(r, n)
+	case 4:
+		return readSnapshotArray(r, n, depth, readCBORValue)
+	case 5:
+		return readSnapshotMap(r, n, depth, readCBORValue)
+	default:
+		// Tags are skipped, keeping the tagged value
+		return readCBORValue(r, depth+1)
+	}
+}
+
+// float16ToFloat64 decodes a half precision float
+func float16ToFloat64(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 0x1f:
+		v = math.Inf(1)
+		if mant != 0 {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+0x400, exp-25)
+	}
+	if h&0x8000 != 0 {
+		v = -v
+	}
+	return v
+}
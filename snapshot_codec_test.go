@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testSnapshot() MetricsSummary {
+	inm := NewInmemSink(time.Minute, time.Minute)
+	inm.SetGaugeWithLabels([]string{"queue"}, 4, []Label{{"b", "2"}, {"a", "1"}})
+	inm.SetPrecisionGauge([]string{"ratio"}, 0.125)
+	inm.EmitKey([]string{"kv"}, 7)
+	inm.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"code", "200"}})
+	inm.AddSample([]string{"latency"}, 10)
+	inm.AddSample([]string{"latency"}, 30)
+	return newMetricSummaryFromInterval(inm.Data()[0])
+}
+
+func TestSnapshotCodecs_RoundTrip(t *testing.T) {
+	summary := testSnapshot()
+	for _, codec := range []SnapshotCodec{JSONSnapshotCodec, ProtobufSnapshotCodec, MsgpackSnapshotCodec, CBORSnapshotCodec} {
+		var buf bytes.Buffer
+		// Two snapshots in one stream
+		enc := NewSnapshotEncoder(&buf, codec)
+		if err := enc.Encode(summary); err != nil {
+			t.Fatalf("%s: unexpected err %s", codec.Name(), err)
+		}
+		if err := enc.Encode(&summary); err != nil {
+			t.Fatalf("%s: unexpected err %s", codec.Name(), err)
+		}
+
+		dec := NewSnapshotDecoder(&buf, codec)
+		for i := 0; i < 2; i++ {
+			var got MetricsSummary
+			if err := dec.Decode(&got); err != nil {
+				t.Fatalf("%s: unexpected err %s", codec.Name(), err)
+			}
+			if got.Timestamp != summary.Timestamp || len(got.Gauges) != 1 || len(got.PrecisionGauges) != 1 ||
+				len(got.Points) != 1 || len(got.Counters) != 1 || len(got.Samples) != 1 {
+				t.Fatalf("%s: bad summary %#v", codec.Name(), got)
+			}
+			if g := got.Gauges[0]; g.Name != summary.Gauges[0].Name || g.Value != 4 ||
+				!reflect.DeepEqual(g.Labels, []Label{{"a", "1"}, {"b", "2"}}) ||
+				!reflect.DeepEqual(g.DisplayLabels, map[string]string{"a": "1", "b": "2"}) {
+				t.Fatalf("%s: bad gauge %#v", codec.Name(), g)
+			}
+			if g := got.Gauges[0]; !g.LastUpdated.Equal(summary.Gauges[0].LastUpdated) {
+				t.Fatalf("%s: bad gauge timestamp %s", codec.Name(), g.LastUpdated)
+			}
+			if g := got.PrecisionGauges[0]; g.Value != 0.125 || !g.LastUpdated.Equal(summary.PrecisionGauges[0].LastUpdated) {
+				t.Fatalf("%s: bad precision gauge %#v", codec.Name(), g)
+			}
+			if p := got.Points[0]; p.Name != "kv" || !reflect.DeepEqual(p.Points, []float32{7}) {
+				t.Fatalf("%s: bad points %#v", codec.Name(), p)
+			}
+			if s := got.Samples[0]; s.Count != 2 || s.Sum != 40 || s.Min != 10 || s.Max != 30 || s.Mean != 20 {
+				t.Fatalf("%s: bad sample %#v", codec.Name(), s)
+			}
+			if c := got.Counters[0]; c.Sum != 3 || c.DisplayLabels["code"] != "200" ||
+				!c.LastUpdated.Equal(summary.Counters[0].LastUpdated) {
+				t.Fatalf("%s: bad counter %#v", codec.Name(), c)
+			}
+		}
+		if err := dec.Decode(&MetricsSummary{}); err != io.EOF {
+			t.Fatalf("%s: expected EOF, got %v", codec.Name(), err)
+		}
+	}
+
+	// All but the JSON codec keep series hashes and label order
+	summary.Counters[0].Labels = []Label{{"z", "1"}, {"a", "2"}}
+	for _, codec := range []SnapshotCodec{ProtobufSnapshotCodec, MsgpackSnapshotCodec, CBORSnapshotCodec} {
+		var buf bytes.Buffer
+		_ = codec.Encode(&buf, &summary)
+		var got MetricsSummary
+		_ = codec.Decode(&buf, &got)
+		if got.Gauges[0].Hash != summary.Gauges[0].Hash || got.Samples[0].Hash == "" {
+			t.Fatalf("%s: bad hashes %q %q", codec.Name(), got.Gauges[0].Hash, got.Samples[0].Hash)
+		}
+		if !reflect.DeepEqual(got.Counters[0].Labels, summary.Counters[0].Labels) {
+			t.Fatalf("%s: bad labels %v", codec.Name(), got.Counters[0].Labels)
+		}
+	}
+}
+
+func TestJSONSnapshotCodec_Labels(t *testing.T) {
+	// Summaries built outside the InmemSink may only carry Labels
+	summary := MetricsSummary{Counters: []SampledValue{{
+		Name:            "requests",
+		Labels:          []Label{{"code", "200"}},
+		AggregateSample: &AggregateSample{Count: 1, Sum: 1},
+	}}}
+	var buf bytes.Buffer
+	if err := JSONSnapshotCodec.Encode(&buf, &summary); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if summary.Counters[0].DisplayLabels != nil {
+		t.Fatalf("the summary was modified")
+	}
+	var got MetricsSummary
+	if err := JSONSnapshotCodec.Decode(&buf, &got); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if !reflect.DeepEqual(got.Counters[0].Labels, []Label{{"code", "200"}}) {
+		t.Fatalf("bad labels %v", got.Counters[0].Labels)
+	}
+}
+
+func TestSnapshotDocument_Decode(t *testing.T) {
+	// Documents written by other encoders, with a float32 in msgpack, and
+	// a half precision float and a tagged string in CBOR
+	for codec, doc := range map[SnapshotCodec]string{
+		MsgpackSnapshotCodec: "\x83\xa7version\x01\xa9timestamp\xa1t\xa6points\x91\x82\xa4name\xa2kv\xa6values\x91\xca\x3f\xc0\x00\x00",
+		CBORSnapshotCodec:    "\xa3\x67version\x01\x69timestamp\xc0\x61t\x66points\x81\xa2\x64name\x62kv\x66values\x81\xf9\x3e\x00",
+	} {
+		var got MetricsSummary
+		if err := codec.Decode(strings.NewReader(doc), &got); err != nil {
+			t.Fatalf("%s: unexpected err %s", codec.Name(), err)
+		}
+		if got.Timestamp != "t" || len(got.Points) != 1 || got.Points[0].Name != "kv" ||
+			!reflect.DeepEqual(got.Points[0].Points, []float32{1.5}) {
+			t.Fatalf("%s: bad summary %#v", codec.Name(), got)
+		}
+
+		// Truncated documents fail
+		err := codec.Decode(strings.NewReader(doc[:len(doc)-1]), &got)
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("%s: expected unexpected EOF, got %v", codec.Name(), err)
+		}
+	}
+
+	for codec, doc := range map[SnapshotCodec]string{
+		MsgpackSnapshotCodec: "\x81\xa7version\x02",
+		CBORSnapshotCodec:    "\xa1\x67version\x02",
+	} {
+		err := codec.Decode(strings.NewReader(doc), &MetricsSummary{})
+		if err == nil || !strings.Contains(err.Error(), "unsupported snapshot version") {
+			t.Fatalf("%s: expected version error, got %v", codec.Name(), err)
+		}
+	}
+}
+
+func TestProtobufSnapshotCodec_Version(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, snapshotProtobufVersion+1)
+	r := io.MultiReader(bytes.NewReader(protowire.AppendVarint(nil, uint64(len(b)))), bytes.NewReader(b))
+	err := ProtobufSnapshotCodec.Decode(r, &MetricsSummary{})
+	if err == nil || !strings.Contains(err.Error(), "unsupported snapshot version") {
+		t.Fatalf("expected version error, got %v", err)
+	}
+}
+
+func TestDisplayMetricsHandler_Accept(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Minute)
+	inm.SetGauge([]string{"queue"}, 4)
+	handler := inm.DisplayMetricsHandler()
+
+	for accept, expected := range map[string]SnapshotCodec{
+		"":                       JSONSnapshotCodec,
+		"text/html, */*":         JSONSnapshotCodec,
+		"application/x-protobuf": ProtobufSnapshotCodec,
+		"application/cbor":       CBORSnapshotCodec,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if ct := rec.Header().Get("Content-Type"); ct != expected.ContentType() {
+			t.Fatalf("accept %q: bad content type %q", accept, ct)
+		}
+		var got MetricsSummary
+		if err := expected.Decode(rec.Body, &got); err != nil || len(got.Gauges) != 1 {
+			t.Fatalf("accept %q: bad body %v %v", accept, got, err)
+		}
+	}
+}
+
+func TestRegisterSnapshotCodec(t *testing.T) {
+	if LookupSnapshotCodec("json") != JSONSnapshotCodec || LookupSnapshotCodec("msgpack") != MsgpackSnapshotCodec ||
+		LookupSnapshotCodec("nope") != nil {
+		t.Fatalf("bad lookup")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"testing"
+)
+
+func TestMetrics_Snapshot(t *testing.T) {
+	conf := DefaultConfig("service")
+	conf.EnableRuntimeMetrics = false
+	conf.EnableSnapshot = true
+	conf.FilterDefault = false
+	met, err := New(conf, &BlackholeSink{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := []Label{{"a", "b"}}
+	met.SetGauge([]string{"queue", "depth"}, 3)
+	met.SetGauge([]string{"queue", "depth"}, 5)
+	met.SetPrecisionGaugeWithLabels([]string{"queue", "depth"}, 7, labels)
+	met.IncrCounter([]string{"requests"}, 1)
+	met.IncrCounter([]string{"requests"}, 2)
+	met.IncrCounterWithLabels([]string{"requests"}, 4, labels)
+
+	// Mutating the caller's labels must not affect the snapshot
+	labels[0].Value = "c"
+
+	snap := met.Snapshot()
+	if v, ok := snap.Gauge([]string{"queue", "depth"}, nil); !ok || v != 5 {
+		t.Fatalf("bad gauge: %v %v", v, ok)
+	}
+	if v, ok := snap.Gauge([]string{"queue", "depth"}, []Label{{"a", "b"}}); !ok || v != 7 {
+		t.Fatalf("bad gauge: %v %v", v, ok)
+	}
+	if v, ok := snap.Counter([]string{"requests"}, nil); !ok || v != 3 {
+		t.Fatalf("bad counter: %v %v", v, ok)
+	}
+	if v, ok := snap.Counter([]string{"requests"}, []Label{{"a", "b"}}); !ok || v != 4 {
+		t.Fatalf("bad counter: %v %v", v, ok)
+	}
+	if _, ok := snap.Counter([]string{"missing"}, nil); ok {
+		t.Fatalf("unexpected counter")
+	}
+}
+
+func TestMetrics_SnapshotDisabled(t *testing.T) {
+	_, met := mockMetric()
+	met.IncrCounter([]string{"requests"}, 1)
+	if snap := met.Snapshot(); len(snap.Counters) != 0 || len(snap.Gauges) != 0 {
+		t.Fatalf("bad snapshot: %v", snap)
+	}
+}
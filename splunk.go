@@ -0,0 +1,302 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// splunkFlushInterval is used when SplunkOpts.FlushInterval is not set
+	splunkFlushInterval = 10 * time.Second
+
+	// splunkBatchSize is used when SplunkOpts.BatchSize is not set
+	splunkBatchSize = 500
+)
+
+// SplunkOpts is used to configure a SplunkSink.
+type SplunkOpts struct {
+	// Address is the base URL of the HTTP Event Collector, for example
+	// "https://splunk:8088"
+	Address string
+
+	// Token is the HEC token events are sent with
+	Token string
+
+	// Index is the metrics index events are written to, the default index
+	// of the token is used when empty
+	Index string
+
+	// Host, Source and SourceType set the default fields of every event,
+	// Splunk fills them in when empty
+	Host       string
+	Source     string
+	SourceType string
+
+	// FlushInterval is how often events are sent, it defaults to 10 seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the maximum number of events per request, it defaults to
+	// 500
+	BatchSize int
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of requests, which are gzip
+	// compressed by default
+	Compression HTTPCompression
+
+	// RetryPolicy applies to failed requests, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// SplunkSink provides a MetricSink which sends metrics to the Splunk HTTP
+// Event Collector in the multi-metric JSON format. Metrics are aggregated
+// in memory and every flush sends one event per label set, holding each
+// series of that set as a "metric_name:<key>" field:
+//
+//	{"time":1714662245.000,"event":"metric","index":"metrics",
+//	 "fields":{"route":"/users","metric_name:api.requests":42,
+//	 "metric_name:api.latency.mean":12.5,"metric_name:api.latency.count":4}}
+//
+// Gauges and key/value pairs report their last value and counters their
+// sum, while samples are sent as the count, mean, min and max fields of
+// their key. Labels become dimensions of the event.
+type SplunkSink struct {
+	url       string
+	headers   http.Header
+	index     string
+	host      string
+	source    string
+	srcType   string
+	batchSize int
+	client    *http.Client
+	encoder   *HTTPEncoder
+	retry     RetryPolicy
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// splunkEvent is a multi-metric event sent by a SplunkSink
+type splunkEvent struct {
+	Time       json.Number            `json:"time"`
+	Event      string                 `json:"event"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	SourceType string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// NewSplunkSink creates a SplunkSink and starts its flush loop.
+func NewSplunkSink(opts SplunkOpts) (*SplunkSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("splunk address is required")
+	}
+	if opts.Token == "" {
+		return nil, fmt.Errorf("splunk HEC token is required")
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = splunkFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = splunkBatchSize
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+	encoder, err := NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	headers.Set("Authorization", "Splunk "+opts.Token)
+
+	s := &SplunkSink{
+		url:       strings.TrimSuffix(opts.Address, "/") + "/services/collector/event",
+		headers:   headers,
+		index:     opts.Index,
+		host:      opts.Host,
+		source:    opts.Source,
+		srcType:   opts.SourceType,
+		batchSize: batchSize,
+		loop:      newFlushLoop(interval),
+		client:    client,
+		encoder:   encoder,
+		retry:     retry,
+		agg:       newIntervalAggregator(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *SplunkSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SplunkSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *SplunkSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *SplunkSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *SplunkSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *SplunkSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SplunkSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *SplunkSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SplunkSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Splunk sink supports.
+func (s *SplunkSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining events are
+// sent.
+func (s *SplunkSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often events are sent, starting from now.
+func (s *SplunkSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *SplunkSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error pushing to Splunk! Err: %s", err)
+	}
+}
+
+// flush sends the events of the interval ending now in batches.
+func (s *SplunkSink) flush(now time.Time) error {
+	events := s.events(s.agg.drain(), now)
+	if len(events) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	for len(events) > 0 {
+		n := min(len(events), s.batchSize)
+		body := bytes.Join(events[:n], nil)
+		err := s.retry.Do(ctx, "Splunk", func() error {
+			resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, s.headers)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = resp.Body.Close() }()
+			return CheckHTTPResponse(resp)
+		})
+		if err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// events encodes aggregates as multi-metric events, one per label set in
+// the order the sets are first seen. Values JSON cannot represent are
+// skipped, as are events left without any.
+func (s *SplunkSink) events(aggs []*aggregate, now time.Time) [][]byte {
+	var order []string
+	groups := make(map[string]map[string]interface{})
+	series := make(map[string]int)
+	for _, a := range aggs {
+		id := seriesKey(nil, a.labels)
+		fields, ok := groups[id]
+		if !ok {
+			fields = make(map[string]interface{}, len(a.labels)+1)
+			for _, l := range a.labels {
+				fields[l.Name] = l.Value
+			}
+			groups[id] = fields
+			order = append(order, id)
+		}
+
+		name := "metric_name:" + strings.Join(a.key, ".")
+		add := func(name string, val float64) {
+			if !math.IsNaN(val) && !math.IsInf(val, 0) {
+				fields[name] = val
+				series[id]++
+			}
+		}
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			add(name, a.last)
+		case aggregateCounter:
+			add(name, a.sum)
+		case aggregateSample:
+			add(name+".count", float64(a.count))
+			add(name+".mean", a.mean())
+			add(name+".min", a.min)
+			add(name+".max", a.max)
+		}
+	}
+
+	ts := json.Number(fmt.Sprintf("%d.%03d", now.Unix(), now.Nanosecond()/int(time.Millisecond)))
+	events := make([][]byte, 0, len(order))
+	for _, id := range order {
+		if series[id] == 0 {
+			continue
+		}
+		b, err := json.Marshal(splunkEvent{
+			Time:       ts,
+			Event:      "metric",
+			Host:       s.host,
+			Source:     s.source,
+			SourceType: s.srcType,
+			Index:      s.index,
+			Fields:     groups[id],
+		})
+		if err != nil {
+			continue
+		}
+		events = append(events, b)
+	}
+	return events
+}
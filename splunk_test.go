@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// splunkServer is an HEC endpoint keeping every event it accepts. status
+// picks the status of a request by its number.
+type splunkServer struct {
+	*httptest.Server
+	t *testing.T
+
+	lock     sync.Mutex
+	requests int
+	batches  []int
+	events   []map[string]interface{}
+	status   func(request int) int
+}
+
+func newSplunkServer(t *testing.T, status func(request int) int) *splunkServer {
+	s := &splunkServer{t: t, status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.collect))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *splunkServer) collect(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests++
+
+	if r.URL.Path != "/services/collector/event" || r.Header.Get("Authorization") != "Splunk secret" {
+		s.t.Errorf("bad request %s %v", r.URL.Path, r.Header)
+	}
+	if code := s.status(s.requests); code != http.StatusOK {
+		w.WriteHeader(code)
+		_, _ = io.WriteString(w, `{"text":"Server is busy","code":9}`)
+		return
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		s.t.Errorf("bad body: %s", err)
+		return
+	}
+
+	// Events are concatenated JSON objects
+	n := 0
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var event map[string]interface{}
+		if err := dec.Decode(&event); err != nil {
+			s.t.Errorf("bad event: %s", err)
+			return
+		}
+		s.events = append(s.events, event)
+		n++
+	}
+	s.batches = append(s.batches, n)
+	_, _ = io.WriteString(w, `{"text":"Success","code":0}`)
+}
+
+func TestSplunkSink(t *testing.T) {
+	srv := newSplunkServer(t, func(int) int { return http.StatusOK })
+	sink, err := NewSplunkSink(SplunkOpts{
+		Address:       srv.URL + "/",
+		Token:         "secret",
+		Index:         "metrics",
+		Source:        "api",
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	route := []Label{{"route", "/users"}}
+	sink.SetGauge([]string{"api", "goroutines"}, 12)
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 1, route)
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 2, route)
+	sink.AddSampleWithLabels([]string{"api", "latency"}, 10, route)
+	sink.AddSampleWithLabels([]string{"api", "latency"}, 30, route)
+	sink.SetPrecisionGauge([]string{"api", "broken"}, math.NaN())
+
+	now := time.Unix(1714662245, 250*int64(time.Millisecond))
+	if err := sink.flush(now); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if len(srv.events) != 2 {
+		t.Fatalf("bad events %v", srv.events)
+	}
+	for _, event := range srv.events {
+		if event["time"] != 1714662245.25 || event["event"] != "metric" || event["index"] != "metrics" ||
+			event["source"] != "api" || event["host"] != nil {
+			t.Fatalf("bad event %v", event)
+		}
+	}
+	if got := srv.events[1]["fields"]; !reflect.DeepEqual(got, map[string]interface{}{
+		"metric_name:api.goroutines": float64(12),
+	}) {
+		t.Fatalf("bad fields %v", got)
+	}
+	if got := srv.events[0]["fields"]; !reflect.DeepEqual(got, map[string]interface{}{
+		"route":                         "/users",
+		"metric_name:api.requests":      float64(3),
+		"metric_name:api.latency.count": float64(2),
+		"metric_name:api.latency.mean":  float64(20),
+		"metric_name:api.latency.min":   float64(10),
+		"metric_name:api.latency.max":   float64(30),
+	}) {
+		t.Fatalf("bad fields %v", got)
+	}
+}
+
+func TestSplunkSink_Batches(t *testing.T) {
+	srv := newSplunkServer(t, func(request int) int {
+		// The first request is retried once the collector recovers
+		if request == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	sink, err := NewSplunkSink(SplunkOpts{
+		Address:       srv.URL,
+		Token:         "secret",
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		RetryPolicy:   &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	for _, host := range []string{"a", "b", "c", "d", "e"} {
+		sink.SetGaugeWithLabels([]string{"up"}, 1, []Label{{"host", host}})
+	}
+	if err := sink.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if srv.requests != 4 || !reflect.DeepEqual(srv.batches, []int{2, 2, 1}) {
+		t.Fatalf("bad batches %d %v", srv.requests, srv.batches)
+	}
+}
+
+func TestNewSplunkSink_Errors(t *testing.T) {
+	if _, err := NewSplunkSink(SplunkOpts{Token: "secret"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewSplunkSink(SplunkOpts{Address: "http://localhost:8088"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
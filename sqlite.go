@@ -0,0 +1,267 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// sqliteTable, sqliteFlushInterval and sqliteRetention are used when
+	// the matching SQLiteOpts are not set
+	sqliteTable         = "metrics"
+	sqliteFlushInterval = 10 * time.Second
+	sqliteRetention     = 7 * 24 * time.Hour
+)
+
+// sqliteTableName restricts table names to plain identifiers, as they cannot
+// be passed as query parameters
+var sqliteTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLiteOpts is used to configure a SQLiteSink.
+type SQLiteOpts struct {
+	// DB is the database the intervals are stored in. It is opened by the
+	// application with a SQLite driver of its choice, such as
+	// github.com/mattn/go-sqlite3 or modernc.org/sqlite, and is not closed
+	// by the sink.
+	DB *sql.DB
+
+	// Table is the table the intervals are stored in, which is created if
+	// needed. It defaults to "metrics".
+	Table string
+
+	// FlushInterval is the length of the aggregation intervals, each of
+	// which is stored as a row per series. It defaults to 10 seconds.
+	FlushInterval time.Duration
+
+	// Retention is how long rows are kept, older rows are deleted on every
+	// flush. It defaults to 7 days, and a negative value keeps all rows.
+	Retention time.Duration
+}
+
+// SQLiteSink provides a MetricSink which stores aggregated intervals in a
+// local SQLite database, so that metrics of devices without network
+// connectivity can be kept and queried later, for example by a CLI. Every
+// series of an interval is stored as a row of a table such as:
+//
+//	CREATE TABLE metrics (
+//		timestamp INTEGER NOT NULL, -- end of the interval, Unix milliseconds
+//		name      TEXT    NOT NULL,
+//		type      TEXT    NOT NULL, -- counter, gauge, kv or sample
+//		labels    TEXT    NOT NULL, -- JSON object
+//		value     REAL    NOT NULL, -- sum of counters, mean of samples
+//		count     INTEGER NOT NULL,
+//		sum       REAL,
+//		min       REAL,
+//		max       REAL
+//	)
+//
+// Gauges and key/value points store their last value. The sum, min and max
+// are only set for samples. Labels can be queried with the JSON functions of
+// SQLite, as in:
+//
+//	SELECT timestamp, value FROM metrics
+//	WHERE name = 'api.latency' AND json_extract(labels, '$.route') = '/users'
+//	ORDER BY timestamp
+type SQLiteSink struct {
+	db        *sql.DB
+	table     string
+	retention time.Duration
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewSQLiteSink creates a SQLiteSink, creating its table and indexes if
+// needed, and starts its flush loop.
+func NewSQLiteSink(opts SQLiteOpts) (*SQLiteSink, error) {
+	if opts.DB == nil {
+		return nil, fmt.Errorf("sqlite database is required")
+	}
+	table := opts.Table
+	if table == "" {
+		table = sqliteTable
+	}
+	if !sqliteTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid sqlite table name %q", table)
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = sqliteFlushInterval
+	}
+	retention := opts.Retention
+	if retention == 0 {
+		retention = sqliteRetention
+	}
+
+	s := &SQLiteSink{
+		db:        opts.DB,
+		table:     table,
+		retention: retention,
+		agg:       newIntervalAggregator(),
+	}
+	if err := s.createTable(context.Background()); err != nil {
+		return nil, err
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+func (s *SQLiteSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SQLiteSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *SQLiteSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *SQLiteSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *SQLiteSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *SQLiteSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SQLiteSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *SQLiteSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SQLiteSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the SQLite sink supports.
+func (s *SQLiteSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop after storing the current interval. The
+// database is left open.
+func (s *SQLiteSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes the length of the aggregation intervals, starting
+// from now.
+func (s *SQLiteSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *SQLiteSink) createTable(ctx context.Context) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+			timestamp INTEGER NOT NULL,
+			name      TEXT    NOT NULL,
+			type      TEXT    NOT NULL,
+			labels    TEXT    NOT NULL,
+			value     REAL    NOT NULL,
+			count     INTEGER NOT NULL,
+			sum       REAL,
+			min       REAL,
+			max       REAL
+		)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.table + `_name_timestamp ON ` + s.table + ` (name, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.table + `_timestamp ON ` + s.table + ` (timestamp)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(context.Background(), now); err != nil {
+		log.Printf("[ERR] Error writing to sqlite! Err: %s", err)
+	}
+}
+
+// flush stores the aggregated interval in a single transaction, and deletes
+// the rows past the retention.
+func (s *SQLiteSink) flush(ctx context.Context, now time.Time) error {
+	aggs := s.agg.drain()
+	if len(aggs) > 0 {
+		if err := s.insert(ctx, now, aggs); err != nil {
+			return err
+		}
+	}
+	if s.retention > 0 {
+		cutoff := now.Add(-s.retention).UnixMilli()
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM `+s.table+` WHERE timestamp < ?`, cutoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteSink) insert(ctx context.Context, now time.Time, aggs []*aggregate) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO `+s.table+
+		` (timestamp, name, type, labels, value, count, sum, min, max) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Close() }()
+
+	ts := now.UnixMilli()
+	for _, a := range aggs {
+		labels := make(map[string]string, len(a.labels))
+		for _, l := range a.labels {
+			labels[l.Name] = l.Value
+		}
+		encoded, err := json.Marshal(labels)
+		if err != nil {
+			return err
+		}
+
+		name := strings.Join(a.key, ".")
+		var typ string
+		var value float64
+		var sum, min, max sql.NullFloat64
+		count := 1
+		switch a.kind {
+		case aggregateGauge:
+			typ, value = "gauge", a.last
+		case aggregateKV:
+			typ, value = "kv", a.last
+		case aggregateCounter:
+			typ, value, count = "counter", a.sum, a.count
+		case aggregateSample:
+			typ, value, count = "sample", a.mean(), a.count
+			sum = sql.NullFloat64{Float64: a.sum, Valid: true}
+			min = sql.NullFloat64{Float64: a.min, Valid: true}
+			max = sql.NullFloat64{Float64: a.max, Valid: true}
+		}
+		if _, err := stmt.ExecContext(ctx, ts, name, typ, string(encoded), value, count, sum, min, max); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
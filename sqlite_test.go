@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDriver is a database/sql driver recording the statements executed,
+// as no SQLite driver is a dependency of this module
+type recordingDriver struct {
+	lock  sync.Mutex
+	execs []recordedExec
+
+	// failInserts is the number of INSERT statements which fail next
+	failInserts int
+}
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d: d}, nil
+}
+
+func (d *recordingDriver) recorded() []recordedExec {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]recordedExec(nil), d.execs...)
+}
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{d: c.d, query: query}, nil
+}
+
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return nil }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.lock.Lock()
+	defer s.d.lock.Unlock()
+	if s.d.failInserts > 0 && strings.HasPrefix(s.query, "INSERT") {
+		s.d.failInserts--
+		return nil, errors.New("insert failed")
+	}
+	s.d.execs = append(s.d.execs, recordedExec{query: s.query, args: args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+var registerRecordingDriver sync.Once
+var recording = &recordingDriver{}
+
+func openRecordingDB(t *testing.T) (*sql.DB, *recordingDriver) {
+	registerRecordingDriver.Do(func() { sql.Register("metrics-recording", recording) })
+	recording.lock.Lock()
+	recording.execs = nil
+	recording.failInserts = 0
+	recording.lock.Unlock()
+
+	db, err := sql.Open("metrics-recording", "")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db, recording
+}
+
+func TestSQLiteSink(t *testing.T) {
+	db, d := openRecordingDB(t)
+	s, err := NewSQLiteSink(SQLiteOpts{DB: db, Table: "telemetry", FlushInterval: time.Hour, Retention: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	execs := d.recorded()
+	if len(execs) != 3 || !strings.HasPrefix(execs[0].query, "CREATE TABLE IF NOT EXISTS telemetry (") {
+		t.Fatalf("bad schema statements %v", execs)
+	}
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 3, []Label{{"code", "200"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	s.AddSample([]string{"api", "latency"}, 10)
+	s.AddSample([]string{"api", "latency"}, 30)
+
+	now := time.UnixMilli(1700000000000)
+	if err := s.flush(context.Background(), now); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	execs = d.recorded()[3:]
+	if len(execs) != 4 {
+		t.Fatalf("bad statements %v", execs)
+	}
+	for _, e := range execs[:3] {
+		if !strings.HasPrefix(e.query, "INSERT INTO telemetry ") {
+			t.Fatalf("bad insert %s", e.query)
+		}
+	}
+	counter, gauge, sample := execs[0].args, execs[1].args, execs[2].args
+	if counter[0] != int64(1700000000000) || counter[1] != "api.requests" || counter[2] != "counter" ||
+		counter[3] != `{"code":"200"}` || counter[4] != 5.0 || counter[5] != int64(2) || counter[6] != nil {
+		t.Fatalf("bad counter row %v", counter)
+	}
+	if gauge[1] != "queue.depth" || gauge[2] != "gauge" || gauge[3] != "{}" || gauge[4] != 7.0 || gauge[5] != int64(1) {
+		t.Fatalf("bad gauge row %v", gauge)
+	}
+	if sample[2] != "sample" || sample[4] != 20.0 || sample[5] != int64(2) ||
+		sample[6] != 40.0 || sample[7] != 10.0 || sample[8] != 30.0 {
+		t.Fatalf("bad sample row %v", sample)
+	}
+
+	cleanup := execs[3]
+	if cleanup.query != "DELETE FROM telemetry WHERE timestamp < ?" || cleanup.args[0] != int64(1700000000000-3600000) {
+		t.Fatalf("bad retention %v", cleanup)
+	}
+}
+
+func TestSQLiteSink_KeepAll(t *testing.T) {
+	db, d := openRecordingDB(t)
+	s, err := NewSQLiteSink(SQLiteOpts{DB: db, FlushInterval: time.Hour, Retention: -1})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	if err := s.flush(context.Background(), time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if execs := d.recorded(); len(execs) != 3 || !strings.Contains(execs[0].query, " metrics (") {
+		t.Fatalf("bad statements %v", execs)
+	}
+}
+
+func TestNewSQLiteSink_Invalid(t *testing.T) {
+	if _, err := NewSQLiteSink(SQLiteOpts{}); err == nil {
+		t.Fatalf("expected a missing database to fail")
+	}
+	db, _ := openRecordingDB(t)
+	if _, err := NewSQLiteSink(SQLiteOpts{DB: db, Table: "metrics; DROP TABLE x"}); err == nil {
+		t.Fatalf("expected an invalid table name to fail")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package stackdriver
+
+// The subset of the Cloud Monitoring v3 REST resources written by the sink
+
+type metricDescriptor struct {
+	Type       string            `json:"type"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Labels     []labelDescriptor `json:"labels,omitempty"`
+}
+
+type labelDescriptor struct {
+	Key       string `json:"key"`
+	ValueType string `json:"valueType"`
+}
+
+type createTimeSeriesRequest struct {
+	TimeSeries []timeSeries `json:"timeSeries"`
+}
+
+type timeSeries struct {
+	Metric     metric            `json:"metric"`
+	Resource   monitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []point           `json:"points"`
+}
+
+type metric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type point struct {
+	Interval timeInterval `json:"interval"`
+	Value    typedValue   `json:"value"`
+}
+
+type timeInterval struct {
+	StartTime string `json:"startTime,omitempty"`
+	EndTime   string `json:"endTime"`
+}
+
+type typedValue struct {
+	DoubleValue       *float64      `json:"doubleValue,omitempty"`
+	DistributionValue *distribution `json:"distributionValue,omitempty"`
+}
+
+type distribution struct {
+	Count                 int64         `json:"count,string"`
+	Mean                  float64       `json:"mean"`
+	SumOfSquaredDeviation float64       `json:"sumOfSquaredDeviation"`
+	BucketOptions         bucketOptions `json:"bucketOptions"`
+	BucketCounts          []int64       `json:"bucketCounts"`
+}
+
+type bucketOptions struct {
+	ExplicitBuckets explicitBuckets `json:"explicitBuckets"`
+}
+
+type explicitBuckets struct {
+	Bounds []float64 `json:"bounds"`
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package stackdriver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+// metadataTokenURL returns the access token of the default service account
+// on Google Cloud compute platforms
+const metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// metadataTokenSource fetches access tokens from the metadata server and
+// caches them until shortly before they expire.
+type metadataTokenSource struct {
+	url    string
+	client *http.Client
+
+	lock    sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+func newMetadataTokenSource(client *http.Client) *metadataTokenSource {
+	return &metadataTokenSource{url: metadataTokenURL, client: client}
+}
+
+func (m *metadataTokenSource) token(ctx context.Context) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.cached != "" && time.Now().Before(m.expires) {
+		return m.cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := metrics.CheckHTTPResponse(resp); err != nil {
+		return "", err
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	m.cached = body.AccessToken
+	// Refresh a minute early so tokens never expire in flight
+	m.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - time.Minute)
+	return m.cached, nil
+}
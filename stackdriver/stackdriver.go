@@ -0,0 +1,475 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package stackdriver provides a sink writing to Google Cloud Monitoring,
+// formerly known as Stackdriver.
+package stackdriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+const (
+	// DefaultMetricPrefix is the metric type prefix of custom metrics
+	DefaultMetricPrefix = "custom.googleapis.com/"
+
+	// defaultEndpoint is the Cloud Monitoring API
+	defaultEndpoint = "https://monitoring.googleapis.com"
+
+	// defaultWriteInterval is used when StackdriverOpts.WriteInterval is not
+	// set
+	defaultWriteInterval = time.Minute
+
+	// minWriteInterval is the most frequent a series may be written
+	minWriteInterval = 10 * time.Second
+
+	// maxSeriesPerRequest is the limit of a single timeSeries.create call
+	maxSeriesPerRequest = 200
+)
+
+// StackdriverOpts is used to configure a StackdriverSink.
+type StackdriverOpts struct {
+	// ProjectID is the Google Cloud project written to, it is required
+	ProjectID string
+
+	// MetricPrefix is prepended to metric types, it defaults to
+	// DefaultMetricPrefix
+	MetricPrefix string
+
+	// ResourceType and ResourceLabels are the monitored resource of every
+	// series. The resource defaults to "global", labelled with the project.
+	ResourceType   string
+	ResourceLabels map[string]string
+
+	// WriteInterval is how often series are written, aligned to multiples
+	// of the interval. It defaults to a minute and may not be less than 10
+	// seconds.
+	WriteInterval time.Duration
+
+	// TokenSource returns the OAuth2 access token of each request. It
+	// defaults to the service account token of the GCE metadata server.
+	TokenSource func(ctx context.Context) (string, error)
+
+	// Endpoint overrides the Cloud Monitoring API address
+	Endpoint string
+
+	// HTTPClient is used for requests, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// RetryPolicy applies to failed writes, it defaults to
+	// metrics.DefaultRetryPolicy. Retries never run past the next write.
+	RetryPolicy *metrics.RetryPolicy
+}
+
+// StackdriverSink provides a MetricSink that writes time series to the
+// Google Cloud Monitoring API. Metrics are aggregated in memory and written
+// at the end of every aligned write interval, creating metric descriptors
+// the first time a metric is seen.
+//
+// The metric type is the prefix followed by the key parts joined with '/'.
+// Gauges and key/value pairs are written as GAUGE metrics holding their
+// last value, counters as CUMULATIVE metrics totalled since the sink was
+// created, and samples as GAUGE distributions of each interval. Labels
+// become metric labels, with names lowercased and sanitized as Cloud
+// Monitoring requires.
+type StackdriverSink struct {
+	project        string
+	prefix         string
+	resourceType   string
+	resourceLabels map[string]string
+	endpoint       string
+	tokenSource    func(ctx context.Context) (string, error)
+	client         *http.Client
+	retry          metrics.RetryPolicy
+	interval       time.Duration
+
+	lock   sync.Mutex
+	series map[string]*series
+
+	// Only used from the write goroutine
+	startTime   time.Time
+	totals      map[string]float64
+	descriptors map[string]*descriptor
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// series aggregates one metric and label set over a write interval
+type series struct {
+	metricType string
+	labels     map[string]string
+	kind       string
+	last       float64
+	sum        float64
+	sumSq      float64
+	count      int64
+}
+
+// descriptor tracks the metric descriptor created for a metric type
+type descriptor struct {
+	kind    string
+	labels  map[string]bool
+	created bool
+}
+
+// NewStackdriverSink creates a StackdriverSink and starts its write loop.
+func NewStackdriverSink(opts StackdriverOpts) (*StackdriverSink, error) {
+	if opts.ProjectID == "" {
+		return nil, fmt.Errorf("stackdriver project ID is required")
+	}
+	interval := opts.WriteInterval
+	if interval == 0 {
+		interval = defaultWriteInterval
+	}
+	if interval < minWriteInterval {
+		return nil, fmt.Errorf("stackdriver write interval may not be less than %s", minWriteInterval)
+	}
+	prefix := opts.MetricPrefix
+	if prefix == "" {
+		prefix = DefaultMetricPrefix
+	}
+	resourceType := opts.ResourceType
+	resourceLabels := opts.ResourceLabels
+	if resourceType == "" {
+		resourceType = "global"
+		resourceLabels = map[string]string{"project_id": opts.ProjectID}
+	}
+	endpoint := strings.TrimSuffix(opts.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	tokenSource := opts.TokenSource
+	if tokenSource == nil {
+		tokenSource = newMetadataTokenSource(client).token
+	}
+	retry := metrics.DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+
+	s := &StackdriverSink{
+		project:        opts.ProjectID,
+		prefix:         prefix,
+		resourceType:   resourceType,
+		resourceLabels: resourceLabels,
+		endpoint:       endpoint + "/v3/projects/" + opts.ProjectID,
+		tokenSource:    tokenSource,
+		client:         client,
+		retry:          retry,
+		interval:       interval,
+		series:         make(map[string]*series),
+		startTime:      time.Now(),
+		totals:         make(map[string]float64),
+		descriptors:    make(map[string]*descriptor),
+		stopCh:         make(chan struct{}),
+		doneCh:         make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Capabilities reports what the Stackdriver sink supports.
+func (s *StackdriverSink) Capabilities() metrics.Capabilities {
+	return metrics.Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+func (s *StackdriverSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *StackdriverSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("gauge", key, float64(val), labels)
+}
+
+func (s *StackdriverSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *StackdriverSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []metrics.Label) {
+	s.record("gauge", key, val, labels)
+}
+
+func (s *StackdriverSink) EmitKey(key []string, val float32) {
+	s.record("gauge", key, float64(val), nil)
+}
+
+func (s *StackdriverSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *StackdriverSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("counter", key, float64(val), labels)
+}
+
+func (s *StackdriverSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *StackdriverSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.record("sample", key, float64(val), labels)
+}
+
+// Shutdown stops the write loop and blocks while the remaining metrics are
+// written.
+func (s *StackdriverSink) Shutdown() {
+	close(s.stopCh)
+	<-s.doneCh
+}
+
+// run writes at the end of every interval, aligned to multiples of the
+// interval so points of different processes line up.
+func (s *StackdriverSink) run() {
+	defer close(s.doneCh)
+	for {
+		now := time.Now()
+		next := now.Truncate(s.interval).Add(s.interval)
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+			s.writeLogged(next)
+		case <-s.stopCh:
+			timer.Stop()
+			s.writeLogged(time.Now())
+			return
+		}
+	}
+}
+
+func (s *StackdriverSink) writeLogged(now time.Time) {
+	if err := s.write(now); err != nil {
+		log.Printf("[ERR] Error writing to Stackdriver! Err: %s", err)
+	}
+}
+
+func (s *StackdriverSink) record(kind string, key []string, val float64, labels []metrics.Label) {
+	metricType := s.prefix + strings.Map(sanitizeType, strings.Join(key, "/"))
+	ls := make(map[string]string, len(labels))
+	for _, l := range labels {
+		ls[labelKey(l.Name)] = l.Value
+	}
+	id := kind + "|" + metricType + "|" + labelsID(ls)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ser, ok := s.series[id]
+	if !ok {
+		ser = &series{metricType: metricType, labels: ls, kind: kind}
+		s.series[id] = ser
+	}
+	ser.last = val
+	ser.sum += val
+	ser.sumSq += val * val
+	ser.count++
+}
+
+// write swaps out the aggregated series, creates any missing metric
+// descriptors and writes the series in batches. It is only called from the
+// write goroutine, which owns the cumulative and descriptor state.
+func (s *StackdriverSink) write(now time.Time) error {
+	s.lock.Lock()
+	pending := s.series
+	s.series = make(map[string]*series)
+	s.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(s.interval))
+	defer cancel()
+
+	ids := make([]string, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	out := make([]timeSeries, 0, len(ids))
+	for _, id := range ids {
+		ser := pending[id]
+		if err := s.ensureDescriptor(ctx, ser); err != nil {
+			// Skip the series rather than the whole write, it is retried
+			// the next time the metric is seen
+			log.Printf("[ERR] Error creating Stackdriver metric descriptor %s! Err: %s", ser.metricType, err)
+			continue
+		}
+		out = append(out, s.timeSeries(id, ser, now))
+	}
+
+	for len(out) > 0 {
+		n := len(out)
+		if n > maxSeriesPerRequest {
+			n = maxSeriesPerRequest
+		}
+		req := createTimeSeriesRequest{TimeSeries: out[:n]}
+		if err := s.retry.Do(ctx, "Stackdriver", func() error {
+			return s.post(ctx, "/timeSeries", req)
+		}); err != nil {
+			return err
+		}
+		out = out[n:]
+	}
+	return nil
+}
+
+// ensureDescriptor creates the metric descriptor of a series, again when it
+// gains labels.
+func (s *StackdriverSink) ensureDescriptor(ctx context.Context, ser *series) error {
+	d, ok := s.descriptors[ser.metricType]
+	if !ok {
+		d = &descriptor{kind: ser.kind, labels: make(map[string]bool)}
+		s.descriptors[ser.metricType] = d
+	}
+	for name := range ser.labels {
+		if !d.labels[name] {
+			d.labels[name] = true
+			d.created = false
+		}
+	}
+	if d.created {
+		return nil
+	}
+
+	md := metricDescriptor{
+		Type:       ser.metricType,
+		MetricKind: "GAUGE",
+		ValueType:  "DOUBLE",
+	}
+	switch d.kind {
+	case "counter":
+		md.MetricKind = "CUMULATIVE"
+	case "sample":
+		md.ValueType = "DISTRIBUTION"
+	}
+	for name := range d.labels {
+		md.Labels = append(md.Labels, labelDescriptor{Key: name, ValueType: "STRING"})
+	}
+	sort.Slice(md.Labels, func(i, j int) bool { return md.Labels[i].Key < md.Labels[j].Key })
+
+	err := s.retry.Do(ctx, "Stackdriver", func() error {
+		return s.post(ctx, "/metricDescriptors", md)
+	})
+	if err != nil {
+		return err
+	}
+	d.created = true
+	return nil
+}
+
+func (s *StackdriverSink) timeSeries(id string, ser *series, now time.Time) timeSeries {
+	ts := timeSeries{
+		Metric:   metric{Type: ser.metricType, Labels: ser.labels},
+		Resource: monitoredResource{Type: s.resourceType, Labels: s.resourceLabels},
+	}
+	end := now.UTC().Format(time.RFC3339Nano)
+	p := point{Interval: timeInterval{EndTime: end}}
+	switch ser.kind {
+	case "gauge":
+		ts.MetricKind, ts.ValueType = "GAUGE", "DOUBLE"
+		p.Value.DoubleValue = &ser.last
+	case "counter":
+		ts.MetricKind, ts.ValueType = "CUMULATIVE", "DOUBLE"
+		s.totals[id] += ser.sum
+		total := s.totals[id]
+		p.Interval.StartTime = s.startTime.UTC().Format(time.RFC3339Nano)
+		p.Value.DoubleValue = &total
+	case "sample":
+		ts.MetricKind, ts.ValueType = "GAUGE", "DISTRIBUTION"
+		mean := ser.sum / float64(ser.count)
+		p.Value.DistributionValue = &distribution{
+			Count:                 ser.count,
+			Mean:                  mean,
+			SumOfSquaredDeviation: math.Max(0, ser.sumSq-float64(ser.count)*mean*mean),
+			BucketOptions:         bucketOptions{ExplicitBuckets: explicitBuckets{Bounds: []float64{}}},
+			BucketCounts:          []int64{ser.count},
+		}
+	}
+	ts.Points = []point{p}
+	return ts
+}
+
+// post sends an authenticated JSON request to the project API.
+func (s *StackdriverSink) post(ctx context.Context, path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	token, err := s.tokenSource(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	return metrics.CheckHTTPResponse(resp)
+}
+
+// labelKey converts a label name into a valid Cloud Monitoring label key
+func labelKey(name string) string {
+	key := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '_'
+		}
+	}, name)
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		key = "l_" + key
+	}
+	return key
+}
+
+func sanitizeType(r rune) rune {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '/':
+		return r
+	default:
+		return '_'
+	}
+}
+
+func labelsID(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(labels[name])
+		b.WriteByte(';')
+	}
+	return b.String()
+}
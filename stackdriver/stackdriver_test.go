@@ -0,0 +1,208 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package stackdriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-metrics"
+)
+
+type recorder struct {
+	lock        sync.Mutex
+	descriptors []metricDescriptor
+	writes      []createTimeSeriesRequest
+}
+
+func (r *recorder) server(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("bad authorization: %s", req.Header.Get("Authorization"))
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		switch req.URL.Path {
+		case "/v3/projects/proj/metricDescriptors":
+			var md metricDescriptor
+			if err := json.NewDecoder(req.Body).Decode(&md); err != nil {
+				t.Errorf("bad descriptor: %s", err)
+			}
+			r.descriptors = append(r.descriptors, md)
+		case "/v3/projects/proj/timeSeries":
+			var ts createTimeSeriesRequest
+			if err := json.NewDecoder(req.Body).Decode(&ts); err != nil {
+				t.Errorf("bad time series: %s", err)
+			}
+			r.writes = append(r.writes, ts)
+		default:
+			t.Errorf("unexpected path %s", req.URL.Path)
+		}
+	}))
+}
+
+func newTestSink(t *testing.T, endpoint string) *StackdriverSink {
+	s, err := NewStackdriverSink(StackdriverOpts{
+		ProjectID:     "proj",
+		Endpoint:      endpoint,
+		WriteInterval: time.Hour,
+		TokenSource: func(ctx context.Context) (string, error) {
+			return "token", nil
+		},
+		RetryPolicy: &metrics.RetryPolicy{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	return s
+}
+
+func TestStackdriverSink(t *testing.T) {
+	rec := &recorder{}
+	srv := rec.server(t)
+	defer srv.Close()
+
+	s := newTestSink(t, srv.URL)
+	defer s.Shutdown()
+	s.startTime = time.Unix(0, 0)
+
+	s.SetGaugeWithLabels([]string{"queue", "depth"}, 5, []metrics.Label{{Name: "Queue-Name", Value: "a"}})
+	s.IncrCounter([]string{"requests"}, 2)
+	s.IncrCounter([]string{"requests"}, 3)
+	s.AddSample([]string{"latency"}, 10)
+	s.AddSample([]string{"latency"}, 30)
+	if err := s.write(time.Unix(60, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	if len(rec.descriptors) != 3 {
+		t.Fatalf("expected three descriptors, got %v", rec.descriptors)
+	}
+	kinds := make(map[string]string)
+	for _, md := range rec.descriptors {
+		kinds[md.Type] = md.MetricKind + "/" + md.ValueType
+	}
+	if kinds["custom.googleapis.com/queue/depth"] != "GAUGE/DOUBLE" ||
+		kinds["custom.googleapis.com/requests"] != "CUMULATIVE/DOUBLE" ||
+		kinds["custom.googleapis.com/latency"] != "GAUGE/DISTRIBUTION" {
+		t.Fatalf("bad descriptors: %v", kinds)
+	}
+
+	if len(rec.writes) != 1 || len(rec.writes[0].TimeSeries) != 3 {
+		t.Fatalf("bad writes: %v", rec.writes)
+	}
+	series := make(map[string]timeSeries)
+	for _, ts := range rec.writes[0].TimeSeries {
+		series[ts.Metric.Type] = ts
+		if ts.Resource.Type != "global" || ts.Resource.Labels["project_id"] != "proj" {
+			t.Fatalf("bad resource: %v", ts.Resource)
+		}
+	}
+
+	gauge := series["custom.googleapis.com/queue/depth"]
+	if gauge.Metric.Labels["queue_name"] != "a" || *gauge.Points[0].Value.DoubleValue != 5 {
+		t.Fatalf("bad gauge: %+v", gauge)
+	}
+	counter := series["custom.googleapis.com/requests"]
+	if p := counter.Points[0]; *p.Value.DoubleValue != 5 || p.Interval.StartTime != "1970-01-01T00:00:00Z" || p.Interval.EndTime != "1970-01-01T00:01:00Z" {
+		t.Fatalf("bad counter: %+v", p)
+	}
+	dist := series["custom.googleapis.com/latency"].Points[0].Value.DistributionValue
+	if dist.Count != 2 || dist.Mean != 20 || dist.SumOfSquaredDeviation != 200 {
+		t.Fatalf("bad distribution: %+v", dist)
+	}
+
+	// Counters are cumulative and descriptors are only created once
+	s.IncrCounter([]string{"requests"}, 1)
+	if err := s.write(time.Unix(120, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(rec.descriptors) != 3 {
+		t.Fatalf("descriptors should not be recreated: %v", rec.descriptors)
+	}
+	if v := *rec.writes[1].TimeSeries[0].Points[0].Value.DoubleValue; v != 6 {
+		t.Fatalf("bad cumulative value: %v", v)
+	}
+
+	// New labels update the descriptor
+	s.IncrCounterWithLabels([]string{"requests"}, 1, []metrics.Label{{Name: "code", Value: "200"}})
+	if err := s.write(time.Unix(180, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(rec.descriptors) != 4 || len(rec.descriptors[3].Labels) != 1 || rec.descriptors[3].Labels[0].Key != "code" {
+		t.Fatalf("bad updated descriptor: %v", rec.descriptors)
+	}
+}
+
+func TestStackdriverSink_Batches(t *testing.T) {
+	rec := &recorder{}
+	srv := rec.server(t)
+	defer srv.Close()
+
+	s := newTestSink(t, srv.URL)
+	defer s.Shutdown()
+
+	for i := 0; i < 250; i++ {
+		s.SetGauge([]string{fmt.Sprintf("gauge%03d", i)}, 1)
+	}
+	if err := s.write(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(rec.writes) != 2 || len(rec.writes[0].TimeSeries) != 200 || len(rec.writes[1].TimeSeries) != 50 {
+		t.Fatalf("bad batches: %d", len(rec.writes))
+	}
+}
+
+func TestNewStackdriverSink_Errors(t *testing.T) {
+	if _, err := NewStackdriverSink(StackdriverOpts{}); err == nil {
+		t.Fatalf("expected a missing project to fail")
+	}
+	if _, err := NewStackdriverSink(StackdriverOpts{ProjectID: "proj", WriteInterval: time.Second}); err == nil {
+		t.Fatalf("expected a short interval to fail")
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	cases := map[string]string{
+		"code":       "code",
+		"Queue-Name": "queue_name",
+		"1st":        "l_1st",
+		"":           "l_",
+	}
+	for in, want := range cases {
+		if got := labelKey(in); got != want {
+			t.Fatalf("labelKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMetadataTokenSource(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("missing metadata header")
+		}
+		calls++
+		_, _ = w.Write([]byte(`{"access_token":"abc","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	m := newMetadataTokenSource(srv.Client())
+	m.url = srv.URL
+	for i := 0; i < 2; i++ {
+		token, err := m.token(context.Background())
+		if err != nil || token != "abc" {
+			t.Fatalf("bad token: %q %v", token, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("tokens should be cached, got %d calls", calls)
+	}
+}
@@ -20,6 +20,7 @@ type Config struct {
 	EnableHostnameLabel  bool          // Enable adding hostname to labels
 	EnableServiceLabel   bool          // Enable adding service to labels
 	EnableRuntimeMetrics bool          // Enables profiling of runtime metrics (GC, Goroutines, Memory)
+	EnableGCSamples      bool          // With EnableRuntimeMetrics, samples heap allocation and growth per GC cycle
 	EnableTypePrefix     bool          // Prefixes key with a type ("counter", "gauge", "timer")
 	TimerGranularity     time.Duration // Granularity of timers.
 	ProfileInterval      time.Duration // Interval to profile runtime metrics
@@ -29,8 +30,49 @@ type Config struct {
 	AllowedLabels   []string // A list of metric labels to allow, with '.' as the separator
 	BlockedLabels   []string // A list of metric labels to block, with '.' as the separator
 	FilterDefault   bool     // Whether to allow metrics by default
+
+	AdaptiveSampler *AdaptiveSampler // Optional sampler that thins out keys exceeding an emission budget
+	StrictNames     bool             // Only emit metrics passed as a MetricName, see RegisterName
+	EnableSnapshot  bool             // Keep current gauge and counter values readable via Metrics.Snapshot
+	Renames         []MetricRename   // Metrics being renamed, optionally emitted under both names
+
+	HostnameLabelKey string // Label key for the hostname with EnableHostnameLabel, defaults to "host"
+	ServiceLabelKey  string // Label key for the service with EnableServiceLabel, defaults to "service"
+
+	CounterCheckpointPath     string        // File persisting counter totals across restarts, restored into any CumulativeSink, implies EnableSnapshot
+	CounterCheckpointInterval time.Duration // Interval between counter checkpoints, defaults to a minute
+	CounterCheckpointCodec    SnapshotCodec // Encoding of counter checkpoints, defaults to ProtobufSnapshotCodec which, unlike JSON, keeps label order
+
+	// LabelValueAllowlist restricts labels to an explicit set of values.
+	// Any other value of a listed label is replaced with OtherLabelValue, so
+	// unbounded values such as raw URLs or user IDs never reach a sink.
+	LabelValueAllowlist map[string][]string
+
+	// CanonicalLabels sorts labels by name and removes duplicate names before
+	// emission, so the same label set given in a different order never
+	// creates a separate series in sinks which treat order as significant.
+	// Duplicate names with different values are resolved with
+	// LabelConflict.
+	CanonicalLabels bool
+	LabelConflict   LabelConflictPolicy
+
+	AuditLogSize int  // Number of recent emissions kept for Metrics.AuditLog, zero disables the audit log
+	AuditCaller  bool // Record the file:line of each emission in the audit log, at some cost per call
+
+	CardinalityWindow time.Duration // Window over which distinct label sets per key are counted, zero disables tracking
+
+	Ratios []RatioMetric // Gauges derived from the ratio of two other metrics, such as used over limit
+
+	MinuteCounts          []string      // Counters with per minute totals for Metrics.CountsSince, with '.' as the separator
+	MinuteCountsRetention time.Duration // How long per minute totals are kept, defaults to an hour
+
+	DetectTypeCollisions bool        // Report keys emitted with different types anywhere in the process, see TypeCollisionError
+	ErrorHandler         func(error) // Receives errors detected while emitting, defaults to logging them
 }
 
+// OtherLabelValue replaces label values missing from Config.LabelValueAllowlist
+const OtherLabelValue = "other"
+
 // Metrics represents an instance of a metrics sink that can
 // be used to emit
 type Metrics struct {
@@ -40,7 +82,48 @@ type Metrics struct {
 	filter        *iradix.Tree
 	allowedLabels map[string]bool
 	blockedLabels map[string]bool
+	labelValues   map[string]map[string]bool
 	filterLock    sync.RWMutex // Lock filters and allowedLabels/blockedLabels access
+
+	// sinkV2 is sink adapted to MetricSinkV2, see Metrics.v2
+	sinkV2     MetricSinkV2
+	sinkV2Once sync.Once
+
+	// unregisteredNames tracks keys already reported under StrictNames
+	unregisteredNames sync.Map
+
+	// snapshots backs Snapshot when EnableSnapshot is set
+	snapshots *snapshotRegistry
+
+	// renames is the lookup table built from Config.Renames
+	renames renameTable
+
+	// units records the unit of samples emitted by the typed helpers, and
+	// trackUnits whether sink includes a UnitSink to pass them to
+	units      sync.Map
+	trackUnits bool
+
+	// audit backs AuditLog when AuditLogSize is set
+	audit *auditLog
+
+	// cardinality backs Cardinality when CardinalityWindow is set
+	cardinality *cardinalityTracker
+
+	// minuteCounts backs CountsSince when MinuteCounts is set
+	minuteCounts *minuteCounts
+
+	// gcSampler backs the per GC cycle samples of EnableGCSamples
+	gcSampler *gcSampler
+
+	// ratios derives the gauges configured in Config.Ratios
+	ratios *ratioEngine
+
+	// captures receives the metrics emitted during Capture
+	captures captureSet
+
+	// checkpointStop stops the counter checkpoint loop on Shutdown
+	checkpointStop chan struct{}
+	shutdownOnce   sync.Once
 }
 
 // Shared global metrics instance
@@ -80,7 +163,41 @@ func New(conf *Config, sink MetricSink) (*Metrics, error) {
 	met := &Metrics{}
 	met.Config = *conf
 	met.sink = sink
+	met.sinkV2 = AdaptSink(sink)
+	met.trackUnits = tracksUnits(sink)
+	if conf.EnableSnapshot || conf.CounterCheckpointPath != "" {
+		met.snapshots = newSnapshotRegistry()
+	}
+	met.renames = newRenameTable(conf.Renames)
+	met.ratios = newRatioEngine(conf.Ratios)
+	met.minuteCounts = newMinuteCounts(conf.MinuteCounts, conf.MinuteCountsRetention)
+	if conf.EnableGCSamples {
+		met.gcSampler = newGCSampler()
+	}
+	if conf.CardinalityWindow > 0 {
+		met.cardinality = newCardinalityTracker(conf.CardinalityWindow)
+	}
+	if conf.AuditLogSize > 0 {
+		met.audit = newAuditLog(conf.AuditLogSize, conf.AuditCaller)
+	}
+	if len(conf.LabelValueAllowlist) > 0 {
+		met.labelValues = make(map[string]map[string]bool, len(conf.LabelValueAllowlist))
+		for name, values := range conf.LabelValueAllowlist {
+			allowed := make(map[string]bool, len(values))
+			for _, v := range values {
+				allowed[v] = true
+			}
+			met.labelValues[name] = allowed
+		}
+	}
 	met.UpdateFilterAndLabels(conf.AllowedPrefixes, conf.BlockedPrefixes, conf.AllowedLabels, conf.BlockedLabels)
+	if conf.CounterCheckpointPath != "" {
+		// Restored after the filters are set up, as they apply to the totals
+		// passed to cumulative sinks
+		met.restoreCheckpoint()
+		met.checkpointStop = make(chan struct{})
+		go met.checkpointLoop(met.checkpointStop)
+	}
 
 	// Start the runtime collector
 	if conf.EnableRuntimeMetrics {
@@ -101,56 +218,205 @@ func NewGlobal(conf *Config, sink MetricSink) (*Metrics, error) {
 
 // Proxy all the methods to the globalMetrics instance
 
+// globalDisabled short-circuits the emission proxies, and the scopes,
+// recorders and nano timers created from them, see SetGlobalDisabled
+var globalDisabled atomic.Bool
+
+// SetGlobalDisabled turns the package level emission functions, such as
+// IncrCounter and MeasureSince, into no-ops which return before any other
+// work when disabled is true. The same applies to the Scope, Recorder and
+// NanoTimer returned by the package level NewScope, NewRecorder and
+// NewNanoTimer. Libraries can then instrument unconditionally, while
+// programs that never configure metrics, such as CLIs, pay no more than an
+// atomic load per call. Metrics instances used directly are not affected.
+func SetGlobalDisabled(disabled bool) {
+	globalDisabled.Store(disabled)
+}
+
+// GlobalDisabled reports whether the package level emission functions are
+// disabled, see SetGlobalDisabled.
+func GlobalDisabled() bool {
+	return globalDisabled.Load()
+}
+
 // Set gauge key and value with 32 bit precision
 func SetGauge(key []string, val float32) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).SetGauge(key, val)
 }
 
 // Set gauge key and value with 32 bit precision
 func SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).SetGaugeWithLabels(key, val, labels)
 }
 
 // Set gauge key and value with 64 bit precision
-// The Sink needs to implement PrecisionGaugeMetricSink, in case it doesn't,  the metric value won't be set and ingored instead
+// Sinks which do not implement PrecisionGaugeMetricSink get a 32 bit gauge if
+// they implement CapabilitySink, and ignore the value otherwise
 func SetPrecisionGauge(key []string, val float64) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).SetPrecisionGauge(key, val)
 }
 
 // Set gauge key, value with 64 bit precision, and labels
-// The Sink needs to implement PrecisionGaugeMetricSink, in case it doesn't, the metric value won't be set and ingored instead
+// Sinks which do not implement PrecisionGaugeMetricSink get a 32 bit gauge if
+// they implement CapabilitySink, and ignore the value otherwise
 func SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).SetPrecisionGaugeWithLabels(key, val, labels)
 }
 
 func EmitKey(key []string, val float32) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).EmitKey(key, val)
 }
 
+func EmitKeys(key []string, vals []float32) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).EmitKeys(key, vals)
+}
+
 func IncrCounter(key []string, val float32) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).IncrCounter(key, val)
 }
 
 func IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).IncrCounterWithLabels(key, val, labels)
 }
 
 func AddSample(key []string, val float32) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).AddSample(key, val)
 }
 
 func AddSampleWithLabels(key []string, val float32, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).AddSampleWithLabels(key, val, labels)
 }
 
+func AddHistogram(key []string, val float64) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddHistogram(key, val)
+}
+
+func AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddHistogramWithLabels(key, val, labels)
+}
+
+func AddSampleDuration(key []string, d time.Duration) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddSampleDuration(key, d)
+}
+
+func AddSampleDurationWithLabels(key []string, d time.Duration, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddSampleDurationWithLabels(key, d, labels)
+}
+
+func AddSampleBytes(key []string, n int64) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddSampleBytes(key, n)
+}
+
+func AddSampleBytesWithLabels(key []string, n int64, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddSampleBytesWithLabels(key, n, labels)
+}
+
 func MeasureSince(key []string, start time.Time) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).MeasureSince(key, start)
 }
 
 func MeasureSinceWithLabels(key []string, start time.Time, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
 	globalMetrics.Load().(*Metrics).MeasureSinceWithLabels(key, start, labels)
 }
 
+// SetGaugeName sets a gauge declared with RegisterName through the global
+// metrics instance, see Metrics.SetGaugeName.
+func SetGaugeName(name MetricName, val float32, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).SetGaugeName(name, val, labels)
+}
+
+func SetPrecisionGaugeName(name MetricName, val float64, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).SetPrecisionGaugeName(name, val, labels)
+}
+
+func IncrCounterName(name MetricName, val float32, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).IncrCounterName(name, val, labels)
+}
+
+func AddSampleName(name MetricName, val float32, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddSampleName(name, val, labels)
+}
+
+func AddHistogramName(name MetricName, val float64, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).AddHistogramName(name, val, labels)
+}
+
+func MeasureSinceName(name MetricName, start time.Time, labels []Label) {
+	if globalDisabled.Load() {
+		return
+	}
+	globalMetrics.Load().(*Metrics).MeasureSinceName(name, start, labels)
+}
+
 func UpdateFilter(allow, block []string) {
 	globalMetrics.Load().(*Metrics).UpdateFilter(allow, block)
 }
@@ -163,6 +429,42 @@ func UpdateFilterAndLabels(allow, block, allowedLabels, blockedLabels []string)
 	globalMetrics.Load().(*Metrics).UpdateFilterAndLabels(allow, block, allowedLabels, blockedLabels)
 }
 
+// NewRecorder creates a Recorder which emits through the global metrics
+// instance with the given shared labels.
+func NewRecorder(labels ...Label) *Recorder {
+	r := globalMetrics.Load().(*Metrics).NewRecorder(labels...)
+	r.global = true
+	return r
+}
+
+// NewNanoTimer creates a NanoTimer for key which emits through the global
+// metrics instance.
+func NewNanoTimer(key []string, interval time.Duration, labels ...Label) *NanoTimer {
+	t := globalMetrics.Load().(*Metrics).NewNanoTimer(key, interval, labels...)
+	t.global.Store(true)
+	return t
+}
+
+// NewScope creates a Scope which emits through the global metrics instance
+// with the given labels.
+func NewScope(labels ...Label) *Scope {
+	s := globalMetrics.Load().(*Metrics).NewScope(labels...)
+	s.global = true
+	return s
+}
+
+// Snapshot returns the current gauge values and counter totals emitted through
+// the global metrics instance. Config.EnableSnapshot must be set.
+func Snapshot() MetricsSnapshot {
+	return globalMetrics.Load().(*Metrics).Snapshot()
+}
+
+// CountsSince returns the total of a counter listed in Config.MinuteCounts
+// over the given window from the global metrics instance.
+func CountsSince(key []string, window time.Duration) float64 {
+	return globalMetrics.Load().(*Metrics).CountsSince(key, window)
+}
+
 // Shutdown disables metric collection, then blocks while attempting to flush metrics to storage.
 // WARNING: Not all MetricSink backends support this functionality, and calling this will cause them to leak resources.
 // This is intended for use immediately prior to application exit.
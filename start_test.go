@@ -285,6 +285,67 @@ func Test_GlobalMetrics_Shutdown(t *testing.T) {
 	}
 }
 
+func Test_GlobalMetrics_Disabled(t *testing.T) {
+	s := &MockSink{}
+	globalMetrics.Store(&Metrics{Config: Config{FilterDefault: true}, sink: s})
+	SetGlobalDisabled(true)
+	defer SetGlobalDisabled(false)
+
+	if !GlobalDisabled() {
+		t.Fatalf("expected disabled")
+	}
+	k := []string{"test"}
+	labels := []Label{{"a", "b"}}
+	SetGauge(k, 1)
+	SetGaugeWithLabels(k, 1, labels)
+	SetPrecisionGauge(k, 1)
+	SetPrecisionGaugeWithLabels(k, 1, labels)
+	EmitKey(k, 1)
+	EmitKeys(k, []float32{1, 2})
+	IncrCounter(k, 1)
+	IncrCounterWithLabels(k, 1, labels)
+	AddSample(k, 1)
+	AddSampleWithLabels(k, 1, labels)
+	AddSampleDuration(k, time.Second)
+	AddSampleDurationWithLabels(k, time.Second, labels)
+	AddSampleBytes(k, 1)
+	AddSampleBytesWithLabels(k, 1, labels)
+	MeasureSince(k, time.Now())
+	MeasureSinceWithLabels(k, time.Now(), labels)
+
+	scope := NewScope(labels...).With(Label{"c", "d"})
+	scope.IncrCounter(k, 1)
+	scope.MeasureSince(k, time.Now())
+	r := NewRecorder(labels...)
+	r.IncrCounter(k, 1)
+	r.Flush()
+	timer := NewNanoTimer(k, time.Hour)
+	defer timer.Stop()
+	timer.Observe(time.Microsecond)
+	timer.Flush()
+	if keys := s.getKeys(); len(keys) != 0 {
+		t.Fatalf("expected nothing emitted, got %v", keys)
+	}
+
+	SetGlobalDisabled(false)
+	IncrCounter(k, 1)
+	if keys := s.getKeys(); len(keys) != 1 {
+		t.Fatalf("expected emission once enabled, got %v", keys)
+	}
+}
+
+func Benchmark_GlobalMetrics_Disabled(b *testing.B) {
+	globalMetrics.Store(&Metrics{Config: Config{FilterDefault: true}, sink: &BlackholeSink{}})
+	SetGlobalDisabled(true)
+	defer SetGlobalDisabled(false)
+
+	k := []string{"test"}
+	labels := []Label{{"a", "b"}}
+	for i := 0; i < b.N; i++ {
+		IncrCounterWithLabels(k, 1, labels)
+	}
+}
+
 // Benchmark_GlobalMetrics_Direct/direct-8         	 5000000	       278 ns/op
 // Benchmark_GlobalMetrics_Direct/atomic.Value-8   	 5000000	       235 ns/op
 func Benchmark_GlobalMetrics_Direct(b *testing.B) {
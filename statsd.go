@@ -5,10 +5,12 @@ package metrics
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 )
@@ -17,30 +19,125 @@ const (
 	// statsdMaxLen is the maximum size of a packet
 	// to send to statsd
 	statsdMaxLen = 1400
+
+	// statsdUnixMaxLen is the maximum size of a datagram sent over a Unix
+	// domain socket, which is not bound by the MTU
+	statsdUnixMaxLen = 8192
+
+	// statsdUnixPrefix marks the address of a Unix domain socket
+	statsdUnixPrefix = "unixgram://"
+
+	// statsdTCPPrefix marks the address of a statsd server accepting TCP
+	// connections
+	statsdTCPPrefix = "tcp://"
 )
 
 // StatsdSink provides a MetricSink that can be used
 // with a statsite or statsd metrics server. It uses
-// only UDP packets, while StatsiteSink uses TCP.
+// UDP packets, or datagrams over a Unix domain socket
+// when the address is such as "unixgram:///var/run/statsd.sock".
+// For statsd endpoints which only accept TCP, an address
+// such as "tcp://statsd:8125" sends newline framed metrics
+// over a connection which is reestablished on errors, in
+// batches as large as those of the StatsiteSink.
 type StatsdSink struct {
+	network     string
 	addr        string
+	maxLen      int
+	dial        Dialer
+	tags        StatsdTagFormat
 	metricQueue chan string
+	kv          *kvBuffer
+	ready       readiness
 }
 
+// Dialer is used by network sinks to establish their connection. It has the
+// same signature as net.Dial, which is the default. Supplying a custom Dialer
+// allows the transport to be wrapped, for example to encrypt and authenticate
+// statsd traffic with DTLS without taking on the blocking behavior of TCP/TLS,
+// as done by the dtls package.
+type Dialer func(network, addr string) (net.Conn, error)
+
+// StatsdTagFormat selects how a StatsdSink encodes labels
+type StatsdTagFormat int
+
+const (
+	// StatsdTagsFlatten appends label values to the key, as plain statsd
+	// has no notion of tags
+	StatsdTagsFlatten StatsdTagFormat = iota
+
+	// StatsdTagsM3 appends labels to the metric name with the tag extension
+	// of the M3 aggregator, as in "name;code=200:1|c", so they survive
+	// aggregation
+	StatsdTagsM3
+)
+
 // NewStatsdSinkFromURL creates an StatsdSink from a URL. It is used
-// (and tested) from NewMetricSinkFromURL.
+// (and tested) from NewMetricSinkFromURL. The optional "tags" parameter
+// selects the label encoding, "m3" for StatsdTagsM3. A Unix domain socket
+// is used for URLs such as unixgram:///var/run/statsd.sock, or statsd URLs
+// with a path and no host, as in statsd:///var/run/statsd.sock, and TCP for
+// statsd+tcp URLs.
 func NewStatsdSinkFromURL(u *url.URL) (MetricSink, error) {
-	return NewStatsdSink(u.Host)
+	addr := u.Host
+	switch {
+	case u.Scheme == "statsd+tcp":
+		addr = statsdTCPPrefix + u.Host
+	case u.Scheme == "unixgram" || u.Host == "" && u.Path != "":
+		addr = statsdUnixPrefix + u.Path
+	}
+	switch tags := u.Query().Get("tags"); tags {
+	case "":
+		return NewStatsdSink(addr)
+	case "m3":
+		return NewM3StatsdSink(addr)
+	default:
+		return nil, fmt.Errorf("bad 'tags' param: %q", tags)
+	}
 }
 
-// NewStatsdSink is used to create a new StatsdSink
+// NewStatsdSink is used to create a new StatsdSink. The address is a UDP
+// host and port, the path of a Unix domain socket prefixed with
+// "unixgram://", or a TCP host and port prefixed with "tcp://".
 func NewStatsdSink(addr string) (*StatsdSink, error) {
+	return NewStatsdSinkWithDialer(addr, net.Dial)
+}
+
+// NewStatsdSinkWithDialer is used to create a new StatsdSink which uses the
+// given Dialer to connect to addr, such as the DTLS Dialer of the dtls
+// package for encrypted UDP.
+// Metrics are batched into writes of at most 1400 bytes over UDP, which
+// leaves headroom under a typical MTU for DTLS record overhead, 8192 bytes
+// over a Unix domain socket and 64KiB over TCP.
+func NewStatsdSinkWithDialer(addr string, dial Dialer) (*StatsdSink, error) {
+	return newStatsdSink(addr, dial, StatsdTagsFlatten), nil
+}
+
+// NewM3StatsdSink is used to create a StatsdSink for the statsd listener of
+// an M3 aggregator, which sends labels as tags with StatsdTagsM3.
+func NewM3StatsdSink(addr string) (*StatsdSink, error) {
+	return newStatsdSink(addr, net.Dial, StatsdTagsM3), nil
+}
+
+func newStatsdSink(addr string, dial Dialer, tags StatsdTagFormat) *StatsdSink {
+	network, maxLen := "udp", statsdMaxLen
+	if path, ok := strings.CutPrefix(addr, statsdUnixPrefix); ok {
+		network, addr, maxLen = "unixgram", path, statsdUnixMaxLen
+	} else if host, ok := strings.CutPrefix(addr, statsdTCPPrefix); ok {
+		network, addr, maxLen = "tcp", host, statsiteMaxBatch
+	}
 	s := &StatsdSink{
+		network:     network,
 		addr:        addr,
+		maxLen:      maxLen,
+		dial:        dial,
+		tags:        tags,
 		metricQueue: make(chan string, 4096),
+		kv:          newKVBuffer(kvBufferPoints),
+		ready:       newReadiness(),
 	}
 	go s.flushMetrics()
-	return s, nil
+	return s
 }
 
 // Close is used to stop flushing to statsd
@@ -48,6 +145,27 @@ func (s *StatsdSink) Shutdown() {
 	close(s.metricQueue)
 }
 
+// Ready returns a channel which is closed once the sink has connected to
+// statsd for the first time.
+func (s *StatsdSink) Ready() <-chan struct{} {
+	return s.ready.ch
+}
+
+// Capabilities reports what the statsd sink supports. Labels are flattened
+// into the key as statsd has no notion of tags, unless the M3 tag extension
+// is used.
+func (s *StatsdSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Tags: s.tags == StatsdTagsM3}
+}
+
+// Preflight checks that the statsd address resolves, see ValidatePipeline.
+// Over UDP, whether a server is listening cannot be checked without sending
+// a metric, while a Unix domain socket must be accepting datagrams and a TCP
+// server connections.
+func (s *StatsdSink) Preflight(ctx context.Context) error {
+	return preflightDial(ctx, s.network, s.addr)
+}
+
 func (s *StatsdSink) SetGauge(key []string, val float32) {
 	flatKey := s.flattenKey(key)
 	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
@@ -68,9 +186,22 @@ func (s *StatsdSink) SetPrecisionGaugeWithLabels(key []string, val float64, labe
 	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
 }
 
+// EmitKey buffers the point apart from other metrics, see KVDropped.
 func (s *StatsdSink) EmitKey(key []string, val float32) {
-	flatKey := s.flattenKey(key)
-	s.pushMetric(fmt.Sprintf("%s:%f|kv\n", flatKey, val))
+	s.kv.add(s.flattenKey(key), val)
+}
+
+// EmitKeys buffers a batch of points, which are encoded into as few packets
+// as possible.
+func (s *StatsdSink) EmitKeys(key []string, vals []float32) {
+	s.kv.add(s.flattenKey(key), vals...)
+}
+
+// KVDropped returns the number of key/value points dropped because more
+// were emitted between flushes than the sink buffers, or the connection to
+// statsd was down. Key/value points never take the place of other metrics.
+func (s *StatsdSink) KVDropped() uint64 {
+	return s.kv.droppedCount()
 }
 
 func (s *StatsdSink) IncrCounter(key []string, val float32) {
@@ -110,12 +241,58 @@ func (s *StatsdSink) flattenKey(parts []string) string {
 
 // Flattens the key along with labels for formatting, removes spaces
 func (s *StatsdSink) flattenKeyLabels(parts []string, labels []Label) string {
+	if s.tags == StatsdTagsM3 {
+		return s.flattenKey(parts) + m3Tags(labels)
+	}
 	for _, label := range labels {
 		parts = append(parts, label.Value)
 	}
 	return s.flattenKey(parts)
 }
 
+// m3Tags encodes labels with the M3 tag extension, sorted by name so every
+// label set maps to a single series. Characters which are part of the
+// syntax are replaced with '_'.
+func m3Tags(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	sorted := make([]Label, len(labels))
+	copy(sorted, labels)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var b strings.Builder
+	for _, l := range sorted {
+		b.WriteByte(';')
+		b.WriteString(m3TagEscaper.Replace(l.Name))
+		b.WriteByte('=')
+		b.WriteString(m3TagEscaper.Replace(l.Value))
+	}
+	return b.String()
+}
+
+// m3TagEscaper replaces the separators of statsd lines and M3 tags
+var m3TagEscaper = strings.NewReplacer(":", "_", "|", "_", ";", "_", "=", "_", " ", "_", "\n", "_")
+
+// encodeKVBatch encodes key/value lines for flatKey, grouped into chunks of
+// at most max bytes so that each chunk can be queued as a single entry.
+func encodeKVBatch(flatKey string, vals []float32, max int) []string {
+	var chunks []string
+	var buf strings.Builder
+	for _, val := range vals {
+		line := fmt.Sprintf("%s:%f|kv\n", flatKey, val)
+		if buf.Len() > 0 && buf.Len()+len(line) > max {
+			chunks = append(chunks, buf.String())
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		chunks = append(chunks, buf.String())
+	}
+	return chunks
+}
+
 // Does a non-blocking push to the metrics queue
 func (s *StatsdSink) pushMetric(m string) {
 	select {
@@ -124,12 +301,26 @@ func (s *StatsdSink) pushMetric(m string) {
 	}
 }
 
+// bufferMetric appends a metric to the packet buffer, writing the packet out
+// first if the metric would overflow it.
+func (s *StatsdSink) bufferMetric(sock net.Conn, buf *bytes.Buffer, metric string) error {
+	if len(metric)+buf.Len() > s.maxLen {
+		_, err := sock.Write(buf.Bytes())
+		buf.Reset()
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteString(metric)
+	return nil
+}
+
 // Flushes metrics
 func (s *StatsdSink) flushMetrics() {
 	var sock net.Conn
 	var err error
 	var wait <-chan time.Time
-	ticker := time.NewTicker(flushInterval)
+	ticker := time.NewTicker(JitterInterval(flushInterval))
 	defer ticker.Stop()
 
 CONNECT:
@@ -137,34 +328,44 @@ CONNECT:
 	buf := bytes.NewBuffer(nil)
 
 	// Attempt to connect
-	sock, err = net.Dial("udp", s.addr)
+	sock, err = s.dial(s.network, s.addr)
 	if err != nil {
 		log.Printf("[ERR] Error connecting to statsd! Err: %s", err)
 		goto WAIT
 	}
+	s.ready.markReady()
 
 	for {
 		select {
 		case metric, ok := <-s.metricQueue:
 			// Get a metric from the queue
 			if !ok {
+				// Best effort flush of whatever is left before quitting
+				for _, chunk := range s.kv.take(s.maxLen) {
+					if s.bufferMetric(sock, buf, chunk) != nil {
+						goto QUIT
+					}
+				}
+				if buf.Len() > 0 {
+					_, _ = sock.Write(buf.Bytes())
+				}
 				goto QUIT
 			}
+			if err := s.bufferMetric(sock, buf, metric); err != nil {
+				log.Printf("[ERR] Error writing to statsd! Err: %s", err)
+				goto WAIT
+			}
 
-			// Check if this would overflow the packet size
-			if len(metric)+buf.Len() > statsdMaxLen {
-				_, err := sock.Write(buf.Bytes())
-				buf.Reset()
-				if err != nil {
+		case <-s.kv.kick:
+			for _, chunk := range s.kv.take(s.maxLen) {
+				if err := s.bufferMetric(sock, buf, chunk); err != nil {
 					log.Printf("[ERR] Error writing to statsd! Err: %s", err)
 					goto WAIT
 				}
 			}
 
-			// Append to the buffer
-			buf.WriteString(metric)
-
 		case <-ticker.C:
+			ticker.Reset(JitterInterval(flushInterval))
 			if buf.Len() == 0 {
 				continue
 			}
@@ -179,6 +380,12 @@ CONNECT:
 	}
 
 WAIT:
+	// Close the socket, so a TCP connection is reestablished
+	if sock != nil {
+		_ = sock.Close()
+		sock = nil
+	}
+
 	// Wait for a while
 	wait = time.After(time.Duration(5) * time.Second)
 	for {
@@ -188,10 +395,15 @@ WAIT:
 			if !ok {
 				goto QUIT
 			}
+		case <-s.kv.kick:
+			s.kv.discard()
 		case <-wait:
 			goto CONNECT
 		}
 	}
 QUIT:
+	if sock != nil {
+		_ = sock.Close()
+	}
 	s.metricQueue = nil
 }
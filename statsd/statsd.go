@@ -0,0 +1,217 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+// Package statsd implements the statsd text protocol, including the
+// DogStatsD tag extension. It is shared by the statsd based sinks, listeners
+// and relays, and can be used by tooling that needs to read or write the
+// same wire format.
+//
+// A line has the form:
+//
+//	<name>:<value>|<type>[|@<sample rate>][|#<tag>,<tag>:<value>]
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type is the statsd metric type of a line.
+type Type string
+
+const (
+	Counter      Type = "c"
+	Gauge        Type = "g"
+	Timer        Type = "ms"
+	Histogram    Type = "h"
+	Distribution Type = "d"
+	Set          Type = "s"
+	KV           Type = "kv"
+)
+
+func (t Type) valid() bool {
+	switch t {
+	case Counter, Gauge, Timer, Histogram, Distribution, Set, KV:
+		return true
+	default:
+		return false
+	}
+}
+
+// Tag is a DogStatsD tag. Tags without a value are encoded as the bare name.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// Metric is a single statsd line.
+type Metric struct {
+	Name  string
+	Type  Type
+	Value float64
+
+	// SetMember holds the value of Set metrics, which need not be numeric
+	SetMember string
+
+	// GaugeDelta marks a gauge value with an explicit sign, which statsd
+	// applies as a change to the current value rather than replacing it
+	GaugeDelta bool
+
+	// SampleRate is the rate the metric was sampled at. Zero means the
+	// metric was not sampled.
+	SampleRate float64
+
+	Tags []Tag
+}
+
+// Parse parses a single statsd line, without its trailing newline.
+func Parse(line string) (Metric, error) {
+	var m Metric
+
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return m, fmt.Errorf("statsd: missing metric name in %q", line)
+	}
+	m.Name = name
+
+	sections := strings.Split(rest, "|")
+	if len(sections) < 2 {
+		return m, fmt.Errorf("statsd: missing metric type in %q", line)
+	}
+	value := sections[0]
+	m.Type = Type(sections[1])
+	if !m.Type.valid() {
+		return m, fmt.Errorf("statsd: unknown metric type %q in %q", sections[1], line)
+	}
+
+	if m.Type == Set {
+		m.SetMember = value
+	} else {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("statsd: invalid value %q in %q", value, line)
+		}
+		m.Value = v
+		if m.Type == Gauge && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")) {
+			m.GaugeDelta = true
+		}
+	}
+
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, fmt.Errorf("statsd: invalid sample rate %q in %q", section, line)
+			}
+			m.SampleRate = rate
+		case strings.HasPrefix(section, "#"):
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				name, value, _ := strings.Cut(tag, ":")
+				m.Tags = append(m.Tags, Tag{Name: name, Value: value})
+			}
+		default:
+			// Unknown extensions, such as DogStatsD container IDs or
+			// timestamps, are ignored for forward compatibility
+		}
+	}
+	return m, nil
+}
+
+// ParsePacket parses every newline separated line of a packet, skipping
+// blank lines. Lines which fail to parse are skipped and reported together
+// in the returned error, so one bad line does not discard a whole packet.
+func ParsePacket(packet []byte) ([]Metric, error) {
+	var metrics []Metric
+	var errs []string
+	for _, line := range bytes.Split(packet, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		m, err := Parse(string(line))
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	if len(errs) > 0 {
+		return metrics, fmt.Errorf("%d invalid lines: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return metrics, nil
+}
+
+// Format encodes a metric as a statsd line, without a trailing newline.
+// Names and tags are escaped with EscapeName and EscapeTag.
+func Format(m Metric) string {
+	return string(AppendFormat(nil, m))
+}
+
+// AppendFormat appends the statsd line for a metric to dst, without a
+// trailing newline, and returns the extended buffer.
+func AppendFormat(dst []byte, m Metric) []byte {
+	dst = append(dst, EscapeName(m.Name)...)
+	dst = append(dst, ':')
+	switch {
+	case m.Type == Set:
+		dst = append(dst, EscapeName(m.SetMember)...)
+	case m.Type == Gauge && m.GaugeDelta && m.Value >= 0:
+		dst = append(dst, '+')
+		fallthrough
+	default:
+		dst = strconv.AppendFloat(dst, m.Value, 'f', -1, 64)
+	}
+	dst = append(dst, '|')
+	dst = append(dst, m.Type...)
+
+	if m.SampleRate > 0 && m.SampleRate < 1 {
+		dst = append(dst, "|@"...)
+		dst = strconv.AppendFloat(dst, m.SampleRate, 'f', -1, 64)
+	}
+	for i, tag := range m.Tags {
+		if i == 0 {
+			dst = append(dst, "|#"...)
+		} else {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, EscapeTag(tag.Name)...)
+		if tag.Value != "" {
+			dst = append(dst, ':')
+			dst = append(dst, EscapeTag(tag.Value)...)
+		}
+	}
+	return dst
+}
+
+// EscapeName replaces the characters which would break the framing of a
+// statsd line in a metric name with underscores. The protocol has no
+// escape sequences, so this cannot be reversed.
+func EscapeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '\n', '\r', ' ':
+			return '_'
+		default:
+			return r
+		}
+	}, name)
+}
+
+// EscapeTag is like EscapeName for tag names and values, which additionally
+// cannot contain commas or colons.
+func EscapeTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '\n', '\r', ' ':
+			return '_'
+		default:
+			return r
+		}
+	}, tag)
+}
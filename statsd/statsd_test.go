@@ -0,0 +1,86 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package statsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected Metric
+	}{
+		{"a.b:1|c", Metric{Name: "a.b", Type: Counter, Value: 1}},
+		{"a:2.5|g", Metric{Name: "a", Type: Gauge, Value: 2.5}},
+		{"a:-3|g", Metric{Name: "a", Type: Gauge, Value: -3, GaugeDelta: true}},
+		{"a:+3|g", Metric{Name: "a", Type: Gauge, Value: 3, GaugeDelta: true}},
+		{"a:12|ms|@0.1", Metric{Name: "a", Type: Timer, Value: 12, SampleRate: 0.1}},
+		{"a:1|h", Metric{Name: "a", Type: Histogram, Value: 1}},
+		{"a:1|d|#env:prod,canary", Metric{Name: "a", Type: Distribution, Value: 1, Tags: []Tag{{"env", "prod"}, {"canary", ""}}}},
+		{"a:user42|s", Metric{Name: "a", Type: Set, SetMember: "user42"}},
+		{"a:7|kv|c:abc", Metric{Name: "a", Type: KV, Value: 7}},
+	} {
+		got, err := Parse(tc.line)
+		if err != nil {
+			t.Fatalf("%s: unexpected err %s", tc.line, err)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("%s: got %+v want %+v", tc.line, got, tc.expected)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, line := range []string{
+		"", "a", ":1|c", "a:1", "a:1|x", "a:x|c", "a:1|c|@0", "a:1|c|@2",
+	} {
+		if _, err := Parse(line); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	metrics, err := ParsePacket([]byte("a:1|c\n\nbogus\r\nb:2|g\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "1 invalid lines") {
+		t.Fatalf("expected error, got %v", err)
+	}
+	if len(metrics) != 2 || metrics[0].Name != "a" || metrics[1].Name != "b" {
+		t.Fatalf("bad metrics: %+v", metrics)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		metric   Metric
+		expected string
+	}{
+		{Metric{Name: "a.b", Type: Counter, Value: 1}, "a.b:1|c"},
+		{Metric{Name: "a b:c", Type: Gauge, Value: 0.25}, "a_b_c:0.25|g"},
+		{Metric{Name: "a", Type: Gauge, Value: 3, GaugeDelta: true}, "a:+3|g"},
+		{Metric{Name: "a", Type: Gauge, Value: -3, GaugeDelta: true}, "a:-3|g"},
+		{Metric{Name: "a", Type: Timer, Value: 12, SampleRate: 0.5}, "a:12|ms|@0.5"},
+		{Metric{Name: "a", Type: Counter, Value: 1, SampleRate: 1}, "a:1|c"},
+		{Metric{Name: "a", Type: Set, SetMember: "u|1"}, "a:u_1|s"},
+		{Metric{Name: "a", Type: Distribution, Value: 1, Tags: []Tag{{"env", "a,b"}, {"canary", ""}}}, "a:1|d|#env:a_b,canary"},
+	} {
+		if got := Format(tc.metric); got != tc.expected {
+			t.Fatalf("got %q want %q", got, tc.expected)
+		}
+	}
+}
+
+func TestFormat_RoundTrip(t *testing.T) {
+	m := Metric{Name: "a", Type: Histogram, Value: 1.5, SampleRate: 0.25, Tags: []Tag{{"k", "v"}}}
+	got, err := Parse(Format(m))
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Fatalf("got %+v want %+v", got, m)
+	}
+}
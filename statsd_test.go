@@ -7,8 +7,11 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -22,6 +25,20 @@ func TestStatsd_Flatten(t *testing.T) {
 	}
 }
 
+func TestStatsd_M3Tags(t *testing.T) {
+	s := &StatsdSink{tags: StatsdTagsM3}
+	flat := s.flattenKeyLabels([]string{"api", "requests"}, []Label{{"path", "/a;b=c"}, {"code", "200"}})
+	if flat != "api.requests;code=200;path=/a_b_c" {
+		t.Fatalf("bad flat %q", flat)
+	}
+	if flat := s.flattenKeyLabels([]string{"a"}, nil); flat != "a" {
+		t.Fatalf("bad flat %q", flat)
+	}
+	if !s.Capabilities().Tags {
+		t.Fatalf("expected tags capability")
+	}
+}
+
 func TestStatsd_PushFullQueue(t *testing.T) {
 	q := make(chan string, 1)
 	q <- "full"
@@ -41,6 +58,17 @@ func TestStatsd_PushFullQueue(t *testing.T) {
 	}
 }
 
+func TestStatsd_EncodeKVBatch(t *testing.T) {
+	chunks := encodeKVBatch("a", []float32{1, 2, 3}, 30)
+	expected := []string{"a:1.000000|kv\na:2.000000|kv\n", "a:3.000000|kv\n"}
+	if !reflect.DeepEqual(chunks, expected) {
+		t.Fatalf("got %q want %q", chunks, expected)
+	}
+	if encodeKVBatch("a", nil, 30) != nil {
+		t.Fatalf("expected no chunks")
+	}
+}
+
 func TestStatsd_Conn(t *testing.T) {
 	addr := "127.0.0.1:7524"
 	errCh := make(chan error)
@@ -59,7 +87,20 @@ func TestStatsd_Conn(t *testing.T) {
 		buf = buf[:n]
 		reader := bufio.NewReader(bytes.NewReader(buf))
 
-		line, err := reader.ReadString('\n')
+		// Key/value points are buffered apart from the other metrics, so
+		// they may arrive anywhere in between
+		var kv []string
+		readLine := func() (string, error) {
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || !strings.HasSuffix(line, "|kv\n") {
+					return line, err
+				}
+				kv = append(kv, line)
+			}
+		}
+
+		line, err := readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -69,7 +110,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -79,7 +120,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -89,7 +130,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -99,17 +140,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
-		if err != nil {
-			errCh <- fmt.Errorf("unexpected err %s", err)
-			return
-		}
-		if line != "key.other:3.000000|kv\n" {
-			errCh <- fmt.Errorf("bad line %s", line)
-			return
-		}
-
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -119,7 +150,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -129,7 +160,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -139,7 +170,7 @@ func TestStatsd_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -148,6 +179,19 @@ func TestStatsd_Conn(t *testing.T) {
 			errCh <- fmt.Errorf("bad line %s", line)
 			return
 		}
+
+		if len(kv) == 0 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				errCh <- fmt.Errorf("unexpected err %s", err)
+				return
+			}
+			kv = append(kv, line)
+		}
+		if len(kv) != 1 || kv[0] != "key.other:3.000000|kv\n" {
+			errCh <- fmt.Errorf("bad key/value lines %q", kv)
+			return
+		}
 	}()
 	s, err := NewStatsdSink(addr)
 	if err != nil {
@@ -177,10 +221,11 @@ func TestStatsd_Conn(t *testing.T) {
 
 func TestNewStatsdSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
-		desc       string
-		input      string
-		expectErr  string
-		expectAddr string
+		desc          string
+		input         string
+		expectErr     string
+		expectAddr    string
+		expectNetwork string
 	}{
 		{
 			desc:       "address is populated",
@@ -192,6 +237,34 @@ func TestNewStatsdSinkFromURL(t *testing.T) {
 			input:      "statsd://statsd.service.consul:1234",
 			expectAddr: "statsd.service.consul:1234",
 		},
+		{
+			desc:       "m3 tags",
+			input:      "statsd://m3aggregator:8125?tags=m3",
+			expectAddr: "m3aggregator:8125",
+		},
+		{
+			desc:          "unix domain socket",
+			input:         "unixgram:///var/run/statsd.sock",
+			expectAddr:    "/var/run/statsd.sock",
+			expectNetwork: "unixgram",
+		},
+		{
+			desc:          "statsd url with a socket path",
+			input:         "statsd:///var/run/statsd.sock?tags=m3",
+			expectAddr:    "/var/run/statsd.sock",
+			expectNetwork: "unixgram",
+		},
+		{
+			desc:          "tcp",
+			input:         "statsd+tcp://statsd.service.consul:8125?tags=m3",
+			expectAddr:    "statsd.service.consul:8125",
+			expectNetwork: "tcp",
+		},
+		{
+			desc:      "unknown tags",
+			input:     "statsd://statsd.service.consul?tags=nope",
+			expectErr: "bad 'tags' param",
+		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
 			u, err := url.Parse(tc.input)
@@ -208,10 +281,115 @@ func TestNewStatsdSinkFromURL(t *testing.T) {
 					t.Fatalf("unexpected err: %s", err)
 				}
 				is := ms.(*StatsdSink)
+				defer is.Shutdown()
 				if is.addr != tc.expectAddr {
 					t.Fatalf("expected addr %s, got: %s", tc.expectAddr, is.addr)
 				}
+				if tc.expectNetwork == "" {
+					tc.expectNetwork = "udp"
+				}
+				if is.network != tc.expectNetwork {
+					t.Fatalf("expected network %s, got: %s", tc.expectNetwork, is.network)
+				}
 			}
 		})
 	}
 }
+
+func TestStatsd_Unixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statsd.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	s, err := NewStatsdSink("unixgram://" + path)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.maxLen != statsdUnixMaxLen {
+		t.Fatalf("bad max len %d", s.maxLen)
+	}
+
+	s.IncrCounter([]string{"counter", "me"}, float32(1))
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, statsdUnixMaxLen)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if got := string(buf[:n]); got != "counter.me:1.000000|c\n" {
+		t.Fatalf("bad datagram %q", got)
+	}
+}
+
+func TestStatsd_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s, err := NewStatsdSink("tcp://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if s.network != "tcp" || s.maxLen != statsiteMaxBatch {
+		t.Fatalf("bad network %s and max len %d", s.network, s.maxLen)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	s.IncrCounter([]string{"counter", "me"}, float32(1))
+	s.SetGauge([]string{"gauge", "val"}, float32(2))
+	<-s.Ready()
+
+	// Shutting down flushes what is buffered and closes the connection
+	s.Shutdown()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if got := string(data); got != "counter.me:1.000000|c\ngauge.val:2.000000|g\n" {
+		t.Fatalf("bad data %q", got)
+	}
+}
+
+func TestStatsd_Dialer(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	var network, address string
+	dial := func(n, a string) (net.Conn, error) {
+		network, address = n, a
+		return client, nil
+	}
+	s, err := NewStatsdSinkWithDialer("127.0.0.1:7525", dial)
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+
+	s.SetGauge([]string{"gauge", "val"}, float32(1))
+
+	_ = server.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if got := string(buf[:n]); got != "gauge.val:1.000000|g\n" {
+		t.Fatalf("bad packet %q", got)
+	}
+	if network != "udp" || address != "127.0.0.1:7525" {
+		t.Fatalf("bad dial %s %s", network, address)
+	}
+}
@@ -4,12 +4,15 @@
 package metrics
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,6 +21,10 @@ const (
 	// inactivity. Prevents stats from getting stuck in a buffer
 	// forever.
 	flushInterval = 100 * time.Millisecond
+
+	// statsiteMaxBatch is the largest number of bytes coalesced into a
+	// single write to statsite
+	statsiteMaxBatch = 64 * 1024
 )
 
 // NewStatsiteSinkFromURL creates an StatsiteSink from a URL. It is used
@@ -26,21 +33,107 @@ func NewStatsiteSinkFromURL(u *url.URL) (MetricSink, error) {
 	return NewStatsiteSink(u.Host)
 }
 
+// NewStatsiteTLSSinkFromURL creates a StatsiteSink connecting over TLS from
+// a statsite+tls:// URL. The optional "ca_file", "cert_file" and "key_file"
+// parameters name PEM files with the CA certificates to verify the server
+// with and the client certificate to present, and "server_name" overrides
+// the name verified.
+func NewStatsiteTLSSinkFromURL(u *url.URL) (MetricSink, error) {
+	params := u.Query()
+	var base *tls.Config
+	if name := params.Get("server_name"); name != "" {
+		base = &tls.Config{ServerName: name, MinVersion: tls.VersionTLS12}
+	}
+	config, err := clientTLSConfig("statsite", base, params.Get("cert_file"), params.Get("key_file"), params.Get("ca_file"))
+	if err != nil {
+		return nil, err
+	}
+	return NewStatsiteSinkTLS(u.Host, config)
+}
+
 // StatsiteSink provides a MetricSink that can be used with a
 // statsite metrics server
 type StatsiteSink struct {
 	addr        string
+	dial        Dialer
+	tlsConfig   *tls.Config
 	metricQueue chan string
+	kv          *kvBuffer
+	maxBatch    int
+	ready       readiness
+
+	// Backpressure accounting, see Stats
+	dropped      uint64
+	batches      uint64
+	bytesWritten uint64
+}
+
+// StatsiteStats reports how well a StatsiteSink is keeping up with the rate
+// of emitted metrics.
+type StatsiteStats struct {
+	// Dropped is the number of metrics discarded because the queue was full
+	// or the connection to statsite was down
+	Dropped uint64
+
+	// Batches is the number of writes made to statsite
+	Batches uint64
+
+	// BytesWritten is the total number of bytes written to statsite
+	BytesWritten uint64
+
+	// KVDropped is the number of key/value points discarded because more
+	// were emitted between flushes than the sink buffers, or the connection
+	// to statsite was down. Key/value points are buffered apart from other
+	// metrics and never take their place in the queue.
+	KVDropped uint64
 }
 
 // NewStatsiteSink is used to create a new StatsiteSink
 func NewStatsiteSink(addr string) (*StatsiteSink, error) {
+	return newStatsiteSink(addr, net.Dial, nil), nil
+}
+
+// NewStatsiteSinkTLS is used to create a StatsiteSink which wraps its
+// connection in TLS, for a statsite relay across an untrusted network. The
+// config may hold client certificates and the CA certificates to verify the
+// server with, its server name defaults to the host of addr. A nil config
+// uses the system roots.
+func NewStatsiteSinkTLS(addr string, config *tls.Config) (*StatsiteSink, error) {
+	if config == nil {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	dialer := &tls.Dialer{Config: config}
+	return newStatsiteSink(addr, dialer.Dial, config), nil
+}
+
+func newStatsiteSink(addr string, dial Dialer, config *tls.Config) *StatsiteSink {
 	s := &StatsiteSink{
 		addr:        addr,
+		dial:        dial,
+		tlsConfig:   config,
 		metricQueue: make(chan string, 4096),
+		kv:          newKVBuffer(kvBufferPoints),
+		maxBatch:    statsiteMaxBatch,
+		ready:       newReadiness(),
 	}
 	go s.flushMetrics()
-	return s, nil
+	return s
+}
+
+// Ready returns a channel which is closed once the sink has connected to
+// statsite for the first time.
+func (s *StatsiteSink) Ready() <-chan struct{} {
+	return s.ready.ch
+}
+
+// Stats returns the backpressure accounting of the sink.
+func (s *StatsiteSink) Stats() StatsiteStats {
+	return StatsiteStats{
+		Dropped:      atomic.LoadUint64(&s.dropped),
+		Batches:      atomic.LoadUint64(&s.batches),
+		BytesWritten: atomic.LoadUint64(&s.bytesWritten),
+		KVDropped:    s.kv.droppedCount(),
+	}
 }
 
 // Close is used to stop flushing to statsite
@@ -48,6 +141,27 @@ func (s *StatsiteSink) Shutdown() {
 	close(s.metricQueue)
 }
 
+// Capabilities reports what the statsite sink supports. Labels are flattened
+// into the key as statsite has no notion of tags.
+func (s *StatsiteSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true}
+}
+
+// Preflight checks that the statsite address resolves and accepts
+// connections, and completes a TLS handshake if enabled, see
+// ValidatePipeline.
+func (s *StatsiteSink) Preflight(ctx context.Context) error {
+	if err := preflightDial(ctx, "tcp", s.addr); err != nil || s.tlsConfig == nil {
+		return err
+	}
+	dialer := &tls.Dialer{Config: s.tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return &PreflightError{Stage: PreflightStageAuth, Err: err}
+	}
+	return conn.Close()
+}
+
 func (s *StatsiteSink) SetGauge(key []string, val float32) {
 	flatKey := s.flattenKey(key)
 	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
@@ -68,9 +182,16 @@ func (s *StatsiteSink) SetPrecisionGaugeWithLabels(key []string, val float64, la
 	s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
 }
 
+// EmitKey buffers the point apart from other metrics, see
+// StatsiteStats.KVDropped.
 func (s *StatsiteSink) EmitKey(key []string, val float32) {
-	flatKey := s.flattenKey(key)
-	s.pushMetric(fmt.Sprintf("%s:%f|kv\n", flatKey, val))
+	s.kv.add(s.flattenKey(key), val)
+}
+
+// EmitKeys buffers a batch of points, which are encoded into as few writes
+// as possible.
+func (s *StatsiteSink) EmitKeys(key []string, vals []float32) {
+	s.kv.add(s.flattenKey(key), vals...)
 }
 
 func (s *StatsiteSink) IncrCounter(key []string, val float32) {
@@ -121,45 +242,87 @@ func (s *StatsiteSink) pushMetric(m string) {
 	select {
 	case s.metricQueue <- m:
 	default:
+		atomic.AddUint64(&s.dropped, 1)
 	}
 }
 
-// Flushes metrics
+// writeBatch writes the buffered metrics to statsite in a single call and
+// resets the buffer, whether or not the write succeeded.
+func (s *StatsiteSink) writeBatch(sock net.Conn, buf *bytes.Buffer) error {
+	n, err := sock.Write(buf.Bytes())
+	buf.Reset()
+	atomic.AddUint64(&s.batches, 1)
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+	return err
+}
+
+// bufferMetric appends a metric to the batch, writing the batch out first if
+// the metric would overflow it.
+func (s *StatsiteSink) bufferMetric(sock net.Conn, buf *bytes.Buffer, metric string) error {
+	if buf.Len() > 0 && buf.Len()+len(metric) > s.maxBatch {
+		if err := s.writeBatch(sock, buf); err != nil {
+			return err
+		}
+	}
+	buf.WriteString(metric)
+	return nil
+}
+
+// Flushes metrics. Metrics are coalesced into a buffer which is written out
+// in a single call whenever the next metric would push it past maxBatch, or
+// when the flush interval elapses, so high latency links see a few large
+// writes rather than a stream of small ones.
 func (s *StatsiteSink) flushMetrics() {
 	var sock net.Conn
 	var err error
 	var wait <-chan time.Time
-	var buffered *bufio.Writer
-	ticker := time.NewTicker(flushInterval)
+	ticker := time.NewTicker(JitterInterval(flushInterval))
 	defer ticker.Stop()
 
+	buf := bytes.NewBuffer(make([]byte, 0, s.maxBatch))
+
 CONNECT:
 	// Attempt to connect
-	sock, err = net.Dial("tcp", s.addr)
+	sock, err = s.dial("tcp", s.addr)
 	if err != nil {
 		log.Printf("[ERR] Error connecting to statsite! Err: %s", err)
 		goto WAIT
 	}
-
-	// Create a buffered writer
-	buffered = bufio.NewWriter(sock)
+	s.ready.markReady()
 
 	for {
 		select {
 		case metric, ok := <-s.metricQueue:
 			// Get a metric from the queue
 			if !ok {
+				// Best effort flush of whatever is left before quitting
+				for _, chunk := range s.kv.take(s.maxBatch) {
+					if s.bufferMetric(sock, buf, chunk) != nil {
+						goto QUIT
+					}
+				}
+				if buf.Len() > 0 {
+					_ = s.writeBatch(sock, buf)
+				}
 				goto QUIT
 			}
-
-			// Try to send to statsite
-			_, err := buffered.Write([]byte(metric))
-			if err != nil {
+			if err := s.bufferMetric(sock, buf, metric); err != nil {
 				log.Printf("[ERR] Error writing to statsite! Err: %s", err)
 				goto WAIT
 			}
+		case <-s.kv.kick:
+			for _, chunk := range s.kv.take(s.maxBatch) {
+				if err := s.bufferMetric(sock, buf, chunk); err != nil {
+					log.Printf("[ERR] Error writing to statsite! Err: %s", err)
+					goto WAIT
+				}
+			}
 		case <-ticker.C:
-			if err := buffered.Flush(); err != nil {
+			ticker.Reset(JitterInterval(flushInterval))
+			if buf.Len() == 0 {
+				continue
+			}
+			if err := s.writeBatch(sock, buf); err != nil {
 				log.Printf("[ERR] Error flushing to statsite! Err: %s", err)
 				goto WAIT
 			}
@@ -167,6 +330,12 @@ CONNECT:
 	}
 
 WAIT:
+	if sock != nil {
+		_ = sock.Close()
+		sock = nil
+	}
+	buf.Reset()
+
 	// Wait for a while
 	wait = time.After(time.Duration(5) * time.Second)
 	for {
@@ -176,10 +345,16 @@ WAIT:
 			if !ok {
 				goto QUIT
 			}
+			atomic.AddUint64(&s.dropped, 1)
+		case <-s.kv.kick:
+			s.kv.discard()
 		case <-wait:
 			goto CONNECT
 		}
 	}
 QUIT:
+	if sock != nil {
+		_ = sock.Close()
+	}
 	s.metricQueue = nil
 }
@@ -5,9 +5,21 @@ package metrics
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"net"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -56,7 +68,20 @@ func TestStatsite_Conn(t *testing.T) {
 
 		reader := bufio.NewReader(conn)
 
-		line, err := reader.ReadString('\n')
+		// Key/value points are buffered apart from the other metrics, so
+		// they may arrive anywhere in between
+		var kv []string
+		readLine := func() (string, error) {
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || !strings.HasSuffix(line, "|kv\n") {
+					return line, err
+				}
+				kv = append(kv, line)
+			}
+		}
+
+		line, err := readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -66,7 +91,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -76,7 +101,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -86,7 +111,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -96,17 +121,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
-		if err != nil {
-			errCh <- fmt.Errorf("unexpected err %s", err)
-			return
-		}
-		if line != "key.other:3.000000|kv\n" {
-			errCh <- fmt.Errorf("bad line %s", line)
-			return
-		}
-
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -116,7 +131,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -126,7 +141,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -136,7 +151,7 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
-		line, err = reader.ReadString('\n')
+		line, err = readLine()
 		if err != nil {
 			errCh <- fmt.Errorf("unexpected err %s", err)
 			return
@@ -146,6 +161,19 @@ func TestStatsite_Conn(t *testing.T) {
 			return
 		}
 
+		if len(kv) == 0 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				errCh <- fmt.Errorf("unexpected err %s", err)
+				return
+			}
+			kv = append(kv, line)
+		}
+		if len(kv) != 1 || kv[0] != "key.other:3.000000|kv\n" {
+			errCh <- fmt.Errorf("bad key/value lines %q", kv)
+			return
+		}
+
 		_ = conn.Close()
 	}()
 	s, err := NewStatsiteSink(addr)
@@ -214,3 +242,159 @@ func TestNewStatsiteSinkFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestStatsite_Batching(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s := &StatsiteSink{
+		addr:        ln.Addr().String(),
+		dial:        net.Dial,
+		metricQueue: make(chan string, 16),
+		kv:          newKVBuffer(kvBufferPoints),
+		maxBatch:    32,
+		ready:       newReadiness(),
+	}
+	go s.flushMetrics()
+	defer s.Shutdown()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	for i := 0; i < 5; i++ {
+		s.IncrCounter([]string{"a"}, 1)
+	}
+
+	// Every metric arrives, coalesced into batches of at most two lines
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 5; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if line != "a:1.000000|c\n" {
+			t.Fatalf("bad line %s", line)
+		}
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for s.Stats().Batches != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad stats: %#v", s.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := s.Stats(); stats.BytesWritten != 65 || stats.Dropped != 0 {
+		t.Fatalf("bad stats: %#v", stats)
+	}
+}
+
+func TestStatsite_TLS(t *testing.T) {
+	// Borrow the certificate of an httptest server, valid for 127.0.0.1
+	srv := httptest.NewTLSServer(nil)
+	serverCert, serverCA := srv.TLS.Certificates[0], srv.Certificate()
+	srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	dir := t.TempDir()
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		return path
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	u, err := url.Parse(fmt.Sprintf("statsite+tls://%s?ca_file=%s&cert_file=%s&key_file=%s",
+		ln.Addr(),
+		writePEM("ca.crt", "CERTIFICATE", serverCA.Raw),
+		writePEM("client.crt", "CERTIFICATE", der),
+		writePEM("client.key", "EC PRIVATE KEY", keyDER)))
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	sink, err := NewMetricSinkFromURL(u.String())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s := sink.(*StatsiteSink)
+	defer s.Shutdown()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	s.IncrCounter([]string{"a"}, 1)
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if line != "a:1.000000|c\n" {
+		t.Fatalf("bad line %q", line)
+	}
+	if peers := conn.(*tls.Conn).ConnectionState().PeerCertificates; len(peers) != 1 {
+		t.Fatalf("expected a client certificate, got %d", len(peers))
+	}
+}
+
+func TestStatsite_TLSPreflight(t *testing.T) {
+	// A plain TCP listener cannot complete the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	s, err := NewStatsiteSinkTLS(ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var perr *PreflightError
+	if err := s.Preflight(ctx); !errors.As(err, &perr) || perr.Stage != PreflightStageAuth {
+		t.Fatalf("expected a handshake error, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// structLabelFields caches the tagged fields of each struct type seen by
+// LabelsFromStruct, so reflection over tags only happens once per type.
+var structLabelFields sync.Map // map[reflect.Type][]structLabelField
+
+type structLabelField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// LabelsFromStruct extracts labels from the fields of a struct annotated with
+// a `metrics` tag, so request and response types can be turned into label
+// sets without hand written mapping code:
+//
+//	type Request struct {
+//		Region string `metrics:"region"`
+//		Tier   int    `metrics:"tier,omitempty"`
+//		Secret string `metrics:"-"`
+//	}
+//
+// Labels are returned in field order. Fields embedded anonymously are
+// flattened into the result. The omitempty option skips fields holding the
+// zero value. v may be a struct or a pointer to one; anything else returns nil.
+func LabelsFromStruct(v interface{}) []Label {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var labels []Label
+	for _, f := range fieldsForType(rv.Type()) {
+		fv, ok := fieldByIndex(rv, f.index)
+		if !ok || (f.omitEmpty && fv.IsZero()) {
+			continue
+		}
+		labels = append(labels, Label{Name: f.name, Value: labelValue(fv)})
+	}
+	return labels
+}
+
+func fieldsForType(t reflect.Type) []structLabelField {
+	if cached, ok := structLabelFields.Load(t); ok {
+		return cached.([]structLabelField)
+	}
+	fields := collectStructFields(t, map[reflect.Type]bool{t: true})
+	structLabelFields.Store(t, fields)
+	return fields
+}
+
+// collectStructFields returns the tagged fields of t. path holds the struct
+// types embedded on the way to t, which are skipped when embedded again so
+// self-embedding types terminate. Only complete results are cached, by
+// fieldsForType, as the fields of an embedded type depend on its path.
+func collectStructFields(t reflect.Type, path map[reflect.Type]bool) []structLabelField {
+	var fields []structLabelField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, hasTag := sf.Tag.Lookup("metrics")
+		if tag == "-" {
+			continue
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && !hasTag && ft.Kind() == reflect.Struct {
+			if path[ft] {
+				continue
+			}
+			path[ft] = true
+			for _, embedded := range collectStructFields(ft, path) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			delete(path, ft)
+			continue
+		}
+		if !hasTag || !sf.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, structLabelField{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but reports nil embedded
+// pointers instead of panicking.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return reflect.Value{}, false
+				}
+				v = v.Elem()
+			}
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func labelValue(v reflect.Value) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	// Fields promoted from unexported embedded structs cannot be converted
+	// back to an interface, but their kind specific accessors still work.
+	if v.CanInterface() {
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			return s.String()
+		}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
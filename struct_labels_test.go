@@ -0,0 +1,79 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type labelsBase struct {
+	Region string `metrics:"region"`
+}
+
+type labelsRequest struct {
+	labelsBase
+	Route    string        `metrics:"route"`
+	Status   int           `metrics:"status_code"`
+	Cached   bool          `metrics:"cached"`
+	Tier     int           `metrics:"tier,omitempty"`
+	Timeout  time.Duration `metrics:"timeout"`
+	Secret   string        `metrics:"-"`
+	Untagged string
+	Owner    *string `metrics:"owner,omitempty"`
+}
+
+func TestLabelsFromStruct(t *testing.T) {
+	req := &labelsRequest{
+		labelsBase: labelsBase{Region: "us-east"},
+		Route:      "/v1/kv",
+		Status:     200,
+		Cached:     true,
+		Timeout:    time.Second,
+		Secret:     "hunter2",
+		Untagged:   "nope",
+	}
+	expected := []Label{
+		{"region", "us-east"},
+		{"route", "/v1/kv"},
+		{"status_code", "200"},
+		{"cached", "true"},
+		{"timeout", "1s"},
+	}
+
+	// Run twice to exercise the type cache
+	for i := 0; i < 2; i++ {
+		if got := LabelsFromStruct(req); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("got %v want %v", got, expected)
+		}
+	}
+
+	owner := "team-a"
+	req.Owner = &owner
+	req.Tier = 2
+	got := LabelsFromStruct(*req)
+	if len(got) != 7 || got[4] != (Label{"tier", "2"}) || got[6] != (Label{"owner", "team-a"}) {
+		t.Fatalf("bad labels: %v", got)
+	}
+
+	if LabelsFromStruct("not a struct") != nil {
+		t.Fatalf("expected nil")
+	}
+	if LabelsFromStruct((*labelsRequest)(nil)) != nil {
+		t.Fatalf("expected nil")
+	}
+}
+
+type selfEmbedding struct {
+	*selfEmbedding
+	Region string `metrics:"region"`
+}
+
+func TestLabelsFromStruct_SelfEmbedding(t *testing.T) {
+	got := LabelsFromStruct(selfEmbedding{Region: "x"})
+	if expected := []Label{{"region", "x"}}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v want %v", got, expected)
+	}
+}
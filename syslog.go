@@ -0,0 +1,459 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// syslogFlushInterval is used when SyslogOpts.FlushInterval is not set
+	syslogFlushInterval = 10 * time.Second
+
+	// syslogEnterpriseID is used when SyslogOpts.EnterpriseID is not set. It
+	// is the private enterprise number reserved for documentation by RFC
+	// 5612.
+	syslogEnterpriseID = 32473
+
+	// syslogTimeout bounds connecting and every write
+	syslogTimeout = 10 * time.Second
+
+	// syslogMaxBatch is the largest number of bytes written to a stream
+	// connection at once
+	syslogMaxBatch = 64 * 1024
+)
+
+// syslogLocalSockets are tried in order when SyslogOpts.Address is empty
+var syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Transports of SyslogSink
+const (
+	SyslogNetworkUDP      = "udp"
+	SyslogNetworkTCP      = "tcp"
+	SyslogNetworkTLS      = "tls"
+	SyslogNetworkUnixgram = "unixgram"
+	SyslogNetworkUnix     = "unix"
+)
+
+// SyslogOpts is used to configure a SyslogSink.
+type SyslogOpts struct {
+	// Network is the transport to the syslog server, one of
+	// SyslogNetworkUDP, the default, SyslogNetworkTCP, SyslogNetworkTLS,
+	// SyslogNetworkUnixgram or SyslogNetworkUnix. Messages are framed with
+	// octet counting on stream transports, as in RFC 6587.
+	Network string
+
+	// Address is the host and port, or socket path, of the syslog server.
+	// The local syslog socket is used when empty.
+	Address string
+
+	// TLSConfig configures SyslogNetworkTLS, including client
+	// certificates. Alternatively CertFile and KeyFile load a client
+	// certificate and CAFile the certificates used to verify the server.
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+	CAFile    string
+
+	// Facility is the syslog facility of every message, it defaults to 16,
+	// local0
+	Facility int
+
+	// Severity is the syslog severity of every message, it defaults to 6,
+	// informational
+	Severity int
+
+	// Hostname and AppName fill the header of every message, they default
+	// to the hostname and the name of the executable
+	Hostname string
+	AppName  string
+
+	// EnterpriseID is the private enterprise number of the structured data
+	// IDs, it defaults to 32473, which is reserved for documentation
+	EnterpriseID int
+
+	// FlushInterval is how often messages are written, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+}
+
+// SyslogSink provides a MetricSink which writes one RFC 5424 message per
+// series and flush interval to a local or remote syslog server, for
+// environments which only permit syslog egress. The value of a series is
+// carried in structured data, followed by its labels:
+//
+//	<134>1 2024-05-02T15:04:05Z web-1 api 4242 sample
+//	 [metric@32473 name="api.latency" value="12.5" count="4" sum="50" min="3" max="30"]
+//	 [labels@32473 route="/users"] api.latency=12.5
+//
+// The MSGID is the type of the series. Gauges and key/value pairs report
+// their last value, counters their sum and samples their mean, with counters
+// and samples adding the count and samples the sum, min and max of the
+// interval. Label names are truncated to 32 characters, with characters
+// syslog does not allow in them replaced by '_'.
+type SyslogSink struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	dial      Dialer
+	priority  string
+	origin    string
+	metricID  string
+	labelsID  string
+
+	agg  *intervalAggregator
+	conn net.Conn
+	loop *flushLoop
+}
+
+// NewSyslogSink creates a SyslogSink and starts its flush loop. The
+// connection is made on the first flush.
+func NewSyslogSink(opts SyslogOpts) (*SyslogSink, error) {
+	network := opts.Network
+	switch network {
+	case "":
+		network = SyslogNetworkUDP
+		if opts.Address == "" {
+			network = SyslogNetworkUnixgram
+		}
+	case SyslogNetworkUDP, SyslogNetworkTCP, SyslogNetworkTLS, SyslogNetworkUnixgram, SyslogNetworkUnix:
+	default:
+		return nil, fmt.Errorf("unknown syslog network %q", opts.Network)
+	}
+	if opts.Address == "" && network != SyslogNetworkUnixgram && network != SyslogNetworkUnix {
+		return nil, fmt.Errorf("syslog address is required for network %q", network)
+	}
+	if opts.Facility < 0 || opts.Facility > 23 {
+		return nil, fmt.Errorf("bad syslog facility %d", opts.Facility)
+	}
+	if opts.Severity < 0 || opts.Severity > 7 {
+		return nil, fmt.Errorf("bad syslog severity %d", opts.Severity)
+	}
+	facility, severity := opts.Facility, opts.Severity
+	if facility == 0 {
+		facility = 16
+	}
+	if severity == 0 {
+		severity = 6
+	}
+
+	var tlsConfig *tls.Config
+	if network == SyslogNetworkTLS {
+		config, err := clientTLSConfig("syslog", opts.TLSConfig, opts.CertFile, opts.KeyFile, opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if config == nil {
+			config = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(opts.Address); err == nil {
+				config.ServerName = host
+			}
+		}
+		tlsConfig = config
+	}
+
+	hostname := opts.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	appName := opts.AppName
+	if appName == "" {
+		appName = filepath.Base(os.Args[0])
+	}
+	enterpriseID := opts.EnterpriseID
+	if enterpriseID <= 0 {
+		enterpriseID = syslogEnterpriseID
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = syslogFlushInterval
+	}
+
+	// Every header is the priority and version, the timestamp and the
+	// origin of the messages
+	s := &SyslogSink{
+		network:   network,
+		addr:      opts.Address,
+		tlsConfig: tlsConfig,
+		dial:      net.Dial,
+		priority:  fmt.Sprintf("<%d>1 ", facility*8+severity),
+		origin: fmt.Sprintf(" %s %s %d ", syslogHeaderField(hostname, 255),
+			syslogHeaderField(appName, 48), os.Getpid()),
+		metricID: "metric@" + strconv.Itoa(enterpriseID),
+		labelsID: "labels@" + strconv.Itoa(enterpriseID),
+		agg:      newIntervalAggregator(),
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+func (s *SyslogSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *SyslogSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *SyslogSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *SyslogSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *SyslogSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *SyslogSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *SyslogSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *SyslogSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *SyslogSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the syslog sink supports.
+func (s *SyslogSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining messages are
+// written.
+func (s *SyslogSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often messages are written, starting from
+// now.
+func (s *SyslogSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *SyslogSink) flushLoop(now time.Time, final bool) {
+	s.flush(now)
+	if final && s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+// flush writes everything aggregated since the last flush. It is only called
+// from the flush loop, which owns the connection. Messages of an interval
+// which cannot be written are dropped.
+func (s *SyslogSink) flush(now time.Time) {
+	messages := s.messages(s.agg.drain(), now)
+	if len(messages) == 0 {
+		return
+	}
+
+	if s.conn == nil {
+		conn, err := s.connect()
+		if err != nil {
+			log.Printf("[ERR] Error connecting to syslog! Err: %s", err)
+			return
+		}
+		s.conn = conn
+	}
+
+	var err error
+	if s.network == SyslogNetworkUDP || s.network == SyslogNetworkUnixgram {
+		// Datagram transports carry a single message per write
+		for _, msg := range messages {
+			if err = s.write(msg); err != nil {
+				break
+			}
+		}
+	} else {
+		var buf bytes.Buffer
+		for _, msg := range messages {
+			if buf.Len() > 0 && buf.Len()+len(msg) > syslogMaxBatch {
+				if err = s.write(buf.Bytes()); err != nil {
+					break
+				}
+				buf.Reset()
+			}
+			buf.WriteString(strconv.Itoa(len(msg)))
+			buf.WriteByte(' ')
+			buf.Write(msg)
+		}
+		if err == nil {
+			err = s.write(buf.Bytes())
+		}
+	}
+	if err != nil {
+		log.Printf("[ERR] Error writing to syslog! Err: %s", err)
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *SyslogSink) write(b []byte) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := s.conn.Write(b)
+	return err
+}
+
+// connect dials the syslog server, or the first local socket which accepts
+// the connection when no address is set.
+func (s *SyslogSink) connect() (net.Conn, error) {
+	if s.addr == "" {
+		var err error
+		for _, path := range syslogLocalSockets {
+			var conn net.Conn
+			if conn, err = s.dial(s.network, path); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+	if s.network != SyslogNetworkTLS {
+		return s.dial(s.network, s.addr)
+	}
+
+	conn, err := s.dial("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(syslogTimeout))
+	tlsConn := tls.Client(conn, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// messages formats aggregates as RFC 5424 messages.
+func (s *SyslogSink) messages(aggs []*aggregate, now time.Time) [][]byte {
+	if len(aggs) == 0 {
+		return nil
+	}
+	header := s.priority + now.UTC().Format("2006-01-02T15:04:05.999999Z07:00") + s.origin
+
+	out := make([][]byte, 0, len(aggs))
+	for _, a := range aggs {
+		name := strings.Join(a.key, ".")
+		var b bytes.Buffer
+		b.WriteString(header)
+
+		var value float64
+		var params []string
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			b.WriteString("gauge")
+			value = a.last
+		case aggregateCounter:
+			b.WriteString("counter")
+			value = a.sum
+			params = []string{"count", strconv.Itoa(a.count)}
+		case aggregateSample:
+			b.WriteString("sample")
+			value = a.mean()
+			params = []string{
+				"count", strconv.Itoa(a.count),
+				"sum", formatSyslogValue(a.sum),
+				"min", formatSyslogValue(a.min),
+				"max", formatSyslogValue(a.max),
+			}
+		}
+
+		b.WriteString(" [")
+		b.WriteString(s.metricID)
+		writeSyslogParam(&b, "name", name)
+		writeSyslogParam(&b, "value", formatSyslogValue(value))
+		for i := 0; i < len(params); i += 2 {
+			writeSyslogParam(&b, params[i], params[i+1])
+		}
+		b.WriteByte(']')
+		if len(a.labels) > 0 {
+			b.WriteByte('[')
+			b.WriteString(s.labelsID)
+			for _, l := range a.labels {
+				writeSyslogParam(&b, syslogParamName(l.Name), l.Value)
+			}
+			b.WriteByte(']')
+		}
+
+		b.WriteByte(' ')
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(formatSyslogValue(value))
+		out = append(out, b.Bytes())
+	}
+	return out
+}
+
+func formatSyslogValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// syslogParamEscaper escapes the characters which are special in structured
+// data parameter values
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func writeSyslogParam(b *bytes.Buffer, name, value string) {
+	b.WriteByte(' ')
+	b.WriteString(name)
+	b.WriteString(`="`)
+	b.WriteString(syslogParamEscaper.Replace(value))
+	b.WriteByte('"')
+}
+
+// syslogParamName makes a label name a valid structured data parameter name,
+// of at most 32 printable characters other than '=', ' ', ']' and '"'.
+func syslogParamName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		return "_"
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// syslogHeaderField makes a value a valid header field of at most max
+// printable characters, or the nil value "-" when empty.
+func syslogHeaderField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if value == "" {
+		return "-"
+	}
+	if len(value) > max {
+		value = value[:max]
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSink_UDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	sink, err := NewSyslogSink(SyslogOpts{
+		Address:       conn.LocalAddr().String(),
+		Hostname:      "web 1",
+		AppName:       "api",
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	sink.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"route", `/a"b]`}, {"bad name=", "x"}})
+	sink.AddSample([]string{"api", "latency"}, 10)
+	sink.AddSample([]string{"api", "latency"}, 30)
+	sink.SetPrecisionGauge([]string{"api", "ratio"}, math.Inf(1))
+	sink.flush(time.Date(2024, 5, 2, 15, 4, 5, 250000000, time.UTC))
+
+	header := fmt.Sprintf("<134>1 2024-05-02T15:04:05.25Z web_1 api %d ", os.Getpid())
+	expected := []string{
+		header + `counter [metric@32473 name="api.requests" value="2" count="1"]` +
+			`[labels@32473 route="/a\"b\]" bad_name_="x"] api.requests=2`,
+		header + `gauge [metric@32473 name="api.ratio" value="+Inf"] api.ratio=+Inf`,
+		header + `sample [metric@32473 name="api.latency" value="20" count="2" sum="40" min="10" max="30"] api.latency=20`,
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1024)
+	for _, want := range expected {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Fatalf("bad message\n got: %s\nwant: %s", got, want)
+		}
+	}
+}
+
+func TestSyslogSink_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	sink, err := NewSyslogSink(SyslogOpts{
+		Network:       SyslogNetworkTCP,
+		Address:       ln.Addr().String(),
+		Facility:      1,
+		Severity:      5,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer sink.Shutdown()
+
+	sink.SetGauge([]string{"a"}, 1)
+	sink.SetGauge([]string{"b"}, 2)
+	go sink.flush(time.Now())
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	// Messages are framed by their length in octets
+	reader := bufio.NewReader(conn)
+	for _, name := range []string{"a", "b"} {
+		size, err := reader.ReadString(' ')
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil {
+			t.Fatalf("bad frame %q", size)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(reader, msg); err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if !strings.HasPrefix(string(msg), "<13>1 ") || !strings.Contains(string(msg), ` name="`+name+`" `) {
+			t.Fatalf("bad message %s", msg)
+		}
+	}
+}
+
+func TestSyslogSink_Unixgram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	sink, err := NewSyslogSink(SyslogOpts{Network: SyslogNetworkUnixgram, Address: path, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	sink.EmitKey([]string{"kv"}, 3)
+	sink.Shutdown()
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if msg := string(buf[:n]); !strings.HasSuffix(msg, `gauge [metric@32473 name="kv" value="3"] kv=3`) {
+		t.Fatalf("bad message %s", msg)
+	}
+}
+
+func TestNewSyslogSink_Errors(t *testing.T) {
+	for _, opts := range []SyslogOpts{
+		{Network: "carrier-pigeon", Address: "localhost:514"},
+		{Network: SyslogNetworkTCP},
+		{Address: "localhost:514", Facility: 24},
+		{Address: "localhost:514", Severity: -1},
+	} {
+		if _, err := NewSyslogSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+}
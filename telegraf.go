@@ -0,0 +1,182 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// telegrafFlushInterval is how often aggregated metrics are written to
+// Telegraf
+const telegrafFlushInterval = 10 * time.Second
+
+// TelegrafSink provides a MetricSink that writes to a Telegraf
+// socket_listener input over TCP or a Unix socket, using the JSON metric
+// format of Telegraf's json serializer, one object per line:
+//
+//	{"name":"api.requests","tags":{"code":"200","metric_type":"counter"},"fields":{"value":5},"timestamp":1700000000}
+//
+// Metrics are aggregated in memory and written on every flush interval, so
+// counters are never collapsed by points sharing a timestamp. Gauges and
+// key/value pairs report their last value, counters their sum, and samples
+// are written as a single metric with count, sum, min, max and mean fields.
+// The metric_type tag mirrors the one added by Telegraf's statsd input.
+type TelegrafSink struct {
+	network string
+	addr    string
+	dial    Dialer
+
+	agg  *intervalAggregator
+	conn net.Conn
+	loop *flushLoop
+}
+
+// telegrafMetric is the JSON encoding of a single metric
+type telegrafMetric struct {
+	Name      string             `json:"name"`
+	Tags      map[string]string  `json:"tags"`
+	Fields    map[string]float64 `json:"fields"`
+	Timestamp int64              `json:"timestamp"`
+}
+
+// NewTelegrafSink creates a TelegrafSink writing to addr over network,
+// which is "tcp" or "unix".
+func NewTelegrafSink(network, addr string) (*TelegrafSink, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, fmt.Errorf("unsupported telegraf network %q", network)
+	}
+	s := &TelegrafSink{
+		network: network,
+		addr:    addr,
+		dial:    net.Dial,
+		agg:     newIntervalAggregator(),
+	}
+	s.loop = startFlushLoop(telegrafFlushInterval, s.flushLoop)
+	return s, nil
+}
+
+func (s *TelegrafSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *TelegrafSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *TelegrafSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *TelegrafSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *TelegrafSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *TelegrafSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *TelegrafSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *TelegrafSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *TelegrafSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Telegraf sink supports.
+func (s *TelegrafSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// written.
+func (s *TelegrafSink) Shutdown() {
+	s.loop.stop()
+}
+
+func (s *TelegrafSink) flushLoop(now time.Time, final bool) {
+	s.flush(now)
+	if final && s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+// flush writes everything aggregated since the last flush. It is only called
+// from the flush loop, which owns the connection.
+func (s *TelegrafSink) flush(now time.Time) {
+	aggs := s.agg.drain()
+	if len(aggs) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, a := range aggs {
+		// Encoding a map of strings and floats cannot fail
+		_ = enc.Encode(telegrafEncode(a, now.Unix()))
+	}
+
+	if s.conn == nil {
+		conn, err := s.dial(s.network, s.addr)
+		if err != nil {
+			log.Printf("[ERR] Error connecting to telegraf! Err: %s", err)
+			return
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		log.Printf("[ERR] Error writing to telegraf! Err: %s", err)
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func telegrafEncode(a *aggregate, ts int64) telegrafMetric {
+	m := telegrafMetric{
+		Name:      strings.Join(a.key, "."),
+		Tags:      make(map[string]string, len(a.labels)+1),
+		Timestamp: ts,
+	}
+	for _, l := range a.labels {
+		m.Tags[l.Name] = l.Value
+	}
+
+	switch a.kind {
+	case aggregateGauge:
+		m.Tags["metric_type"] = "gauge"
+		m.Fields = map[string]float64{"value": a.last}
+	case aggregateKV:
+		m.Tags["metric_type"] = "kv"
+		m.Fields = map[string]float64{"value": a.last}
+	case aggregateCounter:
+		m.Tags["metric_type"] = "counter"
+		m.Fields = map[string]float64{"value": a.sum}
+	case aggregateSample:
+		m.Tags["metric_type"] = "timing"
+		m.Fields = map[string]float64{
+			"count": float64(a.count),
+			"sum":   a.sum,
+			"min":   a.min,
+			"max":   a.max,
+			"mean":  a.mean(),
+		}
+	}
+	return m
+}
@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTelegrafSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telegraf.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s, err := NewTelegrafSink("unix", path)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}})
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 3, []Label{{"code", "200"}})
+	s.AddSample([]string{"api", "latency"}, 10)
+	s.AddSample([]string{"api", "latency"}, 30)
+	s.flush(time.Unix(1700000000, 0))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expected := []string{
+		`{"name":"api.requests","tags":{"code":"200","metric_type":"counter"},"fields":{"value":5},"timestamp":1700000000}` + "\n",
+		`{"name":"api.latency","tags":{"metric_type":"timing"},"fields":{"count":2,"max":30,"mean":20,"min":10,"sum":40},"timestamp":1700000000}` + "\n",
+	}
+	for _, want := range expected {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected err %s", err)
+		}
+		if line != want {
+			t.Fatalf("got %s want %s", line, want)
+		}
+	}
+}
+
+func TestTelegrafSink_Network(t *testing.T) {
+	if _, err := NewTelegrafSink("udp", "127.0.0.1:8094"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
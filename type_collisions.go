@@ -0,0 +1,65 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// typeCollisionKey is the self-telemetry counter incremented every time a key
+// is emitted with a different type than it was first emitted with, labeled
+// with the key.
+var typeCollisionKey = []string{"metrics", "type_collisions"}
+
+// metricTypes records the type every key was first emitted with by any
+// Metrics instance with DetectTypeCollisions, as sinks share one namespace
+// per process.
+var metricTypes sync.Map // flattened key -> type
+
+// reportedCollisions holds the collisions already passed to an error handler
+var reportedCollisions sync.Map // flattened key and type -> struct{}
+
+// TypeCollisionError is reported when a key is emitted with a different type
+// than it was first emitted with, such as a counter which is later set as a
+// gauge. Backends such as Prometheus and statsd silently corrupt the data of
+// such keys.
+type TypeCollisionError struct {
+	Key      string
+	Type     string
+	Previous string
+}
+
+func (e *TypeCollisionError) Error() string {
+	return fmt.Sprintf("metric %q emitted as %s after being emitted as %s", e.Key, e.Type, e.Previous)
+}
+
+// checkType records the type of a key, reporting a collision with the type
+// it was first emitted with. Each collision is passed to the error handler
+// once, while the self-telemetry counter counts every occurrence. The metric
+// itself is still emitted.
+func (m *Metrics) checkType(key []string, typ string) {
+	flat := strings.Join(key, ".")
+	prev, loaded := metricTypes.LoadOrStore(flat, typ)
+	if !loaded || prev.(string) == typ {
+		return
+	}
+
+	m.incrCounterWithLabels(typeCollisionKey, 1, []Label{{Name: "name", Value: flat}})
+	if _, reported := reportedCollisions.LoadOrStore(flat+"|"+typ, struct{}{}); reported {
+		return
+	}
+	m.handleError(&TypeCollisionError{Key: flat, Type: typ, Previous: prev.(string)})
+}
+
+// handleError passes err to Config.ErrorHandler, or logs it.
+func (m *Metrics) handleError(err error) {
+	if m.ErrorHandler != nil {
+		m.ErrorHandler(err)
+		return
+	}
+	log.Printf("[WARN] metrics: %s", err)
+}
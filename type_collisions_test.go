@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMetrics_TypeCollisions(t *testing.T) {
+	var errs []error
+	sink := &MockSink{}
+	met, _ := New(&Config{
+		FilterDefault:        true,
+		DetectTypeCollisions: true,
+		ErrorHandler:         func(err error) { errs = append(errs, err) },
+	}, sink)
+
+	key := []string{"collision", "test"}
+	met.IncrCounter(key, 1)
+	met.IncrCounter(key, 1)
+	met.SetGauge(key, 2)
+	met.SetGauge(key, 3)
+
+	if len(errs) != 1 {
+		t.Fatalf("expected one reported collision, got %v", errs)
+	}
+	var tc *TypeCollisionError
+	if !errors.As(errs[0], &tc) || tc.Key != "collision.test" || tc.Type != "gauge" || tc.Previous != "counter" {
+		t.Fatalf("bad error %v", errs[0])
+	}
+
+	// The gauges are still emitted, along with a collision counter for each
+	var collisions int
+	for i, k := range sink.getKeys() {
+		if reflect.DeepEqual(k, typeCollisionKey) {
+			collisions++
+			if !reflect.DeepEqual(sink.labels[i], []Label{{"name", "collision.test"}}) {
+				t.Fatalf("bad labels %v", sink.labels[i])
+			}
+		}
+	}
+	if collisions != 2 || len(sink.getKeys()) != 6 {
+		t.Fatalf("bad keys %v", sink.getKeys())
+	}
+
+	// Collisions are detected across instances
+	other, _ := New(&Config{
+		FilterDefault:        true,
+		DetectTypeCollisions: true,
+		ErrorHandler:         func(err error) { errs = append(errs, err) },
+	}, &MockSink{})
+	other.AddSample(key, 1)
+	if len(errs) != 2 {
+		t.Fatalf("expected a collision with the other instance, got %v", errs)
+	}
+}
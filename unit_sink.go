@@ -0,0 +1,188 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// durationUnits and sizeUnits are the units a UnitSink converts between, by
+// their size in nanoseconds and bytes
+var (
+	durationUnits = map[string]float64{
+		"nanoseconds":  1,
+		"microseconds": 1e3,
+		"milliseconds": 1e6,
+		"seconds":      1e9,
+		"minutes":      60e9,
+		"hours":        3600e9,
+	}
+	sizeUnits = map[string]float64{
+		"bytes":     1,
+		"kilobytes": 1e3,
+		"megabytes": 1e6,
+		"gigabytes": 1e9,
+		"kibibytes": 1 << 10,
+		"mebibytes": 1 << 20,
+		"gibibytes": 1 << 30,
+	}
+)
+
+// UnitPolicy describes the units a UnitSink emits, following the conventions
+// of the sink it wraps.
+type UnitPolicy struct {
+	// Duration is the unit durations are converted to, one of
+	// "nanoseconds", "microseconds", "milliseconds", "seconds", "minutes"
+	// or "hours". Durations are left as emitted when empty.
+	Duration string
+
+	// Size is the unit sizes are converted to, one of "bytes",
+	// "kilobytes", "megabytes", "gigabytes", "kibibytes", "mebibytes" or
+	// "gibibytes". Sizes are left as emitted when empty.
+	Size string
+
+	// AppendUnit appends the unit as the last part of the key of every
+	// metric with a known unit, as in "api.latency.seconds", which the
+	// Prometheus naming conventions ask for.
+	AppendUnit bool
+}
+
+// UnitSink wraps a MetricSink and converts the values of metrics with a known
+// unit according to a UnitPolicy. Units are known for timers, the typed
+// helpers such as AddSampleDuration, NanoTimer gauges and keys registered
+// with Metrics.RegisterUnit. This allows a single MeasureSince call to reach
+// Prometheus in seconds and statsd in milliseconds:
+//
+//	prom, _ := metrics.NewUnitSink(promSink, metrics.UnitPolicy{Duration: "seconds", AppendUnit: true})
+//	sink := metrics.FanoutSink{prom, statsdSink}
+//
+// Metrics without a known unit pass through unchanged. Units are passed to
+// the UnitSink by the Metrics instance it was given to, directly or within a
+// FanoutSink or DynamicFanoutSink. A UnitSink attached to a DynamicFanoutSink
+// later on only learns the units of keys registered after that.
+type UnitSink struct {
+	sink   MetricSink
+	policy UnitPolicy
+
+	// units maps the flattened keys received to their unit
+	units sync.Map
+}
+
+// unitTracker is implemented by UnitSink and the sinks which may forward to
+// one, so a Metrics instance can pass on the units it knows about.
+type unitTracker interface {
+	// tracksUnits reports whether the sink is or includes a UnitSink
+	tracksUnits() bool
+
+	// setUnit records the unit of the metrics received under a flattened
+	// key
+	setUnit(key, unit string)
+}
+
+// tracksUnits reports whether units should be passed to sink
+func tracksUnits(sink MetricSink) bool {
+	t, ok := sink.(unitTracker)
+	return ok && t.tracksUnits()
+}
+
+func (u *UnitSink) tracksUnits() bool { return true }
+
+func (u *UnitSink) setUnit(key, unit string) {
+	u.units.Store(key, unit)
+}
+
+// NewUnitSink wraps sink with the given unit policy, which fails for unknown
+// units.
+func NewUnitSink(sink MetricSink, policy UnitPolicy) (*UnitSink, error) {
+	if _, ok := durationUnits[policy.Duration]; policy.Duration != "" && !ok {
+		return nil, fmt.Errorf("unknown duration unit %q", policy.Duration)
+	}
+	if _, ok := sizeUnits[policy.Size]; policy.Size != "" && !ok {
+		return nil, fmt.Errorf("unknown size unit %q", policy.Size)
+	}
+	return &UnitSink{sink: sink, policy: policy}, nil
+}
+
+func (u *UnitSink) SetGauge(key []string, val float32) {
+	u.SetGaugeWithLabels(key, val, nil)
+}
+
+func (u *UnitSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	key, scale := u.convert(key)
+	u.sink.SetGaugeWithLabels(key, float32(float64(val)*scale), labels)
+}
+
+func (u *UnitSink) SetPrecisionGauge(key []string, val float64) {
+	u.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (u *UnitSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	key, scale := u.convert(key)
+	setPrecisionGauge(u.sink, key, val*scale, labels)
+}
+
+func (u *UnitSink) EmitKey(key []string, val float32) {
+	key, scale := u.convert(key)
+	u.sink.EmitKey(key, float32(float64(val)*scale))
+}
+
+func (u *UnitSink) IncrCounter(key []string, val float32) {
+	u.IncrCounterWithLabels(key, val, nil)
+}
+
+func (u *UnitSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	key, scale := u.convert(key)
+	u.sink.IncrCounterWithLabels(key, float32(float64(val)*scale), labels)
+}
+
+func (u *UnitSink) AddSample(key []string, val float32) {
+	u.AddSampleWithLabels(key, val, nil)
+}
+
+func (u *UnitSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	key, scale := u.convert(key)
+	u.sink.AddSampleWithLabels(key, float32(float64(val)*scale), labels)
+}
+
+func (u *UnitSink) AddHistogram(key []string, val float64) {
+	u.AddHistogramWithLabels(key, val, nil)
+}
+
+func (u *UnitSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	key, scale := u.convert(key)
+	addHistogram(u.sink, key, val*scale, labels)
+}
+
+// Shutdown forwards to the wrapped sink if it supports it.
+func (u *UnitSink) Shutdown() {
+	if ss, ok := u.sink.(ShutdownSink); ok {
+		ss.Shutdown()
+	}
+}
+
+// convert returns the key for the wrapped sink, and the factor converting
+// values to the unit of the policy. The input key is never modified.
+func (u *UnitSink) convert(key []string) ([]string, float64) {
+	unit, ok := u.units.Load(strings.Join(key, "."))
+	if !ok {
+		return key, 1
+	}
+	from := unit.(string)
+
+	to, scale := from, 1.0
+	if size, ok := durationUnits[from]; ok && u.policy.Duration != "" {
+		to = u.policy.Duration
+		scale = size / durationUnits[to]
+	} else if size, ok := sizeUnits[from]; ok && u.policy.Size != "" {
+		to = u.policy.Size
+		scale = size / sizeUnits[to]
+	}
+
+	if u.policy.AppendUnit && len(key) > 0 && key[len(key)-1] != to {
+		key = append(key[:len(key):len(key)], to)
+	}
+	return key, scale
+}
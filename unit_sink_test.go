@@ -0,0 +1,112 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnitSink(t *testing.T) {
+	prom, statsd := &MockSink{}, &MockSink{}
+	promUnits, err := NewUnitSink(prom, UnitPolicy{Duration: "seconds", Size: "kibibytes", AppendUnit: true})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	met, err := New(&Config{FilterDefault: true, ServiceName: "api", TimerGranularity: time.Millisecond}, FanoutSink{promUnits, statsd})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	met.AddSampleDuration([]string{"unit_sink", "latency"}, 250*time.Millisecond)
+	met.RegisterUnit([]string{"unit_sink", "heap"}, UnitBytes)
+	met.SetGauge([]string{"unit_sink", "heap"}, 2048)
+	met.IncrCounter([]string{"unit_sink", "requests"}, 1)
+
+	if got, want := prom.getKeys(), [][]string{
+		{"api", "unit_sink", "latency", "seconds"},
+		{"api", "unit_sink", "heap", "kibibytes"},
+		{"api", "unit_sink", "requests"},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("bad keys %v", got)
+	}
+	if !reflect.DeepEqual(prom.vals, []float32{0.25, 2, 1}) {
+		t.Fatalf("bad values %v", prom.vals)
+	}
+
+	// The unwrapped sink receives what was emitted
+	if got := statsd.getKeys()[0]; !reflect.DeepEqual(got, []string{"api", "unit_sink", "latency"}) {
+		t.Fatalf("bad key %v", got)
+	}
+	if !reflect.DeepEqual(statsd.vals, []float32{250, 2048, 1}) {
+		t.Fatalf("bad values %v", statsd.vals)
+	}
+}
+
+func TestUnitSink_MeasureSince(t *testing.T) {
+	m := &MockSink{}
+	sink, err := NewUnitSink(m, UnitPolicy{Duration: "microseconds"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	met, err := New(&Config{FilterDefault: true, TimerGranularity: time.Millisecond, EnableTypePrefix: true}, sink)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	met.MeasureSince([]string{"unit_sink", "timer"}, time.Now().Add(-2*time.Millisecond))
+	if unit, ok := met.Unit([]string{"unit_sink", "timer"}); !ok || unit != "milliseconds" {
+		t.Fatalf("bad unit %q", unit)
+	}
+	if got := m.getKeys()[0]; !reflect.DeepEqual(got, []string{"timer", "unit_sink", "timer"}) {
+		t.Fatalf("bad key %v", got)
+	}
+	if v := m.vals[0]; v < 2000 || v > 60000 {
+		t.Fatalf("bad value %v", v)
+	}
+}
+
+func TestUnitSink_Scoped(t *testing.T) {
+	// Units are only passed to the UnitSinks of the instance registering
+	// them
+	m := &MockSink{}
+	sink, err := NewUnitSink(m, UnitPolicy{Duration: "seconds"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	met, err := New(&Config{FilterDefault: true}, sink)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	other, err := New(&Config{FilterDefault: true}, &BlackholeSink{})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	other.AddSampleDuration([]string{"unit_sink", "scoped"}, time.Second)
+	met.AddSample([]string{"unit_sink", "scoped"}, 1000)
+	if !reflect.DeepEqual(m.vals, []float32{1000}) {
+		t.Fatalf("bad values %v", m.vals)
+	}
+
+	// Without a UnitSink, MeasureSince skips recording units, and the
+	// granularity defaults to milliseconds otherwise
+	other.MeasureSince([]string{"unit_sink", "timer"}, time.Now())
+	if _, ok := other.Unit([]string{"unit_sink", "timer"}); ok {
+		t.Fatalf("expected no unit")
+	}
+	met.MeasureSince([]string{"unit_sink", "timer"}, time.Now())
+	if unit, ok := met.Unit([]string{"unit_sink", "timer"}); !ok || unit != "milliseconds" {
+		t.Fatalf("bad unit %q", unit)
+	}
+}
+
+func TestNewUnitSink_Errors(t *testing.T) {
+	if _, err := NewUnitSink(&MockSink{}, UnitPolicy{Duration: "fortnights"}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := NewUnitSink(&MockSink{}, UnitPolicy{Size: "seconds"}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// UnitBytes is the unit recorded for samples emitted with AddSampleBytes
+	UnitBytes = "bytes"
+)
+
+// AddSampleDuration records d as a sample for key, converted to the timer
+// granularity of the Metrics instance in the same way as MeasureSince. The
+// unit is recorded and can be looked up with Unit.
+func (m *Metrics) AddSampleDuration(key []string, d time.Duration) {
+	m.AddSampleDurationWithLabels(key, d, nil)
+}
+
+func (m *Metrics) AddSampleDurationWithLabels(key []string, d time.Duration, labels []Label) {
+	granularity := m.timerGranularity()
+	m.RegisterUnit(key, durationUnit(granularity))
+	m.AddSampleWithLabels(key, float32(d.Nanoseconds())/float32(granularity), labels)
+}
+
+// AddSampleBytes records a size of n bytes as a sample for key. The unit is
+// recorded and can be looked up with Unit.
+func (m *Metrics) AddSampleBytes(key []string, n int64) {
+	m.AddSampleBytesWithLabels(key, n, nil)
+}
+
+func (m *Metrics) AddSampleBytesWithLabels(key []string, n int64, labels []Label) {
+	m.RegisterUnit(key, UnitBytes)
+	m.AddSampleWithLabels(key, float32(n), labels)
+}
+
+// RegisterUnit records the unit of the values emitted for key, which the
+// typed helpers such as AddSampleDuration do themselves, and MeasureSince
+// when the sink of this instance includes a UnitSink. Units can be looked up
+// with Unit, and are converted for every sink wrapped in a UnitSink.
+func (m *Metrics) RegisterUnit(key []string, unit string) {
+	flat := strings.Join(key, ".")
+	if prev, ok := m.units.Load(flat); ok && prev.(string) == unit {
+		return
+	}
+	m.units.Store(flat, unit)
+	if !m.trackUnits {
+		return
+	}
+	tracker := m.sink.(unitTracker)
+	for _, k := range m.emittedKeys(key) {
+		tracker.setUnit(strings.Join(k, "."), unit)
+	}
+}
+
+// timerGranularity returns TimerGranularity, defaulting to milliseconds
+// like DefaultConfig.
+func (m *Metrics) timerGranularity() time.Duration {
+	if m.TimerGranularity <= 0 {
+		return time.Millisecond
+	}
+	return m.TimerGranularity
+}
+
+// emittedKeys returns the keys sinks receive for a key, with the renames and
+// prefixes applied by the emission methods. Without knowing the type of the
+// metric, every type prefix is included when type prefixes are enabled.
+func (m *Metrics) emittedKeys(key []string) [][]string {
+	keys := [][]string{key}
+	if r, ok := m.renames[strings.Join(key, ".")]; ok {
+		keys = [][]string{r.New, r.Old}
+	}
+	if m.HostName != "" && m.EnableHostname && !m.EnableHostnameLabel {
+		// Only gauges are prefixed with the host name
+		for _, k := range keys {
+			keys = append(keys, insert(0, m.HostName, k))
+		}
+	}
+	if m.EnableTypePrefix {
+		var prefixed [][]string
+		for _, typ := range []string{"gauge", "counter", "sample", "timer", "kv"} {
+			for _, k := range keys {
+				prefixed = append(prefixed, insert(0, typ, k))
+			}
+		}
+		keys = prefixed
+	}
+	if m.ServiceName != "" {
+		prefixed := make([][]string, 0, 2*len(keys))
+		for _, k := range keys {
+			prefixed = append(prefixed, insert(0, m.ServiceName, k))
+		}
+		if m.EnableServiceLabel {
+			// Only key/value pairs are prefixed with service labels
+			prefixed = append(prefixed, keys...)
+		}
+		keys = prefixed
+	}
+	return keys
+}
+
+// Unit returns the unit of the values emitted for key, as recorded by one of
+// the typed helpers such as AddSampleDuration or by RegisterUnit, so
+// exporters and dashboards can label values consistently. It returns false
+// if no unit is known.
+func (m *Metrics) Unit(key []string) (string, bool) {
+	unit, ok := m.units.Load(strings.Join(key, "."))
+	if !ok {
+		return "", false
+	}
+	return unit.(string), true
+}
+
+// durationUnit names the unit of durations measured in multiples of
+// granularity.
+func durationUnit(granularity time.Duration) string {
+	switch granularity {
+	case time.Nanosecond:
+		return "nanoseconds"
+	case time.Microsecond:
+		return "microseconds"
+	case time.Millisecond:
+		return "milliseconds"
+	case time.Second:
+		return "seconds"
+	case time.Minute:
+		return "minutes"
+	case time.Hour:
+		return "hours"
+	default:
+		return granularity.String()
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetrics_AddSampleDuration(t *testing.T) {
+	m, met := mockMetric()
+	met.AddSampleDuration([]string{"req", "time"}, 1500*time.Microsecond)
+	if !reflect.DeepEqual(m.vals, []float32{1.5}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	if unit, ok := met.Unit([]string{"req", "time"}); !ok || unit != "milliseconds" {
+		t.Fatalf("bad unit: %q %v", unit, ok)
+	}
+
+	m, met = mockMetric()
+	met.TimerGranularity = time.Second
+	met.AddSampleDurationWithLabels([]string{"req", "time"}, 3*time.Second, []Label{{"a", "b"}})
+	if m.vals[0] != 3 || m.labels[0][0] != (Label{"a", "b"}) {
+		t.Fatalf("bad sample: %v %v", m.vals, m.labels)
+	}
+	if unit, _ := met.Unit([]string{"req", "time"}); unit != "seconds" {
+		t.Fatalf("bad unit: %q", unit)
+	}
+}
+
+func TestMetrics_AddSampleBytes(t *testing.T) {
+	m, met := mockMetric()
+	met.AddSampleBytes([]string{"resp", "size"}, 4096)
+	if !reflect.DeepEqual(m.vals, []float32{4096}) {
+		t.Fatalf("bad vals: %v", m.vals)
+	}
+	if unit, ok := met.Unit([]string{"resp", "size"}); !ok || unit != UnitBytes {
+		t.Fatalf("bad unit: %q %v", unit, ok)
+	}
+	if _, ok := met.Unit([]string{"unknown"}); ok {
+		t.Fatalf("expected no unit")
+	}
+}
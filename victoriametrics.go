@@ -0,0 +1,310 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// vmFlushInterval is used when VMOpts.FlushInterval is not set
+	vmFlushInterval = 10 * time.Second
+
+	// vmImportPath is the Prometheus text import endpoint of VictoriaMetrics
+	vmImportPath = "/api/v1/import/prometheus"
+)
+
+// VMOpts is used to configure a VMSink.
+type VMOpts struct {
+	// Address is the base URL of VictoriaMetrics, or of vminsert including
+	// the tenant path, for example "http://victoriametrics:8428"
+	Address string
+
+	// Username and Password enable basic auth
+	Username string
+	Password string
+
+	// ExtraLabels are added to every series by VictoriaMetrics
+	ExtraLabels map[string]string
+
+	// FlushInterval is how often metrics are pushed, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// HTTPClient is used for pushes, it defaults to a client with a 10
+	// second timeout
+	HTTPClient *http.Client
+
+	// Compression configures the compression of pushes, which are gzip
+	// compressed by default
+	Compression HTTPCompression
+
+	// RetryPolicy applies to failed pushes, it defaults to
+	// DefaultRetryPolicy. Retries never run past the next flush.
+	RetryPolicy *RetryPolicy
+}
+
+// VMSink provides a MetricSink that pushes the Prometheus text exposition
+// format to the import endpoint of VictoriaMetrics. Metrics are aggregated in
+// memory and pushed on every flush interval.
+//
+// Gauges and key/value pairs report their last value. Counters are sent as
+// cumulative _total series and samples as cumulative _count and _sum series,
+// as with the M3Sink.
+type VMSink struct {
+	url     string
+	headers http.Header
+	client  *http.Client
+	encoder *HTTPEncoder
+	retry   RetryPolicy
+
+	agg        *intervalAggregator
+	cumulative *cumulativeSeries
+	loop       *flushLoop
+}
+
+// NewVMSink creates a VMSink and starts its flush loop.
+func NewVMSink(opts VMOpts) (*VMSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("victoriametrics address is required")
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = vmFlushInterval
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	retry := DefaultRetryPolicy
+	if opts.RetryPolicy != nil {
+		retry = *opts.RetryPolicy
+	}
+	encoder, err := NewHTTPEncoder(opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	u := strings.TrimSuffix(opts.Address, "/") + vmImportPath
+	if len(opts.ExtraLabels) > 0 {
+		names := make([]string, 0, len(opts.ExtraLabels))
+		for name := range opts.ExtraLabels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		params := url.Values{}
+		for _, name := range names {
+			params.Add("extra_label", name+"="+opts.ExtraLabels[name])
+		}
+		u += "?" + params.Encode()
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "text/plain; version=0.0.4")
+	if opts.Username != "" || opts.Password != "" {
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(opts.Username, opts.Password)
+		headers.Set("Authorization", req.Header.Get("Authorization"))
+	}
+
+	s := &VMSink{
+		url:        u,
+		headers:    headers,
+		client:     client,
+		encoder:    encoder,
+		retry:      retry,
+		loop:       newFlushLoop(interval),
+		agg:        newIntervalAggregator(),
+		cumulative: newCumulativeSeries(),
+	}
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *VMSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *VMSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *VMSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *VMSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *VMSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *VMSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *VMSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+// RestoreCounters seeds the cumulative totals from a counter checkpoint, see
+// CumulativeSink.
+func (s *VMSink) RestoreCounters(start time.Time, counters []RestoredCounter) {
+	s.agg.restore(counters)
+}
+
+func (s *VMSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *VMSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the VictoriaMetrics sink supports.
+func (s *VMSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// pushed.
+func (s *VMSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *VMSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *VMSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error pushing to VictoriaMetrics! Err: %s", err)
+	}
+}
+
+// flush pushes everything aggregated since the last flush. It is only called
+// from the flush loop, which owns the cumulative state.
+func (s *VMSink) flush(now time.Time) error {
+	aggs := s.agg.drain()
+	if len(aggs) == 0 {
+		return nil
+	}
+	series, meta := s.cumulative.convert(aggs)
+	body := encodePromText(series, meta, now.UnixMilli())
+
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+	return s.retry.Do(ctx, "VictoriaMetrics", func() error {
+		resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, s.headers)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		return CheckHTTPResponse(resp)
+	})
+}
+
+// promTextTypes names the remote write metric types in the text format
+var promTextTypes = map[int]string{
+	remoteWriteCounter: "counter",
+	remoteWriteGauge:   "gauge",
+	remoteWriteSummary: "summary",
+}
+
+// promNoTimestamp makes encodePromText leave out the timestamps, which the
+// Pushgateway rejects
+const promNoTimestamp = math.MinInt64
+
+// encodePromText renders series in the Prometheus text exposition format,
+// grouped into families with a TYPE line each.
+func encodePromText(series []remoteWriteSeries, meta []remoteWriteMetadata, timestampMs int64) []byte {
+	types := make(map[string]int, len(meta))
+	for _, m := range meta {
+		types[m.name] = m.typ
+	}
+
+	// Group the series of each family, keeping their order within it
+	families := make(map[string][]remoteWriteSeries)
+	var names []string
+	for _, s := range series {
+		name, _ := splitPromName(s.labels)
+		family := name
+		if _, ok := types[name]; !ok {
+			family = strings.TrimSuffix(strings.TrimSuffix(name, "_count"), "_sum")
+		}
+		if _, ok := families[family]; !ok {
+			names = append(names, family)
+		}
+		families[family] = append(families[family], s)
+	}
+	sort.Strings(names)
+
+	ts := strconv.FormatInt(timestampMs, 10)
+	var buf bytes.Buffer
+	for _, family := range names {
+		if typ, ok := promTextTypes[types[family]]; ok {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", family, typ)
+		}
+		for _, s := range families[family] {
+			writePromSeries(&buf, s)
+			if timestampMs != promNoTimestamp {
+				buf.WriteByte(' ')
+				buf.WriteString(ts)
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// writePromSeries writes the name, labels and value of a series, which are
+// the same in the Prometheus and OpenMetrics text formats.
+func writePromSeries(buf *bytes.Buffer, s remoteWriteSeries) {
+	name, labels := splitPromName(s.labels)
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(l.Name)
+			buf.WriteString(`="`)
+			buf.WriteString(promTextEscaper.Replace(l.Value))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+}
+
+// splitPromName separates the __name__ label from the other labels of a
+// series.
+func splitPromName(labels []Label) (string, []Label) {
+	for i, l := range labels {
+		if l.Name == "__name__" {
+			rest := make([]Label, 0, len(labels)-1)
+			rest = append(rest, labels[:i]...)
+			return l.Value, append(rest, labels[i+1:]...)
+		}
+	}
+	return "", labels
+}
+
+// promTextEscaper escapes label values in the text format
+var promTextEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVMSink(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if r.URL.Path != vmImportPath || !ok || user != "vm" || pass != "secret" {
+			t.Errorf("bad request: %s %v", r.URL, r.Header)
+		}
+		if got := r.URL.Query()["extra_label"]; len(got) != 2 || got[0] != "env=prod" || got[1] != "job=api" {
+			t.Errorf("bad extra labels %v", got)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s, err := NewVMSink(VMOpts{
+		Address:       srv.URL + "/",
+		Username:      "vm",
+		Password:      "secret",
+		ExtraLabels:   map[string]string{"job": "api", "env": "prod"},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"Code", "200"}, {"path", `a"b`}})
+	s.SetGauge([]string{"queue", "depth"}, 4)
+	s.AddSample([]string{"latency"}, 10)
+	if err := s.flush(time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"Code", "200"}, {"path", `a"b`}})
+	if err := s.flush(time.Unix(1700000010, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	// Nothing is pushed for empty intervals
+	if err := s.flush(time.Unix(1700000020, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	expected := []string{
+		"# TYPE latency summary\n" +
+			"latency_count 1 1700000000000\n" +
+			"latency_sum 10 1700000000000\n" +
+			"# TYPE queue_depth gauge\n" +
+			"queue_depth 4 1700000000000\n" +
+			"# TYPE requests_total counter\n" +
+			`requests_total{Code="200",path="a\"b"} 2 1700000000000` + "\n",
+		"# TYPE requests_total counter\n" +
+			`requests_total{Code="200",path="a\"b"} 5 1700000010000` + "\n",
+	}
+	if len(bodies) != len(expected) {
+		t.Fatalf("bad pushes %q", bodies)
+	}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Fatalf("got\n%s\nwant\n%s", bodies[i], expected[i])
+		}
+	}
+}
+
+func TestNewVMSink_Errors(t *testing.T) {
+	if _, err := NewVMSink(VMOpts{}); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// wavefrontFlushInterval is used when WavefrontOpts.FlushInterval is not
+	// set
+	wavefrontFlushInterval = 10 * time.Second
+
+	// wavefrontBatchSize is used when WavefrontOpts.BatchSize is not set
+	wavefrontBatchSize = 10000
+
+	// wavefrontProxyPort is the metrics port of a Wavefront proxy, used when
+	// an address has no port
+	wavefrontProxyPort = "2878"
+
+	// wavefrontDeltaPrefix marks delta counters, which Wavefront sums on
+	// ingestion
+	wavefrontDeltaPrefix = "∆"
+
+	// wavefrontMaxTagLength is the limit on the combined length of a point
+	// tag key and value
+	wavefrontMaxTagLength = 254
+)
+
+// WavefrontOpts is used to configure a WavefrontSink. Exactly one of
+// ProxyAddr and Server must be set.
+type WavefrontOpts struct {
+	// ProxyAddr is the address of a Wavefront proxy, with port 2878 by
+	// default
+	ProxyAddr string
+
+	// Server is the base URL of a Wavefront cluster for direct ingestion,
+	// for example "https://example.wavefront.com", authenticated with Token
+	Server string
+	Token  string
+
+	// Source identifies the reporting host, it defaults to the hostname
+	Source string
+
+	// Prefix is prepended to every metric name, separated with a '.'
+	Prefix string
+
+	// PointTags are added to every point
+	PointTags map[string]string
+
+	// DeltaCounters sends counters as delta counters holding the change
+	// over each interval, which Wavefront sums across sources. Otherwise
+	// counters report their running total since the sink was created.
+	DeltaCounters bool
+
+	// FlushInterval is how often metrics are sent, it defaults to 10
+	// seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the maximum number of points per write, it defaults to
+	// 10000
+	BatchSize int
+
+	// HTTPClient, Compression and RetryPolicy apply to direct ingestion.
+	// Writes are gzip compressed and retried with DefaultRetryPolicy by
+	// default.
+	HTTPClient  *http.Client
+	Compression HTTPCompression
+	RetryPolicy *RetryPolicy
+}
+
+// WavefrontSink provides a MetricSink that sends the Wavefront data format
+// to a Wavefront proxy over TCP, or directly to the ingestion API:
+//
+//	"api.requests" 5 1700000000 source="web-1" "code"="200"
+//
+// Metrics are aggregated in memory and sent on every flush interval. The
+// key, joined with '.', becomes the metric name and labels become point
+// tags. Gauges and key/value pairs report their last value, counters their
+// running total or, as delta counters, their change, and samples are sent
+// as .count, .mean, .min and .max metrics.
+type WavefrontSink struct {
+	source    string
+	prefix    string
+	pointTags []Label
+	delta     bool
+	batchSize int
+
+	// Proxy transport, only used from the flush loop
+	addr string
+	dial Dialer
+	conn net.Conn
+
+	// Direct ingestion transport
+	url     string
+	headers http.Header
+	client  *http.Client
+	encoder *HTTPEncoder
+	retry   RetryPolicy
+
+	// totals holds the running totals of counters, only used from the flush
+	// loop
+	totals map[string]float64
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// NewWavefrontSink creates a WavefrontSink and starts its flush loop.
+func NewWavefrontSink(opts WavefrontOpts) (*WavefrontSink, error) {
+	if (opts.ProxyAddr == "") == (opts.Server == "") {
+		return nil, fmt.Errorf("exactly one of a wavefront proxy address and server is required")
+	}
+	source := opts.Source
+	if source == "" {
+		source, _ = os.Hostname()
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = wavefrontFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = wavefrontBatchSize
+	}
+
+	var pointTags []Label
+	for name, value := range opts.PointTags {
+		pointTags = append(pointTags, Label{Name: name, Value: value})
+	}
+	sort.Slice(pointTags, func(i, j int) bool { return pointTags[i].Name < pointTags[j].Name })
+
+	s := &WavefrontSink{
+		source:    source,
+		prefix:    opts.Prefix,
+		pointTags: pointTags,
+		delta:     opts.DeltaCounters,
+		batchSize: batchSize,
+		loop:      newFlushLoop(interval),
+		totals:    make(map[string]float64),
+		agg:       newIntervalAggregator(),
+	}
+
+	if opts.ProxyAddr != "" {
+		s.addr = opts.ProxyAddr
+		if _, _, err := net.SplitHostPort(s.addr); err != nil {
+			s.addr = net.JoinHostPort(s.addr, wavefrontProxyPort)
+		}
+		s.dial = net.Dial
+	} else {
+		encoder, err := NewHTTPEncoder(opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		s.encoder = encoder
+		s.url = strings.TrimSuffix(opts.Server, "/") + "/report?f=wavefront"
+		s.headers = make(http.Header)
+		s.headers.Set("Content-Type", "application/octet-stream")
+		if opts.Token != "" {
+			s.headers.Set("Authorization", "Bearer "+opts.Token)
+		}
+		s.client = opts.HTTPClient
+		if s.client == nil {
+			s.client = &http.Client{Timeout: 10 * time.Second}
+		}
+		s.retry = DefaultRetryPolicy
+		if opts.RetryPolicy != nil {
+			s.retry = *opts.RetryPolicy
+		}
+	}
+
+	s.loop.start(s.flushLoop)
+	return s, nil
+}
+
+func (s *WavefrontSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *WavefrontSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *WavefrontSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *WavefrontSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *WavefrontSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *WavefrontSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *WavefrontSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *WavefrontSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *WavefrontSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Wavefront sink supports.
+func (s *WavefrontSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// sent.
+func (s *WavefrontSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *WavefrontSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *WavefrontSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error sending to Wavefront! Err: %s", err)
+	}
+	if final && s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+// flush sends everything aggregated since the last flush in batches. It is
+// only called from the flush loop.
+func (s *WavefrontSink) flush(now time.Time) error {
+	lines := s.lines(s.agg.drain(), now.Unix())
+	ctx, cancel := context.WithDeadline(context.Background(), s.loop.retryDeadline(now))
+	defer cancel()
+
+	var buf bytes.Buffer
+	for len(lines) > 0 {
+		n := min(len(lines), s.batchSize)
+		buf.Reset()
+		for _, line := range lines[:n] {
+			buf.WriteString(line)
+		}
+		var err error
+		if s.addr != "" {
+			err = s.writeProxy(buf.Bytes())
+		} else {
+			body := buf.Bytes()
+			err = s.retry.Do(ctx, "Wavefront", func() error {
+				resp, err := s.encoder.Do(s.client, http.MethodPost, s.url, body, s.headers)
+				if err != nil {
+					return err
+				}
+				defer func() { _ = resp.Body.Close() }()
+				return CheckHTTPResponse(resp)
+			})
+		}
+		if err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+// writeProxy writes to the proxy, reconnecting on the next flush after a
+// failure.
+func (s *WavefrontSink) writeProxy(b []byte) error {
+	if s.conn == nil {
+		conn, err := s.dial("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// lines converts aggregates into lines of the Wavefront data format.
+func (s *WavefrontSink) lines(aggs []*aggregate, ts int64) []string {
+	var out []string
+	for _, a := range aggs {
+		name := strings.Join(a.key, ".")
+		if s.prefix != "" {
+			name = s.prefix + "." + name
+		}
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			out = append(out, s.line(name, a.last, ts, a.labels))
+		case aggregateCounter:
+			if s.delta {
+				out = append(out, s.line(wavefrontDeltaPrefix+name, a.sum, ts, a.labels))
+				continue
+			}
+			id := seriesKey(a.key, a.labels)
+			s.totals[id] += a.sum
+			out = append(out, s.line(name, s.totals[id], ts, a.labels))
+		case aggregateSample:
+			out = append(out,
+				s.line(name+".count", float64(a.count), ts, a.labels),
+				s.line(name+".mean", a.mean(), ts, a.labels),
+				s.line(name+".min", a.min, ts, a.labels),
+				s.line(name+".max", a.max, ts, a.labels),
+			)
+		}
+	}
+	return out
+}
+
+// line formats a single point, with the global point tags overridden by
+// labels of the same name.
+func (s *WavefrontSink) line(name string, val float64, ts int64, labels []Label) string {
+	var b strings.Builder
+	b.WriteString(wavefrontQuote(wavefrontMetricName(name)))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(val, 'f', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(ts, 10))
+	b.WriteString(" source=")
+	b.WriteString(wavefrontQuote(s.source))
+
+	tags := make([]Label, 0, len(s.pointTags)+len(labels))
+	for _, t := range s.pointTags {
+		if !hasLabel(labels, t.Name) {
+			tags = append(tags, t)
+		}
+	}
+	tags = append(tags, labels...)
+	for _, t := range tags {
+		key := wavefrontTagKey(t.Name)
+		if key == "" || t.Value == "" || len(key)+len(t.Value) > wavefrontMaxTagLength {
+			// Wavefront rejects points with empty or oversized tags
+			continue
+		}
+		b.WriteByte(' ')
+		b.WriteString(wavefrontQuote(key))
+		b.WriteByte('=')
+		b.WriteString(wavefrontQuote(t.Value))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func hasLabel(labels []Label, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// wavefrontMetricName replaces characters which are not allowed in metric
+// names, keeping a leading delta counter marker.
+func wavefrontMetricName(name string) string {
+	marker := ""
+	if strings.HasPrefix(name, wavefrontDeltaPrefix) {
+		marker, name = wavefrontDeltaPrefix, strings.TrimPrefix(name, wavefrontDeltaPrefix)
+	}
+	return marker + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/', r == ',', r == '~':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// wavefrontTagKey replaces characters which are not allowed in point tag
+// keys.
+func wavefrontTagKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+// wavefrontQuoter escapes quotes and removes line breaks from quoted values
+var wavefrontQuoter = strings.NewReplacer(`"`, `\"`, "\n", " ", "\r", " ")
+
+func wavefrontQuote(s string) string {
+	return `"` + wavefrontQuoter.Replace(s) + `"`
+}
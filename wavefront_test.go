@@ -0,0 +1,133 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWavefrontSink_Proxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	s, err := NewWavefrontSink(WavefrontOpts{
+		ProxyAddr:     ln.Addr().String(),
+		Source:        "web-1",
+		Prefix:        "app",
+		PointTags:     map[string]string{"env": "prod", "code": "none"},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 2, []Label{{"code", "200"}})
+	s.AddSample([]string{"latency"}, 10)
+	if err := s.flush(time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	s.IncrCounterWithLabels([]string{"requests"}, 3, []Label{{"code", "200"}})
+	if err := s.flush(time.Unix(1700000010, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+
+	expected := `"app.requests" 2 1700000000 source="web-1" "env"="prod" "code"="200"` + "\n" +
+		`"app.latency.count" 1 1700000000 source="web-1" "code"="none" "env"="prod"` + "\n" +
+		`"app.latency.mean" 10 1700000000 source="web-1" "code"="none" "env"="prod"` + "\n" +
+		`"app.latency.min" 10 1700000000 source="web-1" "code"="none" "env"="prod"` + "\n" +
+		`"app.latency.max" 10 1700000000 source="web-1" "code"="none" "env"="prod"` + "\n" +
+		`"app.requests" 5 1700000010 source="web-1" "env"="prod" "code"="200"` + "\n"
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if string(buf) != expected {
+		t.Fatalf("got\n%s\nwant\n%s", buf, expected)
+	}
+}
+
+func TestWavefrontSink_Direct(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/report" || r.URL.Query().Get("f") != "wavefront" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("bad request: %s %v", r.URL, r.Header)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("bad body: %s", err)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	s, err := NewWavefrontSink(WavefrontOpts{
+		Server:        srv.URL + "/",
+		Token:         "secret",
+		Source:        "web-1",
+		DeltaCounters: true,
+		BatchSize:     1,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounter([]string{"requests"}, 2)
+	s.IncrCounter([]string{"requests"}, 3)
+	s.SetGaugeWithLabels([]string{"queue depth"}, 4, []Label{{"host name", `a"b`}, {"empty", ""}})
+	if err := s.flush(time.Unix(1700000000, 0)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected one request per point, got %d", len(bodies))
+	}
+	if expected := `"∆requests" 5 1700000000 source="web-1"` + "\n"; bodies[0] != expected {
+		t.Fatalf("bad delta counter %q", bodies[0])
+	}
+	if expected := `"queue_depth" 4 1700000000 source="web-1" "host_name"="a\"b"` + "\n"; bodies[1] != expected {
+		t.Fatalf("bad gauge %q", bodies[1])
+	}
+}
+
+func TestNewWavefrontSink_Errors(t *testing.T) {
+	for _, opts := range []WavefrontOpts{
+		{},
+		{ProxyAddr: "proxy", Server: "https://example.wavefront.com"},
+	} {
+		if _, err := NewWavefrontSink(opts); err == nil || !strings.Contains(err.Error(), "exactly one") {
+			t.Fatalf("expected error, got %v", err)
+		}
+	}
+
+	s, err := NewWavefrontSink(WavefrontOpts{ProxyAddr: "proxy"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.addr != "proxy:2878" {
+		t.Fatalf("bad addr %s", s.addr)
+	}
+}
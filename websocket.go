@@ -0,0 +1,473 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// WebsocketStreamPath is the conventional path of the WebsocketSink
+	// handler
+	WebsocketStreamPath = "/metrics/stream"
+
+	// websocketBufferSize is used when WebsocketOpts.BufferSize is not set
+	websocketBufferSize = 1024
+
+	// websocketPingInterval is how often idle clients are pinged, so dead
+	// connections are noticed
+	websocketPingInterval = 30 * time.Second
+
+	// websocketWriteTimeout bounds every write to a client
+	websocketWriteTimeout = 10 * time.Second
+
+	// websocketMaxRead is the largest frame accepted from a client, which
+	// has nothing to send but control frames
+	websocketMaxRead = 4096
+
+	// websocketGUID is appended to the key of the opening handshake
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocket frame opcodes
+const (
+	websocketOpText  = 0x1
+	websocketOpClose = 0x8
+	websocketOpPing  = 0x9
+	websocketOpPong  = 0xA
+)
+
+// WebSocket close status codes
+const (
+	websocketCloseNormal    = 1000
+	websocketCloseGoingAway = 1001
+	websocketCloseProtocol  = 1002
+	websocketCloseTooBig    = 1009
+)
+
+// WebsocketOpts is used to configure a WebsocketSink.
+type WebsocketOpts struct {
+	// BufferSize is the number of events buffered for every client, beyond
+	// which events are dropped for that client and counted in Dropped. It
+	// defaults to 1024.
+	BufferSize int
+
+	// AllowedOrigins are the origins, such as "http://localhost:3000",
+	// whose pages may connect. By default only pages served from the same
+	// host as the handler may, while "*" allows any origin. Clients which
+	// are not browsers send no origin and are always allowed.
+	AllowedOrigins []string
+}
+
+// WebsocketSink provides a MetricSink which streams every metric as a JSON
+// event, in the format of KafkaJSON, to the WebSocket clients connected to
+// it, such as a live dashboard in a browser during development. The sink is
+// an http.Handler accepting the connections, usually mounted at
+// WebsocketStreamPath:
+//
+//	sink := metrics.NewWebsocketSink(metrics.WebsocketOpts{})
+//	http.Handle(metrics.WebsocketStreamPath, sink)
+//
+// and read from a page with:
+//
+//	new WebSocket("ws://localhost:8080/metrics/stream").onmessage =
+//	    (msg) => console.log(JSON.parse(msg.data))
+//
+// Every event is sent in its own text message. Metrics emitted while no
+// client is connected are discarded, and a client which cannot keep up has
+// events dropped rather than slowing down the caller.
+type WebsocketSink struct {
+	bufferSize int
+	origins    []string
+
+	lock    sync.Mutex
+	clients map[*websocketClient]struct{}
+	closed  bool
+	dropped uint64
+}
+
+// websocketClient is a connected client, whose events are written by the
+// goroutine serving its request
+type websocketClient struct {
+	conn      net.Conn
+	events    chan []byte
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	doneCh    chan struct{}
+}
+
+// NewWebsocketSink creates a WebsocketSink.
+func NewWebsocketSink(opts WebsocketOpts) *WebsocketSink {
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = websocketBufferSize
+	}
+	return &WebsocketSink{
+		bufferSize: bufferSize,
+		origins:    opts.AllowedOrigins,
+		clients:    make(map[*websocketClient]struct{}),
+	}
+}
+
+func (s *WebsocketSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *WebsocketSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.emit("gauge", key, float64(val), labels)
+}
+
+func (s *WebsocketSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *WebsocketSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.emit("gauge", key, val, labels)
+}
+
+func (s *WebsocketSink) EmitKey(key []string, val float32) {
+	s.emit("key", key, float64(val), nil)
+}
+
+func (s *WebsocketSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *WebsocketSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.emit("counter", key, float64(val), labels)
+}
+
+func (s *WebsocketSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *WebsocketSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.emit("sample", key, float64(val), labels)
+}
+
+// Capabilities reports what the WebSocket sink supports.
+func (s *WebsocketSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Clients returns the number of connected clients.
+func (s *WebsocketSink) Clients() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.clients)
+}
+
+// Dropped returns the number of events dropped so far because a client was
+// not keeping up, counted once for every client missing the event.
+func (s *WebsocketSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Shutdown disconnects every client and rejects new ones.
+func (s *WebsocketSink) Shutdown() {
+	s.lock.Lock()
+	s.closed = true
+	clients := make([]*websocketClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.lock.Unlock()
+
+	for _, c := range clients {
+		c.close(websocketCloseGoingAway)
+	}
+}
+
+// emit sends an event to every connected client, only encoding it when
+// someone is listening.
+func (s *WebsocketSink) emit(typ string, key []string, val float64, labels []Label) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.clients) == 0 {
+		return
+	}
+
+	msg := newMetricEvent(typ, key, val, labels).marshalJSON()
+	for c := range s.clients {
+		select {
+		case c.events <- msg:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and streams
+// events to it until either side closes it.
+func (s *WebsocketSink) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if !s.allowOrigin(req) {
+		http.Error(resp, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	accept, err := websocketAccept(req)
+	if err != nil {
+		if req.Header.Get("Sec-WebSocket-Version") != "13" {
+			resp.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(resp, err.Error(), http.StatusUpgradeRequired)
+			return
+		}
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(resp).Hijack()
+	if err != nil {
+		http.Error(resp, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	c := &websocketClient{
+		conn:   conn,
+		events: make(chan []byte, s.bufferSize),
+		doneCh: make(chan struct{}),
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		_, _ = rw.WriteString("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+		_ = rw.Flush()
+		_ = conn.Close()
+		return
+	}
+	s.clients[c] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.clients, c)
+		s.lock.Unlock()
+	}()
+
+	_ = conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		c.close(0)
+		return
+	}
+
+	go c.readLoop(rw.Reader)
+	c.writeLoop()
+}
+
+// allowOrigin checks the Origin header sent by browsers, so pages of other
+// sites cannot connect on behalf of a visitor.
+func (s *WebsocketSink) allowOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	if len(s.origins) > 0 {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// websocketAccept validates an opening handshake and returns the value of
+// its Sec-WebSocket-Accept header.
+func websocketAccept(req *http.Request) (string, error) {
+	if req.Method != http.MethodGet {
+		return "", fmt.Errorf("websocket handshake must use GET")
+	}
+	if !headerHasToken(req.Header, "Connection", "upgrade") || !headerHasToken(req.Header, "Upgrade", "websocket") {
+		return "", fmt.Errorf("not a websocket handshake")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", fmt.Errorf("unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", fmt.Errorf("bad Sec-WebSocket-Key")
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// headerHasToken reports whether a comma separated header contains token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeLoop writes queued events, and pings while idle, until the client
+// is closed.
+func (c *websocketClient) writeLoop() {
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case msg := <-c.events:
+			err = c.writeFrame(websocketOpText, msg)
+		case <-ping.C:
+			err = c.writeFrame(websocketOpPing, nil)
+		case <-c.doneCh:
+			return
+		}
+		if err != nil {
+			c.close(0)
+			return
+		}
+	}
+}
+
+// readLoop answers the control frames of the client until it closes the
+// connection. Anything else sent by the client is ignored.
+func (c *websocketClient) readLoop(r *bufio.Reader) {
+	for {
+		op, payload, err := readWebsocketFrame(r, true)
+		switch {
+		case errors.Is(err, errWebsocketTooBig):
+			c.close(websocketCloseTooBig)
+			return
+		case err != nil:
+			c.close(websocketCloseProtocol)
+			return
+		}
+		switch op {
+		case websocketOpClose:
+			c.close(websocketCloseNormal)
+			return
+		case websocketOpPing:
+			if c.writeFrame(websocketOpPong, payload) != nil {
+				c.close(0)
+				return
+			}
+		}
+	}
+}
+
+// close sends a close frame with the given status code, unless it is zero,
+// and closes the connection.
+func (c *websocketClient) close(code uint16) {
+	c.closeOnce.Do(func() {
+		if code != 0 {
+			_ = c.writeFrame(websocketOpClose, binary.BigEndian.AppendUint16(nil, code))
+		}
+		close(c.doneCh)
+		_ = c.conn.Close()
+	})
+}
+
+// writeFrame writes a single unfragmented, unmasked frame as servers do.
+func (c *websocketClient) writeFrame(op byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	_, err := c.conn.Write(appendWebsocketFrame(nil, op, payload, nil))
+	return err
+}
+
+// appendWebsocketFrame encodes a final frame, masked with mask unless it is
+// nil.
+func appendWebsocketFrame(buf []byte, op byte, payload []byte, mask []byte) []byte {
+	buf = append(buf, 0x80|op)
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if mask == nil {
+		return append(buf, payload...)
+	}
+	buf = append(buf, mask[:4]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i%4])
+	}
+	return buf
+}
+
+// errWebsocketTooBig is returned for frames larger than websocketMaxRead
+var errWebsocketTooBig = errors.New("websocket frame too big")
+
+// readWebsocketFrame reads a frame and unmasks its payload. Frames sent by
+// clients must be masked, which requireMask enforces.
+func readWebsocketFrame(r io.Reader, requireMask bool) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	if requireMask && !masked {
+		return 0, nil, fmt.Errorf("unmasked websocket frame")
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > websocketMaxRead {
+		return 0, nil, errWebsocketTooBig
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
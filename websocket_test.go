@@ -0,0 +1,206 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialWebsocket opens a WebSocket connection to srv with a raw client.
+func dialWebsocket(t *testing.T, srv *httptest.Server, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+WebsocketStreamPath, nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	return conn, r, resp
+}
+
+func waitWebsocketClients(t *testing.T, s *WebsocketSink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Clients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d clients, got %d", n, s.Clients())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebsocketSink(t *testing.T) {
+	s := NewWebsocketSink(WebsocketOpts{})
+	defer s.Shutdown()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// Nothing is encoded while nobody listens
+	s.IncrCounter([]string{"ignored"}, 1)
+
+	conn, r, resp := dialWebsocket(t, srv, nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("bad status %d", resp.StatusCode)
+	}
+	// The example handshake of RFC 6455
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad accept %q", got)
+	}
+	waitWebsocketClients(t, s, 1)
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 1, []Label{{"code", "200"}})
+	op, payload, err := readWebsocketFrame(r, false)
+	if err != nil || op != websocketOpText {
+		t.Fatalf("bad frame %d %v", op, err)
+	}
+	var event struct {
+		Name   string            `json:"name"`
+		Type   string            `json:"type"`
+		Value  float64           `json:"value"`
+		Labels map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if event.Name != "api.requests" || event.Type != "counter" || event.Value != 1 || event.Labels["code"] != "200" {
+		t.Fatalf("bad event %s", payload)
+	}
+
+	// Pings are answered, with a masked frame as clients send them
+	mask := []byte{1, 2, 3, 4}
+	if _, err := conn.Write(appendWebsocketFrame(nil, websocketOpPing, []byte("hi"), mask)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	op, payload, err = readWebsocketFrame(r, false)
+	if err != nil || op != websocketOpPong || string(payload) != "hi" {
+		t.Fatalf("bad pong %d %q %v", op, payload, err)
+	}
+
+	// Closing by the client is acknowledged
+	if _, err := conn.Write(appendWebsocketFrame(nil, websocketOpClose, nil, mask)); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	op, payload, err = readWebsocketFrame(r, false)
+	if err != nil || op != websocketOpClose || binary.BigEndian.Uint16(payload) != websocketCloseNormal {
+		t.Fatalf("bad close %d %x %v", op, payload, err)
+	}
+	waitWebsocketClients(t, s, 0)
+}
+
+func TestWebsocketSink_Shutdown(t *testing.T) {
+	s := NewWebsocketSink(WebsocketOpts{})
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	_, r, _ := dialWebsocket(t, srv, nil)
+	waitWebsocketClients(t, s, 1)
+	s.Shutdown()
+	op, payload, err := readWebsocketFrame(r, false)
+	if err != nil || op != websocketOpClose || binary.BigEndian.Uint16(payload) != websocketCloseGoingAway {
+		t.Fatalf("bad close %d %x %v", op, payload, err)
+	}
+
+	if _, _, resp := dialWebsocket(t, srv, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected new clients to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebsocketSink_Dropped(t *testing.T) {
+	s := NewWebsocketSink(WebsocketOpts{BufferSize: 1})
+	defer s.Shutdown()
+
+	// A client whose writer is not running keeps its buffer full
+	c := &websocketClient{events: make(chan []byte, 1), doneCh: make(chan struct{})}
+	s.clients[c] = struct{}{}
+	s.SetGauge([]string{"a"}, 1)
+	s.SetGauge([]string{"a"}, 2)
+	s.SetGauge([]string{"a"}, 3)
+	if s.Dropped() != 2 {
+		t.Fatalf("bad dropped %d", s.Dropped())
+	}
+	delete(s.clients, c)
+}
+
+func TestWebsocketSink_Handshake(t *testing.T) {
+	s := NewWebsocketSink(WebsocketOpts{AllowedOrigins: []string{"http://localhost:3000"}})
+	defer s.Shutdown()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		desc   string
+		header http.Header
+		status int
+	}{
+		{"allowed origin", http.Header{"Origin": {"http://localhost:3000"}}, http.StatusSwitchingProtocols},
+		{"other origin", http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden},
+		{"old version", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusUpgradeRequired},
+		{"bad key", http.Header{"Sec-Websocket-Key": {"short"}}, http.StatusBadRequest},
+		{"no upgrade", http.Header{"Upgrade": {"h2c"}}, http.StatusBadRequest},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, _, resp := dialWebsocket(t, srv, tc.header)
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+		})
+	}
+
+	// Without allowed origins, only the host of the handler is
+	req := httptest.NewRequest(http.MethodGet, "http://metrics.local/metrics/stream", nil)
+	req.Header.Set("Origin", "http://metrics.local")
+	if !NewWebsocketSink(WebsocketOpts{}).allowOrigin(req) {
+		t.Fatalf("expected the same origin to be allowed")
+	}
+	req.Header.Set("Origin", "http://evil.example")
+	if NewWebsocketSink(WebsocketOpts{}).allowOrigin(req) {
+		t.Fatalf("expected another origin to be rejected")
+	}
+}
+
+func TestWebsocketFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 4096} {
+		payload := bytes.Repeat([]byte("x"), n)
+		frame := appendWebsocketFrame(nil, websocketOpText, payload, []byte{9, 8, 7, 6})
+		op, got, err := readWebsocketFrame(bytes.NewReader(frame), true)
+		if err != nil || op != websocketOpText || !bytes.Equal(got, payload) {
+			t.Fatalf("bad frame of %d bytes: %v", n, err)
+		}
+	}
+
+	frame := appendWebsocketFrame(nil, websocketOpText, []byte("x"), nil)
+	if _, _, err := readWebsocketFrame(bytes.NewReader(frame), true); err == nil || !strings.Contains(err.Error(), "unmasked") {
+		t.Fatalf("expected unmasked frames to be rejected, got %v", err)
+	}
+	frame = appendWebsocketFrame(nil, websocketOpText, make([]byte, websocketMaxRead+1), []byte{1, 2, 3, 4})
+	if _, _, err := readWebsocketFrame(bytes.NewReader(frame), true); err != errWebsocketTooBig {
+		t.Fatalf("expected big frames to be rejected, got %v", err)
+	}
+}
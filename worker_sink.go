@@ -0,0 +1,216 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultWorkerQueueSize is used when a worker sink is created with a queue
+// size of zero
+const DefaultWorkerQueueSize = 4096
+
+// workerOpKind is the sink method a queued operation calls
+type workerOpKind int
+
+const (
+	workerGauge workerOpKind = iota
+	workerPrecisionGauge
+	workerEmitKey
+	workerEmitKeys
+	workerCounter
+	workerSample
+	workerHistogram
+	workerBarrier
+	workerStop
+)
+
+// workerOp is a sink call queued for a WorkerSink
+type workerOp struct {
+	kind   workerOpKind
+	key    []string
+	labels []Label
+	val    float64
+	vals   []float32
+	done   chan struct{}
+}
+
+// WorkerSink wraps a MetricSink and calls it from a dedicated goroutine, so
+// the time a sink spends flattening and encoding metrics is never added to
+// the instrumented call path. Calls are queued in order. When the queue is
+// full, because the sink cannot keep up, metrics are dropped rather than
+// blocking the caller, and counted in Dropped.
+type WorkerSink struct {
+	sink    MetricSink
+	queue   chan workerOp
+	dropped uint64
+
+	stopOnce sync.Once
+	doneCh   chan struct{}
+}
+
+// NewWorkerSink wraps sink with a worker goroutine fed by a queue holding up
+// to queueSize calls, or DefaultWorkerQueueSize if zero.
+func NewWorkerSink(sink MetricSink, queueSize int) *WorkerSink {
+	if queueSize <= 0 {
+		queueSize = DefaultWorkerQueueSize
+	}
+	w := &WorkerSink{
+		sink:   sink,
+		queue:  make(chan workerOp, queueSize),
+		doneCh: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// NewIsolatedFanoutSink creates a FanoutSink which gives every sink its own
+// WorkerSink, so an expensive encoder in one sink delays neither the caller
+// nor the other sinks.
+func NewIsolatedFanoutSink(queueSize int, sinks ...MetricSink) FanoutSink {
+	fh := make(FanoutSink, len(sinks))
+	for i, s := range sinks {
+		fh[i] = NewWorkerSink(s, queueSize)
+	}
+	return fh
+}
+
+func (w *WorkerSink) SetGauge(key []string, val float32) {
+	w.SetGaugeWithLabels(key, val, nil)
+}
+
+func (w *WorkerSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	w.enqueue(workerOp{kind: workerGauge, key: key, val: float64(val), labels: labels})
+}
+
+func (w *WorkerSink) SetPrecisionGauge(key []string, val float64) {
+	w.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (w *WorkerSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	w.enqueue(workerOp{kind: workerPrecisionGauge, key: key, val: val, labels: labels})
+}
+
+func (w *WorkerSink) EmitKey(key []string, val float32) {
+	w.enqueue(workerOp{kind: workerEmitKey, key: key, val: float64(val)})
+}
+
+func (w *WorkerSink) EmitKeys(key []string, vals []float32) {
+	w.enqueue(workerOp{kind: workerEmitKeys, key: key, vals: append([]float32(nil), vals...)})
+}
+
+func (w *WorkerSink) IncrCounter(key []string, val float32) {
+	w.IncrCounterWithLabels(key, val, nil)
+}
+
+func (w *WorkerSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	w.enqueue(workerOp{kind: workerCounter, key: key, val: float64(val), labels: labels})
+}
+
+func (w *WorkerSink) AddSample(key []string, val float32) {
+	w.AddSampleWithLabels(key, val, nil)
+}
+
+func (w *WorkerSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	w.enqueue(workerOp{kind: workerSample, key: key, val: float64(val), labels: labels})
+}
+
+func (w *WorkerSink) AddHistogram(key []string, val float64) {
+	w.AddHistogramWithLabels(key, val, nil)
+}
+
+func (w *WorkerSink) AddHistogramWithLabels(key []string, val float64, labels []Label) {
+	w.enqueue(workerOp{kind: workerHistogram, key: key, val: val, labels: labels})
+}
+
+// Capabilities reports the capabilities of the wrapped sink.
+func (w *WorkerSink) Capabilities() Capabilities {
+	return SinkCapabilities(w.sink)
+}
+
+// Ready forwards to the wrapped sink, which is considered ready if it does
+// not implement ReadySink.
+func (w *WorkerSink) Ready() <-chan struct{} {
+	if rs, ok := w.sink.(ReadySink); ok {
+		return rs.Ready()
+	}
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// Dropped returns the number of calls dropped because the queue was full.
+func (w *WorkerSink) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Flush blocks until every call queued so far has reached the wrapped sink,
+// then flushes it if it supports it.
+func (w *WorkerSink) Flush() {
+	done := make(chan struct{})
+	select {
+	case w.queue <- workerOp{kind: workerBarrier, done: done}:
+		<-done
+	case <-w.doneCh:
+	}
+	if fs, ok := w.sink.(FlushSink); ok {
+		fs.Flush()
+	}
+}
+
+// Shutdown stops the worker once the queued calls have reached the wrapped
+// sink, then shuts that down if it supports it. Later calls are dropped.
+func (w *WorkerSink) Shutdown() {
+	w.stopOnce.Do(func() {
+		w.queue <- workerOp{kind: workerStop}
+		<-w.doneCh
+		if ss, ok := w.sink.(ShutdownSink); ok {
+			ss.Shutdown()
+		}
+	})
+}
+
+// enqueue queues a call without ever blocking. The key and labels are
+// copied, as callers are free to reuse them once the call returns.
+func (w *WorkerSink) enqueue(op workerOp) {
+	op.key = append([]string(nil), op.key...)
+	if op.labels != nil {
+		op.labels = append([]Label(nil), op.labels...)
+	}
+	select {
+	case w.queue <- op:
+	default:
+		if atomic.AddUint64(&w.dropped, 1) == 1 {
+			log.Printf("[WARN] metrics: worker queue for %T is full, dropping metrics", w.sink)
+		}
+	}
+}
+
+func (w *WorkerSink) run() {
+	defer close(w.doneCh)
+	for op := range w.queue {
+		switch op.kind {
+		case workerGauge:
+			w.sink.SetGaugeWithLabels(op.key, float32(op.val), op.labels)
+		case workerPrecisionGauge:
+			setPrecisionGauge(w.sink, op.key, op.val, op.labels)
+		case workerEmitKey:
+			w.sink.EmitKey(op.key, float32(op.val))
+		case workerEmitKeys:
+			emitKeys(w.sink, op.key, op.vals)
+		case workerCounter:
+			w.sink.IncrCounterWithLabels(op.key, float32(op.val), op.labels)
+		case workerSample:
+			w.sink.AddSampleWithLabels(op.key, float32(op.val), op.labels)
+		case workerHistogram:
+			addHistogram(w.sink, op.key, op.val, op.labels)
+		case workerBarrier:
+			close(op.done)
+		case workerStop:
+			return
+		}
+	}
+}
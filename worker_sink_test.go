@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// gatedSink holds up every counter until released
+type gatedSink struct {
+	MockSink
+	release chan struct{}
+}
+
+func (b *gatedSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	<-b.release
+	b.MockSink.IncrCounterWithLabels(key, val, labels)
+}
+
+func TestWorkerSink(t *testing.T) {
+	m := &MockSink{}
+	w := NewWorkerSink(m, 0)
+
+	key := []string{"req"}
+	labels := []Label{{"code", "200"}}
+	w.IncrCounterWithLabels(key, 1, labels)
+	w.SetPrecisionGauge([]string{"p"}, 1.5)
+	w.EmitKeys([]string{"kv"}, []float32{1, 2})
+
+	// Reused inputs must not affect queued calls
+	key[0] = "changed"
+	labels[0].Value = "500"
+
+	w.Flush()
+	expected := [][]string{{"req"}, {"p"}, {"kv"}, {"kv"}}
+	if got := m.getKeys(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v want %v", got, expected)
+	}
+	if !reflect.DeepEqual(m.labels[0], []Label{{"code", "200"}}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+	if !reflect.DeepEqual(m.precisionVals, []float64{1.5}) {
+		t.Fatalf("bad precision values: %v", m.precisionVals)
+	}
+
+	w.Shutdown()
+	if !m.shutdown {
+		t.Fatalf("wrapped sink should be shut down")
+	}
+	w.Shutdown()
+}
+
+func TestWorkerSink_Drops(t *testing.T) {
+	b := &gatedSink{release: make(chan struct{})}
+	w := NewWorkerSink(b, 2)
+
+	// The first call is held by the worker, two more fill the queue
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		w.IncrCounter([]string{"req"}, 1)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("callers should never block")
+	}
+	if d := w.Dropped(); d < 7 {
+		t.Fatalf("expected dropped calls, got %d", d)
+	}
+
+	close(b.release)
+	w.Shutdown()
+	if n := len(b.getKeys()); uint64(n)+w.Dropped() != 10 {
+		t.Fatalf("expected every call delivered or dropped, got %d and %d", n, w.Dropped())
+	}
+}
+
+func TestNewIsolatedFanoutSink(t *testing.T) {
+	slow := &gatedSink{release: make(chan struct{})}
+	fast := &MockSink{}
+	fh := NewIsolatedFanoutSink(16, slow, fast)
+
+	fh.IncrCounter([]string{"req"}, 1)
+	fh[1].(*WorkerSink).Flush()
+	if len(fast.getKeys()) != 1 {
+		t.Fatalf("a slow sink should not hold up the others")
+	}
+	if len(slow.getKeys()) != 0 {
+		t.Fatalf("slow sink should still be blocked")
+	}
+
+	close(slow.release)
+	fh.Shutdown()
+	if len(slow.getKeys()) != 1 || !slow.shutdown || !fast.shutdown {
+		t.Fatalf("expected both sinks drained and shut down")
+	}
+	if !SinkCapabilities(fh).PrecisionFloats {
+		t.Fatalf("capabilities should pass through")
+	}
+}
@@ -0,0 +1,391 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// zabbixFlushInterval and zabbixBatchSize are used when the matching
+	// ZabbixOpts are not set. zabbix_sender also sends 250 values per
+	// request.
+	zabbixFlushInterval = 10 * time.Second
+	zabbixBatchSize     = 250
+
+	// zabbixPort is used when ZabbixOpts.Address has no port
+	zabbixPort = "10051"
+
+	// zabbixTimeout bounds connecting and every request
+	zabbixTimeout = 10 * time.Second
+
+	// zabbixMaxResponse bounds the size of a response read from the server
+	zabbixMaxResponse = 1 << 20
+
+	// zabbixDefaultKey formats the item key of a series, as in
+	// "api.requests[200,GET]"
+	zabbixDefaultKey = `{{.Name}}{{with .Params}}[{{.}}]{{end}}`
+)
+
+// zabbixHeader starts every message of the sender protocol, followed by the
+// protocol flags, the length of the data and four reserved bytes
+var zabbixHeader = []byte("ZBXD\x01")
+
+// zabbixFailed extracts the number of values the server failed to process
+var zabbixFailed = regexp.MustCompile(`failed: (\d+)`)
+
+// ZabbixOpts is used to configure a ZabbixSink.
+type ZabbixOpts struct {
+	// Address is the Zabbix server or proxy, the port defaults to 10051
+	Address string
+
+	// Host is the name of the host the trapper items belong to, as
+	// configured in Zabbix
+	Host string
+
+	// KeyTemplate is a text/template producing the item key of a series. It
+	// is executed with a ZabbixKey and defaults to
+	// "{{.Name}}{{with .Params}}[{{.}}]{{end}}", which turns labels into
+	// key parameters, as in "api.requests[200,GET]".
+	KeyTemplate string
+
+	// FlushInterval is how often values are sent, it defaults to 10 seconds
+	FlushInterval time.Duration
+
+	// BatchSize is the number of values per request, it defaults to 250
+	BatchSize int
+}
+
+// ZabbixKey is the data of a ZabbixOpts.KeyTemplate.
+type ZabbixKey struct {
+	// Name is the flattened metric key, with a suffix such as ".mean" for
+	// the values of samples
+	Name string
+
+	// Labels maps the label names of the series to their values
+	Labels map[string]string
+
+	// Params are the label values formatted as item key parameters,
+	// separated by commas and quoted where needed
+	Params string
+}
+
+// ZabbixSink provides a MetricSink which sends metrics to Zabbix trapper
+// items with the sender protocol, which is JSON over TCP behind a "ZBXD"
+// header. Metrics are aggregated in memory and sent on every flush interval:
+// gauges and key/value pairs send their last value, counters their sum, and
+// samples are sent as .count, .mean, .min and .max keys. The trapper items
+// must exist in Zabbix, values for unknown items are counted as failed by
+// the server and logged.
+type ZabbixSink struct {
+	addr      string
+	host      string
+	key       *template.Template
+	batchSize int
+	dial      Dialer
+
+	agg  *intervalAggregator
+	loop *flushLoop
+}
+
+// zabbixValue is a single value of a sender request
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+// zabbixRequest is the body of a sender request
+type zabbixRequest struct {
+	Request string        `json:"request"`
+	Data    []zabbixValue `json:"data"`
+	Clock   int64         `json:"clock"`
+	NS      int           `json:"ns"`
+}
+
+// zabbixResponse is the body of a sender response
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// NewZabbixSink creates a ZabbixSink and starts its flush loop.
+func NewZabbixSink(opts ZabbixOpts) (*ZabbixSink, error) {
+	if opts.Address == "" {
+		return nil, fmt.Errorf("zabbix address is required")
+	}
+	if opts.Host == "" {
+		return nil, fmt.Errorf("zabbix host is required")
+	}
+	addr := opts.Address
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, zabbixPort)
+	}
+	keyTemplate := opts.KeyTemplate
+	if keyTemplate == "" {
+		keyTemplate = zabbixDefaultKey
+	}
+	key, err := template.New("key").Parse(keyTemplate)
+	if err == nil {
+		// Catch references to unknown fields before the first flush
+		err = key.Execute(io.Discard, ZabbixKey{Name: "a", Labels: map[string]string{}})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad zabbix key template: %w", err)
+	}
+	interval := opts.FlushInterval
+	if interval <= 0 {
+		interval = zabbixFlushInterval
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = zabbixBatchSize
+	}
+
+	s := &ZabbixSink{
+		addr:      addr,
+		host:      opts.Host,
+		key:       key,
+		batchSize: batchSize,
+		dial:      net.Dial,
+		agg:       newIntervalAggregator(),
+	}
+	s.loop = startFlushLoop(interval, s.flushLoop)
+	return s, nil
+}
+
+func (s *ZabbixSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *ZabbixSink) SetGaugeWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateGauge, key, float64(val), labels)
+}
+
+func (s *ZabbixSink) SetPrecisionGauge(key []string, val float64) {
+	s.SetPrecisionGaugeWithLabels(key, val, nil)
+}
+
+func (s *ZabbixSink) SetPrecisionGaugeWithLabels(key []string, val float64, labels []Label) {
+	s.agg.record(aggregateGauge, key, val, labels)
+}
+
+func (s *ZabbixSink) EmitKey(key []string, val float32) {
+	s.agg.record(aggregateKV, key, float64(val), nil)
+}
+
+func (s *ZabbixSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *ZabbixSink) IncrCounterWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateCounter, key, float64(val), labels)
+}
+
+func (s *ZabbixSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *ZabbixSink) AddSampleWithLabels(key []string, val float32, labels []Label) {
+	s.agg.record(aggregateSample, key, float64(val), labels)
+}
+
+// Capabilities reports what the Zabbix sink supports.
+func (s *ZabbixSink) Capabilities() Capabilities {
+	return Capabilities{PrecisionFloats: true, Timestamps: true, Tags: true}
+}
+
+// Shutdown stops the flush loop and blocks while the remaining metrics are
+// sent.
+func (s *ZabbixSink) Shutdown() {
+	s.loop.stop()
+}
+
+// SetFlushInterval changes how often metrics are sent, starting from now.
+func (s *ZabbixSink) SetFlushInterval(interval time.Duration) {
+	s.loop.setInterval(interval)
+}
+
+func (s *ZabbixSink) flushLoop(now time.Time, final bool) {
+	if err := s.flush(now); err != nil {
+		log.Printf("[ERR] Error pushing to zabbix! Err: %s", err)
+	}
+}
+
+// flush sends everything aggregated since the last flush, in batches of at
+// most batchSize values.
+func (s *ZabbixSink) flush(now time.Time) error {
+	values, err := s.values(s.agg.drain(), now)
+	if err != nil {
+		return err
+	}
+	for len(values) > 0 {
+		n := min(len(values), s.batchSize)
+		if err := s.send(values[:n], now); err != nil {
+			return err
+		}
+		values = values[n:]
+	}
+	return nil
+}
+
+// values converts aggregates into sender values.
+func (s *ZabbixSink) values(aggs []*aggregate, now time.Time) ([]zabbixValue, error) {
+	var values []zabbixValue
+	add := func(a *aggregate, suffix string, val float64) error {
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return nil
+		}
+		key, err := s.itemKey(a, suffix)
+		if err != nil {
+			return err
+		}
+		values = append(values, zabbixValue{
+			Host:  s.host,
+			Key:   key,
+			Value: strconv.FormatFloat(val, 'f', -1, 64),
+			Clock: now.Unix(),
+			NS:    now.Nanosecond(),
+		})
+		return nil
+	}
+
+	for _, a := range aggs {
+		var err error
+		switch a.kind {
+		case aggregateGauge, aggregateKV:
+			err = add(a, "", a.last)
+		case aggregateCounter:
+			err = add(a, "", a.sum)
+		case aggregateSample:
+			stats := []struct {
+				suffix string
+				val    float64
+			}{{".count", float64(a.count)}, {".mean", a.mean()}, {".min", a.min}, {".max", a.max}}
+			for _, stat := range stats {
+				if err = add(a, stat.suffix, stat.val); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// itemKey executes the key template for an aggregate.
+func (s *ZabbixSink) itemKey(a *aggregate, suffix string) (string, error) {
+	data := ZabbixKey{
+		Name:   strings.Join(a.key, ".") + suffix,
+		Labels: make(map[string]string, len(a.labels)),
+	}
+	params := make([]string, len(a.labels))
+	for i, l := range a.labels {
+		data.Labels[l.Name] = l.Value
+		params[i] = zabbixQuoteParam(l.Value)
+	}
+	data.Params = strings.Join(params, ",")
+
+	var buf strings.Builder
+	if err := s.key.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute zabbix key template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// zabbixQuoteParam quotes an item key parameter containing characters with a
+// meaning in item keys.
+func zabbixQuoteParam(v string) string {
+	if !strings.ContainsAny(v, `,[]" `) {
+		return v
+	}
+	return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+}
+
+// send makes a single sender request over a new connection, as the server
+// closes it after responding.
+func (s *ZabbixSink) send(values []zabbixValue, now time.Time) error {
+	body, err := json.Marshal(zabbixRequest{
+		Request: "sender data",
+		Data:    values,
+		Clock:   now.Unix(),
+		NS:      now.Nanosecond(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.dial("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(zabbixTimeout))
+
+	if _, err := conn.Write(encodeZabbixPacket(body)); err != nil {
+		return err
+	}
+	resp, err := readZabbixPacket(conn)
+	if err != nil {
+		return err
+	}
+
+	var r zabbixResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		return fmt.Errorf("bad zabbix response: %w", err)
+	}
+	if r.Response != "success" {
+		return fmt.Errorf("zabbix rejected the values: %s %s", r.Response, r.Info)
+	}
+	if m := zabbixFailed.FindStringSubmatch(r.Info); m != nil && m[1] != "0" {
+		// The other values were stored, so the remaining batches are sent
+		log.Printf("[WARN] Zabbix failed to process %s values, check that their trapper items exist: %s", m[1], r.Info)
+	}
+	return nil
+}
+
+// encodeZabbixPacket prepends the protocol header to data.
+func encodeZabbixPacket(data []byte) []byte {
+	packet := make([]byte, 0, len(zabbixHeader)+8+len(data))
+	packet = append(packet, zabbixHeader...)
+	packet = binary.LittleEndian.AppendUint32(packet, uint32(len(data)))
+	packet = binary.LittleEndian.AppendUint32(packet, 0)
+	return append(packet, data...)
+}
+
+// readZabbixPacket reads a message and returns its data.
+func readZabbixPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, len(zabbixHeader)+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:4], zabbixHeader[:4]) {
+		return nil, fmt.Errorf("bad zabbix response header %q", header[:4])
+	}
+	n := binary.LittleEndian.Uint32(header[5:9])
+	if n > zabbixMaxResponse {
+		return nil, fmt.Errorf("zabbix response of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MIT
+
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zabbixTrapper is a fake Zabbix server recording the sender requests
+type zabbixTrapper struct {
+	ln       net.Listener
+	requests chan zabbixRequest
+	info     string
+}
+
+func newZabbixTrapper(t *testing.T) *zabbixTrapper {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	z := &zabbixTrapper{ln: ln, requests: make(chan zabbixRequest, 16), info: "processed: 1; failed: 0; total: 1; seconds spent: 0.000055"}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			data, err := readZabbixPacket(conn)
+			if err == nil {
+				var req zabbixRequest
+				_ = json.Unmarshal(data, &req)
+				z.requests <- req
+				resp, _ := json.Marshal(zabbixResponse{Response: "success", Info: z.info})
+				_, _ = conn.Write(encodeZabbixPacket(resp))
+			}
+			_ = conn.Close()
+		}
+	}()
+	return z
+}
+
+func TestZabbixSink(t *testing.T) {
+	z := newZabbixTrapper(t)
+	s, err := NewZabbixSink(ZabbixOpts{Address: z.ln.Addr().String(), Host: "web-1", FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"api", "requests"}, 2, []Label{{"code", "200"}, {"path", "/a,b"}})
+	s.SetGauge([]string{"queue", "depth"}, 7)
+	s.AddSample([]string{"api", "latency"}, 10)
+
+	now := time.Unix(1700000000, 5)
+	if err := s.flush(now); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	req := <-z.requests
+	if req.Request != "sender data" || req.Clock != 1700000000 || req.NS != 5 {
+		t.Fatalf("bad request %+v", req)
+	}
+	var got []string
+	for _, v := range req.Data {
+		if v.Host != "web-1" || v.Clock != 1700000000 || v.NS != 5 {
+			t.Fatalf("bad value %+v", v)
+		}
+		got = append(got, v.Key+"="+v.Value)
+	}
+	want := []string{
+		`api.requests[200,"/a,b"]=2`,
+		"queue.depth=7",
+		"api.latency.count=1",
+		"api.latency.mean=10",
+		"api.latency.min=10",
+		"api.latency.max=10",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("bad values %v", got)
+	}
+}
+
+func TestZabbixSink_KeyTemplateAndBatches(t *testing.T) {
+	z := newZabbixTrapper(t)
+	s, err := NewZabbixSink(ZabbixOpts{
+		Address:       z.ln.Addr().String(),
+		Host:          "web-1",
+		KeyTemplate:   `app[{{.Name}},{{index .Labels "code"}}]`,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+
+	s.IncrCounterWithLabels([]string{"requests"}, 1, []Label{{"code", "500"}})
+	s.SetGauge([]string{"a"}, 1)
+	s.SetGauge([]string{"b"}, 2)
+	if err := s.flush(time.Now()); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	first, second := <-z.requests, <-z.requests
+	if len(first.Data) != 2 || len(second.Data) != 1 {
+		t.Fatalf("bad batches %d %d", len(first.Data), len(second.Data))
+	}
+	if first.Data[0].Key != "app[requests,500]" || first.Data[1].Key != "app[a,]" {
+		t.Fatalf("bad keys %+v", first.Data)
+	}
+}
+
+func TestZabbixPacket(t *testing.T) {
+	packet := encodeZabbixPacket([]byte(`{"a":1}`))
+	if !bytes.Equal(packet[:13], []byte("ZBXD\x01\x07\x00\x00\x00\x00\x00\x00\x00")) {
+		t.Fatalf("bad header %q", packet[:13])
+	}
+	data, err := readZabbixPacket(bytes.NewReader(packet))
+	if err != nil || string(data) != `{"a":1}` {
+		t.Fatalf("bad data %q %v", data, err)
+	}
+	if _, err := readZabbixPacket(strings.NewReader("HTTP/1.1 400 Bad Request\r\n")); err == nil {
+		t.Fatalf("expected a bad header to fail")
+	}
+}
+
+func TestNewZabbixSink_Invalid(t *testing.T) {
+	for _, opts := range []ZabbixOpts{
+		{Host: "web-1"},
+		{Address: "zabbix"},
+		{Address: "zabbix", Host: "web-1", KeyTemplate: "{{.Nope}}"},
+		{Address: "zabbix", Host: "web-1", KeyTemplate: "{{"},
+	} {
+		if _, err := NewZabbixSink(opts); err == nil {
+			t.Fatalf("expected error for %+v", opts)
+		}
+	}
+
+	s, err := NewZabbixSink(ZabbixOpts{Address: "zabbix", Host: "web-1"})
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer s.Shutdown()
+	if s.addr != "zabbix:10051" {
+		t.Fatalf("bad addr %s", s.addr)
+	}
+}